@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sagernet/sing-box/log"
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/agent"
+	"github.com/UTPBox/utp-core/internal/captive"
+	"github.com/UTPBox/utp-core/internal/config"
+)
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Run the UTP-Core service managed by a remote controller",
+	Long: `Run the service like "run" and keep an outbound WebSocket connection to a
+controller, which can push configurations, trigger reloads and receive status
+reports. Suitable for instances behind NAT; no admin port is exposed.`,
+	RunE: runAgent,
+}
+
+var (
+	controllerURL   string
+	controllerToken string
+	nodeID          string
+	reportInterval  time.Duration
+)
+
+func init() {
+	agentCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file (replaced by pushed configurations)")
+	addRemoteFlags(agentCmd, true)
+	addAPIFlags(agentCmd)
+	agentCmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory for persistent state such as ACME certificates (default: $UTP_STATE_DIR or user config dir)")
+	agentCmd.Flags().StringVar(&controllerURL, "controller", "", "Controller WebSocket URL (wss://, or ws:// on loopback)")
+	agentCmd.Flags().StringVar(&controllerToken, "token", os.Getenv("UTP_CONTROLLER_TOKEN"), "Bearer token for the controller (default: $UTP_CONTROLLER_TOKEN)")
+	agentCmd.Flags().StringVar(&nodeID, "node-id", "", "Node ID reported to the controller (default: hostname)")
+	agentCmd.Flags().DurationVar(&reportInterval, "report-interval", agent.DefaultReportInterval, "Time between status reports")
+	agentCmd.MarkFlagRequired("controller")
+	rootCmd.AddCommand(agentCmd)
+}
+
+func runAgent(cmd *cobra.Command, args []string) error {
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+	return runService(cmd, args)
+}
+
+// startAgent connects to the controller. Reloads are forwarded to the
+// service loop through controls until stopped is closed.
+func startAgent(controls chan control, stopped chan struct{}) (*agent.Agent, error) {
+	handler := &agentHandler{controls: controls, stopped: stopped, started: time.Now()}
+	a, err := agent.New(agent.Options{
+		URL:            controllerURL,
+		Token:          controllerToken,
+		NodeID:         nodeID,
+		ReportInterval: reportInterval,
+	}, handler, log.StdLogger())
+	if err != nil {
+		return nil, err
+	}
+	a.Start()
+	return a, nil
+}
+
+// agentHandler applies controller requests to the running service
+type agentHandler struct {
+	controls chan control
+	stopped  chan struct{}
+	started  time.Time
+}
+
+// ApplyConfig validates a pushed configuration, replaces the configuration
+// file and reloads. An invalid configuration never reaches the disk; its
+// placeholders are escaped, so the controller cannot read the environment
+// or files of the host through them.
+func (h *agentHandler) ApplyConfig(content []byte) error {
+	if _, err := parseOptions(newContext(context.Background()), content); err != nil {
+		return err
+	}
+	if info, err := os.Stat(configPath); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a configuration directory and cannot be replaced", configPath)
+	}
+	if config.IsRemote(configPath) {
+		return fmt.Errorf("%s is a remote configuration and cannot be replaced", configPath)
+	}
+	temporary := filepath.Join(filepath.Dir(configPath), "."+filepath.Base(configPath)+".tmp")
+	if err := os.WriteFile(temporary, config.Escape(content), 0o600); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Rename(temporary, configPath); err != nil {
+		os.Remove(temporary)
+		return fmt.Errorf("failed to replace config file: %w", err)
+	}
+	return h.Reload()
+}
+
+func (h *agentHandler) Reload() error {
+	return requestControl(h.controls, h.stopped, actionReload)
+}
+
+func (h *agentHandler) Status() any {
+	status := map[string]any{
+		"version":         version,
+		"commit":          commit,
+		"started":         h.started,
+		"uptime":          time.Since(h.started).Round(time.Second).String(),
+		"captive_portals": captive.All(),
+	}
+	if current := active.Load(); current != nil {
+		status["config_hash"] = current.hash
+	}
+	return status
+}
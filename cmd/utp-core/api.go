@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/api"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/metrics"
+	"github.com/UTPBox/utp-core/internal/tenant"
+)
+
+var (
+	apiListen string
+	apiToken  string
+)
+
+// addAPIFlags adds the flags serving the gRPC management API
+func addAPIFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&apiListen, "api", "", "Serve the gRPC management API on this address, e.g. 127.0.0.1:9092 or unix:/run/utp-core.sock")
+	cmd.Flags().StringVar(&apiToken, "api-token", os.Getenv("UTP_API_TOKEN"), "Bearer token required by the management API (default: $UTP_API_TOKEN)")
+}
+
+// startAPI serves the management API. Lifecycle calls are forwarded to the
+// service loop through controls until stopped is closed.
+func startAPI(controls chan control, stopped chan struct{}) (*api.Server, error) {
+	server, err := api.New(api.Options{Listen: apiListen, Token: apiToken}, &apiHandler{controls: controls, stopped: stopped})
+	if err != nil {
+		return nil, err
+	}
+	server.Start()
+	fmt.Printf("Management API listening on %s\n", server.Addr())
+	return server, nil
+}
+
+// selectableGroup is implemented by groups that can be switched manually,
+// such as the Sing-box selector
+type selectableGroup interface {
+	adapter.OutboundGroup
+	SelectOutbound(tag string) bool
+}
+
+// apiHandler applies management API calls to the running service
+type apiHandler struct {
+	controls chan control
+	stopped  chan struct{}
+}
+
+func (h *apiHandler) Start() error {
+	return requestControl(h.controls, h.stopped, actionStart)
+}
+
+func (h *apiHandler) Stop() error {
+	return requestControl(h.controls, h.stopped, actionStop)
+}
+
+func (h *apiHandler) Reload() error {
+	return requestControl(h.controls, h.stopped, actionReload)
+}
+
+func (h *apiHandler) Status() api.Status {
+	status := api.Status{Version: version}
+	if current := active.Load(); current != nil {
+		status.Running = true
+		status.Uptime = time.Since(current.started)
+		status.ConfigHash = current.hash
+	}
+	return status
+}
+
+func (h *apiHandler) Outbounds() ([]api.Outbound, error) {
+	current, err := running()
+	if err != nil {
+		return nil, err
+	}
+	var outbounds []api.Outbound
+	for _, outbound := range current.box.Outbound().Outbounds() {
+		item := api.Outbound{Tag: outbound.Tag(), Type: outbound.Type()}
+		if group, isGroup := outbound.(adapter.OutboundGroup); isGroup {
+			_, item.Selectable = outbound.(selectableGroup)
+			item.Now = group.Now()
+			item.All = group.All()
+		}
+		if record, loaded := failure.Last(tenant.ContextWith(context.Background(), current.tenant), outbound.Tag()); loaded {
+			item.FailureKind = string(record.Kind)
+			item.FailureMessage = record.Message
+		}
+		outbounds = append(outbounds, item)
+	}
+	return outbounds, nil
+}
+
+func (h *apiHandler) SwitchSelector(tag string, member string) error {
+	current, err := running()
+	if err != nil {
+		return err
+	}
+	outbound, loaded := current.box.Outbound().Outbound(tag)
+	if !loaded {
+		return api.Errorf(api.CodeNotFound, "outbound not found: %s", tag)
+	}
+	group, selectable := outbound.(selectableGroup)
+	if !selectable {
+		return api.Errorf(api.CodeInvalidArgument, "outbound is not a selector: %s", tag)
+	}
+	if !group.SelectOutbound(member) {
+		return api.Errorf(api.CodeInvalidArgument, "not a member of %s: %s", tag, member)
+	}
+	return nil
+}
+
+func (h *apiHandler) Connections() ([]metrics.Connection, error) {
+	current, err := running()
+	if err != nil {
+		return nil, err
+	}
+	return current.metrics.Connections(), nil
+}
+
+func (h *apiHandler) CloseConnection(id string) error {
+	current, err := running()
+	if err != nil {
+		return err
+	}
+	if !current.metrics.CloseConnection(id) {
+		return api.Errorf(api.CodeNotFound, "connection not found: %s", id)
+	}
+	return nil
+}
+
+// running returns the running instance, failing while stopped
+func running() (*runningInstance, error) {
+	current := active.Load()
+	if current == nil {
+		return nil, api.Errorf(api.CodeFailedPrecondition, "not running")
+	}
+	return current, nil
+}
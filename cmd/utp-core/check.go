@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sagernet/sing-box"
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/config"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate the configuration without starting the service",
+	Long: `Parse the configuration with every utp-core extension registered and build
+(but not start) all inbounds, outbounds and services. Exits non-zero on the
+first error, so configurations can be validated in CI and scripts.`,
+	RunE:          checkConfig,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	checkCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file, directory or HTTPS URL")
+	addRemoteFlags(checkCmd, false)
+	rootCmd.AddCommand(checkCmd)
+}
+
+func checkConfig(cmd *cobra.Command, args []string) error {
+	configContent, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Parse errors carry the JSON path (or row and column) of the problem
+	ctx = newContext(ctx)
+	options, err := parseOptions(ctx, configContent)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if err := withPresets(configContent, &options); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	ctx = config.ContextWithOptions(ctx, &options)
+
+	// Constructors validate extension options (servers, keys, rules...)
+	instance, err := box.New(box.Options{
+		Context: ctx,
+		Options: options,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	instance.Close()
+
+	fmt.Printf("%s: configuration OK\n", configPath)
+	return nil
+}
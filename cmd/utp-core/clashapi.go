@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badoption"
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/extensions/clashapi"
+)
+
+var (
+	clashAPIListen string
+	clashAPISecret string
+	clashAPIUI     string
+)
+
+// addClashAPIFlags adds the flags serving the Clash API without editing the
+// configuration
+func addClashAPIFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&clashAPIListen, "clash-api", "", "Serve the Clash API for dashboards such as Yacd or Metacubexd on this address, e.g. 127.0.0.1:9090")
+	cmd.Flags().StringVar(&clashAPISecret, "clash-api-secret", os.Getenv("UTP_CLASH_API_SECRET"), "Secret required by the Clash API (default: $UTP_CLASH_API_SECRET)")
+	cmd.Flags().StringVar(&clashAPIUI, "clash-api-ui", "", "Directory of a dashboard served by the Clash API at /ui/")
+}
+
+// withClashAPI adds the clash-api service requested by --clash-api to options
+func withClashAPI(options *option.Options) error {
+	if clashAPIListen == "" {
+		return nil
+	}
+	host, portText, err := net.SplitHostPort(clashAPIListen)
+	if err != nil {
+		return fmt.Errorf("invalid --clash-api address: %w", err)
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid --clash-api port: %s", portText)
+	}
+	if host == "" {
+		host = "::"
+	}
+	address, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("invalid --clash-api address: %w", err)
+	}
+	listen := badoption.Addr(address)
+	options.Services = append(options.Services, option.Service{
+		Type: "clash-api",
+		Tag:  "clash-api",
+		Options: &clashapi.ClashAPIOptions{
+			ListenOptions: option.ListenOptions{Listen: &listen, ListenPort: uint16(port)},
+			Secret:        clashAPISecret,
+			ExternalUI:    clashAPIUI,
+		},
+	})
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/config"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the configuration as loaded",
+	Long: `Print the configuration with directory fragments merged and remote
+configurations fetched. With --effective, placeholders are substituted and the
+result is printed in canonical form (keys sorted) with its hash on stderr; the
+hash matches the one reported by "version --config" and by the admin and
+management APIs of a node running it. The effective configuration contains the
+secrets placeholders hide.`,
+	RunE:          showConfig,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var showEffective bool
+
+func init() {
+	configShowCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file, directory or HTTPS URL")
+	addRemoteFlags(configShowCmd, false)
+	configShowCmd.Flags().BoolVar(&showEffective, "effective", false, "Substitute placeholders and print the canonical form with its hash")
+	configCmd.AddCommand(configShowCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+func showConfig(cmd *cobra.Command, args []string) error {
+	loader := config.NewLoader(configPath).WithRemote(config.RemoteOptions{
+		Header:    configHeader,
+		PinSHA256: configPins,
+	})
+	if !showEffective {
+		content, err := loader.ReadRaw()
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(content)
+		if !bytes.HasSuffix(content, []byte("\n")) {
+			fmt.Println()
+		}
+		return nil
+	}
+	content, err := loader.Read()
+	if err != nil {
+		return err
+	}
+	canonical, err := config.Canonical(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	hash, err := config.Hash(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, canonical, "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+	os.Stdout.Write(indented.Bytes())
+	fmt.Fprintf(os.Stderr, "sha256: %s\n", hash)
+	return nil
+}
+
+// configHash returns the hash of the effective configuration at
+// versionConfig, for the version command
+func configHash() (string, error) {
+	content, err := config.NewLoader(versionConfig).WithRemote(config.RemoteOptions{
+		Header:    configHeader,
+		PinSHA256: configPins,
+	}).Read()
+	if err != nil {
+		return "", err
+	}
+	return config.Hash(content)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/clock"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the environment for what the extensions need at runtime",
+	Long: `Check the prerequisites extensions rely on: privileges for raw sockets and
+TUN devices, entropy, clock accuracy, IPv6 connectivity, the MTU of the
+default route and the open-file limit. Each problem is printed with the fix
+that avoids it. Run it as the user (and with the capabilities) the service runs
+with. Exits non-zero when a check fails.`,
+	Args:          cobra.NoArgs,
+	RunE:          runDoctor,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var doctorOffline bool
+
+// Thresholds and probe addresses of the doctor checks
+const (
+	doctorTimeout      = 10 * time.Second
+	clockWarnSkew      = 2 * time.Second
+	clockFailSkew      = 30 * time.Second // Shadowsocks 2022 rejects requests beyond it
+	wireGuardOverhead  = 80               // IPv6 and WireGuard headers
+	ipv4ProbeAddress   = "8.8.8.8:53"
+	ipv6ProbeAddress   = "[2001:4860:4860::8888]:53"
+	ipv6ConnectAddress = "[2606:4700:4700::1111]:443"
+)
+
+// doctorStatus is the outcome of a check, printed in front of it
+type doctorStatus string
+
+const (
+	doctorOK   doctorStatus = "ok"
+	doctorWarn doctorStatus = "WARN"
+	doctorFail doctorStatus = "FAIL"
+	doctorSkip doctorStatus = "skip"
+)
+
+type doctorResult struct {
+	status doctorStatus
+	detail string
+	fix    string
+}
+
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context) doctorResult
+}
+
+func init() {
+	doctorCmd.Flags().BoolVar(&doctorOffline, "offline", false, "Skip the checks contacting servers on the Internet (clock, IPv6 connectivity)")
+	rootCmd.AddCommand(doctorCmd)
+}
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+
+	checks := append(platformChecks(),
+		doctorCheck{"clock", checkClock},
+		doctorCheck{"ipv6", checkIPv6},
+		doctorCheck{"route mtu", checkMTU},
+	)
+	var failed int
+	for _, check := range checks {
+		result := check.run(ctx)
+		fmt.Printf("%-4s  %-12s %s\n", result.status, check.name, result.detail)
+		if result.fix != "" {
+			fmt.Printf("      %-12s fix: %s\n", "", result.fix)
+		}
+		if result.status == doctorFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkClock measures the system clock against the HTTPS time sources of
+// the time-sync service. Skewed clocks fail TLS certificate checks and the
+// replay protection of VMess and Shadowsocks 2022.
+func checkClock(ctx context.Context) doctorResult {
+	if doctorOffline {
+		return doctorResult{status: doctorSkip, detail: "not measured (--offline)"}
+	}
+	dialer := &net.Dialer{}
+	offset, _, err := clock.Measure(ctx, dialer.DialContext, clock.DefaultSources)
+	if err != nil {
+		return doctorResult{
+			status: doctorWarn,
+			detail: "could not measure: " + strings.ReplaceAll(err.Error(), "\n", "; "),
+			fix:    "if the time sources are blocked, add a time-sync service with a detour through a working outbound",
+		}
+	}
+	skew := offset.Abs().Round(time.Millisecond)
+	detail := fmt.Sprintf("system clock %s off", skew)
+	fix := "enable NTP (timedatectl set-ntp true), or add a time-sync service when NTP is blocked"
+	switch {
+	case skew >= clockFailSkew:
+		return doctorResult{status: doctorFail, detail: detail + ": TLS, VMess and Shadowsocks 2022 handshakes will fail", fix: fix}
+	case skew >= clockWarnSkew:
+		return doctorResult{status: doctorWarn, detail: detail, fix: fix}
+	}
+	return doctorResult{status: doctorOK, detail: detail}
+}
+
+// checkIPv6 looks for an IPv6 route and, online, connects over it. Without
+// IPv6, AAAA answers make outbounds try addresses they cannot reach.
+func checkIPv6(ctx context.Context) doctorResult {
+	fix := `set "strategy": "ipv4_only" in the dns options (or on the outbounds' domain_resolver)`
+	// Connecting a UDP socket picks a route without sending anything
+	conn, err := net.Dial("udp6", ipv6ProbeAddress)
+	if err != nil {
+		return doctorResult{status: doctorWarn, detail: "no IPv6 route", fix: fix}
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	if doctorOffline {
+		return doctorResult{status: doctorOK, detail: fmt.Sprintf("route from %s (connectivity not tested, --offline)", local)}
+	}
+	dialer := &net.Dialer{}
+	tcpConn, err := dialer.DialContext(ctx, "tcp6", ipv6ConnectAddress)
+	if err != nil {
+		return doctorResult{status: doctorWarn, detail: fmt.Sprintf("route from %s, but no connectivity: %v", local, err), fix: fix}
+	}
+	tcpConn.Close()
+	return doctorResult{status: doctorOK, detail: fmt.Sprintf("connected from %s", local)}
+}
+
+// checkMTU reports the MTU of the interface of the IPv4 default route, which
+// bounds the mtu of WireGuard endpoints and TUN inbounds tunneling over it
+func checkMTU(ctx context.Context) doctorResult {
+	conn, err := net.Dial("udp4", ipv4ProbeAddress)
+	if err != nil {
+		return doctorResult{status: doctorFail, detail: "no IPv4 default route", fix: "connect the host to a network, or check the routing table (ip route)"}
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return doctorResult{status: doctorWarn, detail: fmt.Sprintf("list interfaces: %v", err)}
+	}
+	for _, iface := range interfaces {
+		addresses, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, address := range addresses {
+			prefix, ok := address.(*net.IPNet)
+			if !ok || !prefix.IP.Equal(local) {
+				continue
+			}
+			detail := fmt.Sprintf("%d on %s", iface.MTU, iface.Name)
+			if iface.MTU < 1500 {
+				return doctorResult{
+					status: doctorWarn,
+					detail: detail + ", below 1500",
+					fix:    fmt.Sprintf(`set "mtu": %d (or lower) on WireGuard endpoints and TUN inbounds, or enable MSS clamping on the router`, iface.MTU-wireGuardOverhead),
+				}
+			}
+			return doctorResult{status: doctorOK, detail: detail}
+		}
+	}
+	return doctorResult{status: doctorWarn, detail: fmt.Sprintf("no interface holds %s", local)}
+}
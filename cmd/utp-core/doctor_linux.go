@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Capability bits of CapEff in /proc/self/status
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+const (
+	minOpenFiles = 16384
+	minEntropy   = 256 // Bits; kernels from 5.18 always report 256
+)
+
+const capabilityFix = "run as root, or grant the capabilities: setcap cap_net_raw,cap_net_admin+ep $(which utp-core), or AmbientCapabilities=CAP_NET_RAW CAP_NET_ADMIN in the systemd unit"
+
+func platformChecks() []doctorCheck {
+	return []doctorCheck{
+		{"raw sockets", checkRawSockets},
+		{"tun", checkTUN},
+		{"entropy", checkEntropy},
+		{"open files", checkOpenFiles},
+	}
+}
+
+// effectiveCapabilities returns the CapEff mask of this process
+func effectiveCapabilities() (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if found {
+			return strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		}
+	}
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
+
+// checkRawSockets opens a raw socket as udp2raw does for its faketcp and
+// icmp modes
+func checkRawSockets(ctx context.Context) doctorResult {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return doctorResult{
+			status: doctorWarn,
+			detail: fmt.Sprintf("cannot open raw sockets (%v): udp2raw outbounds will fail", err),
+			fix:    capabilityFix,
+		}
+	}
+	syscall.Close(fd)
+	return doctorResult{status: doctorOK, detail: "raw sockets available (CAP_NET_RAW)"}
+}
+
+// checkTUN looks for the TUN device and the CAP_NET_ADMIN needed to create
+// interfaces, set routing marks and add the udp2raw auto_rule
+func checkTUN(ctx context.Context) doctorResult {
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		return doctorResult{
+			status: doctorWarn,
+			detail: "no /dev/net/tun: tun inbounds will fail",
+			fix:    "load the tun module (modprobe tun); in containers, pass --device /dev/net/tun",
+		}
+	}
+	capabilities, err := effectiveCapabilities()
+	if err != nil {
+		return doctorResult{status: doctorWarn, detail: fmt.Sprintf("read capabilities: %v", err)}
+	}
+	if capabilities&(1<<capNetAdmin) == 0 {
+		return doctorResult{
+			status: doctorWarn,
+			detail: "no CAP_NET_ADMIN: tun inbounds, routing_mark and udp2raw auto_rule will fail",
+			fix:    capabilityFix,
+		}
+	}
+	return doctorResult{status: doctorOK, detail: "/dev/net/tun and CAP_NET_ADMIN available"}
+}
+
+// checkEntropy reads the entropy estimate of the kernel pool, which keys
+// and TLS handshakes draw from
+func checkEntropy(ctx context.Context) doctorResult {
+	content, err := os.ReadFile("/proc/sys/kernel/random/entropy_avail")
+	if err != nil {
+		return doctorResult{status: doctorWarn, detail: fmt.Sprintf("read entropy: %v", err)}
+	}
+	entropy, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return doctorResult{status: doctorWarn, detail: fmt.Sprintf("read entropy: %v", err)}
+	}
+	detail := fmt.Sprintf("%d bits available", entropy)
+	if entropy < minEntropy {
+		return doctorResult{
+			status: doctorWarn,
+			detail: detail + ": key generation may block",
+			fix:    "install an entropy daemon (haveged or rng-tools), or give virtual machines a virtio-rng device",
+		}
+	}
+	return doctorResult{status: doctorOK, detail: detail}
+}
+
+// checkOpenFiles reports the open-file limit, which bounds the connections
+// the service can hold. Go raises the soft limit to the hard one at start,
+// so this is what the service gets.
+func checkOpenFiles(ctx context.Context) doctorResult {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return doctorResult{status: doctorWarn, detail: fmt.Sprintf("read limit: %v", err)}
+	}
+	detail := fmt.Sprintf("limit %d", limit.Cur)
+	if limit.Cur < minOpenFiles {
+		return doctorResult{
+			status: doctorWarn,
+			detail: detail + ": busy instances will fail with \"too many open files\"",
+			fix:    fmt.Sprintf("raise it to at least %d: LimitNOFILE=1048576 in the systemd unit, or ulimit -Hn in the shell starting the service", minOpenFiles),
+		}
+	}
+	return doctorResult{status: doctorOK, detail: detail}
+}
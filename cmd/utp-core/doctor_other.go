@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"runtime"
+)
+
+func platformChecks() []doctorCheck {
+	return []doctorCheck{{"privileges", checkPrivileges}}
+}
+
+// checkPrivileges only explains what needs privileges here: raw sockets and
+// capabilities are checked on Linux
+func checkPrivileges(ctx context.Context) doctorResult {
+	if runtime.GOOS == "windows" {
+		return doctorResult{
+			status: doctorSkip,
+			detail: "not checked on windows: udp2raw is Linux-only, tun inbounds need an elevated prompt",
+		}
+	}
+	return doctorResult{
+		status: doctorSkip,
+		detail: "not checked on " + runtime.GOOS + ": udp2raw is Linux-only, tun inbounds need root",
+	}
+}
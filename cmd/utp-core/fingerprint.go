@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/fingerprint"
+)
+
+var fingerprintCmd = &cobra.Command{
+	Use:   "fingerprint",
+	Short: "Show what the first flight of an outbound reveals",
+	Long: `Capture the bytes an outbound sends to its server before the server answers
+(TLS ClientHello, SSH banner, HTTP request...) and report traits known to
+identify the client, such as the JA3 of Go crypto/tls or the default Go
+User-Agent, with the settings that avoid them. The outbound is redirected to a
+local capture server; nothing is sent to the real server.`,
+	Args:          cobra.NoArgs,
+	RunE:          fingerprintOutbound,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var (
+	fingerprintTag         string
+	fingerprintDestination string
+	fingerprintTimeout     time.Duration
+)
+
+// fingerprintIdle ends a capture once the outbound has sent something and
+// then waits for the server
+const fingerprintIdle = 300 * time.Millisecond
+
+func init() {
+	fingerprintCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file, directory or HTTPS URL")
+	fingerprintCmd.Flags().StringVar(&fingerprintTag, "outbound", "", "Tag of the outbound to inspect")
+	fingerprintCmd.Flags().StringVar(&fingerprintDestination, "destination", "example.com:443", "Destination dialed through the outbound")
+	fingerprintCmd.Flags().DurationVar(&fingerprintTimeout, "timeout", 5*time.Second, "How long to wait for the outbound to send")
+	fingerprintCmd.Flags().BoolVarP(&replayVerbose, "verbose", "v", false, "Print the instance log to stderr")
+	fingerprintCmd.MarkFlagRequired("outbound")
+	addRemoteFlags(fingerprintCmd, false)
+	rootCmd.AddCommand(fingerprintCmd)
+}
+
+func fingerprintOutbound(cmd *cobra.Command, args []string) error {
+	configContent, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = newContext(ctx)
+	options, err := parseOptions(ctx, configContent)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	var outbound *option.Outbound
+	for index := range options.Outbounds {
+		if options.Outbounds[index].Tag == fingerprintTag {
+			outbound = &options.Outbounds[index]
+		}
+	}
+	if outbound == nil {
+		return fmt.Errorf("outbound %q not found in %s", fingerprintTag, configPath)
+	}
+	switch outbound.Type {
+	case C.TypeDirect, C.TypeBlock, C.TypeDNS, C.TypeSelector, C.TypeURLTest, "load-balance":
+		return fmt.Errorf("outbound %q (%s) has no server of its own to fingerprint", fingerprintTag, outbound.Type)
+	}
+	content, err := json.MarshalContext(ctx, outbound)
+	if err != nil {
+		return err
+	}
+
+	data, err := captureFirstFlight(content)
+	if err != nil {
+		return err
+	}
+	report := fingerprint.Analyze(data)
+	fmt.Printf("outbound %s (%s): %d bytes of %s\n", fingerprintTag, outbound.Type, len(data), report.Protocol)
+	for _, detail := range report.Details {
+		fmt.Printf("  %-18s %s\n", detail[0]+":", detail[1])
+	}
+	fmt.Print(hex.Dump(data[:min(len(data), 64)]))
+	if len(report.Concerns) == 0 {
+		fmt.Println("no known concerns")
+		return nil
+	}
+	fmt.Println("concerns:")
+	for _, concern := range report.Concerns {
+		fmt.Printf("  - %s\n    %s\n", concern.Issue, concern.Advice)
+	}
+	return nil
+}
+
+// captureFirstFlight dials through the outbound in raw, redirected to a
+// local server, and returns what it sends before waiting for an answer
+func captureFirstFlight(raw []byte) ([]byte, error) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	port := server.Addr().(*net.TCPAddr).Port
+
+	outbound, err := redirect(raw, map[string]any{}, []string{"port", "server_port"}, port)
+	if err != nil {
+		return nil, err
+	}
+	address, _ := outbound["server"].(string)
+	if address == "" {
+		return nil, fmt.Errorf("outbound %q has no server option to redirect", fingerprintTag)
+	}
+	outbound["server"] = "127.0.0.1"
+	delete(outbound, "detour")
+	// Names derived from the server address must not become the local one
+	if tlsOptions, ok := outbound["tls"].(map[string]any); ok && tlsOptions["server_name"] == nil {
+		if _, err := netip.ParseAddr(address); err != nil {
+			tlsOptions["server_name"] = address
+		}
+	}
+	instance, cancel, err := startReplayInstance(map[string]any{"outbounds": []any{outbound}})
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer instance.Close()
+	dialer, _ := instance.Outbound().Outbound(replayTag)
+
+	ctx, cancelDial := context.WithTimeout(context.Background(), fingerprintTimeout)
+	defer cancelDial()
+	dialResult := make(chan error, 1)
+	go func() {
+		conn, err := dialer.DialContext(ctx, N.NetworkTCP, M.ParseSocksaddr(fingerprintDestination))
+		if err == nil {
+			// Some protocols send their header with the first payload
+			fmt.Fprintf(conn, "HEAD / HTTP/1.1\r\nHost: %s\r\n\r\n", fingerprintDestination)
+			<-ctx.Done()
+			conn.Close()
+		}
+		dialResult <- err
+	}()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+		defer conn.Close()
+	case err := <-dialResult:
+		return nil, fmt.Errorf("outbound did not connect to the capture server: %v", err)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("outbound did not connect to the capture server within %s", fingerprintTimeout)
+	}
+
+	var data []byte
+	buffer := make([]byte, 16*1024)
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	for len(data) < 64*1024 {
+		n, err := conn.Read(buffer)
+		data = append(data, buffer[:n]...)
+		if err != nil {
+			if len(data) > 0 {
+				break
+			}
+			return nil, fmt.Errorf("outbound sent nothing before hearing from the server: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(fingerprintIdle))
+	}
+	return data, nil
+}
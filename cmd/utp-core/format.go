@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/sagernet/sing/common/json"
+	"github.com/sagernet/sing/common/json/badjson"
+	"github.com/spf13/cobra"
+
+	psiphon "github.com/UTPBox/utp-core/extensions/psiphon"
+	"github.com/UTPBox/utp-core/internal/config"
+	"github.com/UTPBox/utp-core/internal/logsink"
+	"github.com/UTPBox/utp-core/internal/preset"
+)
+
+var formatCmd = &cobra.Command{
+	Use:   "format",
+	Short: "Normalize and pretty-print the configuration",
+	Long: `Round-trip the configuration through the contextual parser (including
+utp-core extension types) and print it as normalized, indented JSON. With
+--migrate, deprecated extension fields are rewritten into their current form.`,
+	RunE:          formatConfig,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var (
+	formatWrite   bool
+	formatMigrate bool
+)
+
+func init() {
+	formatCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file, directory or HTTPS URL")
+	addRemoteFlags(formatCmd, false)
+	formatCmd.Flags().BoolVarP(&formatWrite, "write", "w", false, "Write the result back to the configuration file instead of stdout")
+	formatCmd.Flags().BoolVar(&formatMigrate, "migrate", false, "Rewrite deprecated extension fields")
+	rootCmd.AddCommand(formatCmd)
+}
+
+func formatConfig(cmd *cobra.Command, args []string) error {
+	if info, err := os.Stat(configPath); err == nil && info.IsDir() && formatWrite {
+		return fmt.Errorf("%s is a directory; --write only supports single files", configPath)
+	}
+	if config.IsRemote(configPath) && formatWrite {
+		return fmt.Errorf("%s is a remote configuration; --write only supports local files", configPath)
+	}
+	loader := config.NewLoader(configPath).WithRemote(config.RemoteOptions{
+		Header:    configHeader,
+		PinSHA256: configPins,
+	})
+	configContent, err := loader.Read()
+	if err != nil {
+		return err
+	}
+	if formatWrite {
+		// Writing back would replace placeholders with the secrets they hide,
+		// and outbounds with their expanded templates
+		rawContent, err := loader.ReadRaw()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(rawContent, configContent) {
+			return fmt.Errorf("%s uses ${...} placeholders or outbound templates; --write would store their values", configPath)
+		}
+	}
+
+	ctx := newContext(context.Background())
+	options, err := parseOptions(ctx, configContent)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+
+	if formatMigrate {
+		for _, outbound := range options.Outbounds {
+			if psiphonOptions, ok := outbound.Options.(*psiphon.PsiphonOptions); ok && psiphonOptions.Migrate() {
+				fmt.Fprintf(os.Stderr, "outbound %s: migrated use_tls to tls\n", outbound.Tag)
+			}
+		}
+	}
+
+	// Drop empty values so the output only contains what was configured
+	normalized, err := badjson.Omitempty(ctx, options)
+	if err != nil {
+		return fmt.Errorf("failed to normalize config: %w", err)
+	}
+	buffer := new(bytes.Buffer)
+	encoder := json.NewEncoderContext(ctx, buffer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(normalized); err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	// log.format and log.levels are not Sing-box fields
+	logOptions, _, _ := logsink.Extract(configContent)
+	formatted, err := logsink.Restore(buffer.Bytes(), logOptions)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	// Nor are the route shorthands, which format keeps unexpanded
+	presets, _, _ := preset.Extract(configContent)
+	formatted, err = preset.Restore(formatted, presets)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	buffer = bytes.NewBuffer(formatted)
+
+	if !formatWrite {
+		_, err = os.Stdout.Write(buffer.Bytes())
+		return err
+	}
+	if bytes.Equal(configContent, buffer.Bytes()) {
+		return nil
+	}
+	if err := os.WriteFile(configPath, buffer.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, configPath)
+	return nil
+}
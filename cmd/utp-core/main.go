@@ -2,19 +2,55 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/sagernet/sing-box"
+	"github.com/sagernet/sing-box/adapter/inbound"
 	"github.com/sagernet/sing-box/adapter/outbound"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/common/urltest"
+	"github.com/sagernet/sing-box/dns"
 	"github.com/sagernet/sing-box/include"
 	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json"
+	"github.com/sagernet/sing/common/ntp"
+	"github.com/sagernet/sing/service"
 	"github.com/spf13/cobra"
 
+	"github.com/UTPBox/utp-core/extensions/admin"
+	"github.com/UTPBox/utp-core/extensions/chaos"
+	"github.com/UTPBox/utp-core/extensions/circuitbreaker"
+	"github.com/UTPBox/utp-core/extensions/clashapi"
+	"github.com/UTPBox/utp-core/extensions/dnscrypt"
+	"github.com/UTPBox/utp-core/extensions/dnsserver"
+	"github.com/UTPBox/utp-core/extensions/egresscheck"
+	"github.com/UTPBox/utp-core/extensions/firstflight"
+	"github.com/UTPBox/utp-core/extensions/group"
+	"github.com/UTPBox/utp-core/extensions/healthcheck"
+	"github.com/UTPBox/utp-core/extensions/httpinject"
+	"github.com/UTPBox/utp-core/extensions/localproxy"
+	"github.com/UTPBox/utp-core/extensions/naive"
+	"github.com/UTPBox/utp-core/extensions/obfs"
 	psiphon "github.com/UTPBox/utp-core/extensions/psiphon"
+	"github.com/UTPBox/utp-core/extensions/qos"
+	"github.com/UTPBox/utp-core/extensions/snirelay"
+	"github.com/UTPBox/utp-core/extensions/ssh"
+	"github.com/UTPBox/utp-core/extensions/statebackup"
+	"github.com/UTPBox/utp-core/extensions/subscription"
+	"github.com/UTPBox/utp-core/extensions/telemetry"
+	"github.com/UTPBox/utp-core/extensions/timesync"
+	"github.com/UTPBox/utp-core/extensions/udp2raw"
+	"github.com/UTPBox/utp-core/extensions/warp"
+	"github.com/UTPBox/utp-core/internal/api"
+	"github.com/UTPBox/utp-core/internal/clock"
+	"github.com/UTPBox/utp-core/internal/logsink"
+	"github.com/UTPBox/utp-core/internal/preset"
+	"github.com/UTPBox/utp-core/internal/state"
 )
 
 var (
@@ -37,16 +73,38 @@ var runCmd = &cobra.Command{
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print version information",
-	Run: func(cmd *cobra.Command, args []string) {
+	Long: `Print version information. With --config, also print the hash of the
+effective configuration, as reported by a node running it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
 		fmt.Printf("UTP-Core %s (commit: %s)\n", version, commit)
+		if versionConfig == "" {
+			return nil
+		}
+		hash, err := configHash()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Config: %s (sha256: %s)\n", versionConfig, hash)
+		return nil
 	},
+	SilenceUsage: true,
 }
 
-var configPath string
+var (
+	configPath    string
+	stateDir      string
+	versionConfig string
+)
 
 func init() {
-	runCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file")
+	runCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file, directory or HTTPS URL")
+	addRemoteFlags(runCmd, true)
+	addClashAPIFlags(runCmd)
+	addAPIFlags(runCmd)
+	addTenantFlags(runCmd)
+	runCmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory for persistent state such as ACME certificates (default: $UTP_STATE_DIR or user config dir)")
 	rootCmd.AddCommand(runCmd)
+	versionCmd.Flags().StringVarP(&versionConfig, "config", "c", "", "Configuration file, directory or HTTPS URL to print the hash of")
 	rootCmd.AddCommand(versionCmd)
 }
 
@@ -58,15 +116,108 @@ func main() {
 }
 
 func runService(cmd *cobra.Command, args []string) error {
+	if stateDir != "" {
+		state.SetDir(stateDir)
+	}
+
 	// 1. Load configuration file
-	configContent, err := os.ReadFile(configPath)
+	configContent, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
+		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	current, err := startInstance(configContent)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("UTP-Core started successfully")
+	// Instances replaced by a reload stop with the service
+	defer closeDraining()
+	active.Store(current)
+
+	// Tenants are owned by this goroutine like the main instance
+	tenants, err := startTenants()
+	if err != nil {
+		current.Close()
+		return err
+	}
+	defer closeTenants(tenants)
+
+	// Requests from the controller and the management API are served on
+	// this goroutine, which owns the running instance
+	controls := make(chan control)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	if controllerURL != "" {
+		controller, err := startAgent(controls, stopped)
+		if err != nil {
+			current.Close()
+			return err
+		}
+		defer controller.Close()
+	}
+	var apiServer *api.Server
+	if apiListen != "" {
+		apiServer, err = startAPI(controls, stopped)
+		if err != nil {
+			current.Close()
+			return err
+		}
+		defer apiServer.Close()
+	}
+
+	// Wait for interrupt; SIGHUP reloads the configuration, as does a
+	// changed remote configuration
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	refresh := refreshTicks()
+	for {
+		request := control{action: actionReload}
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				if current != nil {
+					current.Close()
+				}
+				return nil
+			}
+		case request = <-controls:
+		case <-refresh:
+			if current == nil || !remoteChanged(current) {
+				continue
+			}
+		}
+		current, err = applyControl(current, request.action)
+		if request.action == actionReload {
+			reloadTenants(tenants)
+		}
+		active.Store(current)
+		if request.result != nil {
+			request.result <- err
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to %s: %v\n", request.action, err)
+			// Without the management API, nothing could start it again
+			if current == nil && apiServer == nil {
+				return err
+			}
+			continue
+		}
+		switch request.action {
+		case actionStart:
+			fmt.Println("UTP-Core started")
+		case actionStop:
+			fmt.Println("UTP-Core stopped")
+		default:
+			fmt.Println("UTP-Core configuration reloaded")
+		}
+	}
+}
 
+// newContext returns ctx carrying the Sing-box registries with the utp-core
+// extensions registered
+func newContext(ctx context.Context) context.Context {
 	// 2. Initialize Registries using include package
 	inboundRegistry := include.InboundRegistry()
 	outboundRegistry := include.OutboundRegistry()
@@ -74,11 +225,56 @@ func runService(cmd *cobra.Command, args []string) error {
 	dnsTransportRegistry := include.DNSTransportRegistry()
 	serviceRegistry := include.ServiceRegistry()
 
-	// 3. Register Custom Psiphon Outbound
+	// 3. Register Custom Outbounds
 	outbound.Register[psiphon.PsiphonOptions](outboundRegistry, "psiphon", psiphon.NewOutbound)
+	outbound.Register[chaos.ChaosOptions](outboundRegistry, "chaos", chaos.NewOutbound)
+	outbound.Register[group.LoadBalanceOptions](outboundRegistry, "load-balance", group.NewOutbound)
+	outbound.Register[group.FallbackOptions](outboundRegistry, "fallback", group.NewFallback)
+	outbound.Register[group.ManualOptions](outboundRegistry, "manual", group.NewManual)
+	outbound.Register[obfs.Obfs4Options](outboundRegistry, "obfs4", obfs.NewOutbound)
+	outbound.Register[obfs.MeekOptions](outboundRegistry, "meek", obfs.NewMeekOutbound)
+	outbound.Register[obfs.CloakOptions](outboundRegistry, "cloak", obfs.NewCloakOutbound)
+	outbound.Register[naive.NaiveOptions](outboundRegistry, "naive", naive.NewOutbound)
+	outbound.Register[httpinject.HTTPInjectOptions](outboundRegistry, "http-inject", httpinject.NewOutbound)
+	outbound.Register[httpinject.WSInjectOptions](outboundRegistry, "ws-inject", httpinject.NewWSOutbound)
+	outbound.Register[udp2raw.UDP2RawOptions](outboundRegistry, "udp2raw", udp2raw.NewOutbound)
+	outbound.Register[ssh.SSHOptions](outboundRegistry, "ssh-direct", ssh.NewOutbound)
+	outbound.Register[ssh.SSHTLSOptions](outboundRegistry, "ssh-tls", ssh.NewTLSOutbound)
+	outbound.Register[ssh.SSHDNSTTOptions](outboundRegistry, "ssh-dnstt", ssh.NewDNSTTOutbound)
+	outbound.Register[warp.NoiseOptions](outboundRegistry, "warp-noise", warp.NewNoiseOutbound)
+
+	// 3a. Register Custom Inbounds
+	inbound.Register[snirelay.SNIRelayOptions](inboundRegistry, "sni-relay", snirelay.NewInbound)
+	inbound.Register[chaos.ChaosInboundOptions](inboundRegistry, "chaos", chaos.NewInbound)
+	inbound.Register[localproxy.LocalProxyOptions](inboundRegistry, "local-proxy", localproxy.NewInbound)
+	inbound.Register[dnsserver.DNSServerOptions](inboundRegistry, "dns-server", dnsserver.NewInbound)
+
+	// 3b. Register Custom Services
+	boxService.Register[admin.AdminOptions](serviceRegistry, "admin", admin.NewService)
+	boxService.Register[subscription.SubscriptionOptions](serviceRegistry, "subscription", subscription.NewService)
+	boxService.Register[clashapi.ClashAPIOptions](serviceRegistry, "clash-api", clashapi.NewService)
+	boxService.Register[timesync.TimeSyncOptions](serviceRegistry, "time-sync", timesync.NewService)
+	boxService.Register[telemetry.TelemetryOptions](serviceRegistry, "telemetry", telemetry.NewService)
+	boxService.Register[statebackup.StateBackupOptions](serviceRegistry, "state-backup", statebackup.NewService)
+	boxService.Register[firstflight.FirstFlightOptions](serviceRegistry, "first-flight", firstflight.NewService)
+	boxService.Register[circuitbreaker.CircuitBreakerOptions](serviceRegistry, "circuit-breaker", circuitbreaker.NewService)
+	boxService.Register[qos.QoSOptions](serviceRegistry, "qos", qos.NewService)
+	boxService.Register[healthcheck.HealthCheckOptions](serviceRegistry, "health-check", healthcheck.NewService)
+	boxService.Register[egresscheck.EgressCheckOptions](serviceRegistry, "egress-check", egresscheck.NewService)
+
+	// 3c. Register Custom DNS Servers
+	dns.RegisterTransport[dnscrypt.DNSCryptOptions](dnsTransportRegistry, "dnscrypt", dnscrypt.NewTransport)
+
+	// URL test results are shared by urltest groups and the Clash API
+	ctx = service.ContextWithPtr(ctx, urltest.NewHistoryStorage())
+	// Handshakes use the clock corrected by time-sync, unless the Sing-box
+	// ntp service is enabled and replaces it
+	ctx = service.ContextWith[ntp.TimeService](ctx, clock.TimeService{})
+	// log.output may name a syslog, journald or remote syslog sink
+	ctx = logsink.ContextWithSinks(ctx)
 
 	// 4. Inject Registries into Context
-	ctx = box.Context(
+	return box.Context(
 		ctx,
 		inboundRegistry,
 		outboundRegistry,
@@ -86,42 +282,42 @@ func runService(cmd *cobra.Command, args []string) error {
 		dnsTransportRegistry,
 		serviceRegistry,
 	)
+}
 
-	// 5. Parse configuration contextually (Required for custom protocols)
+// parseOptions parses content with the registries of ctx (required for
+// custom protocols). The utp-core log and route fields are removed first;
+// see logsink.Extract and preset.Extract.
+func parseOptions(ctx context.Context, content []byte) (option.Options, error) {
+	// 5. Parse configuration contextually
 	var options option.Options
-	err = options.UnmarshalJSONContext(ctx, configContent)
+	_, content, err := logsink.Extract(content)
 	if err != nil {
-		return fmt.Errorf("failed to parse config: %w", err)
+		return options, fmt.Errorf("failed to parse config: %w", err)
 	}
-
-	// 6. Set up default logging if missing (optional)
-	if options.Log == nil {
-		options.Log = &option.LogOptions{
-			Level:  "info",
-			Output: filepath.Join(os.TempDir(), "utp-core.log"),
+	_, content, err = preset.Extract(content)
+	if err != nil {
+		return options, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := options.UnmarshalJSONContext(ctx, content); err != nil {
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) && syntaxError.Offset <= int64(len(content)) {
+			prefix := string(content[:syntaxError.Offset])
+			row := strings.Count(prefix, "\n") + 1
+			column := len(prefix) - strings.LastIndex(prefix, "\n") - 1
+			return options, fmt.Errorf("failed to parse config: row %d, column %d: %w", row, column, err)
 		}
+		return options, fmt.Errorf("failed to parse config: %w", err)
 	}
+	return options, nil
+}
 
-	// 7. Create and Start Sing-box instance
-	instance, err := box.New(box.Options{
-		Context: ctx,
-		Options: options,
-	})
+// withPresets adds the rules of the route shorthands of content (such as
+// route.time_bypass) to options parsed from it. Format keeps the shorthands
+// instead.
+func withPresets(content []byte, options *option.Options) error {
+	presets, _, err := preset.Extract(content)
 	if err != nil {
-		return fmt.Errorf("failed to create instance: %w", err)
-	}
-
-	if err := instance.Start(); err != nil {
-		return fmt.Errorf("failed to start instance: %w", err)
+		return err
 	}
-	defer instance.Close()
-
-	fmt.Println("UTP-Core started successfully")
-	
-	// Wait for interrupt
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-
-	return nil
+	return preset.Apply(options, presets)
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/pairing"
+)
+
+var pairCmd = &cobra.Command{
+	Use:   "pair",
+	Short: "Provision a configuration to a new instance with a short code",
+	Long: `Deliver a configuration from a provisioning instance to a new one without
+copying files. The new instance runs "pair join", both sides display the same
+short code, and the operator approves the request on the provisioning side
+("pair serve") only if the codes match. The configuration is end-to-end
+encrypted with a key derived from the pairing exchange.`,
+}
+
+var pairServeCmd = &cobra.Command{
+	Use:           "serve",
+	Short:         "Accept pairing requests and deliver a configuration",
+	RunE:          pairServe,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var pairJoinCmd = &cobra.Command{
+	Use:           "join",
+	Short:         "Request a configuration from a pairing server",
+	RunE:          pairJoin,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var (
+	pairListen  string
+	pairDeliver string
+	pairServer  string
+	pairForce   bool
+)
+
+func init() {
+	pairServeCmd.Flags().StringVar(&pairListen, "listen", "0.0.0.0:8787", "Address to accept pairing requests on")
+	pairServeCmd.Flags().StringVar(&pairDeliver, "deliver", "", "Configuration file delivered to approved instances")
+	pairServeCmd.MarkFlagRequired("deliver")
+	pairJoinCmd.Flags().StringVar(&pairServer, "server", "", "Pairing server address (host:port or URL)")
+	pairJoinCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Where to write the received configuration")
+	pairJoinCmd.Flags().BoolVar(&pairForce, "force", false, "Overwrite an existing configuration file")
+	pairJoinCmd.MarkFlagRequired("server")
+	pairCmd.AddCommand(pairServeCmd, pairJoinCmd)
+	rootCmd.AddCommand(pairCmd)
+}
+
+func pairServe(cmd *cobra.Command, args []string) error {
+	// Refuse to start with a configuration the joiner could not parse
+	content, err := os.ReadFile(pairDeliver)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if _, err := parseOptions(newContext(context.Background()), content); err != nil {
+		return fmt.Errorf("%s: %w", pairDeliver, err)
+	}
+
+	// Prompts are answered one at a time on the terminal
+	var promptAccess sync.Mutex
+	stdin := bufio.NewReader(os.Stdin)
+	approve := func(request pairing.Request) bool {
+		promptAccess.Lock()
+		defer promptAccess.Unlock()
+		fmt.Printf("Pairing request from %s with code %s. Approve only if the new instance shows the same code. [y/N] ", request.Remote, request.Code)
+		answer, _ := stdin.ReadString('\n')
+		approved := strings.EqualFold(strings.TrimSpace(answer), "y")
+		if approved {
+			fmt.Println("Approved, delivering configuration")
+		} else {
+			fmt.Println("Rejected")
+		}
+		return approved
+	}
+	server := &http.Server{
+		Addr: pairListen,
+		Handler: pairing.NewServer(func() ([]byte, error) {
+			return os.ReadFile(pairDeliver)
+		}, approve),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		server.Close()
+	}()
+	fmt.Printf("Waiting for pairing requests on %s\n", pairListen)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func pairJoin(cmd *cobra.Command, args []string) error {
+	if _, err := os.Stat(configPath); err == nil && !pairForce {
+		return fmt.Errorf("%s already exists, use --force to overwrite", configPath)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	ctx, cancelTimeout := context.WithTimeout(ctx, pairing.RequestTTL)
+	defer cancelTimeout()
+
+	content, err := pairing.Join(ctx, pairServer, func(code string) {
+		fmt.Printf("Pairing code: %s\nConfirm this code on the pairing server.\n", code)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := parseOptions(newContext(context.Background()), content); err != nil {
+		return fmt.Errorf("received configuration is invalid: %w", err)
+	}
+	if err := os.WriteFile(configPath, content, 0o600); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	fmt.Printf("Configuration written to %s\n", configPath)
+	return nil
+}
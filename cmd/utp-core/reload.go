@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing-box"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+
+	"github.com/UTPBox/utp-core/internal/api"
+	"github.com/UTPBox/utp-core/internal/config"
+	"github.com/UTPBox/utp-core/internal/logsink"
+	"github.com/UTPBox/utp-core/internal/metrics"
+	"github.com/UTPBox/utp-core/internal/session"
+	"github.com/UTPBox/utp-core/internal/tenant"
+)
+
+// runningInstance is a started Sing-box instance and the configuration it
+// was built from
+type runningInstance struct {
+	box     *box.Box
+	cancel  context.CancelFunc
+	content []byte
+	hash    string         // Of the effective configuration, see config.Hash
+	metrics *metrics.Store // Open connections, for the management API
+	started time.Time
+	tenant  string // Tenant served, "" for the main instance
+	shared  bool   // Listens with shared sockets, see exclusiveResource
+}
+
+// Bounds of draining an instance replaced by a reload
+const (
+	drainTimeout  = 5 * time.Minute
+	drainInterval = time.Second
+)
+
+// errExclusive is returned when an instance has to start alongside another
+// but uses a resource only one instance can hold
+var errExclusive = errors.New("configuration cannot run alongside another instance")
+
+// draining holds the instances replaced by a reload that still serve their
+// open connections
+var draining struct {
+	access    sync.Mutex
+	instances map[*runningInstance]struct{}
+}
+
+// active is the running instance, or nil while stopped. The service loop
+// owns the instance; management requests only read it.
+var active atomic.Pointer[runningInstance]
+
+// Actions of control requests
+const (
+	actionStart  = "start"
+	actionStop   = "stop"
+	actionReload = "reload"
+)
+
+// control asks the service loop to change the running instance
+type control struct {
+	action string
+	result chan error // Receives the outcome, may be nil
+}
+
+// requestControl sends action to the service loop and waits for the outcome
+func requestControl(controls chan control, stopped chan struct{}, action string) error {
+	result := make(chan error, 1)
+	select {
+	case controls <- control{action: action, result: result}:
+		return <-result
+	case <-stopped:
+		return fmt.Errorf("service is stopping")
+	}
+}
+
+// applyControl performs action on current and returns the instance running
+// afterwards, or nil
+func applyControl(current *runningInstance, action string) (*runningInstance, error) {
+	switch action {
+	case actionStop:
+		if current == nil {
+			return nil, api.Errorf(api.CodeFailedPrecondition, "not running")
+		}
+		closeDraining()
+		return nil, current.Close()
+	case actionStart:
+		if current != nil {
+			return current, api.Errorf(api.CodeFailedPrecondition, "already running")
+		}
+	}
+	if current != nil {
+		return reloadInstance(current)
+	}
+	content, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return startInstance(content)
+}
+
+// startInstance builds and starts the main instance from configuration
+// content
+func startInstance(content []byte) (*runningInstance, error) {
+	return startInstanceFor("", content)
+}
+
+// startInstanceFor builds and starts an instance of the tenant name from
+// configuration content. Extensions are registered in fresh registries for
+// every instance.
+func startInstanceFor(name string, content []byte) (*runningInstance, error) {
+	return launchInstance(name, content, false)
+}
+
+// launchInstance builds and starts an instance as startInstanceFor does.
+// With alongside, it fails with errExclusive before building anything if the
+// configuration cannot run next to the instance it replaces.
+func launchInstance(name string, content []byte, alongside bool) (*runningInstance, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = tenant.ContextWith(ctx, name)
+
+	// 2-5. Register extensions and parse configuration contextually
+	ctx = newContext(ctx)
+	options, err := parseOptions(ctx, content)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := withPresets(content, &options); err != nil {
+		cancel()
+		return nil, err
+	}
+	// --clash-api serves the main instance; tenants configure their own
+	if name == "" {
+		if err := withClashAPI(&options); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	// Listening sockets are shared whenever the configuration allows, so a
+	// reload can start the next instance before this one stops listening
+	reason := exclusiveResource(&options)
+	if alongside && reason != "" {
+		cancel()
+		return nil, fmt.Errorf("%w: %s", errExclusive, reason)
+	}
+	if reason == "" {
+		shareListeners(&options)
+	}
+	ctx = config.ContextWithOptions(ctx, &options)
+	hash, err := config.Hash(content)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	ctx = config.ContextWithHash(ctx, hash)
+
+	// 6. Set up default logging if missing (optional)
+	if options.Log == nil {
+		options.Log = &option.LogOptions{
+			Level:  "info",
+			Output: filepath.Join(os.TempDir(), "utp-core.log"),
+		}
+	}
+	// log.format and log.levels are applied by the log pipe
+	logOptions, _, err := logsink.Extract(content)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	ctx = logsink.ContextWithOptions(ctx, logOptions, options.Log)
+
+	// 7. Create and Start Sing-box instance
+	instance, err := box.New(box.Options{
+		Context: ctx,
+		Options: options,
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to create instance: %w", err)
+	}
+	store := metrics.NewStore()
+	instance.Router().AppendTracker(store)
+	if err := instance.Start(); err != nil {
+		instance.Close()
+		cancel()
+		return nil, fmt.Errorf("failed to start instance: %w", err)
+	}
+	store.Start()
+	return &runningInstance{box: instance, cancel: cancel, content: content, hash: hash, metrics: store, started: time.Now(), tenant: name, shared: reason == ""}, nil
+}
+
+func (r *runningInstance) Close() error {
+	err := r.box.Close()
+	r.metrics.Close()
+	r.cancel()
+	return err
+}
+
+// reloadInstance replaces current with an instance built from the
+// configuration file. The new configuration is parsed before anything is
+// torn down, so a broken file leaves the running instance untouched.
+//
+// When both configurations can run side by side, the new instance starts
+// while current still runs and takes over its listening sockets; current
+// then stops accepting and drains its open connections. Otherwise current
+// closes first, dropping its connections, and if the new instance fails to
+// start the previous configuration is restored. Either way outbounds hand
+// their underlying sessions over, so identical outbounds do not reconnect.
+func reloadInstance(current *runningInstance) (*runningInstance, error) {
+	content, err := loadConfig()
+	if err != nil {
+		return current, err
+	}
+	return replaceInstance(current, content)
+}
+
+// replaceInstance replaces current with an instance of the same tenant
+// built from content, as described for reloadInstance
+func replaceInstance(current *runningInstance, content []byte) (*runningInstance, error) {
+	ctx := tenant.ContextWith(context.Background(), current.tenant)
+	if _, err := parseOptions(newContext(ctx), content); err != nil {
+		return current, err
+	}
+
+	session.BeginReload()
+	defer session.EndReload()
+	if current.shared {
+		current.offerSessions()
+		next, err := launchInstance(current.tenant, content, true)
+		if err == nil {
+			current.drain()
+			return next, nil
+		}
+		if !errors.Is(err, errExclusive) {
+			fmt.Fprintf(os.Stderr, "Failed to start alongside the running instance, restarting: %v\n", err)
+		}
+	}
+	current.Close()
+
+	next, err := startInstanceFor(current.tenant, content)
+	if err == nil {
+		return next, nil
+	}
+	previous, restoreErr := startInstanceFor(current.tenant, current.content)
+	if restoreErr != nil {
+		return nil, fmt.Errorf("%w; restoring previous configuration: %v", err, restoreErr)
+	}
+	return previous, err
+}
+
+// offerSessions offers the sessions of the outbounds of r to the instance
+// starting alongside it
+func (r *runningInstance) offerSessions() {
+	for _, outbound := range r.box.Outbound().Outbounds() {
+		if migrator, ok := outbound.(session.Migrator); ok {
+			migrator.OfferSessions()
+		}
+	}
+}
+
+// drain stops r from accepting connections, which then reach the instance
+// sharing its sockets, and closes r in the background once its open
+// connections have finished or drainTimeout has passed
+func (r *runningInstance) drain() {
+	r.box.Inbound().Close()
+	draining.access.Lock()
+	if draining.instances == nil {
+		draining.instances = make(map[*runningInstance]struct{})
+	}
+	draining.instances[r] = struct{}{}
+	draining.access.Unlock()
+	go func() {
+		deadline := time.Now().Add(drainTimeout)
+		for len(r.metrics.Connections()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(drainInterval)
+		}
+		draining.access.Lock()
+		_, pending := draining.instances[r]
+		delete(draining.instances, r)
+		draining.access.Unlock()
+		if pending {
+			r.Close()
+		}
+	}()
+}
+
+// closeDraining closes the instances still draining at once
+func closeDraining() {
+	draining.access.Lock()
+	instances := draining.instances
+	draining.instances = nil
+	draining.access.Unlock()
+	for r := range instances {
+		r.Close()
+	}
+}
+
+// exclusiveResource names a resource of options that only one instance can
+// hold at a time, or returns "" if an instance built from options can run
+// alongside another. Inbounds and services must listen through the listen
+// options, whose sockets can be shared; TUN devices, system proxy settings,
+// fixed WireGuard ports, the cache file and the APIs Sing-box listens for
+// itself cannot.
+func exclusiveResource(options *option.Options) string {
+	if runtime.GOOS == "windows" {
+		// SO_REUSEADDR would let other processes take over the ports
+		return "shared listening sockets on Windows"
+	}
+	for _, inbound := range options.Inbounds {
+		listen := listenOptions(inbound.Options)
+		if listen == nil {
+			return inbound.Type + " inbound"
+		}
+		if field := reflect.ValueOf(inbound.Options).Elem().FieldByName("SetSystemProxy"); field.IsValid() && field.Bool() {
+			return "set_system_proxy"
+		}
+	}
+	for _, service := range options.Services {
+		if service.Type == C.TypeResolved || listenOptions(service.Options) == nil {
+			return service.Type + " service"
+		}
+	}
+	for _, endpoint := range options.Endpoints {
+		if endpoint.Type == C.TypeTailscale {
+			return "tailscale endpoint"
+		}
+		if wireguard, ok := endpoint.Options.(*option.WireGuardEndpointOptions); ok && wireguard.ListenPort != 0 {
+			return "wireguard endpoint listen_port"
+		}
+	}
+	if experimental := options.Experimental; experimental != nil {
+		switch {
+		case experimental.CacheFile != nil && experimental.CacheFile.Enabled:
+			return "cache_file"
+		case experimental.ClashAPI != nil:
+			return "clash_api"
+		case experimental.V2RayAPI != nil:
+			return "v2ray_api"
+		}
+	}
+	return ""
+}
+
+// shareListeners sets reuse_addr on the listen options of every inbound and
+// service, letting the instance replacing this one listen on the same ports
+func shareListeners(options *option.Options) {
+	for _, inbound := range options.Inbounds {
+		listenOptions(inbound.Options).ReuseAddr = true
+	}
+	for _, service := range options.Services {
+		listenOptions(service.Options).ReuseAddr = true
+	}
+}
+
+// listenOptions returns the listen options embedded in the options of an
+// inbound or service, or nil if there are none
+func listenOptions(options any) *option.ListenOptions {
+	value := reflect.ValueOf(options)
+	if value.Kind() != reflect.Pointer || value.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	value = value.Elem()
+	for i := range value.NumField() {
+		field := value.Type().Field(i)
+		if field.Anonymous && field.Type == reflect.TypeFor[option.ListenOptions]() {
+			return value.Field(i).Addr().Interface().(*option.ListenOptions)
+		}
+	}
+	return nil
+}
+
+// remoteChanged re-fetches a remote configuration and reports whether it
+// differs from the one current was built from
+func remoteChanged(current *runningInstance) bool {
+	content, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to refresh configuration: %v\n", err)
+		return false
+	}
+	return !bytes.Equal(content, current.content)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/config"
+)
+
+var (
+	configHeader  string
+	configPins    []string
+	configRefresh time.Duration
+)
+
+// addRemoteFlags adds the flags controlling -c https://... to cmd
+func addRemoteFlags(cmd *cobra.Command, refresh bool) {
+	cmd.Flags().StringVar(&configHeader, "config-header", os.Getenv("UTP_CONFIG_HEADER"), "Header sent when fetching a remote configuration, e.g. \"Authorization: Bearer ...\" (default: $UTP_CONFIG_HEADER)")
+	cmd.Flags().StringSliceVar(&configPins, "config-pin", nil, "SPKI SHA-256 pin of the remote configuration server, replacing certificate verification")
+	if refresh {
+		cmd.Flags().DurationVar(&configRefresh, "config-refresh", time.Hour, "Interval for re-fetching a remote configuration (0 disables)")
+	}
+}
+
+// loadConfig reads the configuration from configPath. A remote
+// configuration that could not be fetched is read from the cache with a
+// warning.
+func loadConfig() ([]byte, error) {
+	loader := config.NewLoader(configPath).WithRemote(config.RemoteOptions{
+		Header:    configHeader,
+		PinSHA256: configPins,
+	})
+	content, err := loader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if err := loader.Stale(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to fetch %s, using cached copy: %v\n", configPath, err)
+	}
+	return content, nil
+}
+
+// refreshTicks returns a channel ticking every --config-refresh for remote
+// configurations, or nil
+func refreshTicks() <-chan time.Time {
+	if !config.IsRemote(configPath) || configRefresh <= 0 {
+		return nil
+	}
+	return time.NewTicker(configRefresh).C
+}
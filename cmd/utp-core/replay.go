@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sagernet/sing-box"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/config"
+	"github.com/UTPBox/utp-core/internal/replay"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <transcript>",
+	Short: "Replay a recorded handshake against an outbound or inbound",
+	Long: `Developer tool validating protocol framing against reference captures. An
+outbound transcript dials the destination through the outbound, which is
+redirected to a local fake server playing the recorded server side; an inbound
+transcript starts the inbound on a local port and plays the recorded client
+side against it. Bytes produced by the implementation are compared with the
+capture and differences are printed as hex dumps.`,
+	Args:          cobra.ExactArgs(1),
+	RunE:          replayTranscript,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var replayVerbose bool
+
+const (
+	replayTag            = "replay"
+	defaultReplayTimeout = 5 * time.Second
+)
+
+func init() {
+	replayCmd.Flags().BoolVarP(&replayVerbose, "verbose", "v", false, "Print the instance log to stderr")
+	rootCmd.AddCommand(replayCmd)
+}
+
+func replayTranscript(cmd *cobra.Command, args []string) error {
+	transcript, err := replay.Load(args[0])
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	timeout := defaultReplayTimeout
+	if transcript.Timeout != "" {
+		timeout, err = time.ParseDuration(transcript.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+	}
+
+	var results []replay.Result
+	if transcript.Outbound != nil {
+		results, err = replayOutbound(transcript, timeout)
+	} else {
+		results, err = replayInbound(transcript, timeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := len(results) < len(transcript.Steps)
+	for _, result := range results {
+		direction := "client -> server"
+		if result.Step.From == replay.FromServer {
+			direction = "server -> client"
+		}
+		status := "ok"
+		if result.Failed() {
+			status = "FAIL"
+			failed = true
+		}
+		fmt.Printf("step %d  %s  %d bytes  %s", result.Index, direction, len(result.Step.Data()), status)
+		if result.Step.Note != "" {
+			fmt.Printf("  (%s)", result.Step.Note)
+		}
+		fmt.Println()
+		if result.Mismatch != nil {
+			fmt.Print(result.Mismatch)
+		}
+		if result.Err != nil {
+			fmt.Printf("  %v\n", result.Err)
+		}
+	}
+	for index := len(results); index < len(transcript.Steps); index++ {
+		fmt.Printf("step %d  not played\n", index+1)
+	}
+	if failed {
+		return fmt.Errorf("replay does not match the transcript")
+	}
+	return nil
+}
+
+// replayOutbound plays the server side while the outbound dials through it
+func replayOutbound(transcript *replay.Transcript, timeout time.Duration) ([]replay.Result, error) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer server.Close()
+	port := server.Addr().(*net.TCPAddr).Port
+
+	outbound, err := redirect(transcript.Outbound, map[string]any{"server": "127.0.0.1"}, []string{"port", "server_port"}, port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outbound: %w", err)
+	}
+	instance, cancel, err := startReplayInstance(map[string]any{"outbounds": []any{outbound}})
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer instance.Close()
+	dialer, _ := instance.Outbound().Outbound(replayTag)
+
+	ctx, cancelDial := context.WithTimeout(context.Background(), timeout*time.Duration(len(transcript.Steps)+1))
+	defer cancelDial()
+	dialResult := make(chan error, 1)
+	go func() {
+		conn, err := dialer.DialContext(ctx, N.NetworkTCP, M.ParseSocksaddr(transcript.Destination))
+		if err == nil {
+			// Keep the client side open until the server side is done
+			<-ctx.Done()
+			conn.Close()
+		}
+		dialResult <- err
+	}()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		return replay.Play(conn, transcript.Steps, replay.FromServer, timeout), nil
+	case err := <-dialResult:
+		return nil, fmt.Errorf("outbound did not connect to the replay server: %v", err)
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("outbound did not connect to the replay server within %s", timeout)
+	}
+}
+
+// replayInbound plays the client side against the inbound
+func replayInbound(transcript *replay.Transcript, timeout time.Duration) ([]replay.Result, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	inbound, err := redirect(transcript.Inbound, map[string]any{"listen": "127.0.0.1"}, []string{"listen_port"}, port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inbound: %w", err)
+	}
+	instance, cancel, err := startReplayInstance(map[string]any{
+		"inbounds":  []any{inbound},
+		"outbounds": []any{map[string]any{"type": "direct", "tag": "direct"}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	defer instance.Close()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the inbound: %w", err)
+	}
+	defer conn.Close()
+	return replay.Play(conn, transcript.Steps, replay.FromClient, timeout), nil
+}
+
+// redirect tags object as the replay object and points it at the local
+// port, replacing the first of portKeys it contains (or the last one)
+func redirect(raw json.RawMessage, values map[string]any, portKeys []string, port int) (map[string]any, error) {
+	var object map[string]any
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	object["tag"] = replayTag
+	for key, value := range values {
+		object[key] = value
+	}
+	portKey := portKeys[len(portKeys)-1]
+	for _, key := range portKeys {
+		if _, exists := object[key]; exists {
+			portKey = key
+			break
+		}
+	}
+	object[portKey] = port
+	return object, nil
+}
+
+// startReplayInstance starts an instance with the given configuration
+// sections and logging disabled unless --verbose is set
+func startReplayInstance(sections map[string]any) (*box.Box, context.CancelFunc, error) {
+	if replayVerbose {
+		sections["log"] = map[string]any{"level": "trace", "output": "stderr"}
+	} else {
+		sections["log"] = map[string]any{"disabled": true}
+	}
+	content, err := json.Marshal(sections)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = newContext(ctx)
+	options, err := parseOptions(ctx, content)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	ctx = config.ContextWithOptions(ctx, &options)
+	instance, err := box.New(box.Options{Context: ctx, Options: options})
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("failed to create instance: %w", err)
+	}
+	if err := instance.Start(); err != nil {
+		instance.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("failed to start instance: %w", err)
+	}
+	return instance, cancel, nil
+}
+
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/extensions/admin"
+	"github.com/UTPBox/utp-core/extensions/group"
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+var selectCmd = &cobra.Command{
+	Use:   "select <group> [member]",
+	Short: "Switch the member or weights of a manual group",
+	Long: `Choose the member a "manual" group sends connections through, or change the
+weights it spreads them by while no member is chosen. The change is sent to
+the running instance through the admin API of the configuration, which saves
+it in the state directory. When no admin service is configured or reachable,
+the state file is written directly and the change applies when utp-core next
+starts or reloads. Without a member or flags, the saved state is printed.`,
+	Args:          cobra.RangeArgs(1, 2),
+	RunE:          selectMember,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var (
+	selectWeights map[string]int
+	selectClear   bool
+)
+
+func init() {
+	selectCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file, directory or HTTPS URL")
+	selectCmd.Flags().StringToIntVar(&selectWeights, "weight", nil, "Weight of a member, as member=weight (repeatable, 0 excludes the member)")
+	selectCmd.Flags().BoolVar(&selectClear, "clear", false, "Clear the chosen member and spread connections by weight again")
+	selectCmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory for persistent state such as ACME certificates (default: $UTP_STATE_DIR or user config dir)")
+	addRemoteFlags(selectCmd, false)
+	rootCmd.AddCommand(selectCmd)
+}
+
+func selectMember(cmd *cobra.Command, args []string) error {
+	if stateDir != "" {
+		state.SetDir(stateDir)
+	}
+	tag := args[0]
+	var selected *string
+	switch {
+	case len(args) == 2 && selectClear:
+		return fmt.Errorf("a member and --clear are mutually exclusive")
+	case len(args) == 2:
+		selected = &args[1]
+	case selectClear:
+		selected = new(string)
+	}
+
+	configContent, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options, err := parseOptions(newContext(ctx), configContent)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	var manual *group.ManualOptions
+	for _, outbound := range options.Outbounds {
+		if opts, isManual := outbound.Options.(*group.ManualOptions); isManual && outbound.Tag == tag {
+			manual = opts
+		}
+	}
+	if manual == nil {
+		return fmt.Errorf("%s: no manual group %s", configPath, tag)
+	}
+	if selected != nil && *selected != "" && !slices.Contains(manual.Outbounds, *selected) {
+		return fmt.Errorf("not a member of %s: %s", tag, *selected)
+	}
+	for member, weight := range selectWeights {
+		if !slices.Contains(manual.Outbounds, member) {
+			return fmt.Errorf("weight of %s, which is not a member of %s", member, tag)
+		}
+		if weight < 0 {
+			return fmt.Errorf("negative weight of %s", member)
+		}
+	}
+
+	path := group.ManualStatePath(ctx, tag)
+	if selected == nil && len(selectWeights) == 0 {
+		return printManualState(path)
+	}
+	for _, item := range options.Services {
+		opts, isAdmin := item.Options.(*admin.AdminOptions)
+		if !isAdmin {
+			continue
+		}
+		err := selectViaAdmin(opts, tag, selected, selectWeights)
+		if err == nil {
+			fmt.Printf("Applied to the running instance through admin service %s\n", item.Tag)
+			return nil
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) {
+			return err
+		}
+		fmt.Printf("Admin service %s not reachable: %v\n", item.Tag, err)
+	}
+
+	saved, err := group.LoadManualState(path)
+	if errors.Is(err, os.ErrNotExist) {
+		saved = group.ManualState{Selected: manual.Default}
+	} else if err != nil {
+		return err
+	}
+	if selected != nil {
+		saved.Selected = *selected
+	}
+	if len(selectWeights) > 0 {
+		if saved.Weights == nil {
+			saved.Weights = make(map[string]int)
+		}
+		maps.Copy(saved.Weights, selectWeights)
+	}
+	if err := saved.Save(path); err != nil {
+		return err
+	}
+	fmt.Printf("Saved to %s; applies when utp-core next starts or reloads\n", path)
+	return nil
+}
+
+// selectViaAdmin sends the change to the admin API described by opts
+func selectViaAdmin(opts *admin.AdminOptions, tag string, selected *string, weights map[string]int) error {
+	host := "127.0.0.1"
+	if listen := opts.Listen.Build(netip.IPv4Unspecified()); !listen.IsUnspecified() {
+		host = listen.String()
+	}
+	body, err := json.Marshal(struct {
+		Selected *string        `json:"selected,omitempty"`
+		Weights  map[string]int `json:"weights,omitempty"`
+	}{selected, weights})
+	if err != nil {
+		return err
+	}
+	endpoint := "http://" + net.JoinHostPort(host, strconv.Itoa(int(opts.ListenPort))) + "/api/outbounds/" + url.PathEscape(tag)
+	request, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if opts.Secret != "" {
+		request.Header.Set("Authorization", "Bearer "+opts.Secret)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	var failed struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(response.Body).Decode(&failed)
+	if failed.Error == "" {
+		failed.Error = response.Status
+	}
+	return fmt.Errorf("admin service: %s", failed.Error)
+}
+
+// printManualState prints the state saved at path
+func printManualState(path string) error {
+	saved, err := group.LoadManualState(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Nothing saved: the group starts with its configured default and weights")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	selected := saved.Selected
+	if selected == "" {
+		selected = "none, spread by weight"
+	}
+	fmt.Printf("Selected: %s\n", selected)
+	for _, member := range slices.Sorted(maps.Keys(saved.Weights)) {
+		fmt.Printf("  %-24s weight %d\n", member, saved.Weights[member])
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+// envBackupPassphrase holds the backup passphrase when --passphrase-file
+// is not given
+const envBackupPassphrase = "UTP_BACKUP_PASSPHRASE"
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Back up and restore the state directory",
+	Long: `The state directory holds WARP identities, SSH host keys, subscriptions,
+counters and caches. Backups are encrypted with a passphrase, read from
+--passphrase-file or $` + envBackupPassphrase + `.`,
+}
+
+var stateBackupCmd = &cobra.Command{
+	Use:           "backup",
+	Short:         "Write an encrypted backup of the state directory",
+	Args:          cobra.NoArgs,
+	RunE:          backupState,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var stateRestoreCmd = &cobra.Command{
+	Use:   "restore <backup file or https URL>",
+	Short: "Restore the state directory from a backup",
+	Long: `Decrypt a backup written by "utp-core state backup" or the state-backup
+service and write its files into the state directory, replacing files of the
+same name. Stop running instances first, as they would overwrite restored
+files with their own state.`,
+	Args:          cobra.ExactArgs(1),
+	RunE:          restoreState,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var (
+	backupOutput         string
+	backupPassphraseFile string
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{stateBackupCmd, stateRestoreCmd} {
+		cmd.Flags().StringVar(&backupPassphraseFile, "passphrase-file", "", "File holding the backup passphrase (default: $"+envBackupPassphrase+")")
+		cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory for persistent state such as ACME certificates (default: $UTP_STATE_DIR or user config dir)")
+	}
+	stateBackupCmd.Flags().StringVarP(&backupOutput, "output", "o", "", "Backup file (default: <state directory>/backups/state-<time>.utpbackup)")
+	stateCmd.AddCommand(stateBackupCmd, stateRestoreCmd)
+	rootCmd.AddCommand(stateCmd)
+}
+
+// backupPassphrase reads the passphrase from --passphrase-file or the
+// environment
+func backupPassphrase() (string, error) {
+	if backupPassphraseFile != "" {
+		content, err := os.ReadFile(backupPassphraseFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	if passphrase := os.Getenv(envBackupPassphrase); passphrase != "" {
+		return passphrase, nil
+	}
+	return "", fmt.Errorf("no passphrase: use --passphrase-file or set $%s", envBackupPassphrase)
+}
+
+func backupState(cmd *cobra.Command, args []string) error {
+	if stateDir != "" {
+		state.SetDir(stateDir)
+	}
+	passphrase, err := backupPassphrase()
+	if err != nil {
+		return err
+	}
+	content, err := state.Backup(state.Dir(), passphrase)
+	if err != nil {
+		return err
+	}
+	output := backupOutput
+	if output == "" {
+		directory, err := state.Ensure(state.BackupsDir)
+		if err != nil {
+			return err
+		}
+		output = filepath.Join(directory, state.BackupName(time.Now()))
+	}
+	if err := os.WriteFile(output, content, 0o600); err != nil {
+		return err
+	}
+	fmt.Printf("State of %s backed up to %s\n", state.Dir(), output)
+	return nil
+}
+
+func restoreState(cmd *cobra.Command, args []string) error {
+	if stateDir != "" {
+		state.SetDir(stateDir)
+	}
+	passphrase, err := backupPassphrase()
+	if err != nil {
+		return err
+	}
+	content, err := readBackup(args[0])
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(state.Dir(), 0o700); err != nil {
+		return err
+	}
+	restored, err := state.Restore(state.Dir(), content, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d files into %s\n", restored, state.Dir())
+	return nil
+}
+
+// readBackup reads a backup from a file or an HTTPS URL
+func readBackup(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", source, response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/extensions/telemetry"
+)
+
+var telemetryCmd = &cobra.Command{
+	Use:   "telemetry",
+	Short: "Inspect the opt-in usage telemetry",
+}
+
+var telemetryPreviewCmd = &cobra.Command{
+	Use:   "preview",
+	Short: "Show the counts gathered locally and what a report would send",
+	Long: `Print the protocol counts gathered since the last report, which never leave
+this device, followed by a sample of the noised report built from them with
+the privacy budget of the configured telemetry service. Each run draws new
+noise, like every real report does.`,
+	RunE:          previewTelemetry,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+func init() {
+	telemetryPreviewCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Path to configuration file, directory or HTTPS URL")
+	addRemoteFlags(telemetryPreviewCmd, false)
+	telemetryCmd.AddCommand(telemetryPreviewCmd)
+	rootCmd.AddCommand(telemetryCmd)
+}
+
+func previewTelemetry(cmd *cobra.Command, args []string) error {
+	epsilon := telemetry.DefaultEpsilon
+	configured := false
+	if configContent, err := loadConfig(); err == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		options, err := parseOptions(newContext(ctx), configContent)
+		if err != nil {
+			return fmt.Errorf("%s: %w", configPath, err)
+		}
+		for _, item := range options.Services {
+			if opts, isTelemetry := item.Options.(*telemetry.TelemetryOptions); isTelemetry {
+				configured = true
+				if opts.Epsilon > 0 {
+					epsilon = opts.Epsilon
+				}
+			}
+		}
+	}
+	if !configured {
+		fmt.Println("Telemetry is not enabled: no telemetry service is configured.")
+	}
+
+	pending, err := telemetry.LoadPending(context.Background())
+	if err != nil {
+		return fmt.Errorf("%s: %w", telemetry.PendingPath(context.Background()), err)
+	}
+	fmt.Printf("Local counts since %s (never sent):\n", pending.Since.Format(time.DateTime))
+	if len(pending.Networks) == 0 {
+		fmt.Println("  none")
+	}
+	for _, network := range slices.Sorted(maps.Keys(pending.Networks)) {
+		fmt.Printf("  %s\n", network)
+		protocols := pending.Networks[network]
+		for _, protocol := range slices.Sorted(maps.Keys(protocols)) {
+			counts := protocols[protocol]
+			fmt.Printf("    %-16s %d/%d succeeded\n", protocol, counts.Successes, counts.Attempts)
+		}
+	}
+
+	report := pending.Report(epsilon)
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nSample report (epsilon %g):\n%s\n", epsilon, content)
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/internal/config"
+	"github.com/UTPBox/utp-core/internal/tenant"
+)
+
+var tenantsDir string
+
+// addTenantFlags adds the flag serving tenant namespaces next to the main
+// instance
+func addTenantFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&tenantsDir, "tenants", "", "Directory of tenant configurations, <name>.json files or <name>/ fragment directories, each run as a separate namespace")
+}
+
+// tenantPaths maps the tenant names found in --tenants to their
+// configuration path
+func tenantPaths() (map[string]string, error) {
+	entries, err := os.ReadDir(tenantsDir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			if !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			name = strings.TrimSuffix(name, ".json")
+		}
+		if err := tenant.ValidateName(name); err != nil {
+			return nil, err
+		}
+		if _, exists := paths[name]; exists {
+			return nil, fmt.Errorf("tenant %s is configured twice", name)
+		}
+		paths[name] = filepath.Join(tenantsDir, entry.Name())
+	}
+	return paths, nil
+}
+
+// startTenants starts an instance for every tenant of --tenants. A tenant
+// failing to start stops the ones already started.
+func startTenants() (map[string]*runningInstance, error) {
+	tenants := make(map[string]*runningInstance)
+	if tenantsDir == "" {
+		return tenants, nil
+	}
+	paths, err := tenantPaths()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range slices.Sorted(maps.Keys(paths)) {
+		content, err := config.NewLoader(paths[name]).WithoutPlaceholders().Read()
+		var instance *runningInstance
+		if err == nil {
+			instance, err = startInstanceFor(name, content)
+		}
+		if err != nil {
+			closeTenants(tenants)
+			return nil, fmt.Errorf("tenant %s: %w", name, err)
+		}
+		tenants[name] = instance
+		fmt.Printf("Tenant %s started\n", name)
+	}
+	return tenants, nil
+}
+
+// reloadTenants brings the running tenants in line with --tenants: new
+// tenants are started, removed ones stopped and changed ones reloaded. A
+// tenant failing to reload keeps running its previous configuration.
+func reloadTenants(tenants map[string]*runningInstance) {
+	if tenantsDir == "" {
+		return
+	}
+	paths, err := tenantPaths()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to reload tenants: %v\n", err)
+		return
+	}
+	for _, name := range slices.Sorted(maps.Keys(tenants)) {
+		if _, exists := paths[name]; !exists {
+			tenants[name].Close()
+			delete(tenants, name)
+			fmt.Printf("Tenant %s stopped\n", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(paths)) {
+		content, err := config.NewLoader(paths[name]).WithoutPlaceholders().Read()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to reload tenant %s: %v\n", name, err)
+			continue
+		}
+		current, running := tenants[name]
+		switch {
+		case !running:
+			next, err := startInstanceFor(name, content)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to start tenant %s: %v\n", name, err)
+				continue
+			}
+			tenants[name] = next
+			fmt.Printf("Tenant %s started\n", name)
+		case !bytes.Equal(content, current.content):
+			next, err := replaceInstance(current, content)
+			if next == nil {
+				delete(tenants, name)
+			} else {
+				tenants[name] = next
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to reload tenant %s: %v\n", name, err)
+				continue
+			}
+			fmt.Printf("Tenant %s reloaded\n", name)
+		}
+	}
+}
+
+// closeTenants stops every tenant instance
+func closeTenants(tenants map[string]*runningInstance) {
+	for name, instance := range tenants {
+		instance.Close()
+		delete(tenants, name)
+	}
+}
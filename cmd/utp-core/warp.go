@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sagernet/sing/common/json/badjson"
+	"github.com/spf13/cobra"
+
+	"github.com/UTPBox/utp-core/extensions/warp"
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+var warpCmd = &cobra.Command{
+	Use:   "warp",
+	Short: "Provision Cloudflare WARP WireGuard endpoints",
+	Long: `Register devices with the Cloudflare WARP API and turn them into Sing-box
+WireGuard endpoints. The device credentials are kept in the state directory
+(warp/<tag>.json) so a WARP+ license can be applied later.`,
+}
+
+var warpRegisterCmd = &cobra.Command{
+	Use:   "register",
+	Short: "Register a new WARP device and print or write its endpoint",
+	Long: `Generate a WireGuard keypair, register it as a new WARP device and print
+the resulting "wireguard" endpoint (peer, reserved bytes and interface
+addresses). With --license, the device is bound to a WARP+ account first. With
+--scan, the default endpoint is probed and replaced by the best endpoint of a
+scan when it does not answer. With --write, the endpoint is added to the
+configuration file, replacing the endpoint of the same tag.`,
+	Args:          cobra.NoArgs,
+	RunE:          warpRegister,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var warpLicenseCmd = &cobra.Command{
+	Use:           "license <key>",
+	Short:         "Apply a WARP+ license key to a registered device",
+	Args:          cobra.ExactArgs(1),
+	RunE:          warpLicense,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var warpScanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Find WARP endpoints answering a registered device",
+	Long: `Send WireGuard handshake initiations of a registered device to the default
+endpoint and to random addresses and ports of the WARP ranges, and rank the
+endpoints that answer by loss, then round-trip time. The best endpoint is kept
+for the device and used in the printed or written endpoint, for networks where
+162.159.192.1:2408 is filtered.`,
+	Args:          cobra.NoArgs,
+	RunE:          warpScan,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var (
+	warpTag        string
+	warpLicenseKey string
+	warpWrite      bool
+	warpScanFirst  bool
+
+	warpScanPrefixes []string
+	warpScanPorts    []uint
+	warpScanOptions  warp.ScanOptions
+	warpScanTop      int
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{warpRegisterCmd, warpLicenseCmd, warpScanCmd} {
+		cmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "Configuration file written by --write")
+		cmd.Flags().StringVar(&warpTag, "tag", "warp", "Tag of the endpoint")
+		cmd.Flags().BoolVarP(&warpWrite, "write", "w", false, "Write the endpoint to the configuration file instead of stdout")
+		cmd.Flags().StringVar(&stateDir, "state-dir", "", "Directory for persistent state such as ACME certificates (default: $UTP_STATE_DIR or user config dir)")
+	}
+	warpRegisterCmd.Flags().StringVar(&warpLicenseKey, "license", "", "WARP+ license key to apply")
+	warpRegisterCmd.Flags().BoolVar(&warpScanFirst, "scan", false, "Scan for an endpoint when the default does not answer")
+	for _, cmd := range []*cobra.Command{warpRegisterCmd, warpScanCmd} {
+		cmd.Flags().StringSliceVar(&warpScanPrefixes, "range", nil, "Address ranges to scan (default: the WARP ranges)")
+		cmd.Flags().UintSliceVar(&warpScanPorts, "port", nil, "UDP ports to scan (default: the WARP ports)")
+		cmd.Flags().IntVar(&warpScanOptions.Samples, "samples", warp.DefaultSamples, "Random endpoints probed besides the default")
+		cmd.Flags().IntVar(&warpScanOptions.Attempts, "attempts", warp.DefaultAttempts, "Handshakes sent to each endpoint")
+		cmd.Flags().DurationVar(&warpScanOptions.Timeout, "timeout", warp.DefaultScanTimeout, "Wait for each handshake response")
+		cmd.Flags().IntVar(&warpScanOptions.Concurrency, "concurrency", warp.DefaultConcurrency, "Endpoints probed at once")
+	}
+	warpScanCmd.Flags().IntVar(&warpScanTop, "top", 10, "Endpoints listed")
+	warpCmd.AddCommand(warpRegisterCmd, warpLicenseCmd, warpScanCmd)
+	rootCmd.AddCommand(warpCmd)
+}
+
+func warpRegister(cmd *cobra.Command, args []string) error {
+	if err := checkWarpWrite(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	client := warp.NewClient("", nil)
+	device, err := client.Register(ctx)
+	if err != nil {
+		return err
+	}
+	// Keep the credentials before anything else can fail, or the device is
+	// lost
+	if err := saveWarpDevice(device); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "registered device %s\n", device.ID)
+	if warpLicenseKey != "" {
+		if err := client.ApplyLicense(ctx, device, warpLicenseKey); err != nil {
+			return err
+		}
+		if err := saveWarpDevice(device); err != nil {
+			return err
+		}
+	}
+	if warpScanFirst {
+		opts, err := scanOptions()
+		if err != nil {
+			return err
+		}
+		result, err := warp.Select(ctx, device, opts)
+		if err != nil {
+			return fmt.Errorf("scan: %w", err)
+		}
+		if err := selectWarpEndpoint(device, result); err != nil {
+			return err
+		}
+	}
+	return outputWarpEndpoint(device)
+}
+
+func warpScan(cmd *cobra.Command, args []string) error {
+	if err := checkWarpWrite(); err != nil {
+		return err
+	}
+	opts, err := scanOptions()
+	if err != nil {
+		return err
+	}
+	device, err := loadWarpDevice()
+	if err != nil {
+		return err
+	}
+	results, err := warp.Scan(context.Background(), device, opts)
+	if err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("scan: no endpoint answered")
+	}
+	for index, result := range results {
+		if index == warpScanTop {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "%-22s rtt %-6s loss %3.0f%%\n", result.Endpoint, result.RTT.Round(time.Millisecond), result.Loss*100)
+	}
+	if err := selectWarpEndpoint(device, results[0]); err != nil {
+		return err
+	}
+	return outputWarpEndpoint(device)
+}
+
+// scanOptions returns the scan flags
+func scanOptions() (warp.ScanOptions, error) {
+	opts := warpScanOptions
+	for _, value := range warpScanPrefixes {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid range: %s", value)
+		}
+		opts.Prefixes = append(opts.Prefixes, prefix)
+	}
+	for _, port := range warpScanPorts {
+		if port == 0 || port > 65535 {
+			return opts, fmt.Errorf("invalid port: %d", port)
+		}
+		opts.Ports = append(opts.Ports, uint16(port))
+	}
+	return opts, nil
+}
+
+// selectWarpEndpoint keeps result as the endpoint of device
+func selectWarpEndpoint(device *warp.Device, result warp.ScanResult) error {
+	fmt.Fprintf(os.Stderr, "selected %s (rtt %s)\n", result.Endpoint, result.RTT.Round(time.Millisecond))
+	device.PeerEndpoint = result.Endpoint.String()
+	return saveWarpDevice(device)
+}
+
+func warpLicense(cmd *cobra.Command, args []string) error {
+	if err := checkWarpWrite(); err != nil {
+		return err
+	}
+	device, err := loadWarpDevice()
+	if err != nil {
+		return err
+	}
+	if err := warp.NewClient("", nil).ApplyLicense(context.Background(), device, args[0]); err != nil {
+		return err
+	}
+	if err := saveWarpDevice(device); err != nil {
+		return err
+	}
+	return outputWarpEndpoint(device)
+}
+
+// checkWarpWrite rejects --write on a configuration it cannot rewrite,
+// before a device is registered
+func checkWarpWrite() error {
+	if !warpWrite {
+		return nil
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory; --write only supports single files", configPath)
+	}
+	return nil
+}
+
+// warpDevicePath returns where the device of the endpoint tag is kept
+func warpDevicePath() string {
+	if stateDir != "" {
+		state.SetDir(stateDir)
+	}
+	return state.Path("warp", warpTag+".json")
+}
+
+func saveWarpDevice(device *warp.Device) error {
+	content, err := json.MarshalIndent(device, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := warpDevicePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	if err := os.WriteFile(path, append(content, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	return nil
+}
+
+func loadWarpDevice() (*warp.Device, error) {
+	path := warpDevicePath()
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no device registered for tag %s; run \"warp register\" first", warpTag)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read device: %w", err)
+	}
+	var device warp.Device
+	if err := json.Unmarshal(content, &device); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &device, nil
+}
+
+// outputWarpEndpoint prints the endpoint of device, or writes it to the
+// configuration file with --write
+func outputWarpEndpoint(device *warp.Device) error {
+	if device.Account.WarpPlus {
+		fmt.Fprintf(os.Stderr, "account: %s (WARP+)\n", device.Account.AccountType)
+	} else {
+		fmt.Fprintf(os.Stderr, "account: %s\n", device.Account.AccountType)
+	}
+	endpoint, err := device.Endpoint(warpTag)
+	if err != nil {
+		return err
+	}
+	if !warpWrite {
+		compact, err := endpoint.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		var buffer bytes.Buffer
+		if err := json.Indent(&buffer, compact, "", "  "); err != nil {
+			return err
+		}
+		buffer.WriteByte('\n')
+		_, err = os.Stdout.Write(buffer.Bytes())
+		return err
+	}
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	content, err = putEndpoint(content, endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if err := os.WriteFile(configPath, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, configPath)
+	return nil
+}
+
+// putEndpoint adds endpoint to the endpoints of content, replacing the one
+// with the same tag. The rest of the configuration, placeholders included,
+// is kept as written.
+func putEndpoint(content []byte, endpoint *badjson.JSONObject) ([]byte, error) {
+	var object badjson.JSONObject
+	if err := object.UnmarshalJSON(content); err != nil {
+		return nil, err
+	}
+	tag, _ := endpoint.Get("tag")
+	section, _ := object.Get("endpoints")
+	endpoints, isArray := section.(badjson.JSONArray)
+	if section != nil && !isArray {
+		return nil, fmt.Errorf("endpoints is not a list")
+	}
+	replaced := false
+	for i, existing := range endpoints {
+		if existingObject, isObject := existing.(*badjson.JSONObject); isObject {
+			if existingTag, _ := existingObject.Get("tag"); existingTag == tag {
+				endpoints[i] = endpoint
+				replaced = true
+			}
+		}
+	}
+	if !replaced {
+		endpoints = append(endpoints, endpoint)
+	}
+	object.Put("endpoints", endpoints)
+	compact, err := object.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := json.Indent(&buffer, compact, "", "  "); err != nil {
+		return nil, err
+	}
+	buffer.WriteByte('\n')
+	return buffer.Bytes(), nil
+}
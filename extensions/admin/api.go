@@ -0,0 +1,328 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/sing-box/adapter"
+
+	"github.com/UTPBox/utp-core/extensions/chaos"
+	"github.com/UTPBox/utp-core/internal/capability"
+	"github.com/UTPBox/utp-core/internal/captive"
+	"github.com/UTPBox/utp-core/internal/config"
+	"github.com/UTPBox/utp-core/internal/egress"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/health"
+	"github.com/UTPBox/utp-core/internal/logsink"
+	"github.com/UTPBox/utp-core/internal/metrics"
+	"github.com/UTPBox/utp-core/internal/tenant"
+)
+
+// maxLogTail bounds how much of the log file is read for the tail
+const maxLogTail = 256 << 10
+
+// selectableGroup is implemented by groups that can be switched manually,
+// such as the Sing-box selector
+type selectableGroup interface {
+	adapter.OutboundGroup
+	SelectOutbound(tag string) bool
+}
+
+// weightedGroup is implemented by groups spreading connections over their
+// members by adjustable weights, such as the manual group
+type weightedGroup interface {
+	Weights() map[string]int
+	SetWeights(weights map[string]int) error
+}
+
+// faultInjector is implemented by chaos outbounds and inbounds, whose fault
+// profile can be changed at runtime
+type faultInjector interface {
+	Tag() string
+	Profile() chaos.Profile
+	SetProfile(p chaos.Profile) error
+}
+
+type statusResponse struct {
+	Uptime         int64            `json:"uptime"` // Seconds
+	Outbounds      int              `json:"outbounds"`
+	Traffic        metrics.Counters `json:"traffic"`
+	CaptivePortals []captive.Status `json:"captive_portals,omitempty"` // Portals pausing outbound reconnects
+	ConfigHash     string           `json:"config_hash,omitempty"`     // Of the running configuration
+}
+
+type groupResponse struct {
+	Now        string   `json:"now"`
+	All        []string `json:"all"`
+	Selectable bool     `json:"selectable"`
+
+	Weights map[string]int `json:"weights,omitempty"` // Of weighted groups
+}
+
+type chaosResponse struct {
+	Tag     string        `json:"tag"`
+	Kind    string        `json:"kind"` // inbound or outbound
+	Profile chaos.Profile `json:"profile"`
+}
+
+type outboundResponse struct {
+	Tag     string           `json:"tag"`
+	Type    string           `json:"type"`
+	Group   *groupResponse   `json:"group,omitempty"`
+	Traffic metrics.Counters `json:"traffic"`
+	Failure *failure.Record  `json:"failure,omitempty"`
+	Health  *health.Status   `json:"health,omitempty"`
+	Exit    *egress.Exit     `json:"exit,omitempty"` // Seen by the egress-check service
+}
+
+func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, statusResponse{
+		Uptime:         int64(s.metrics.Uptime().Seconds()),
+		Outbounds:      len(s.outbounds.Outbounds()),
+		Traffic:        s.metrics.Total(),
+		CaptivePortals: captive.All(),
+		ConfigHash:     config.HashFromContext(s.ctx),
+	})
+}
+
+func (s *Service) handleOutbounds(w http.ResponseWriter, r *http.Request) {
+	traffic := s.metrics.Outbounds()
+	outbounds := s.outbounds.Outbounds()
+	response := make([]outboundResponse, 0, len(outbounds))
+	for _, outbound := range outbounds {
+		item := outboundResponse{
+			Tag:     outbound.Tag(),
+			Type:    outbound.Type(),
+			Traffic: traffic[outbound.Tag()],
+		}
+		if group, isGroup := outbound.(adapter.OutboundGroup); isGroup {
+			_, selectable := outbound.(selectableGroup)
+			item.Group = &groupResponse{
+				Now:        group.Now(),
+				All:        group.All(),
+				Selectable: selectable,
+			}
+			if weighted, isWeighted := outbound.(weightedGroup); isWeighted {
+				item.Group.Weights = weighted.Weights()
+			}
+		}
+		if record, loaded := failure.Last(s.ctx, outbound.Tag()); loaded {
+			item.Failure = &record
+		}
+		if status, loaded := health.Load(outbound.Tag()); loaded {
+			item.Health = &status
+		}
+		if history, loaded := egress.Load(outbound.Tag()); loaded {
+			if exit, seen := history.Current(); seen {
+				item.Exit = &exit
+			}
+		}
+		response = append(response, item)
+	}
+	writeJSON(w, response)
+}
+
+// handleSelect switches a selector group to another member and changes the
+// weights of a weighted group
+func (s *Service) handleSelect(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Selected *string        `json:"selected"`
+		Weights  map[string]int `json:"weights"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	tag := r.PathValue("tag")
+	outbound, loaded := s.outbounds.Outbound(tag)
+	if !loaded {
+		writeError(w, http.StatusNotFound, fmt.Errorf("outbound not found: %s", tag))
+		return
+	}
+	if request.Selected == nil && len(request.Weights) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: selected or weights required"))
+		return
+	}
+	if len(request.Weights) > 0 {
+		group, weighted := outbound.(weightedGroup)
+		if !weighted {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("outbound has no weights: %s", tag))
+			return
+		}
+		if err := group.SetWeights(request.Weights); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid weights for %s: %w", tag, err))
+			return
+		}
+		s.logger.Info("changed weights of ", tag)
+	}
+	if request.Selected != nil {
+		group, selectable := outbound.(selectableGroup)
+		if !selectable {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("outbound is not a selector: %s", tag))
+			return
+		}
+		if !group.SelectOutbound(*request.Selected) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("not a member of %s: %s", tag, *request.Selected))
+			return
+		}
+		s.logger.Info("selected ", *request.Selected, " for ", tag)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUsers returns the traffic of every user authenticated by an inbound
+func (s *Service) handleUsers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.metrics.Users())
+}
+
+// handleFailures returns the failed dials of every outbound, by stage and
+// reason
+func (s *Service) handleFailures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, metrics.Failures(tenant.FromContext(s.ctx)))
+}
+
+// handleCapabilities returns what each registered outbound type supports,
+// for protocol pickers
+func (s *Service) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, capability.Matrix(s.ctx))
+}
+
+// handleEgress returns the exits seen through every outbound checked by the
+// egress-check service
+func (s *Service) handleEgress(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, egress.All())
+}
+
+// handleChaos returns the fault profile of every chaos outbound and inbound
+func (s *Service) handleChaos(w http.ResponseWriter, r *http.Request) {
+	response := []chaosResponse{}
+	for _, outbound := range s.outbounds.Outbounds() {
+		if injector, isChaos := outbound.(faultInjector); isChaos {
+			response = append(response, chaosResponse{Tag: injector.Tag(), Kind: "outbound", Profile: injector.Profile()})
+		}
+	}
+	for _, inbound := range s.inbounds.Inbounds() {
+		if injector, isChaos := inbound.(faultInjector); isChaos {
+			response = append(response, chaosResponse{Tag: injector.Tag(), Kind: "inbound", Profile: injector.Profile()})
+		}
+	}
+	writeJSON(w, response)
+}
+
+// handleChaosProfile replaces the fault profile of a chaos outbound or
+// inbound. Outbound tags are looked up first.
+func (s *Service) handleChaosProfile(w http.ResponseWriter, r *http.Request) {
+	var profile chaos.Profile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+	tag := r.PathValue("tag")
+	var (
+		injector faultInjector
+		kind     string
+	)
+	if outbound, loaded := s.outbounds.Outbound(tag); loaded {
+		injector, _ = outbound.(faultInjector)
+		kind = "outbound"
+	} else if inbound, loaded := s.inbounds.Get(tag); loaded {
+		injector, _ = inbound.(faultInjector)
+		kind = "inbound"
+	}
+	if injector == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("chaos outbound or inbound not found: %s", tag))
+		return
+	}
+	if err := injector.SetProfile(profile); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid profile for %s: %w", tag, err))
+		return
+	}
+	s.logger.Info("changed chaos profile of ", tag)
+	writeJSON(w, chaosResponse{Tag: tag, Kind: kind, Profile: injector.Profile()})
+}
+
+func (s *Service) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.metrics.History())
+}
+
+// handleLogs returns the last lines of the log file. Logs written to the
+// console or a log sink are not retained and cannot be tailed.
+func (s *Service) handleLogs(w http.ResponseWriter, r *http.Request) {
+	lines := s.opts.LogLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			lines = min(n, s.opts.LogLines)
+		}
+	}
+	path := s.logPath()
+	if path == "" {
+		writeError(w, http.StatusNotFound, errors.New("log is not written to a file"))
+		return
+	}
+	tail, err := tailFile(path, lines)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, tail)
+}
+
+func (s *Service) logPath() string {
+	options := config.OptionsFromContext(s.ctx)
+	if options == nil || options.Log == nil || options.Log.Disabled {
+		return ""
+	}
+	switch options.Log.Output {
+	case "", "stdout", "stderr":
+		return ""
+	}
+	if logsink.IsSink(options.Log.Output) {
+		return ""
+	}
+	return options.Log.Output
+}
+
+// tailFile returns up to n trailing lines of path
+func tailFile(path string, n int) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := max(info.Size()-maxLogTail, 0)
+	content, err := io.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if offset > 0 {
+		// The first line was cut by the offset
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return slices.DeleteFunc(lines, func(line string) bool { return line == "" }), nil
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
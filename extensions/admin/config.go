@@ -0,0 +1,16 @@
+package admin
+
+import (
+	"github.com/sagernet/sing-box/option"
+
+	"github.com/UTPBox/utp-core/internal/metrics"
+)
+
+// AdminOptions defines the configuration for the admin service
+type AdminOptions struct {
+	option.ListenOptions        // listen / listen_port of the admin listener
+	Secret               string `json:"secret,omitempty"`    // Bearer token required by the API
+	LogLines             int    `json:"log_lines,omitempty"` // Lines returned by the log tail (default 200)
+
+	UserQuotas map[string]metrics.Quota `json:"user_quotas,omitempty"` // Limits of users authenticated by inbounds, by name
+}
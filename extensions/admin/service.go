@@ -0,0 +1,141 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/common/listener"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/metrics"
+)
+
+const defaultLogLines = 200
+
+//go:embed web
+var webFiles embed.FS
+
+// Service is the admin listener. It serves the embedded dashboard and the
+// JSON API the dashboard is built on.
+type Service struct {
+	boxService.Adapter
+	ctx       context.Context
+	logger    log.ContextLogger
+	opts      AdminOptions
+	inbounds  adapter.InboundManager
+	outbounds adapter.OutboundManager
+	metrics   *metrics.Store
+	listener  *listener.Listener
+	server    *http.Server
+}
+
+// NewService creates the admin service and starts tracking the traffic of
+// routed connections
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts AdminOptions) (adapter.Service, error) {
+	if opts.LogLines <= 0 {
+		opts.LogLines = defaultLogLines
+	}
+	router := service.FromContext[adapter.Router](ctx)
+	if router == nil {
+		return nil, errors.New("admin: router not available")
+	}
+	s := &Service{
+		Adapter:   boxService.NewAdapter("admin", tag),
+		ctx:       ctx,
+		logger:    logger,
+		opts:      opts,
+		inbounds:  service.FromContext[adapter.InboundManager](ctx),
+		outbounds: service.FromContext[adapter.OutboundManager](ctx),
+		metrics:   metrics.NewStore(),
+	}
+	for name, quota := range opts.UserQuotas {
+		if quota.Traffic < 0 || quota.MaxConnections < 0 {
+			return nil, fmt.Errorf("admin: invalid quota of user %s", name)
+		}
+	}
+	s.metrics.SetQuotas(opts.UserQuotas)
+	router.AppendTracker(s.metrics)
+	s.listener = listener.New(listener.Options{
+		Context: ctx,
+		Logger:  logger,
+		Listen:  opts.ListenOptions,
+	})
+	s.server = &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	s.metrics.Start()
+	tcpListener, err := s.listener.ListenTCP()
+	if err != nil {
+		return err
+	}
+	if s.opts.Secret == "" && !isLoopback(tcpListener.Addr()) {
+		s.logger.Warn("admin listener is reachable from the network without a secret")
+	}
+	go func() {
+		if err := s.server.Serve(tcpListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("admin server: ", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Service) Close() error {
+	s.metrics.Close()
+	return s.server.Close()
+}
+
+func (s *Service) handler() http.Handler {
+	mux := http.NewServeMux()
+	web, _ := fs.Sub(webFiles, "web")
+	mux.Handle("GET /", http.FileServerFS(web))
+	mux.Handle("GET /api/status", s.authorize(s.handleStatus))
+	mux.Handle("GET /api/outbounds", s.authorize(s.handleOutbounds))
+	mux.Handle("PUT /api/outbounds/{tag}", s.authorize(s.handleSelect))
+	mux.Handle("GET /api/traffic", s.authorize(s.handleTraffic))
+	mux.Handle("GET /api/users", s.authorize(s.handleUsers))
+	mux.Handle("GET /api/failures", s.authorize(s.handleFailures))
+	mux.Handle("GET /api/capabilities", s.authorize(s.handleCapabilities))
+	mux.Handle("GET /api/egress", s.authorize(s.handleEgress))
+	mux.Handle("GET /api/chaos", s.authorize(s.handleChaos))
+	mux.Handle("PUT /api/chaos/{tag}", s.authorize(s.handleChaosProfile))
+	mux.Handle("GET /api/logs", s.authorize(s.handleLogs))
+	return mux
+}
+
+// authorize requires the configured secret as a Bearer token
+func (s *Service) authorize(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.opts.Secret != "" {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Secret)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		}
+		handler(w, r)
+	})
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && tcpAddr.IP.IsLoopback()
+}
@@ -0,0 +1,160 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/limiter"
+)
+
+var _ adapter.Outbound = (*Outbound)(nil)
+
+// Outbound forwards traffic through a detour outbound while injecting
+// latency, jitter, loss, resets and throttling. It is intended for local
+// robustness testing of retry and failover logic, not for production use.
+type Outbound struct {
+	tag     string
+	opts    ChaosOptions
+	logger  log.ContextLogger
+	manager adapter.OutboundManager
+	ctrl    *controller
+	control *controlServer
+	limiter *limiter.Limiter
+}
+
+// NewOutbound creates a new chaos outbound
+func NewOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts ChaosOptions) (adapter.Outbound, error) {
+	if opts.Detour == "" {
+		return nil, fmt.Errorf("chaos outbound requires a detour")
+	}
+	ctrl := &controller{}
+	if err := ctrl.Store(opts.profile()); err != nil {
+		return nil, fmt.Errorf("invalid chaos profile: %w", err)
+	}
+	o := &Outbound{
+		tag:     tag,
+		opts:    opts,
+		logger:  logger,
+		manager: service.FromContext[adapter.OutboundManager](ctx),
+		ctrl:    ctrl,
+		limiter: limiter.New(opts.Options),
+	}
+	if opts.Control != "" {
+		control, err := newControlServer(opts.Control, ctrl)
+		if err != nil {
+			return nil, err
+		}
+		o.control = control
+	}
+	return o, nil
+}
+
+func (o *Outbound) Type() string {
+	return "chaos"
+}
+
+func (o *Outbound) Tag() string {
+	return o.tag
+}
+
+func (o *Outbound) Dependencies() []string {
+	return []string{o.opts.Detour}
+}
+
+func (o *Outbound) Network() []string {
+	return []string{"tcp", "udp"}
+}
+
+func (o *Outbound) Start() error {
+	if o.control == nil {
+		return nil
+	}
+	if err := o.control.Start(); err != nil {
+		return fmt.Errorf("failed to start chaos control endpoint: %w", err)
+	}
+	o.logger.Info("chaos control endpoint listening on ", o.opts.Control)
+	return nil
+}
+
+func (o *Outbound) Close() error {
+	if o.control == nil {
+		return nil
+	}
+	return o.control.Close()
+}
+
+// Profile returns the currently active fault profile
+func (o *Outbound) Profile() Profile {
+	return o.ctrl.Load()
+}
+
+// SetProfile replaces the active fault profile for new and existing connections
+func (o *Outbound) SetProfile(p Profile) error {
+	return o.ctrl.Store(p)
+}
+
+func (o *Outbound) detour() (adapter.Outbound, error) {
+	if o.manager == nil {
+		return nil, fmt.Errorf("outbound manager not available")
+	}
+	detour, loaded := o.manager.Outbound(o.opts.Detour)
+	if !loaded {
+		return nil, fmt.Errorf("detour outbound not found: %s", o.opts.Detour)
+	}
+	return detour, nil
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	detour, err := o.detour()
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. Apply dial latency and simulated loss
+	p := o.ctrl.Load()
+	if err := sleepContext(ctx, p.delay()); err != nil {
+		release()
+		return nil, err
+	}
+	if chance(p.Loss) {
+		release()
+		return nil, failure.New(failure.KindHandshakeTimeout, failure.StageConnect, fmt.Errorf("chaos: simulated loss dialing %s", destination))
+	}
+
+	// 2. Dial through the detour and wrap the stream
+	c, err := detour.DialContext(ctx, network, destination)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return limiter.WrapConn(&conn{Conn: c, ctrl: o.ctrl}, release), nil
+}
+
+func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	detour, err := o.detour()
+	if err != nil {
+		return nil, err
+	}
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := detour.ListenPacket(ctx, destination)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return limiter.WrapPacketConn(&packetConn{PacketConn: pc, ctrl: o.ctrl}, release), nil
+}
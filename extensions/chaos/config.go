@@ -0,0 +1,46 @@
+package chaos
+
+import (
+	"time"
+
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/limiter"
+)
+
+// FaultOptions describe the conditions injected by the chaos outbound and
+// inbound
+type FaultOptions struct {
+	Latency   badoption.Duration `json:"latency,omitempty"`   // Fixed delay added to every dial or accepted connection
+	Jitter    badoption.Duration `json:"jitter,omitempty"`    // Random extra delay in [0, jitter)
+	Loss      float64            `json:"loss,omitempty"`      // Probability (0-1) of dropping a connection or datagram
+	Reset     float64            `json:"reset,omitempty"`     // Probability (0-1) of resetting a stream on each read/write
+	Bandwidth int64              `json:"bandwidth,omitempty"` // Throughput cap in bytes per second (0 = unlimited)
+	Control   string             `json:"control,omitempty"`   // Optional loopback listen address for the runtime control endpoint
+}
+
+func (o FaultOptions) profile() Profile {
+	return Profile{
+		Latency:   time.Duration(o.Latency),
+		Jitter:    time.Duration(o.Jitter),
+		Loss:      o.Loss,
+		Reset:     o.Reset,
+		Bandwidth: o.Bandwidth,
+	}
+}
+
+// ChaosOptions defines the configuration for the chaos outbound
+type ChaosOptions struct {
+	Detour string `json:"detour"` // Outbound tag that carries the actual traffic
+	FaultOptions
+
+	limiter.Options // max_connections / max_pending_dials
+}
+
+// ChaosInboundOptions defines the configuration for the chaos inbound. The
+// listen detour names the inbound accepted connections are handed to.
+type ChaosInboundOptions struct {
+	option.ListenOptions
+	FaultOptions
+}
@@ -0,0 +1,92 @@
+package chaos
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// conn wraps a stream connection and injects resets and throttling
+type conn struct {
+	net.Conn
+	ctrl *controller
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	p := c.ctrl.Load()
+	if chance(p.Reset) {
+		c.Conn.Close()
+		return 0, syscall.ECONNRESET
+	}
+	n, err := c.Conn.Read(b)
+	throttle(p.Bandwidth, n)
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	p := c.ctrl.Load()
+	if chance(p.Reset) {
+		c.Conn.Close()
+		return 0, syscall.ECONNRESET
+	}
+	throttle(p.Bandwidth, len(b))
+	return c.Conn.Write(b)
+}
+
+// packetConn wraps a packet connection and injects loss, latency and throttling
+type packetConn struct {
+	net.PacketConn
+	ctrl *controller
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p := c.ctrl.Load()
+	if chance(p.Loss) {
+		// Pretend the datagram was sent; it is silently dropped
+		return len(b), nil
+	}
+	throttle(p.Bandwidth, len(b))
+	if d := p.delay(); d > 0 {
+		time.Sleep(d)
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		p := c.ctrl.Load()
+		if chance(p.Loss) {
+			continue
+		}
+		throttle(p.Bandwidth, n)
+		return n, addr, nil
+	}
+}
+
+// throttle sleeps long enough to keep n bytes under the given rate
+func throttle(bandwidth int64, n int) {
+	if bandwidth <= 0 || n <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(int64(n) * int64(time.Second) / bandwidth))
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,80 @@
+package chaos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// controlServer exposes the active profile over a small JSON HTTP endpoint.
+//
+//	GET  /profile  returns the current profile
+//	PUT  /profile  replaces the profile (durations in nanoseconds)
+//
+// It has no authentication, so it only listens on loopback; the admin
+// service changes profiles remotely behind its secret.
+type controlServer struct {
+	addr   string
+	ctrl   *controller
+	server *http.Server
+}
+
+func newControlServer(addr string, ctrl *controller) (*controlServer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control address: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("control must listen on a loopback address, use the admin service for remote control")
+	}
+	s := &controlServer{addr: addr, ctrl: ctrl}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/profile", s.handleProfile)
+	s.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s, nil
+}
+
+func (s *controlServer) Start() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			listener.Close()
+		}
+	}()
+	return nil
+}
+
+func (s *controlServer) Close() error {
+	return s.server.Close()
+}
+
+func (s *controlServer) handleProfile(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var p Profile
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.ctrl.Store(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.ctrl.Load())
+}
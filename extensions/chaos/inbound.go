@@ -0,0 +1,117 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/listener"
+	"github.com/sagernet/sing-box/log"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var _ adapter.TCPInjectableInbound = (*Inbound)(nil)
+
+// Inbound accepts connections, injects latency, loss, resets and throttling
+// and hands them to the inbound named by the listen detour, so clients can
+// be tested against a server behind a bad network. Like the outbound, it is
+// intended for local testing only.
+type Inbound struct {
+	tag      string
+	opts     ChaosInboundOptions
+	logger   log.ContextLogger
+	router   adapter.Router
+	listener *listener.Listener
+	ctrl     *controller
+	control  *controlServer
+}
+
+// NewInbound creates a new chaos inbound
+func NewInbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts ChaosInboundOptions) (adapter.Inbound, error) {
+	if opts.Detour == "" {
+		return nil, fmt.Errorf("chaos inbound requires a detour inbound")
+	}
+	ctrl := &controller{}
+	if err := ctrl.Store(opts.profile()); err != nil {
+		return nil, fmt.Errorf("invalid chaos profile: %w", err)
+	}
+	i := &Inbound{
+		tag:    tag,
+		opts:   opts,
+		logger: logger,
+		router: router,
+		ctrl:   ctrl,
+	}
+	if opts.Control != "" {
+		control, err := newControlServer(opts.Control, ctrl)
+		if err != nil {
+			return nil, err
+		}
+		i.control = control
+	}
+	i.listener = listener.New(listener.Options{
+		Context:           ctx,
+		Logger:            logger,
+		Network:           []string{N.NetworkTCP},
+		Listen:            opts.ListenOptions,
+		ConnectionHandler: i,
+	})
+	return i, nil
+}
+
+func (i *Inbound) Type() string {
+	return "chaos"
+}
+
+func (i *Inbound) Tag() string {
+	return i.tag
+}
+
+func (i *Inbound) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	if i.control != nil {
+		if err := i.control.Start(); err != nil {
+			return fmt.Errorf("failed to start chaos control endpoint: %w", err)
+		}
+		i.logger.Info("chaos control endpoint listening on ", i.opts.Control)
+	}
+	return i.listener.Start()
+}
+
+func (i *Inbound) Close() error {
+	if i.control != nil {
+		i.control.Close()
+	}
+	return i.listener.Close()
+}
+
+// Profile returns the currently active fault profile
+func (i *Inbound) Profile() Profile {
+	return i.ctrl.Load()
+}
+
+// SetProfile replaces the active fault profile for new and existing connections
+func (i *Inbound) SetProfile(p Profile) error {
+	return i.ctrl.Store(p)
+}
+
+// NewConnectionEx delays or drops the connection, then routes it to the
+// detour inbound with resets and throttling injected
+func (i *Inbound) NewConnectionEx(ctx context.Context, c net.Conn, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	p := i.ctrl.Load()
+	if err := sleepContext(ctx, p.delay()); err != nil {
+		N.CloseOnHandshakeFailure(c, onClose, err)
+		return
+	}
+	if chance(p.Loss) {
+		i.logger.DebugContext(ctx, "chaos: simulated loss of connection from ", metadata.Source)
+		N.CloseOnHandshakeFailure(c, onClose, fmt.Errorf("chaos: simulated loss"))
+		return
+	}
+	metadata.Inbound = i.tag
+	metadata.InboundType = i.Type()
+	i.router.RouteConnectionEx(ctx, &conn{Conn: c, ctrl: i.ctrl}, metadata, onClose)
+}
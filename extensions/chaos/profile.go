@@ -0,0 +1,69 @@
+package chaos
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Profile describes the network conditions injected by the chaos outbound
+type Profile struct {
+	Latency   time.Duration `json:"latency"`
+	Jitter    time.Duration `json:"jitter"`
+	Loss      float64       `json:"loss"`
+	Reset     float64       `json:"reset"`
+	Bandwidth int64         `json:"bandwidth"`
+}
+
+// Validate checks that probabilities and limits are within range
+func (p Profile) Validate() error {
+	if p.Latency < 0 || p.Jitter < 0 {
+		return fmt.Errorf("latency and jitter must not be negative")
+	}
+	if p.Loss < 0 || p.Loss > 1 {
+		return fmt.Errorf("loss must be between 0 and 1")
+	}
+	if p.Reset < 0 || p.Reset > 1 {
+		return fmt.Errorf("reset must be between 0 and 1")
+	}
+	if p.Bandwidth < 0 {
+		return fmt.Errorf("bandwidth must not be negative")
+	}
+	return nil
+}
+
+// delay returns the latency plus a random jitter component
+func (p Profile) delay() time.Duration {
+	d := p.Latency
+	if p.Jitter > 0 {
+		d += rand.N(p.Jitter)
+	}
+	return d
+}
+
+func chance(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+// controller holds the active profile and allows it to be swapped at runtime
+type controller struct {
+	access  sync.RWMutex
+	profile Profile
+}
+
+func (c *controller) Load() Profile {
+	c.access.RLock()
+	defer c.access.RUnlock()
+	return c.profile
+}
+
+func (c *controller) Store(p Profile) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	c.access.Lock()
+	c.profile = p
+	c.access.Unlock()
+	return nil
+}
@@ -0,0 +1,15 @@
+package circuitbreaker
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// CircuitBreakerOptions defines the configuration for the circuit-breaker
+// service
+type CircuitBreakerOptions struct {
+	Threshold  int                `json:"threshold,omitempty"`   // Failed dials in a row within window that start a storm (default 20)
+	Outbounds  int                `json:"outbounds,omitempty"`   // Distinct outbounds among them (default 3)
+	Window     badoption.Duration `json:"window,omitempty"`      // Span the failures are counted over (default 1m)
+	Backoff    badoption.Duration `json:"backoff,omitempty"`     // Delay before the first probe of a storm (default 10s)
+	MaxBackoff badoption.Duration `json:"max_backoff,omitempty"` // Largest delay between probes (default 10m)
+}
@@ -0,0 +1,86 @@
+package circuitbreaker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/log"
+
+	"github.com/UTPBox/utp-core/internal/breaker"
+)
+
+const (
+	defaultThreshold  = 20
+	defaultOutbounds  = 3
+	defaultWindow     = time.Minute
+	defaultBackoff    = 10 * time.Second
+	defaultMaxBackoff = 10 * time.Minute
+)
+
+// Service puts a storm breaker in force for the extension outbounds of the
+// instance (see internal/breaker)
+type Service struct {
+	boxService.Adapter
+	logger  log.ContextLogger
+	breaker *breaker.Breaker
+}
+
+// NewService creates the circuit-breaker service
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts CircuitBreakerOptions) (adapter.Service, error) {
+	config := breaker.Config{
+		Threshold:  defaultThreshold,
+		Outbounds:  defaultOutbounds,
+		Window:     defaultWindow,
+		Backoff:    defaultBackoff,
+		MaxBackoff: defaultMaxBackoff,
+	}
+	if opts.Threshold > 0 {
+		config.Threshold = opts.Threshold
+	}
+	if opts.Outbounds > 0 {
+		config.Outbounds = opts.Outbounds
+	}
+	if opts.Window > 0 {
+		config.Window = time.Duration(opts.Window)
+	}
+	if opts.Backoff > 0 {
+		config.Backoff = time.Duration(opts.Backoff)
+	}
+	if opts.MaxBackoff > 0 {
+		config.MaxBackoff = time.Duration(opts.MaxBackoff)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("circuit-breaker: %w", err)
+	}
+	s := &Service{
+		Adapter: boxService.NewAdapter("circuit-breaker", tag),
+		logger:  logger,
+	}
+	s.breaker = breaker.New(config, s.changed)
+	return s, nil
+}
+
+// Start puts the breaker in force before outbounds start dialing
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	breaker.Set(s.breaker)
+	return nil
+}
+
+func (s *Service) Close() error {
+	breaker.Clear(s.breaker)
+	return nil
+}
+
+func (s *Service) changed(storm bool, failures int) {
+	if storm {
+		s.logger.Warn("failure storm: ", failures, " dials failed in a row, probing with backoff")
+		return
+	}
+	s.logger.Info("dial succeeded, failure storm over")
+}
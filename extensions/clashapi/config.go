@@ -0,0 +1,12 @@
+package clashapi
+
+import (
+	"github.com/sagernet/sing-box/option"
+)
+
+// ClashAPIOptions defines the configuration for the Clash API service
+type ClashAPIOptions struct {
+	option.ListenOptions        // listen / listen_port of the API listener
+	Secret               string `json:"secret,omitempty"`      // Bearer token required by the API (also accepted as ?token=)
+	ExternalUI           string `json:"external_ui,omitempty"` // Directory of a dashboard (Yacd, Metacubexd) served at /ui/
+}
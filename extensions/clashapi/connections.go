@@ -0,0 +1,146 @@
+package clashapi
+
+import (
+	"net/http"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	M "github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/metrics"
+)
+
+// maxChain bounds the group nesting followed for connection chains
+const maxChain = 8
+
+type connectionMetadata struct {
+	Network         string `json:"network"`
+	Type            string `json:"type"`
+	SourceIP        string `json:"sourceIP"`
+	DestinationIP   string `json:"destinationIP"`
+	SourcePort      string `json:"sourcePort"`
+	DestinationPort string `json:"destinationPort"`
+	Host            string `json:"host"`
+	DNSMode         string `json:"dnsMode"`
+	ProcessPath     string `json:"processPath"`
+}
+
+type connectionResponse struct {
+	ID          string             `json:"id"`
+	Metadata    connectionMetadata `json:"metadata"`
+	Upload      int64              `json:"upload"`
+	Download    int64              `json:"download"`
+	Start       time.Time          `json:"start"`
+	Chains      []string           `json:"chains"`
+	Rule        string             `json:"rule"`
+	RulePayload string             `json:"rulePayload"`
+}
+
+type connectionsResponse struct {
+	DownloadTotal int64                `json:"downloadTotal"`
+	UploadTotal   int64                `json:"uploadTotal"`
+	Connections   []connectionResponse `json:"connections"`
+	Memory        uint64               `json:"memory"`
+}
+
+// handleConnections returns the open connections, streamed every
+// ?interval= milliseconds (default 1000) over a WebSocket
+func (s *Service) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if !isWebSocket(r) {
+		writeJSON(w, s.connections())
+		return
+	}
+	interval := time.Second
+	if value, err := strconv.Atoi(r.URL.Query().Get("interval")); err == nil && value > 0 {
+		interval = max(time.Duration(value)*time.Millisecond, 100*time.Millisecond)
+	}
+	s.stream(w, r, interval, func() []any {
+		return []any{s.connections()}
+	})
+}
+
+func (s *Service) connections() connectionsResponse {
+	total := s.metrics.Total()
+	open := s.metrics.Connections()
+	response := connectionsResponse{
+		DownloadTotal: total.Download,
+		UploadTotal:   total.Upload,
+		Connections:   make([]connectionResponse, 0, len(open)),
+		Memory:        heapInUse(),
+	}
+	for _, c := range open {
+		response.Connections = append(response.Connections, s.connection(c))
+	}
+	return response
+}
+
+func (s *Service) connection(c metrics.Connection) connectionResponse {
+	source := M.ParseSocksaddr(c.Source)
+	destination := M.ParseSocksaddr(c.Destination)
+	response := connectionResponse{
+		ID: c.ID,
+		Metadata: connectionMetadata{
+			Network:         c.Network,
+			Type:            c.InboundType + "/" + c.Inbound,
+			SourceIP:        addrString(source.Addr),
+			SourcePort:      strconv.Itoa(int(source.Port)),
+			DestinationIP:   addrString(destination.Addr),
+			DestinationPort: strconv.Itoa(int(destination.Port)),
+			Host:            c.Domain,
+			DNSMode:         "normal",
+		},
+		Upload:   c.Upload,
+		Download: c.Download,
+		Start:    c.Start,
+		Chains:   s.chain(c.Outbound),
+		Rule:     c.Rule,
+	}
+	return response
+}
+
+// chain follows the groups from tag to the outbound currently carrying
+// their connections. Clash lists it from the last hop back to the group.
+func (s *Service) chain(tag string) []string {
+	chain := []string{tag}
+	for len(chain) < maxChain {
+		outbound, loaded := s.outbounds.Outbound(tag)
+		if !loaded {
+			break
+		}
+		group, isGroup := outbound.(adapter.OutboundGroup)
+		if !isGroup || group.Now() == "" || slices.Contains(chain, group.Now()) {
+			break
+		}
+		tag = group.Now()
+		chain = append(chain, tag)
+	}
+	slices.Reverse(chain)
+	return chain
+}
+
+func (s *Service) handleCloseAll(w http.ResponseWriter, r *http.Request) {
+	s.metrics.CloseConnections()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) handleClose(w http.ResponseWriter, r *http.Request) {
+	s.metrics.CloseConnection(r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func addrString(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return ""
+	}
+	return addr.Unmap().String()
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
@@ -0,0 +1,270 @@
+package clashapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/urltest"
+	C "github.com/sagernet/sing-box/constant"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// globalGroup is the pseudo group Clash dashboards expect, listing every
+// proxy with the default outbound selected
+const globalGroup = "GLOBAL"
+
+// maxParallelTests bounds the delay tests of a group run at once
+const maxParallelTests = 10
+
+// selectableGroup is implemented by groups that can be switched manually,
+// such as the Sing-box selector
+type selectableGroup interface {
+	adapter.OutboundGroup
+	SelectOutbound(tag string) bool
+}
+
+type proxyResponse struct {
+	Type    string                    `json:"type"`
+	Name    string                    `json:"name"`
+	UDP     bool                      `json:"udp"`
+	History []*adapter.URLTestHistory `json:"history"`
+	Now     string                    `json:"now,omitempty"`
+	All     []string                  `json:"all,omitempty"`
+}
+
+// displayTypes are the Clash names of outbound types without a Sing-box
+// display name
+var displayTypes = map[string]string{
+	C.TypeBlock:    "Reject",
+	C.TypeSelector: "Selector",
+	C.TypeURLTest:  "URLTest",
+	"load-balance": "LoadBalance",
+	"fallback":     "Fallback",
+	"psiphon":      "Psiphon",
+	"chaos":        "Chaos",
+	"obfs4":        "Obfs4",
+	"meek":         "Meek",
+	"cloak":        "Cloak",
+	"naive":        "Naive",
+	"udp2raw":      "Udp2raw",
+}
+
+func (s *Service) proxy(outbound adapter.Outbound) proxyResponse {
+	response := proxyResponse{
+		Type:    displayTypes[outbound.Type()],
+		Name:    outbound.Tag(),
+		UDP:     slices.Contains(outbound.Network(), N.NetworkUDP),
+		History: []*adapter.URLTestHistory{},
+	}
+	if response.Type == "" {
+		response.Type = C.ProxyDisplayName(outbound.Type())
+	}
+	if history := s.history.LoadURLTestHistory(adapter.OutboundTag(outbound)); history != nil {
+		response.History = append(response.History, history)
+	}
+	if group, isGroup := outbound.(adapter.OutboundGroup); isGroup {
+		response.Now = group.Now()
+		response.All = group.All()
+	}
+	return response
+}
+
+// all returns the outbounds and endpoints
+func (s *Service) all() []adapter.Outbound {
+	outbounds := s.outbounds.Outbounds()
+	for _, endpoint := range s.endpoints.Endpoints() {
+		outbounds = append(outbounds, endpoint)
+	}
+	return slices.DeleteFunc(outbounds, func(outbound adapter.Outbound) bool {
+		return outbound.Tag() == ""
+	})
+}
+
+func (s *Service) global(outbounds []adapter.Outbound) proxyResponse {
+	defaultTag := s.outbounds.Default().Tag()
+	members := []string{defaultTag}
+	for _, outbound := range outbounds {
+		switch outbound.Type() {
+		case C.TypeDirect, C.TypeBlock, C.TypeDNS:
+			continue
+		}
+		if outbound.Tag() != defaultTag {
+			members = append(members, outbound.Tag())
+		}
+	}
+	return proxyResponse{
+		Type:    "Fallback",
+		Name:    globalGroup,
+		UDP:     true,
+		History: []*adapter.URLTestHistory{},
+		Now:     defaultTag,
+		All:     members,
+	}
+}
+
+func (s *Service) handleProxies(w http.ResponseWriter, r *http.Request) {
+	outbounds := s.all()
+	proxies := make(map[string]proxyResponse, len(outbounds)+1)
+	proxies[globalGroup] = s.global(outbounds)
+	for _, outbound := range outbounds {
+		proxies[outbound.Tag()] = s.proxy(outbound)
+	}
+	writeJSON(w, map[string]any{"proxies": proxies})
+}
+
+func (s *Service) handleGroups(w http.ResponseWriter, r *http.Request) {
+	groups := []proxyResponse{}
+	for _, outbound := range s.all() {
+		if _, isGroup := outbound.(adapter.OutboundGroup); isGroup {
+			groups = append(groups, s.proxy(outbound))
+		}
+	}
+	writeJSON(w, map[string]any{"proxies": groups})
+}
+
+func (s *Service) handleProxy(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if name == globalGroup {
+		writeJSON(w, s.global(s.all()))
+		return
+	}
+	outbound, loaded := s.outbounds.Outbound(name)
+	if !loaded {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	writeJSON(w, s.proxy(outbound))
+}
+
+// handleSelect switches a selector group to another member
+func (s *Service) handleSelect(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "Body invalid")
+		return
+	}
+	name := r.PathValue("name")
+	outbound, loaded := s.outbounds.Outbound(name)
+	if !loaded {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	group, selectable := outbound.(selectableGroup)
+	if !selectable {
+		writeError(w, http.StatusBadRequest, "Must be a Selector")
+		return
+	}
+	if !group.SelectOutbound(request.Name) {
+		writeError(w, http.StatusBadRequest, "Selector update error: not found")
+		return
+	}
+	s.logger.Info("selected ", request.Name, " for ", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) handleDelay(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel, link, ok := delayRequest(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	outbound, loaded := s.outbounds.Outbound(r.PathValue("name"))
+	if !loaded {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	delay, err := s.test(ctx, link, outbound)
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, "Timeout")
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, "An error occurred in the delay test")
+	default:
+		writeJSON(w, map[string]uint16{"delay": delay})
+	}
+}
+
+// handleGroupDelay tests every member of a group and returns the delays of
+// the reachable ones
+func (s *Service) handleGroupDelay(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel, link, ok := delayRequest(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	outbound, loaded := s.outbounds.Outbound(r.PathValue("name"))
+	if !loaded {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	group, isGroup := outbound.(adapter.OutboundGroup)
+	if !isGroup {
+		writeError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+	var (
+		access  sync.Mutex
+		wait    sync.WaitGroup
+		slots   = make(chan struct{}, maxParallelTests)
+		results = make(map[string]uint16)
+	)
+	for _, tag := range group.All() {
+		member, loaded := s.outbounds.Outbound(tag)
+		if !loaded {
+			continue
+		}
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+			if delay, err := s.test(ctx, link, member); err == nil {
+				access.Lock()
+				results[tag] = delay
+				access.Unlock()
+			}
+		}()
+	}
+	wait.Wait()
+	writeJSON(w, results)
+}
+
+// test measures the delay of outbound and records it for the dashboards and
+// the urltest groups
+func (s *Service) test(ctx context.Context, link string, outbound adapter.Outbound) (uint16, error) {
+	tag := adapter.OutboundTag(outbound)
+	delay, err := urltest.URLTest(ctx, link, outbound)
+	if err != nil {
+		s.logger.Debug("outbound ", tag, " unavailable: ", err)
+		s.history.DeleteURLTestHistory(tag)
+		return 0, err
+	}
+	s.history.StoreURLTestHistory(tag, &adapter.URLTestHistory{Time: time.Now(), Delay: delay})
+	return delay, nil
+}
+
+// delayRequest reads the url and timeout (milliseconds) parameters of a
+// delay test
+func delayRequest(w http.ResponseWriter, r *http.Request) (context.Context, context.CancelFunc, string, bool) {
+	query := r.URL.Query()
+	timeout, err := strconv.ParseUint(query.Get("timeout"), 10, 16)
+	if err != nil || timeout == 0 {
+		writeError(w, http.StatusBadRequest, "Body invalid")
+		return nil, nil, "", false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(timeout)*time.Millisecond)
+	return ctx, cancel, query.Get("url"), true
+}
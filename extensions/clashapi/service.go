@@ -0,0 +1,231 @@
+package clashapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/common/listener"
+	"github.com/sagernet/sing-box/common/urltest"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/metrics"
+)
+
+// Service serves the subset of the Clash REST API used by Clash dashboards,
+// backed by the running instance
+type Service struct {
+	boxService.Adapter
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    log.ContextLogger
+	opts      ClashAPIOptions
+	router    adapter.Router
+	outbounds adapter.OutboundManager
+	endpoints adapter.EndpointManager
+	history   adapter.URLTestHistoryStorage
+	metrics   *metrics.Store
+	listener  *listener.Listener
+	server    *http.Server
+}
+
+// NewService creates the Clash API service and starts tracking routed
+// connections
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts ClashAPIOptions) (adapter.Service, error) {
+	router := service.FromContext[adapter.Router](ctx)
+	if router == nil {
+		return nil, errors.New("clash-api: router not available")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Service{
+		Adapter:   boxService.NewAdapter("clash-api", tag),
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    logger,
+		opts:      opts,
+		router:    router,
+		outbounds: service.FromContext[adapter.OutboundManager](ctx),
+		endpoints: service.FromContext[adapter.EndpointManager](ctx),
+		metrics:   metrics.NewStore(),
+	}
+	// Shared with the urltest groups when registered in the context
+	if history := service.PtrFromContext[urltest.HistoryStorage](ctx); history != nil {
+		s.history = history
+	} else {
+		s.history = urltest.NewHistoryStorage()
+	}
+	router.AppendTracker(s.metrics)
+	s.listener = listener.New(listener.Options{
+		Context: ctx,
+		Logger:  logger,
+		Listen:  opts.ListenOptions,
+	})
+	s.server = &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	s.metrics.Start()
+	tcpListener, err := s.listener.ListenTCP()
+	if err != nil {
+		return err
+	}
+	if s.opts.Secret == "" && !isLoopback(tcpListener.Addr()) {
+		s.logger.Warn("Clash API is reachable from the network without a secret")
+	}
+	go func() {
+		if err := s.server.Serve(tcpListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Clash API server: ", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Service) Close() error {
+	// Ends the streams, which outlive Server.Close as hijacked connections
+	s.cancel()
+	s.metrics.Close()
+	return s.server.Close()
+}
+
+func (s *Service) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"hello": "clash"})
+	})
+	mux.HandleFunc("GET /version", s.handleVersion)
+	mux.HandleFunc("GET /configs", s.handleConfigs)
+	mux.HandleFunc("PUT /configs", noContent)
+	mux.HandleFunc("PATCH /configs", noContent)
+	mux.HandleFunc("GET /proxies", s.handleProxies)
+	mux.HandleFunc("GET /proxies/{name}", s.handleProxy)
+	mux.HandleFunc("PUT /proxies/{name}", s.handleSelect)
+	mux.HandleFunc("GET /proxies/{name}/delay", s.handleDelay)
+	mux.HandleFunc("GET /group", s.handleGroups)
+	mux.HandleFunc("GET /group/{name}", s.handleProxy)
+	mux.HandleFunc("GET /group/{name}/delay", s.handleGroupDelay)
+	mux.HandleFunc("GET /providers/proxies", emptyProviders)
+	mux.HandleFunc("GET /providers/rules", emptyProviders)
+	mux.HandleFunc("GET /rules", s.handleRules)
+	mux.HandleFunc("GET /connections", s.handleConnections)
+	mux.HandleFunc("DELETE /connections", s.handleCloseAll)
+	mux.HandleFunc("DELETE /connections/{id}", s.handleClose)
+	mux.HandleFunc("GET /traffic", s.handleTraffic)
+	mux.HandleFunc("GET /memory", s.handleMemory)
+	mux.HandleFunc("GET /logs", s.handleLogs)
+	if s.opts.ExternalUI != "" {
+		mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServer(http.Dir(s.opts.ExternalUI))))
+		mux.Handle("GET /ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	}
+	return s.authorize(mux)
+}
+
+// authorize allows cross-origin requests, as dashboards are often hosted
+// elsewhere, and requires the configured secret as a Bearer token. Browsers
+// cannot set headers on WebSockets, so those pass it as ?token=.
+func (s *Service) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Access-Control-Allow-Origin", "*")
+		header.Set("Access-Control-Allow-Private-Network", "true")
+		if r.Method == http.MethodOptions {
+			header.Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			header.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if s.opts.Secret != "" && !strings.HasPrefix(r.URL.Path, "/ui") {
+			token, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !isBearer && isWebSocket(r) {
+				token = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Secret)) != 1 {
+				writeError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Service) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{"version": "utp-core", "premium": true, "meta": true})
+}
+
+// handleConfigs reports a rule-mode configuration. Ports are configured by
+// inbounds and cannot be changed through the API, so updates are accepted
+// and ignored.
+func (s *Service) handleConfigs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"port":         0,
+		"socks-port":   0,
+		"redir-port":   0,
+		"tproxy-port":  0,
+		"mixed-port":   0,
+		"allow-lan":    false,
+		"bind-address": "*",
+		"mode":         "rule",
+		"mode-list":    []string{"rule"},
+		"log-level":    "info",
+		"ipv6":         true,
+	})
+}
+
+func (s *Service) handleRules(w http.ResponseWriter, r *http.Request) {
+	type rule struct {
+		Type    string `json:"type"`
+		Payload string `json:"payload"`
+		Proxy   string `json:"proxy"`
+	}
+	rules := s.router.Rules()
+	response := make([]rule, 0, len(rules))
+	for _, item := range rules {
+		response = append(response, rule{
+			Type:    item.Type(),
+			Payload: item.String(),
+			Proxy:   item.Action().String(),
+		})
+	}
+	writeJSON(w, map[string]any{"rules": response})
+}
+
+func noContent(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// emptyProviders answers provider listings; subscriptions are exposed as
+// their groups instead
+func emptyProviders(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{"providers": map[string]any{}})
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcpAddr, isTCP := addr.(*net.TCPAddr)
+	return isTCP && tcpAddr.IP.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError answers in the Clash error format
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
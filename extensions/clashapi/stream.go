@@ -0,0 +1,212 @@
+package clashapi
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sagernet/ws"
+	"github.com/sagernet/ws/wsutil"
+
+	"github.com/UTPBox/utp-core/internal/config"
+	"github.com/UTPBox/utp-core/internal/logsink"
+)
+
+// Log following parameters
+const (
+	logPollInterval = 500 * time.Millisecond
+	maxLogRead      = 1 << 20
+)
+
+// Clash log levels, in increasing severity
+var logLevels = map[string]int{"debug": 0, "info": 1, "warning": 2, "error": 3, "silent": 4}
+
+// levelNames maps the Sing-box level names found in log lines
+var levelNames = map[string]string{
+	"TRACE": "debug", "DEBUG": "debug", "INFO": "info", "WARN": "warning",
+	"ERROR": "error", "FATAL": "error", "PANIC": "error",
+}
+
+var colorCodes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// stream calls produce every interval and sends the values it returns, as
+// WebSocket text messages or, for plain requests, as a chunked stream of
+// JSON lines, until the client goes away or the service closes
+func (s *Service) stream(w http.ResponseWriter, r *http.Request, interval time.Duration, produce func() []any) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(s.ctx, cancel)
+	defer stop()
+
+	var send func(value any) error
+	if isWebSocket(r) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			// Consume control frames and notice the close
+			for {
+				if _, _, err := wsutil.ReadClientData(conn); err != nil {
+					cancel()
+					return
+				}
+			}
+		}()
+		send = func(value any) error {
+			content, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			return wsutil.WriteServerText(conn, content)
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		send = func(value any) error {
+			if err := encoder.Encode(value); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, value := range produce() {
+			if err := send(value); err != nil {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleTraffic streams the throughput of the last second
+func (s *Service) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	type traffic struct {
+		Up   int64 `json:"up"`
+		Down int64 `json:"down"`
+	}
+	last := s.metrics.Total()
+	s.stream(w, r, time.Second, func() []any {
+		current := s.metrics.Total()
+		sample := traffic{Up: current.Upload - last.Upload, Down: current.Download - last.Download}
+		last = current
+		return []any{sample}
+	})
+}
+
+func (s *Service) handleMemory(w http.ResponseWriter, r *http.Request) {
+	s.stream(w, r, time.Second, func() []any {
+		return []any{map[string]uint64{"inuse": heapInUse(), "oslimit": 0}}
+	})
+}
+
+// handleLogs streams the lines appended to the log file at or above
+// ?level= (default info). Logs written to the console or a log sink are not
+// retained and cannot be followed.
+func (s *Service) handleLogs(w http.ResponseWriter, r *http.Request) {
+	type message struct {
+		Type    string `json:"type"`
+		Payload string `json:"payload"`
+	}
+	minimum, known := logLevels[r.URL.Query().Get("level")]
+	if !known {
+		minimum = logLevels["info"]
+	}
+	path := s.logPath()
+	if path == "" {
+		writeError(w, http.StatusNotFound, "Log is not written to a file")
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var pending string
+	s.stream(w, r, logPollInterval, func() []any {
+		if info, err := file.Stat(); err == nil && info.Size() < offset {
+			// Truncated or rotated in place
+			offset, pending = 0, ""
+		}
+		content, _ := io.ReadAll(io.NewSectionReader(file, offset, maxLogRead))
+		offset += int64(len(content))
+		lines := strings.Split(pending+string(content), "\n")
+		pending = lines[len(lines)-1]
+		var messages []any
+		for _, line := range lines[:len(lines)-1] {
+			level, payload := parseLogLine(colorCodes.ReplaceAllString(line, ""))
+			if level != "" && logLevels[level] >= minimum {
+				messages = append(messages, message{Type: level, Payload: payload})
+			}
+		}
+		return messages
+	})
+}
+
+// parseLogLine finds the level of a Sing-box log line, or of a JSON record
+// (log.format), and returns it with the message following it
+func parseLogLine(line string) (string, string) {
+	if strings.HasPrefix(line, "{") {
+		var record logsink.Record
+		if json.Unmarshal([]byte(line), &record) != nil {
+			return "", ""
+		}
+		return levelNames[strings.ToUpper(record.Level)], record.Message
+	}
+	rest := line
+	for range 4 {
+		field, remaining, found := strings.Cut(strings.TrimLeft(rest, " "), " ")
+		if level, isLevel := levelNames[field]; isLevel {
+			return level, strings.TrimSpace(remaining)
+		}
+		if !found {
+			break
+		}
+		rest = remaining
+	}
+	return "", ""
+}
+
+func (s *Service) logPath() string {
+	options := config.OptionsFromContext(s.ctx)
+	if options == nil || options.Log == nil || options.Log.Disabled {
+		return ""
+	}
+	switch options.Log.Output {
+	case "", "stdout", "stderr":
+		return ""
+	}
+	if logsink.IsSink(options.Log.Output) {
+		return ""
+	}
+	return options.Log.Output
+}
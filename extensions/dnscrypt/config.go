@@ -0,0 +1,15 @@
+package dnscrypt
+
+import (
+	"github.com/sagernet/sing-box/option"
+)
+
+// DNSCryptOptions defines the configuration for the dnscrypt DNS server. The
+// resolver is given by stamp, or by server, provider_name and public_key;
+// fields set alongside a stamp replace its values.
+type DNSCryptOptions struct {
+	option.RemoteDNSServerOptions
+	Stamp        string `json:"stamp,omitempty"`         // sdns:// resolver stamp
+	ProviderName string `json:"provider_name,omitempty"` // e.g. 2.dnscrypt-cert.example.com
+	PublicKey    string `json:"public_key,omitempty"`    // Provider signing key in hex (colons allowed)
+}
@@ -0,0 +1,103 @@
+package dnscrypt
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/dialer"
+	boxDNS "github.com/sagernet/sing-box/dns"
+	"github.com/sagernet/sing-box/log"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/UTPBox/utp-core/internal/dnscrypt"
+)
+
+var _ adapter.DNSTransport = (*Transport)(nil)
+
+// Transport resolves through a DNSCrypt resolver, reached by the dial
+// fields like the Sing-box udp and tcp servers
+type Transport struct {
+	boxDNS.TransportAdapter
+	dialer N.Dialer
+	client *dnscrypt.Client
+}
+
+// NewTransport creates a dnscrypt DNS server
+func NewTransport(ctx context.Context, logger log.ContextLogger, tag string, opts DNSCryptOptions) (adapter.DNSTransport, error) {
+	stamp, err := resolverStamp(opts)
+	if err != nil {
+		return nil, fmt.Errorf("dnscrypt: %w", err)
+	}
+	host, port, _ := net.SplitHostPort(stamp.Address)
+	portNumber, _ := strconv.ParseUint(port, 10, 16)
+	opts.Server, opts.ServerPort = host, uint16(portNumber)
+	transportDialer, err := boxDNS.NewRemoteDialer(ctx, opts.RemoteDNSServerOptions)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transport{
+		TransportAdapter: boxDNS.NewTransportAdapterWithRemoteOptions("dnscrypt", tag, opts.RemoteDNSServerOptions),
+		dialer:           transportDialer,
+	}
+	t.client = dnscrypt.New(stamp, t.dial)
+	return t, nil
+}
+
+// resolverStamp returns the stamp of opts with the fields set alongside it
+// applied
+func resolverStamp(opts DNSCryptOptions) (dnscrypt.Stamp, error) {
+	var stamp dnscrypt.Stamp
+	if opts.Stamp != "" {
+		var err error
+		if stamp, err = dnscrypt.ParseStamp(opts.Stamp); err != nil {
+			return stamp, err
+		}
+	}
+	if opts.Server != "" {
+		port := opts.ServerPort
+		if port == 0 {
+			port = 443
+		}
+		stamp.Address = net.JoinHostPort(opts.Server, strconv.Itoa(int(port)))
+	}
+	if opts.ProviderName != "" {
+		stamp.ProviderName = opts.ProviderName
+	}
+	if opts.PublicKey != "" {
+		key, err := hex.DecodeString(strings.ReplaceAll(opts.PublicKey, ":", ""))
+		if err != nil || len(key) != 32 {
+			return stamp, fmt.Errorf("public_key must be 32 bytes in hex")
+		}
+		stamp.PublicKey = key
+	}
+	if stamp.Address == "" || stamp.ProviderName == "" || stamp.PublicKey == nil {
+		return stamp, fmt.Errorf("requires a stamp, or server, provider_name and public_key")
+	}
+	return stamp, nil
+}
+
+func (t *Transport) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	return dialer.InitializeDetour(t.dialer)
+}
+
+func (t *Transport) Close() error {
+	return nil
+}
+
+func (t *Transport) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	return t.client.Exchange(ctx, message)
+}
+
+func (t *Transport) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	return t.dialer.DialContext(ctx, network, M.ParseSocksaddr(address))
+}
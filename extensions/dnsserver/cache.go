@@ -0,0 +1,253 @@
+package dnsserver
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCacheEntries = 4096
+	defaultMaxTTL       = 24 * time.Hour
+	defaultNegativeTTL  = 5 * time.Minute
+	// staleTTL is the TTL of expired answers served while they are refreshed,
+	// as recommended by RFC 8767
+	staleTTL = 30
+	// prefetchWindow is the share of its TTL an entry has left when a hit
+	// refreshes it ahead of expiry
+	prefetchWindow = 10
+)
+
+// cacheKey identifies a cached response. Policies resolve through their own
+// upstreams, so each has its own entries.
+type cacheKey struct {
+	policy   *policy
+	name     string
+	qtype    uint16
+	qclass   uint16
+	dnssecOK bool
+	checking bool
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	response   *dns.Msg
+	stored     time.Time
+	ttl        time.Duration
+	hits       int
+	refreshing bool
+	element    *list.Element
+}
+
+// cache keeps the responses of the upstreams for their TTL, negative
+// answers included, evicting the least recently used entries beyond
+// max_entries
+type cache struct {
+	maxEntries  int
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	stale       time.Duration
+	prefetch    int
+
+	access  sync.Mutex
+	entries map[cacheKey]*cacheEntry
+	order   *list.List // Most recently used first
+}
+
+func newCache(opts *CacheOptions) *cache {
+	c := &cache{
+		maxEntries:  defaultCacheEntries,
+		maxTTL:      defaultMaxTTL,
+		negativeTTL: defaultNegativeTTL,
+		entries:     make(map[cacheKey]*cacheEntry),
+		order:       list.New(),
+	}
+	if opts == nil {
+		return c
+	}
+	if opts.MaxEntries > 0 {
+		c.maxEntries = opts.MaxEntries
+	}
+	if opts.MaxTTL > 0 {
+		c.maxTTL = time.Duration(opts.MaxTTL)
+	}
+	if opts.NegativeTTL > 0 {
+		c.negativeTTL = time.Duration(opts.NegativeTTL)
+	}
+	c.stale = time.Duration(opts.Stale)
+	c.prefetch = opts.Prefetch
+	return c
+}
+
+func newCacheKey(p *policy, message *dns.Msg) cacheKey {
+	question := message.Question[0]
+	key := cacheKey{
+		policy:   p,
+		name:     strings.ToLower(question.Name),
+		qtype:    question.Qtype,
+		qclass:   question.Qclass,
+		checking: message.CheckingDisabled,
+	}
+	if opt := message.IsEdns0(); opt != nil {
+		key.dnssecOK = opt.Do()
+	}
+	return key
+}
+
+// lookup returns a copy of the response cached for key with its TTLs
+// counted down, or an expired one still within the stale period with the
+// stale TTL. refresh reports whether the caller should refresh the entry:
+// it is stale, or popular enough to prefetch and about to expire. Only one
+// caller is asked to refresh an entry at a time.
+func (c *cache) lookup(key cacheKey, now time.Time) (response *dns.Msg, refresh bool) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	entry, loaded := c.entries[key]
+	if !loaded {
+		return nil, false
+	}
+	age := now.Sub(entry.stored)
+	if age >= entry.ttl+c.stale {
+		c.remove(entry)
+		return nil, false
+	}
+	entry.hits++
+	c.order.MoveToFront(entry.element)
+	response = entry.response.Copy()
+	if age >= entry.ttl {
+		setTTL(response, func(uint32) uint32 { return staleTTL })
+		refresh = true
+	} else {
+		elapsed := uint32(age / time.Second)
+		setTTL(response, func(ttl uint32) uint32 { return ttl - min(ttl, elapsed) })
+		refresh = c.prefetch > 0 && entry.hits >= c.prefetch && (entry.ttl-age)*prefetchWindow < entry.ttl
+	}
+	if refresh {
+		if entry.refreshing {
+			refresh = false
+		} else {
+			entry.refreshing = true
+		}
+	}
+	return response, refresh
+}
+
+// store caches response for key, unless it is not cacheable. A refreshed
+// entry keeps its hits, so a popular name stays prefetched.
+func (c *cache) store(key cacheKey, response *dns.Msg, now time.Time) {
+	ttl, cacheable := c.ttlOf(response)
+	c.access.Lock()
+	defer c.access.Unlock()
+	previous, loaded := c.entries[key]
+	if !cacheable {
+		if loaded {
+			previous.refreshing = false
+		}
+		return
+	}
+	entry := &cacheEntry{key: key, response: response.Copy(), stored: now, ttl: ttl}
+	if loaded {
+		entry.hits = previous.hits
+		c.remove(previous)
+	}
+	entry.element = c.order.PushFront(entry)
+	c.entries[key] = entry
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back().Value.(*cacheEntry))
+	}
+}
+
+// release lets another caller refresh key after a failed refresh
+func (c *cache) release(key cacheKey) {
+	c.access.Lock()
+	if entry, loaded := c.entries[key]; loaded {
+		entry.refreshing = false
+	}
+	c.access.Unlock()
+}
+
+func (c *cache) remove(entry *cacheEntry) {
+	c.order.Remove(entry.element)
+	delete(c.entries, entry.key)
+}
+
+// ttlOf returns how long response may be cached: the lowest TTL of its
+// records, or for NXDOMAIN and empty answers the negative TTL of its SOA
+// record (RFC 2308), each capped. Other failures, truncated responses and
+// negative answers without a SOA record are not cached.
+func (c *cache) ttlOf(response *dns.Msg) (time.Duration, bool) {
+	if response.Truncated {
+		return 0, false
+	}
+	switch {
+	case response.Rcode == dns.RcodeSuccess && len(response.Answer) > 0:
+		lowest := uint32(c.maxTTL / time.Second)
+		for _, records := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+			for _, record := range records {
+				if record.Header().Rrtype != dns.TypeOPT {
+					lowest = min(lowest, record.Header().Ttl)
+				}
+			}
+		}
+		return time.Duration(lowest) * time.Second, lowest > 0
+	case response.Rcode == dns.RcodeSuccess || response.Rcode == dns.RcodeNameError:
+		for _, record := range response.Ns {
+			if soa, isSOA := record.(*dns.SOA); isSOA {
+				ttl := min(time.Duration(min(soa.Hdr.Ttl, soa.Minttl))*time.Second, c.negativeTTL)
+				return ttl, ttl > 0
+			}
+		}
+	}
+	return 0, false
+}
+
+// setTTL replaces the TTL of every record of message but its EDNS0 options
+func setTTL(message *dns.Msg, ttl func(uint32) uint32) {
+	for _, records := range [][]dns.RR{message.Answer, message.Ns, message.Extra} {
+		for _, record := range records {
+			if header := record.Header(); header.Rrtype != dns.TypeOPT {
+				header.Ttl = ttl(header.Ttl)
+			}
+		}
+	}
+}
+
+// resolveCached answers message from the cache when it can, and through the
+// upstreams of p otherwise. Stale answers and prefetched ones are refreshed
+// in the background.
+func (r *resolver) resolveCached(ctx context.Context, p *policy, message *dns.Msg) (*dns.Msg, error) {
+	if r.cache == nil {
+		return r.resolve(ctx, p, message)
+	}
+	key := newCacheKey(p, message)
+	response, refresh := r.cache.lookup(key, time.Now())
+	if response != nil {
+		if refresh {
+			go r.refresh(p, key, message.Copy())
+		}
+		response.Question = message.Question
+		return response, nil
+	}
+	response, err := r.resolve(ctx, p, message)
+	if err == nil {
+		r.cache.store(key, response, time.Now())
+	}
+	return response, err
+}
+
+// refresh resolves message again for the cache entry key
+func (r *resolver) refresh(p *policy, key cacheKey, message *dns.Msg) {
+	ctx, cancel := context.WithTimeout(r.ctx, queryTimeout)
+	defer cancel()
+	response, err := r.resolve(ctx, p, message)
+	if err != nil {
+		r.logger.DebugContext(ctx, "refresh ", strings.TrimSuffix(key.name, "."), ": ", err)
+		r.cache.release(key)
+		return
+	}
+	r.cache.store(key, response, time.Now())
+}
@@ -0,0 +1,74 @@
+package dnsserver
+
+import (
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// DNSServerOptions defines the configuration for the DNS server inbound
+type DNSServerOptions struct {
+	option.ListenOptions
+	Protocol string                   `json:"protocol,omitempty"` // "doh" (default) or "dot"
+	TLS      *tlsconfig.ServerOptions `json:"tls,omitempty"`      // Without TLS, DoH and DoT are served in cleartext (e.g. behind a reverse proxy)
+	Path     string                   `json:"path,omitempty"`     // DoH request path (default /dns-query)
+
+	Upstream      string            `json:"upstream,omitempty"`       // DNS server tag answering queries (default: DNS rules)
+	Upstreams     []UpstreamOptions `json:"upstreams,omitempty"`      // DNS servers tried in order; replaces upstream
+	Blocklists    []BlocklistEntry  `json:"blocklists,omitempty"`     // Named lists in hosts or AdBlock syntax
+	Block         []string          `json:"block,omitempty"`          // Lists applied to clients without a policy (default: all)
+	Allow         []string          `json:"allow,omitempty"`          // Domains and their subdomains that are never blocked
+	BlockResponse string            `json:"block_response,omitempty"` // "nxdomain" (default) or "null" (0.0.0.0 / ::)
+	Clients       []ClientPolicy    `json:"clients,omitempty"`        // Per-client policies, first match wins
+	Cache         *CacheOptions     `json:"cache,omitempty"`          // Response cache (enabled by default)
+}
+
+// CacheOptions configures the response cache. Expired answers are only
+// served when stale is set, and names are only prefetched when prefetch is.
+type CacheOptions struct {
+	Disabled    bool               `json:"disabled,omitempty"`     // Send every query upstream
+	MaxEntries  int                `json:"max_entries,omitempty"`  // Responses kept, least recently used evicted first (default 4096)
+	MaxTTL      badoption.Duration `json:"max_ttl,omitempty"`      // Cap on the TTL of answers (default 24h)
+	NegativeTTL badoption.Duration `json:"negative_ttl,omitempty"` // Cap on the TTL of NXDOMAIN and empty answers (default 5m)
+	Stale       badoption.Duration `json:"stale,omitempty"`        // How long expired answers are served while refreshed
+	Prefetch    int                `json:"prefetch,omitempty"`     // Hits after which an answer is refreshed before it expires
+}
+
+// BlocklistEntry is a list file loaded at start
+type BlocklistEntry struct {
+	Tag  string `json:"tag"`
+	Path string `json:"path"`
+}
+
+// ClientPolicy overrides filtering and upstream selection for clients
+type ClientPolicy struct {
+	Name             string            `json:"name,omitempty"`              // Used in logs
+	SourceIPCIDR     []string          `json:"source_ip_cidr"`              // Client addresses or prefixes
+	Block            []string          `json:"block,omitempty"`             // Lists applied to the client (replaces the default)
+	DisableFiltering bool              `json:"disable_filtering,omitempty"` // Answer every query unfiltered
+	Upstream         string            `json:"upstream,omitempty"`          // DNS server tag for the client
+	Upstreams        []UpstreamOptions `json:"upstreams,omitempty"`         // DNS servers for the client, tried in order
+}
+
+// UpstreamOptions is a DNS server of an upstream list with its retry policy.
+// A query moves to the next server when this one fails every attempt or
+// answers SERVFAIL.
+type UpstreamOptions struct {
+	Server      string             `json:"server"`                 // DNS server tag
+	Timeout     badoption.Duration `json:"timeout,omitempty"`      // Per attempt (default 5s)
+	Retries     int                `json:"retries,omitempty"`      // Further attempts after an error or timeout
+	TCPFallback string             `json:"tcp_fallback,omitempty"` // DNS server tag retried when a response is truncated
+}
+
+// Protocols
+const (
+	ProtocolDoH = "doh"
+	ProtocolDoT = "dot"
+)
+
+// Block responses
+const (
+	BlockResponseNXDomain = "nxdomain"
+	BlockResponseNull     = "null"
+)
@@ -0,0 +1,153 @@
+package dnsserver
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// blocklist is a set of blocked domains. Hosts-file and plain entries block
+// exactly the listed name, AdBlock "||domain^" rules also block subdomains
+// and "@@||domain^" exceptions unblock them again.
+type blocklist struct {
+	exact      map[string]struct{}
+	suffix     map[string]struct{}
+	exceptions map[string]struct{}
+}
+
+func loadBlocklist(path string) (*blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	l := &blocklist{
+		exact:      make(map[string]struct{}),
+		suffix:     make(map[string]struct{}),
+		exceptions: make(map[string]struct{}),
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		l.parseLine(strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *blocklist) parseLine(line string) {
+	if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+		return
+	}
+	// AdBlock network rules; cosmetic and path rules do not apply to DNS
+	if rule, isException := strings.CutPrefix(line, "@@"); strings.HasPrefix(rule, "||") {
+		rule, _, _ = strings.Cut(rule[2:], "$")
+		rule = strings.TrimSuffix(rule, "^")
+		if !validDomain(rule) {
+			return
+		}
+		if isException {
+			l.exceptions[normalize(rule)] = struct{}{}
+		} else {
+			l.suffix[normalize(rule)] = struct{}{}
+		}
+		return
+	}
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	// Hosts file: address followed by names
+	if _, err := netip.ParseAddr(fields[0]); err == nil {
+		fields = fields[1:]
+	} else if len(fields) > 1 {
+		return
+	}
+	for _, name := range fields {
+		if validDomain(name) && name != "localhost" && !strings.HasPrefix(name, "localhost.") {
+			l.exact[normalize(name)] = struct{}{}
+		}
+	}
+}
+
+func (l *blocklist) size() int {
+	return len(l.exact) + len(l.suffix)
+}
+
+// blocked reports whether domain (normalized) is blocked
+func (l *blocklist) blocked(domain string) bool {
+	if _, found := l.exact[domain]; found && !matchSuffix(l.exceptions, domain) {
+		return true
+	}
+	return matchSuffix(l.suffix, domain) && !matchSuffix(l.exceptions, domain)
+}
+
+// matchSuffix reports whether domain or one of its parents is in set
+func matchSuffix(set map[string]struct{}, domain string) bool {
+	for {
+		if _, found := set[domain]; found {
+			return true
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			return false
+		}
+		domain = parent
+	}
+}
+
+func normalize(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func validDomain(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/*:?=&")
+}
+
+// filter combines the named lists with the allow list
+type filter struct {
+	lists map[string]*blocklist
+	allow map[string]struct{}
+}
+
+func newFilter(entries []BlocklistEntry, allow []string) (*filter, error) {
+	f := &filter{
+		lists: make(map[string]*blocklist),
+		allow: make(map[string]struct{}),
+	}
+	for _, entry := range entries {
+		if entry.Tag == "" {
+			return nil, fmt.Errorf("blocklist %s: missing tag", entry.Path)
+		}
+		if _, exists := f.lists[entry.Tag]; exists {
+			return nil, fmt.Errorf("duplicate blocklist tag: %s", entry.Tag)
+		}
+		list, err := loadBlocklist(entry.Path)
+		if err != nil {
+			return nil, fmt.Errorf("blocklist %s: %w", entry.Tag, err)
+		}
+		f.lists[entry.Tag] = list
+	}
+	for _, domain := range allow {
+		f.allow[normalize(domain)] = struct{}{}
+	}
+	return f, nil
+}
+
+// blocked returns the tag of the first list in tags that blocks domain
+func (f *filter) blocked(domain string, tags []string) (string, bool) {
+	domain = normalize(domain)
+	if matchSuffix(f.allow, domain) {
+		return "", false
+	}
+	for _, tag := range tags {
+		if f.lists[tag].blocked(domain) {
+			return tag, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,208 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/service"
+)
+
+// policy is the filtering and upstream selection applied to a client
+type policy struct {
+	name      string
+	prefixes  []netip.Prefix
+	block     []string
+	filtering bool
+	upstreams []upstream
+}
+
+// resolver applies client policies and answers through the DNS router
+type resolver struct {
+	ctx           context.Context
+	logger        log.ContextLogger
+	opts          DNSServerOptions
+	filter        *filter
+	defaultPolicy policy
+	policies      []policy
+	router        adapter.DNSRouter
+	transports    adapter.DNSTransportManager
+	cache         *cache // nil when disabled
+}
+
+func newResolver(ctx context.Context, logger log.ContextLogger, opts DNSServerOptions) (*resolver, error) {
+	switch opts.BlockResponse {
+	case "":
+		opts.BlockResponse = BlockResponseNXDomain
+	case BlockResponseNXDomain, BlockResponseNull:
+	default:
+		return nil, fmt.Errorf("unknown block_response: %s", opts.BlockResponse)
+	}
+	r := &resolver{
+		ctx:    ctx,
+		logger: logger,
+		opts:   opts,
+		defaultPolicy: policy{
+			name:      "default",
+			block:     opts.Block,
+			filtering: true,
+		},
+	}
+	if opts.Cache == nil || !opts.Cache.Disabled {
+		if opts.Cache != nil && (opts.Cache.MaxEntries < 0 || opts.Cache.Stale < 0 || opts.Cache.Prefetch < 0) {
+			return nil, fmt.Errorf("cache: max_entries, stale and prefetch must not be negative")
+		}
+		r.cache = newCache(opts.Cache)
+	}
+	var err error
+	r.defaultPolicy.upstreams, err = newUpstreams(opts.Upstream, opts.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	if r.defaultPolicy.block == nil {
+		for _, entry := range opts.Blocklists {
+			r.defaultPolicy.block = append(r.defaultPolicy.block, entry.Tag)
+		}
+	}
+	for index, client := range opts.Clients {
+		p := policy{
+			name:      client.Name,
+			block:     client.Block,
+			filtering: !client.DisableFiltering,
+		}
+		if p.name == "" {
+			p.name = fmt.Sprint("client[", index, "]")
+		}
+		if p.block == nil {
+			p.block = r.defaultPolicy.block
+		}
+		p.upstreams, err = newUpstreams(client.Upstream, client.Upstreams)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.name, err)
+		}
+		if p.upstreams == nil {
+			p.upstreams = r.defaultPolicy.upstreams
+		}
+		if len(client.SourceIPCIDR) == 0 {
+			return nil, fmt.Errorf("%s: missing source_ip_cidr", p.name)
+		}
+		for _, value := range client.SourceIPCIDR {
+			prefix, err := parsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p.name, err)
+			}
+			p.prefixes = append(p.prefixes, prefix)
+		}
+		r.policies = append(r.policies, p)
+	}
+	return r, nil
+}
+
+// start loads the block lists and checks the referenced DNS servers
+func (r *resolver) start() error {
+	r.router = service.FromContext[adapter.DNSRouter](r.ctx)
+	r.transports = service.FromContext[adapter.DNSTransportManager](r.ctx)
+	if r.router == nil || r.transports == nil {
+		return fmt.Errorf("DNS router not available")
+	}
+	f, err := newFilter(r.opts.Blocklists, r.opts.Allow)
+	if err != nil {
+		return err
+	}
+	for _, p := range append([]policy{r.defaultPolicy}, r.policies...) {
+		for _, tag := range p.block {
+			if _, loaded := f.lists[tag]; !loaded {
+				return fmt.Errorf("%s: blocklist not found: %s", p.name, tag)
+			}
+		}
+		if err := r.checkUpstreams(p.upstreams); err != nil {
+			return fmt.Errorf("%s: %w", p.name, err)
+		}
+	}
+	for tag, list := range f.lists {
+		r.logger.Info("loaded blocklist ", tag, ": ", list.size(), " rules")
+	}
+	r.filter = f
+	return nil
+}
+
+func (r *resolver) policyFor(client netip.Addr) *policy {
+	for index := range r.policies {
+		for _, prefix := range r.policies[index].prefixes {
+			if prefix.Contains(client) {
+				return &r.policies[index]
+			}
+		}
+	}
+	return &r.defaultPolicy
+}
+
+// exchange answers a packed query with a packed response
+func (r *resolver) exchange(ctx context.Context, client netip.Addr, query []byte) ([]byte, error) {
+	var message dns.Msg
+	if err := message.Unpack(query); err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	if len(message.Question) != 1 {
+		return reply(&message, dns.RcodeFormatError).Pack()
+	}
+	p := r.policyFor(client)
+	name := message.Question[0].Name
+	if p.filtering {
+		if list, blocked := r.filter.blocked(name, p.block); blocked {
+			r.logger.DebugContext(ctx, "blocked ", strings.TrimSuffix(name, "."), " for ", p.name, " (", client, ") by ", list)
+			return r.blockedReply(&message).Pack()
+		}
+	}
+	response, err := r.resolveCached(ctx, p, &message)
+	if err != nil {
+		r.logger.DebugContext(ctx, "exchange ", strings.TrimSuffix(name, "."), ": ", err)
+		return reply(&message, dns.RcodeServerFailure).Pack()
+	}
+	response.Id = message.Id
+	return response.Pack()
+}
+
+func (r *resolver) blockedReply(message *dns.Msg) *dns.Msg {
+	if r.opts.BlockResponse == BlockResponseNXDomain {
+		return reply(message, dns.RcodeNameError)
+	}
+	response := reply(message, dns.RcodeSuccess)
+	question := message.Question[0]
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch question.Qtype {
+	case dns.TypeA:
+		response.Answer = append(response.Answer, &dns.A{Hdr: header, A: netip.IPv4Unspecified().AsSlice()})
+	case dns.TypeAAAA:
+		response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: netip.IPv6Unspecified().AsSlice()})
+	}
+	return response
+}
+
+func reply(message *dns.Msg, rcode int) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetRcode(message, rcode)
+	response.RecursionAvailable = true
+	return response
+}
+
+// parsePrefix accepts a CIDR prefix or a single address
+func parsePrefix(value string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid source_ip_cidr value: %s", value)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
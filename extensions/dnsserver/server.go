@@ -0,0 +1,290 @@
+package dnsserver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/listener"
+	"github.com/sagernet/sing-box/log"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+const (
+	defaultPath      = "/dns-query"
+	idleTimeout      = 30 * time.Second
+	queryTimeout     = 10 * time.Second
+	maxMessageLength = 65535
+)
+
+// Inbound serves DNS over HTTPS or DNS over TLS, answering through the
+// Sing-box DNS router after applying the client's filtering policy
+type Inbound struct {
+	ctx       context.Context
+	tag       string
+	opts      DNSServerOptions
+	logger    log.ContextLogger
+	listener  *listener.Listener
+	tlsConfig *tlsconfig.ServerConfig
+	resolver  *resolver
+	http      *http.Server
+	conns     *connListener
+}
+
+// NewInbound creates a new DNS server inbound
+func NewInbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts DNSServerOptions) (adapter.Inbound, error) {
+	switch opts.Protocol {
+	case "":
+		opts.Protocol = ProtocolDoH
+	case ProtocolDoH, ProtocolDoT:
+	default:
+		return nil, fmt.Errorf("unknown protocol: %s", opts.Protocol)
+	}
+	if opts.Path == "" {
+		opts.Path = defaultPath
+	}
+	if !strings.HasPrefix(opts.Path, "/") {
+		return nil, fmt.Errorf("path must start with /")
+	}
+	r, err := newResolver(ctx, logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	i := &Inbound{
+		ctx:      ctx,
+		tag:      tag,
+		opts:     opts,
+		logger:   logger,
+		resolver: r,
+	}
+	if opts.TLS != nil {
+		tlsOptions := *opts.TLS
+		if len(tlsOptions.ALPN) == 0 {
+			if opts.Protocol == ProtocolDoT {
+				tlsOptions.ALPN = []string{"dot"}
+			} else {
+				tlsOptions.ALPN = []string{"http/1.1"}
+			}
+		}
+		i.tlsConfig, err = tlsconfig.NewServer(ctx, logger, tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Protocol == ProtocolDoH {
+		mux := http.NewServeMux()
+		mux.HandleFunc(opts.Path, i.serveHTTP)
+		i.http = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: queryTimeout,
+			IdleTimeout:       idleTimeout,
+		}
+		i.conns = newConnListener()
+	}
+	i.listener = listener.New(listener.Options{
+		Context:           ctx,
+		Logger:            logger,
+		Network:           []string{N.NetworkTCP},
+		Listen:            opts.ListenOptions,
+		ConnectionHandler: i,
+	})
+	return i, nil
+}
+
+func (i *Inbound) Type() string {
+	return "dns-server"
+}
+
+func (i *Inbound) Tag() string {
+	return i.tag
+}
+
+func (i *Inbound) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	if err := i.resolver.start(); err != nil {
+		return err
+	}
+	if i.tlsConfig != nil {
+		if err := i.tlsConfig.Start(); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	if i.http != nil {
+		go i.http.Serve(i.conns)
+	}
+	return i.listener.Start()
+}
+
+func (i *Inbound) Close() error {
+	i.listener.Close()
+	if i.http != nil {
+		i.http.Close()
+	}
+	if i.tlsConfig != nil {
+		i.tlsConfig.Close()
+	}
+	return nil
+}
+
+func (i *Inbound) NewConnectionEx(ctx context.Context, conn net.Conn, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	if i.tlsConfig != nil {
+		tlsConn, err := i.tlsConfig.Handshake(ctx, conn)
+		if err != nil {
+			i.logger.DebugContext(ctx, "TLS handshake from ", metadata.Source, ": ", err)
+			N.CloseOnHandshakeFailure(conn, onClose, err)
+			return
+		}
+		conn = tlsConn
+	}
+	conn = &trackedConn{Conn: conn, onClose: onClose}
+	if i.http != nil {
+		i.conns.push(conn)
+		return
+	}
+	i.serveStream(ctx, conn, metadata.Source.Addr.Unmap())
+}
+
+// serveStream answers length-prefixed queries (RFC 7858) until the client
+// goes idle
+func (i *Inbound) serveStream(ctx context.Context, conn net.Conn, client netip.Addr) {
+	defer conn.Close()
+	var writeAccess sync.Mutex
+	var header [2]byte
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(header[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		// Queries are answered concurrently; responses may arrive out of order
+		go func() {
+			response, err := i.resolver.exchange(ctx, client, query)
+			if err != nil {
+				i.logger.DebugContext(ctx, "query from ", client, ": ", err)
+				return
+			}
+			buffer := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(response)), uint16(len(response)))
+			writeAccess.Lock()
+			defer writeAccess.Unlock()
+			conn.Write(append(buffer, response...))
+		}()
+	}
+}
+
+// serveHTTP answers RFC 8484 GET and POST requests
+func (i *Inbound) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		query, err = decodeBase64URL(r.URL.Query().Get("dns"))
+		if err != nil || len(query) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		query, err = io.ReadAll(io.LimitReader(r.Body, maxMessageLength+1))
+		if err != nil || len(query) == 0 || len(query) > maxMessageLength {
+			http.Error(w, "invalid message", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client := netip.Addr{}
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		client = addrPort.Addr().Unmap()
+	}
+	response, err := i.resolver.exchange(r.Context(), client, query)
+	if err != nil {
+		i.logger.DebugContext(r.Context(), "query from ", client, ": ", err)
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(response)
+}
+
+// connListener hands connections accepted by the Sing-box listener to the
+// HTTP server
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// trackedConn reports the end of the connection to the listener
+type trackedConn struct {
+	net.Conn
+	onClose N.CloseHandlerFunc
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if c.onClose != nil {
+			c.onClose(nil)
+		}
+	})
+	return err
+}
+
+func (c *trackedConn) Upstream() any {
+	return c.Conn
+}
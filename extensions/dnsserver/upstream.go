@@ -0,0 +1,150 @@
+package dnsserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sagernet/sing-box/adapter"
+)
+
+// defaultUpstreamTimeout bounds an attempt of an upstreams entry
+const defaultUpstreamTimeout = 5 * time.Second
+
+// upstream is a DNS server of a policy with its retry policy
+type upstream struct {
+	server      string
+	timeout     time.Duration
+	attempts    int
+	tcpFallback string
+}
+
+// newUpstreams returns the DNS servers of a policy: the upstreams list, a
+// single attempt of upstream, or nil to answer by the DNS rules
+func newUpstreams(single string, list []UpstreamOptions) ([]upstream, error) {
+	if len(list) == 0 {
+		if single == "" {
+			return nil, nil
+		}
+		return []upstream{{server: single, timeout: queryTimeout, attempts: 1}}, nil
+	}
+	if single != "" {
+		return nil, fmt.Errorf("upstream and upstreams cannot be combined")
+	}
+	upstreams := make([]upstream, 0, len(list))
+	for index, entry := range list {
+		if entry.Server == "" {
+			return nil, fmt.Errorf("upstreams[%d]: missing server", index)
+		}
+		if entry.Timeout < 0 || entry.Retries < 0 {
+			return nil, fmt.Errorf("upstreams[%d]: timeout and retries must not be negative", index)
+		}
+		u := upstream{
+			server:      entry.Server,
+			timeout:     time.Duration(entry.Timeout),
+			attempts:    1 + entry.Retries,
+			tcpFallback: entry.TCPFallback,
+		}
+		if u.timeout == 0 {
+			u.timeout = defaultUpstreamTimeout
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+// checkUpstreams fails on a DNS server of upstreams that is not configured
+func (r *resolver) checkUpstreams(upstreams []upstream) error {
+	for _, u := range upstreams {
+		for _, tag := range []string{u.server, u.tcpFallback} {
+			if tag == "" {
+				continue
+			}
+			if _, loaded := r.transports.Transport(tag); !loaded {
+				return fmt.Errorf("DNS server not found: %s", tag)
+			}
+		}
+	}
+	return nil
+}
+
+// resolve answers message through the upstreams of p in order, or through
+// the DNS rules when p has none. A server that fails every attempt or answers
+// SERVFAIL passes the query to the next one; when none answers better, the
+// last SERVFAIL or truncated response is returned, else the last error.
+func (r *resolver) resolve(ctx context.Context, p *policy, message *dns.Msg) (*dns.Msg, error) {
+	if len(p.upstreams) == 0 {
+		ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+		return r.router.Exchange(ctx, message, adapter.DNSQueryOptions{})
+	}
+	name := strings.TrimSuffix(message.Question[0].Name, ".")
+	var (
+		fallback *dns.Msg
+		lastErr  error
+	)
+	for _, u := range p.upstreams {
+		response, err := r.exchangeUpstream(ctx, u, message)
+		switch {
+		case err != nil:
+			r.logger.DebugContext(ctx, "exchange ", name, " via ", u.server, ": ", err)
+			lastErr = err
+		case response.Rcode == dns.RcodeServerFailure:
+			r.logger.DebugContext(ctx, "exchange ", name, " via ", u.server, ": SERVFAIL")
+			if fallback == nil {
+				fallback = response
+			}
+		case response.Truncated:
+			r.logger.DebugContext(ctx, "exchange ", name, " via ", u.server, ": truncated")
+			if fallback == nil || fallback.Rcode == dns.RcodeServerFailure {
+				fallback = response
+			}
+		default:
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, lastErr
+}
+
+// exchangeUpstream sends message to u, and again to its TCP fallback when
+// the response is truncated
+func (r *resolver) exchangeUpstream(ctx context.Context, u upstream, message *dns.Msg) (*dns.Msg, error) {
+	response, err := r.attempt(ctx, u, u.server, message)
+	if err != nil || !response.Truncated || u.tcpFallback == "" {
+		return response, err
+	}
+	r.logger.DebugContext(ctx, "response truncated, retrying via ", u.tcpFallback)
+	return r.attempt(ctx, u, u.tcpFallback, message)
+}
+
+// attempt sends message to server up to u.attempts times, each bounded by
+// u.timeout. Responses, SERVFAIL included, end the attempts; errors and
+// timeouts do not.
+func (r *resolver) attempt(ctx context.Context, u upstream, server string, message *dns.Msg) (*dns.Msg, error) {
+	transport, loaded := r.transports.Transport(server)
+	if !loaded {
+		return nil, fmt.Errorf("DNS server not found: %s", server)
+	}
+	var err error
+	for range u.attempts {
+		attemptCtx, cancel := context.WithTimeout(ctx, u.timeout)
+		var response *dns.Msg
+		response, err = r.router.Exchange(attemptCtx, message.Copy(), adapter.DNSQueryOptions{Transport: transport})
+		cancel()
+		if err == nil {
+			return response, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,21 @@
+package egresscheck
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// EgressCheckOptions defines the configuration for the egress-check service
+type EgressCheckOptions struct {
+	Outbounds []string           `json:"outbounds,omitempty"` // Outbounds to check (default: every outbound with a server, groups excluded)
+	Provider  string             `json:"provider,omitempty"`  // URL answering with the requesting address (default https://ipinfo.io/json)
+	Interval  badoption.Duration `json:"interval,omitempty"`  // Time between checks (default 30m)
+	Timeout   badoption.Duration `json:"timeout,omitempty"`   // Timeout of one check (default 15s)
+	History   int                `json:"history,omitempty"`   // Exits kept per outbound (default 10)
+	Alert     string             `json:"alert,omitempty"`     // "country" (default) or "ip": changes logged as warnings
+}
+
+// Alerts
+const (
+	AlertCountry = "country"
+	AlertIP      = "ip"
+)
@@ -0,0 +1,363 @@
+package egresscheck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/json/badoption"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/egress"
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+const (
+	// DefaultProvider answers with the address and country of the requester
+	DefaultProvider   = "https://ipinfo.io/json"
+	defaultInterval   = 30 * time.Minute
+	defaultTimeout    = 15 * time.Second
+	defaultHistory    = 10
+	maxParallelChecks = 10
+	maxResponseSize   = 4096
+)
+
+// Service asks an IP-info provider, through each checked outbound, which
+// address the outbound exits from. A change of exit is logged, so silent
+// failover to another server or transparent interception on the path is
+// noticed; the exits seen are kept in the state directory.
+type Service struct {
+	boxService.Adapter
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    log.ContextLogger
+	opts      EgressCheckOptions
+	path      string
+	outbounds adapter.OutboundManager
+	endpoints adapter.EndpointManager
+
+	access    sync.Mutex
+	histories map[string]egress.History
+}
+
+// HistoryPath returns the file keeping the exits seen by the tenant of ctx
+func HistoryPath(ctx context.Context) string {
+	return state.PathContext(ctx, "egress.json")
+}
+
+// NewService creates the egress-check service
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts EgressCheckOptions) (adapter.Service, error) {
+	if opts.Provider == "" {
+		opts.Provider = DefaultProvider
+	}
+	if provider, err := url.Parse(opts.Provider); err != nil || (provider.Scheme != "http" && provider.Scheme != "https") {
+		return nil, fmt.Errorf("egress-check: provider must be an http or https URL")
+	}
+	switch opts.Alert {
+	case "":
+		opts.Alert = AlertCountry
+	case AlertCountry, AlertIP:
+	default:
+		return nil, fmt.Errorf("egress-check: unknown alert %q: expected country or ip", opts.Alert)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = badoption.Duration(defaultInterval)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = badoption.Duration(defaultTimeout)
+	}
+	if opts.History <= 0 {
+		opts.History = defaultHistory
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Service{
+		Adapter:   boxService.NewAdapter("egress-check", tag),
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    logger,
+		opts:      opts,
+		path:      HistoryPath(ctx),
+		outbounds: service.FromContext[adapter.OutboundManager](ctx),
+		endpoints: service.FromContext[adapter.EndpointManager](ctx),
+		histories: make(map[string]egress.History),
+	}, nil
+}
+
+// Start restores the exits seen by previous runs, so a change across a
+// restart is noticed too, and begins checking once every outbound has
+// started
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStarted {
+		return nil
+	}
+	if err := s.restore(); err != nil {
+		s.logger.Warn("restore exit history: ", err)
+	}
+	go s.loop()
+	return nil
+}
+
+func (s *Service) Close() error {
+	s.cancel()
+	s.access.Lock()
+	defer s.access.Unlock()
+	for tag := range s.histories {
+		egress.Delete(tag)
+	}
+	return nil
+}
+
+func (s *Service) restore() error {
+	content, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []egress.History
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return fmt.Errorf("damaged state %s: %w", s.path, err)
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	for _, history := range saved {
+		history.Error = ""
+		s.histories[history.Outbound] = history
+		egress.Store(history)
+	}
+	return nil
+}
+
+func (s *Service) save() error {
+	s.access.Lock()
+	saved := make([]egress.History, 0, len(s.histories))
+	for _, history := range s.histories {
+		saved = append(saved, history)
+	}
+	s.access.Unlock()
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(s.path, content, 0o600)
+	}
+	return err
+}
+
+func (s *Service) loop() {
+	ticker := time.NewTicker(time.Duration(s.opts.Interval))
+	defer ticker.Stop()
+	for {
+		s.checkAll()
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll checks the outbounds, which are looked up again on every round
+// since subscriptions add and remove them
+func (s *Service) checkAll() {
+	targets := s.targets()
+	s.access.Lock()
+	for tag := range s.histories {
+		if _, checked := targets[tag]; !checked {
+			delete(s.histories, tag)
+			egress.Delete(tag)
+		}
+	}
+	s.access.Unlock()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxParallelChecks)
+	for tag, outbound := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ip, country, err := s.check(outbound)
+			if s.ctx.Err() == nil {
+				s.record(tag, ip, country, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if s.ctx.Err() == nil {
+		if err := s.save(); err != nil {
+			s.logger.Warn("save exit history: ", err)
+		}
+	}
+}
+
+// targets returns the outbounds to check by tag
+func (s *Service) targets() map[string]adapter.Outbound {
+	targets := make(map[string]adapter.Outbound)
+	if s.outbounds == nil {
+		return targets
+	}
+	if len(s.opts.Outbounds) > 0 {
+		for _, tag := range s.opts.Outbounds {
+			if outbound, loaded := s.outbounds.Outbound(tag); loaded {
+				targets[tag] = outbound
+			}
+		}
+		return targets
+	}
+	all := s.outbounds.Outbounds()
+	if s.endpoints != nil {
+		for _, endpoint := range s.endpoints.Endpoints() {
+			all = append(all, endpoint)
+		}
+	}
+	for _, outbound := range all {
+		if _, isGroup := outbound.(adapter.OutboundGroup); isGroup {
+			continue
+		}
+		switch outbound.Type() {
+		case C.TypeDirect, C.TypeBlock, C.TypeDNS:
+			continue
+		}
+		targets[outbound.Tag()] = outbound
+	}
+	return targets
+}
+
+// check asks the provider, through outbound, for the address and country
+// it exits from
+func (s *Service) check(outbound adapter.Outbound) (string, string, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, time.Duration(s.opts.Timeout))
+	defer cancel()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return outbound.DialContext(ctx, network, metadata.ParseSocksaddr(addr))
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.opts.Provider, nil)
+	if err != nil {
+		return "", "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, maxResponseSize))
+	if err != nil {
+		return "", "", err
+	}
+	return parseExit(content)
+}
+
+// record adds the result of a check to the history of tag and logs a change
+// of exit, as a warning when it is one alert asks for
+func (s *Service) record(tag string, ip string, country string, err error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	history, loaded := s.histories[tag]
+	if !loaded {
+		history = egress.History{Outbound: tag}
+	}
+	now := time.Now()
+	if err != nil {
+		history.Error = err.Error()
+		s.logger.Debug("egress check through ", tag, " failed: ", err)
+		s.store(history)
+		return
+	}
+	history.Error = ""
+	current, seen := history.Current()
+	switch {
+	case seen && current.IP == ip && current.Country == country:
+		history.Exits[len(history.Exits)-1].Checked = now
+		s.store(history)
+		return
+	case !seen:
+		s.logger.Info("outbound ", tag, " exits from ", describeExit(ip, country))
+	case current.Country != country && current.Country != "" && country != "":
+		s.logger.Warn("exit country of outbound ", tag, " changed from ", describeExit(current.IP, current.Country), " to ", describeExit(ip, country))
+	case s.opts.Alert == AlertIP:
+		s.logger.Warn("exit of outbound ", tag, " changed from ", describeExit(current.IP, current.Country), " to ", describeExit(ip, country))
+	default:
+		s.logger.Info("exit of outbound ", tag, " changed from ", describeExit(current.IP, current.Country), " to ", describeExit(ip, country))
+	}
+	history.Exits = append(history.Exits, egress.Exit{IP: ip, Country: country, Since: now, Checked: now})
+	if excess := len(history.Exits) - s.opts.History; excess > 0 {
+		history.Exits = append([]egress.Exit(nil), history.Exits[excess:]...)
+	}
+	s.store(history)
+}
+
+func (s *Service) store(history egress.History) {
+	s.histories[history.Outbound] = history
+	egress.Store(history)
+}
+
+func describeExit(ip string, country string) string {
+	if country == "" {
+		return ip
+	}
+	return ip + " (" + country + ")"
+}
+
+// parseExit reads the address and country from a provider answer. Plain
+// text answers hold the address alone; JSON answers name it "ip" (ipinfo.io,
+// ipify) or "query" (ip-api.com), and the country "country_code",
+// "countryCode" or "country".
+func parseExit(content []byte) (string, string, error) {
+	text := strings.TrimSpace(string(content))
+	var country string
+	if strings.HasPrefix(text, "{") {
+		var info struct {
+			IP               string `json:"ip"`
+			Query            string `json:"query"`
+			Country          string `json:"country"`
+			CountryCode      string `json:"country_code"`
+			CountryCodeCamel string `json:"countryCode"`
+		}
+		if err := json.Unmarshal(content, &info); err != nil {
+			return "", "", fmt.Errorf("invalid provider response: %w", err)
+		}
+		text = info.IP
+		if text == "" {
+			text = info.Query
+		}
+		for _, candidate := range []string{info.CountryCode, info.CountryCodeCamel, info.Country} {
+			if len(candidate) == 2 {
+				country = strings.ToUpper(candidate)
+				break
+			}
+		}
+	}
+	addr, err := netip.ParseAddr(text)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid address in provider response: %q", text)
+	}
+	return addr.Unmap().String(), country, nil
+}
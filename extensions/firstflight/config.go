@@ -0,0 +1,16 @@
+package firstflight
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// FirstFlightOptions defines the configuration for the first-flight service
+type FirstFlightOptions struct {
+	Profile    string             `json:"profile,omitempty"`     // fragment, mtu or random (default mtu)
+	MinSegment int                `json:"min_segment,omitempty"` // Overrides the smallest segment of the profile
+	MaxSegment int                `json:"max_segment,omitempty"` // Overrides the largest segment of the profile
+	MinFlight  int                `json:"min_flight,omitempty"`  // Overrides the smallest padded first message
+	MaxFlight  int                `json:"max_flight,omitempty"`  // Overrides the largest padded first message
+	Limit      int                `json:"limit,omitempty"`       // Overrides the bytes shaped per connection
+	Delay      badoption.Duration `json:"delay,omitempty"`       // Overrides the pause between segments
+}
@@ -0,0 +1,74 @@
+package firstflight
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/log"
+
+	"github.com/UTPBox/utp-core/internal/shaping"
+)
+
+// Service puts a first-flight policy in force for the extension outbounds
+// of the instance (see internal/shaping)
+type Service struct {
+	boxService.Adapter
+	logger log.ContextLogger
+	policy *shaping.Policy
+}
+
+// NewService creates the first-flight service
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts FirstFlightOptions) (adapter.Service, error) {
+	if opts.Profile == "" {
+		opts.Profile = shaping.DefaultProfile
+	}
+	policy, loaded := shaping.Profiles[opts.Profile]
+	if !loaded {
+		return nil, fmt.Errorf("unknown first-flight profile: %s", opts.Profile)
+	}
+	if opts.MinSegment > 0 {
+		policy.MinSegment = opts.MinSegment
+	}
+	if opts.MaxSegment > 0 {
+		policy.MaxSegment = opts.MaxSegment
+	}
+	if opts.MinFlight > 0 {
+		policy.MinFlight = opts.MinFlight
+	}
+	if opts.MaxFlight > 0 {
+		policy.MaxFlight = opts.MaxFlight
+	}
+	if opts.Limit > 0 {
+		policy.Limit = opts.Limit
+	}
+	if opts.Delay > 0 {
+		policy.Delay = time.Duration(opts.Delay)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("first-flight profile %s: %w", opts.Profile, err)
+	}
+	return &Service{
+		Adapter: boxService.NewAdapter("first-flight", tag),
+		logger:  logger,
+		policy:  &policy,
+	}, nil
+}
+
+// Start puts the policy in force before outbounds start dialing
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	shaping.SetPolicy(s.policy)
+	s.logger.Info("shaping first flights: segments ", s.policy.MinSegment, "-", s.policy.MaxSegment,
+		" bytes over the first ", s.policy.Limit, " bytes")
+	return nil
+}
+
+func (s *Service) Close() error {
+	shaping.ClearPolicy(s.policy)
+	return nil
+}
@@ -0,0 +1,237 @@
+package group
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/blacklist"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/health"
+	"github.com/UTPBox/utp-core/internal/limiter"
+)
+
+var _ adapter.OutboundGroup = (*Outbound)(nil)
+
+// Outbound spreads connections over its member outbounds. With sticky
+// routing, a destination keeps leaving through the member that last served
+// it until the pin expires or that member fails. With exit_country, only
+// members known to exit in one of the countries are used, so route rules can
+// select an exit country by targeting the group.
+type Outbound struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	tag       string
+	opts      LoadBalanceOptions
+	logger    log.ContextLogger
+	manager   adapter.OutboundManager
+	limiter   *limiter.Limiter
+	blacklist *blacklist.List
+	affinity  *affinity
+	countries *exitCountries
+	exit      []string
+	next      atomic.Uint32
+	last      atomic.Value // string, member of the latest successful dial
+}
+
+// NewOutbound creates a new load-balance group
+func NewOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts LoadBalanceOptions) (adapter.Outbound, error) {
+	if len(opts.Outbounds) == 0 {
+		return nil, fmt.Errorf("load-balance group requires at least one outbound")
+	}
+	switch opts.Strategy {
+	case "", StrategyRoundRobin, StrategyRandom:
+	default:
+		return nil, fmt.Errorf("unknown load-balance strategy: %s", opts.Strategy)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	o := &Outbound{
+		ctx:       ctx,
+		cancel:    cancel,
+		tag:       tag,
+		opts:      opts,
+		logger:    logger,
+		manager:   service.FromContext[adapter.OutboundManager](ctx),
+		limiter:   limiter.New(opts.Options),
+		blacklist: blacklist.ForContext(ctx),
+		countries: newExitCountries(opts.Countries),
+	}
+	for _, country := range opts.ExitCountry {
+		o.exit = append(o.exit, strings.ToUpper(country))
+	}
+	if opts.Sticky != nil {
+		switch opts.Sticky.Key {
+		case "", StickyKeyHost, StickyKeyPrefix:
+		default:
+			return nil, fmt.Errorf("unknown sticky key: %s", opts.Sticky.Key)
+		}
+		o.affinity = newAffinity(*opts.Sticky)
+	}
+	return o, nil
+}
+
+func (o *Outbound) Type() string {
+	return "load-balance"
+}
+
+func (o *Outbound) Tag() string {
+	return o.tag
+}
+
+func (o *Outbound) Dependencies() []string {
+	return o.opts.Outbounds
+}
+
+func (o *Outbound) Network() []string {
+	return []string{"tcp", "udp"}
+}
+
+func (o *Outbound) Start() error {
+	if o.opts.ProbeCountry {
+		go o.probeCountries(o.ctx)
+	}
+	return nil
+}
+
+func (o *Outbound) Close() error {
+	o.cancel()
+	return nil
+}
+
+// Country returns the known exit country of member, or ""
+func (o *Outbound) Country(member string) string {
+	return o.countries.Country(member)
+}
+
+// Now returns the member that served the latest connection
+func (o *Outbound) Now() string {
+	if member, ok := o.last.Load().(string); ok {
+		return member
+	}
+	return o.opts.Outbounds[0]
+}
+
+// All returns the member tags
+func (o *Outbound) All() []string {
+	return o.opts.Outbounds
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	var conn net.Conn
+	err = o.tryMembers(ctx, destination, func(member adapter.Outbound) error {
+		var err error
+		conn, err = member.DialContext(ctx, network, destination)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	var conn net.PacketConn
+	err = o.tryMembers(ctx, destination, func(member adapter.Outbound) error {
+		var err error
+		conn, err = member.ListenPacket(ctx, destination)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapPacketConn(conn, release), nil
+}
+
+// tryMembers calls dial with the pinned member first, then with the others
+// in strategy order, until one succeeds
+func (o *Outbound) tryMembers(ctx context.Context, destination metadata.Socksaddr, dial func(member adapter.Outbound) error) error {
+	if o.manager == nil {
+		return fmt.Errorf("outbound manager not available")
+	}
+	order := o.order(destination)
+	if len(order) == 0 {
+		return fmt.Errorf("no member known to exit in %s", strings.Join(o.exit, ", "))
+	}
+	var lastErr error
+	for _, tag := range order {
+		member, loaded := o.manager.Outbound(tag)
+		if !loaded {
+			lastErr = fmt.Errorf("outbound not found: %s", tag)
+			continue
+		}
+		err := dial(member)
+		if err == nil {
+			o.blacklist.Success(memberKey(tag))
+			o.last.Store(tag)
+			if o.affinity != nil {
+				o.affinity.Store(destination, tag)
+			}
+			return nil
+		}
+		lastErr = err
+		o.logger.Debug("load-balance[", o.tag, "]: member ", tag, " failed: ", err)
+		if ctx.Err() != nil {
+			break
+		}
+		if ban := o.blacklist.Failure(memberKey(tag), err); ban > 0 {
+			o.logger.Info("load-balance[", o.tag, "]: member ", tag, " keeps failing, trying it last for ", ban)
+		}
+	}
+	return lastErr
+}
+
+// order returns the members to try for destination. Blacklisted members
+// and members the health check marked down come last, even when pinned.
+func (o *Outbound) order(destination metadata.Socksaddr) []string {
+	members := o.opts.Outbounds
+	var start int
+	if o.opts.Strategy == StrategyRandom {
+		start = rand.IntN(len(members))
+	} else {
+		start = int(o.next.Add(1)-1) % len(members)
+	}
+	order := make([]string, 0, len(members))
+	if o.affinity != nil {
+		if pinned, ok := o.affinity.Load(destination); ok && o.allowed(pinned) {
+			order = append(order, pinned)
+		}
+	}
+	for i := range members {
+		member := members[(start+i)%len(members)]
+		if (len(order) > 0 && order[0] == member) || !o.allowed(member) {
+			continue
+		}
+		order = append(order, member)
+	}
+	return health.Demote(blacklist.Demote(o.blacklist, order, memberKey))
+}
+
+// memberKey identifies a member in the blacklist
+func memberKey(tag string) string {
+	return "outbound/" + tag
+}
+
+// allowed reports whether member satisfies exit_country. Members whose
+// country is not known (yet) are not used while a country is required.
+func (o *Outbound) allowed(member string) bool {
+	return len(o.exit) == 0 || slices.Contains(o.exit, o.countries.Country(member))
+}
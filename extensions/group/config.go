@@ -0,0 +1,58 @@
+package group
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/limiter"
+)
+
+// LoadBalanceOptions defines the configuration for the load-balance group
+type LoadBalanceOptions struct {
+	Outbounds []string       `json:"outbounds"`          // Member outbound tags
+	Strategy  string         `json:"strategy,omitempty"` // "round-robin" (default) or "random"
+	Sticky    *StickyOptions `json:"sticky,omitempty"`   // Pin destinations to the member that served them
+
+	Countries    map[string]string `json:"countries,omitempty"`     // Static exit country (ISO 3166-1 alpha-2) per member tag
+	ProbeCountry bool              `json:"probe_country,omitempty"` // Look up the exit country of untagged members through them
+	ProbeURL     string            `json:"probe_url,omitempty"`     // IP-info service used for probing (default https://ipinfo.io/country)
+	ExitCountry  []string          `json:"exit_country,omitempty"`  // Only use members exiting in these countries
+
+	limiter.Options // max_connections / max_pending_dials
+}
+
+// FallbackOptions defines the configuration for the fallback group
+type FallbackOptions struct {
+	Outbounds []string           `json:"outbounds"`          // Member outbound tags, most preferred first
+	URL       string             `json:"url,omitempty"`      // Probe fetched through each member (default https://www.gstatic.com/generate_204)
+	Interval  badoption.Duration `json:"interval,omitempty"` // Time between probe rounds (default 3m)
+	Timeout   badoption.Duration `json:"timeout,omitempty"`  // Timeout of one probe (default 5s)
+
+	limiter.Options // max_connections / max_pending_dials
+}
+
+// ManualOptions defines the configuration for the manual group
+type ManualOptions struct {
+	Outbounds []string       `json:"outbounds"`         // Member outbound tags
+	Default   string         `json:"default,omitempty"` // Member selected until another is chosen (default: none, spread by weight)
+	Weights   map[string]int `json:"weights,omitempty"` // Share of connections per member while none is selected (default 1, 0 excludes)
+
+	limiter.Options // max_connections / max_pending_dials
+}
+
+// StickyOptions configures session affinity
+type StickyOptions struct {
+	TTL badoption.Duration `json:"ttl,omitempty"` // How long a destination stays pinned after its last use (default 10m)
+	Key string             `json:"key,omitempty"` // "host" (default) or "prefix" to pin IPv4 /24 and IPv6 /64 networks
+}
+
+// Balancing strategies
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyRandom     = "random"
+)
+
+// Sticky keys
+const (
+	StickyKeyHost   = "host"
+	StickyKeyPrefix = "prefix"
+)
@@ -0,0 +1,333 @@
+package group
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/urltest"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/health"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+const (
+	// DefaultFallbackInterval is the time between probe rounds
+	DefaultFallbackInterval = 3 * time.Minute
+	defaultProbeTimeout     = 5 * time.Second
+	maxParallelProbes       = 10
+	// minProbeSpacing bounds the rounds caused by failing dials
+	minProbeSpacing = 10 * time.Second
+)
+
+var _ adapter.OutboundGroup = (*Fallback)(nil)
+
+// Fallback sends connections through the first member, in configured
+// order, whose latest probe succeeded, and through the following ones when
+// a dial fails. Members are probed periodically and again after the
+// selected member fails. Results are shared with the urltest groups and the
+// Clash API, and kept in the state directory so a restart resumes with the
+// last working member instead of waiting for the first round.
+type Fallback struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	tag      string
+	opts     FallbackOptions
+	logger   log.ContextLogger
+	manager  adapter.OutboundManager
+	limiter  *limiter.Limiter
+	history  adapter.URLTestHistoryStorage
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	wake     chan struct{}
+	selected atomic.Value // string, member announced in the log
+}
+
+// fallbackState is the persisted probe results, by member
+type fallbackState struct {
+	History map[string]*adapter.URLTestHistory `json:"history"`
+}
+
+// NewFallback creates a new fallback group
+func NewFallback(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts FallbackOptions) (adapter.Outbound, error) {
+	if len(opts.Outbounds) == 0 {
+		return nil, fmt.Errorf("fallback group requires at least one outbound")
+	}
+	if opts.URL != "" {
+		if _, err := url.Parse(opts.URL); err != nil {
+			return nil, fmt.Errorf("fallback: invalid url: %w", err)
+		}
+	}
+	interval := time.Duration(opts.Interval)
+	if interval <= 0 {
+		interval = DefaultFallbackInterval
+	}
+	timeout := time.Duration(opts.Timeout)
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	var history adapter.URLTestHistoryStorage
+	if shared := service.PtrFromContext[urltest.HistoryStorage](ctx); shared != nil {
+		history = shared
+	} else {
+		history = urltest.NewHistoryStorage()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	f := &Fallback{
+		ctx:      ctx,
+		cancel:   cancel,
+		tag:      tag,
+		opts:     opts,
+		logger:   logger,
+		manager:  service.FromContext[adapter.OutboundManager](ctx),
+		limiter:  limiter.New(opts.Options),
+		history:  history,
+		path:     state.PathContext(ctx, "groups", url.PathEscape(tag)+".json"),
+		interval: interval,
+		timeout:  timeout,
+		wake:     make(chan struct{}, 1),
+	}
+	f.restore()
+	return f, nil
+}
+
+func (f *Fallback) Type() string {
+	return "fallback"
+}
+
+func (f *Fallback) Tag() string {
+	return f.tag
+}
+
+func (f *Fallback) Dependencies() []string {
+	return f.opts.Outbounds
+}
+
+func (f *Fallback) Network() []string {
+	return []string{"tcp", "udp"}
+}
+
+func (f *Fallback) Start() error {
+	return nil
+}
+
+// PostStart begins probing once the members have started
+func (f *Fallback) PostStart() error {
+	go f.loop()
+	return nil
+}
+
+func (f *Fallback) Close() error {
+	f.cancel()
+	return nil
+}
+
+// Now returns the first member whose latest probe succeeded and that the
+// health check has not marked down, or the first member when none did
+func (f *Fallback) Now() string {
+	for _, member := range f.opts.Outbounds {
+		if f.history.LoadURLTestHistory(member) != nil && !health.Down(member) {
+			return member
+		}
+	}
+	return f.opts.Outbounds[0]
+}
+
+// All returns the member tags
+func (f *Fallback) All() []string {
+	return f.opts.Outbounds
+}
+
+func (f *Fallback) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := f.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, f.tag, err)
+	}
+	var conn net.Conn
+	err = f.tryMembers(ctx, func(member adapter.Outbound) error {
+		var err error
+		conn, err = member.DialContext(ctx, network, destination)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, failure.Report(ctx, f.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+func (f *Fallback) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	release, err := f.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, f.tag, err)
+	}
+	var conn net.PacketConn
+	err = f.tryMembers(ctx, func(member adapter.Outbound) error {
+		var err error
+		conn, err = member.ListenPacket(ctx, destination)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, failure.Report(ctx, f.tag, err)
+	}
+	return limiter.WrapPacketConn(conn, release), nil
+}
+
+// tryMembers calls dial with the selected member, then with the others in
+// configured order, those marked down last, until one succeeds. A failing
+// member loses its probe result and a new round is requested.
+func (f *Fallback) tryMembers(ctx context.Context, dial func(member adapter.Outbound) error) error {
+	if f.manager == nil {
+		return fmt.Errorf("outbound manager not available")
+	}
+	selected := f.Now()
+	order := []string{selected}
+	for _, member := range health.Demote(f.opts.Outbounds) {
+		if member != selected {
+			order = append(order, member)
+		}
+	}
+	var lastErr error
+	for _, tag := range order {
+		member, loaded := f.manager.Outbound(tag)
+		if !loaded {
+			lastErr = fmt.Errorf("outbound not found: %s", tag)
+			continue
+		}
+		err := dial(member)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		f.logger.Debug("fallback[", f.tag, "]: member ", tag, " failed: ", err)
+		if ctx.Err() != nil {
+			break
+		}
+		if tag == selected && failure.Transient(failure.KindOf(err)) {
+			f.history.DeleteURLTestHistory(tag)
+			select {
+			case f.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return lastErr
+}
+
+// loop probes the members every interval, and when woken by a failure
+func (f *Fallback) loop() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		round := time.Now()
+		f.probe()
+		select {
+		case <-ticker.C:
+		case <-f.wake:
+			select {
+			case <-time.After(time.Until(round.Add(minProbeSpacing))):
+			case <-f.ctx.Done():
+				return
+			}
+		case <-f.ctx.Done():
+			return
+		}
+	}
+}
+
+// probe tests every member, logs a change of the selected member and saves
+// the results
+func (f *Fallback) probe() {
+	if f.manager == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxParallelProbes)
+	for _, tag := range f.opts.Outbounds {
+		member, loaded := f.manager.Outbound(tag)
+		if !loaded {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			ctx, cancel := context.WithTimeout(f.ctx, f.timeout)
+			defer cancel()
+			delay, err := urltest.URLTest(ctx, f.opts.URL, member)
+			if err != nil {
+				f.logger.Debug("fallback[", f.tag, "]: probe through ", tag, " failed: ", err)
+				f.history.DeleteURLTestHistory(tag)
+				return
+			}
+			f.history.StoreURLTestHistory(tag, &adapter.URLTestHistory{Time: time.Now(), Delay: delay})
+		}()
+	}
+	wg.Wait()
+	if f.ctx.Err() != nil {
+		return
+	}
+	selected := f.Now()
+	if previous, _ := f.selected.Swap(selected).(string); previous != selected {
+		if f.history.LoadURLTestHistory(selected) == nil {
+			f.logger.Warn("fallback[", f.tag, "]: no member passed the probe, using ", selected)
+		} else {
+			f.logger.Info("fallback[", f.tag, "]: using ", selected)
+		}
+	}
+	f.save()
+}
+
+// restore loads the results saved by a previous run, unless the members
+// were already probed in this process
+func (f *Fallback) restore() {
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return
+	}
+	var saved fallbackState
+	if err := json.Unmarshal(content, &saved); err != nil {
+		f.logger.Warn("fallback[", f.tag, "]: ignoring damaged state ", f.path, ": ", err)
+		return
+	}
+	for _, member := range f.opts.Outbounds {
+		if history := saved.History[member]; history != nil && f.history.LoadURLTestHistory(member) == nil {
+			f.history.StoreURLTestHistory(member, history)
+		}
+	}
+}
+
+func (f *Fallback) save() {
+	saved := fallbackState{History: make(map[string]*adapter.URLTestHistory)}
+	for _, member := range f.opts.Outbounds {
+		if history := f.history.LoadURLTestHistory(member); history != nil {
+			saved.History[member] = history
+		}
+	}
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(f.path), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(f.path, content, 0o600)
+	}
+	if err != nil {
+		f.logger.Warn("fallback[", f.tag, "]: failed to save state: ", err)
+	}
+}
@@ -0,0 +1,138 @@
+package group
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+)
+
+const (
+	// DefaultProbeURL answers with the country of the requesting address
+	DefaultProbeURL     = "https://ipinfo.io/country"
+	countryProbePeriod  = time.Hour
+	countryProbeTimeout = 15 * time.Second
+)
+
+// exitCountries tracks the exit country of each member, from static
+// configuration or probed through the member itself
+type exitCountries struct {
+	access    sync.RWMutex
+	countries map[string]string
+}
+
+func newExitCountries(static map[string]string) *exitCountries {
+	e := &exitCountries{countries: make(map[string]string, len(static))}
+	for member, country := range static {
+		e.countries[member] = strings.ToUpper(country)
+	}
+	return e
+}
+
+// Country returns the exit country of member, or "" if unknown
+func (e *exitCountries) Country(member string) string {
+	e.access.RLock()
+	defer e.access.RUnlock()
+	return e.countries[member]
+}
+
+func (e *exitCountries) store(member string, country string) {
+	e.access.Lock()
+	e.countries[member] = country
+	e.access.Unlock()
+}
+
+// probeCountries looks up the exit country of every member without a static
+// country, then repeats periodically until ctx is done
+func (o *Outbound) probeCountries(ctx context.Context) {
+	ticker := time.NewTicker(countryProbePeriod)
+	defer ticker.Stop()
+	for {
+		for _, member := range o.opts.Outbounds {
+			if _, static := o.opts.Countries[member]; static {
+				continue
+			}
+			country, err := o.probeCountry(ctx, member)
+			if err != nil {
+				o.logger.Debug("load-balance[", o.tag, "]: country probe through ", member, " failed: ", err)
+				continue
+			}
+			if previous := o.countries.Country(member); previous != country {
+				o.logger.Info("load-balance[", o.tag, "]: member ", member, " exits in ", country)
+			}
+			o.countries.store(member, country)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probeCountry asks the IP-info service which country the member exits in.
+// Both plain text and JSON answers with a "country" field are accepted.
+func (o *Outbound) probeCountry(ctx context.Context, tag string) (string, error) {
+	member, loaded := o.manager.Outbound(tag)
+	if !loaded {
+		return "", fmt.Errorf("outbound not found: %s", tag)
+	}
+	probeURL := o.opts.ProbeURL
+	if probeURL == "" {
+		probeURL = DefaultProbeURL
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return member.DialContext(ctx, network, metadata.ParseSocksaddr(addr))
+			},
+		},
+		Timeout: countryProbeTimeout,
+	}
+	defer client.CloseIdleConnections()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	return parseCountry(content)
+}
+
+func parseCountry(content []byte) (string, error) {
+	country := strings.TrimSpace(string(content))
+	if strings.HasPrefix(country, "{") {
+		var info struct {
+			Country     string `json:"country"`
+			CountryCode string `json:"country_code"`
+		}
+		if err := json.Unmarshal(content, &info); err != nil {
+			return "", fmt.Errorf("invalid probe response: %w", err)
+		}
+		country = info.CountryCode
+		if country == "" {
+			country = info.Country
+		}
+	}
+	if len(country) != 2 {
+		return "", fmt.Errorf("invalid country in probe response: %q", country)
+	}
+	return strings.ToUpper(country), nil
+}
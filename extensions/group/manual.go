@@ -0,0 +1,349 @@
+package group
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/health"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+var _ adapter.OutboundGroup = (*Manual)(nil)
+
+// Manual sends connections through the member chosen by the user, or
+// spreads them over the members by weight while none is chosen. The choice
+// and the weights are switched through the admin and management APIs or
+// `utp-core select`, and kept in the state directory, so they survive
+// restarts and reloads.
+type Manual struct {
+	tag     string
+	opts    ManualOptions
+	logger  log.ContextLogger
+	manager adapter.OutboundManager
+	limiter *limiter.Limiter
+	path    string
+	last    atomic.Value // string, member of the latest successful dial
+
+	access   sync.RWMutex
+	selected string
+	weights  map[string]int
+}
+
+// ManualState is the choice and the weights of a manual group, as kept in
+// the state directory
+type ManualState struct {
+	Selected string         `json:"selected"` // Empty to spread by weight
+	Weights  map[string]int `json:"weights,omitempty"`
+}
+
+// ManualStatePath returns the file keeping the state of the manual group tag
+func ManualStatePath(ctx context.Context, tag string) string {
+	return state.PathContext(ctx, "groups", url.PathEscape(tag)+".json")
+}
+
+// LoadManualState reads the state saved at path. A missing file is
+// reported with os.ErrNotExist.
+func LoadManualState(path string) (ManualState, error) {
+	var saved ManualState
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return saved, err
+	}
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return saved, fmt.Errorf("damaged state %s: %w", path, err)
+	}
+	return saved, nil
+}
+
+// Save writes s to path
+func (s ManualState) Save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(path, content, 0o600)
+	}
+	return err
+}
+
+// NewManual creates a new manual group. A saved choice and saved weights
+// take precedence over default and weights.
+func NewManual(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts ManualOptions) (adapter.Outbound, error) {
+	if len(opts.Outbounds) == 0 {
+		return nil, fmt.Errorf("manual group requires at least one outbound")
+	}
+	m := &Manual{
+		tag:      tag,
+		opts:     opts,
+		logger:   logger,
+		manager:  service.FromContext[adapter.OutboundManager](ctx),
+		limiter:  limiter.New(opts.Options),
+		path:     ManualStatePath(ctx, tag),
+		selected: opts.Default,
+		weights:  make(map[string]int, len(opts.Outbounds)),
+	}
+	if opts.Default != "" && !m.isMember(opts.Default) {
+		return nil, fmt.Errorf("manual: default %s is not a member", opts.Default)
+	}
+	for _, member := range opts.Outbounds {
+		m.weights[member] = 1
+	}
+	if err := m.mergeWeights(opts.Weights); err != nil {
+		return nil, fmt.Errorf("manual: %w", err)
+	}
+	m.restore()
+	return m, nil
+}
+
+// restore applies the state saved by a previous run, skipping members that
+// are no longer in the group
+func (m *Manual) restore() {
+	saved, err := LoadManualState(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		m.logger.Warn("manual[", m.tag, "]: ignoring ", err)
+		return
+	}
+	if saved.Selected == "" || m.isMember(saved.Selected) {
+		m.selected = saved.Selected
+	}
+	for member, weight := range saved.Weights {
+		if m.isMember(member) && weight >= 0 {
+			m.weights[member] = weight
+		}
+	}
+}
+
+func (m *Manual) isMember(tag string) bool {
+	return slices.Contains(m.opts.Outbounds, tag)
+}
+
+// mergeWeights checks weights and applies them over the current ones. The
+// result must leave a member to spread connections over.
+func (m *Manual) mergeWeights(weights map[string]int) error {
+	merged := maps.Clone(m.weights)
+	for member, weight := range weights {
+		if !m.isMember(member) {
+			return fmt.Errorf("weight of %s, which is not a member", member)
+		}
+		if weight < 0 {
+			return fmt.Errorf("negative weight of %s", member)
+		}
+		merged[member] = weight
+	}
+	if !slices.ContainsFunc(m.opts.Outbounds, func(member string) bool { return merged[member] > 0 }) {
+		return fmt.Errorf("every weight is 0")
+	}
+	m.weights = merged
+	return nil
+}
+
+func (m *Manual) Type() string {
+	return "manual"
+}
+
+func (m *Manual) Tag() string {
+	return m.tag
+}
+
+func (m *Manual) Dependencies() []string {
+	return m.opts.Outbounds
+}
+
+func (m *Manual) Network() []string {
+	return []string{"tcp", "udp"}
+}
+
+func (m *Manual) Start() error {
+	return nil
+}
+
+func (m *Manual) Close() error {
+	return nil
+}
+
+// Now returns the chosen member, or the member that served the latest
+// connection while none is chosen
+func (m *Manual) Now() string {
+	m.access.RLock()
+	selected := m.selected
+	m.access.RUnlock()
+	if selected != "" {
+		return selected
+	}
+	if member, ok := m.last.Load().(string); ok {
+		return member
+	}
+	return m.opts.Outbounds[0]
+}
+
+// All returns the member tags
+func (m *Manual) All() []string {
+	return m.opts.Outbounds
+}
+
+// Selected returns the chosen member, or "" while connections are spread by
+// weight
+func (m *Manual) Selected() string {
+	m.access.RLock()
+	defer m.access.RUnlock()
+	return m.selected
+}
+
+// Weights returns the weight of every member
+func (m *Manual) Weights() map[string]int {
+	m.access.RLock()
+	defer m.access.RUnlock()
+	return maps.Clone(m.weights)
+}
+
+// SelectOutbound chooses the member tag, or spreads connections by weight
+// again for "", and saves the choice
+func (m *Manual) SelectOutbound(tag string) bool {
+	if tag != "" && !m.isMember(tag) {
+		return false
+	}
+	m.access.Lock()
+	m.selected = tag
+	m.access.Unlock()
+	m.save()
+	return true
+}
+
+// SetWeights changes the weights of the members listed and saves them
+func (m *Manual) SetWeights(weights map[string]int) error {
+	m.access.Lock()
+	err := m.mergeWeights(weights)
+	m.access.Unlock()
+	if err != nil {
+		return err
+	}
+	m.save()
+	return nil
+}
+
+func (m *Manual) save() {
+	m.access.RLock()
+	saved := ManualState{Selected: m.selected, Weights: maps.Clone(m.weights)}
+	m.access.RUnlock()
+	if err := saved.Save(m.path); err != nil {
+		m.logger.Warn("manual[", m.tag, "]: failed to save state: ", err)
+	}
+}
+
+func (m *Manual) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := m.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, m.tag, err)
+	}
+	var conn net.Conn
+	err = m.tryMembers(ctx, func(member adapter.Outbound) error {
+		var err error
+		conn, err = member.DialContext(ctx, network, destination)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, failure.Report(ctx, m.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+func (m *Manual) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	release, err := m.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, m.tag, err)
+	}
+	var conn net.PacketConn
+	err = m.tryMembers(ctx, func(member adapter.Outbound) error {
+		var err error
+		conn, err = member.ListenPacket(ctx, destination)
+		return err
+	})
+	if err != nil {
+		release()
+		return nil, failure.Report(ctx, m.tag, err)
+	}
+	return limiter.WrapPacketConn(conn, release), nil
+}
+
+// tryMembers calls dial with the chosen member only, as the user asked for
+// it, or with the members in weighted random order until one succeeds
+func (m *Manual) tryMembers(ctx context.Context, dial func(member adapter.Outbound) error) error {
+	if m.manager == nil {
+		return fmt.Errorf("outbound manager not available")
+	}
+	var lastErr error
+	for _, tag := range m.order() {
+		member, loaded := m.manager.Outbound(tag)
+		if !loaded {
+			lastErr = fmt.Errorf("outbound not found: %s", tag)
+			continue
+		}
+		err := dial(member)
+		if err == nil {
+			m.last.Store(tag)
+			return nil
+		}
+		lastErr = err
+		m.logger.Debug("manual[", m.tag, "]: member ", tag, " failed: ", err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return lastErr
+}
+
+// order returns the chosen member, or the members of positive weight drawn
+// without replacement in proportion to their weights, those marked down
+// last
+func (m *Manual) order() []string {
+	m.access.RLock()
+	defer m.access.RUnlock()
+	if m.selected != "" {
+		return []string{m.selected}
+	}
+	var total int
+	remaining := make([]string, 0, len(m.opts.Outbounds))
+	for _, member := range m.opts.Outbounds {
+		if m.weights[member] > 0 {
+			remaining = append(remaining, member)
+			total += m.weights[member]
+		}
+	}
+	order := make([]string, 0, len(remaining))
+	for len(remaining) > 0 {
+		pick := rand.IntN(total)
+		for i, member := range remaining {
+			if pick < m.weights[member] {
+				order = append(order, member)
+				total -= m.weights[member]
+				remaining = slices.Delete(remaining, i, i+1)
+				break
+			}
+			pick -= m.weights[member]
+		}
+	}
+	return health.Demote(order)
+}
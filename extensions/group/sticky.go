@@ -0,0 +1,87 @@
+package group
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// DefaultStickyTTL is used when sticky routing is enabled without a TTL
+const DefaultStickyTTL = 10 * time.Minute
+
+// affinity remembers which member last served a destination, so logins and
+// captchas are not broken by connections leaving through different exits
+type affinity struct {
+	ttl    time.Duration
+	prefix bool
+
+	access    sync.Mutex
+	entries   map[string]affinityEntry
+	lastSweep time.Time
+}
+
+type affinityEntry struct {
+	member  string
+	expires time.Time
+}
+
+func newAffinity(opts StickyOptions) *affinity {
+	ttl := time.Duration(opts.TTL)
+	if ttl <= 0 {
+		ttl = DefaultStickyTTL
+	}
+	return &affinity{
+		ttl:     ttl,
+		prefix:  opts.Key == StickyKeyPrefix,
+		entries: make(map[string]affinityEntry),
+	}
+}
+
+// key groups destinations that should share an exit. Domains are pinned by
+// name in both modes; addresses by network in prefix mode.
+func (a *affinity) key(destination metadata.Socksaddr) string {
+	if destination.IsFqdn() {
+		return strings.ToLower(strings.TrimSuffix(destination.Fqdn, "."))
+	}
+	addr := destination.Addr.Unmap()
+	if !a.prefix {
+		return addr.String()
+	}
+	bits := 24
+	if addr.Is6() {
+		bits = 64
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// Load returns the member pinned for destination
+func (a *affinity) Load(destination metadata.Socksaddr) (string, bool) {
+	key := a.key(destination)
+	a.access.Lock()
+	defer a.access.Unlock()
+	entry, ok := a.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.member, true
+}
+
+// Store pins destination to member and extends the TTL
+func (a *affinity) Store(destination metadata.Socksaddr, member string) {
+	key := a.key(destination)
+	now := time.Now()
+	a.access.Lock()
+	defer a.access.Unlock()
+	a.entries[key] = affinityEntry{member: member, expires: now.Add(a.ttl)}
+	if now.Sub(a.lastSweep) > a.ttl {
+		for k, entry := range a.entries {
+			if now.After(entry.expires) {
+				delete(a.entries, k)
+			}
+		}
+		a.lastSweep = now
+	}
+}
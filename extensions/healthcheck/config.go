@@ -0,0 +1,23 @@
+package healthcheck
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// HealthCheckOptions defines the configuration for the health-check service
+type HealthCheckOptions struct {
+	Outbounds []string           `json:"outbounds,omitempty"` // Outbounds to probe (default: every outbound with a server, groups excluded)
+	Probe     string             `json:"probe,omitempty"`     // "http" (default), "tls" or "tcp"
+	Target    string             `json:"target,omitempty"`    // URL for http, host:port for tls and tcp (defaults use www.gstatic.com)
+	Interval  badoption.Duration `json:"interval,omitempty"`  // Time between probes (default 1m)
+	Timeout   badoption.Duration `json:"timeout,omitempty"`   // Timeout of one probe (default 10s)
+	Fall      int                `json:"fall,omitempty"`      // Failed probes in a row that mark an outbound down (default 2)
+	Rise      int                `json:"rise,omitempty"`      // Successful probes in a row that mark it up again (default 1)
+}
+
+// Probe kinds
+const (
+	ProbeHTTP = "http"
+	ProbeTLS  = "tls"
+	ProbeTCP  = "tcp"
+)
@@ -0,0 +1,260 @@
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/common/urltest"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/json/badoption"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/clock"
+	"github.com/UTPBox/utp-core/internal/health"
+)
+
+const (
+	defaultHTTPTarget = "https://www.gstatic.com/generate_204"
+	defaultTLSTarget  = "www.gstatic.com:443"
+	defaultInterval   = time.Minute
+	defaultTimeout    = 10 * time.Second
+	defaultFall       = 2
+	defaultRise       = 1
+	maxParallelProbes = 10
+)
+
+// Service probes outbounds periodically and records whether they are up in
+// internal/health, where groups find which members to try last
+type Service struct {
+	boxService.Adapter
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    log.ContextLogger
+	opts      HealthCheckOptions
+	outbounds adapter.OutboundManager
+	endpoints adapter.EndpointManager
+
+	access   sync.Mutex
+	counters map[string]*counter
+}
+
+// counter is the run of identical probe results of one outbound
+type counter struct {
+	status    health.Status
+	failures  int
+	successes int
+}
+
+// NewService creates the health-check service
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts HealthCheckOptions) (adapter.Service, error) {
+	switch opts.Probe {
+	case "":
+		opts.Probe = ProbeHTTP
+	case ProbeHTTP, ProbeTLS, ProbeTCP:
+	default:
+		return nil, fmt.Errorf("health-check: unknown probe %q: expected http, tls or tcp", opts.Probe)
+	}
+	if opts.Target == "" {
+		if opts.Probe == ProbeHTTP {
+			opts.Target = defaultHTTPTarget
+		} else {
+			opts.Target = defaultTLSTarget
+		}
+	}
+	if opts.Probe == ProbeHTTP {
+		if target, err := url.Parse(opts.Target); err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+			return nil, fmt.Errorf("health-check: target must be an http or https URL for the http probe")
+		}
+	} else if _, _, err := net.SplitHostPort(opts.Target); err != nil {
+		return nil, fmt.Errorf("health-check: target must be host:port for the %s probe", opts.Probe)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = badoption.Duration(defaultInterval)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = badoption.Duration(defaultTimeout)
+	}
+	if opts.Fall <= 0 {
+		opts.Fall = defaultFall
+	}
+	if opts.Rise <= 0 {
+		opts.Rise = defaultRise
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Service{
+		Adapter:   boxService.NewAdapter("health-check", tag),
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    logger,
+		opts:      opts,
+		outbounds: service.FromContext[adapter.OutboundManager](ctx),
+		endpoints: service.FromContext[adapter.EndpointManager](ctx),
+		counters:  make(map[string]*counter),
+	}, nil
+}
+
+// Start begins probing once every outbound has started
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStarted {
+		return nil
+	}
+	go s.loop()
+	return nil
+}
+
+func (s *Service) Close() error {
+	s.cancel()
+	s.access.Lock()
+	defer s.access.Unlock()
+	for tag := range s.counters {
+		health.Delete(tag)
+	}
+	return nil
+}
+
+func (s *Service) loop() {
+	ticker := time.NewTicker(time.Duration(s.opts.Interval))
+	defer ticker.Stop()
+	for {
+		s.probeAll()
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll probes the outbounds, which are looked up again on every round
+// since subscriptions add and remove them
+func (s *Service) probeAll() {
+	targets := s.targets()
+	s.access.Lock()
+	for tag := range s.counters {
+		if _, probed := targets[tag]; !probed {
+			delete(s.counters, tag)
+			health.Delete(tag)
+		}
+	}
+	s.access.Unlock()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxParallelProbes)
+	for tag, outbound := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			latency, err := s.probe(outbound)
+			if s.ctx.Err() == nil {
+				s.record(tag, latency, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// targets returns the outbounds to probe by tag
+func (s *Service) targets() map[string]adapter.Outbound {
+	targets := make(map[string]adapter.Outbound)
+	if s.outbounds == nil {
+		return targets
+	}
+	if len(s.opts.Outbounds) > 0 {
+		for _, tag := range s.opts.Outbounds {
+			if outbound, loaded := s.outbounds.Outbound(tag); loaded {
+				targets[tag] = outbound
+			}
+		}
+		return targets
+	}
+	all := s.outbounds.Outbounds()
+	if s.endpoints != nil {
+		for _, endpoint := range s.endpoints.Endpoints() {
+			all = append(all, endpoint)
+		}
+	}
+	for _, outbound := range all {
+		if _, isGroup := outbound.(adapter.OutboundGroup); isGroup {
+			continue
+		}
+		switch outbound.Type() {
+		case C.TypeDirect, C.TypeBlock, C.TypeDNS:
+			continue
+		}
+		targets[outbound.Tag()] = outbound
+	}
+	return targets
+}
+
+// probe reaches the target through outbound and returns the time it took
+func (s *Service) probe(outbound adapter.Outbound) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, time.Duration(s.opts.Timeout))
+	defer cancel()
+	if s.opts.Probe == ProbeHTTP {
+		delay, err := urltest.URLTest(ctx, s.opts.Target, outbound)
+		return time.Duration(delay) * time.Millisecond, err
+	}
+	start := time.Now()
+	conn, err := outbound.DialContext(ctx, "tcp", metadata.ParseSocksaddr(s.opts.Target))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if s.opts.Probe == ProbeTLS {
+		host, _, _ := net.SplitHostPort(s.opts.Target)
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: host,
+			Time:       clock.Now,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return 0, fmt.Errorf("TLS handshake: %w", err)
+		}
+	}
+	return time.Since(start), nil
+}
+
+// record updates the status of tag with a probe result, changing it only
+// after fall failures or rise successes in a row
+func (s *Service) record(tag string, latency time.Duration, err error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	c, loaded := s.counters[tag]
+	if !loaded {
+		c = &counter{status: health.Status{Outbound: tag, Up: true, Since: time.Now()}}
+		s.counters[tag] = c
+	}
+	c.status.Checked = time.Now()
+	if err != nil {
+		c.failures++
+		c.successes = 0
+		c.status.Error = err.Error()
+		s.logger.Debug("probe through ", tag, " failed: ", err)
+		if c.status.Up && c.failures >= s.opts.Fall {
+			c.status.Up = false
+			c.status.Since = c.status.Checked
+			s.logger.Warn("outbound ", tag, " is down: ", err)
+		}
+	} else {
+		c.successes++
+		c.failures = 0
+		c.status.Error = ""
+		c.status.Latency = latency
+		if !c.status.Up && c.successes >= s.opts.Rise {
+			c.status.Up = true
+			c.status.Since = c.status.Checked
+			s.logger.Info("outbound ", tag, " is up again")
+		}
+	}
+	health.Store(c.status)
+}
@@ -0,0 +1,81 @@
+package httpinject
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// chunkedConn streams writes as the chunks of a request body and reads the
+// response body, which net/http has already de-chunked when the server
+// chunks it
+type chunkedConn struct {
+	net.Conn
+	body  io.ReadCloser // Response body
+	size  int           // Largest chunk, 0 for one chunk per write
+	delay time.Duration // Pause between chunks
+
+	writeAccess sync.Mutex
+	written     bool // A chunk went out, so the next one waits delay
+	ended       bool // The last chunk was sent
+}
+
+func newChunkedConn(conn net.Conn, body io.ReadCloser, size int, delay time.Duration) *chunkedConn {
+	return &chunkedConn{Conn: conn, body: body, size: size, delay: delay}
+}
+
+func (c *chunkedConn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *chunkedConn) Write(b []byte) (int, error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	if c.ended {
+		return 0, net.ErrClosed
+	}
+	var n int
+	for n < len(b) {
+		chunk := b[n:]
+		if c.size > 0 && len(chunk) > c.size {
+			chunk = chunk[:c.size]
+		}
+		if c.written && c.delay > 0 {
+			time.Sleep(c.delay)
+		}
+		// Size line, data and CRLF in one write, so each chunk leaves as
+		// one segment
+		frame := make([]byte, 0, len(chunk)+20)
+		frame = strconv.AppendInt(frame, int64(len(chunk)), 16)
+		frame = append(frame, "\r\n"...)
+		frame = append(frame, chunk...)
+		frame = append(frame, "\r\n"...)
+		if _, err := c.Conn.Write(frame); err != nil {
+			return n, err
+		}
+		c.written = true
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// CloseWrite ends the request body with the last chunk, leaving the
+// response readable
+func (c *chunkedConn) CloseWrite() error {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	if c.ended {
+		return nil
+	}
+	c.ended = true
+	_, err := c.Conn.Write([]byte("0\r\n\r\n"))
+	return err
+}
+
+func (c *chunkedConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.CloseWrite()
+	return c.Conn.Close()
+}
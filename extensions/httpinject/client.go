@@ -0,0 +1,334 @@
+package httpinject
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/fronting"
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/payload"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// Request modes
+const (
+	modeConnect = "connect"
+	modeUpgrade = "upgrade"
+	modeChunked = "chunked"
+)
+
+// Default server ports
+const (
+	defaultPort    = 80
+	defaultTLSPort = 443
+)
+
+var _ adapter.Outbound = (*Outbound)(nil)
+
+// Outbound reaches destinations through an HTTP proxy or tunnel gateway, as
+// HTTP injector apps do. Each connection sends its own request, a CONNECT
+// for the destination or an upgrade request (or a payload in their place),
+// and once the server answers 2xx or 101 the connection carries the
+// destination's byte stream in both directions. In chunked mode, the stream
+// is the chunked body of a POST upstream and the response body downstream.
+type Outbound struct {
+	tag       string
+	opts      HTTPInjectOptions
+	logger    log.ContextLogger
+	template  *payload.Template
+	overrides *headers.Overrides
+	variants  []*payload.Template // Request of each header override rule
+	method    string              // Of the request, for reading the response
+	tlsConfig *tlsconfig.Config   // nil without TLS
+	limiter   *limiter.Limiter
+	guard     *dnsguard.Guard
+	dialer    *netdial.Outbound
+}
+
+// NewOutbound creates a new http-inject outbound
+func NewOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts HTTPInjectOptions) (adapter.Outbound, error) {
+	if opts.Server == "" {
+		return nil, fmt.Errorf("http-inject requires server")
+	}
+	tlsConfig, err := newTLSConfig(ctx, opts.Server, opts.TLS, opts.TLSFragment, opts.Names)
+	if err != nil {
+		return nil, fmt.Errorf("http-inject: %w", err)
+	}
+	if opts.Payload != "" && opts.HostHeader != "" {
+		return nil, fmt.Errorf("http-inject: host_header does not apply to a payload, which sets its own Host")
+	}
+	if opts.Host, err = opts.Names.Host(opts.Host); err != nil {
+		return nil, fmt.Errorf("http-inject: %w", err)
+	}
+	if opts.Port == 0 {
+		opts.Port = defaultPort
+		if tlsConfig != nil {
+			opts.Port = defaultTLSPort
+		}
+	}
+	if opts.Mode == "" {
+		opts.Mode = modeConnect
+	}
+	if opts.ChunkSize < 0 || opts.ChunkDelay < 0 {
+		return nil, fmt.Errorf("http-inject: invalid chunk_size or chunk_delay")
+	}
+	if opts.Mode != modeChunked && (opts.ChunkSize != 0 || opts.ChunkDelay != 0) {
+		return nil, fmt.Errorf("http-inject: chunk_size and chunk_delay require chunked mode")
+	}
+	text, method, err := requestTemplate(opts)
+	if err != nil {
+		return nil, fmt.Errorf("http-inject: %w", err)
+	}
+	template, err := payload.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("http-inject: %w", err)
+	}
+	if opts.Payload != "" && len(opts.HeaderOverrides) > 0 {
+		return nil, fmt.Errorf("http-inject: header_overrides do not apply to a payload")
+	}
+	overrides, err := headers.Compile(opts.HeaderOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("http-inject: %w", err)
+	}
+	variants := make([]*payload.Template, 0, len(opts.HeaderOverrides))
+	for i, rule := range opts.HeaderOverrides {
+		variantOpts := opts
+		var host string
+		variantOpts.Headers, host = mergeHeaders(opts.Headers, rule.Headers)
+		if host != "" {
+			variantOpts.Host, variantOpts.HostHeader = host, host
+		}
+		text, _, err := requestTemplate(variantOpts)
+		if err != nil {
+			return nil, fmt.Errorf("http-inject: header_overrides[%d]: %w", i, err)
+		}
+		variant, err := payload.Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("http-inject: header_overrides[%d]: %w", i, err)
+		}
+		variants = append(variants, variant)
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("http-inject: %w", err)
+	}
+	dialer, err := netdial.New(ctx, tag, opts.DialerOptions, opts.Marks)
+	if err != nil {
+		return nil, fmt.Errorf("http-inject: %w", err)
+	}
+	guard, err := dnsguard.New(ctx, opts.DNSGuard)
+	if err != nil {
+		return nil, err
+	}
+	return &Outbound{
+		tag:       tag,
+		opts:      opts,
+		logger:    logger,
+		template:  template,
+		overrides: overrides,
+		variants:  variants,
+		method:    method,
+		tlsConfig: tlsConfig,
+		limiter:   limiter.New(opts.Options),
+		guard:     guard,
+		dialer:    dialer,
+	}, nil
+}
+
+// requestTemplate returns the payload template of the request of opts and
+// its method: the configured payload, or a request built for the mode
+func requestTemplate(opts HTTPInjectOptions) (string, string, error) {
+	if opts.Payload != "" {
+		method, _, _ := strings.Cut(strings.TrimSpace(opts.Payload), " ")
+		return opts.Payload, strings.ToUpper(method), nil
+	}
+	var request strings.Builder
+	var method string
+	switch opts.Mode {
+	case modeConnect:
+		method = "CONNECT"
+		host := "[host_port]"
+		if opts.HostHeader != "" {
+			host = opts.HostHeader
+		}
+		fmt.Fprintf(&request, "CONNECT [host_port] HTTP/1.1[crlf]Host: %s[crlf]", host)
+	case modeUpgrade, modeChunked:
+		path, host := opts.Path, opts.Host
+		if path == "" {
+			path = "/"
+		}
+		if host == "" {
+			host = opts.Server
+		}
+		if opts.Mode == modeUpgrade {
+			method = "GET"
+			fmt.Fprintf(&request, "GET %s HTTP/1.1[crlf]Host: %s[crlf]Upgrade: websocket[crlf]Connection: Upgrade[crlf]", path, host)
+		} else {
+			method = "POST"
+			fmt.Fprintf(&request, "POST %s HTTP/1.1[crlf]Host: %s[crlf]Transfer-Encoding: chunked[crlf]", path, host)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid mode %q: expected connect, upgrade or chunked", opts.Mode)
+	}
+	if opts.Username != "" || opts.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(opts.Username + ":" + opts.Password))
+		fmt.Fprintf(&request, "Proxy-Authorization: Basic %s[crlf]", credentials)
+	}
+	// Sorted, so every request of the outbound looks the same
+	names := make([]string, 0, len(opts.Headers))
+	for name := range opts.Headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		value := opts.Headers[name]
+		if strings.ContainsAny(name, "\r\n: ") || strings.ContainsAny(value, "\r\n") {
+			return "", "", fmt.Errorf("invalid header %q", name)
+		}
+		fmt.Fprintf(&request, "%s: %s[crlf]", name, value)
+	}
+	request.WriteString("[crlf]")
+	return request.String(), method, nil
+}
+
+// mergeHeaders returns the extra headers of a request with the headers of
+// an override rule set over them, and the Host the rule sets, if any
+func mergeHeaders(headers map[string]string, overrides map[string]string) (map[string]string, string) {
+	merged := make(map[string]string, len(headers)+len(overrides))
+	for name, value := range headers {
+		merged[name] = value
+	}
+	var host string
+	for name, value := range overrides {
+		if strings.EqualFold(name, "Host") {
+			host = value
+			continue
+		}
+		for existing := range merged {
+			if strings.EqualFold(existing, name) {
+				delete(merged, existing)
+			}
+		}
+		merged[name] = value
+	}
+	return merged, host
+}
+
+// requestFor returns the request template for destination: that of the
+// first header override rule matching it, or the default one
+func (o *Outbound) requestFor(destination metadata.Socksaddr) *payload.Template {
+	if index := o.overrides.MatchIndex(destination); index >= 0 {
+		return o.variants[index]
+	}
+	return o.template
+}
+
+// newTLSConfig prepares TLS towards server, or returns nil without TLS. The
+// sni of names replaces the server name.
+func newTLSConfig(ctx context.Context, server string, options *tlsconfig.Options, fragment tlsconfig.FragmentOptions, names fronting.Names) (*tlsconfig.Config, error) {
+	if err := names.Validate(); err != nil {
+		return nil, err
+	}
+	if options == nil || !options.Enabled {
+		if names.SNI != "" || fragment.Enabled {
+			return nil, fmt.Errorf("sni and tls_fragment require tls")
+		}
+		return nil, nil
+	}
+	tlsOptions := *options
+	serverName, err := names.ServerName(tlsOptions.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	tlsOptions.ServerName = serverName
+	tlsConfig, err := tlsconfig.New(ctx, server, tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig, tlsConfig.Fragment(fragment)
+}
+
+func (o *Outbound) Type() string {
+	return "http-inject"
+}
+
+func (o *Outbound) Tag() string {
+	return o.tag
+}
+
+func (o *Outbound) Dependencies() []string {
+	return o.opts.DialerOptions.Dependencies()
+}
+
+// The tunnel is a byte stream; UDP would need framing no gateway speaks
+func (o *Outbound) Network() []string {
+	return []string{"tcp"}
+}
+
+func (o *Outbound) Start() error {
+	return nil
+}
+
+func (o *Outbound) Close() error {
+	return nil
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	conn, err := o.dial(ctx, destination)
+	if err != nil {
+		release()
+		o.logger.Debug("http-inject[", o.tag, "]: server ", o.opts.Server, ":", o.opts.Port, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+// dial connects to the server, over TLS when configured, and asks it for a
+// tunnel to destination
+func (o *Outbound) dial(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	conn, err := o.guard.DialContext(ctx, o.dialer.For(adapter.ContextFrom(ctx)), "tcp", o.opts.Server, o.opts.Port)
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to dial server: %w", err))
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(C.TCPTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if o.tlsConfig != nil {
+		tlsConn, err := o.tlsConfig.Handshake(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, failure.Wrap(failure.StageTLS, err)
+		}
+		conn = tlsConn
+	}
+	tunnel, err := o.handshake(ctx, conn, destination)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	return nil, fmt.Errorf("http-inject outbound does not support UDP")
+}
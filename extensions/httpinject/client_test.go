@@ -0,0 +1,114 @@
+package httpinject
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/testkit"
+)
+
+// serveTestProxy serves an HTTP proxy on network at proxy.example:8080,
+// answering every request with response and echoing the tunnels it opens.
+// The connections are recorded into the returned transcripts.
+func serveTestProxy(t *testing.T, network *testkit.Network, response string) <-chan *testkit.Transcript {
+	t.Helper()
+	transcripts := make(chan *testkit.Transcript, 4)
+	listener, err := network.Serve("proxy.example:8080", func(conn net.Conn) {
+		transcript := testkit.Record(conn)
+		_, conn, err := testkit.ReadRequest(transcript)
+		if err != nil {
+			return
+		}
+		transcripts <- transcript
+		io.WriteString(conn, response)
+		testkit.Echo(conn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return transcripts
+}
+
+func newTestOutbound(t *testing.T, network *testkit.Network, opts HTTPInjectOptions) adapter.Outbound {
+	t.Helper()
+	opts.Server, opts.Port = "proxy.example", 8080
+	outbound, _, err := testkit.NewOutbound(testkit.Context(context.Background(), network, nil), nil, NewOutbound, "http-inject-out", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outbound
+}
+
+func TestConnect(t *testing.T) {
+	network := &testkit.Network{}
+	transcripts := serveTestProxy(t, network, "HTTP/1.1 200 Connection established\r\n\r\n")
+	outbound := newTestOutbound(t, network, HTTPInjectOptions{
+		Username: "user",
+		Password: "secret",
+		Headers:  map[string]string{"User-Agent": "injector"},
+		HeaderOverrides: []headers.OverrideRule{{
+			DomainSuffix: []string{"video.example"},
+			Headers:      map[string]string{"User-Agent": "player", "X-Online-Host": "cdn.example"},
+		}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The requests are compared with annotated transcripts in testdata
+	for _, test := range []struct {
+		destination metadata.Socksaddr
+		golden      string
+	}{
+		{metadata.ParseSocksaddrHostPort("example.com", 443), "connect"},
+		{metadata.ParseSocksaddrHostPort("www.video.example", 443), "connect-override"},
+	} {
+		conn, err := outbound.DialContext(ctx, "tcp", test.destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transcript := <-transcripts
+		if _, err := io.WriteString(conn, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		echo := make([]byte, 4)
+		if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+			t.Fatalf("read %q, %v through the tunnel, want the echo", echo, err)
+		}
+		if err := transcript.Golden(filepath.Join("testdata", test.golden+".golden")); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	for _, test := range []struct {
+		response string
+		kind     failure.Kind
+		stage    failure.Stage
+	}{
+		{"HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n", failure.KindAuthFailed, failure.StageAuth},
+		{"HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n", failure.KindUnreachable, failure.StageTarget},
+		{"HTTP/1.1 429 Too Many Requests\r\nContent-Length: 0\r\n\r\n", failure.KindQuotaExceeded, failure.StageHandshake},
+	} {
+		network := &testkit.Network{}
+		serveTestProxy(t, network, test.response)
+		outbound := newTestOutbound(t, network, HTTPInjectOptions{})
+		_, err := outbound.DialContext(context.Background(), "tcp", metadata.ParseSocksaddrHostPort("example.com", 443))
+		var typed *failure.Error
+		if !errors.As(err, &typed) || typed.Kind != test.kind || typed.Stage != test.stage {
+			t.Fatalf("%.12s: error = %v, want %s at %s", test.response, err, test.kind, test.stage)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package httpinject
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/fronting"
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// HTTPInjectOptions defines the configuration for the http-inject outbound.
+// Every connection is a request to the proxy or gateway at server, which
+// answers it and then relays the connection's bytes both ways.
+type HTTPInjectOptions struct {
+	Server   string            `json:"server"`             // Proxy or gateway hostname or IP
+	Port     int               `json:"port,omitempty"`     // Proxy or gateway port (default 80, 443 with TLS)
+	Mode     string            `json:"mode,omitempty"`     // connect (default): CONNECT the destination; upgrade: GET with an Upgrade header; chunked: POST streaming chunks
+	Host     string            `json:"host,omitempty"`     // Host header of upgrade and chunked requests (default server); host_header also sets it on CONNECT
+	Path     string            `json:"path,omitempty"`     // Path of upgrade and chunked requests (default /), e.g. /tunnel/[host_port]
+	Headers  map[string]string `json:"headers,omitempty"`  // Extra request headers
+	Username string            `json:"username,omitempty"` // Proxy-Authorization Basic user
+	Password string            `json:"password,omitempty"` // Proxy-Authorization Basic password
+	Payload  string            `json:"payload,omitempty"`  // Payload template sent instead of the request; [host] and [port] are the destination
+
+	HeaderOverrides []headers.OverrideRule `json:"header_overrides,omitempty"` // Per-destination request headers, first match wins
+
+	ChunkSize  int                `json:"chunk_size,omitempty"`  // Largest chunk of chunked mode (default: one chunk per write)
+	ChunkDelay badoption.Duration `json:"chunk_delay,omitempty"` // Pause between chunks of chunked mode
+
+	TLS         *tlsconfig.Options        `json:"tls,omitempty"`          // TLS towards the server, when enabled
+	TLSFragment tlsconfig.FragmentOptions `json:"tls_fragment,omitempty"` // Split the ClientHello into TCP segments
+	DNSGuard    dnsguard.Options          `json:"dns_guard,omitempty"`    // Reject poisoned server addresses and re-resolve securely
+
+	fronting.Names        // sni / host_header
+	limiter.Options       // max_connections / max_pending_dials
+	sockopt.Marks         // dscp / tos / socket_priority
+	netdial.DialerOptions // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+}
+
+// WSInjectOptions defines the configuration for the ws-inject outbound.
+// Every connection is a WebSocket to the gateway at server, which relays the
+// messages' bytes both ways.
+type WSInjectOptions struct {
+	Server              string            `json:"server"`                           // Gateway hostname or IP
+	Port                int               `json:"port,omitempty"`                   // Gateway port (default 80, 443 with TLS)
+	Host                string            `json:"host,omitempty"`                   // Host header (default server)
+	Path                string            `json:"path,omitempty"`                   // Request path (default /), e.g. /tunnel/[host_port]
+	Headers             map[string]string `json:"headers,omitempty"`                // Extra request headers; values may use [host] and [port]
+	MaxEarlyData        int               `json:"max_early_data,omitempty"`         // Bytes of the first write sent with the handshake (0 = none)
+	EarlyDataHeaderName string            `json:"early_data_header_name,omitempty"` // Header carrying early data (default: appended to the path)
+
+	HeaderOverrides []headers.OverrideRule `json:"header_overrides,omitempty"` // Per-destination request headers, first match wins
+
+	TLS         *tlsconfig.Options        `json:"tls,omitempty"`          // TLS towards the gateway, when enabled
+	TLSFragment tlsconfig.FragmentOptions `json:"tls_fragment,omitempty"` // Split the ClientHello into TCP segments
+	DNSGuard    dnsguard.Options          `json:"dns_guard,omitempty"`    // Reject poisoned server addresses and re-resolve securely
+
+	fronting.Names        // sni / host_header
+	limiter.Options       // max_connections / max_pending_dials
+	sockopt.Marks         // dscp / tos / socket_priority
+	netdial.DialerOptions // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+}
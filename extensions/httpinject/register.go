@@ -0,0 +1,4 @@
+package httpinject
+
+// Note: Registration is handled in cmd/utp-core/main.go alongside the
+// other extension outbounds.
@@ -0,0 +1,79 @@
+package httpinject
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/payload"
+)
+
+// handshake sends the request for destination and reads the response up to
+// its final status. Bytes the server sent past it belong to the tunnel and
+// are kept for the first reads.
+func (o *Outbound) handshake(ctx context.Context, conn net.Conn, destination metadata.Socksaddr) (net.Conn, error) {
+	vars := payload.Vars{Host: destination.AddrString(), Port: int(destination.Port)}
+	if err := o.requestFor(destination).Write(ctx, conn, vars); err != nil {
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("write request: %w", err))
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		response, err := http.ReadResponse(reader, &http.Request{Method: o.method})
+		if err != nil {
+			return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("read response: %w", err))
+		}
+		switch {
+		case response.StatusCode == http.StatusSwitchingProtocols:
+		case response.StatusCode/100 == 1:
+			// Interim responses such as 100 Continue precede the final one
+			continue
+		case response.StatusCode/100 == 2 && o.opts.Mode == modeChunked:
+			return newChunkedConn(conn, response.Body, o.opts.ChunkSize, time.Duration(o.opts.ChunkDelay)), nil
+		case response.StatusCode/100 == 2:
+			// A gateway answering a GET with a page before the tunnel: skip
+			// the page when its length is known
+			if o.method != http.MethodConnect && response.ContentLength > 0 {
+				if _, err := io.CopyN(io.Discard, response.Body, response.ContentLength); err != nil {
+					return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("read response: %w", err))
+				}
+			}
+		default:
+			return nil, statusError(response, destination)
+		}
+		if reader.Buffered() > 0 {
+			return &bufferedConn{Conn: conn, reader: reader}, nil
+		}
+		return conn, nil
+	}
+}
+
+// statusError classifies a refused request by its status
+func statusError(response *http.Response, destination metadata.Socksaddr) error {
+	err := fmt.Errorf("server refused %s: %s", destination, response.Status)
+	switch response.StatusCode {
+	case http.StatusProxyAuthRequired, http.StatusUnauthorized:
+		return failure.New(failure.KindAuthFailed, failure.StageAuth, err)
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return failure.New(failure.KindUnreachable, failure.StageTarget, err)
+	case http.StatusTooManyRequests, http.StatusPaymentRequired:
+		return failure.New(failure.KindQuotaExceeded, failure.StageHandshake, err)
+	}
+	return failure.Wrap(failure.StageHandshake, err)
+}
+
+// bufferedConn replays bytes read along with the response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
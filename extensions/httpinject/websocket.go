@@ -0,0 +1,363 @@
+package httpinject
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/payload"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// websocketGUID is appended to the key to compute Sec-WebSocket-Accept
+// (RFC 6455 section 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Headers written by the handshake itself
+var reservedHeaders = []string{"Host", "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version"}
+
+var _ adapter.Outbound = (*WSOutbound)(nil)
+
+// WSOutbound reaches destinations through a WebSocket gateway. Each
+// connection completes a real RFC 6455 handshake, and its bytes travel in
+// masked binary messages; pings are answered and closes are echoed, so
+// gateways and CDNs that check the protocol keep the tunnel open.
+type WSOutbound struct {
+	tag       string
+	opts      WSInjectOptions
+	logger    log.ContextLogger
+	path      *payload.Template
+	request   wsRequest
+	overrides *headers.Overrides
+	variants  []wsRequest       // Request of each header override rule
+	tlsConfig *tlsconfig.Config // nil without TLS
+	limiter   *limiter.Limiter
+	guard     *dnsguard.Guard
+	dialer    *netdial.Outbound
+}
+
+// wsRequest is the Host and extra headers of a handshake request
+type wsRequest struct {
+	host    string
+	headers []wsHeader
+}
+
+// wsHeader is an extra request header whose value is a template
+type wsHeader struct {
+	name  string
+	value *payload.Template
+}
+
+// NewWSOutbound creates a new ws-inject outbound
+func NewWSOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts WSInjectOptions) (adapter.Outbound, error) {
+	if opts.Server == "" {
+		return nil, fmt.Errorf("ws-inject requires server")
+	}
+	if opts.MaxEarlyData < 0 {
+		return nil, fmt.Errorf("ws-inject: invalid max_early_data %d", opts.MaxEarlyData)
+	}
+	tlsConfig, err := newTLSConfig(ctx, opts.Server, opts.TLS, opts.TLSFragment, opts.Names)
+	if err != nil {
+		return nil, fmt.Errorf("ws-inject: %w", err)
+	}
+	if opts.Host, err = opts.Names.Host(opts.Host); err != nil {
+		return nil, fmt.Errorf("ws-inject: %w", err)
+	}
+	if opts.Port == 0 {
+		opts.Port = defaultPort
+		if tlsConfig != nil {
+			opts.Port = defaultTLSPort
+		}
+	}
+	if opts.Host == "" {
+		opts.Host = opts.Server
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	path, err := payload.Parse(opts.Path)
+	if err != nil {
+		return nil, fmt.Errorf("ws-inject: path: %w", err)
+	}
+	extra, err := parseHeaders(opts.Headers, opts.EarlyDataHeaderName)
+	if err != nil {
+		return nil, fmt.Errorf("ws-inject: %w", err)
+	}
+	overrides, err := headers.Compile(opts.HeaderOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("ws-inject: %w", err)
+	}
+	variants := make([]wsRequest, 0, len(opts.HeaderOverrides))
+	for i, rule := range opts.HeaderOverrides {
+		merged, host := mergeHeaders(opts.Headers, rule.Headers)
+		if host == "" {
+			host = opts.Host
+		}
+		variant, err := parseHeaders(merged, opts.EarlyDataHeaderName)
+		if err != nil {
+			return nil, fmt.Errorf("ws-inject: header_overrides[%d]: %w", i, err)
+		}
+		variants = append(variants, wsRequest{host: host, headers: variant})
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("ws-inject: %w", err)
+	}
+	dialer, err := netdial.New(ctx, tag, opts.DialerOptions, opts.Marks)
+	if err != nil {
+		return nil, fmt.Errorf("ws-inject: %w", err)
+	}
+	guard, err := dnsguard.New(ctx, opts.DNSGuard)
+	if err != nil {
+		return nil, err
+	}
+	return &WSOutbound{
+		tag:       tag,
+		opts:      opts,
+		logger:    logger,
+		path:      path,
+		request:   wsRequest{host: opts.Host, headers: extra},
+		overrides: overrides,
+		variants:  variants,
+		tlsConfig: tlsConfig,
+		limiter:   limiter.New(opts.Options),
+		guard:     guard,
+		dialer:    dialer,
+	}, nil
+}
+
+// parseHeaders parses extra request headers, sorted by name so every
+// request of the outbound looks the same
+func parseHeaders(values map[string]string, earlyDataHeader string) ([]wsHeader, error) {
+	headers := make([]wsHeader, 0, len(values))
+	for name, value := range values {
+		if name == "" || strings.ContainsAny(name, "\r\n: ") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid header %q", name)
+		}
+		canonical := http.CanonicalHeaderKey(name)
+		if slices.Contains(reservedHeaders, canonical) || strings.EqualFold(name, earlyDataHeader) {
+			return nil, fmt.Errorf("header %s is set by the handshake", canonical)
+		}
+		template, err := payload.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		headers = append(headers, wsHeader{name: name, value: template})
+	}
+	slices.SortFunc(headers, func(a, b wsHeader) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return headers, nil
+}
+
+// requestFor returns the request for destination: that of the first header
+// override rule matching it, or the default one
+func (o *WSOutbound) requestFor(destination metadata.Socksaddr) wsRequest {
+	if index := o.overrides.MatchIndex(destination); index >= 0 {
+		return o.variants[index]
+	}
+	return o.request
+}
+
+func (o *WSOutbound) Type() string {
+	return "ws-inject"
+}
+
+func (o *WSOutbound) Tag() string {
+	return o.tag
+}
+
+func (o *WSOutbound) Dependencies() []string {
+	return o.opts.DialerOptions.Dependencies()
+}
+
+func (o *WSOutbound) Network() []string {
+	return []string{"tcp"}
+}
+
+func (o *WSOutbound) Start() error {
+	return nil
+}
+
+func (o *WSOutbound) Close() error {
+	return nil
+}
+
+// DialContext connects to the gateway. With early data, the handshake waits
+// for the first write, which it carries.
+func (o *WSOutbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	conn, err := o.dial(ctx, destination)
+	if err != nil {
+		release()
+		o.logger.Debug("ws-inject[", o.tag, "]: server ", o.opts.Server, ":", o.opts.Port, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+func (o *WSOutbound) dial(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	conn, err := o.guard.DialContext(ctx, o.dialer.For(adapter.ContextFrom(ctx)), "tcp", o.opts.Server, o.opts.Port)
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to dial server: %w", err))
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(C.TCPTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if o.tlsConfig != nil {
+		tlsConn, err := o.tlsConfig.Handshake(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, failure.Wrap(failure.StageTLS, err)
+		}
+		conn = tlsConn
+	}
+	if o.opts.MaxEarlyData > 0 {
+		conn.SetDeadline(time.Time{})
+		return &earlyConn{Conn: conn, ctx: ctx, outbound: o, destination: destination, ready: make(chan struct{})}, nil
+	}
+	ws, err := o.handshake(conn, destination, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// handshake upgrades conn to a WebSocket for destination, sending early in
+// the request
+func (o *WSOutbound) handshake(conn net.Conn, destination metadata.Socksaddr, early []byte) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	vars := payload.Vars{Host: destination.AddrString(), Port: int(destination.Port)}
+	path := o.path.Text(vars)
+	if len(early) > 0 && o.opts.EarlyDataHeaderName == "" {
+		path += base64.RawURLEncoding.EncodeToString(early)
+	}
+	selected := o.requestFor(destination)
+	var request strings.Builder
+	fmt.Fprintf(&request, "GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n", path, selected.host)
+	fmt.Fprintf(&request, "Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n", key)
+	if len(early) > 0 && o.opts.EarlyDataHeaderName != "" {
+		fmt.Fprintf(&request, "%s: %s\r\n", o.opts.EarlyDataHeaderName, base64.RawURLEncoding.EncodeToString(early))
+	}
+	for _, header := range selected.headers {
+		fmt.Fprintf(&request, "%s: %s\r\n", header.name, header.value.Text(vars))
+	}
+	request.WriteString("\r\n")
+	if _, err := conn.Write([]byte(request.String())); err != nil {
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("write request: %w", err))
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("read response: %w", err))
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, statusError(response, destination)
+	}
+	if !strings.EqualFold(response.Header.Get("Upgrade"), "websocket") {
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("server upgraded to %q instead of websocket", response.Header.Get("Upgrade")))
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("invalid Sec-WebSocket-Accept"))
+	}
+	return newWSConn(conn, reader), nil
+}
+
+// acceptKey returns the Sec-WebSocket-Accept expected for key
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (o *WSOutbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	return nil, fmt.Errorf("ws-inject outbound does not support UDP")
+}
+
+// earlyConn defers the handshake to the first write, whose first bytes
+// ride in the request as early data, saving a round trip
+type earlyConn struct {
+	net.Conn                    // To the gateway, until the handshake
+	ctx         context.Context // Of the dial, whose tenant failures are reported to
+	outbound    *WSOutbound
+	destination metadata.Socksaddr
+
+	once  sync.Once
+	ready chan struct{} // Closed once the handshake is done or abandoned
+	ws    *wsConn
+	err   error
+}
+
+func (c *earlyConn) Write(b []byte) (int, error) {
+	written := -1
+	c.once.Do(func() {
+		defer close(c.ready)
+		early := b[:min(len(b), c.outbound.opts.MaxEarlyData)]
+		c.Conn.SetDeadline(time.Now().Add(C.TCPTimeout))
+		c.ws, c.err = c.outbound.handshake(c.Conn, c.destination, early)
+		if c.err != nil {
+			c.outbound.logger.Debug("ws-inject[", c.outbound.tag, "]: server ", c.outbound.opts.Server, ":", c.outbound.opts.Port, " failed: ", c.err)
+			failure.Report(c.ctx, c.outbound.tag, c.err)
+			return
+		}
+		c.Conn.SetDeadline(time.Time{})
+		written = len(early)
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	if written < 0 {
+		return c.ws.Write(b)
+	}
+	if written == len(b) {
+		return written, nil
+	}
+	n, err := c.ws.Write(b[written:])
+	return written + n, err
+}
+
+// Read waits for the handshake, which only the first write starts
+func (c *earlyConn) Read(b []byte) (int, error) {
+	<-c.ready
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.ws.Read(b)
+}
+
+func (c *earlyConn) Close() error {
+	c.once.Do(func() {
+		c.err = net.ErrClosed
+		close(c.ready)
+	})
+	if c.ws != nil {
+		return c.ws.Close()
+	}
+	return c.Conn.Close()
+}
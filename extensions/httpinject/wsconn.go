@@ -0,0 +1,127 @@
+package httpinject
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/ws"
+)
+
+// closeTimeout bounds the write of the close frame when a connection closes
+const closeTimeout = time.Second
+
+// wsConn is the client end of a WebSocket carrying a byte stream. Writes
+// are sent as masked binary messages, and the payloads of the server's data
+// messages are read back to back.
+type wsConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	remaining int64 // Payload left in the data frame being read
+
+	writeAccess sync.Mutex
+	closeSent   atomic.Bool
+}
+
+func newWSConn(conn net.Conn, reader *bufio.Reader) *wsConn {
+	return &wsConn{Conn: conn, reader: reader}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		header, err := ws.ReadHeader(c.reader)
+		if err != nil {
+			return 0, err
+		}
+		// Servers must not mask (RFC 6455 section 5.1)
+		if header.Masked {
+			c.sendClose(ws.StatusProtocolError)
+			return 0, fmt.Errorf("websocket: masked frame from server")
+		}
+		if header.OpCode.IsControl() {
+			if err := c.control(header); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		c.remaining = header.Length
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// control handles a control frame: pings are answered with pongs, and a
+// close frame is echoed and ends the stream
+func (c *wsConn) control(header ws.Header) error {
+	if header.Length > ws.MaxControlFramePayloadSize || !header.Fin {
+		c.sendClose(ws.StatusProtocolError)
+		return fmt.Errorf("websocket: invalid control frame")
+	}
+	body := make([]byte, header.Length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return err
+	}
+	switch header.OpCode {
+	case ws.OpPing:
+		return c.writeFrame(ws.OpPong, body)
+	case ws.OpClose:
+		code, _ := ws.ParseCloseFrameData(body)
+		if code.Empty() {
+			code = ws.StatusNormalClosure
+		}
+		c.sendClose(code)
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if c.closeSent.Load() {
+		return 0, net.ErrClosed
+	}
+	if err := c.writeFrame(ws.OpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes one masked frame. Frames are written whole, so pongs
+// sent while reading do not interleave with data.
+func (c *wsConn) writeFrame(op ws.OpCode, body []byte) error {
+	header := ws.Header{Fin: true, OpCode: op, Masked: true, Length: int64(len(body))}
+	rand.Read(header.Mask[:])
+	frame := bytes.NewBuffer(make([]byte, 0, ws.HeaderSize(header)+len(body)))
+	ws.WriteHeader(frame, header)
+	start := frame.Len()
+	frame.Write(body)
+	ws.Cipher(frame.Bytes()[start:], header.Mask, 0)
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	_, err := c.Conn.Write(frame.Bytes())
+	return err
+}
+
+// sendClose starts or answers the close handshake, once
+func (c *wsConn) sendClose(code ws.StatusCode) {
+	if c.closeSent.Swap(true) {
+		return
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.writeFrame(ws.OpClose, ws.NewCloseFrameBody(code, ""))
+}
+
+// Close sends a close frame before closing the connection
+func (c *wsConn) Close() error {
+	c.sendClose(ws.StatusNormalClosure)
+	return c.Conn.Close()
+}
@@ -0,0 +1,12 @@
+package localproxy
+
+import "github.com/sagernet/sing-box/option"
+
+// LocalProxyOptions defines the configuration for the local proxy inbound.
+// It accepts every option of the Sing-box "mixed" inbound.
+type LocalProxyOptions struct {
+	option.HTTPMixedInboundOptions
+	PACPath      string   `json:"pac_path,omitempty"`       // URL path of the PAC file (default /proxy.pac)
+	PACProxyHost string   `json:"pac_proxy_host,omitempty"` // host:port advertised in the PAC file (default: the listen address, or the local address browsers connect to)
+	PACDirect    []string `json:"pac_direct,omitempty"`     // Extra domain suffixes that always go DIRECT
+}
@@ -0,0 +1,130 @@
+package localproxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+)
+
+// privateRanges mirrors ip_is_private for IPv4 hosts
+var privateRanges = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16"}
+
+// generatePAC renders a PAC file from the route rules. Rules are translated
+// in order; rules with conditions a browser cannot evaluate (ports,
+// processes, rule sets, logical rules...) are skipped.
+func generatePAC(options *option.Options, extraDirect []string, proxyHost string) string {
+	outboundTypes := make(map[string]string)
+	var defaultOutbound string
+	if options != nil {
+		for _, outbound := range options.Outbounds {
+			outboundTypes[outbound.Tag] = outbound.Type
+			if defaultOutbound == "" {
+				defaultOutbound = outbound.Tag
+			}
+		}
+	}
+
+	proxy := fmt.Sprintf("PROXY %s; SOCKS5 %s", proxyHost, proxyHost)
+	verdict := func(outbound string) string {
+		if outboundTypes[outbound] == C.TypeDirect {
+			return "DIRECT"
+		}
+		return proxy
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+	for _, suffix := range extraDirect {
+		fmt.Fprintf(&b, "  if (%s) return %s;\n", domainSuffixCond(suffix), strconv.Quote("DIRECT"))
+	}
+	if options != nil && options.Route != nil {
+		for _, rule := range options.Route.Rules {
+			cond, ok := ruleCondition(rule)
+			if !ok {
+				continue
+			}
+			action := rule.DefaultOptions.RuleAction
+			switch action.Action {
+			case "", C.RuleActionTypeRoute:
+				fmt.Fprintf(&b, "  if (%s) return %s;\n", cond, strconv.Quote(verdict(action.RouteOptions.Outbound)))
+			case C.RuleActionTypeReject:
+				// Let the core enforce the rejection
+				fmt.Fprintf(&b, "  if (%s) return %s;\n", cond, strconv.Quote(proxy))
+			}
+		}
+		if options.Route.Final != "" {
+			defaultOutbound = options.Route.Final
+		}
+	}
+	fmt.Fprintf(&b, "  return %s;\n", strconv.Quote(verdict(defaultOutbound)))
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// ruleCondition translates the destination matchers of a default rule into
+// a JavaScript expression
+func ruleCondition(rule option.Rule) (string, bool) {
+	if rule.Type != "" && rule.Type != C.RuleTypeDefault {
+		return "", false
+	}
+	r := rule.DefaultOptions.RawDefaultRule
+	if r.Invert || len(r.Inbound) > 0 || r.IPVersion != 0 || len(r.Network) > 0 || len(r.AuthUser) > 0 ||
+		len(r.Protocol) > 0 || len(r.Client) > 0 || len(r.DomainRegex) > 0 || len(r.Geosite) > 0 ||
+		len(r.SourceGeoIP) > 0 || len(r.GeoIP) > 0 || len(r.SourceIPCIDR) > 0 || r.SourceIPIsPrivate ||
+		len(r.SourcePort) > 0 || len(r.SourcePortRange) > 0 || len(r.Port) > 0 || len(r.PortRange) > 0 ||
+		len(r.ProcessName) > 0 || len(r.ProcessPath) > 0 || len(r.ProcessPathRegex) > 0 ||
+		len(r.PackageName) > 0 || len(r.User) > 0 || len(r.UserID) > 0 || r.ClashMode != "" ||
+		len(r.NetworkType) > 0 || len(r.WIFISSID) > 0 || len(r.WIFIBSSID) > 0 || len(r.RuleSet) > 0 {
+		return "", false
+	}
+
+	// Within a rule, domain matchers are OR-ed, as are IP matchers
+	var conds []string
+	for _, domain := range r.Domain {
+		conds = append(conds, fmt.Sprintf("host == %s", strconv.Quote(strings.ToLower(domain))))
+	}
+	for _, suffix := range r.DomainSuffix {
+		conds = append(conds, domainSuffixCond(suffix))
+	}
+	for _, keyword := range r.DomainKeyword {
+		conds = append(conds, fmt.Sprintf("host.indexOf(%s) >= 0", strconv.Quote(strings.ToLower(keyword))))
+	}
+	cidrs := append([]string(nil), r.IPCIDR...)
+	if r.IPIsPrivate {
+		cidrs = append(cidrs, privateRanges...)
+		conds = append(conds, "isPlainHostName(host)")
+	}
+	for _, cidr := range cidrs {
+		if cond, ok := cidrCondition(cidr); ok {
+			conds = append(conds, cond)
+		}
+	}
+	if len(conds) == 0 {
+		return "", false
+	}
+	return strings.Join(conds, " || "), true
+}
+
+func domainSuffixCond(suffix string) string {
+	suffix = strings.TrimPrefix(strings.ToLower(suffix), ".")
+	return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", strconv.Quote(suffix), strconv.Quote("."+suffix))
+}
+
+// cidrCondition renders an IPv4 prefix as isInNet; IPv6 is not portable in PAC
+func cidrCondition(cidr string) (string, bool) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil || !prefix.Addr().Is4() {
+		return "", false
+	}
+	mask := netip.AddrFrom4([4]byte{})
+	if bits := prefix.Bits(); bits > 0 {
+		m := ^uint32(0) << (32 - bits)
+		mask = netip.AddrFrom4([4]byte{byte(m >> 24), byte(m >> 16), byte(m >> 8), byte(m)})
+	}
+	return fmt.Sprintf("isInNet(host, %q, %q)", prefix.Masked().Addr().String(), mask.String()), true
+}
@@ -0,0 +1,232 @@
+package localproxy
+
+import (
+	std_bufio "bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/listener"
+	"github.com/sagernet/sing-box/common/uot"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing-box/protocol/mixed"
+	"github.com/sagernet/sing/common/auth"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/protocol/socks/socks4"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+
+	"github.com/UTPBox/utp-core/internal/config"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+const defaultPACPath = "/proxy.pac"
+
+var _ adapter.TCPInjectableInbound = (*Inbound)(nil)
+
+// Inbound is a local HTTP(S)/SOCKS5 proxy that also serves a PAC file
+// generated from the current route rules on the same port. HTTP is handed
+// to the Sing-box mixed inbound; SOCKS is served here so UDP associations
+// can be tuned.
+type Inbound struct {
+	ctx           context.Context
+	tag           string
+	opts          LocalProxyOptions
+	logger        log.ContextLogger
+	router        *uot.Router
+	authenticator *auth.Authenticator
+	mixed         adapter.TCPInjectableInbound
+	listener      *listener.Listener
+	tlsConfig     *tlsconfig.ServerConfig
+}
+
+// NewInbound creates a new local proxy inbound
+func NewInbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts LocalProxyOptions) (adapter.Inbound, error) {
+	if opts.PACPath == "" {
+		opts.PACPath = defaultPACPath
+	}
+	if !strings.HasPrefix(opts.PACPath, "/") {
+		return nil, fmt.Errorf("pac_path must start with /")
+	}
+	if opts.PACProxyHost != "" && !validProxyHost(opts.PACProxyHost) {
+		return nil, fmt.Errorf("pac_proxy_host must be host:port, got %q", opts.PACProxyHost)
+	}
+	// TLS is terminated here so the PAC request can be sniffed in cleartext
+	mixedOptions := opts.HTTPMixedInboundOptions
+	mixedOptions.TLS = nil
+	proxy, err := mixed.NewInbound(ctx, router, logger, tag, mixedOptions)
+	if err != nil {
+		return nil, err
+	}
+	i := &Inbound{
+		ctx:           ctx,
+		tag:           tag,
+		opts:          opts,
+		logger:        logger,
+		router:        uot.NewRouter(router, logger),
+		authenticator: auth.NewAuthenticator(opts.Users),
+		mixed:         proxy.(adapter.TCPInjectableInbound),
+	}
+	if opts.TLS != nil {
+		i.tlsConfig, err = tlsconfig.NewServer(ctx, logger, tlsconfig.ServerOptions{InboundTLSOptions: *opts.TLS})
+		if err != nil {
+			return nil, err
+		}
+	}
+	i.listener = listener.New(listener.Options{
+		Context:           ctx,
+		Logger:            logger,
+		Network:           []string{N.NetworkTCP},
+		Listen:            opts.ListenOptions,
+		ConnectionHandler: i,
+		SetSystemProxy:    opts.SetSystemProxy,
+		SystemProxySOCKS:  true,
+	})
+	return i, nil
+}
+
+func (i *Inbound) Type() string {
+	return "local-proxy"
+}
+
+func (i *Inbound) Tag() string {
+	return i.tag
+}
+
+func (i *Inbound) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	// The mixed inbound only handles connections we pass to it, so it is
+	// never started and does not bind the port itself
+	if i.tlsConfig != nil {
+		if err := i.tlsConfig.Start(); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+	return i.listener.Start()
+}
+
+func (i *Inbound) Close() error {
+	i.listener.Close()
+	if i.tlsConfig != nil {
+		i.tlsConfig.Close()
+	}
+	return i.mixed.Close()
+}
+
+func (i *Inbound) NewConnectionEx(ctx context.Context, conn net.Conn, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	if i.tlsConfig != nil {
+		tlsConn, err := i.tlsConfig.Handshake(ctx, conn)
+		if err != nil {
+			i.logger.DebugContext(ctx, "TLS handshake from ", metadata.Source, ": ", err)
+			N.CloseOnHandshakeFailure(conn, onClose, err)
+			return
+		}
+		conn = tlsConn
+	}
+	reader := std_bufio.NewReader(conn)
+	// SOCKS clients send a few bytes and wait for the reply, so they are
+	// told apart by the first byte before peeking for the PAC request
+	version, _ := reader.Peek(1)
+	if len(version) == 1 && (version[0] == socks4.Version || version[0] == socks5.Version) {
+		i.serveSOCKS(ctx, conn, reader, metadata, onClose)
+		return
+	}
+	request := []byte("GET " + i.opts.PACPath)
+	peeked, _ := reader.Peek(len(request) + 1)
+	if len(peeked) == len(request)+1 && bytes.HasPrefix(peeked, request) && (peeked[len(request)] == ' ' || peeked[len(request)] == '?') {
+		i.servePAC(conn, reader, onClose)
+		return
+	}
+	i.mixed.NewConnectionEx(ctx, &bufferedConn{Conn: conn, reader: reader}, metadata, onClose)
+}
+
+func (i *Inbound) servePAC(conn net.Conn, reader *std_bufio.Reader, onClose N.CloseHandlerFunc) {
+	defer func() {
+		conn.Close()
+		if onClose != nil {
+			onClose(nil)
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	req.Body.Close()
+	body := generatePAC(config.OptionsFromContext(i.ctx), i.opts.PACDirect, i.pacProxyHost(conn))
+	i.logger.Debug("serving PAC file to ", conn.RemoteAddr())
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/x-ns-proxy-autoconfig"}, "Cache-Control": {"no-cache"}},
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+	resp.Write(conn)
+}
+
+// pacProxyHost returns the proxy address written into the PAC file:
+// pac_proxy_host, or the listen address, or, when listening on every
+// address, the local address the browser reached. The Host header is not
+// used, since the client chooses it and the PAC file is a script.
+func (i *Inbound) pacProxyHost(conn net.Conn) string {
+	if i.opts.PACProxyHost != "" {
+		return i.opts.PACProxyHost
+	}
+	addr := i.opts.Listen.Build(netip.IPv4Unspecified())
+	if addr.IsUnspecified() {
+		addr = M.SocksaddrFromNet(conn.LocalAddr()).Addr
+	}
+	return netip.AddrPortFrom(addr.Unmap(), i.opts.ListenPort).String()
+}
+
+// validProxyHost reports whether value is a host:port fit to be written
+// into the PAC file: an IP address or a DNS name, and a port
+func validProxyHost(value string) bool {
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return false
+	}
+	if number, err := strconv.ParseUint(port, 10, 16); err != nil || number == 0 {
+		return false
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// bufferedConn replays bytes already buffered while sniffing the request
+type bufferedConn struct {
+	net.Conn
+	reader *std_bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
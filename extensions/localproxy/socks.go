@@ -0,0 +1,188 @@
+package localproxy
+
+import (
+	std_bufio "bufio"
+	"context"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/listener"
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/protocol/socks"
+)
+
+// SOCKS5 UDP fragmentation (RFC 1928, section 7). FRAG numbers the
+// fragments of a datagram from 1; the high bit marks the last one.
+const (
+	fragmentEnd     = 0x80
+	fragmentTimeout = 5 * time.Second
+	maxDatagramSize = 65535
+)
+
+// serveSOCKS handles a SOCKS4/5 connection like the mixed inbound does, except
+// that UDP associations reassemble fragmented requests and take the
+// udp_timeout of the inbound
+func (i *Inbound) serveSOCKS(ctx context.Context, conn net.Conn, reader *std_bufio.Reader, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	handler := adapter.NewUpstreamHandlerEx(metadata, i.routeConnection, i.routePacketConnection)
+	// The reader may hold bytes sent right after the request
+	conn = &bufferedConn{Conn: conn, reader: reader}
+	err := socks.HandleConnectionEx(ctx, conn, reader, i.authenticator, handler, associateListener{i.listener}, metadata.Source, onClose)
+	N.CloseOnHandshakeFailure(conn, onClose, err)
+	if err != nil {
+		if E.IsClosedOrCanceled(err) {
+			i.logger.DebugContext(ctx, "connection closed: ", err)
+		} else {
+			i.logger.ErrorContext(ctx, E.Cause(err, "process connection from ", metadata.Source))
+		}
+	}
+}
+
+// Connections report the mixed inbound type, as the HTTP ones do
+func (i *Inbound) routeConnection(ctx context.Context, conn net.Conn, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	metadata.Inbound = i.tag
+	metadata.InboundType = i.mixed.Type()
+	if user, loaded := auth.UserFromContext[string](ctx); loaded {
+		metadata.User = user
+		i.logger.InfoContext(ctx, "[", user, "] inbound connection to ", metadata.Destination)
+	} else {
+		i.logger.InfoContext(ctx, "inbound connection to ", metadata.Destination)
+	}
+	i.router.RouteConnectionEx(ctx, conn, metadata, onClose)
+}
+
+func (i *Inbound) routePacketConnection(ctx context.Context, conn N.PacketConn, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	metadata.Inbound = i.tag
+	metadata.InboundType = i.mixed.Type()
+	// Without udp_timeout, associations of unknown protocols stay open as
+	// long as their TCP connection
+	if i.opts.UDPTimeout > 0 {
+		metadata.UDPTimeout = time.Duration(i.opts.UDPTimeout)
+	}
+	if user, loaded := auth.UserFromContext[string](ctx); loaded {
+		metadata.User = user
+		i.logger.InfoContext(ctx, "[", user, "] inbound packet connection to ", metadata.Destination)
+	} else {
+		i.logger.InfoContext(ctx, "inbound packet connection to ", metadata.Destination)
+	}
+	i.router.RoutePacketConnectionEx(ctx, conn, metadata, onClose)
+}
+
+// associateListener opens the UDP sockets of associations with the listen
+// options of the inbound (bind_interface, routing_mark, reuse_addr)
+type associateListener struct {
+	listener *listener.Listener
+}
+
+func (l associateListener) ListenPacket(listenConfig net.ListenConfig, ctx context.Context, network string, address string) (net.PacketConn, error) {
+	conn, err := l.listener.ListenPacket(listenConfig, ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &fragmentConn{PacketConn: conn}, nil
+}
+
+// fragmentConn reassembles fragmented SOCKS5 UDP requests before the
+// association parses them. A sequence starts at position 1 and is dropped
+// when a fragment arrives out of order, from another address or more than
+// fragmentTimeout after its first one. Requests larger than the buffer of
+// the reader (16 KiB in Sing-box) are dropped rather than truncated.
+type fragmentConn struct {
+	net.PacketConn
+	buffer   []byte
+	source   string // Address the fragments of the sequence come from
+	header   []byte // Header of the first fragment, with FRAG cleared
+	data     []byte
+	position byte
+	started  time.Time
+}
+
+func (c *fragmentConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.buffer == nil {
+		c.buffer = make([]byte, maxDatagramSize)
+	}
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.buffer)
+		if err != nil {
+			return 0, nil, err
+		}
+		packet := c.buffer[:n]
+		headerLength := requestHeaderLength(packet)
+		if headerLength == 0 {
+			continue
+		}
+		frag := packet[2]
+		if frag == 0 {
+			c.reset()
+			if len(packet) > len(b) {
+				continue
+			}
+			return copy(b, packet), addr, nil
+		}
+		position := frag &^ fragmentEnd
+		if position == 0 {
+			continue
+		}
+		if c.position != 0 && (position != c.position+1 || addr.String() != c.source || time.Since(c.started) > fragmentTimeout) {
+			c.reset()
+		}
+		if c.position == 0 {
+			if position != 1 {
+				continue
+			}
+			c.source = addr.String()
+			c.header = append(c.header[:0], packet[:headerLength]...)
+			c.header[2] = 0
+			c.started = time.Now()
+		}
+		c.data = append(c.data, packet[headerLength:]...)
+		c.position = position
+		if len(c.header)+len(c.data) > maxDatagramSize {
+			c.reset()
+			continue
+		}
+		if frag&fragmentEnd != 0 {
+			if len(c.header)+len(c.data) > len(b) {
+				c.reset()
+				continue
+			}
+			n = copy(b, c.header)
+			n += copy(b[n:], c.data)
+			c.reset()
+			return n, addr, nil
+		}
+	}
+}
+
+func (c *fragmentConn) reset() {
+	c.data = c.data[:0]
+	c.position = 0
+}
+
+// requestHeaderLength returns the length of the RSV, FRAG and address
+// fields of a SOCKS5 UDP request, or 0 when it is malformed
+func requestHeaderLength(packet []byte) int {
+	if len(packet) < 4 {
+		return 0
+	}
+	var length int
+	switch packet[3] {
+	case 1:
+		length = 4 + 4 + 2
+	case 4:
+		length = 4 + 16 + 2
+	case 3:
+		if len(packet) < 5 {
+			return 0
+		}
+		length = 4 + 1 + int(packet[4]) + 2
+	default:
+		return 0
+	}
+	if len(packet) < length {
+		return 0
+	}
+	return length
+}
@@ -0,0 +1,243 @@
+package naive
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	"golang.org/x/net/http2"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// HTTP/2 health checks of the shared connection
+const (
+	readIdleTimeout = 30 * time.Second
+	pingTimeout     = 15 * time.Second
+)
+
+var _ adapter.Outbound = (*Outbound)(nil)
+
+// Outbound reaches destinations through a NaiveProxy server. Each connection
+// is an HTTP/2 CONNECT stream; streams share one TLS connection whose
+// ClientHello mimics a browser, as the Chromium network stack of NaiveProxy
+// does.
+type Outbound struct {
+	tag           string
+	opts          NaiveOptions
+	logger        log.ContextLogger
+	authorization string // Proxy-Authorization value, empty without credentials
+	tlsConfig     *tlsconfig.Config
+	transport     *http2.Transport
+	limiter       *limiter.Limiter
+	guard         *dnsguard.Guard
+	dialer        *netdial.Outbound
+
+	access sync.Mutex
+	client *http2.ClientConn
+}
+
+// NewOutbound creates a new NaiveProxy outbound
+func NewOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts NaiveOptions) (adapter.Outbound, error) {
+	if opts.Server == "" || opts.Port == 0 {
+		return nil, fmt.Errorf("naive requires server and port")
+	}
+	tlsOptions := tlsconfig.Options{}
+	if opts.TLS != nil {
+		tlsOptions = *opts.TLS
+	}
+	tlsOptions.Enabled = true
+	// Padding is only negotiated over HTTP/2
+	tlsOptions.ALPN = []string{http2.NextProtoTLS}
+	tlsConfig, err := tlsconfig.New(ctx, opts.Server, tlsOptions)
+	if err != nil {
+		return nil, fmt.Errorf("naive: %w", err)
+	}
+	if err := tlsConfig.Fragment(opts.TLSFragment); err != nil {
+		return nil, fmt.Errorf("naive: %w", err)
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("naive: %w", err)
+	}
+	dialer, err := netdial.New(ctx, tag, opts.DialerOptions, opts.Marks)
+	if err != nil {
+		return nil, fmt.Errorf("naive: %w", err)
+	}
+	guard, err := dnsguard.New(ctx, opts.DNSGuard)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbound{
+		tag:       tag,
+		opts:      opts,
+		logger:    logger,
+		tlsConfig: tlsConfig,
+		transport: &http2.Transport{ReadIdleTimeout: readIdleTimeout, PingTimeout: pingTimeout},
+		limiter:   limiter.New(opts.Options),
+		guard:     guard,
+		dialer:    dialer,
+	}
+	if opts.Username != "" || opts.Password != "" {
+		o.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(opts.Username+":"+opts.Password))
+	}
+	return o, nil
+}
+
+func (o *Outbound) Type() string {
+	return "naive"
+}
+
+func (o *Outbound) Tag() string {
+	return o.tag
+}
+
+func (o *Outbound) Dependencies() []string {
+	return o.opts.DialerOptions.Dependencies()
+}
+
+// UDP over NaiveProxy needs HTTP/3 CONNECT-UDP, which is not implemented
+func (o *Outbound) Network() []string {
+	return []string{"tcp"}
+}
+
+func (o *Outbound) Start() error {
+	return nil
+}
+
+func (o *Outbound) Close() error {
+	o.access.Lock()
+	defer o.access.Unlock()
+	if o.client != nil {
+		o.client.Close()
+		o.client = nil
+	}
+	return nil
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	conn, err := o.dial(ctx, destination)
+	if err != nil {
+		release()
+		o.logger.Debug("naive[", o.tag, "]: server ", o.opts.Server, ":", o.opts.Port, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+// dial opens a CONNECT stream to destination, on a fresh connection if the
+// shared one broke before the request was sent
+func (o *Outbound) dial(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := o.clientConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := o.connect(ctx, client, destination)
+		if err == nil || attempt > 0 || client.CanTakeNewRequest() {
+			return conn, err
+		}
+	}
+}
+
+// clientConn returns the shared HTTP/2 connection, establishing a new one
+// when it can take no more streams
+func (o *Outbound) clientConn(ctx context.Context) (*http2.ClientConn, error) {
+	o.access.Lock()
+	defer o.access.Unlock()
+	if o.client != nil && o.client.CanTakeNewRequest() {
+		return o.client, nil
+	}
+	// Streams of many connections share the socket, so only QoS rules
+	// matching the outbound apply
+	conn, err := o.guard.DialContext(ctx, o.dialer.For(nil), "tcp", o.opts.Server, o.opts.Port)
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to dial server: %w", err))
+	}
+	tlsConn, err := o.tlsConfig.Handshake(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, failure.Wrap(failure.StageTLS, err)
+	}
+	if state, ok := tlsConn.(interface{ ConnectionState() tls.ConnectionState }); ok && state.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, failure.Wrap(failure.StageTLS, fmt.Errorf("server did not negotiate HTTP/2"))
+	}
+	client, err := o.transport.NewClientConn(tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, failure.Wrap(failure.StageHandshake, err)
+	}
+	if o.client != nil {
+		o.client.Close()
+	}
+	o.client = client
+	return client, nil
+}
+
+// connect sends the CONNECT request for destination and waits for the
+// response headers
+func (o *Outbound) connect(ctx context.Context, client *http2.ClientConn, destination metadata.Socksaddr) (net.Conn, error) {
+	reader, writer := io.Pipe()
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: destination.String()},
+		Host:   destination.String(),
+		Header: http.Header{"Padding": {paddingHeader()}},
+		Body:   reader,
+	}
+	if o.authorization != "" {
+		request.Header.Set("Proxy-Authorization", o.authorization)
+	}
+	// The stream outlives the dial context, which only bounds the wait for
+	// the response
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	timer := time.AfterFunc(C.TCPTimeout, cancel)
+	response, err := client.RoundTrip(request.WithContext(streamCtx))
+	timer.Stop()
+	stop()
+	if err != nil {
+		cancel()
+		writer.Close()
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("CONNECT failed: %w", err))
+	}
+	if response.StatusCode != http.StatusOK {
+		cancel()
+		writer.Close()
+		response.Body.Close()
+		err := fmt.Errorf("server responded %s", response.Status)
+		if response.StatusCode == http.StatusProxyAuthRequired {
+			return nil, failure.Wrap(failure.StageAuth, err)
+		}
+		return nil, failure.Wrap(failure.StageTarget, err)
+	}
+	return &naiveConn{
+		body:   response.Body,
+		writer: writer,
+		cancel: cancel,
+		padded: response.Header.Get("Padding") != "",
+	}, nil
+}
+
+func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	return nil, fmt.Errorf("naive outbound does not support UDP")
+}
@@ -0,0 +1,25 @@
+package naive
+
+import (
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// NaiveOptions defines the configuration for the NaiveProxy outbound
+type NaiveOptions struct {
+	Server   string `json:"server"`             // Server hostname or IP
+	Port     int    `json:"port"`               // Server port (usually 443)
+	Username string `json:"username,omitempty"` // Basic auth user
+	Password string `json:"password,omitempty"` // Basic auth password
+
+	TLS         *tlsconfig.Options        `json:"tls,omitempty"`          // TLS towards the server (uTLS, pins); always enabled
+	TLSFragment tlsconfig.FragmentOptions `json:"tls_fragment,omitempty"` // Split the ClientHello into TCP segments
+	DNSGuard    dnsguard.Options          `json:"dns_guard,omitempty"`    // Reject poisoned server addresses and re-resolve securely
+
+	limiter.Options       // max_connections / max_pending_dials
+	sockopt.Marks         // dscp / tos / socket_priority
+	netdial.DialerOptions // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+}
@@ -0,0 +1,135 @@
+package naive
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// NaiveProxy padding. The first frames of each direction carry a 3 byte
+// header (data length, padding length) and random zero padding, hiding the
+// lengths of the TLS handshake inside the tunnel; later data is sent as is.
+const (
+	paddingFrames     = 8
+	maxPaddingLength  = 255
+	maxFrameLength    = 0xffff
+	paddingHeaderSize = 3
+)
+
+// paddingHeader returns the value of the padding request header: 16 to 32
+// characters, the first 16 random ones that HPACK cannot Huffman-compress
+func paddingHeader() string {
+	header := make([]byte, 16+rand.IntN(17))
+	bits := rand.Uint64()
+	for i := range header {
+		if i < 16 {
+			header[i] = "!#$()+<>?@[]^`{}"[bits&15]
+			bits >>= 4
+		} else {
+			header[i] = '~'
+		}
+	}
+	return string(header)
+}
+
+// naiveConn is one CONNECT stream. Writes go to the request body and reads
+// come from the response body.
+type naiveConn struct {
+	body   io.ReadCloser
+	writer *io.PipeWriter
+	cancel context.CancelFunc
+	padded bool // The server answered with a padding header
+
+	readFrames       int
+	readRemaining    int // Data left in the current frame
+	paddingRemaining int // Padding after it
+
+	writeAccess sync.Mutex
+	writeFrames int
+}
+
+func (c *naiveConn) Read(b []byte) (int, error) {
+	for {
+		if c.readRemaining > 0 {
+			n, err := c.body.Read(b[:min(len(b), c.readRemaining)])
+			c.readRemaining -= n
+			return n, err
+		}
+		if c.paddingRemaining > 0 {
+			if _, err := io.CopyN(io.Discard, c.body, int64(c.paddingRemaining)); err != nil {
+				return 0, err
+			}
+			c.paddingRemaining = 0
+		}
+		if !c.padded || c.readFrames >= paddingFrames {
+			return c.body.Read(b)
+		}
+		var header [paddingHeaderSize]byte
+		if _, err := io.ReadFull(c.body, header[:]); err != nil {
+			return 0, err
+		}
+		c.readFrames++
+		c.readRemaining = int(binary.BigEndian.Uint16(header[:2]))
+		c.paddingRemaining = int(header[2])
+	}
+}
+
+func (c *naiveConn) Write(b []byte) (int, error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	var n int
+	for c.padded && c.writeFrames < paddingFrames && len(b) > 0 {
+		data := b[:min(len(b), maxFrameLength)]
+		padding := rand.IntN(maxPaddingLength + 1)
+		frame := make([]byte, paddingHeaderSize+len(data)+padding)
+		binary.BigEndian.PutUint16(frame, uint16(len(data)))
+		frame[2] = byte(padding)
+		copy(frame[paddingHeaderSize:], data)
+		if _, err := c.writer.Write(frame); err != nil {
+			return n, err
+		}
+		c.writeFrames++
+		n += len(data)
+		b = b[len(data):]
+	}
+	if len(b) == 0 {
+		return n, nil
+	}
+	written, err := c.writer.Write(b)
+	return n + written, err
+}
+
+// CloseWrite ends the request body, half-closing the stream
+func (c *naiveConn) CloseWrite() error {
+	return c.writer.Close()
+}
+
+func (c *naiveConn) Close() error {
+	c.writer.Close()
+	c.cancel()
+	return c.body.Close()
+}
+
+func (c *naiveConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *naiveConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *naiveConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *naiveConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *naiveConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,203 @@
+package obfs
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	mrand "math/rand/v2"
+)
+
+// Browser signatures of the Cloak ClientHello
+const (
+	BrowserChrome  = "chrome"
+	BrowserFirefox = "firefox"
+)
+
+// TLS extension types
+const (
+	extServerName           = 0x0000
+	extStatusRequest        = 0x0005
+	extSupportedGroups      = 0x000a
+	extECPointFormats       = 0x000b
+	extSignatureAlgorithms  = 0x000d
+	extALPN                 = 0x0010
+	extSCT                  = 0x0012
+	extPadding              = 0x0015
+	extExtendedMasterSecret = 0x0017
+	extCompressCertificate  = 0x001b
+	extRecordSizeLimit      = 0x001c
+	extDelegatedCredentials = 0x0022
+	extSessionTicket        = 0x0023
+	extSupportedVersions    = 0x002b
+	extPSKKeyExchangeModes  = 0x002d
+	extKeyShare             = 0x0033
+	extApplicationSettings  = 0x4469
+	extRenegotiationInfo    = 0xff01
+)
+
+// clientHelloFields are the values Cloak hides in the random, session ID
+// and X25519 key share of a ClientHello
+type clientHelloFields struct {
+	random     []byte
+	sessionID  []byte
+	keyShare   []byte
+	serverName string
+}
+
+// composeClientHello returns a ClientHello handshake message shaped like the
+// one of browser, carrying fields
+func composeClientHello(browser string, fields clientHelloFields) []byte {
+	var cipherSuites []uint16
+	var extensions [][]byte
+	if browser == BrowserFirefox {
+		cipherSuites, extensions = firefoxHello(fields)
+	} else {
+		cipherSuites, extensions = chromeHello(fields)
+	}
+	body := []byte{0x03, 0x03}
+	body = append(body, fields.random...)
+	body = append(body, byte(len(fields.sessionID)))
+	body = append(body, fields.sessionID...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(cipherSuites)*2))
+	for _, suite := range cipherSuites {
+		body = binary.BigEndian.AppendUint16(body, suite)
+	}
+	body = append(body, 0x01, 0x00) // Null compression
+	var extensionBytes []byte
+	for _, extension := range extensions {
+		extensionBytes = append(extensionBytes, extension...)
+	}
+	if browser != BrowserFirefox {
+		// BoringSSL pads hellos between 256 and 511 bytes to 512, as some
+		// middleboxes hang on that range
+		length := 4 + len(body) + 2 + len(extensionBytes)
+		if length > 0xff && length < 0x200 {
+			padding := 0x200 - length
+			if padding >= 4+1 {
+				padding -= 4
+			} else {
+				padding = 1
+			}
+			extensionBytes = append(extensionBytes, tlsExtension(extPadding, make([]byte, padding))...)
+		}
+	}
+	body = binary.BigEndian.AppendUint16(body, uint16(len(extensionBytes)))
+	body = append(body, extensionBytes...)
+	message := []byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(message, body...)
+}
+
+// chromeHello follows Chrome before post-quantum key shares: GREASE values,
+// extension order permuted on every connection
+func chromeHello(fields clientHelloFields) ([]uint16, [][]byte) {
+	grease := greaseValues()
+	cipherSuites := []uint16{grease[0], 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	keyShares := []byte{byte(grease[1] >> 8), byte(grease[1]), 0x00, 0x01, 0x00, 0x00, 0x1d, 0x00, 0x20}
+	keyShares = append(keyShares, fields.keyShare...)
+	extensions := [][]byte{
+		tlsExtension(extServerName, serverNameData(fields.serverName)),
+		tlsExtension(extExtendedMasterSecret, nil),
+		tlsExtension(extRenegotiationInfo, []byte{0x00}),
+		tlsExtension(extSupportedGroups, u16List(grease[1], 0x001d, 0x0017, 0x0018)),
+		tlsExtension(extECPointFormats, []byte{0x01, 0x00}),
+		tlsExtension(extSessionTicket, nil),
+		tlsExtension(extALPN, alpnData("h2", "http/1.1")),
+		tlsExtension(extStatusRequest, []byte{0x01, 0x00, 0x00, 0x00, 0x00}),
+		tlsExtension(extSignatureAlgorithms, u16List(0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601)),
+		tlsExtension(extSCT, nil),
+		tlsExtension(extKeyShare, prefix16(keyShares)),
+		tlsExtension(extPSKKeyExchangeModes, []byte{0x01, 0x01}),
+		tlsExtension(extSupportedVersions, u8List(grease[2], 0x0304, 0x0303)),
+		tlsExtension(extCompressCertificate, []byte{0x02, 0x00, 0x02}),
+		tlsExtension(extApplicationSettings, prefix16(prefix8([]byte("h2")))),
+	}
+	mrand.Shuffle(len(extensions), func(i, j int) {
+		extensions[i], extensions[j] = extensions[j], extensions[i]
+	})
+	extensions = append([][]byte{tlsExtension(grease[3], nil)}, extensions...)
+	extensions = append(extensions, tlsExtension(grease[4], []byte{0x00}))
+	return cipherSuites, extensions
+}
+
+// firefoxHello follows Firefox: X25519 and P-256 key shares, delegated
+// credentials and a record size limit
+func firefoxHello(fields clientHelloFields) ([]uint16, [][]byte) {
+	cipherSuites := []uint16{0x1301, 0x1303, 0x1302, 0xc02b, 0xc02f, 0xcca9, 0xcca8, 0xc02c, 0xc030, 0xc00a, 0xc009, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	keyShares := []byte{0x00, 0x1d, 0x00, 0x20}
+	keyShares = append(keyShares, fields.keyShare...)
+	// The P-256 share is a valid point, though nothing is agreed with it
+	p256, _ := ecdh.P256().GenerateKey(rand.Reader)
+	point := p256.PublicKey().Bytes()
+	keyShares = append(keyShares, 0x00, 0x17, 0x00, byte(len(point)))
+	keyShares = append(keyShares, point...)
+	extensions := [][]byte{
+		tlsExtension(extServerName, serverNameData(fields.serverName)),
+		tlsExtension(extExtendedMasterSecret, nil),
+		tlsExtension(extRenegotiationInfo, []byte{0x00}),
+		tlsExtension(extSupportedGroups, u16List(0x001d, 0x0017, 0x0018, 0x0019, 0x0100, 0x0101)),
+		tlsExtension(extECPointFormats, []byte{0x01, 0x00}),
+		tlsExtension(extSessionTicket, nil),
+		tlsExtension(extALPN, alpnData("h2", "http/1.1")),
+		tlsExtension(extStatusRequest, []byte{0x01, 0x00, 0x00, 0x00, 0x00}),
+		tlsExtension(extDelegatedCredentials, u16List(0x0403, 0x0503, 0x0603, 0x0203)),
+		tlsExtension(extKeyShare, prefix16(keyShares)),
+		tlsExtension(extSupportedVersions, u8List(0x0304, 0x0303)),
+		tlsExtension(extSignatureAlgorithms, u16List(0x0403, 0x0503, 0x0603, 0x0804, 0x0805, 0x0806, 0x0401, 0x0501, 0x0601, 0x0203, 0x0201)),
+		tlsExtension(extPSKKeyExchangeModes, []byte{0x01, 0x01}),
+		tlsExtension(extRecordSizeLimit, []byte{0x40, 0x01}),
+	}
+	return cipherSuites, extensions
+}
+
+// greaseValues returns five distinct GREASE values (RFC 8701)
+func greaseValues() []uint16 {
+	values := make([]uint16, 0, 5)
+	for _, i := range mrand.Perm(16)[:5] {
+		values = append(values, uint16(i)<<12|0x0a00|uint16(i)<<4|0x0a)
+	}
+	return values
+}
+
+func tlsExtension(extensionType uint16, data []byte) []byte {
+	extension := binary.BigEndian.AppendUint16(nil, extensionType)
+	return append(extension, prefix16(data)...)
+}
+
+func prefix16(data []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...)
+}
+
+func prefix8(data []byte) []byte {
+	return append([]byte{byte(len(data))}, data...)
+}
+
+// u16List returns values with a 2-byte length prefix
+func u16List(values ...uint16) []byte {
+	var list []byte
+	for _, value := range values {
+		list = binary.BigEndian.AppendUint16(list, value)
+	}
+	return prefix16(list)
+}
+
+// u8List returns values with a 1-byte length prefix
+func u8List(values ...uint16) []byte {
+	var list []byte
+	for _, value := range values {
+		list = binary.BigEndian.AppendUint16(list, value)
+	}
+	return prefix8(list)
+}
+
+func serverNameData(serverName string) []byte {
+	entry := append([]byte{0x00}, prefix16([]byte(serverName))...)
+	return prefix16(entry)
+}
+
+func alpnData(protocols ...string) []byte {
+	var list []byte
+	for _, protocol := range protocols {
+		list = append(list, prefix8([]byte(protocol))...)
+	}
+	return prefix16(list)
+}
@@ -0,0 +1,193 @@
+package obfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/protocol/socks"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/pool"
+)
+
+var _ adapter.Outbound = (*Outbound)(nil)
+
+// Outbound reaches destinations through an obfs4 bridge. Each connection
+// performs its own obfs4 handshake, ahead of time when pooled, and asks the
+// SOCKS5 proxy behind the bridge for the destination.
+type Outbound struct {
+	tag     string
+	opts    Obfs4Options
+	logger  log.ContextLogger
+	bridge  *bridge
+	limiter *limiter.Limiter
+	guard   *dnsguard.Guard
+	dialer  *netdial.Outbound
+	pool    *pool.Pool
+}
+
+// NewOutbound creates a new obfs4 outbound
+func NewOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts Obfs4Options) (adapter.Outbound, error) {
+	if opts.Server == "" || opts.Port == 0 {
+		return nil, fmt.Errorf("obfs4 requires server and port")
+	}
+	switch opts.IATMode {
+	case IATNone, IATEnabled, IATParanoid:
+	default:
+		return nil, fmt.Errorf("invalid obfs4 iat_mode: %d", opts.IATMode)
+	}
+	b, err := parseBridge(opts.Cert, opts.NodeID, opts.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("obfs4: %w", err)
+	}
+	dialer, err := netdial.New(ctx, tag, opts.DialerOptions, opts.Marks)
+	if err != nil {
+		return nil, fmt.Errorf("obfs4: %w", err)
+	}
+	guard, err := dnsguard.New(ctx, opts.DNSGuard)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbound{
+		tag:     tag,
+		opts:    opts,
+		logger:  logger,
+		bridge:  b,
+		limiter: limiter.New(opts.Options),
+		guard:   guard,
+		dialer:  dialer,
+	}
+	o.pool = pool.New(opts.PoolOptions, func(ctx context.Context) (net.Conn, error) {
+		conn, err := o.connect(ctx, nil)
+		if err != nil {
+			o.logger.Debug("obfs4[", o.tag, "]: failed to pool a connection: ", err)
+			return nil, err
+		}
+		return conn, nil
+	})
+	return o, nil
+}
+
+func (o *Outbound) Type() string {
+	return "obfs4"
+}
+
+func (o *Outbound) Tag() string {
+	return o.tag
+}
+
+func (o *Outbound) Dependencies() []string {
+	return o.opts.DialerOptions.Dependencies()
+}
+
+// The SOCKS5 proxy is only reached through the obfs4 stream, so UDP
+// associations are not available
+func (o *Outbound) Network() []string {
+	return []string{"tcp"}
+}
+
+func (o *Outbound) Start() error {
+	o.pool.Start()
+	return nil
+}
+
+func (o *Outbound) Close() error {
+	o.pool.Close()
+	return nil
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	conn, err := o.dial(ctx, destination)
+	if err != nil {
+		release()
+		o.logger.Debug("obfs4[", o.tag, "]: bridge ", o.opts.Server, ":", o.opts.Port, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+// dial opens an obfs4 connection to the bridge, or takes a pooled one, and
+// asks its proxy for destination
+func (o *Outbound) dial(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	// A pooled connection may have been dropped by the bridge since; a new
+	// one is tried when it fails
+	if pooled, _ := o.pool.Get().(*Obfs4Conn); pooled != nil {
+		err := o.request(ctx, pooled, destination)
+		if err == nil {
+			return pooled, nil
+		}
+		o.logger.Debug("obfs4[", o.tag, "]: pooled connection failed, dialing a new one: ", err)
+		pooled.Close()
+	}
+	conn, err := o.connect(ctx, adapter.ContextFrom(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if err := o.request(ctx, conn, destination); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect dials the bridge and performs the obfs4 handshake. QoS rules match
+// the connection in inboundContext; pooled connections have none.
+func (o *Outbound) connect(ctx context.Context, inboundContext *adapter.InboundContext) (*Obfs4Conn, error) {
+	// 1. Dial the bridge; resolved addresses are checked against poisoning
+	// ranges when configured
+	conn, err := o.guard.DialContext(ctx, o.dialer.For(inboundContext), "tcp", o.opts.Server, o.opts.Port)
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to dial bridge: %w", err))
+	}
+	conn.SetDeadline(deadlineOf(ctx))
+
+	// 2. obfs4 handshake, authenticating the bridge by its identity key
+	obfsConn, err := newObfs4Conn(conn, o.bridge, o.opts.IATMode)
+	if err != nil {
+		conn.Close()
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("obfs4 handshake failed: %w", err))
+	}
+	conn.SetDeadline(time.Time{})
+	return obfsConn, nil
+}
+
+// request sends the SOCKS5 request for destination to the proxy behind the
+// bridge
+func (o *Outbound) request(ctx context.Context, conn *Obfs4Conn, destination metadata.Socksaddr) error {
+	conn.SetDeadline(deadlineOf(ctx))
+	if _, err := socks.ClientHandshake5(conn, socks5.CommandConnect, destination, o.opts.Username, o.opts.Password); err != nil {
+		return failure.Wrap(failure.StageTarget, fmt.Errorf("SOCKS5 request failed: %w", err))
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// deadlineOf returns the deadline of a handshake step run under ctx
+func deadlineOf(ctx context.Context) time.Time {
+	deadline := time.Now().Add(C.TCPTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	return deadline
+}
+
+func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	return nil, fmt.Errorf("obfs4 outbound does not support UDP")
+}
@@ -0,0 +1,335 @@
+package obfs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/protocol/socks"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+
+	"github.com/UTPBox/utp-core/internal/clock"
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+)
+
+// Cloak handshake parameters
+const (
+	cloakUIDLength         = 16
+	cloakProxyMethodLength = 12
+	cloakDefaultNumConn    = 4
+	// The ServerHello hides the session key in its random (from offset 6)
+	// and key share (from offset 84)
+	cloakServerHelloLength = 116
+)
+
+var _ adapter.Outbound = (*CloakOutbound)(nil)
+
+// CloakOutbound reaches destinations through a Cloak server. A session is a
+// few TCP connections, each opened with a ClientHello carrying the
+// credentials encrypted to the server key; connections are streams
+// multiplexed over the session, and each asks the SOCKS5 proxy behind the
+// server for its destination. Servers answer unauthenticated clients as the
+// site named by server_name would.
+type CloakOutbound struct {
+	tag       string
+	opts      CloakOptions
+	logger    log.ContextLogger
+	uid       []byte
+	publicKey *ecdh.PublicKey
+	method    byte
+	limiter   *limiter.Limiter
+	guard     *dnsguard.Guard
+	dialer    *netdial.Outbound
+
+	access  sync.Mutex
+	session *cloakSession
+}
+
+// NewCloakOutbound creates a new cloak outbound
+func NewCloakOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts CloakOptions) (adapter.Outbound, error) {
+	if opts.Server == "" || opts.Port == 0 {
+		return nil, fmt.Errorf("cloak requires server and port")
+	}
+	if opts.ServerName == "" {
+		return nil, fmt.Errorf("cloak requires server_name")
+	}
+	uid, err := base64.StdEncoding.DecodeString(opts.UID)
+	if err != nil || len(uid) != cloakUIDLength {
+		return nil, fmt.Errorf("cloak: uid must be %d bytes in base64", cloakUIDLength)
+	}
+	key, err := base64.StdEncoding.DecodeString(opts.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("cloak: invalid public_key: %w", err)
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("cloak: invalid public_key: %w", err)
+	}
+	if opts.ProxyMethod == "" || len(opts.ProxyMethod) > cloakProxyMethodLength {
+		return nil, fmt.Errorf("cloak: proxy_method must be 1 to %d characters", cloakProxyMethodLength)
+	}
+	if opts.EncryptionMethod == "" {
+		opts.EncryptionMethod = CloakAES256GCM
+	}
+	method, ok := cloakMethods[opts.EncryptionMethod]
+	if !ok {
+		return nil, fmt.Errorf("cloak: unknown encryption_method %q", opts.EncryptionMethod)
+	}
+	switch opts.BrowserSig {
+	case "":
+		opts.BrowserSig = BrowserChrome
+	case BrowserChrome, BrowserFirefox:
+	default:
+		return nil, fmt.Errorf("cloak: unknown browser_sig %q: expected chrome or firefox", opts.BrowserSig)
+	}
+	if opts.NumConn < 0 {
+		return nil, fmt.Errorf("cloak: invalid num_conn %d", opts.NumConn)
+	}
+	if opts.NumConn == 0 {
+		opts.NumConn = cloakDefaultNumConn
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("cloak: %w", err)
+	}
+	dialer, err := netdial.New(ctx, tag, opts.DialerOptions, opts.Marks)
+	if err != nil {
+		return nil, fmt.Errorf("cloak: %w", err)
+	}
+	guard, err := dnsguard.New(ctx, opts.DNSGuard)
+	if err != nil {
+		return nil, err
+	}
+	return &CloakOutbound{
+		tag:       tag,
+		opts:      opts,
+		logger:    logger,
+		uid:       uid,
+		publicKey: publicKey,
+		method:    method,
+		limiter:   limiter.New(opts.Options),
+		guard:     guard,
+		dialer:    dialer,
+	}, nil
+}
+
+func (o *CloakOutbound) Type() string {
+	return "cloak"
+}
+
+func (o *CloakOutbound) Tag() string {
+	return o.tag
+}
+
+func (o *CloakOutbound) Dependencies() []string {
+	return o.opts.DialerOptions.Dependencies()
+}
+
+// The SOCKS5 proxy is only reached through Cloak streams, so UDP
+// associations are not available
+func (o *CloakOutbound) Network() []string {
+	return []string{"tcp"}
+}
+
+func (o *CloakOutbound) Start() error {
+	return nil
+}
+
+func (o *CloakOutbound) Close() error {
+	o.access.Lock()
+	defer o.access.Unlock()
+	if o.session != nil {
+		o.session.close(net.ErrClosed)
+		o.session = nil
+	}
+	return nil
+}
+
+func (o *CloakOutbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	conn, err := o.dial(ctx, destination)
+	if err != nil {
+		release()
+		o.logger.Debug("cloak[", o.tag, "]: server ", o.opts.Server, ":", o.opts.Port, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+// dial opens a stream and asks the proxy behind the server for destination.
+// A stream opened on a session that just closed is retried on a new one.
+func (o *CloakOutbound) dial(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	deadline := time.Now().Add(C.TCPTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	for attempt := 0; ; attempt++ {
+		session, err := o.currentSession(ctx, deadline)
+		if err != nil {
+			return nil, err
+		}
+		stream := session.open()
+		if stream == nil {
+			if attempt > 0 {
+				return nil, failure.Wrap(failure.StageConnect, session.err)
+			}
+			continue
+		}
+		stream.SetDeadline(deadline)
+		if _, err := socks.ClientHandshake5(stream, socks5.CommandConnect, destination, o.opts.Username, o.opts.Password); err != nil {
+			stream.Close()
+			if session.closed() {
+				return nil, failure.Wrap(failure.StageConnect, session.err)
+			}
+			return nil, failure.Wrap(failure.StageTarget, fmt.Errorf("SOCKS5 request failed: %w", err))
+		}
+		stream.SetDeadline(time.Time{})
+		return stream, nil
+	}
+}
+
+// currentSession returns the session with the server, establishing a new
+// one when it closed
+func (o *CloakOutbound) currentSession(ctx context.Context, deadline time.Time) (*cloakSession, error) {
+	o.access.Lock()
+	defer o.access.Unlock()
+	if o.session != nil && !o.session.closed() {
+		return o.session, nil
+	}
+	sessionID := make([]byte, 4)
+	crand.Read(sessionID)
+	conns := make([]net.Conn, o.opts.NumConn)
+	keys := make([][32]byte, o.opts.NumConn)
+	errs := make([]error, o.opts.NumConn)
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns[i], keys[i], errs[i] = o.connect(ctx, binary.BigEndian.Uint32(sessionID), deadline)
+		}()
+	}
+	wg.Wait()
+	var err error
+	for i := range conns {
+		if errs[i] == nil && keys[i] != keys[0] {
+			errs[i] = failure.Wrap(failure.StageHandshake, fmt.Errorf("connections of the session got different keys"))
+		}
+		if err == nil {
+			err = errs[i]
+		}
+	}
+	if err != nil {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		return nil, err
+	}
+	obfuscator, err := newCloakObfuscator(o.method, keys[0])
+	if err != nil {
+		return nil, err
+	}
+	o.session = newCloakSession(obfuscator, conns)
+	return o.session, nil
+}
+
+// connect opens one connection of a session and returns the session key
+func (o *CloakOutbound) connect(ctx context.Context, sessionID uint32, deadline time.Time) (net.Conn, [32]byte, error) {
+	var sessionKey [32]byte
+	// Streams of many connections share the sockets, so only QoS rules
+	// matching the outbound apply
+	conn, err := o.guard.DialContext(ctx, o.dialer.For(nil), "tcp", o.opts.Server, o.opts.Port)
+	if err != nil {
+		return nil, sessionKey, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to dial server: %w", err))
+	}
+	conn.SetDeadline(deadline)
+	sessionKey, err = o.handshake(conn, sessionID)
+	if err != nil {
+		conn.Close()
+		return nil, sessionKey, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, sessionKey, nil
+}
+
+// handshake sends the credentials (UID, proxy method, encryption method,
+// time and session ID), sealed with a key agreed between an ephemeral key
+// and the server key, in the random, session ID and key share of the
+// ClientHello. The server returns the session key sealed the same way in
+// its ServerHello, followed by a ChangeCipherSpec and a fake certificate
+// record.
+func (o *CloakOutbound) handshake(conn net.Conn, sessionID uint32) ([32]byte, error) {
+	var sessionKey [32]byte
+	ephemeral, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return sessionKey, err
+	}
+	secret, err := ephemeral.ECDH(o.publicKey)
+	if err != nil {
+		return sessionKey, failure.Wrap(failure.StageHandshake, err)
+	}
+	block, _ := aes.NewCipher(secret)
+	aead, _ := cipher.NewGCM(block)
+	random := ephemeral.PublicKey().Bytes()
+	credentials := make([]byte, 48)
+	copy(credentials, o.uid)
+	copy(credentials[16:28], o.opts.ProxyMethod)
+	credentials[28] = o.method
+	binary.BigEndian.PutUint64(credentials[29:], uint64(clock.Now().Unix()))
+	binary.BigEndian.PutUint32(credentials[37:], sessionID)
+	sealed := aead.Seal(nil, random[:12], credentials, nil)
+
+	hello := composeClientHello(o.opts.BrowserSig, clientHelloFields{
+		random:     random,
+		sessionID:  sealed[:32],
+		keyShare:   sealed[32:],
+		serverName: o.opts.ServerName,
+	})
+	record := []byte{cloakRecordHandshake, 0x03, 0x01, byte(len(hello) >> 8), byte(len(hello))}
+	if _, err := conn.Write(append(record, hello...)); err != nil {
+		return sessionKey, failure.Wrap(failure.StageHandshake, err)
+	}
+	recordType, serverHello, err := readRecord(conn)
+	if err != nil {
+		return sessionKey, failure.Wrap(failure.StageHandshake, fmt.Errorf("failed to read ServerHello: %w", err))
+	}
+	if recordType != cloakRecordHandshake || len(serverHello) < cloakServerHelloLength {
+		return sessionKey, failure.Wrap(failure.StageHandshake, fmt.Errorf("unexpected ServerHello"))
+	}
+	encrypted := append(serverHello[6:38:38], serverHello[84:116]...)
+	key, err := aead.Open(nil, encrypted[:12], encrypted[12:60], nil)
+	if err != nil {
+		// The server answered as the mimicked site: it did not recognize us
+		return sessionKey, failure.Wrap(failure.StageAuth, fmt.Errorf("server rejected the credentials (check uid, public_key, proxy_method and the clock)"))
+	}
+	for range 2 {
+		if _, _, err := readRecord(conn); err != nil {
+			return sessionKey, failure.Wrap(failure.StageHandshake, err)
+		}
+	}
+	copy(sessionKey[:], key)
+	return sessionKey, nil
+}
+
+func (o *CloakOutbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	return nil, fmt.Errorf("cloak outbound does not support UDP")
+}
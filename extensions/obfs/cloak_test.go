@@ -0,0 +1,454 @@
+package obfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing/common/metadata"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/salsa20"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/testkit"
+)
+
+// The server of these tests follows the Cloak server (github.com/cbeuw/Cloak)
+// with the standard primitives: the credentials in the ClientHello, the
+// session key in the ServerHello and the multiplexing frames are written
+// here, not with the code of the outbound.
+const (
+	recordHandshake        = 0x16
+	recordChangeCipherSpec = 0x14
+	recordApplicationData  = 0x17
+	frameHeaderLength      = 14
+	frameClosingStream     = 0x01
+	serverFramePayload     = 4096
+)
+
+// sessionCipher seals and opens the frames of a Cloak session: a header of
+// stream ID, sequence number, closing flag and overhead length, XORed with
+// Salsa20 keyed by the session key and nonced by the last 8 bytes of the
+// frame; then the payload, sealed with the first 12 header bytes as nonce
+// unless the method is plain.
+type sessionCipher struct {
+	key  [32]byte
+	aead cipher.AEAD // nil for plain
+}
+
+func newSessionCipher(method byte, key [32]byte) (*sessionCipher, error) {
+	c := &sessionCipher{key: key}
+	var err error
+	switch method {
+	case 0x00: // plain
+	case 0x01: // aes-256-gcm
+		block, _ := aes.NewCipher(key[:])
+		c.aead, err = cipher.NewGCM(block)
+	case 0x02: // chacha20-poly1305
+		c.aead, err = chacha20poly1305.New(key[:])
+	case 0x03: // aes-128-gcm
+		block, _ := aes.NewCipher(key[:16])
+		c.aead, err = cipher.NewGCM(block)
+	default:
+		err = fmt.Errorf("unknown encryption method %d", method)
+	}
+	return c, err
+}
+
+// record returns a frame in a TLS application data record. Plain frames are
+// padded to the 8 bytes of the header nonce.
+func (c *sessionCipher) record(streamID uint32, seq uint64, closing byte, payload []byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, streamID)
+	header = binary.BigEndian.AppendUint64(header, seq)
+	var body []byte
+	if c.aead != nil {
+		header = append(header, closing, byte(c.aead.Overhead()))
+		body = c.aead.Seal(nil, header[:12], payload, nil)
+	} else {
+		extra := max(0, 8-len(payload))
+		header = append(header, closing, byte(extra))
+		body = append(bytes.Clone(payload), make([]byte, extra)...)
+		rand.Read(body[len(payload):])
+	}
+	salsa20.XORKeyStream(header, header, body[len(body)-8:], &c.key)
+	frame := append(header, body...)
+	return append([]byte{recordApplicationData, 0x03, 0x03, byte(len(frame) >> 8), byte(len(frame))}, frame...)
+}
+
+// open returns the stream ID, closing flag and payload of a frame
+func (c *sessionCipher) open(frame []byte) (uint32, byte, []byte, error) {
+	if len(frame) < frameHeaderLength+8 {
+		return 0, 0, nil, errors.New("short frame")
+	}
+	header, body := bytes.Clone(frame[:frameHeaderLength]), frame[frameHeaderLength:]
+	salsa20.XORKeyStream(header, header, body[len(body)-8:], &c.key)
+	if int(header[13]) > len(body) {
+		return 0, 0, nil, errors.New("invalid overhead length")
+	}
+	payload := body[:len(body)-int(header[13])]
+	if c.aead != nil {
+		var err error
+		if payload, err = c.aead.Open(nil, header[:12], body, nil); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return binary.BigEndian.Uint32(header), header[12], payload, nil
+}
+
+func readTLSRecord(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	_, err := io.ReadFull(r, body)
+	return header[0], body, err
+}
+
+// cloakServer accepts the sessions of one user, handing their streams to a
+// SOCKS5 proxy echoing them back
+type cloakServer struct {
+	private *ecdh.PrivateKey
+	uid     []byte
+	streams chan *testkit.Transcript // SOCKS5 exchanges of the streams
+
+	access   sync.Mutex
+	sessions map[uint32]*serverSession
+}
+
+type serverSession struct {
+	cipher    *sessionCipher
+	writeLock sync.Mutex
+	access    sync.Mutex
+	streams   map[uint32]net.Conn
+}
+
+func newCloakServer(t *testing.T) *cloakServer {
+	t.Helper()
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &cloakServer{
+		private:  private,
+		uid:      make([]byte, 16),
+		streams:  make(chan *testkit.Transcript, 4),
+		sessions: make(map[uint32]*serverSession),
+	}
+	rand.Read(s.uid)
+	return s
+}
+
+func (s *cloakServer) serve(conn net.Conn) {
+	recordType, hello, err := readTLSRecord(conn)
+	if err != nil || recordType != recordHandshake {
+		return
+	}
+	random, sessionID, keyShare, ok := hiddenFields(hello)
+	if !ok {
+		return
+	}
+	credentials, aead, ok := s.authenticate(random, append(sessionID, keyShare...))
+	var nonce, sealedKey []byte
+	var session *serverSession
+	if ok {
+		if session, err = s.session(binary.BigEndian.Uint32(credentials[37:]), credentials[28]); err != nil {
+			return
+		}
+		nonce = make([]byte, 12)
+		rand.Read(nonce)
+		sealedKey = aead.Seal(nil, nonce, session.cipher.key[:], nil)
+	} else {
+		// Answered as the mimicked site would, with nothing hidden
+		nonce, sealedKey = make([]byte, 12), make([]byte, 48)
+		rand.Read(nonce)
+		rand.Read(sealedKey)
+	}
+	if _, err := conn.Write(serverFlight(sessionID, nonce, sealedKey)); err != nil || session == nil {
+		return
+	}
+	for {
+		recordType, frame, err := readTLSRecord(conn)
+		if err != nil {
+			return
+		}
+		if recordType != recordApplicationData {
+			continue
+		}
+		streamID, closing, payload, err := session.cipher.open(frame)
+		if err != nil {
+			return
+		}
+		session.receive(conn, streamID, closing, payload, s.streams)
+	}
+}
+
+// authenticate opens the credentials sealed into the session ID and key
+// share with the X25519 secret of the random, and checks the UID and proxy
+// method: UID 16 | proxy method 12 | encryption method 1 | time 8 |
+// session ID 4 | padding
+func (s *cloakServer) authenticate(random []byte, sealed []byte) ([]byte, cipher.AEAD, bool) {
+	clientKey, err := ecdh.X25519().NewPublicKey(random)
+	if err != nil {
+		return nil, nil, false
+	}
+	secret, err := s.private.ECDH(clientKey)
+	if err != nil {
+		return nil, nil, false
+	}
+	block, _ := aes.NewCipher(secret)
+	aead, _ := cipher.NewGCM(block)
+	credentials, err := aead.Open(nil, random[:12], sealed, nil)
+	if err != nil || len(credentials) != 48 || !bytes.Equal(credentials[:16], s.uid) || string(bytes.TrimRight(credentials[16:28], "\x00")) != "socks" {
+		return nil, nil, false
+	}
+	sent := time.Unix(int64(binary.BigEndian.Uint64(credentials[29:])), 0)
+	if time.Since(sent).Abs() > time.Hour {
+		return nil, nil, false
+	}
+	return credentials, aead, true
+}
+
+// session returns the session of id, which the other connections of a
+// client join
+func (s *cloakServer) session(id uint32, method byte) (*serverSession, error) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if session := s.sessions[id]; session != nil {
+		return session, nil
+	}
+	var key [32]byte
+	rand.Read(key[:])
+	c, err := newSessionCipher(method, key)
+	if err != nil {
+		return nil, err
+	}
+	session := &serverSession{cipher: c, streams: make(map[uint32]net.Conn)}
+	s.sessions[id] = session
+	return session, nil
+}
+
+// receive passes a frame to its stream, starting the stream on its first
+// frame. Replies go out on conn.
+func (s *serverSession) receive(conn net.Conn, streamID uint32, closing byte, payload []byte, transcripts chan<- *testkit.Transcript) {
+	s.access.Lock()
+	stream := s.streams[streamID]
+	if stream == nil && closing == 0 {
+		var proxy net.Conn
+		stream, proxy = testkit.Pipe(conn.LocalAddr(), conn.RemoteAddr())
+		s.streams[streamID] = stream
+		go func() {
+			defer proxy.Close()
+			transcript := testkit.Record(proxy)
+			if _, err := testkit.AcceptSOCKS5(transcript); err != nil {
+				return
+			}
+			transcripts <- transcript
+			testkit.Echo(proxy)
+		}()
+		go s.send(conn, streamID, stream)
+	}
+	s.access.Unlock()
+	switch {
+	case stream == nil:
+	case closing == frameClosingStream:
+		stream.Close()
+	default:
+		stream.Write(payload)
+	}
+}
+
+// send relays what the proxy writes to stream as frames on conn
+func (s *serverSession) send(conn net.Conn, streamID uint32, stream net.Conn) {
+	buffer := make([]byte, serverFramePayload)
+	for seq := uint64(0); ; seq++ {
+		n, err := stream.Read(buffer)
+		var record []byte
+		if err != nil {
+			record = s.cipher.record(streamID, seq, frameClosingStream, []byte{0})
+		} else {
+			record = s.cipher.record(streamID, seq, 0, buffer[:n])
+		}
+		s.writeLock.Lock()
+		_, writeErr := conn.Write(record)
+		s.writeLock.Unlock()
+		if err != nil || writeErr != nil {
+			return
+		}
+	}
+}
+
+// hiddenFields returns the fields Cloak hides credentials in: the
+// random, the session ID and the X25519 key share
+func hiddenFields(hello []byte) (random []byte, sessionID []byte, keyShare []byte, ok bool) {
+	message := cryptobyte.String(hello)
+	var body, ignored, extensions cryptobyte.String
+	if !message.Skip(1) || !message.ReadUint24LengthPrefixed(&body) || !body.Skip(2) ||
+		!body.ReadBytes(&random, 32) || !body.ReadUint8LengthPrefixed((*cryptobyte.String)(&sessionID)) ||
+		!body.ReadUint16LengthPrefixed(&ignored) || !body.ReadUint8LengthPrefixed(&ignored) ||
+		!body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, nil, nil, false
+	}
+	for !extensions.Empty() {
+		var extensionType uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extensionType) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, nil, nil, false
+		}
+		if extensionType != 0x0033 { // key_share
+			continue
+		}
+		var shares cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&shares) {
+			return nil, nil, nil, false
+		}
+		for !shares.Empty() {
+			var group uint16
+			var key cryptobyte.String
+			if !shares.ReadUint16(&group) || !shares.ReadUint16LengthPrefixed(&key) {
+				return nil, nil, nil, false
+			}
+			if group == 0x001d { // x25519
+				keyShare = key
+			}
+		}
+	}
+	return random, sessionID, keyShare, len(sessionID) == 32 && len(keyShare) == 32
+}
+
+// serverFlight returns the records a Cloak server answers with: a TLS 1.3
+// ServerHello whose random is the nonce and the first 20 bytes of the
+// sealed session key, and whose X25519 key share holds the other 28, then
+// a ChangeCipherSpec and a certificate of random bytes
+func serverFlight(sessionID []byte, nonce []byte, sealedKey []byte) []byte {
+	keyShare := make([]byte, 32)
+	rand.Read(keyShare)
+	copy(keyShare, sealedKey[20:])
+	var builder cryptobyte.Builder
+	builder.AddUint8(0x02) // server_hello
+	builder.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0303)
+		b.AddBytes(nonce)
+		b.AddBytes(sealedKey[:20])
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sessionID) })
+		b.AddUint16(0x1302) // TLS_AES_256_GCM_SHA384
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(0x0033)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x001d)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(keyShare) })
+			})
+			b.AddUint16(0x002b) // supported_versions: TLS 1.3
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(0x0304) })
+		})
+	})
+	certificate := make([]byte, 1024)
+	rand.Read(certificate)
+	var flight []byte
+	for _, record := range []struct {
+		recordType byte
+		body       []byte
+	}{{recordHandshake, builder.BytesOrPanic()}, {recordChangeCipherSpec, []byte{0x01}}, {recordApplicationData, certificate}} {
+		flight = append(flight, record.recordType, 0x03, 0x03, byte(len(record.body)>>8), byte(len(record.body)))
+		flight = append(flight, record.body...)
+	}
+	return flight
+}
+
+func cloakOutbound(t *testing.T, server *cloakServer, publicKey *ecdh.PublicKey, opts CloakOptions) adapter.Outbound {
+	t.Helper()
+	network := &testkit.Network{}
+	listener, err := network.Serve("cloak.example:443", server.serve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	opts.Server, opts.Port = "cloak.example", 443
+	opts.UID = base64.StdEncoding.EncodeToString(server.uid)
+	opts.PublicKey = base64.StdEncoding.EncodeToString(publicKey.Bytes())
+	opts.ProxyMethod = "socks"
+	opts.ServerName = "www.example.com"
+	outbound, _, err := testkit.NewOutbound(testkit.Context(context.Background(), network, nil), nil, NewCloakOutbound, "cloak-out", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbound.(*CloakOutbound).Close() })
+	return outbound
+}
+
+func TestCloak(t *testing.T) {
+	for _, opts := range []CloakOptions{
+		{EncryptionMethod: CloakPlain, BrowserSig: BrowserChrome},
+		{EncryptionMethod: CloakAES256GCM, BrowserSig: BrowserFirefox},
+		{EncryptionMethod: CloakAES128GCM, BrowserSig: BrowserChrome, NumConn: 1},
+		{EncryptionMethod: CloakChaCha20Poly1305, BrowserSig: BrowserFirefox},
+	} {
+		t.Run(opts.EncryptionMethod, func(t *testing.T) {
+			server := newCloakServer(t)
+			outbound := cloakOutbound(t, server, server.private.PublicKey(), opts)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			// Streams of the session, on every connection of it
+			for range 3 {
+				conn, err := outbound.DialContext(ctx, "tcp", metadata.ParseSocksaddrHostPort("example.com", 443))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := (<-server.streams).Golden(filepath.Join("testdata", "socks5.golden")); err != nil {
+					t.Fatal(err)
+				}
+				message := make([]byte, 2*serverFramePayload+100)
+				rand.Read(message)
+				if _, err := conn.Write(message); err != nil {
+					t.Fatal(err)
+				}
+				echo := make([]byte, len(message))
+				if _, err := io.ReadFull(conn, echo); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(echo, message) {
+					t.Fatal("echo differs from the message")
+				}
+				conn.Close()
+			}
+			server.access.Lock()
+			sessions := len(server.sessions)
+			server.access.Unlock()
+			if sessions != 1 {
+				t.Fatalf("%d sessions, want the streams to share one", sessions)
+			}
+		})
+	}
+}
+
+func TestCloakUnknownKey(t *testing.T) {
+	server := newCloakServer(t)
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound := cloakOutbound(t, server, other.PublicKey(), CloakOptions{NumConn: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = outbound.DialContext(ctx, "tcp", metadata.ParseSocksaddrHostPort("example.com", 443))
+	var typed *failure.Error
+	if !errors.As(err, &typed) || typed.Stage != failure.StageAuth {
+		t.Fatalf("dial error = %v, want an auth failure", err)
+	}
+}
@@ -0,0 +1,446 @@
+package obfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/salsa20"
+)
+
+// Cloak encryption methods of the frame payloads
+const (
+	CloakPlain            = "plain"
+	CloakAES256GCM        = "aes-256-gcm"
+	CloakAES128GCM        = "aes-128-gcm"
+	CloakChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+// cloakMethods are the wire codes of the encryption methods; aes-gcm is the
+// Cloak alias of aes-256-gcm
+var cloakMethods = map[string]byte{
+	CloakPlain:            0x00,
+	CloakAES256GCM:        0x01,
+	"aes-gcm":             0x01,
+	CloakChaCha20Poly1305: 0x02,
+	CloakAES128GCM:        0x03,
+}
+
+// Cloak frames: a 14 byte header (stream ID, sequence number, closing flag,
+// length of the trailing overhead) encrypted with Salsa20 under the session
+// key, using the last 8 bytes of the frame as nonce, then the payload,
+// sealed with the header as AEAD nonce unless the method is plain. Each
+// frame is sent as a TLS application data record.
+const (
+	cloakHeaderLength    = 14
+	cloakNonceLength     = 8
+	cloakMaxPayload      = 16*1024 - 256
+	cloakIdleTimeout     = time.Minute
+	cloakRecordApp       = 0x17
+	cloakRecordHandshake = 0x16
+)
+
+// Closing flags of frames. Closing frames carry random padding.
+const (
+	closingNothing = 0x00
+	closingStream  = 0x01
+	closingSession = 0x02
+)
+
+var errCloakSessionClosed = errors.New("cloak: session closed by server")
+
+type cloakFrame struct {
+	streamID uint32
+	seq      uint64
+	closing  byte
+	payload  []byte
+}
+
+type cloakObfuscator struct {
+	sessionKey [32]byte
+	aead       cipher.AEAD // nil for plain
+}
+
+func newCloakObfuscator(method byte, sessionKey [32]byte) (*cloakObfuscator, error) {
+	o := &cloakObfuscator{sessionKey: sessionKey}
+	var err error
+	switch method {
+	case 0x00:
+	case 0x01, 0x03:
+		key := sessionKey[:]
+		if method == 0x03 {
+			key = key[:16]
+		}
+		block, _ := aes.NewCipher(key)
+		o.aead, err = cipher.NewGCM(block)
+	case 0x02:
+		o.aead, err = chacha20poly1305.New(sessionKey[:])
+	default:
+		err = fmt.Errorf("unknown encryption method %d", method)
+	}
+	return o, err
+}
+
+// record returns f obfuscated in a TLS application data record
+func (o *cloakObfuscator) record(f cloakFrame) []byte {
+	extraLength := 0
+	if o.aead != nil {
+		extraLength = o.aead.Overhead()
+	} else if len(f.payload) < cloakNonceLength {
+		extraLength = cloakNonceLength - len(f.payload)
+	}
+	frameLength := cloakHeaderLength + len(f.payload) + extraLength
+	record := make([]byte, 5+frameLength)
+	record[0] = cloakRecordApp
+	record[1], record[2] = 0x03, 0x03
+	binary.BigEndian.PutUint16(record[3:], uint16(frameLength))
+	frame := record[5:]
+	header := frame[:cloakHeaderLength]
+	binary.BigEndian.PutUint32(header, f.streamID)
+	binary.BigEndian.PutUint64(header[4:], f.seq)
+	header[12] = f.closing
+	header[13] = byte(extraLength)
+	if o.aead != nil {
+		o.aead.Seal(frame[cloakHeaderLength:cloakHeaderLength], header[:12], f.payload, nil)
+	} else {
+		copy(frame[cloakHeaderLength:], f.payload)
+		crand.Read(frame[cloakHeaderLength+len(f.payload):])
+	}
+	salsa20.XORKeyStream(header, header, frame[frameLength-cloakNonceLength:], &o.sessionKey)
+	return record
+}
+
+func (o *cloakObfuscator) open(frame []byte) (cloakFrame, error) {
+	if len(frame) < cloakHeaderLength+cloakNonceLength {
+		return cloakFrame{}, fmt.Errorf("short frame")
+	}
+	header := frame[:cloakHeaderLength]
+	salsa20.XORKeyStream(header, header, frame[len(frame)-cloakNonceLength:], &o.sessionKey)
+	body := frame[cloakHeaderLength:]
+	payloadLength := len(body) - int(header[13])
+	if payloadLength < 0 {
+		return cloakFrame{}, fmt.Errorf("invalid frame overhead")
+	}
+	f := cloakFrame{
+		streamID: binary.BigEndian.Uint32(header),
+		seq:      binary.BigEndian.Uint64(header[4:]),
+		closing:  header[12],
+		payload:  body[:payloadLength],
+	}
+	if o.aead != nil {
+		if _, err := o.aead.Open(body[:0], header[:12], body, nil); err != nil {
+			return cloakFrame{}, err
+		}
+	}
+	return f, nil
+}
+
+// readRecord reads one TLS record
+func readRecord(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// cloakSession multiplexes streams over the connections of one Cloak
+// session. Each stream writes to one of the connections, picked by its ID;
+// the server spreads its frames over all of them, so they are put back in
+// order by sequence number.
+type cloakSession struct {
+	obfuscator *cloakObfuscator
+	conns      []net.Conn
+	writeLocks []sync.Mutex
+
+	access       sync.Mutex
+	streams      map[uint32]*cloakStream
+	nextStreamID uint32
+	idle         time.Time // Since when there are no streams
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func newCloakSession(obfuscator *cloakObfuscator, conns []net.Conn) *cloakSession {
+	s := &cloakSession{
+		obfuscator:   obfuscator,
+		conns:        conns,
+		writeLocks:   make([]sync.Mutex, len(conns)),
+		streams:      make(map[uint32]*cloakStream),
+		nextStreamID: 1,
+		idle:         time.Now(),
+		done:         make(chan struct{}),
+	}
+	for _, conn := range conns {
+		go s.readLoop(conn)
+	}
+	go s.idleLoop()
+	return s
+}
+
+func (s *cloakSession) readLoop(conn net.Conn) {
+	for {
+		recordType, body, err := readRecord(conn)
+		if err != nil {
+			s.close(err)
+			return
+		}
+		if recordType != cloakRecordApp {
+			continue
+		}
+		f, err := s.obfuscator.open(body)
+		if err != nil {
+			s.close(fmt.Errorf("cloak: invalid frame: %w", err))
+			return
+		}
+		if f.closing == closingSession {
+			s.close(errCloakSessionClosed)
+			return
+		}
+		s.access.Lock()
+		stream := s.streams[f.streamID]
+		s.access.Unlock()
+		if stream != nil {
+			stream.receive(f)
+		}
+	}
+}
+
+// idleLoop closes the session once it had no streams for cloakIdleTimeout
+func (s *cloakSession) idleLoop() {
+	ticker := time.NewTicker(cloakIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.access.Lock()
+		idle := len(s.streams) == 0 && time.Since(s.idle) > cloakIdleTimeout
+		s.access.Unlock()
+		if idle {
+			s.close(net.ErrClosed)
+			return
+		}
+	}
+}
+
+// open starts a stream, or returns nil when the session is closed. The
+// server learns of the stream from its first frame.
+func (s *cloakSession) open() *cloakStream {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.closed() {
+		return nil
+	}
+	stream := &cloakStream{
+		session: s,
+		id:      s.nextStreamID,
+		pending: make(map[uint64]cloakFrame),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s.nextStreamID++
+	s.streams[stream.id] = stream
+	return stream
+}
+
+func (s *cloakSession) remove(id uint32) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	delete(s.streams, id)
+	if len(s.streams) == 0 {
+		s.idle = time.Now()
+	}
+}
+
+func (s *cloakSession) write(f cloakFrame) error {
+	index := int(f.streamID % uint32(len(s.conns)))
+	record := s.obfuscator.record(f)
+	s.writeLocks[index].Lock()
+	defer s.writeLocks[index].Unlock()
+	if _, err := s.conns[index].Write(record); err != nil {
+		s.close(err)
+		return err
+	}
+	return nil
+}
+
+func (s *cloakSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *cloakSession) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		for _, conn := range s.conns {
+			conn.Close()
+		}
+	})
+}
+
+// cloakStream is one connection through the session
+type cloakStream struct {
+	session  *cloakSession
+	id       uint32
+	deadline atomic.Pointer[time.Time]
+
+	writeAccess sync.Mutex
+	writeSeq    uint64
+
+	access  sync.Mutex
+	nextSeq uint64
+	pending map[uint64]cloakFrame // Frames received ahead of nextSeq
+	queue   [][]byte
+	eof     bool
+	notify  chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// receive queues the frames of the stream in sequence order
+func (c *cloakStream) receive(f cloakFrame) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if f.seq < c.nextSeq || c.eof {
+		return
+	}
+	c.pending[f.seq] = f
+	for {
+		next, ok := c.pending[c.nextSeq]
+		if !ok {
+			break
+		}
+		delete(c.pending, c.nextSeq)
+		c.nextSeq++
+		if next.closing == closingStream {
+			c.eof = true
+			clear(c.pending)
+			break
+		}
+		if len(next.payload) > 0 {
+			c.queue = append(c.queue, next.payload)
+		}
+	}
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *cloakStream) Read(b []byte) (int, error) {
+	var timeout <-chan time.Time
+	if deadline := c.deadline.Load(); deadline != nil && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(*deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		c.access.Lock()
+		if len(c.queue) > 0 {
+			n := copy(b, c.queue[0])
+			if n == len(c.queue[0]) {
+				c.queue = c.queue[1:]
+			} else {
+				c.queue[0] = c.queue[0][n:]
+			}
+			c.access.Unlock()
+			return n, nil
+		}
+		eof := c.eof
+		c.access.Unlock()
+		if eof {
+			return 0, io.EOF
+		}
+		select {
+		case <-c.notify:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, net.ErrClosed
+		case <-c.session.done:
+			return 0, c.session.err
+		}
+	}
+}
+
+func (c *cloakStream) Write(b []byte) (int, error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	var n int
+	for len(b) > 0 {
+		payload := b[:min(len(b), cloakMaxPayload)]
+		if err := c.session.write(cloakFrame{streamID: c.id, seq: c.writeSeq, payload: payload}); err != nil {
+			return n, err
+		}
+		c.writeSeq++
+		n += len(payload)
+		b = b[len(payload):]
+	}
+	return n, nil
+}
+
+// Close tells the server the stream is closed, as Cloak has no half-close
+func (c *cloakStream) Close() error {
+	c.closeOnce.Do(func() {
+		c.writeAccess.Lock()
+		close(c.done)
+		padding := make([]byte, 1+mrand.IntN(256))
+		crand.Read(padding)
+		c.session.write(cloakFrame{streamID: c.id, seq: c.writeSeq, closing: closingStream, payload: padding})
+		c.writeAccess.Unlock()
+		c.session.remove(c.id)
+	})
+	return nil
+}
+
+func (c *cloakStream) LocalAddr() net.Addr {
+	return c.session.conns[0].LocalAddr()
+}
+
+func (c *cloakStream) RemoteAddr() net.Addr {
+	return c.session.conns[0].RemoteAddr()
+}
+
+func (c *cloakStream) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *cloakStream) SetReadDeadline(t time.Time) error {
+	c.deadline.Store(&t)
+	return nil
+}
+
+func (c *cloakStream) SetWriteDeadline(t time.Time) error {
+	return nil
+}
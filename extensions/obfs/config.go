@@ -0,0 +1,78 @@
+package obfs
+
+import (
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/fronting"
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/pool"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// Obfs4Options defines the configuration for the obfs4 outbound. The bridge
+// forwards the obfs4 stream to a SOCKS5 proxy, which connects to the
+// destinations.
+type Obfs4Options struct {
+	Server    string `json:"server"`               // Bridge hostname or IP
+	Port      int    `json:"port"`                 // Bridge port
+	Cert      string `json:"cert,omitempty"`       // cert= of the bridge line, encoding the node ID and public key
+	NodeID    string `json:"node_id,omitempty"`    // Hex node ID, with public_key instead of cert
+	PublicKey string `json:"public_key,omitempty"` // Hex Curve25519 identity key of the bridge
+	IATMode   int    `json:"iat_mode,omitempty"`   // iat-mode= of the bridge line: 0 (off), 1 or 2 (paranoid)
+	Username  string `json:"username,omitempty"`   // SOCKS5 user of the proxy behind the bridge
+	Password  string `json:"password,omitempty"`   // SOCKS5 password
+
+	DNSGuard dnsguard.Options `json:"dns_guard,omitempty"` // Reject poisoned bridge addresses and re-resolve securely
+
+	limiter.Options       // max_connections / max_pending_dials
+	sockopt.Marks         // dscp / tos / socket_priority
+	netdial.DialerOptions // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+	pool.PoolOptions      // pool_size / pool_idle_timeout
+}
+
+// MeekOptions defines the configuration for the meek outbound. The meek
+// server forwards the session to a SOCKS5 proxy, which connects to the
+// destinations.
+type MeekOptions struct {
+	URL      string `json:"url"`                // URL of the meek server; its host is sent as the HTTP Host unless host_header is set
+	Front    string `json:"front,omitempty"`    // Domain dialed and sent as SNI instead of the URL host, unless sni is set
+	Username string `json:"username,omitempty"` // SOCKS5 user of the proxy behind the meek server
+	Password string `json:"password,omitempty"` // SOCKS5 password
+	HTTP2    bool   `json:"http2,omitempty"`    // Carry every session as streams of one HTTP/2 connection to the front; https URLs only
+
+	HeaderOverrides []headers.OverrideRule `json:"header_overrides,omitempty"` // Per-destination request headers, first match wins
+
+	TLS         *tlsconfig.Options        `json:"tls,omitempty"`          // TLS towards the front (uTLS, pins); https URLs only
+	TLSFragment tlsconfig.FragmentOptions `json:"tls_fragment,omitempty"` // Split the ClientHello into TCP segments
+	DNSGuard    dnsguard.Options          `json:"dns_guard,omitempty"`    // Reject poisoned front addresses and re-resolve securely
+
+	fronting.Names        // sni / host_header
+	limiter.Options       // max_connections / max_pending_dials
+	sockopt.Marks         // dscp / tos / socket_priority
+	netdial.DialerOptions // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+}
+
+// CloakOptions defines the configuration for the cloak outbound. The Cloak
+// server forwards the streams of proxy_method to a SOCKS5 proxy, which
+// connects to the destinations.
+type CloakOptions struct {
+	Server           string `json:"server"`                      // Server hostname or IP
+	Port             int    `json:"port"`                        // Server port (usually 443)
+	UID              string `json:"uid"`                         // Base64 user ID (UID)
+	PublicKey        string `json:"public_key"`                  // Base64 X25519 public key of the server (PublicKey)
+	ProxyMethod      string `json:"proxy_method"`                // Entry of the server ProxyBook leading to the SOCKS5 proxy (ProxyMethod)
+	EncryptionMethod string `json:"encryption_method,omitempty"` // plain, aes-256-gcm (default), aes-128-gcm or chacha20-poly1305
+	ServerName       string `json:"server_name"`                 // Domain in the ClientHello (ServerName)
+	BrowserSig       string `json:"browser_sig,omitempty"`       // chrome (default) or firefox ClientHello
+	NumConn          int    `json:"num_conn,omitempty"`          // TCP connections of a session (default 4)
+	Username         string `json:"username,omitempty"`          // SOCKS5 user of the proxy behind the server
+	Password         string `json:"password,omitempty"`          // SOCKS5 password
+
+	DNSGuard dnsguard.Options `json:"dns_guard,omitempty"` // Reject poisoned server addresses and re-resolve securely
+
+	limiter.Options       // max_connections / max_pending_dials
+	sockopt.Marks         // dscp / tos / socket_priority
+	netdial.DialerOptions // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+}
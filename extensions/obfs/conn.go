@@ -0,0 +1,338 @@
+package obfs
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// IAT modes, selecting how writes are split and delayed to hide their
+// sizes and timing
+const (
+	IATNone     = 0 // Writes are padded once per burst and sent at once
+	IATEnabled  = 1 // Bursts are sent in segments with random delays
+	IATParanoid = 2 // Every segment has a random length and delay
+)
+
+// Packet parameters. Each frame carries one packet: a type, the payload
+// length, the payload and zero padding.
+const (
+	packetOverhead         = 1 + 2
+	maxPacketPayloadLength = maxFramePayloadLength - packetOverhead
+	burstHeaderLength      = frameOverhead + packetOverhead
+	maxIATDelay            = 100 // In units of 100µs
+	readSize               = maxSegmentLength * 16
+
+	packetTypePayload  = 0
+	packetTypePRNGSeed = 1
+)
+
+// Obfs4Conn is an obfs4 client connection. Writes are sealed into
+// length-obfuscated frames and padded to lengths drawn from a distribution
+// the bridge seeds; reads are opened from the bridge's frames.
+type Obfs4Conn struct {
+	net.Conn
+	iatMode int
+	lengths *distribution
+	delays  *distribution // nil without IAT obfuscation
+
+	writeAccess sync.Mutex
+	encoder     encoder
+
+	readAccess sync.Mutex
+	decoder    decoder
+	received   bytes.Buffer // Network data not yet decoded
+	decoded    bytes.Buffer // Payload not yet read
+}
+
+// newObfs4Conn performs the obfs4 handshake with the bridge b over conn
+func newObfs4Conn(conn net.Conn, b *bridge, iatMode int) (*Obfs4Conn, error) {
+	var seed [seedLength]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	c := &Obfs4Conn{Conn: conn, iatMode: iatMode, lengths: newDistribution(seed[:], 0, maxSegmentLength)}
+	if iatMode != IATNone {
+		c.delays = newDistribution(iatSeed(seed[:]), 0, maxIATDelay)
+	}
+	if err := c.handshake(b); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Obfs4Conn) handshake(b *bridge) error {
+	hs, err := newClientHandshake(b)
+	if err != nil {
+		return err
+	}
+	request, err := hs.generate()
+	if err != nil {
+		return err
+	}
+	if _, err := c.Conn.Write(request); err != nil {
+		return err
+	}
+	buffer := make([]byte, maxHandshakeLength)
+	for {
+		n, err := c.Conn.Read(buffer)
+		if err != nil {
+			return err
+		}
+		c.received.Write(buffer[:n])
+		length, keySeed, err := hs.parseServer(c.received.Bytes())
+		if err == errMarkNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		c.received.Next(length)
+		keys, err := sessionKeys(keySeed)
+		if err != nil {
+			return err
+		}
+		c.encoder = encoder{newFrameCodec(keys[:frameKeyLength])}
+		c.decoder = decoder{frameCodec: newFrameCodec(keys[frameKeyLength:])}
+		return nil
+	}
+}
+
+func (c *Obfs4Conn) Read(b []byte) (int, error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	var err error
+	for c.decoded.Len() == 0 && err == nil {
+		err = c.readPackets()
+	}
+	// Relay what was decoded before reporting the error
+	if c.decoded.Len() > 0 {
+		n, _ := c.decoded.Read(b)
+		return n, nil
+	}
+	return 0, err
+}
+
+// readPackets decodes the frames received so far, reading from the network
+// when none is complete
+func (c *Obfs4Conn) readPackets() error {
+	if err := c.decodePackets(); err != errAgain {
+		return err
+	}
+	buffer := make([]byte, readSize)
+	n, readErr := c.Conn.Read(buffer)
+	c.received.Write(buffer[:n])
+	err := c.decodePackets()
+	// Read errors are fatal and take priority
+	if readErr != nil {
+		return readErr
+	}
+	if err == errAgain {
+		return nil
+	}
+	return err
+}
+
+// decodePackets decodes the complete frames received. It returns errAgain
+// when no frame was complete.
+func (c *Obfs4Conn) decodePackets() error {
+	decodedAny := false
+	var frame [maxFramePayloadLength]byte
+	for c.received.Len() > 0 {
+		packet, err := c.decoder.decode(frame[:0], &c.received)
+		if err == errAgain {
+			break
+		} else if err != nil {
+			return err
+		}
+		decodedAny = true
+		if len(packet) < packetOverhead {
+			return fmt.Errorf("obfs4: packet of %d bytes", len(packet))
+		}
+		payloadLength := int(binary.BigEndian.Uint16(packet[1:]))
+		if payloadLength > len(packet)-packetOverhead {
+			return fmt.Errorf("obfs4: packet payload of %d bytes", payloadLength)
+		}
+		payload := packet[packetOverhead : packetOverhead+payloadLength]
+		switch packet[0] {
+		case packetTypePayload:
+			c.decoded.Write(payload)
+		case packetTypePRNGSeed:
+			// The bridge picks the distributions, so all its clients share
+			// its traffic shape
+			if len(payload) == seedLength {
+				c.lengths.reset(payload)
+				if c.delays != nil {
+					c.delays.reset(iatSeed(payload))
+				}
+			}
+		}
+	}
+	if !decodedAny {
+		return errAgain
+	}
+	return nil
+}
+
+func (c *Obfs4Conn) Write(b []byte) (int, error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	var burst []byte
+	var err error
+	for chunk := range chunks(b, maxPacketPayloadLength) {
+		if burst, err = c.packet(burst, packetTypePayload, chunk, 0); err != nil {
+			return 0, err
+		}
+	}
+	if c.iatMode != IATParanoid {
+		if burst, err = c.pad(burst, c.lengths.sample()); err != nil {
+			return 0, err
+		}
+	}
+	if c.iatMode == IATNone {
+		if _, err := c.Conn.Write(burst); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	for len(burst) > 0 {
+		length := min(len(burst), maxSegmentLength)
+		if c.iatMode == IATParanoid {
+			target := c.lengths.sample()
+			if target == 0 {
+				continue
+			}
+			if len(burst) < target {
+				if burst, err = c.pad(burst, target); err != nil {
+					return 0, err
+				}
+				if len(burst) != target {
+					// Padding took more than one frame; sample again now
+					// that enough is buffered
+					continue
+				}
+			}
+			length = target
+		}
+		if _, err := c.Conn.Write(burst[:length]); err != nil {
+			return 0, err
+		}
+		burst = burst[length:]
+		time.Sleep(time.Duration(c.delays.sample()) * 100 * time.Microsecond)
+	}
+	return len(b), nil
+}
+
+// packet appends a frame carrying one packet to burst
+func (c *Obfs4Conn) packet(burst []byte, packetType byte, payload []byte, padding int) ([]byte, error) {
+	packet := make([]byte, packetOverhead+len(payload)+padding)
+	packet[0] = packetType
+	binary.BigEndian.PutUint16(packet[1:], uint16(len(payload)))
+	copy(packet[packetOverhead:], payload)
+	return c.encoder.encode(burst, packet)
+}
+
+// pad appends padding frames so that the last segment of burst is target
+// bytes long
+func (c *Obfs4Conn) pad(burst []byte, target int) ([]byte, error) {
+	tail := len(burst) % maxSegmentLength
+	padding := target - tail
+	if target < tail {
+		padding = maxSegmentLength - tail + target
+	}
+	var err error
+	if padding > burstHeaderLength {
+		return c.packet(burst, packetTypePayload, nil, padding-burstHeaderLength)
+	} else if padding > 0 {
+		// Too short for a frame: fill this segment and pad the next
+		if burst, err = c.packet(burst, packetTypePayload, nil, maxPacketPayloadLength); err != nil {
+			return nil, err
+		}
+		return c.packet(burst, packetTypePayload, nil, padding)
+	}
+	return burst, nil
+}
+
+func (c *Obfs4Conn) Upstream() any {
+	return c.Conn
+}
+
+// chunks yields b in slices of at most size bytes
+func chunks(b []byte, size int) func(func([]byte) bool) {
+	return func(yield func([]byte) bool) {
+		for len(b) > 0 {
+			n := min(len(b), size)
+			if !yield(b[:n]) {
+				return
+			}
+			b = b[n:]
+		}
+	}
+}
+
+// iatSeed derives the seed of the delay distribution from the length seed
+func iatSeed(seed []byte) []byte {
+	sum := sha256.Sum256(seed)
+	return sum[:seedLength]
+}
+
+func randomIntn(n int) int {
+	return rand.IntN(n)
+}
+
+// distribution is a weighted random distribution of integers generated
+// from a seed, as obfs4 uses for lengths and delays. Samples use a fresh
+// random source; only the shape is deterministic.
+type distribution struct {
+	access       sync.Mutex
+	minValue     int
+	maxValue     int
+	values       []int
+	cumulative   []float64
+	totalWeights float64
+}
+
+func newDistribution(seed []byte, minValue int, maxValue int) *distribution {
+	d := &distribution{minValue: minValue, maxValue: maxValue}
+	d.reset(seed)
+	return d
+}
+
+// reset draws between 1 and 100 values with uniform weights
+func (d *distribution) reset(seed []byte) {
+	rng := mathrand.New(newDRBG(seed))
+	count := d.maxValue + 1 - d.minValue
+	permutation := rng.Perm(count)
+	count = rng.Intn(min(count, 100)) + 1
+	values := make([]int, count)
+	cumulative := make([]float64, count)
+	var total float64
+	for i := range values {
+		values[i] = permutation[i] + d.minValue
+	}
+	for i := range cumulative {
+		total += rng.Float64()
+		cumulative[i] = total
+	}
+	d.access.Lock()
+	defer d.access.Unlock()
+	d.values, d.cumulative, d.totalWeights = values, cumulative, total
+}
+
+func (d *distribution) sample() int {
+	d.access.Lock()
+	defer d.access.Unlock()
+	target := rand.Float64() * d.totalWeights
+	for i, bound := range d.cumulative {
+		if target < bound {
+			return d.values[i]
+		}
+	}
+	return d.values[len(d.values)-1]
+}
@@ -0,0 +1,234 @@
+package obfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Framing parameters, shared with obfs4 bridges. Frames are a length
+// obfuscated with a SipHash-2-4 DRBG followed by a NaCl secretbox.
+const (
+	maxSegmentLength      = 1500 - (40 + 12)
+	frameLengthLength     = 2
+	frameOverhead         = frameLengthLength + secretbox.Overhead
+	maxFramePayloadLength = maxSegmentLength - frameOverhead
+	maxFrameLength        = maxSegmentLength - frameLengthLength
+	minFrameLength        = frameOverhead - frameLengthLength
+
+	secretboxKeyLength = 32
+	noncePrefixLength  = 16
+	nonceCounterLength = 8
+	seedLength         = 16 + 8 // SipHash key and initial OFB block
+	frameKeyLength     = secretboxKeyLength + noncePrefixLength + seedLength
+
+	inlineSeedFrameLength = frameOverhead + packetOverhead + seedLength
+)
+
+var (
+	errAgain       = errors.New("obfs4: more data needed")
+	errTagMismatch = errors.New("obfs4: frame authentication failed")
+)
+
+// drbg is the hash DRBG of obfs4: SipHash-2-4 in OFB mode, where the hash
+// state accumulates every block written to it
+type drbg struct {
+	sip sipHash
+	ofb [8]byte
+}
+
+func newDRBG(seed []byte) *drbg {
+	d := &drbg{sip: newSipHash(seed[:16])}
+	copy(d.ofb[:], seed[16:seedLength])
+	return d
+}
+
+// nextBlock returns the next 8 byte block
+func (d *drbg) nextBlock() [8]byte {
+	d.sip.write(d.ofb[:])
+	binary.LittleEndian.PutUint64(d.ofb[:], d.sip.sum64())
+	return d.ofb
+}
+
+// Int63 and Seed make the DRBG a math/rand source for the deterministic
+// distributions
+func (d *drbg) Int63() int64 {
+	block := d.nextBlock()
+	return int64(binary.BigEndian.Uint64(block[:]) & (1<<63 - 1))
+}
+
+func (d *drbg) Seed(int64) {}
+
+// sipHash is a streaming SipHash-2-4
+type sipHash struct {
+	v0, v1, v2, v3 uint64
+	tail           [8]byte
+	tailLength     int
+	length         uint64
+}
+
+func newSipHash(key []byte) sipHash {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:16])
+	return sipHash{
+		v0: k0 ^ 0x736f6d6570736575,
+		v1: k1 ^ 0x646f72616e646f6d,
+		v2: k0 ^ 0x6c7967656e657261,
+		v3: k1 ^ 0x7465646279746573,
+	}
+}
+
+func (s *sipHash) write(p []byte) {
+	s.length += uint64(len(p))
+	for len(p) > 0 {
+		n := copy(s.tail[s.tailLength:], p)
+		s.tailLength += n
+		p = p[n:]
+		if s.tailLength == len(s.tail) {
+			s.compress(binary.LittleEndian.Uint64(s.tail[:]))
+			s.tailLength = 0
+		}
+	}
+}
+
+func (s *sipHash) compress(m uint64) {
+	s.v3 ^= m
+	s.round()
+	s.round()
+	s.v0 ^= m
+}
+
+func (s *sipHash) round() {
+	s.v0 += s.v1
+	s.v1 = s.v1<<13 | s.v1>>51
+	s.v1 ^= s.v0
+	s.v0 = s.v0<<32 | s.v0>>32
+	s.v2 += s.v3
+	s.v3 = s.v3<<16 | s.v3>>48
+	s.v3 ^= s.v2
+	s.v0 += s.v3
+	s.v3 = s.v3<<21 | s.v3>>43
+	s.v3 ^= s.v0
+	s.v2 += s.v1
+	s.v1 = s.v1<<17 | s.v1>>47
+	s.v1 ^= s.v2
+	s.v2 = s.v2<<32 | s.v2>>32
+}
+
+// sum64 returns the hash of the data written so far, leaving the state
+// untouched
+func (s *sipHash) sum64() uint64 {
+	final := *s
+	var last [8]byte
+	copy(last[:], s.tail[:s.tailLength])
+	last[7] = byte(s.length)
+	final.compress(binary.LittleEndian.Uint64(last[:]))
+	final.v2 ^= 0xff
+	for range 4 {
+		final.round()
+	}
+	return final.v0 ^ final.v1 ^ final.v2 ^ final.v3
+}
+
+// nonce is a 16 byte prefix from the key material followed by a frame
+// counter starting at 1
+type nonce struct {
+	prefix  [noncePrefixLength]byte
+	counter uint64
+}
+
+func (n *nonce) bytes() ([24]byte, error) {
+	var out [24]byte
+	if n.counter == 0 {
+		return out, errors.New("obfs4: nonce counter wrapped")
+	}
+	copy(out[:], n.prefix[:])
+	binary.BigEndian.PutUint64(out[noncePrefixLength:], n.counter)
+	return out, nil
+}
+
+// frameCodec holds the state of one direction of the frame codec
+type frameCodec struct {
+	key   [secretboxKeyLength]byte
+	nonce nonce
+	drbg  *drbg
+}
+
+func newFrameCodec(key []byte) frameCodec {
+	c := frameCodec{nonce: nonce{counter: 1}, drbg: newDRBG(key[secretboxKeyLength+noncePrefixLength:])}
+	copy(c.key[:], key[:secretboxKeyLength])
+	copy(c.nonce.prefix[:], key[secretboxKeyLength:])
+	return c
+}
+
+type encoder struct {
+	frameCodec
+}
+
+// encode seals payload into a frame appended to out
+func (e *encoder) encode(out []byte, payload []byte) ([]byte, error) {
+	if len(payload) > maxFramePayloadLength {
+		return nil, fmt.Errorf("obfs4: frame payload of %d bytes", len(payload))
+	}
+	nonce, err := e.nonce.bytes()
+	if err != nil {
+		return nil, err
+	}
+	e.nonce.counter++
+	start := len(out)
+	out = append(out, 0, 0)
+	out = secretbox.Seal(out, payload, &nonce, &e.key)
+	mask := e.drbg.nextBlock()
+	length := uint16(len(out)-start-frameLengthLength) ^ binary.BigEndian.Uint16(mask[:])
+	binary.BigEndian.PutUint16(out[start:], length)
+	return out, nil
+}
+
+type decoder struct {
+	frameCodec
+	nextNonce         [24]byte
+	nextLength        uint16
+	nextLengthInvalid bool
+}
+
+// decode opens the next frame of frames into out, or returns errAgain until
+// it was received completely
+func (d *decoder) decode(out []byte, frames *bytes.Buffer) ([]byte, error) {
+	if d.nextLength == 0 {
+		if frames.Len() < frameLengthLength {
+			return nil, errAgain
+		}
+		var masked [frameLengthLength]byte
+		io.ReadFull(frames, masked[:])
+		nonce, err := d.nonce.bytes()
+		if err != nil {
+			return nil, err
+		}
+		d.nextNonce = nonce
+		mask := d.drbg.nextBlock()
+		length := binary.BigEndian.Uint16(masked[:]) ^ binary.BigEndian.Uint16(mask[:])
+		if length < minFrameLength || length > maxFrameLength {
+			// Keep reading a random length before failing, so the length
+			// check does not leak through the timing of the teardown
+			d.nextLengthInvalid = true
+			length = uint16(minFrameLength + rand.IntN(maxFrameLength-minFrameLength+1))
+		}
+		d.nextLength = length
+	}
+	if frames.Len() < int(d.nextLength) {
+		return nil, errAgain
+	}
+	box := frames.Next(int(d.nextLength))
+	opened, ok := secretbox.Open(out, box, &d.nextNonce, &d.key)
+	if !ok || d.nextLengthInvalid {
+		return nil, errTagMismatch
+	}
+	d.nonce.counter++
+	d.nextLength = 0
+	return opened, nil
+}
@@ -0,0 +1,606 @@
+package obfs
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/protocol/socks"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+	"golang.org/x/net/http2"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/session"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+	"github.com/UTPBox/utp-core/internal/tenant"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// Meek protocol parameters, following the Tor meek client
+const (
+	meekSessionIDLength  = 16
+	meekMaxPayloadLength = 0x10000
+	meekMinPollInterval  = 100 * time.Millisecond
+	meekMaxPollInterval  = 5 * time.Second
+	meekPollMultiplier   = 1.5
+	meekMaxRetries       = 5
+	meekRetryDelay       = 500 * time.Millisecond
+	meekRoundTripTimeout = 20 * time.Second
+	meekReadIdleTimeout  = 30 * time.Second
+	meekPingTimeout      = 15 * time.Second
+)
+
+var (
+	_ adapter.Outbound = (*MeekOutbound)(nil)
+	_ session.Migrator = (*MeekOutbound)(nil)
+)
+
+// MeekOutbound reaches destinations through a meek server, usually behind a
+// CDN reached under a different front domain. Each connection is a meek
+// session of its own and asks the SOCKS5 proxy behind the server for the
+// destination. With HTTP/2, the requests of all sessions are streams of one
+// connection to the front instead of connections of their own, and that
+// connection carries over to an identical outbound on reloads.
+type MeekOutbound struct {
+	tag       string
+	opts      MeekOptions
+	logger    log.ContextLogger
+	url       string
+	host      string // HTTP Host, empty for the URL host
+	overrides *headers.Overrides
+	front     string
+	port      int
+	tlsConfig *tlsconfig.Config // nil for http URLs
+	limiter   *limiter.Limiter
+	guard     *dnsguard.Guard
+	dialer    *netdial.Outbound
+	shared    *http.Client                  // HTTP/2 client of all sessions, nil for HTTP/1.1
+	owner     *atomic.Pointer[MeekOutbound] // Outbound shared dials the front through
+	migration string                        // Session key for reloads, "" for HTTP/1.1
+}
+
+// NewMeekOutbound creates a new meek outbound
+func NewMeekOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts MeekOptions) (adapter.Outbound, error) {
+	serverURL, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("meek: invalid url: %w", err)
+	}
+	if (serverURL.Scheme != "https" && serverURL.Scheme != "http") || serverURL.Hostname() == "" {
+		return nil, fmt.Errorf("meek: url must be an http or https URL with a host")
+	}
+	if err := opts.Names.Validate(); err != nil {
+		return nil, fmt.Errorf("meek: %w", err)
+	}
+	for i, rule := range opts.HeaderOverrides {
+		for name := range rule.Headers {
+			if http.CanonicalHeaderKey(name) == "X-Session-Id" {
+				return nil, fmt.Errorf("meek: header_overrides[%d]: X-Session-Id is set by the session", i)
+			}
+		}
+	}
+	overrides, err := headers.Compile(opts.HeaderOverrides)
+	if err != nil {
+		return nil, fmt.Errorf("meek: %w", err)
+	}
+	o := &MeekOutbound{
+		tag:       tag,
+		opts:      opts,
+		logger:    logger,
+		url:       serverURL.String(),
+		host:      opts.HostHeader,
+		overrides: overrides,
+		front:     opts.Front,
+		port:      443,
+		limiter:   limiter.New(opts.Options),
+	}
+	if o.front == "" {
+		o.front = serverURL.Hostname()
+	}
+	if serverURL.Scheme == "http" {
+		o.port = 80
+	}
+	if port := serverURL.Port(); port != "" {
+		if o.port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("meek: invalid url port %q", port)
+		}
+	}
+	if serverURL.Scheme == "https" {
+		tlsOptions := tlsconfig.Options{}
+		if opts.TLS != nil {
+			tlsOptions = *opts.TLS
+		}
+		tlsOptions.Enabled = true
+		if tlsOptions.ServerName, err = opts.Names.ServerName(tlsOptions.ServerName); err != nil {
+			return nil, fmt.Errorf("meek: %w", err)
+		}
+		if tlsOptions.ServerName == "" {
+			tlsOptions.ServerName = o.front
+		}
+		if len(tlsOptions.ALPN) == 0 {
+			// Browser fingerprints offer h2 whichever version meek polls with
+			if opts.HTTP2 {
+				tlsOptions.ALPN = []string{http2.NextProtoTLS}
+			} else {
+				tlsOptions.ALPN = []string{"http/1.1"}
+			}
+		}
+		if o.tlsConfig, err = tlsconfig.New(ctx, o.front, tlsOptions); err != nil {
+			return nil, fmt.Errorf("meek: %w", err)
+		}
+		if err := o.tlsConfig.Fragment(opts.TLSFragment); err != nil {
+			return nil, fmt.Errorf("meek: %w", err)
+		}
+	} else if (opts.TLS != nil && opts.TLS.Enabled) || opts.SNI != "" || opts.TLSFragment.Enabled {
+		return nil, fmt.Errorf("meek: tls, sni and tls_fragment require an https url")
+	} else if opts.HTTP2 {
+		return nil, fmt.Errorf("meek: http2 requires an https url")
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("meek: %w", err)
+	}
+	if o.dialer, err = netdial.New(ctx, tag, opts.DialerOptions, opts.Marks); err != nil {
+		return nil, fmt.Errorf("meek: %w", err)
+	}
+	if o.guard, err = dnsguard.New(ctx, opts.DNSGuard); err != nil {
+		return nil, err
+	}
+	if opts.HTTP2 {
+		o.owner = new(atomic.Pointer[MeekOutbound])
+		o.shared = &http.Client{Transport: o.http2Transport(), Timeout: meekRoundTripTimeout}
+		o.adopt(ctx)
+		o.owner.Store(o)
+	}
+	return o, nil
+}
+
+// http2Transport returns the transport coalescing sessions onto one HTTP/2
+// connection to the front, opening another only when the server limits
+// concurrent streams. Pings detect a connection the front dropped silently.
+// The front is dialed through the outbound owning the transport.
+func (o *MeekOutbound) http2Transport() *http2.Transport {
+	owner := o.owner
+	return &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			o := owner.Load()
+			// Sessions of many connections share the socket, so only QoS
+			// rules matching the outbound apply
+			conn, err := o.guard.DialContext(ctx, o.dialer.For(nil), "tcp", o.front, o.port)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn, err := o.tlsConfig.Handshake(ctx, conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if state, ok := tlsConn.(interface{ ConnectionState() tls.ConnectionState }); ok && state.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+				tlsConn.Close()
+				return nil, fmt.Errorf("front did not negotiate HTTP/2")
+			}
+			o.logger.Debug("meek[", o.tag, "]: HTTP/2 connection to ", o.front, " established")
+			return tlsConn, nil
+		},
+		ReadIdleTimeout: meekReadIdleTimeout,
+		PingTimeout:     meekPingTimeout,
+	}
+}
+
+func (o *MeekOutbound) Type() string {
+	return "meek"
+}
+
+func (o *MeekOutbound) Tag() string {
+	return o.tag
+}
+
+func (o *MeekOutbound) Dependencies() []string {
+	return o.opts.DialerOptions.Dependencies()
+}
+
+// The SOCKS5 proxy is only reached through the meek session, so UDP
+// associations are not available
+func (o *MeekOutbound) Network() []string {
+	return []string{"tcp"}
+}
+
+func (o *MeekOutbound) Start() error {
+	return nil
+}
+
+// adopt takes over the HTTP/2 client of an outbound with the same front and
+// TLS settings replaced by a reload. Sessions of both outbounds then share
+// its connections until the replaced one closes.
+func (o *MeekOutbound) adopt(ctx context.Context) {
+	identity := o.opts
+	identity.Username, identity.Password = "", ""
+	identity.HeaderOverrides = nil
+	identity.DNSGuard = dnsguard.Options{}
+	identity.Options = limiter.Options{}
+	identity.Marks = sockopt.Marks{}
+	o.migration = session.Key(tenant.Scope(ctx, "meek"), identity)
+	previous, loaded := session.Adopt(o.migration)
+	if !loaded {
+		return
+	}
+	h, ok := previous.(meekHandover)
+	if !ok {
+		previous.Close()
+		return
+	}
+	o.shared, o.owner = h.outbound.shared, h.outbound.owner
+	o.logger.Info("meek[", o.tag, "]: reusing HTTP/2 connection to ", o.front, " from previous configuration")
+}
+
+// meekHandover is the HTTP/2 client of an outbound while it is offered or
+// parked during a reload
+type meekHandover struct {
+	outbound *MeekOutbound
+}
+
+// Close closes the idle connections of the client unless another outbound
+// adopted it
+func (h meekHandover) Close() error {
+	if h.outbound.owner.Load() == h.outbound {
+		h.outbound.shared.CloseIdleConnections()
+	}
+	return nil
+}
+
+// OfferSessions offers the HTTP/2 client to an identical outbound of the
+// instance started by a reload
+func (o *MeekOutbound) OfferSessions() {
+	if o.shared != nil && o.owner.Load() == o {
+		session.Offer(o.migration, meekHandover{o})
+	}
+}
+
+func (o *MeekOutbound) Close() error {
+	if o.shared == nil || o.owner.Load() != o {
+		// HTTP/1.1, or adopted by the outbound replacing this one
+		return nil
+	}
+	if session.Reloading() {
+		session.Park(o.migration, meekHandover{o})
+		return nil
+	}
+	return meekHandover{o}.Close()
+}
+
+func (o *MeekOutbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	conn, err := o.dial(ctx, destination)
+	if err != nil {
+		release()
+		o.logger.Debug("meek[", o.tag, "]: ", o.url, " via ", o.front, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+// dial opens a meek session and asks the proxy behind the meek server for
+// destination
+func (o *MeekOutbound) dial(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	// 1. Open the session. Requests dial the front lazily; resolved addresses
+	// are checked against poisoning ranges when configured, and QoS rules may
+	// match the destination. Header overrides for the destination apply to
+	// every request of the session.
+	conn, err := newMeekConn(o, o.dialer.For(adapter.ContextFrom(ctx)), o.overrides.Match(destination))
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to open meek session: %w", err))
+	}
+	deadline := time.Now().Add(C.TCPTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	// 2. SOCKS5 request to the proxy behind the meek server, carried by the
+	// first requests of the session
+	if _, err := socks.ClientHandshake5(conn, socks5.CommandConnect, destination, o.opts.Username, o.opts.Password); err != nil {
+		sessionErr := conn.sessionErr()
+		conn.Close()
+		if sessionErr != nil {
+			return nil, failure.Wrap(failure.StageConnect, sessionErr)
+		}
+		return nil, failure.Wrap(failure.StageTarget, fmt.Errorf("SOCKS5 request failed: %w", err))
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (o *MeekOutbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	return nil, fmt.Errorf("meek outbound does not support UDP")
+}
+
+// MeekConn carries a stream over a meek session: sequential HTTP POST
+// requests sharing a random X-Session-Id header. Each request uploads the
+// bytes written since the previous one and its response body carries
+// downstream bytes; when idle, the connection polls with an increasing
+// interval. The HTTP transport re-establishes connections to the front
+// between requests. Meek has no sequence numbers, so only requests answered
+// with an error status, whose payload the server did not take, are retried.
+type MeekConn struct {
+	client    *http.Client
+	shared    bool // client is the HTTP/2 client of the outbound
+	url       string
+	host      string      // HTTP Host, empty for the URL host
+	header    http.Header // Extra request headers, nil for none
+	sessionID string
+
+	access  sync.Mutex
+	cond    *sync.Cond
+	pending []byte
+	closed  bool
+	err     error
+	signal  chan struct{}
+
+	reader net.Conn // Read end of the pipe the relay writes downstream bytes to
+	writer net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newMeekConn starts a session with the meek server of o, reaching the front
+// with dialer unless the session shares the HTTP/2 client of o. The Host of
+// header replaces that of o; its other headers are added to every request.
+func newMeekConn(o *MeekOutbound, dialer netdial.Dialer, header http.Header) (*MeekConn, error) {
+	var id [meekSessionIDLength]byte
+	if _, err := crand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	client := o.shared
+	if client == nil {
+		client = o.http1Client(dialer)
+	}
+	host := o.host
+	if override := header.Get("Host"); override != "" {
+		host = override
+		header = header.Clone()
+		header.Del("Host")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := net.Pipe()
+	c := &MeekConn{
+		client:    client,
+		shared:    o.shared != nil,
+		url:       o.url,
+		host:      host,
+		header:    header,
+		sessionID: base64.RawURLEncoding.EncodeToString(id[:]),
+		signal:    make(chan struct{}, 1),
+		reader:    reader,
+		writer:    writer,
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	c.cond = sync.NewCond(&c.access)
+	go c.relay()
+	return c, nil
+}
+
+// http1Client returns the HTTP/1.1 client of a session, reaching the front
+// with dialer
+func (o *MeekOutbound) http1Client(dialer netdial.Dialer) *http.Client {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := o.guard.DialContext(ctx, dialer, "tcp", o.front, o.port)
+		if err != nil || o.tlsConfig == nil {
+			return conn, err
+		}
+		tlsConn, err := o.tlsConfig.Handshake(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	transport := &http.Transport{
+		DialContext:         dial,
+		DialTLSContext:      dial,
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     meekMaxPollInterval * 2,
+	}
+	return &http.Client{Transport: transport, Timeout: meekRoundTripTimeout}
+}
+
+func (c *MeekConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if err == io.EOF || errors.Is(err, io.ErrClosedPipe) {
+		if sessionErr := c.closeErr(); sessionErr != nil {
+			err = sessionErr
+		}
+	}
+	return n, err
+}
+
+// Write queues b for the next request, blocking while a full payload is
+// already waiting
+func (c *MeekConn) Write(b []byte) (int, error) {
+	c.access.Lock()
+	for len(c.pending) >= meekMaxPayloadLength && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		c.access.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.pending = append(c.pending, b...)
+	c.access.Unlock()
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+// The meek server drops sessions that stop polling, so closing needs no
+// request
+func (c *MeekConn) Close() error {
+	c.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (c *MeekConn) closeWithError(err error) {
+	c.access.Lock()
+	if c.closed {
+		c.access.Unlock()
+		return
+	}
+	c.closed = true
+	c.err = err
+	c.cond.Broadcast()
+	c.access.Unlock()
+	c.cancel()
+	c.reader.Close()
+	c.writer.Close()
+	if !c.shared {
+		c.client.CloseIdleConnections()
+	}
+}
+
+// closeErr returns the error the connection was closed with, if closed
+func (c *MeekConn) closeErr() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.err
+}
+
+// sessionErr returns the error that ended the session, or nil while it is
+// open or after Close
+func (c *MeekConn) sessionErr() error {
+	if err := c.closeErr(); err != net.ErrClosed {
+		return err
+	}
+	return nil
+}
+
+// relay sends pending data and polls for downstream data until closed
+func (c *MeekConn) relay() {
+	interval := time.Duration(0)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.signal:
+		case <-timer.C:
+		case <-c.ctx.Done():
+			return
+		}
+		payload := c.takePending()
+		received, err := c.roundTrip(payload)
+		if err == nil && len(received) > 0 {
+			_, err = c.writer.Write(received)
+		}
+		if err != nil {
+			c.closeWithError(fmt.Errorf("meek: %w", err))
+			return
+		}
+		switch {
+		case len(received) > 0:
+			interval = 0
+		case len(payload) > 0:
+			interval = meekMinPollInterval
+		default:
+			interval = min(max(time.Duration(float64(interval)*meekPollMultiplier), meekMinPollInterval), meekMaxPollInterval)
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (c *MeekConn) takePending() []byte {
+	c.access.Lock()
+	defer c.access.Unlock()
+	n := min(len(c.pending), meekMaxPayloadLength)
+	payload := slices.Clone(c.pending[:n])
+	c.pending = c.pending[n:]
+	c.cond.Broadcast()
+	return payload
+}
+
+// roundTrip uploads payload and returns the downstream bytes of the
+// response. The body is read before it is handed to the reader, so a slow
+// reader does not run into the request timeout.
+func (c *MeekConn) roundTrip(payload []byte) ([]byte, error) {
+	delay := meekRetryDelay
+	for attempt := 1; ; attempt++ {
+		response, err := c.post(payload)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode == http.StatusOK {
+			defer response.Body.Close()
+			return io.ReadAll(response.Body)
+		}
+		response.Body.Close()
+		if attempt == meekMaxRetries {
+			return nil, fmt.Errorf("unexpected response status: %s", response.Status)
+		}
+		select {
+		case <-time.After(delay):
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (c *MeekConn) post(payload []byte) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if c.host != "" {
+		request.Host = c.host
+	}
+	request.Header.Set("X-Session-Id", c.sessionID)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	for name, values := range c.header {
+		request.Header[name] = values
+	}
+	return c.client.Do(request)
+}
+
+func (c *MeekConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *MeekConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// Deadlines apply to reads; writes only block while a full payload waits
+// for the next request
+func (c *MeekConn) SetDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *MeekConn) SetReadDeadline(t time.Time) error {
+	return c.reader.SetReadDeadline(t)
+}
+
+func (c *MeekConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package obfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/testkit"
+)
+
+// meekServer is a meek server handing each session to a SOCKS5 proxy
+// echoing it back. It records the Host and headers of the requests, and the
+// SOCKS5 exchange of each session.
+type meekServer struct {
+	requests    chan testkit.SOCKSRequest
+	transcripts chan *testkit.Transcript
+
+	access   sync.Mutex
+	sessions map[string]net.Conn
+	hosts    map[string]bool
+	header   http.Header // Of the last request
+}
+
+func (s *meekServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get("X-Session-Id")
+	if r.Method != http.MethodPost || id == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	s.access.Lock()
+	s.hosts[r.Host] = true
+	s.header = r.Header.Clone()
+	session := s.sessions[id]
+	if session == nil {
+		var proxy net.Conn
+		session, proxy = testkit.Pipe(nil, nil)
+		s.sessions[id] = session
+		go func() {
+			defer proxy.Close()
+			transcript := testkit.Record(proxy)
+			request, err := testkit.AcceptSOCKS5(transcript)
+			if err != nil {
+				return
+			}
+			s.requests <- request
+			s.transcripts <- transcript
+			testkit.Echo(proxy)
+		}()
+	}
+	s.access.Unlock()
+	upstream, err := io.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	session.Write(upstream)
+	// Return what the proxy answers shortly after
+	var downstream []byte
+	buffer := make([]byte, meekMaxPayloadLength)
+	session.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	for {
+		n, err := session.Read(buffer)
+		downstream = append(downstream, buffer[:n]...)
+		if errors.Is(err, os.ErrDeadlineExceeded) || len(downstream) >= meekMaxPayloadLength {
+			break
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Write(downstream)
+}
+
+// startMeekServer serves a meek server on network at address
+func startMeekServer(t *testing.T, network *testkit.Network, address string) *meekServer {
+	t.Helper()
+	server := &meekServer{
+		requests:    make(chan testkit.SOCKSRequest, 4),
+		transcripts: make(chan *testkit.Transcript, 4),
+		sessions:    make(map[string]net.Conn),
+		hosts:       make(map[string]bool),
+	}
+	listener, err := network.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: server}
+	go httpServer.Serve(listener)
+	t.Cleanup(func() { httpServer.Close() })
+	return server
+}
+
+func meekOutbound(t *testing.T, network *testkit.Network, opts MeekOptions) adapter.Outbound {
+	t.Helper()
+	outbound, _, err := testkit.NewOutbound(testkit.Context(context.Background(), network, nil), nil, NewMeekOutbound, "meek-out", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outbound
+}
+
+// testEcho writes a message larger than a request payload to conn and reads
+// it back
+func testEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	message := make([]byte, meekMaxPayloadLength+1000)
+	rand.Read(message)
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, message) {
+		t.Fatal("echo differs from the message")
+	}
+}
+
+func TestMeek(t *testing.T) {
+	network := &testkit.Network{}
+	// The URL host is only the HTTP Host; the front is dialed
+	server := startMeekServer(t, network, "front.example:80")
+	outbound := meekOutbound(t, network, MeekOptions{
+		URL:      "http://meek.example/",
+		Front:    "front.example",
+		Username: "user",
+		Password: "secret",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	destination := metadata.ParseSocksaddrHostPort("example.com", 443)
+	conn, err := outbound.DialContext(ctx, "tcp", destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-server.requests
+	if err := (<-server.transcripts).Golden(filepath.Join("testdata", "socks5-auth.golden")); err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+
+	server.access.Lock()
+	defer server.access.Unlock()
+	if len(server.hosts) != 1 || !server.hosts["meek.example"] {
+		t.Fatalf("requests were sent for hosts %v, want meek.example", server.hosts)
+	}
+}
+
+func TestMeekHeaderOverrides(t *testing.T) {
+	network := &testkit.Network{}
+	server := startMeekServer(t, network, "meek.example:80")
+	outbound := meekOutbound(t, network, MeekOptions{
+		URL: "http://meek.example/",
+		HeaderOverrides: []headers.OverrideRule{{
+			DomainSuffix: []string{"video.example"},
+			Headers:      map[string]string{"Host": "cdn.example", "X-Client": "video"},
+		}},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := outbound.DialContext(ctx, "tcp", metadata.ParseSocksaddrHostPort("www.video.example", 443))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-server.requests
+	testEcho(t, conn)
+
+	server.access.Lock()
+	defer server.access.Unlock()
+	if len(server.hosts) != 1 || !server.hosts["cdn.example"] || server.header.Get("X-Client") != "video" {
+		t.Fatalf("requests were sent for hosts %v with headers %v, want the override", server.hosts, server.header)
+	}
+}
@@ -0,0 +1,475 @@
+package obfs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/UTPBox/utp-core/internal/clock"
+	"github.com/UTPBox/utp-core/internal/shaping"
+)
+
+// ntor and handshake parameters, shared with obfs4 bridges
+const (
+	nodeIDLength         = 20
+	keyLength            = 32
+	representativeLength = 32
+	authLength           = 32
+	markLength           = 16
+	macLength            = 16
+
+	maxHandshakeLength       = 8192
+	clientMinHandshakeLength = representativeLength + markLength + macLength
+	serverMinHandshakeLength = representativeLength + authLength + markLength + macLength
+	clientMinPadLength       = (serverMinHandshakeLength + inlineSeedFrameLength) - clientMinHandshakeLength
+	clientMaxPadLength       = maxHandshakeLength - clientMinHandshakeLength
+)
+
+var (
+	protoID = []byte("ntor-curve25519-sha256-1")
+	tMac    = append(protoID[:len(protoID):len(protoID)], ":mac"...)
+	tKey    = append(protoID[:len(protoID):len(protoID)], ":key_extract"...)
+	tVerify = append(protoID[:len(protoID):len(protoID)], ":key_verify"...)
+	mExpand = append(protoID[:len(protoID):len(protoID)], ":key_expand"...)
+
+	errMarkNotFound = errors.New("obfs4: server handshake mark not found yet")
+)
+
+// bridge identifies an obfs4 bridge: its node ID and long-term public key
+type bridge struct {
+	nodeID    [nodeIDLength]byte
+	publicKey [keyLength]byte
+}
+
+// parseBridge reads the bridge identity from a bridge line cert, or from a
+// hex node ID and public key
+func parseBridge(cert string, nodeID string, publicKey string) (*bridge, error) {
+	var b bridge
+	if cert != "" {
+		raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(cert, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid obfs4 cert: %w", err)
+		}
+		if len(raw) != nodeIDLength+keyLength {
+			return nil, fmt.Errorf("invalid obfs4 cert: expected %d bytes, got %d", nodeIDLength+keyLength, len(raw))
+		}
+		copy(b.nodeID[:], raw[:nodeIDLength])
+		copy(b.publicKey[:], raw[nodeIDLength:])
+		return &b, nil
+	}
+	if nodeID == "" || publicKey == "" {
+		return nil, fmt.Errorf("obfs4 requires cert, or node_id and public_key")
+	}
+	id, err := hex.DecodeString(nodeID)
+	if err != nil || len(id) != nodeIDLength {
+		return nil, fmt.Errorf("invalid obfs4 node_id: expected %d hex bytes", nodeIDLength)
+	}
+	key, err := hex.DecodeString(publicKey)
+	if err != nil || len(key) != keyLength {
+		return nil, fmt.Errorf("invalid obfs4 public_key: expected %d hex bytes", keyLength)
+	}
+	copy(b.nodeID[:], id)
+	copy(b.publicKey[:], key)
+	return &b, nil
+}
+
+// keypair is an ephemeral Curve25519 key whose public key has an Elligator2
+// representative, so it is indistinguishable from random bytes on the wire
+type keypair struct {
+	private        [keyLength]byte
+	public         [keyLength]byte
+	representative [representativeLength]byte
+}
+
+// newKeypair draws keys until one is representable, about every other key
+func newKeypair() (*keypair, error) {
+	for {
+		var k keypair
+		if _, err := rand.Read(k.private[:]); err != nil {
+			return nil, err
+		}
+		public, err := curve25519.X25519(k.private[:], curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+		var tweak [1]byte
+		if _, err := rand.Read(tweak[:]); err != nil {
+			return nil, err
+		}
+		// Clamped scalars only reach the prime order subgroup, which sets
+		// apart their representatives. Adding a random low order point
+		// hides this; it is cleared again by the peer's clamped scalar.
+		u, ok := addLowOrder(feFromBytes(public), int(tweak[0]&7))
+		if !ok {
+			continue
+		}
+		representative, ok := representativeOf(u)
+		if !ok {
+			continue
+		}
+		k.public = feBytes(u)
+		k.representative = representative
+		return &k, nil
+	}
+}
+
+// clientHandshake is the client side of the obfs4 handshake: the ntor key
+// exchange hidden in random padding and located by HMAC marks
+type clientHandshake struct {
+	bridge    *bridge
+	keypair   *keypair
+	padLength int
+	epochHour []byte
+	mac       hash.Hash
+}
+
+func newClientHandshake(b *bridge) (*clientHandshake, error) {
+	keypair, err := newKeypair()
+	if err != nil {
+		return nil, err
+	}
+	padLength, shaped := shaping.Padding(clientMinHandshakeLength, clientMaxPadLength)
+	if !shaped {
+		padLength = clientMinPadLength + randomIntn(clientMaxPadLength-clientMinPadLength+1)
+	}
+	return &clientHandshake{
+		bridge:    b,
+		keypair:   keypair,
+		padLength: max(padLength, clientMinPadLength),
+		mac:       hmac.New(sha256.New, append(b.publicKey[:], b.nodeID[:]...)),
+	}, nil
+}
+
+// generate returns the client handshake: X' | P_C | M_C | MAC(X' | P_C | M_C | E)
+func (hs *clientHandshake) generate() ([]byte, error) {
+	var buffer bytes.Buffer
+	hs.mac.Reset()
+	hs.mac.Write(hs.keypair.representative[:])
+	mark := hs.mac.Sum(nil)[:markLength]
+
+	padding := make([]byte, hs.padLength)
+	if _, err := rand.Read(padding); err != nil {
+		return nil, err
+	}
+	buffer.Write(hs.keypair.representative[:])
+	buffer.Write(padding)
+	buffer.Write(mark)
+
+	hs.mac.Reset()
+	hs.mac.Write(buffer.Bytes())
+	hs.epochHour = []byte(strconv.FormatInt(clock.Now().Unix()/3600, 10))
+	hs.mac.Write(hs.epochHour)
+	buffer.Write(hs.mac.Sum(nil)[:macLength])
+	return buffer.Bytes(), nil
+}
+
+// parseServer looks for the server handshake at the start of response. It
+// returns the length of the handshake and the ntor key seed, or
+// errMarkNotFound while more data is needed.
+func (hs *clientHandshake) parseServer(response []byte) (int, []byte, error) {
+	if len(response) < serverMinHandshakeLength {
+		return 0, nil, errMarkNotFound
+	}
+	var representative [representativeLength]byte
+	copy(representative[:], response[:representativeLength])
+	serverAuth := response[representativeLength : representativeLength+authLength]
+
+	hs.mac.Reset()
+	hs.mac.Write(representative[:])
+	mark := hs.mac.Sum(nil)[:markLength]
+	position := findMark(mark, response, representativeLength+authLength, maxHandshakeLength)
+	if position < 0 {
+		if len(response) >= maxHandshakeLength {
+			return 0, nil, errors.New("obfs4: invalid server handshake")
+		}
+		return 0, nil, errMarkNotFound
+	}
+
+	hs.mac.Reset()
+	hs.mac.Write(response[:position+markLength])
+	hs.mac.Write(hs.epochHour)
+	if !hmac.Equal(hs.mac.Sum(nil)[:macLength], response[position+markLength:position+markLength+macLength]) {
+		return 0, nil, errors.New("obfs4: server handshake MAC mismatch")
+	}
+
+	serverPublic := feBytes(publicOf(representative))
+	seed, auth, err := hs.ntor(serverPublic)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !hmac.Equal(auth, serverAuth) {
+		return 0, nil, errors.New("obfs4: server authentication failed, check the bridge cert")
+	}
+	return position + markLength + macLength, seed, nil
+}
+
+// ntor completes the key exchange with the server ephemeral key Y and
+// returns the key seed and the expected server AUTH
+func (hs *clientHandshake) ntor(serverPublic [keyLength]byte) ([]byte, []byte, error) {
+	var secretInput bytes.Buffer
+	// EXP(Y, x) | EXP(B, x)
+	for _, peer := range [][]byte{serverPublic[:], hs.bridge.publicKey[:]} {
+		shared, err := curve25519.X25519(hs.keypair.private[:], peer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("obfs4: ntor failed: %w", err)
+		}
+		secretInput.Write(shared)
+	}
+
+	// obfs4 bridges hash B twice where Tor's ntor has ID | B, so the suffix
+	// is B | B | X | Y | PROTOID | ID
+	var suffix bytes.Buffer
+	suffix.Write(hs.bridge.publicKey[:])
+	suffix.Write(hs.bridge.publicKey[:])
+	suffix.Write(hs.keypair.public[:])
+	suffix.Write(serverPublic[:])
+	suffix.Write(protoID)
+	suffix.Write(hs.bridge.nodeID[:])
+	secretInput.Write(suffix.Bytes())
+
+	keySeed := hmacSum(tKey, secretInput.Bytes())
+	verify := hmacSum(tVerify, secretInput.Bytes())
+	authInput := append(verify, suffix.Bytes()...)
+	authInput = append(authInput, "Server"...)
+	return keySeed, hmacSum(tMac, authInput), nil
+}
+
+// findMark returns the position of mark in buffer between start and
+// limit, provided the MAC following it was received, or -1
+func findMark(mark []byte, buffer []byte, start int, limit int) int {
+	end := min(len(buffer), limit)
+	if start > end || end-start < markLength+macLength {
+		return -1
+	}
+	position := bytes.Index(buffer[start:end], mark)
+	if position < 0 || start+position+markLength+macLength > end {
+		return -1
+	}
+	return start + position
+}
+
+// sessionKeys expands the ntor key seed into the key material of both
+// directions
+func sessionKeys(keySeed []byte) ([]byte, error) {
+	okm := make([]byte, frameKeyLength*2)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, keySeed, tKey, mExpand), okm); err != nil {
+		return nil, err
+	}
+	return okm, nil
+}
+
+func hmacSum(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Curve25519 field and Montgomery curve arithmetic for Elligator2. Keys are
+// generated once per connection, so math/big is fast enough.
+var (
+	fieldP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	halfP  = new(big.Int).Rsh(fieldP, 1)
+	curveA = big.NewInt(486662)
+	// Order of the prime order subgroup
+	groupOrder, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+	lowOrderOnce  sync.Once
+	lowOrderPoint *point // Generator of the points of order dividing 8
+)
+
+func feFromBytes(b []byte) *big.Int {
+	var reversed [keyLength]byte
+	for i := range reversed {
+		reversed[i] = b[keyLength-1-i]
+	}
+	x := new(big.Int).SetBytes(reversed[:])
+	return x.Mod(x, fieldP)
+}
+
+func feBytes(x *big.Int) [keyLength]byte {
+	var out [keyLength]byte
+	x.FillBytes(out[:])
+	for i := 0; i < keyLength/2; i++ {
+		out[i], out[keyLength-1-i] = out[keyLength-1-i], out[i]
+	}
+	return out
+}
+
+func feMod(x *big.Int) *big.Int {
+	return x.Mod(x, fieldP)
+}
+
+func feInverse(x *big.Int) *big.Int {
+	return new(big.Int).ModInverse(x, fieldP)
+}
+
+// curveRHS returns u^3 + A*u^2 + u
+func curveRHS(u *big.Int) *big.Int {
+	rhs := new(big.Int).Mul(u, u)
+	rhs.Add(rhs, new(big.Int).Mul(curveA, u))
+	rhs.Add(rhs, big.NewInt(1))
+	rhs.Mul(rhs, u)
+	return feMod(rhs)
+}
+
+// publicOf maps a representative to the public key it encodes
+func publicOf(representative [representativeLength]byte) *big.Int {
+	// The two high bits are random padding
+	representative[representativeLength-1] &= 0x3f
+	r := feFromBytes(representative[:])
+	// d = -A / (1 + 2r^2)
+	t := new(big.Int).Mul(r, r)
+	t.Lsh(t, 1)
+	t.Add(t, big.NewInt(1))
+	feMod(t)
+	d := new(big.Int)
+	if t.Sign() != 0 {
+		d.Neg(curveA)
+		d.Mul(d, feInverse(t))
+		feMod(d)
+	}
+	if big.Jacobi(curveRHS(d), fieldP) >= 0 {
+		return d
+	}
+	// u = -A - d
+	u := new(big.Int).Neg(curveA)
+	u.Sub(u, d)
+	return feMod(u)
+}
+
+// representativeOf returns a random representative of the public key u, if
+// it has one
+func representativeOf(u *big.Int) ([representativeLength]byte, bool) {
+	var representative [representativeLength]byte
+	uPlusA := feMod(new(big.Int).Add(u, curveA))
+	if u.Sign() == 0 || uPlusA.Sign() == 0 {
+		return representative, false
+	}
+	var choice [1]byte
+	if _, err := rand.Read(choice[:]); err != nil {
+		return representative, false
+	}
+	// Either -u / 2(u+A) or -(u+A) / 2u; both are squares or neither is
+	numerator, denominator := u, uPlusA
+	if choice[0]&1 != 0 {
+		numerator, denominator = uPlusA, u
+	}
+	x := new(big.Int).Neg(numerator)
+	x.Mul(x, feInverse(feMod(new(big.Int).Lsh(denominator, 1))))
+	feMod(x)
+	if big.Jacobi(x, fieldP) != 1 {
+		return representative, false
+	}
+	r := new(big.Int).ModSqrt(x, fieldP)
+	if r == nil {
+		return representative, false
+	}
+	// The root below p/2 leaves the two high bits free for padding
+	if r.Cmp(halfP) > 0 {
+		r.Sub(fieldP, r)
+	}
+	representative = feBytes(r)
+	representative[representativeLength-1] |= choice[0] & 0xc0
+	return representative, true
+}
+
+// point is an affine point of the Montgomery curve; nil is the identity
+type point struct {
+	u, v *big.Int
+}
+
+func (p *point) add(q *point) *point {
+	switch {
+	case p == nil:
+		return q
+	case q == nil:
+		return p
+	}
+	var lambda *big.Int
+	if p.u.Cmp(q.u) == 0 {
+		if p.v.Cmp(q.v) != 0 || p.v.Sign() == 0 {
+			return nil
+		}
+		// (3u^2 + 2Au + 1) / 2v
+		numerator := new(big.Int).Mul(p.u, p.u)
+		numerator.Mul(numerator, big.NewInt(3))
+		numerator.Add(numerator, new(big.Int).Lsh(new(big.Int).Mul(curveA, p.u), 1))
+		numerator.Add(numerator, big.NewInt(1))
+		lambda = numerator.Mul(numerator, feInverse(feMod(new(big.Int).Lsh(p.v, 1))))
+	} else {
+		numerator := new(big.Int).Sub(q.v, p.v)
+		lambda = numerator.Mul(numerator, feInverse(feMod(new(big.Int).Sub(q.u, p.u))))
+	}
+	feMod(lambda)
+	u := new(big.Int).Mul(lambda, lambda)
+	u.Sub(u, curveA)
+	u.Sub(u, p.u)
+	u.Sub(u, q.u)
+	feMod(u)
+	v := new(big.Int).Sub(p.u, u)
+	v.Mul(v, lambda)
+	v.Sub(v, p.v)
+	return &point{u: u, v: feMod(v)}
+}
+
+func (p *point) multiply(k *big.Int) *point {
+	var result *point
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		result = result.add(result)
+		if k.Bit(i) == 1 {
+			result = result.add(p)
+		}
+	}
+	return result
+}
+
+// lift returns a point with coordinate u, or nil if u is not on the curve
+func lift(u *big.Int) *point {
+	v := new(big.Int).ModSqrt(curveRHS(u), fieldP)
+	if v == nil {
+		return nil
+	}
+	return &point{u: new(big.Int).Set(u), v: v}
+}
+
+// addLowOrder returns the coordinate of u plus n times a point of order 8
+func addLowOrder(u *big.Int, n int) (*big.Int, bool) {
+	lowOrderOnce.Do(func() {
+		for candidate := int64(2); lowOrderPoint == nil; candidate++ {
+			p := lift(big.NewInt(candidate))
+			if p == nil {
+				continue
+			}
+			// Multiplying by the subgroup order leaves the low order part
+			t := p.multiply(groupOrder)
+			if t.multiply(big.NewInt(4)) != nil {
+				lowOrderPoint = t
+			}
+		}
+	})
+	p := lift(u)
+	if p == nil {
+		return nil, false
+	}
+	for range n {
+		p = p.add(lowOrderPoint)
+	}
+	if p == nil {
+		return nil, false
+	}
+	return p.u, true
+}
@@ -0,0 +1,467 @@
+package obfs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/testkit"
+)
+
+// The bridge of these tests follows obfs4-spec.txt of obfs4proxy and the
+// ntor handshake as obfs4proxy implements it, with the standard primitives
+// only: none of the handshake or framing code of the outbound is used.
+const (
+	specMarkLength     = 16
+	specMACLength      = 16
+	specMaxHandshake   = 8192
+	specMaxPacket      = 1448 - 2 - secretbox.Overhead - 3 // Segment less frame and packet headers
+	specPacketPayload  = 0
+	specPacketPRNGSeed = 1
+	specNtorProtoID    = "ntor-curve25519-sha256-1"
+)
+
+// Field of Curve25519 and the A of its Montgomery form, for Elligator2
+var (
+	p25519 = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	a25519 = big.NewInt(486662)
+)
+
+func leInt(b []byte) *big.Int {
+	reversed := make([]byte, len(b))
+	for i := range b {
+		reversed[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(reversed)
+}
+
+func leBytes(x *big.Int) []byte {
+	b := x.FillBytes(make([]byte, 32))
+	for i := 0; i < 16; i++ {
+		b[i], b[31-i] = b[31-i], b[i]
+	}
+	return b
+}
+
+// isSquare is Euler's criterion
+func isSquare(x *big.Int) bool {
+	r := new(big.Int).Exp(x, new(big.Int).Rsh(new(big.Int).Sub(p25519, big.NewInt(1)), 1), p25519)
+	return r.Cmp(big.NewInt(1)) <= 0
+}
+
+// sqrt25519 returns a square root of x, or nil: p = 5 mod 8, so the root is
+// x^((p+3)/8), possibly times sqrt(-1) = 2^((p-1)/4)
+func sqrt25519(x *big.Int) *big.Int {
+	r := new(big.Int).Exp(x, new(big.Int).Rsh(new(big.Int).Add(p25519, big.NewInt(3)), 3), p25519)
+	if new(big.Int).Exp(r, big.NewInt(2), p25519).Cmp(x) != 0 {
+		i := new(big.Int).Exp(big.NewInt(2), new(big.Int).Rsh(new(big.Int).Sub(p25519, big.NewInt(1)), 2), p25519)
+		r.Mod(r.Mul(r, i), p25519)
+	}
+	if new(big.Int).Exp(r, big.NewInt(2), p25519).Cmp(x) != 0 {
+		return nil
+	}
+	return r
+}
+
+// elligatorDecode maps a representative to a public key: v = -A / (1 + 2r^2)
+// is the key when v^3 + Av^2 + v is a square, and -v - A otherwise. The two
+// high bits of representatives are random.
+func elligatorDecode(representative []byte) []byte {
+	masked := bytes.Clone(representative)
+	masked[31] &= 0x3f
+	r := leInt(masked)
+	denominator := new(big.Int).Mul(r, r)
+	denominator.Mod(denominator.Add(denominator.Lsh(denominator, 1), big.NewInt(1)), p25519)
+	v := new(big.Int).Neg(a25519)
+	v.Mod(v.Mul(v, new(big.Int).ModInverse(denominator, p25519)), p25519)
+	curve := new(big.Int).Add(v, a25519)
+	curve.Mod(curve.Add(curve.Mul(curve, v), big.NewInt(1)).Mul(curve, v), p25519)
+	if !isSquare(curve) {
+		v.Mod(v.Sub(new(big.Int).Neg(v), a25519), p25519)
+	}
+	return leBytes(v)
+}
+
+// elligatorEncode returns a representative of the public key u, when
+// -u / 2(u + A) is a square: its root below p/2, with random high bits
+func elligatorEncode(public []byte) ([]byte, bool) {
+	u := leInt(public)
+	denominator := new(big.Int).Add(u, a25519)
+	denominator.Mod(denominator.Lsh(denominator, 1), p25519)
+	inverse := new(big.Int).ModInverse(denominator, p25519)
+	if u.Sign() == 0 || inverse == nil {
+		return nil, false
+	}
+	ratio := new(big.Int).Neg(u)
+	r := sqrt25519(ratio.Mod(ratio.Mul(ratio, inverse), p25519))
+	if r == nil {
+		return nil, false
+	}
+	if r.Cmp(new(big.Int).Rsh(p25519, 1)) > 0 {
+		r.Sub(p25519, r)
+	}
+	representative := leBytes(r)
+	var high [1]byte
+	rand.Read(high[:])
+	representative[31] |= high[0] & 0xc0
+	return representative, true
+}
+
+// sipHash24 is SipHash-2-4 of message, as in the SipHash paper
+func sipHash24(key []byte, message []byte) uint64 {
+	k0, k1 := binary.LittleEndian.Uint64(key), binary.LittleEndian.Uint64(key[8:])
+	v := [4]uint64{k0 ^ 0x736f6d6570736575, k1 ^ 0x646f72616e646f6d, k0 ^ 0x6c7967656e657261, k1 ^ 0x7465646279746573}
+	rotl := func(x uint64, n int) uint64 { return x<<n | x>>(64-n) }
+	sipRound := func() {
+		v[0] += v[1]
+		v[1] = rotl(v[1], 13) ^ v[0]
+		v[0] = rotl(v[0], 32)
+		v[2] += v[3]
+		v[3] = rotl(v[3], 16) ^ v[2]
+		v[0] += v[3]
+		v[3] = rotl(v[3], 21) ^ v[0]
+		v[2] += v[1]
+		v[1] = rotl(v[1], 17) ^ v[2]
+		v[2] = rotl(v[2], 32)
+	}
+	padded := append(bytes.Clone(message), make([]byte, 8-len(message)%8)...)
+	padded[len(padded)-1] = byte(len(message))
+	for i := 0; i < len(padded); i += 8 {
+		m := binary.LittleEndian.Uint64(padded[i:])
+		v[3] ^= m
+		sipRound()
+		sipRound()
+		v[0] ^= m
+	}
+	v[2] ^= 0xff
+	for range 4 {
+		sipRound()
+	}
+	return v[0] ^ v[1] ^ v[2] ^ v[3]
+}
+
+func TestSipHash(t *testing.T) {
+	// Appendix A of the SipHash paper
+	key, message := make([]byte, 16), make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	copy(message, key)
+	const want uint64 = 0xa129ca6149be45e5
+	if got := sipHash24(key, message); got != want {
+		t.Fatalf("test SipHash = %x, want %x", got, want)
+	}
+	// The DRBG of the outbound hashes in blocks
+	h := newSipHash(key)
+	h.write(message[:8])
+	h.write(message[8:])
+	if got := h.sum64(); got != want {
+		t.Fatalf("SipHash = %x, want %x", got, want)
+	}
+}
+
+// frameCipher is one direction of obfs4 framing: NaCl secretboxes under a
+// nonce prefix and counter, after their length masked by the SipHash-2-4
+// OFB DRBG. The DRBG hashes every block it produced so far, seed included.
+type frameCipher struct {
+	key     [32]byte
+	prefix  [16]byte
+	counter uint64
+	sipKey  []byte
+	blocks  []byte
+}
+
+// newFrameCiphers expands the ntor key seed: the first 72 bytes key the
+// frames of the client, the others those of the bridge
+func newFrameCiphers(keySeed []byte) (client *frameCipher, bridge *frameCipher) {
+	material := make([]byte, 144)
+	io.ReadFull(hkdf.New(sha256.New, keySeed, []byte(specNtorProtoID+":key_extract"), []byte(specNtorProtoID+":key_expand")), material)
+	ciphers := [2]*frameCipher{}
+	for i := range ciphers {
+		keys := material[72*i:]
+		c := &frameCipher{sipKey: keys[48:64], blocks: bytes.Clone(keys[64:72])}
+		copy(c.key[:], keys)
+		copy(c.prefix[:], keys[32:48])
+		ciphers[i] = c
+	}
+	return ciphers[0], ciphers[1]
+}
+
+func (c *frameCipher) nextMask() uint16 {
+	block := binary.LittleEndian.AppendUint64(nil, sipHash24(c.sipKey, c.blocks))
+	c.blocks = append(c.blocks, block...)
+	return binary.BigEndian.Uint16(block)
+}
+
+func (c *frameCipher) nonce() *[24]byte {
+	c.counter++
+	var nonce [24]byte
+	copy(nonce[:], c.prefix[:])
+	binary.BigEndian.PutUint64(nonce[16:], c.counter)
+	return &nonce
+}
+
+// seal returns the frame of a packet: type, length, payload
+func (c *frameCipher) seal(packetType byte, payload []byte) []byte {
+	packet := append([]byte{packetType, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+	box := secretbox.Seal(nil, packet, c.nonce(), &c.key)
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(box))^c.nextMask()), box...)
+}
+
+// open reads a frame and returns its packet type and payload
+func (c *frameCipher) open(r io.Reader) (byte, []byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, err
+	}
+	box := make([]byte, binary.BigEndian.Uint16(length[:])^c.nextMask())
+	if _, err := io.ReadFull(r, box); err != nil {
+		return 0, nil, err
+	}
+	packet, ok := secretbox.Open(nil, box, c.nonce(), &c.key)
+	if !ok || len(packet) < 3 || int(binary.BigEndian.Uint16(packet[1:])) > len(packet)-3 {
+		return 0, nil, errors.New("invalid frame")
+	}
+	return packet[0], packet[3 : 3+binary.BigEndian.Uint16(packet[1:])], nil
+}
+
+// bridgeServer accepts obfs4 clients of the identity nodeID and public
+type bridgeServer struct {
+	nodeID  [20]byte
+	public  []byte
+	private []byte
+}
+
+func newBridgeServer() *bridgeServer {
+	b := &bridgeServer{private: make([]byte, 32)}
+	rand.Read(b.nodeID[:])
+	rand.Read(b.private)
+	b.public, _ = curve25519.X25519(b.private, curve25519.Basepoint)
+	return b
+}
+
+// mac is HMAC-SHA256 keyed with B | NODEID, truncated to 16 bytes
+func (b *bridgeServer) mac(parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, append(bytes.Clone(b.public), b.nodeID[:]...))
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)[:16]
+}
+
+// handshake answers the client handshake X' | P_C | M_C | MAC with
+// Y' | AUTH | P_S | M_S | MAC and the PRNG seed frame, and returns the
+// stream of the client
+func (b *bridgeServer) handshake(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReaderSize(conn, specMaxHandshake)
+	var hello []byte
+	markAt := -1
+	for markAt < 0 {
+		if len(hello) >= specMaxHandshake {
+			return nil, errors.New("client mark not found")
+		}
+		chunk := make([]byte, specMaxHandshake-len(hello))
+		n, err := reader.Read(chunk)
+		if err != nil {
+			return nil, err
+		}
+		hello = append(hello, chunk[:n]...)
+		if len(hello) >= 32 {
+			if i := bytes.Index(hello[32:], b.mac(hello[:32])); i >= 0 && 32+i+specMarkLength+specMACLength <= len(hello) {
+				markAt = 32 + i
+			}
+		}
+	}
+	end := markAt + specMarkLength
+	// Bridges accept the epoch hours next to their own
+	var epochHour []byte
+	now := time.Now().Unix() / 3600
+	for _, hour := range []int64{now, now - 1, now + 1} {
+		candidate := []byte(strconv.FormatInt(hour, 10))
+		if hmac.Equal(b.mac(hello[:end], candidate), hello[end:end+specMACLength]) {
+			epochHour = candidate
+		}
+	}
+	if epochHour == nil {
+		return nil, errors.New("client MAC mismatch")
+	}
+	if end+specMACLength != len(hello) {
+		return nil, errors.New("client wrote before the handshake completed")
+	}
+	clientPublic := elligatorDecode(hello[:32])
+
+	var y, serverPublic, representative []byte
+	for representative == nil {
+		y = make([]byte, 32)
+		rand.Read(y)
+		serverPublic, _ = curve25519.X25519(y, curve25519.Basepoint)
+		representative, _ = elligatorEncode(serverPublic)
+	}
+	// secret_input = EXP(X,y) | EXP(X,b) | B | B | X | Y | PROTOID | ID, as
+	// obfs4proxy writes B where Tor's ntor has ID
+	xy, _ := curve25519.X25519(y, clientPublic)
+	xb, _ := curve25519.X25519(b.private, clientPublic)
+	suffix := bytes.Join([][]byte{b.public, b.public, clientPublic, serverPublic, []byte(specNtorProtoID), b.nodeID[:]}, nil)
+	secretInput := bytes.Join([][]byte{xy, xb, suffix}, nil)
+	tag := func(label string, data ...[]byte) []byte {
+		h := hmac.New(sha256.New, []byte(specNtorProtoID+label))
+		for _, part := range data {
+			h.Write(part)
+		}
+		return h.Sum(nil)
+	}
+	keySeed := tag(":key_extract", secretInput)
+	auth := tag(":mac", tag(":key_verify", secretInput), suffix, []byte("Server"))
+
+	padding := make([]byte, 1+int(representative[0])%200)
+	rand.Read(padding)
+	response := bytes.Join([][]byte{representative, auth, padding, b.mac(representative)}, nil)
+	response = append(response, b.mac(response, epochHour)...)
+	clientCipher, bridgeCipher := newFrameCiphers(keySeed)
+	seed := make([]byte, 24)
+	rand.Read(seed)
+	if _, err := conn.Write(append(response, bridgeCipher.seal(specPacketPRNGSeed, seed)...)); err != nil {
+		return nil, err
+	}
+	return &bridgeStream{Conn: conn, reader: reader, send: bridgeCipher, receive: clientCipher}, nil
+}
+
+// bridgeStream is the stream of a client at the bridge
+type bridgeStream struct {
+	net.Conn
+	reader  io.Reader
+	send    *frameCipher
+	receive *frameCipher
+	pending []byte
+}
+
+func (s *bridgeStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		packetType, payload, err := s.receive.open(s.reader)
+		if err != nil {
+			return 0, err
+		}
+		if packetType == specPacketPayload {
+			s.pending = payload
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *bridgeStream) Write(p []byte) (int, error) {
+	var frames []byte
+	for rest := p; len(rest) > 0; {
+		chunk := rest[:min(len(rest), specMaxPacket)]
+		rest = rest[len(chunk):]
+		frames = append(frames, s.send.seal(specPacketPayload, chunk)...)
+	}
+	if _, err := s.Conn.Write(frames); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func TestObfs4(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		iatMode int
+		// Holds another private key than the bridge line names
+		impostor bool
+	}{
+		{"iat-none", IATNone, false},
+		{"iat-enabled", IATEnabled, false},
+		{"iat-paranoid", IATParanoid, false},
+		{"impostor", IATNone, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bridge, serving := newBridgeServer(), newBridgeServer()
+			if test.impostor {
+				serving.nodeID, serving.public = bridge.nodeID, bridge.public
+			} else {
+				serving = bridge
+			}
+			network := &testkit.Network{}
+			transcripts := make(chan *testkit.Transcript, 1)
+			listener, err := network.Serve("bridge.example:443", func(conn net.Conn) {
+				stream, err := serving.handshake(conn)
+				if err != nil {
+					return
+				}
+				transcript := testkit.Record(stream)
+				if _, err := testkit.AcceptSOCKS5(transcript); err != nil {
+					return
+				}
+				transcripts <- transcript
+				testkit.Echo(stream)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			outbound, _, err := testkit.NewOutbound(testkit.Context(context.Background(), network, nil), nil, NewOutbound, "obfs4-out", Obfs4Options{
+				Server:    "bridge.example",
+				Port:      443,
+				NodeID:    hex.EncodeToString(bridge.nodeID[:]),
+				PublicKey: hex.EncodeToString(bridge.public),
+				IATMode:   test.iatMode,
+				Username:  "user",
+				Password:  "secret",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := outbound.DialContext(ctx, "tcp", metadata.ParseSocksaddrHostPort("example.com", 443))
+			if test.impostor {
+				var typed *failure.Error
+				if !errors.As(err, &typed) || typed.Stage != failure.StageHandshake || typed.Kind != failure.KindAuthFailed {
+					t.Fatalf("dial error = %v, want a handshake failure of kind %s", err, failure.KindAuthFailed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := (<-transcripts).Golden(filepath.Join("testdata", "socks5-auth.golden")); err != nil {
+				t.Fatal(err)
+			}
+			// Larger than a frame, so the stream spans several
+			message := make([]byte, 3*specMaxPacket+100)
+			rand.Read(message)
+			if _, err := conn.Write(message); err != nil {
+				t.Fatal(err)
+			}
+			echo := make([]byte, len(message))
+			if _, err := io.ReadFull(conn, echo); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(echo, message) {
+				t.Fatal("echo differs from the message")
+			}
+		})
+	}
+}
@@ -2,30 +2,299 @@ package psiphon
 
 import (
 	"context"
-	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/sagernet/sing-box/adapter"
 	C "github.com/sagernet/sing-box/constant"
 	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing-box/option"
 	"github.com/sagernet/sing/common/metadata"
 	"golang.org/x/crypto/ssh"
+
+	"github.com/UTPBox/utp-core/internal/blacklist"
+	"github.com/UTPBox/utp-core/internal/captive"
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/hostkey"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/session"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+	"github.com/UTPBox/utp-core/internal/tenant"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
 )
 
-var _ adapter.Outbound = (*Outbound)(nil)
+var (
+	_ adapter.Outbound = (*Outbound)(nil)
+	_ session.Migrator = (*Outbound)(nil)
+)
 
 type Outbound struct {
-	tag  string
-	opts PsiphonOptions
+	tag       string
+	opts      PsiphonOptions
+	logger    log.ContextLogger
+	endpoints []*endpoint
+	current   atomic.Uint32
+	overrides *headers.Overrides
+	hostKeys  *hostkey.Verifier // Servers without a host key in their entry
+	limiter   *limiter.Limiter
+	guard     *dnsguard.Guard
+	dialer    *netdial.Outbound
+	captive   *captive.Detector
+	blacklist *blacklist.List
+	sessions  *sessionManager
+	migration string
+}
+
+// endpoint is one Psiphon server the outbound can connect to
+type endpoint struct {
+	server    string
+	port      int
+	username  string
+	password  string
+	hostKey   ssh.PublicKey
+	region    string
+	tlsConfig *tlsconfig.Config
+	meek      *meekServer // Set when reached through a fronting CDN
 }
 
 // NewOutbound creates a new Psiphon outbound
 func NewOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts PsiphonOptions) (adapter.Outbound, error) {
-	return &Outbound{
-		tag:  tag,
-		opts: opts,
-	}, nil
+	if opts.TLS == nil && opts.UseTLS {
+		// Legacy use_tls carries no trust anchor, so it stays unverified
+		logger.Warn("psiphon[", tag, "]: use_tls does not verify the server certificate, configure tls.pin_sha256 or tls.certificate instead")
+	}
+
+	switch opts.Transport {
+	case TransportConnect, TransportFrontedMeek:
+	default:
+		return nil, fmt.Errorf("psiphon: unknown transport: %s", opts.Transport)
+	}
+	meekMode := opts.Transport == TransportFrontedMeek
+	if err := validateNames(opts); err != nil {
+		return nil, fmt.Errorf("psiphon: %w", err)
+	}
+
+	// 1. Collect endpoints: the static server first, then server entries
+	var endpoints []*endpoint
+	if opts.Server != "" || (meekMode && opts.Meek != nil) {
+		ep := &endpoint{
+			server:   opts.Server,
+			port:     opts.Port,
+			username: opts.Username,
+			password: opts.Password,
+		}
+		if meekMode {
+			meek, err := newMeekServer(nil, opts.Meek, opts.HostHeader)
+			if err != nil {
+				return nil, err
+			}
+			ep.meek = meek
+			if ep.server == "" {
+				ep.server = meek.host
+			}
+		}
+		endpoints = append(endpoints, ep)
+	}
+	if opts.ServerEntryList != "" || len(opts.ServerEntries) > 0 {
+		entries, err := DecodeServerEntryList(opts.ServerEntryList, opts.ServerEntries)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ep, err := endpointFromEntry(entry, opts)
+			if err != nil {
+				logger.Debug("psiphon[", tag, "]: skipping server entry ", entry.IPAddress, ": ", err)
+				continue
+			}
+			endpoints = append(endpoints, ep)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("psiphon: no usable server (set server or server entries with the SSH or FRONTED-MEEK capability)")
+	}
+
+	// 2. Prepare TLS per endpoint, since the SNI defaults to the server address
+	// or, with meek, to the front domain
+	for _, ep := range endpoints {
+		var tlsConfig *tlsconfig.Config
+		var err error
+		if ep.meek != nil {
+			tlsConfig, err = newMeekTLSConfig(ctx, opts, ep.meek)
+		} else {
+			tlsConfig, err = newTLSConfig(ctx, opts, ep.server)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ep.tlsConfig = tlsConfig
+	}
+
+	overrides, err := headers.Compile(opts.HeaderOverrides)
+	if err != nil {
+		return nil, err
+	}
+	// header_host also named the SNI of use_tls, so the Host is only resolved
+	// once TLS is prepared
+	if opts.HeaderHost, err = opts.Names.Host(opts.HeaderHost); err != nil {
+		return nil, fmt.Errorf("psiphon: %w", err)
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("psiphon: %w", err)
+	}
+	if err := validateSSH(opts.SSH); err != nil {
+		return nil, fmt.Errorf("psiphon: %w", err)
+	}
+	var hostKeyOptions hostkey.HostKeyOptions
+	if opts.SSH != nil {
+		hostKeyOptions = opts.SSH.HostKeyOptions
+	}
+	hostKeys, err := hostkey.New(ctx, hostKeyOptions)
+	if err != nil {
+		return nil, fmt.Errorf("psiphon: ssh: %w", err)
+	}
+	dialer, err := netdial.New(ctx, tag, opts.DialerOptions, opts.Marks)
+	if err != nil {
+		return nil, fmt.Errorf("psiphon: %w", err)
+	}
+	guard, err := dnsguard.New(ctx, opts.DNSGuard)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbound{
+		tag:       tag,
+		opts:      opts,
+		logger:    logger,
+		endpoints: endpoints,
+		overrides: overrides,
+		hostKeys:  hostKeys,
+		limiter:   limiter.New(opts.Options),
+		guard:     guard,
+		dialer:    dialer,
+		captive:   captive.New(opts.CaptivePortal),
+		blacklist: blacklist.ForContext(ctx),
+	}
+	o.sessions = newSessionManager(o, opts.PoolSize)
+
+	// 3. Take over SSH sessions from an identical outbound replaced by a reload
+	// Only options that identify the remote end decide whether sessions carry over
+	identity := opts
+	identity.Options = limiter.Options{}
+	identity.DNSGuard = dnsguard.Options{}
+	identity.CaptivePortal = captive.Options{}
+	identity.Marks = sockopt.Marks{}
+	identity.PoolSize = 0
+	o.migration = session.Key(tenant.Scope(ctx, "psiphon"), identity)
+	if previous, loaded := session.Adopt(o.migration); loaded {
+		if manager, ok := previous.(*sessionManager); ok {
+			o.sessions.adopt(manager)
+			logger.Info("psiphon[", tag, "]: reusing SSH sessions from previous configuration")
+		} else {
+			previous.Close()
+		}
+	}
+	return o, nil
+}
+
+// key identifies ep in the blacklist
+func (ep *endpoint) key() string {
+	return "psiphon/" + net.JoinHostPort(ep.server, strconv.Itoa(ep.port))
+}
+
+// endpointFromEntry converts a server entry into an endpoint. Only entries
+// offering plain SSH, or fronted meek in meek mode, can be used.
+func endpointFromEntry(entry *ServerEntry, opts PsiphonOptions) (*endpoint, error) {
+	if opts.Transport == TransportFrontedMeek {
+		if !entry.Has(CapabilityFrontedMeek) {
+			return nil, fmt.Errorf("no FRONTED-MEEK capability")
+		}
+	} else if !entry.Has(CapabilitySSH) || entry.SSHPort == 0 {
+		return nil, fmt.Errorf("no SSH capability")
+	}
+	if opts.Region != "" && !strings.EqualFold(entry.Region, opts.Region) {
+		return nil, fmt.Errorf("region %s excluded", entry.Region)
+	}
+	ep := &endpoint{
+		server:   entry.IPAddress,
+		port:     entry.SSHPort,
+		username: entry.SSHUsername,
+		password: entry.SSHPassword,
+		region:   entry.Region,
+	}
+	if opts.Transport == TransportFrontedMeek {
+		meek, err := newMeekServer(entry, opts.Meek, opts.HostHeader)
+		if err != nil {
+			return nil, err
+		}
+		ep.meek = meek
+	}
+	if entry.SSHHostKey != "" {
+		keyBytes, err := base64.StdEncoding.DecodeString(entry.SSHHostKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH host key: %w", err)
+		}
+		ep.hostKey, err = ssh.ParsePublicKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH host key: %w", err)
+		}
+	}
+	return ep, nil
+}
+
+// validateNames checks sni and host_header can be applied: the SNI (like
+// tls_fragment) needs TLS, and the meek Host must not be set twice
+func validateNames(opts PsiphonOptions) error {
+	if err := opts.Names.Validate(); err != nil {
+		return err
+	}
+	if (opts.SNI != "" || opts.TLSFragment.Enabled) && opts.Transport == TransportConnect && (opts.TLS == nil || !opts.TLS.Enabled) && !opts.UseTLS {
+		return fmt.Errorf("sni and tls_fragment require tls")
+	}
+	if opts.Transport == TransportFrontedMeek && opts.Meek != nil {
+		if _, err := opts.Names.Host(opts.Meek.Host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTLSConfig builds the TLS layer for one server, or nil without TLS
+func newTLSConfig(ctx context.Context, opts PsiphonOptions, server string) (*tlsconfig.Config, error) {
+	tlsOptions := opts.TLS
+	if tlsOptions == nil && opts.UseTLS {
+		tlsOptions = &tlsconfig.Options{
+			OutboundTLSOptions: option.OutboundTLSOptions{
+				Enabled:    true,
+				ServerName: firstNonEmpty(opts.SNI, opts.HeaderHost, server),
+				Insecure:   true,
+			},
+		}
+	}
+	if tlsOptions == nil || !tlsOptions.Enabled {
+		return nil, nil
+	}
+	options := *tlsOptions
+	serverName, err := opts.Names.ServerName(options.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	options.ServerName = serverName
+	if len(options.ALPN) == 0 {
+		// The HTTP handshake is HTTP/1.1, while browser fingerprints offer h2
+		options.ALPN = []string{"http/1.1"}
+	}
+	tlsConfig, err := tlsconfig.New(ctx, server, options)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig, tlsConfig.Fragment(opts.TLSFragment)
 }
 
 func (o *Outbound) Type() string {
@@ -37,91 +306,213 @@ func (o *Outbound) Tag() string {
 }
 
 func (o *Outbound) Dependencies() []string {
-	return nil
+	return o.opts.DialerOptions.Dependencies()
 }
 
 func (o *Outbound) Start() error {
 	return nil
 }
 
+// OfferSessions offers the SSH sessions to an identical outbound of the
+// instance started by a reload
+func (o *Outbound) OfferSessions() {
+	session.Offer(o.migration, o.sessions)
+}
+
 func (o *Outbound) Close() error {
-	return nil
+	if session.Reloading() {
+		session.Park(o.migration, o.sessions)
+		return nil
+	}
+	return o.sessions.Close()
 }
 
 func (o *Outbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
-	// 1. Dial base TCP connection to the Psiphon server
-	dialer := &net.Dialer{}
-	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("%s:%d", o.opts.Server, o.opts.Port))
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	sshClient, err := o.sessions.client(ctx, destination)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial server: %w", err)
+		release()
+		return nil, err
 	}
 
-	// 2. Wrap with TLS if configured
-	if o.opts.UseTLS {
-		tlsConfig := &tls.Config{
-			ServerName: o.opts.HeaderHost,
-			InsecureSkipVerify: true,
+	// 5. Dial target over a new channel of the shared session
+	targetAddr := destination.String()
+	proxyConn, err := sshClient.Dial(network, targetAddr)
+	if err != nil {
+		release()
+		return nil, failure.Report(ctx, o.tag, failure.Wrap(failure.StageTarget, fmt.Errorf("failed to dial target via SSH: %w", err)))
+	}
+	return limiter.WrapConn(proxyConn, release), nil
+}
+
+// ListenPacket relays UDP through a UDPGW service reached over the SSH session
+func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	sshClient, err := o.sessions.client(ctx, destination)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	udpgwAddr := o.opts.UDPGW
+	if udpgwAddr == "" {
+		udpgwAddr = defaultUDPGW
+	}
+	channel, err := sshClient.Dial("tcp", udpgwAddr)
+	if err != nil {
+		release()
+		return nil, failure.Report(ctx, o.tag, failure.Wrap(failure.StageTarget, fmt.Errorf("failed to open UDPGW channel: %w", err)))
+	}
+	lookup := func(name string) (netip.Addr, error) {
+		return lookupUDPGW(func() (net.Conn, error) {
+			return sshClient.Dial("tcp", udpgwAddr)
+		}, name)
+	}
+	return limiter.WrapPacketConn(newUDPGWConn(channel, lookup), release), nil
+}
+
+// connectAny tries each endpoint once, starting from the last one that
+// worked. Blacklisted endpoints are tried last.
+func (o *Outbound) connectAny(ctx context.Context, destination metadata.Socksaddr) (*ssh.Client, error) {
+	var lastErr error
+	start := o.current.Load()
+	indexes := make([]uint32, len(o.endpoints))
+	for attempt := range indexes {
+		indexes[attempt] = (start + uint32(attempt)) % uint32(len(o.endpoints))
+	}
+	indexes = blacklist.Demote(o.blacklist, indexes, func(index uint32) string {
+		return o.endpoints[index].key()
+	})
+	failed := make(map[*endpoint]error)
+	for _, index := range indexes {
+		ep := o.endpoints[index]
+		sshClient, err := o.connect(ctx, ep, destination)
+		if err == nil {
+			o.blacklist.Success(ep.key())
+			return sshClient, nil
 		}
-		if tlsConfig.ServerName == "" {
-			tlsConfig.ServerName = o.opts.Server
+		lastErr = err
+		failed[ep] = err
+		o.logger.Debug("psiphon[", o.tag, "]: server ", ep.server, ":", ep.port, " failed: ", err)
+		// Rotate to the next endpoint for subsequent dials
+		o.current.CompareAndSwap(index, (index+1)%uint32(len(o.endpoints)))
+		if ctx.Err() != nil || !failure.Retryable(failure.KindOf(err)) {
+			break
 		}
-		tlsConn := tls.Client(conn, tlsConfig)
-		if err := tlsConn.HandshakeContext(ctx); err != nil {
-			conn.Close()
-			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	// A portal makes every server look blocked, so check for one before
+	// reporting them down
+	if ctx.Err() == nil && failure.Transient(failure.KindOf(lastErr)) {
+		if portal, detected := o.captive.Check(ctx); detected {
+			o.logger.Warn("psiphon[", o.tag, "]: ", portal.Err(), ", pausing reconnects until connectivity returns")
+			lastErr = failure.New(failure.KindCaptivePortal, failure.StageConnect, portal.Err())
+			failed = nil
+		}
+	}
+	if ctx.Err() == nil {
+		for ep, err := range failed {
+			if ban := o.blacklist.Failure(ep.key(), err); ban > 0 {
+				o.logger.Info("psiphon[", o.tag, "]: server ", ep.server, ":", ep.port, " keeps failing, trying it last for ", ban)
+			}
 		}
-		conn = tlsConn
 	}
+	return nil, failure.Report(ctx, o.tag, lastErr)
+}
 
-	// 3. Perform HTTP Handshake
-	if err := doHTTPHandshake(conn, o.opts); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("HTTP handshake failed: %w", err)
+// connect establishes an authenticated SSH client to ep
+func (o *Outbound) connect(ctx context.Context, ep *endpoint, destination metadata.Socksaddr) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if ep.meek != nil {
+		conn, err = o.dialMeek(ep)
+	} else {
+		conn, err = o.dialConnect(ctx, ep, destination)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	// 4. Establish SSH Session
 	sshConfig := &ssh.ClientConfig{
-		User: o.opts.Username,
+		User: ep.username,
 		Auth: []ssh.AuthMethod{
-			ssh.Password(o.opts.Password),
+			ssh.Password(ep.password),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         C.TCPTimeout,
+		Timeout:       C.TCPTimeout,
+		ClientVersion: clientVersion(o.opts.SSH),
+	}
+	// The key of a server entry is authoritative for its server
+	if ep.hostKey != nil {
+		sshConfig.HostKeyCallback = ssh.FixedHostKey(ep.hostKey)
+	} else {
+		o.hostKeys.Configure(sshConfig)
 	}
 
-	// Establish SSH connection
-	sshConn, channels, reqs, err := ssh.NewClientConn(conn, o.opts.Server, sshConfig)
+	// Establish SSH connection, pacing the handshake when configured
+	paced, handshakeDone := paceHandshake(conn, o.opts.SSH)
+	sshConn, channels, reqs, err := ssh.NewClientConn(paced, net.JoinHostPort(ep.server, strconv.Itoa(ep.port)), sshConfig)
+	handshakeDone()
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("SSH connection failed: %w", err)
+		return nil, failure.Wrap(failure.StageAuth, fmt.Errorf("SSH connection failed: %w", err))
 	}
 
 	// Create SSH client
-	sshClient := ssh.NewClient(sshConn, channels, reqs)
+	return ssh.NewClient(sshConn, channels, reqs), nil
+}
 
-	// 5. Dial target
-	targetAddr := destination.String()
-	proxyConn, err := sshClient.Dial(network, targetAddr)
+// dialConnect reaches ep with an HTTP CONNECT handshake, optionally over TLS
+func (o *Outbound) dialConnect(ctx context.Context, ep *endpoint, destination metadata.Socksaddr) (net.Conn, error) {
+	// 1. Dial base TCP connection to the Psiphon server
+	// Resolved addresses are checked against poisoning ranges when configured.
+	// SSH sessions are shared by connections, so only outbound QoS rules apply.
+	conn, err := o.guard.DialContext(ctx, o.dialer.For(nil), "tcp", ep.server, ep.port)
 	if err != nil {
-		sshClient.Close()
-		return nil, fmt.Errorf("failed to dial target via SSH: %w", err)
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to dial server: %w", err))
 	}
 
-	return proxyConn, nil
-}
+	// 2. Wrap with TLS if configured
+	if ep.tlsConfig != nil {
+		tlsConn, err := ep.tlsConfig.Handshake(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, failure.Wrap(failure.StageTLS, fmt.Errorf("TLS handshake failed: %w", err))
+		}
+		conn = tlsConn
+	}
 
-func (o *Outbound) DialPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
-	return nil, fmt.Errorf("UDP not supported in this basic Psiphon implementation")
+	// 3. Perform HTTP Handshake
+	if err := doHTTPHandshake(conn, ep.server, ep.port, o.opts.HeaderHost, o.overrides.Match(destination)); err != nil {
+		conn.Close()
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("HTTP handshake failed: %w", err))
+	}
+	return conn, nil
 }
 
-// Implement ListenPacket to satisfy interface
-func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
-	// Usually used for inbound UDP connection handling? 
-	// Or maybe for specific reverse tunneling?
-	return nil, fmt.Errorf("ListenPacket not supported in Psiphon output")
+// dialMeek reaches ep through its fronting CDN. Meek servers expect the SSH
+// stream to be OSSH obfuscated when a keyword is known.
+func (o *Outbound) dialMeek(ep *endpoint) (net.Conn, error) {
+	conn, err := dialMeek(ep, o.guard, o.dialer.For(nil))
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, err)
+	}
+	if ep.meek.sshObfuscatedKey == "" {
+		return conn, nil
+	}
+	obfuscated, err := newObfuscatedConn(conn, ep.meek.sshObfuscatedKey)
+	if err != nil {
+		conn.Close()
+		return nil, failure.Wrap(failure.StageHandshake, err)
+	}
+	return obfuscated, nil
 }
 
 // Implement Network() method
 func (o *Outbound) Network() []string {
-	return []string{"tcp"}
+	return []string{"tcp", "udp"}
 }
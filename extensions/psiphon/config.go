@@ -1,5 +1,19 @@
 package psiphon
 
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/captive"
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/fronting"
+	"github.com/UTPBox/utp-core/internal/headers"
+	"github.com/UTPBox/utp-core/internal/hostkey"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
 // PsiphonOptions defines the configuration for the Psiphon outbound protocol
 type PsiphonOptions struct {
 	Server     string `json:"server"`      // Server hostname or IP
@@ -9,4 +23,57 @@ type PsiphonOptions struct {
 	UseTLS     bool   `json:"use_tls"`     // Enable TLS wrapping
 	HeaderHost string `json:"header_host"` // Optional HTTP Host header
 	Obfuscate  bool   `json:"obfuscate"`   // Enable additional obfuscation (placeholder)
+
+	ServerEntries   []string `json:"server_entries,omitempty"`    // Psiphon server entries (hex or base64), tried after server
+	ServerEntryList string   `json:"server_entry_list,omitempty"` // Base64 server list with one encoded entry per line
+	Region          string   `json:"region,omitempty"`            // Only use server entries in this region (e.g. "US")
+	UDPGW           string   `json:"udpgw,omitempty"`             // UDPGW address on the server side (default 127.0.0.1:7300)
+	PoolSize        int      `json:"pool_size,omitempty"`         // SSH sessions kept alive and shared by all streams (default 1)
+
+	Transport string       `json:"transport,omitempty"` // "" (HTTP CONNECT) or "fronted-meek"
+	Meek      *MeekOptions `json:"meek,omitempty"`      // Fronted meek settings, used with transport "fronted-meek"
+
+	TLS             *tlsconfig.Options        `json:"tls,omitempty"`              // Shared TLS layer (REALITY, uTLS); takes precedence over use_tls
+	TLSFragment     tlsconfig.FragmentOptions `json:"tls_fragment,omitempty"`     // Split the ClientHello into TCP segments
+	HeaderOverrides []headers.OverrideRule    `json:"header_overrides,omitempty"` // Per-destination handshake headers, first match wins
+	SSH             *SSHOptions               `json:"ssh,omitempty"`              // Banner, handshake timing and host key verification of the SSH sessions
+
+	DNSGuard      dnsguard.Options `json:"dns_guard,omitempty"`      // Reject poisoned server addresses and re-resolve securely
+	CaptivePortal captive.Options  `json:"captive_portal,omitempty"` // Detect captive portals before reporting servers down
+
+	fronting.Names        // sni / host_header: SNI of every TLS handshake, Host of the CONNECT request or of meek polls
+	limiter.Options       // max_connections / max_pending_dials
+	sockopt.Marks         // dscp / tos / socket_priority
+	netdial.DialerOptions // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+}
+
+// Transports supported by the Psiphon outbound
+const (
+	TransportConnect     = ""
+	TransportFrontedMeek = "fronted-meek"
+)
+
+// SSHOptions disguise the SSH handshake, whose banner and timing are
+// visible when the transport does not obfuscate it, and verify the servers
+// whose server entries carry no host key
+type SSHOptions struct {
+	ClientVersion   string             `json:"client_version,omitempty"`   // "openssh" for a random OpenSSH 9.x banner per session, or a literal SSH-2.0- banner (default: SSH-2.0-Go)
+	BannerDelay     badoption.Duration `json:"banner_delay,omitempty"`     // Wait before sending the banner
+	BannerJitter    badoption.Duration `json:"banner_jitter,omitempty"`    // Random extra wait before the banner in [0, jitter)
+	HandshakeJitter badoption.Duration `json:"handshake_jitter,omitempty"` // Random wait before each later handshake packet in [0, jitter)
+
+	hostkey.HostKeyOptions // host_key / host_key_algorithms / known_hosts_path / trust_on_first_use
+}
+
+// MeekOptions configures the fronted meek transport. Server entries with the
+// FRONTED-MEEK capability carry these values themselves; options set here
+// take precedence for the static server and the front domain.
+type MeekOptions struct {
+	FrontDomain      string `json:"front_domain"`                 // CDN domain used for SNI and DNS
+	FrontAddress     string `json:"front_address,omitempty"`      // Address actually dialed (default: front_domain)
+	FrontPort        int    `json:"front_port,omitempty"`         // CDN port (default 443)
+	Host             string `json:"host"`                         // HTTP Host header routed by the CDN to the meek server
+	CookiePublicKey  string `json:"cookie_public_key"`            // Base64 NaCl key encrypting the session cookie
+	ObfuscatedKey    string `json:"obfuscated_key,omitempty"`     // Keyword obfuscating the session cookie
+	SSHObfuscatedKey string `json:"ssh_obfuscated_key,omitempty"` // OSSH keyword for the tunnelled SSH stream
 }
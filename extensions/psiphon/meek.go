@@ -0,0 +1,381 @@
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// Meek protocol parameters, following the Psiphon meek client
+const (
+	meekProtocolVersion  = 3
+	meekTunnelProtocol   = "FRONTED-MEEK-OSSH"
+	meekCookieMaxPadding = 32
+	meekMaxPayloadLength = 0x10000
+	meekMinPollInterval  = 100 * time.Millisecond
+	meekMaxPollInterval  = 5 * time.Second
+	meekPollMultiplier   = 1.5
+	meekRoundTripRetries = 3
+	meekRoundTripTimeout = 20 * time.Second
+	meekDefaultFrontPort = 443
+	meekRetryDelay       = 100 * time.Millisecond
+)
+
+// meekServer is how an endpoint is reached through a fronting CDN
+type meekServer struct {
+	frontDomain      string
+	frontAddress     string
+	frontPort        int
+	host             string
+	cookieKey        [32]byte
+	obfuscatedKey    string
+	sshObfuscatedKey string
+}
+
+// newMeekServer merges the meek settings of a server entry (may be nil)
+// with the configured options (may be nil). hostHeader, when set, replaces
+// the Host of both.
+func newMeekServer(entry *ServerEntry, opts *MeekOptions, hostHeader string) (*meekServer, error) {
+	m := &meekServer{frontPort: meekDefaultFrontPort}
+	var cookieKey string
+	if entry != nil {
+		m.frontDomain = entry.MeekFrontingDomain
+		if len(entry.MeekFrontingAddresses) > 0 {
+			m.frontAddress = entry.MeekFrontingAddresses[0]
+		}
+		m.host = entry.MeekFrontingHost
+		cookieKey = entry.MeekCookieEncryptionPublicKey
+		m.obfuscatedKey = entry.MeekObfuscatedKey
+		m.sshObfuscatedKey = entry.SSHObfuscatedKey
+	}
+	if opts != nil {
+		m.frontDomain = firstNonEmpty(opts.FrontDomain, m.frontDomain)
+		m.frontAddress = firstNonEmpty(opts.FrontAddress, m.frontAddress)
+		m.host = firstNonEmpty(opts.Host, m.host)
+		cookieKey = firstNonEmpty(opts.CookiePublicKey, cookieKey)
+		m.obfuscatedKey = firstNonEmpty(opts.ObfuscatedKey, m.obfuscatedKey)
+		m.sshObfuscatedKey = firstNonEmpty(opts.SSHObfuscatedKey, m.sshObfuscatedKey)
+		if opts.FrontPort != 0 {
+			m.frontPort = opts.FrontPort
+		}
+	}
+	m.host = firstNonEmpty(hostHeader, m.host)
+	if m.frontDomain == "" || m.host == "" {
+		return nil, fmt.Errorf("meek: front_domain and host are required")
+	}
+	if m.frontAddress == "" {
+		m.frontAddress = m.frontDomain
+	}
+	key, err := base64.StdEncoding.DecodeString(cookieKey)
+	if err != nil || len(key) != len(m.cookieKey) {
+		return nil, fmt.Errorf("meek: invalid cookie_public_key")
+	}
+	copy(m.cookieKey[:], key)
+	return m, nil
+}
+
+// meekCookieData is the session information sealed into the first cookie
+type meekCookieData struct {
+	MeekProtocolVersion  int    `json:"v"`
+	ClientTunnelProtocol string `json:"t"`
+	EndPoint             string `json:"e,omitempty"`
+}
+
+// makeMeekCookie seals the session information for the meek server with an
+// ephemeral NaCl key, obfuscates it and stores it under a random name
+func makeMeekCookie(m *meekServer) (*http.Cookie, error) {
+	data, err := json.Marshal(meekCookieData{
+		MeekProtocolVersion:  meekProtocolVersion,
+		ClientTunnelProtocol: meekTunnelProtocol,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPublic, ephemeralPrivate, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	sealed := box.Seal(slices.Clone(ephemeralPublic[:]), data, &nonce, &m.cookieKey, ephemeralPrivate)
+
+	o, err := newObfuscator(m.obfuscatedKey, meekCookieMaxPadding, false)
+	if err != nil {
+		return nil, err
+	}
+	o.clientToServer.XORKeyStream(sealed, sealed)
+	value := append(slices.Clone(o.seedMessage), sealed...)
+
+	letter, err := rand.Int(rand.Reader, big.NewInt(26))
+	if err != nil {
+		return nil, err
+	}
+	return &http.Cookie{
+		Name:  string(rune('A' + letter.Int64())),
+		Value: base64.StdEncoding.EncodeToString(value),
+	}, nil
+}
+
+// meekConn carries a stream over HTTPS POST requests. Each request uploads
+// pending bytes and its response body carries downstream bytes; when idle,
+// the connection polls with an increasing interval. The first request sends
+// the sealed session cookie, later requests the session ID cookie returned
+// by the server.
+type meekConn struct {
+	client *http.Client
+	url    string
+	host   string
+
+	access  sync.Mutex
+	cond    *sync.Cond
+	cookie  *http.Cookie
+	pending []byte
+	closed  bool
+	signal  chan struct{}
+
+	reader *io.PipeReader
+	writer *io.PipeWriter
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// dialMeek opens a meek session to ep, reaching the front with dialer. TLS
+// is always used towards the front.
+func dialMeek(ep *endpoint, guard *dnsguard.Guard, dialer netdial.Dialer) (net.Conn, error) {
+	m := ep.meek
+	cookie, err := makeMeekCookie(m)
+	if err != nil {
+		return nil, fmt.Errorf("meek: failed to create cookie: %w", err)
+	}
+	transport := &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := guard.DialContext(ctx, dialer, "tcp", m.frontAddress, m.frontPort)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn, err := ep.tlsConfig.Handshake(ctx, conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     meekMaxPollInterval * 2,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	c := &meekConn{
+		client: &http.Client{Transport: transport, Timeout: meekRoundTripTimeout},
+		url:    "https://" + net.JoinHostPort(m.frontDomain, strconv.Itoa(m.frontPort)) + "/",
+		host:   m.host,
+		cookie: cookie,
+		signal: make(chan struct{}, 1),
+		reader: reader,
+		writer: writer,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	c.cond = sync.NewCond(&c.access)
+	go c.relay()
+	return c, nil
+}
+
+func (c *meekConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Write queues b for the next request, blocking while a full payload is
+// already waiting
+func (c *meekConn) Write(b []byte) (int, error) {
+	c.access.Lock()
+	for len(c.pending) >= meekMaxPayloadLength && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		c.access.Unlock()
+		return 0, net.ErrClosed
+	}
+	c.pending = append(c.pending, b...)
+	c.access.Unlock()
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+func (c *meekConn) Close() error {
+	c.closeWithError(net.ErrClosed)
+	return nil
+}
+
+func (c *meekConn) closeWithError(err error) {
+	c.access.Lock()
+	if c.closed {
+		c.access.Unlock()
+		return
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	c.access.Unlock()
+	c.cancel()
+	c.writer.CloseWithError(err)
+	c.client.CloseIdleConnections()
+}
+
+// relay sends pending data and polls for downstream data until closed
+func (c *meekConn) relay() {
+	interval := time.Duration(0)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.signal:
+		case <-timer.C:
+		case <-c.ctx.Done():
+			return
+		}
+		payload := c.takePending()
+		received, err := c.roundTrip(payload)
+		if err != nil {
+			c.closeWithError(fmt.Errorf("meek: %w", err))
+			return
+		}
+		switch {
+		case received > 0:
+			interval = 0
+		case len(payload) > 0:
+			interval = meekMinPollInterval
+		default:
+			interval = min(max(time.Duration(float64(interval)*meekPollMultiplier), meekMinPollInterval), meekMaxPollInterval)
+		}
+		timer.Reset(interval)
+	}
+}
+
+func (c *meekConn) takePending() []byte {
+	c.access.Lock()
+	defer c.access.Unlock()
+	n := min(len(c.pending), meekMaxPayloadLength)
+	payload := slices.Clone(c.pending[:n])
+	c.pending = c.pending[n:]
+	c.cond.Broadcast()
+	return payload
+}
+
+// roundTrip uploads payload, retrying requests that fail before any
+// downstream data was received
+func (c *meekConn) roundTrip(payload []byte) (int64, error) {
+	var lastErr error
+	for attempt := 0; attempt < meekRoundTripRetries; attempt++ {
+		response, err := c.post(payload)
+		if err == nil {
+			defer response.Body.Close()
+			return io.Copy(c.writer, response.Body)
+		}
+		lastErr = err
+		select {
+		case <-time.After(meekRetryDelay << attempt):
+		case <-c.ctx.Done():
+			return 0, c.ctx.Err()
+		}
+	}
+	return 0, lastErr
+}
+
+func (c *meekConn) post(payload []byte) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	request.Host = c.host
+	request.Header.Set("Content-Type", "application/octet-stream")
+	c.access.Lock()
+	request.AddCookie(c.cookie)
+	c.access.Unlock()
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+	// The server replaces the sealed cookie with a session ID
+	if cookies := response.Cookies(); len(cookies) > 0 {
+		c.access.Lock()
+		c.cookie = &http.Cookie{Name: cookies[0].Name, Value: cookies[0].Value}
+		c.access.Unlock()
+	}
+	return response, nil
+}
+
+func (c *meekConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *meekConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (c *meekConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *meekConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *meekConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// newMeekTLSConfig prepares TLS towards the front. Without a tls object the
+// CDN certificate is verified against the system roots for front_domain.
+func newMeekTLSConfig(ctx context.Context, opts PsiphonOptions, m *meekServer) (*tlsconfig.Config, error) {
+	tlsOptions := tlsconfig.Options{}
+	if opts.TLS != nil {
+		tlsOptions = *opts.TLS
+	}
+	tlsOptions.Enabled = true
+	serverName, err := opts.Names.ServerName(tlsOptions.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	tlsOptions.ServerName = firstNonEmpty(serverName, m.frontDomain)
+	if len(tlsOptions.ALPN) == 0 {
+		// Meek polls over HTTP/1.1, while browser fingerprints offer h2
+		tlsOptions.ALPN = []string{"http/1.1"}
+	}
+	tlsConfig, err := tlsconfig.New(ctx, m.frontDomain, tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConfig, tlsConfig.Fragment(opts.TLSFragment)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
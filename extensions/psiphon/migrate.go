@@ -0,0 +1,27 @@
+package psiphon
+
+import (
+	"github.com/sagernet/sing-box/option"
+
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// Migrate rewrites deprecated fields into their current form and reports
+// whether anything changed. The legacy use_tls flag becomes an equivalent
+// (unverified) tls object, using sni or header_host as the server name.
+func (o *PsiphonOptions) Migrate() bool {
+	if !o.UseTLS {
+		return false
+	}
+	if o.TLS == nil {
+		o.TLS = &tlsconfig.Options{
+			OutboundTLSOptions: option.OutboundTLSOptions{
+				Enabled:    true,
+				ServerName: firstNonEmpty(o.SNI, o.HeaderHost),
+				Insecure:   true,
+			},
+		}
+	}
+	o.UseTLS = false
+	return true
+}
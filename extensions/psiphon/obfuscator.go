@@ -0,0 +1,139 @@
+package psiphon
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+
+	"github.com/UTPBox/utp-core/internal/shaping"
+)
+
+// Obfuscated SSH (OSSH) parameters, shared with Psiphon servers
+const (
+	obfuscateSeedLength     = 16
+	obfuscateKeyLength      = 16
+	obfuscateHashIterations = 6000
+	obfuscateMagicValue     = 0x0BF5CA7E
+	obfuscateMaxPadding     = 8192
+)
+
+// obfuscator implements the client side of the OSSH stream obfuscation. The
+// client sends a random seed followed by an encrypted magic value and
+// padding; both directions are then RC4 encrypted with keys derived from
+// the seed and the shared keyword.
+type obfuscator struct {
+	seedMessage    []byte
+	clientToServer *rc4.Cipher
+	serverToClient *rc4.Cipher
+}
+
+// newObfuscator draws up to maxPadding bytes of padding. When the seed
+// message opens the connection, the first-flight policy chooses its length.
+func newObfuscator(keyword string, maxPadding int, opening bool) (*obfuscator, error) {
+	seed := make([]byte, obfuscateSeedLength)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	clientToServer, err := rc4.NewCipher(deriveObfuscationKey(seed, keyword, "client_to_server"))
+	if err != nil {
+		return nil, err
+	}
+	serverToClient, err := rc4.NewCipher(deriveObfuscationKey(seed, keyword, "server_to_client"))
+	if err != nil {
+		return nil, err
+	}
+	paddingLength, shaped := shaping.Padding(obfuscateSeedLength+8, maxPadding)
+	if !opening || !shaped {
+		drawn, err := rand.Int(rand.Reader, big.NewInt(int64(maxPadding)+1))
+		if err != nil {
+			return nil, err
+		}
+		paddingLength = int(drawn.Int64())
+	}
+	padding := make([]byte, paddingLength)
+	if _, err := rand.Read(padding); err != nil {
+		return nil, err
+	}
+	message := make([]byte, 0, obfuscateSeedLength+8+len(padding))
+	message = append(message, seed...)
+	message = binary.BigEndian.AppendUint32(message, obfuscateMagicValue)
+	message = binary.BigEndian.AppendUint32(message, uint32(len(padding)))
+	message = append(message, padding...)
+	clientToServer.XORKeyStream(message[obfuscateSeedLength:], message[obfuscateSeedLength:])
+	return &obfuscator{
+		seedMessage:    message,
+		clientToServer: clientToServer,
+		serverToClient: serverToClient,
+	}, nil
+}
+
+// deriveObfuscationKey is the iterated SHA-1 key schedule of obfuscated-openssh
+func deriveObfuscationKey(seed []byte, keyword string, iv string) []byte {
+	h := sha1.New()
+	h.Write(seed)
+	h.Write([]byte(keyword))
+	h.Write([]byte(iv))
+	digest := h.Sum(nil)
+	for i := 0; i < obfuscateHashIterations; i++ {
+		h.Reset()
+		h.Write(digest)
+		digest = h.Sum(digest[:0])
+	}
+	return digest[:obfuscateKeyLength]
+}
+
+// obfuscatedConn wraps a stream in OSSH obfuscation. The seed message is
+// sent together with the first write.
+type obfuscatedConn struct {
+	net.Conn
+	obfuscator *obfuscator
+
+	writeAccess sync.Mutex
+	seedSent    bool
+	readAccess  sync.Mutex
+}
+
+func newObfuscatedConn(conn net.Conn, keyword string) (net.Conn, error) {
+	if keyword == "" {
+		return nil, fmt.Errorf("OSSH requires an obfuscation keyword")
+	}
+	o, err := newObfuscator(keyword, obfuscateMaxPadding, true)
+	if err != nil {
+		return nil, err
+	}
+	return &obfuscatedConn{Conn: conn, obfuscator: o}, nil
+}
+
+func (c *obfuscatedConn) Read(b []byte) (int, error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	n, err := c.Conn.Read(b)
+	c.obfuscator.serverToClient.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (c *obfuscatedConn) Write(b []byte) (int, error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	buffer := make([]byte, 0, len(c.obfuscator.seedMessage)+len(b))
+	if !c.seedSent {
+		buffer = append(buffer, c.obfuscator.seedMessage...)
+	}
+	prefix := len(buffer)
+	buffer = append(buffer, b...)
+	c.obfuscator.clientToServer.XORKeyStream(buffer[prefix:], buffer[prefix:])
+	if _, err := c.Conn.Write(buffer); err != nil {
+		return 0, err
+	}
+	c.seedSent = true
+	return len(b), nil
+}
+
+func (c *obfuscatedConn) Upstream() any {
+	return c.Conn
+}
@@ -0,0 +1,113 @@
+package psiphon
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Capabilities advertised in Psiphon server entries
+const (
+	CapabilitySSH           = "SSH"
+	CapabilityOSSH          = "OSSH"
+	CapabilityFrontedMeek   = "FRONTED-MEEK"
+	CapabilityUnfrontedMeek = "UNFRONTED-MEEK"
+)
+
+// ServerEntry is the subset of a Psiphon server entry used by this outbound
+type ServerEntry struct {
+	IPAddress                     string   `json:"ipAddress"`
+	Region                        string   `json:"region"`
+	SSHPort                       int      `json:"sshPort"`
+	SSHUsername                   string   `json:"sshUsername"`
+	SSHPassword                   string   `json:"sshPassword"`
+	SSHHostKey                    string   `json:"sshHostKey"`
+	SSHObfuscatedPort             int      `json:"sshObfuscatedPort"`
+	SSHObfuscatedKey              string   `json:"sshObfuscatedKey"`
+	Capabilities                  []string `json:"capabilities"`
+	MeekServerPort                int      `json:"meekServerPort"`
+	MeekFrontingDomain            string   `json:"meekFrontingDomain"`
+	MeekFrontingHost              string   `json:"meekFrontingHost"`
+	MeekFrontingAddresses         []string `json:"meekFrontingAddresses"`
+	MeekCookieEncryptionPublicKey string   `json:"meekCookieEncryptionPublicKey"`
+	MeekObfuscatedKey             string   `json:"meekObfuscatedKey"`
+
+	capabilities map[string]bool
+}
+
+// Has reports whether the entry advertises capability
+func (e *ServerEntry) Has(capability string) bool {
+	return e.capabilities[capability]
+}
+
+// DecodeServerEntry decodes one server entry. Entries are distributed
+// hex-encoded as "<ip> <web port> <web secret> <web cert> <json>"; a
+// base64 wrapping of that string is also accepted.
+func DecodeServerEntry(encoded string) (*ServerEntry, error) {
+	encoded = strings.TrimSpace(encoded)
+	raw, err := hex.DecodeString(encoded)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("server entry is neither hex nor base64")
+		}
+		if decoded, err := hex.DecodeString(strings.TrimSpace(string(raw))); err == nil {
+			raw = decoded
+		}
+	}
+	fields := strings.SplitN(string(raw), " ", 5)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("malformed server entry")
+	}
+	var entry ServerEntry
+	if err := json.Unmarshal([]byte(fields[4]), &entry); err != nil {
+		return nil, fmt.Errorf("malformed server entry JSON: %w", err)
+	}
+	if entry.IPAddress == "" {
+		entry.IPAddress = fields[0]
+	}
+	entry.capabilities = make(map[string]bool, len(entry.Capabilities))
+	for _, capability := range entry.Capabilities {
+		entry.capabilities[strings.ToUpper(capability)] = true
+	}
+	return &entry, nil
+}
+
+// DecodeServerEntryList decodes a base64 blob of newline separated entries
+// (the format of Psiphon server lists) and any individually listed entries.
+// Malformed entries are skipped; an error is returned only if none decode.
+func DecodeServerEntryList(list string, entries []string) ([]*ServerEntry, error) {
+	var encoded []string
+	if list != "" {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(list))
+		if err != nil {
+			return nil, fmt.Errorf("server_entry_list is not valid base64: %w", err)
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(raw)))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				encoded = append(encoded, line)
+			}
+		}
+	}
+	encoded = append(encoded, entries...)
+
+	var decoded []*ServerEntry
+	var lastErr error
+	for _, e := range encoded {
+		entry, err := DecodeServerEntry(e)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		decoded = append(decoded, entry)
+	}
+	if len(decoded) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return decoded, nil
+}
@@ -0,0 +1,48 @@
+package psiphon
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+const testEntryJSON = `{"ipAddress":"192.0.2.1","region":"US","sshPort":22,"sshObfuscatedPort":443,"sshObfuscatedKey":"key","capabilities":["SSH","ossh","FRONTED-MEEK"],"meekServerPort":80}`
+
+func testEntry() string {
+	return hex.EncodeToString([]byte("192.0.2.1 8080 secret cert " + testEntryJSON))
+}
+
+func TestDecodeServerEntry(t *testing.T) {
+	for _, encoded := range []string{testEntry(), base64.StdEncoding.EncodeToString([]byte(testEntry()))} {
+		entry, err := DecodeServerEntry(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.IPAddress != "192.0.2.1" || entry.SSHObfuscatedPort != 443 || !entry.Has(CapabilityOSSH) || entry.Has(CapabilityUnfrontedMeek) {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
+	}
+}
+
+func FuzzDecodeServerEntry(f *testing.F) {
+	f.Add(testEntry())
+	f.Add(base64.StdEncoding.EncodeToString([]byte(testEntry())))
+	f.Add(hex.EncodeToString([]byte("192.0.2.1 8080 secret cert {}")))
+	f.Add(hex.EncodeToString([]byte("192.0.2.1 8080 secret cert")))
+	f.Add("not an entry")
+	f.Fuzz(func(t *testing.T, encoded string) {
+		entry, err := DecodeServerEntry(encoded)
+		if err != nil {
+			if entry != nil {
+				t.Fatalf("entry returned with error %v", err)
+			}
+			return
+		}
+		for _, capability := range entry.Capabilities {
+			if !entry.Has(strings.ToUpper(capability)) {
+				t.Fatalf("capability %q of the entry is not reported", capability)
+			}
+		}
+	})
+}
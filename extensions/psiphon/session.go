@@ -0,0 +1,149 @@
+package psiphon
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+)
+
+const (
+	defaultPoolSize = 1
+	minBackoff      = time.Second
+	maxBackoff      = time.Minute
+)
+
+// sessionManager keeps authenticated SSH clients alive and multiplexes
+// streams over them, so each dial opens a channel instead of paying for a
+// fresh TCP+TLS+SSH handshake. Clients are grouped by the header override
+// that was active when they were established, since the HTTP handshake is
+// only sent once per session.
+type sessionManager struct {
+	outbound *Outbound
+	size     int
+
+	access   sync.Mutex
+	pools    map[int][]*ssh.Client
+	next     int
+	failures int
+	retryAt  time.Time
+	captive  bool // Reconnects paused by a captive portal
+}
+
+func newSessionManager(o *Outbound, size int) *sessionManager {
+	if size <= 0 {
+		size = defaultPoolSize
+	}
+	return &sessionManager{
+		outbound: o,
+		size:     size,
+		pools:    make(map[int][]*ssh.Client),
+	}
+}
+
+// client returns a live SSH client for destination, establishing a new one
+// when the pool is not full yet
+func (m *sessionManager) client(ctx context.Context, destination metadata.Socksaddr) (*ssh.Client, error) {
+	key := m.outbound.overrides.MatchIndex(destination)
+
+	m.access.Lock()
+	pool := m.pools[key]
+	if len(pool) >= m.size {
+		m.next++
+		client := pool[m.next%len(pool)]
+		m.access.Unlock()
+		return client, nil
+	}
+	// Fail fast behind a captive portal, and reconnect at once when it is gone
+	if portal, detected := m.outbound.captive.Detected(); detected {
+		m.captive = true
+		m.failures = 0
+		m.retryAt = time.Time{}
+		m.access.Unlock()
+		return nil, failure.New(failure.KindCaptivePortal, failure.StageConnect, portal.Err())
+	}
+	if m.captive {
+		m.captive = false
+		m.outbound.logger.Info("psiphon[", m.outbound.tag, "]: captive portal gone, reconnecting")
+	}
+	wait := time.Until(m.retryAt)
+	m.access.Unlock()
+
+	// Back off after consecutive failures so a dead network is not hammered
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, failure.New(failure.KindCanceled, failure.StageConnect, fmt.Errorf("waiting for reconnect backoff: %w", ctx.Err()))
+		}
+	}
+
+	client, err := m.outbound.connectAny(ctx, destination)
+
+	m.access.Lock()
+	defer m.access.Unlock()
+	if err != nil {
+		m.failures++
+		backoff := minBackoff << min(m.failures-1, 6)
+		m.retryAt = time.Now().Add(min(backoff, maxBackoff))
+		return nil, err
+	}
+	m.failures = 0
+	m.retryAt = time.Time{}
+	m.pools[key] = append(m.pools[key], client)
+	go m.watch(key, client)
+	return client, nil
+}
+
+// watch removes client from its pool once the session drops
+func (m *sessionManager) watch(key int, client *ssh.Client) {
+	client.Wait()
+	m.access.Lock()
+	defer m.access.Unlock()
+	pool := m.pools[key]
+	for i, c := range pool {
+		if c == client {
+			m.pools[key] = append(pool[:i:i], pool[i+1:]...)
+			break
+		}
+	}
+	m.outbound.logger.Debug("psiphon[", m.outbound.tag, "]: SSH session closed")
+}
+
+// Close closes every pooled client
+func (m *sessionManager) Close() error {
+	m.access.Lock()
+	pools := m.pools
+	m.pools = make(map[int][]*ssh.Client)
+	m.access.Unlock()
+	for _, pool := range pools {
+		for _, client := range pool {
+			client.Close()
+		}
+	}
+	return nil
+}
+
+// adopt takes over the clients of a manager from a previous instance
+func (m *sessionManager) adopt(previous *sessionManager) {
+	previous.access.Lock()
+	pools := previous.pools
+	previous.pools = make(map[int][]*ssh.Client)
+	previous.access.Unlock()
+
+	m.access.Lock()
+	defer m.access.Unlock()
+	for key, pool := range pools {
+		m.pools[key] = append(m.pools[key], pool...)
+		for _, client := range pool {
+			go m.watch(key, client)
+		}
+	}
+}
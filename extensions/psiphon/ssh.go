@@ -0,0 +1,100 @@
+package psiphon
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ClientVersionOpenSSH selects a random OpenSSH 9.x banner for every SSH
+// session
+const ClientVersionOpenSSH = "openssh"
+
+// openSSHVersions are banners of OpenSSH 9.x clients shipped by common
+// distributions
+var openSSHVersions = []string{
+	"SSH-2.0-OpenSSH_9.0p1 Ubuntu-1ubuntu8.7",
+	"SSH-2.0-OpenSSH_9.2p1 Debian-2+deb12u3",
+	"SSH-2.0-OpenSSH_9.3p1 Ubuntu-1ubuntu3.6",
+	"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13.5",
+	"SSH-2.0-OpenSSH_9.7",
+	"SSH-2.0-OpenSSH_9.8",
+	"SSH-2.0-OpenSSH_9.9",
+}
+
+// maxVersionLength is the longest identification string allowed by RFC
+// 4253, without CR LF
+const maxVersionLength = 253
+
+// validateSSH checks the SSH options
+func validateSSH(opts *SSHOptions) error {
+	if opts == nil {
+		return nil
+	}
+	version := opts.ClientVersion
+	if version != "" && version != ClientVersionOpenSSH {
+		if !strings.HasPrefix(version, "SSH-2.0-") || len(version) > maxVersionLength || strings.ContainsAny(version, "\r\n") {
+			return fmt.Errorf("ssh.client_version must be %q or a single-line SSH-2.0- banner of at most %d bytes", ClientVersionOpenSSH, maxVersionLength)
+		}
+	}
+	if opts.BannerDelay < 0 || opts.BannerJitter < 0 || opts.HandshakeJitter < 0 {
+		return fmt.Errorf("ssh delays must not be negative")
+	}
+	return nil
+}
+
+// clientVersion returns the banner of a new SSH session, "" for the default
+// of the Go SSH library
+func clientVersion(opts *SSHOptions) string {
+	if opts == nil {
+		return ""
+	}
+	if opts.ClientVersion == ClientVersionOpenSSH {
+		return openSSHVersions[rand.IntN(len(openSSHVersions))]
+	}
+	return opts.ClientVersion
+}
+
+// pacedConn delays the writes of an SSH handshake: the banner by
+// banner_delay plus up to banner_jitter, and the following packets by up to
+// handshake_jitter each. Writes are passed through once the handshake is
+// done.
+type pacedConn struct {
+	net.Conn
+	opts   *SSHOptions
+	banner bool
+	done   atomic.Bool
+}
+
+// paceHandshake returns conn delaying its handshake writes, or conn itself
+// when no delay is configured
+func paceHandshake(conn net.Conn, opts *SSHOptions) (net.Conn, func()) {
+	if opts == nil || (opts.BannerDelay == 0 && opts.BannerJitter == 0 && opts.HandshakeJitter == 0) {
+		return conn, func() {}
+	}
+	c := &pacedConn{Conn: conn, opts: opts}
+	return c, func() { c.done.Store(true) }
+}
+
+func (c *pacedConn) Write(b []byte) (int, error) {
+	if !c.done.Load() {
+		if !c.banner {
+			c.banner = true
+			time.Sleep(time.Duration(c.opts.BannerDelay) + jitter(time.Duration(c.opts.BannerJitter)))
+		} else {
+			time.Sleep(jitter(time.Duration(c.opts.HandshakeJitter)))
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// jitter returns a random duration in [0, limit)
+func jitter(limit time.Duration) time.Duration {
+	if limit <= 0 {
+		return 0
+	}
+	return rand.N(limit)
+}
@@ -4,19 +4,38 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/UTPBox/utp-core/internal/failure"
 )
 
-// doHTTPHandshake performs a Psiphon-style HTTP handshake
-func doHTTPHandshake(conn net.Conn, opts PsiphonOptions) error {
-	host := opts.HeaderHost
+// doHTTPHandshake performs a Psiphon-style HTTP handshake. Headers from a
+// matching header override are added to the request; a "Host" override
+// replaces header_host.
+func doHTTPHandshake(conn net.Conn, server string, port int, headerHost string, overrides http.Header) error {
+	host := headerHost
+	if override := overrides.Get("Host"); override != "" {
+		host = override
+	}
 	if host == "" {
-		host = opts.Server // Fallback to server address if no host header provided
+		host = server // Fallback to server address if no host header provided
 	}
 
 	// Construct HTTP CONNECT request
 	// Note: Psiphon often uses specific variations, this is a standard implementation
-	req := fmt.Sprintf("CONNECT %s:%d HTTP/1.1\r\nHost: %s\r\n\r\n",
-		opts.Server, opts.Port, host)
+	var extra strings.Builder
+	for key, values := range overrides {
+		if key == "Host" {
+			continue
+		}
+		for _, value := range values {
+			fmt.Fprintf(&extra, "%s: %s\r\n", key, value)
+		}
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n%s\r\n",
+		net.JoinHostPort(server, strconv.Itoa(port)), host, extra.String())
 
 	// Write request
 	_, err := conn.Write([]byte(req))
@@ -34,8 +53,29 @@ func doHTTPHandshake(conn net.Conn, opts PsiphonOptions) error {
 	// Check for success (200 OK)
 	// We look for "200" to be flexible with the exact status line text
 	if !bytes.Contains(buf[:n], []byte("200")) {
-		return fmt.Errorf("HTTP handshake failed, response: %s", string(buf[:n]))
+		err := fmt.Errorf("HTTP handshake failed, response: %s", string(buf[:n]))
+		switch statusCode(buf[:n]) {
+		case http.StatusProxyAuthRequired, http.StatusUnauthorized:
+			return failure.New(failure.KindAuthFailed, failure.StageHandshake, err)
+		case http.StatusTooManyRequests, http.StatusPaymentRequired:
+			return failure.New(failure.KindQuotaExceeded, failure.StageHandshake, err)
+		}
+		return err
 	}
 
 	return nil
 }
+
+// statusCode extracts the status code from an HTTP status line, or 0
+func statusCode(response []byte) int {
+	line, _, _ := bytes.Cut(response, []byte("\r\n"))
+	fields := bytes.Fields(line)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return 0
+	}
+	code, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0
+	}
+	return code
+}
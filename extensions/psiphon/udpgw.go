@@ -0,0 +1,363 @@
+package psiphon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// defaultUDPGW is where Psiphon servers run their UDPGW relay
+const defaultUDPGW = "127.0.0.1:7300"
+
+// UDPGW (badvpn-udpgw) message flags
+const (
+	udpgwFlagKeepalive = 0x01
+	udpgwFlagRebind    = 0x02
+	udpgwFlagDNS       = 0x04
+	udpgwFlagIPv6      = 0x08
+)
+
+const (
+	udpgwKeepaliveInterval = 10 * time.Second
+	// Remote addresses idle this long are forgotten, freeing their IDs
+	udpgwIdleTimeout = time.Minute
+	// maxUDPGWRemotes bounds the remote addresses of a conn, as servers
+	// bound the connections of a client (badvpn-udpgw defaults to 256). The
+	// least recently used is dropped beyond it.
+	maxUDPGWRemotes    = 256
+	udpgwLookupTimeout = 5 * time.Second
+)
+
+// udpgwResolver is the destination of lookups. Psiphon servers send
+// messages flagged DNS to their own resolver, whatever the address; it only
+// matters to UDPGW servers without transparent DNS.
+var udpgwResolver = netip.MustParseAddrPort("8.8.8.8:53")
+
+// udpgwConn carries datagrams over a single SSH channel using the UDPGW
+// framing: every message is a little-endian length followed by flags, a
+// connection ID, the remote address and the payload. Each remote address
+// gets its own connection ID. Domain names are resolved by the server's
+// resolver through lookup, so they never leave the tunnel.
+type udpgwConn struct {
+	stream net.Conn
+	lookup func(name string) (netip.Addr, error)
+
+	access  sync.Mutex
+	remotes map[netip.AddrPort]*udpgwRemote
+	ids     map[uint16]*udpgwRemote
+	names   map[string]netip.Addr
+	nextID  uint16
+
+	writeAccess sync.Mutex
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// udpgwRemote is a remote address with the connection ID it was given
+type udpgwRemote struct {
+	id       uint16
+	addr     netip.AddrPort
+	name     metadata.Socksaddr // Destination written to, a domain name or addr
+	lastUsed time.Time
+}
+
+func newUDPGWConn(stream net.Conn, lookup func(name string) (netip.Addr, error)) *udpgwConn {
+	c := &udpgwConn{
+		stream:  stream,
+		lookup:  lookup,
+		remotes: make(map[netip.AddrPort]*udpgwRemote),
+		ids:     make(map[uint16]*udpgwRemote),
+		names:   make(map[string]netip.Addr),
+		done:    make(chan struct{}),
+	}
+	go c.keepalive()
+	return c
+}
+
+func (c *udpgwConn) keepalive() {
+	ticker := time.NewTicker(udpgwKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writeMessage(udpgwFlagKeepalive, 0, netip.AddrPort{}, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// remote returns the connection ID of addr, and the flags of the message.
+// A new ID is sent with the rebind flag, so the server drops what it kept
+// for a previous address of the ID.
+func (c *udpgwConn) remote(addr netip.AddrPort, name metadata.Socksaddr) (uint16, byte) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	now := time.Now()
+	if r, loaded := c.remotes[addr]; loaded {
+		r.lastUsed = now
+		r.name = name
+		return r.id, 0
+	}
+	c.evict(now)
+	id := c.nextID + 1
+	for id == 0 || c.ids[id] != nil {
+		id++
+	}
+	c.nextID = id
+	r := &udpgwRemote{id: id, addr: addr, name: name, lastUsed: now}
+	c.remotes[addr] = r
+	c.ids[id] = r
+	return id, udpgwFlagRebind
+}
+
+// evict forgets idle remote addresses, and the least recently used one when
+// there are too many
+func (c *udpgwConn) evict(now time.Time) {
+	var oldest *udpgwRemote
+	for _, r := range c.remotes {
+		if now.Sub(r.lastUsed) >= udpgwIdleTimeout {
+			c.forget(r)
+		} else if oldest == nil || r.lastUsed.Before(oldest.lastUsed) {
+			oldest = r
+		}
+	}
+	if len(c.remotes) >= maxUDPGWRemotes {
+		c.forget(oldest)
+	}
+}
+
+func (c *udpgwConn) forget(r *udpgwRemote) {
+	delete(c.remotes, r.addr)
+	delete(c.ids, r.id)
+}
+
+// resolve returns the address of name, looked up through the tunnel once
+// per conn
+func (c *udpgwConn) resolve(name string) (netip.Addr, error) {
+	c.access.Lock()
+	addr, loaded := c.names[name]
+	c.access.Unlock()
+	if loaded {
+		return addr, nil
+	}
+	addr, err := c.lookup(name)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	c.access.Lock()
+	if len(c.names) >= maxUDPGWRemotes {
+		clear(c.names)
+	}
+	c.names[name] = addr
+	c.access.Unlock()
+	return addr, nil
+}
+
+func (c *udpgwConn) writeMessage(flags byte, id uint16, addr netip.AddrPort, payload []byte) error {
+	message, err := encodeUDPGW(flags, id, addr, payload)
+	if err != nil {
+		return err
+	}
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	_, err = c.stream.Write(message)
+	return err
+}
+
+func (c *udpgwConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	destination := metadata.SocksaddrFromNet(addr)
+	addrPort := destination.Unwrap().AddrPort()
+	if destination.IsFqdn() {
+		ip, err := c.resolve(destination.Fqdn)
+		if err != nil {
+			return 0, err
+		}
+		addrPort = netip.AddrPortFrom(ip, destination.Port)
+	}
+	if !addrPort.IsValid() {
+		return 0, fmt.Errorf("udpgw: invalid destination %s", addr)
+	}
+	id, flags := c.remote(addrPort, destination)
+	if addrPort.Port() == 53 {
+		// Let the server resolve through its own DNS
+		flags |= udpgwFlagDNS
+	}
+	if err := c.writeMessage(flags, id, addrPort, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom returns the next datagram, from the destination it answers as
+// written to WriteTo, domain names included
+func (c *udpgwConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		flags, id, addr, payload, err := readUDPGW(c.stream)
+		if err != nil {
+			return 0, nil, err
+		}
+		if flags&udpgwFlagKeepalive != 0 {
+			continue
+		}
+		var source net.Addr = net.UDPAddrFromAddrPort(addr)
+		c.access.Lock()
+		if r := c.ids[id]; r != nil {
+			r.lastUsed = time.Now()
+			source = r.name
+		}
+		c.access.Unlock()
+		return copy(b, payload), source, nil
+	}
+}
+
+func (c *udpgwConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.stream.Close()
+}
+
+func (c *udpgwConn) LocalAddr() net.Addr {
+	return c.stream.LocalAddr()
+}
+
+func (c *udpgwConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *udpgwConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *udpgwConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+// encodeUDPGW frames a message; keepalives carry no address or payload
+func encodeUDPGW(flags byte, id uint16, addr netip.AddrPort, payload []byte) ([]byte, error) {
+	message := make([]byte, 2, 2+1+2+18+len(payload))
+	message = append(message, flags)
+	message = binary.LittleEndian.AppendUint16(message, id)
+	if flags&udpgwFlagKeepalive == 0 {
+		if addr.Addr().Is6() {
+			message[2] |= udpgwFlagIPv6
+		}
+		message = append(message, addr.Addr().AsSlice()...)
+		message = binary.BigEndian.AppendUint16(message, addr.Port())
+		message = append(message, payload...)
+	}
+	if len(message)-2 > 0xffff {
+		return nil, fmt.Errorf("udpgw: datagram too large")
+	}
+	binary.LittleEndian.PutUint16(message, uint16(len(message)-2))
+	return message, nil
+}
+
+// readUDPGW reads the next message of r
+func readUDPGW(r io.Reader) (flags byte, id uint16, addr netip.AddrPort, payload []byte, err error) {
+	var length [2]byte
+	if _, err = io.ReadFull(r, length[:]); err != nil {
+		return
+	}
+	message := make([]byte, binary.LittleEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(r, message); err != nil {
+		return
+	}
+	if len(message) < 3 {
+		err = fmt.Errorf("udpgw: short message")
+		return
+	}
+	flags = message[0]
+	id = binary.LittleEndian.Uint16(message[1:3])
+	if flags&udpgwFlagKeepalive != 0 {
+		return
+	}
+	message = message[3:]
+	addrLen := 4
+	if flags&udpgwFlagIPv6 != 0 {
+		addrLen = 16
+	}
+	if len(message) < addrLen+2 {
+		err = fmt.Errorf("udpgw: short message")
+		return
+	}
+	ip, _ := netip.AddrFromSlice(message[:addrLen])
+	addr = netip.AddrPortFrom(ip, binary.BigEndian.Uint16(message[addrLen:]))
+	payload = message[addrLen+2:]
+	return
+}
+
+// lookupUDPGW resolves name with DNS queries sent over a UDPGW channel opened
+// by dial, flagged for the server's resolver, trying IPv4 before IPv6
+func lookupUDPGW(dial func() (net.Conn, error), name string) (netip.Addr, error) {
+	stream, err := dial()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("udpgw: lookup %s: %w", name, err)
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(udpgwLookupTimeout))
+	for id, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(name), qtype)
+		packed, err := query.Pack()
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		message, err := encodeUDPGW(udpgwFlagDNS, uint16(id+1), udpgwResolver, packed)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		if _, err := stream.Write(message); err != nil {
+			return netip.Addr{}, fmt.Errorf("udpgw: lookup %s: %w", name, err)
+		}
+		response, err := readLookupResponse(stream, uint16(id+1), query.Id)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("udpgw: lookup %s: %w", name, err)
+		}
+		for _, answer := range response.Answer {
+			switch record := answer.(type) {
+			case *dns.A:
+				if addr, ok := netip.AddrFromSlice(record.A.To4()); ok {
+					return addr, nil
+				}
+			case *dns.AAAA:
+				if addr, ok := netip.AddrFromSlice(record.AAAA); ok {
+					return addr, nil
+				}
+			}
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("udpgw: no address for %s", name)
+}
+
+// readLookupResponse returns the response to the query queryID sent with
+// connection ID id, skipping keepalives and stale answers
+func readLookupResponse(stream net.Conn, id uint16, queryID uint16) (*dns.Msg, error) {
+	for {
+		flags, messageID, _, payload, err := readUDPGW(stream)
+		if err != nil {
+			return nil, err
+		}
+		if flags&udpgwFlagKeepalive != 0 || messageID != id {
+			continue
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(payload); err != nil || response.Id != queryID {
+			continue
+		}
+		if response.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("%s", dns.RcodeToString[response.Rcode])
+		}
+		return response, nil
+	}
+}
@@ -0,0 +1,10 @@
+package qos
+
+import (
+	"github.com/UTPBox/utp-core/internal/sockopt"
+)
+
+// QoSOptions defines the configuration for the qos service
+type QoSOptions struct {
+	Rules []sockopt.Rule `json:"rules"` // Marks for matching connections, first match wins over the outbound's own marks
+}
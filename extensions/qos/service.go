@@ -0,0 +1,53 @@
+package qos
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/log"
+
+	"github.com/UTPBox/utp-core/internal/sockopt"
+)
+
+// Service puts QoS marking rules in force for the extension outbounds of
+// the instance (see internal/sockopt)
+type Service struct {
+	boxService.Adapter
+	logger log.ContextLogger
+	rules  *sockopt.Rules
+	count  int
+}
+
+// NewService creates the qos service
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts QoSOptions) (adapter.Service, error) {
+	if len(opts.Rules) == 0 {
+		return nil, fmt.Errorf("qos service requires rules")
+	}
+	rules, err := sockopt.Compile(opts.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("qos %w", err)
+	}
+	return &Service{
+		Adapter: boxService.NewAdapter("qos", tag),
+		logger:  logger,
+		rules:   rules,
+		count:   len(opts.Rules),
+	}, nil
+}
+
+// Start puts the rules in force before outbounds start dialing
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	sockopt.SetRules(s.rules)
+	s.logger.Info("marking outbound sockets with ", s.count, " QoS rules")
+	return nil
+}
+
+func (s *Service) Close() error {
+	sockopt.ClearRules(s.rules)
+	return nil
+}
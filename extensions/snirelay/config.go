@@ -0,0 +1,21 @@
+package snirelay
+
+import "github.com/sagernet/sing-box/option"
+
+// SNIRelayOptions defines the configuration for the SNI relay inbound. It
+// accepts the Sing-box listen options (listen, listen_port, tcp_fast_open,
+// netns, ...).
+type SNIRelayOptions struct {
+	option.ListenOptions
+	Rules            []SNIRule `json:"rules"`                       // Evaluated in order, first match wins
+	DefaultOutbound  string    `json:"default_outbound,omitempty"`  // Outbound for unmatched or SNI-less connections (empty = reject)
+	DefaultServer    string    `json:"default_server,omitempty"`    // Destination for unmatched connections (host:port)
+	HandshakeTimeout int       `json:"handshake_timeout,omitempty"` // Seconds to wait for the ClientHello (default 10)
+}
+
+// SNIRule maps server names to an outbound and backend destination
+type SNIRule struct {
+	ServerName []string `json:"server_name"`      // Exact names or "*.example.com" wildcards
+	Outbound   string   `json:"outbound"`         // Outbound tag used to reach the backend
+	Server     string   `json:"server,omitempty"` // Backend host:port (default: SNI on port 443)
+}
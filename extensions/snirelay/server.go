@@ -0,0 +1,162 @@
+package snirelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/listener"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/service"
+)
+
+var _ adapter.TCPInjectableInbound = (*Inbound)(nil)
+
+// Inbound accepts TLS connections, reads the SNI from the ClientHello without
+// terminating TLS and relays the raw stream to a backend chosen per rule.
+type Inbound struct {
+	tag      string
+	opts     SNIRelayOptions
+	logger   log.ContextLogger
+	manager  adapter.OutboundManager
+	listener *listener.Listener
+}
+
+// NewInbound creates a new SNI relay inbound
+func NewInbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts SNIRelayOptions) (adapter.Inbound, error) {
+	if opts.ListenPort == 0 {
+		return nil, fmt.Errorf("missing listen_port")
+	}
+	for i, rule := range opts.Rules {
+		if len(rule.ServerName) == 0 {
+			return nil, fmt.Errorf("rule[%d]: missing server_name", i)
+		}
+		if rule.Outbound == "" {
+			return nil, fmt.Errorf("rule[%d]: missing outbound", i)
+		}
+		for j, name := range rule.ServerName {
+			opts.Rules[i].ServerName[j] = strings.ToLower(name)
+		}
+	}
+	i := &Inbound{
+		tag:     tag,
+		opts:    opts,
+		logger:  logger,
+		manager: service.FromContext[adapter.OutboundManager](ctx),
+	}
+	i.listener = listener.New(listener.Options{
+		Context:           ctx,
+		Logger:            logger,
+		Network:           []string{N.NetworkTCP},
+		Listen:            opts.ListenOptions,
+		ConnectionHandler: i,
+	})
+	return i, nil
+}
+
+func (i *Inbound) Type() string {
+	return "sni-relay"
+}
+
+func (i *Inbound) Tag() string {
+	return i.tag
+}
+
+func (i *Inbound) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	return i.listener.Start()
+}
+
+func (i *Inbound) Close() error {
+	return i.listener.Close()
+}
+
+// NewConnectionEx reads the ClientHello of conn without terminating TLS and
+// relays the raw stream to the backend of the matching rule
+func (i *Inbound) NewConnectionEx(ctx context.Context, conn net.Conn, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	err := i.relay(ctx, conn, metadata)
+	conn.Close()
+	onClose(err)
+}
+
+func (i *Inbound) relay(ctx context.Context, conn net.Conn, source adapter.InboundContext) error {
+	// 1. Read the ClientHello without terminating TLS
+	timeout := time.Duration(i.opts.HandshakeTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	hello, serverName, err := readClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && !errors.Is(err, errNotClientHello) {
+		i.logger.DebugContext(ctx, "read ClientHello from ", source.Source, ": ", err)
+		return err
+	}
+
+	// 2. Select the route for this server name
+	outboundTag, server := i.match(serverName)
+	if outboundTag == "" {
+		i.logger.DebugContext(ctx, "no route for SNI \"", serverName, "\" from ", source.Source)
+		return fmt.Errorf("no route for SNI %q", serverName)
+	}
+	var destination metadata.Socksaddr
+	if server != "" {
+		destination = metadata.ParseSocksaddr(server)
+	} else if serverName != "" {
+		destination = metadata.ParseSocksaddrHostPort(serverName, 443)
+	} else {
+		i.logger.DebugContext(ctx, "no destination for connection without SNI from ", source.Source)
+		return fmt.Errorf("no destination for connection without SNI")
+	}
+
+	// 3. Dial the backend through the selected outbound
+	outbound, loaded := i.manager.Outbound(outboundTag)
+	if !loaded {
+		i.logger.ErrorContext(ctx, "outbound not found: ", outboundTag)
+		return fmt.Errorf("outbound not found: %s", outboundTag)
+	}
+	remote, err := outbound.DialContext(ctx, N.NetworkTCP, destination)
+	if err != nil {
+		i.logger.ErrorContext(ctx, "dial ", destination, " via ", outboundTag, ": ", err)
+		return err
+	}
+	defer remote.Close()
+	i.logger.InfoContext(ctx, "relay ", source.Source, " [", serverName, "] => ", destination, " via ", outboundTag)
+
+	// 4. Replay the ClientHello and relay raw bytes in both directions
+	if _, err := remote.Write(hello); err != nil {
+		return err
+	}
+	return bufio.CopyConn(ctx, conn, remote)
+}
+
+// match returns the outbound tag and backend for serverName
+func (i *Inbound) match(serverName string) (string, string) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName != "" {
+		for _, rule := range i.opts.Rules {
+			for _, pattern := range rule.ServerName {
+				if matchServerName(pattern, serverName) {
+					return rule.Outbound, rule.Server
+				}
+			}
+		}
+	}
+	return i.opts.DefaultOutbound, i.opts.DefaultServer
+}
+
+func matchServerName(pattern, name string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(name, "."+suffix)
+	}
+	return pattern == name
+}
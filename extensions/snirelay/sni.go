@@ -0,0 +1,170 @@
+package snirelay
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	errNotClientHello    = errors.New("not a TLS ClientHello")
+	errInvalidServerName = errors.New("invalid server name")
+)
+
+// maxClientHello bounds how much we buffer while looking for the SNI
+const maxClientHello = 16 * 1024
+
+// readClientHello reads one full TLS handshake record from r and returns the
+// raw bytes read together with the server name it carries (may be empty).
+func readClientHello(r io.Reader) ([]byte, string, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, "", err
+	}
+	// ContentType handshake(22), legacy version 3.x
+	if header[0] != 22 || header[1] != 3 {
+		return header, "", errNotClientHello
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length == 0 || length > maxClientHello {
+		return header, "", errNotClientHello
+	}
+	record := make([]byte, 5+length)
+	copy(record, header)
+	if _, err := io.ReadFull(r, record[5:]); err != nil {
+		return nil, "", err
+	}
+	serverName, err := parseServerName(record[5:])
+	return record, serverName, err
+}
+
+// DecodeClientHello returns the server name carried by a complete TLS
+// record holding a ClientHello (empty if it has none). It is deterministic,
+// does not allocate beyond the returned name and never reads past record,
+// so it can be used as a fuzzing entry point for the relay's parser.
+func DecodeClientHello(record []byte) (string, error) {
+	if len(record) < 5 || record[0] != 22 || record[1] != 3 {
+		return "", errNotClientHello
+	}
+	length := int(binary.BigEndian.Uint16(record[3:5]))
+	if length == 0 || length > maxClientHello || length != len(record)-5 {
+		return "", errNotClientHello
+	}
+	return parseServerName(record[5:])
+}
+
+// parseServerName extracts the server_name extension from a handshake message
+func parseServerName(msg []byte) (string, error) {
+	// Handshake header: type(1) length(3). A ClientHello fragmented over
+	// several records is not supported.
+	if len(msg) < 4 || msg[0] != 1 {
+		return "", errNotClientHello
+	}
+	helloLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if helloLen > len(msg)-4 {
+		return "", errNotClientHello
+	}
+	msg = msg[4 : 4+helloLen]
+	// legacy_version(2) random(32)
+	if len(msg) < 34 {
+		return "", errNotClientHello
+	}
+	msg = msg[34:]
+	// session_id
+	msg, ok := skipVector(msg, 1)
+	if !ok {
+		return "", errNotClientHello
+	}
+	// cipher_suites
+	if msg, ok = skipVector(msg, 2); !ok {
+		return "", errNotClientHello
+	}
+	// compression_methods
+	if msg, ok = skipVector(msg, 1); !ok {
+		return "", errNotClientHello
+	}
+	if len(msg) == 0 {
+		// No extensions
+		return "", nil
+	}
+	if len(msg) < 2 {
+		return "", errNotClientHello
+	}
+	extensionsLen := int(binary.BigEndian.Uint16(msg))
+	if extensionsLen > len(msg)-2 {
+		return "", errNotClientHello
+	}
+	extensions := msg[2 : 2+extensionsLen]
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions)
+		extLen := int(binary.BigEndian.Uint16(extensions[2:]))
+		extensions = extensions[4:]
+		if extLen > len(extensions) {
+			return "", errNotClientHello
+		}
+		if extType == 0 {
+			return parseServerNameList(extensions[:extLen])
+		}
+		extensions = extensions[extLen:]
+	}
+	return "", nil
+}
+
+func parseServerNameList(ext []byte) (string, error) {
+	if len(ext) < 2 {
+		return "", errNotClientHello
+	}
+	listLen := int(binary.BigEndian.Uint16(ext))
+	if listLen > len(ext)-2 {
+		return "", errNotClientHello
+	}
+	list := ext[2 : 2+listLen]
+	for len(list) >= 3 {
+		nameType := list[0]
+		nameLen := int(binary.BigEndian.Uint16(list[1:]))
+		list = list[3:]
+		if nameLen > len(list) {
+			return "", errNotClientHello
+		}
+		if nameType == 0 {
+			if !validServerName(list[:nameLen]) {
+				return "", errInvalidServerName
+			}
+			return string(list[:nameLen]), nil
+		}
+		list = list[nameLen:]
+	}
+	return "", nil
+}
+
+// validServerName accepts DNS host names only, so crafted names with
+// control characters or separators never reach routing and logs
+func validServerName(name []byte) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// skipVector skips a length-prefixed vector with an n-byte length
+func skipVector(b []byte, n int) ([]byte, bool) {
+	if len(b) < n {
+		return nil, false
+	}
+	var length int
+	for i := 0; i < n; i++ {
+		length = length<<8 | int(b[i])
+	}
+	b = b[n:]
+	if length > len(b) {
+		return nil, false
+	}
+	return b[length:], true
+}
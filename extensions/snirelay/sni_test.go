@@ -0,0 +1,66 @@
+package snirelay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// clientHello returns the first record of a TLS handshake by crypto/tls
+// for serverName
+func clientHello(t testing.TB, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+(int(header[3])<<8|int(header[4])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestDecodeClientHello(t *testing.T) {
+	serverName, err := DecodeClientHello(clientHello(t, "www.example.com"))
+	if err != nil || serverName != "www.example.com" {
+		t.Fatalf("DecodeClientHello = %q, %v", serverName, err)
+	}
+}
+
+func FuzzDecodeClientHello(f *testing.F) {
+	f.Add(clientHello(f, "www.example.com"))
+	f.Add(clientHello(f, "a.b"))
+	f.Add([]byte{22, 3, 1, 0, 4, 1, 0, 0, 0})
+	f.Add([]byte{22, 3, 1, 0, 0})
+	f.Add([]byte("GET / HTTP/1.1\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, record []byte) {
+		serverName, err := DecodeClientHello(record)
+		if err != nil {
+			if serverName != "" {
+				t.Fatalf("name %q returned with error %v", serverName, err)
+			}
+			return
+		}
+		if serverName != "" && !bytes.Contains(record, []byte(serverName)) {
+			t.Fatalf("name %q is not in the record", serverName)
+		}
+		if strings.ContainsAny(serverName, "\x00/ ") {
+			t.Fatalf("invalid name %q accepted", serverName)
+		}
+		// The relay reads the same record from the connection
+		_, readName, readErr := readClientHello(bytes.NewReader(record))
+		if readErr != nil || readName != serverName {
+			t.Fatalf("readClientHello = %q, %v; DecodeClientHello = %q", readName, readErr, serverName)
+		}
+	})
+}
@@ -0,0 +1,340 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/dnstt"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/hostkey"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/payload"
+	"github.com/UTPBox/utp-core/internal/session"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// Default server ports
+const (
+	defaultPort    = 22
+	defaultTLSPort = 443
+)
+
+// Session upkeep defaults
+const (
+	defaultKeepaliveInterval  = 30 * time.Second
+	defaultKeepaliveMaxMissed = 3
+	minBackoff                = time.Second
+	maxBackoff                = time.Minute
+)
+
+var (
+	_ adapter.Outbound = (*Outbound)(nil)
+	_ session.Migrator = (*Outbound)(nil)
+)
+
+// Outbound reaches destinations through an SSH server. Connections are
+// direct-tcpip channels of one authenticated session, established on the
+// first dial. Keepalives detect sessions silently dropped by NATs and
+// network changes, and a session that drops is re-established in the
+// background, backing off while the server is unreachable.
+type Outbound struct {
+	ctx       context.Context // Canceled on Close, ending reconnects
+	cancel    context.CancelFunc
+	typ       string
+	tag       string
+	opts      SSHOptions
+	logger    log.ContextLogger
+	config    *gossh.ClientConfig
+	tlsConfig *tlsconfig.Config // Set for ssh-tls
+	tunnel    *dnstt.Client     // Set for ssh-dnstt
+	payload   *payload.Template // Set with payload
+	limiter   *limiter.Limiter
+	guard     *dnsguard.Guard
+	dialer    *netdial.Outbound
+	migration string // Session key for reloads, "" for ssh-dnstt
+
+	keepaliveInterval  time.Duration // 0 disables keepalives
+	keepaliveMaxMissed int
+
+	access   sync.Mutex
+	client   *gossh.Client
+	failures int // Consecutive failed connects
+	retryAt  time.Time
+	lastErr  error // Of the latest failed connect
+}
+
+// NewOutbound creates a new ssh-direct outbound
+func NewOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts SSHOptions) (adapter.Outbound, error) {
+	if opts.Port == 0 {
+		opts.Port = defaultPort
+	}
+	o, err := newOutbound(ctx, logger, "ssh-direct", tag, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.adopt(ctx, opts.identity())
+	return o, nil
+}
+
+// NewTLSOutbound creates a new ssh-tls outbound
+func NewTLSOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts SSHTLSOptions) (adapter.Outbound, error) {
+	if opts.Port == 0 {
+		opts.Port = defaultTLSPort
+	}
+	tlsOptions := tlsconfig.Options{}
+	if opts.TLS != nil {
+		tlsOptions = *opts.TLS
+	}
+	tlsOptions.Enabled = true
+	tlsConfig, err := tlsconfig.New(ctx, opts.Server, tlsOptions)
+	if err != nil {
+		return nil, fmt.Errorf("ssh-tls: %w", err)
+	}
+	if err := tlsConfig.Fragment(opts.TLSFragment); err != nil {
+		return nil, fmt.Errorf("ssh-tls: %w", err)
+	}
+	o, err := newOutbound(ctx, logger, "ssh-tls", tag, opts.SSHOptions, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	identity := opts
+	identity.SSHOptions = opts.identity()
+	o.adopt(ctx, identity)
+	return o, nil
+}
+
+// NewDNSTTOutbound creates a new ssh-dnstt outbound
+func NewDNSTTOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts SSHDNSTTOptions) (adapter.Outbound, error) {
+	if opts.Server == "" {
+		opts.Server = opts.Domain
+	}
+	if opts.Port == 0 {
+		opts.Port = defaultPort
+	}
+	if opts.Proxy != nil || opts.Payload != "" {
+		return nil, fmt.Errorf("ssh-dnstt: proxy and payload are not supported, queries go to the resolver")
+	}
+	o, err := newOutbound(ctx, logger, "ssh-dnstt", tag, opts.SSHOptions, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.tunnel, err = dnstt.New(opts.TunnelOptions, o.dialer.For(nil))
+	if err != nil {
+		return nil, fmt.Errorf("ssh-dnstt: %w", err)
+	}
+	// The session rides the DNS tunnel of this outbound, which closes with
+	// it, so it is not handed over on reloads
+	return o, nil
+}
+
+func newOutbound(ctx context.Context, logger log.ContextLogger, typ string, tag string, opts SSHOptions, tlsConfig *tlsconfig.Config) (*Outbound, error) {
+	if opts.Server == "" || opts.User == "" {
+		return nil, fmt.Errorf("%s requires server and user", typ)
+	}
+	auth, err := authMethods(opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	if opts.Proxy != nil {
+		if err := opts.Proxy.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", typ, err)
+		}
+	}
+	var template *payload.Template
+	if opts.Payload != "" {
+		// The payload takes the place of the CONNECT request
+		if opts.Proxy != nil && opts.Proxy.Type != proxyHTTP {
+			return nil, fmt.Errorf("%s: payload requires an http proxy", typ)
+		}
+		template, err = payload.Parse(opts.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", typ, err)
+		}
+	}
+	dialer, err := netdial.New(ctx, tag, opts.DialerOptions, opts.Marks)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	hostKeys, err := hostkey.New(ctx, opts.HostKeyOptions)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", typ, err)
+	}
+	guard, err := dnsguard.New(ctx, opts.DNSGuard)
+	if err != nil {
+		return nil, err
+	}
+	keepaliveInterval := time.Duration(opts.KeepaliveInterval)
+	switch {
+	case keepaliveInterval == 0:
+		keepaliveInterval = defaultKeepaliveInterval
+	case keepaliveInterval < 0:
+		keepaliveInterval = 0
+	}
+	if opts.KeepaliveMaxMissed < 0 || opts.MaxRekeyData < 0 {
+		return nil, fmt.Errorf("%s: negative keepalive_max_missed or max_rekey_data", typ)
+	}
+	if opts.KeepaliveMaxMissed == 0 {
+		opts.KeepaliveMaxMissed = defaultKeepaliveMaxMissed
+	}
+	config := &gossh.ClientConfig{User: opts.User, Auth: auth}
+	config.RekeyThreshold = uint64(opts.MaxRekeyData)
+	hostKeys.Configure(config)
+	ctx, cancel := context.WithCancel(ctx)
+	return &Outbound{
+		ctx:       ctx,
+		cancel:    cancel,
+		typ:       typ,
+		tag:       tag,
+		opts:      opts,
+		logger:    logger,
+		config:    config,
+		tlsConfig: tlsConfig,
+		payload:   template,
+		limiter:   limiter.New(opts.Options),
+		guard:     guard,
+		dialer:    dialer,
+
+		keepaliveInterval:  keepaliveInterval,
+		keepaliveMaxMissed: opts.KeepaliveMaxMissed,
+	}, nil
+}
+
+// authMethods returns the methods offered to the server: the private key
+// first, then the password, and keyboard-interactive answering every prompt
+// with the password, as servers asking for a one-time code do not suit an
+// unattended tunnel anyway
+func authMethods(opts SSHOptions) ([]gossh.AuthMethod, error) {
+	var methods []gossh.AuthMethod
+	keyPEM := []byte(opts.PrivateKey)
+	if opts.PrivateKeyPath != "" {
+		if opts.PrivateKey != "" {
+			return nil, fmt.Errorf("private_key and private_key_path are mutually exclusive")
+		}
+		content, err := os.ReadFile(opts.PrivateKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("read private key: %w", err)
+		}
+		keyPEM = content
+	}
+	if len(keyPEM) > 0 {
+		var signer gossh.Signer
+		var err error
+		if opts.PrivateKeyPassphrase != "" {
+			signer, err = gossh.ParsePrivateKeyWithPassphrase(keyPEM, []byte(opts.PrivateKeyPassphrase))
+		} else {
+			signer, err = gossh.ParsePrivateKey(keyPEM)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %w", err)
+		}
+		methods = append(methods, gossh.PublicKeys(signer))
+	}
+	if opts.Password != "" {
+		password := opts.Password
+		methods = append(methods, gossh.Password(password), gossh.KeyboardInteractive(
+			func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("password or private key required")
+	}
+	return methods, nil
+}
+
+func (o *Outbound) Type() string {
+	return o.typ
+}
+
+func (o *Outbound) Tag() string {
+	return o.tag
+}
+
+func (o *Outbound) Dependencies() []string {
+	return o.opts.DialerOptions.Dependencies()
+}
+
+// UDP needs a UDPGW service on the server, which plain SSH servers lack
+func (o *Outbound) Network() []string {
+	return []string{"tcp"}
+}
+
+func (o *Outbound) Start() error {
+	return nil
+}
+
+// OfferSessions offers the SSH session to an identical outbound of the
+// instance started by a reload
+func (o *Outbound) OfferSessions() {
+	session.Offer(o.migration, handover{o})
+}
+
+func (o *Outbound) Close() error {
+	o.cancel()
+	if session.Reloading() {
+		session.Park(o.migration, handover{o})
+	} else {
+		handover{o}.Close()
+	}
+	if o.tunnel != nil {
+		o.tunnel.Close()
+	}
+	return nil
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	conn, err := o.dial(ctx, destination)
+	if err != nil {
+		release()
+		o.logger.Debug(o.typ, "[", o.tag, "]: server ", o.opts.Server, ":", o.opts.Port, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapConn(conn, release), nil
+}
+
+func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	return nil, fmt.Errorf("%s outbound does not support UDP", o.typ)
+}
+
+// dial opens a direct-tcpip channel to destination, on a fresh session if
+// the current one broke before the channel was opened
+func (o *Outbound) dial(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := o.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.DialContext(ctx, "tcp", destination.String())
+		if err == nil {
+			return conn, nil
+		}
+		var rejected *gossh.OpenChannelError
+		if errors.As(err, &rejected) || attempt > 0 || ctx.Err() != nil {
+			return nil, failure.Wrap(failure.StageTarget, fmt.Errorf("failed to dial target via SSH: %w", err))
+		}
+		o.drop(client)
+	}
+}
@@ -0,0 +1,68 @@
+package ssh
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/dnstt"
+	"github.com/UTPBox/utp-core/internal/hostkey"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+// SSHOptions defines the configuration for the ssh-direct outbound, and the
+// SSH session of the other ssh-* outbounds. At least one of password and
+// private key is required.
+type SSHOptions struct {
+	Server               string `json:"server"`                           // Server hostname or IP
+	Port                 int    `json:"port,omitempty"`                   // Server port (default 22, 443 for ssh-tls)
+	User                 string `json:"user"`                             // SSH user
+	Password             string `json:"password,omitempty"`               // Password, also answering keyboard-interactive prompts
+	PrivateKey           string `json:"private_key,omitempty"`            // PEM private key (OpenSSH, PKCS#1, PKCS#8 or SEC 1)
+	PrivateKeyPath       string `json:"private_key_path,omitempty"`       // File holding the PEM private key
+	PrivateKeyPassphrase string `json:"private_key_passphrase,omitempty"` // Passphrase of an encrypted private key
+
+	KeepaliveInterval  badoption.Duration `json:"keepalive_interval,omitempty"`   // Time between keepalive requests (default 30s, negative disables)
+	KeepaliveMaxMissed int                `json:"keepalive_max_missed,omitempty"` // Unanswered keepalives after which the session is dropped (default 3)
+	MaxRekeyData       int64              `json:"max_rekey_data,omitempty"`       // Bytes after which session keys are renegotiated (default 64 GiB for AES, 1 GiB for ChaCha20)
+
+	DNSGuard dnsguard.Options `json:"dns_guard,omitempty"` // Reject poisoned server addresses and re-resolve securely
+	Proxy    *ProxyOptions    `json:"proxy,omitempty"`     // HTTP or SOCKS5 proxy the server is reached through
+	Payload  string           `json:"payload,omitempty"`   // HTTP injector payload sent ahead of the SSH handshake, e.g. "GET / HTTP/1.1[crlf]Host: [host][crlf][crlf]"
+
+	hostkey.HostKeyOptions // host_key / host_key_algorithms / known_hosts_path / trust_on_first_use
+	limiter.Options        // max_connections / max_pending_dials
+	sockopt.Marks          // dscp / tos / socket_priority
+	netdial.DialerOptions  // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+}
+
+// ProxyOptions defines the HTTP or SOCKS5 proxy of networks that only let
+// connections out through one. The proxy resolves the server name.
+type ProxyOptions struct {
+	Type     string `json:"type"`               // http (CONNECT) or socks5
+	Server   string `json:"server"`             // Proxy hostname or IP
+	Port     int    `json:"port"`               // Proxy port
+	Username string `json:"username,omitempty"` // Proxy-Authorization Basic user, or SOCKS5 user
+	Password string `json:"password,omitempty"`
+}
+
+// SSHTLSOptions defines the configuration for the ssh-tls outbound, which
+// runs the SSH session inside TLS, as stunnel-fronted servers expect
+type SSHTLSOptions struct {
+	SSHOptions
+
+	TLS         *tlsconfig.Options        `json:"tls,omitempty"`          // TLS towards the server (SNI, uTLS, pins); always enabled
+	TLSFragment tlsconfig.FragmentOptions `json:"tls_fragment,omitempty"` // Split the ClientHello into TCP segments
+}
+
+// SSHDNSTTOptions defines the configuration for the ssh-dnstt outbound,
+// which runs the SSH session through a dnstt DNS tunnel. server and port
+// only name the SSH server for host key checks (default: the tunnel domain
+// and 22); the dnstt server forwards to it.
+type SSHDNSTTOptions struct {
+	SSHOptions
+
+	dnstt.TunnelOptions // domain / public_key / resolver
+}
@@ -0,0 +1,49 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/UTPBox/utp-core/internal/payload"
+)
+
+// maxPayloadResponse bounds what is skipped while waiting for the SSH banner
+const maxPayloadResponse = 64 << 10
+
+// sendPayload writes the payload and skips what the server or proxy answers
+// to it, usually an HTTP response such as "HTTP/1.1 200 OK" or "101
+// Switching Protocols", up to the line of the SSH banner
+func (o *Outbound) sendPayload(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	vars := payload.Vars{Host: o.opts.Server, Port: o.opts.Port}
+	if err := o.payload.Write(ctx, conn, vars); err != nil {
+		return nil, fmt.Errorf("write payload: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	var first []byte // Line reported when the banner never comes
+	for skipped := 0; ; {
+		prefix, err := reader.Peek(4)
+		if err == nil && bytes.Equal(prefix, []byte("SSH-")) {
+			break
+		}
+		line, err := reader.ReadSlice('\n')
+		if first == nil && len(line) > 0 {
+			first = bytes.TrimSpace(line)
+			o.logger.Debug(o.typ, "[", o.tag, "]: payload answered with ", string(first))
+		}
+		skipped += len(line)
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			if first != nil {
+				return nil, fmt.Errorf("no SSH banner after payload, answered %q: %w", first, err)
+			}
+			return nil, fmt.Errorf("no SSH banner after payload: %w", err)
+		}
+		if skipped > maxPayloadResponse {
+			return nil, fmt.Errorf("no SSH banner in the first %d bytes after payload, answered %q", maxPayloadResponse, first)
+		}
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
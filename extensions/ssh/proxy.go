@@ -0,0 +1,249 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	C "github.com/sagernet/sing-box/constant"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+)
+
+// Proxy types
+const (
+	proxyHTTP   = "http"
+	proxySOCKS5 = "socks5"
+)
+
+// SOCKS5 protocol values of RFC 1928 and RFC 1929
+const (
+	socksVersion        = 5
+	socksNoAuth         = 0x00
+	socksUserPass       = 0x02
+	socksNoAcceptable   = 0xff
+	socksUserPassVer    = 1
+	socksConnect        = 1
+	socksAddrIPv4       = 1
+	socksAddrDomain     = 3
+	socksAddrIPv6       = 4
+	socksReplySucceeded = 0
+)
+
+// socksReplies describes the failure codes of SOCKS5 replies
+var socksReplies = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (p *ProxyOptions) validate() error {
+	switch p.Type {
+	case proxyHTTP, proxySOCKS5:
+	default:
+		return fmt.Errorf("invalid proxy type %q: expected http or socks5", p.Type)
+	}
+	if p.Server == "" || p.Port <= 0 || p.Port > 65535 {
+		return fmt.Errorf("proxy requires server and port")
+	}
+	if p.Type == proxySOCKS5 && (len(p.Username) > 255 || len(p.Password) > 255) {
+		return fmt.Errorf("SOCKS5 proxy username and password are limited to 255 bytes")
+	}
+	return nil
+}
+
+// proxyConnect asks the proxy at the other end of conn for a connection to
+// target, and returns the connection carrying it once the proxy has agreed
+func proxyConnect(ctx context.Context, conn net.Conn, proxy *ProxyOptions, target string) (net.Conn, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(C.TCPTimeout)
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	if proxy.Type == proxySOCKS5 {
+		return conn, socks5Connect(conn, proxy, target)
+	}
+	return httpConnect(conn, proxy, target)
+}
+
+// httpConnect sends a CONNECT request with Basic credentials and checks the
+// status of the response. Bytes read past the response, such as the banner
+// of the SSH server, are kept for the SSH handshake.
+func httpConnect(conn net.Conn, proxy *ProxyOptions, target string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if proxy.Username != "" || proxy.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, fmt.Errorf("write CONNECT request: %w", err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("read CONNECT response: %w", err)
+	}
+	if response.StatusCode/100 != 2 {
+		response.Body.Close()
+		err := fmt.Errorf("proxy refused CONNECT %s: %s", target, response.Status)
+		switch response.StatusCode {
+		case http.StatusProxyAuthRequired, http.StatusUnauthorized:
+			return nil, failure.New(failure.KindAuthFailed, failure.StageConnect, err)
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return nil, failure.New(failure.KindUnreachable, failure.StageConnect, err)
+		case http.StatusTooManyRequests:
+			return nil, failure.New(failure.KindQuotaExceeded, failure.StageConnect, err)
+		}
+		return nil, err
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn replays bytes the proxy sent along with its response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// socks5Connect negotiates the authentication method, authenticates with
+// username and password when the proxy asks for it, and sends a CONNECT
+// request, leaving the name of target to the proxy to resolve
+func socks5Connect(conn net.Conn, proxy *ProxyOptions, target string) error {
+	host, portText, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return err
+	}
+	methods := []byte{socksNoAuth}
+	if proxy.Username != "" || proxy.Password != "" {
+		methods = []byte{socksUserPass, socksNoAuth}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("write SOCKS5 greeting: %w", err)
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return fmt.Errorf("read SOCKS5 method: %w", err)
+	}
+	if choice[0] != socksVersion {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", choice[0])
+	}
+	switch choice[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if len(methods) == 1 {
+			return fmt.Errorf("SOCKS5 proxy chose an unoffered method")
+		}
+		request := []byte{socksUserPassVer, byte(len(proxy.Username))}
+		request = append(request, proxy.Username...)
+		request = append(request, byte(len(proxy.Password)))
+		request = append(request, proxy.Password...)
+		if _, err := conn.Write(request); err != nil {
+			return fmt.Errorf("write SOCKS5 credentials: %w", err)
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return fmt.Errorf("read SOCKS5 authentication status: %w", err)
+		}
+		if status[1] != 0 {
+			return failure.New(failure.KindAuthFailed, failure.StageConnect, errors.New("SOCKS5 proxy rejected the username or password"))
+		}
+	case socksNoAcceptable:
+		return failure.New(failure.KindAuthFailed, failure.StageConnect, errors.New("SOCKS5 proxy accepts none of the offered authentication methods"))
+	default:
+		return fmt.Errorf("SOCKS5 proxy chose an unoffered method %d", choice[1])
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if addr.Is4() {
+			request = append(request, socksAddrIPv4)
+		} else {
+			request = append(request, socksAddrIPv6)
+		}
+		request = append(request, addr.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("server name too long for SOCKS5: %s", host)
+		}
+		request = append(request, socksAddrDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return fmt.Errorf("write SOCKS5 request: %w", err)
+	}
+
+	// The reply ends with the bound address, whose length depends on its type
+	var reply [5]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fmt.Errorf("read SOCKS5 reply: %w", err)
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("invalid SOCKS5 reply version %d", reply[0])
+	}
+	if reply[1] != socksReplySucceeded {
+		err := fmt.Errorf("SOCKS5 proxy refused CONNECT %s: %s", target, socksReply(reply[1]))
+		switch reply[1] {
+		case 3, 4, 6:
+			return failure.New(failure.KindUnreachable, failure.StageConnect, err)
+		case 5:
+			return failure.New(failure.KindBlockedReset, failure.StageConnect, err)
+		}
+		return err
+	}
+	var remaining int
+	switch reply[3] {
+	case socksAddrIPv4:
+		remaining = net.IPv4len - 1 + 2
+	case socksAddrIPv6:
+		remaining = net.IPv6len - 1 + 2
+	case socksAddrDomain:
+		remaining = int(reply[4]) + 2
+	default:
+		return fmt.Errorf("invalid SOCKS5 reply address type %d", reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, remaining)); err != nil {
+		return fmt.Errorf("read SOCKS5 reply: %w", err)
+	}
+	return nil
+}
+
+func socksReply(code byte) string {
+	if description, ok := socksReplies[code]; ok {
+		return description
+	}
+	return fmt.Sprintf("reply code %d", code)
+}
@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/testkit"
+)
+
+const testBanner = "SSH-2.0-OpenSSH_9.6\r\n"
+
+// dialTestProxy connects to a proxy served on network by handler and asks it
+// for target. The bytes exchanged with the proxy are recorded into
+// transcript, when given.
+func dialTestProxy(t *testing.T, proxy *ProxyOptions, target string, handler func(conn net.Conn), transcript **testkit.Transcript) (net.Conn, error) {
+	t.Helper()
+	network := &testkit.Network{}
+	listener, err := network.Serve("proxy.example:3128", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	proxy.Server, proxy.Port = "proxy.example", 3128
+	if err := proxy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := network.DialContext(context.Background(), "tcp", "proxy.example:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if transcript != nil {
+		*transcript = testkit.Record(conn)
+		conn = *transcript
+	}
+	return proxyConnect(context.Background(), conn, proxy, target)
+}
+
+// readBanner checks that the banner the server sent right after the proxy
+// response reaches the SSH handshake
+func readBanner(t *testing.T, conn net.Conn) {
+	t.Helper()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != testBanner {
+		t.Fatalf("read %q after the proxy response, want the server banner", line)
+	}
+}
+
+// The proxy flights are compared with annotated transcripts in testdata,
+// written from RFC 9110 and RFC 1928/1929
+func TestHTTPProxy(t *testing.T) {
+	for _, test := range []struct {
+		golden string
+		proxy  ProxyOptions
+	}{
+		{"http-connect", ProxyOptions{Type: proxyHTTP}},
+		{"http-connect-auth", ProxyOptions{Type: proxyHTTP, Username: "user", Password: "secret"}},
+	} {
+		t.Run(test.golden, func(t *testing.T) {
+			var transcript *testkit.Transcript
+			conn, err := dialTestProxy(t, &test.proxy, "ssh.example:22", func(conn net.Conn) {
+				request, conn, err := testkit.ReadRequest(conn)
+				if err != nil || request.Method != "CONNECT" {
+					return
+				}
+				// The banner arrives with the response
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"+testBanner)
+				io.Copy(io.Discard, conn)
+			}, &transcript)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readBanner(t, conn)
+			if err := transcript.Golden(filepath.Join("testdata", test.golden+".golden")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	for _, test := range []struct {
+		golden string
+		proxy  ProxyOptions
+		target string
+	}{
+		{"socks5-domain", ProxyOptions{Type: proxySOCKS5}, "ssh.example:22"},
+		{"socks5-auth-ipv4", ProxyOptions{Type: proxySOCKS5, Username: "user", Password: "secret"}, "192.0.2.1:2222"},
+		{"socks5-ipv6", ProxyOptions{Type: proxySOCKS5}, "[2001:db8::1]:22"},
+	} {
+		t.Run(test.golden, func(t *testing.T) {
+			requests := make(chan testkit.SOCKSRequest, 1)
+			var transcript *testkit.Transcript
+			conn, err := dialTestProxy(t, &test.proxy, test.target, func(conn net.Conn) {
+				request, err := testkit.AcceptSOCKS5(conn)
+				if err != nil {
+					return
+				}
+				requests <- request
+				io.WriteString(conn, testBanner)
+				io.Copy(io.Discard, conn)
+			}, &transcript)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readBanner(t, conn)
+			request := <-requests
+			if request.Destination.String() != test.target || request.Username != test.proxy.Username || request.Password != test.proxy.Password {
+				t.Fatalf("proxy got %+v for %s", request, test.target)
+			}
+			if err := transcript.Golden(filepath.Join("testdata", test.golden+".golden")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProxyRefused(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		proxy   ProxyOptions
+		handler func(conn net.Conn)
+		kind    failure.Kind
+	}{
+		{"http-auth", ProxyOptions{Type: proxyHTTP}, func(conn net.Conn) {
+			if _, _, err := testkit.ReadRequest(conn); err == nil {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+			}
+		}, failure.KindAuthFailed},
+		{"http-gateway", ProxyOptions{Type: proxyHTTP}, func(conn net.Conn) {
+			if _, _, err := testkit.ReadRequest(conn); err == nil {
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+			}
+		}, failure.KindUnreachable},
+		{"socks5-methods", ProxyOptions{Type: proxySOCKS5}, func(conn net.Conn) {
+			// Only username and password, which were not offered
+			if _, err := io.ReadFull(conn, make([]byte, 3)); err == nil {
+				conn.Write([]byte{socksVersion, socksNoAcceptable})
+			}
+		}, failure.KindAuthFailed},
+		{"socks5-refused", ProxyOptions{Type: proxySOCKS5}, func(conn net.Conn) {
+			greeting := make([]byte, 3)
+			if _, err := io.ReadFull(conn, greeting); err != nil {
+				return
+			}
+			conn.Write([]byte{socksVersion, socksNoAuth})
+			request := make([]byte, 4+1+len("ssh.example")+2)
+			if _, err := io.ReadFull(conn, request); err == nil {
+				conn.Write([]byte{socksVersion, 5, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+			}
+		}, failure.KindBlockedReset},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := dialTestProxy(t, &test.proxy, "ssh.example:22", test.handler, nil)
+			var typed *failure.Error
+			if !errors.As(err, &typed) || typed.Kind != test.kind {
+				t.Fatalf("error = %v, want a failure of kind %s", err, test.kind)
+			}
+		})
+	}
+}
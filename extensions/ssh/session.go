@@ -0,0 +1,276 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	C "github.com/sagernet/sing-box/constant"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/session"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+	"github.com/UTPBox/utp-core/internal/tenant"
+)
+
+// session returns the SSH client, establishing a new session when there is
+// none. While backing off after failed connects, dials fail at once with the
+// latest error rather than hammering an unreachable server; the background
+// reconnect retries once the backoff expires.
+func (o *Outbound) session(ctx context.Context) (*gossh.Client, error) {
+	o.access.Lock()
+	defer o.access.Unlock()
+	if o.client != nil {
+		return o.client, nil
+	}
+	if wait := time.Until(o.retryAt); wait > 0 {
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("reconnecting in %s: %w", wait.Round(time.Second), o.lastErr))
+	}
+	client, err := o.connect(ctx)
+	if err != nil && ctx.Err() != nil {
+		return nil, err
+	}
+	if err != nil {
+		o.failures++
+		o.retryAt = time.Now().Add(min(minBackoff<<min(o.failures-1, 6), maxBackoff))
+		o.lastErr = err
+		return nil, err
+	}
+	o.failures = 0
+	o.retryAt = time.Time{}
+	o.lastErr = nil
+	o.client = client
+	go o.watch(client)
+	if o.keepaliveInterval > 0 {
+		go o.keepalive(client)
+	}
+	return client, nil
+}
+
+// reconnect re-establishes the session after it dropped, until it succeeds,
+// another dial re-establishes it or the outbound closes
+func (o *Outbound) reconnect() {
+	for {
+		o.access.Lock()
+		established := o.client != nil
+		wait := time.Until(o.retryAt)
+		o.access.Unlock()
+		if established {
+			return
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-o.ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		if o.ctx.Err() != nil {
+			return
+		}
+		if _, err := o.session(o.ctx); err != nil {
+			o.logger.Debug(o.typ, "[", o.tag, "]: reconnect failed: ", err)
+			continue
+		}
+		o.logger.Info(o.typ, "[", o.tag, "]: SSH session re-established")
+		return
+	}
+}
+
+// keepalive sends keepalive requests on client every interval and drops the
+// session once none has been answered for keepaliveMaxMissed intervals.
+// Servers answer the request with a failure, which proves them alive as well.
+func (o *Outbound) keepalive(client *gossh.Client) {
+	ticker := time.NewTicker(o.keepaliveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !o.current(client) {
+			// Closed, or handed to the outbound replacing this one
+			return
+		}
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		timer := time.NewTimer(o.keepaliveInterval * time.Duration(o.keepaliveMaxMissed))
+		select {
+		case err := <-reply:
+			timer.Stop()
+			if err != nil {
+				// The session is gone; watch handles it
+				return
+			}
+		case <-timer.C:
+			o.logger.Info(o.typ, "[", o.tag, "]: ", o.keepaliveMaxMissed, " keepalives unanswered, dropping SSH session")
+			o.drop(client)
+			return
+		}
+	}
+}
+
+// connect reaches the server, through the proxy when one is set, over TLS
+// for ssh-tls and through the DNS tunnel for ssh-dnstt, sends the payload,
+// and runs the SSH key exchange and authentication
+func (o *Outbound) connect(ctx context.Context) (*gossh.Client, error) {
+	conn, err := o.dialServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if o.tlsConfig != nil {
+		tlsConn, err := o.tlsConfig.Handshake(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, failure.Wrap(failure.StageTLS, err)
+		}
+		conn = tlsConn
+	}
+	// The SSH library only bounds handshakes on connections it dials itself
+	conn.SetDeadline(time.Now().Add(C.TCPTimeout))
+	if o.payload != nil {
+		payloadConn, err := o.sendPayload(ctx, conn)
+		if err != nil {
+			conn.Close()
+			return nil, failure.Wrap(failure.StageHandshake, err)
+		}
+		conn = payloadConn
+	}
+	sshConn, channels, requests, err := gossh.NewClientConn(conn, o.address(), o.config)
+	if err != nil {
+		conn.Close()
+		return nil, failure.Wrap(failure.StageAuth, fmt.Errorf("SSH handshake failed: %w", err))
+	}
+	conn.SetDeadline(time.Time{})
+	return gossh.NewClient(sshConn, channels, requests), nil
+}
+
+func (o *Outbound) dialServer(ctx context.Context) (net.Conn, error) {
+	if o.tunnel != nil {
+		return o.tunnel.DialContext(ctx)
+	}
+	// Channels of many connections share the session, so only QoS rules
+	// matching the outbound apply
+	if proxy := o.opts.Proxy; proxy != nil && o.payload == nil {
+		conn, err := o.guard.DialContext(ctx, o.dialer.For(nil), "tcp", proxy.Server, proxy.Port)
+		if err != nil {
+			return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to dial proxy: %w", err))
+		}
+		tunnel, err := proxyConnect(ctx, conn, proxy, o.address())
+		if err != nil {
+			conn.Close()
+			return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("%s proxy: %w", proxy.Type, err))
+		}
+		return tunnel, nil
+	}
+	server, port := o.opts.Server, o.opts.Port
+	if o.opts.Proxy != nil {
+		// The payload asks the proxy for the server
+		server, port = o.opts.Proxy.Server, o.opts.Proxy.Port
+	}
+	conn, err := o.guard.DialContext(ctx, o.dialer.For(nil), "tcp", server, port)
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to dial server: %w", err))
+	}
+	return conn, nil
+}
+
+// address is the server address the host key callback is given
+func (o *Outbound) address() string {
+	return net.JoinHostPort(o.opts.Server, strconv.Itoa(o.opts.Port))
+}
+
+// watch forgets client once its session drops and re-establishes the
+// session unless the outbound closed or client was no longer its session
+func (o *Outbound) watch(client *gossh.Client) {
+	err := client.Wait()
+	if !o.drop(client) || o.ctx.Err() != nil {
+		return
+	}
+	o.logger.Debug(o.typ, "[", o.tag, "]: SSH session closed: ", err)
+	o.reconnect()
+}
+
+// drop closes client and forgets it if it is still the current session,
+// reporting whether it was
+func (o *Outbound) drop(client *gossh.Client) bool {
+	o.access.Lock()
+	defer o.access.Unlock()
+	current := o.client == client
+	if current {
+		o.client = nil
+	}
+	client.Close()
+	return current
+}
+
+// current reports whether client is the session of the outbound
+func (o *Outbound) current(client *gossh.Client) bool {
+	o.access.Lock()
+	defer o.access.Unlock()
+	return o.client == client
+}
+
+// identity returns the options that identify the session: those of the
+// server, the credentials and the path to the server. Outbounds with equal
+// identities share their session across reloads.
+func (opts SSHOptions) identity() SSHOptions {
+	opts.KeepaliveInterval = 0
+	opts.KeepaliveMaxMissed = 0
+	opts.DNSGuard = dnsguard.Options{}
+	opts.Options = limiter.Options{}
+	opts.Marks = sockopt.Marks{}
+	return opts
+}
+
+// handover is the SSH session of an outbound while it is offered or parked
+// during a reload
+type handover struct {
+	outbound *Outbound
+}
+
+// Close closes the session unless another outbound adopted it
+func (h handover) Close() error {
+	h.outbound.access.Lock()
+	client := h.outbound.client
+	h.outbound.client = nil
+	h.outbound.access.Unlock()
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
+
+// adopt takes over the SSH session of an outbound with the same identity
+// replaced by a reload, so the first dial needs no handshake
+func (o *Outbound) adopt(ctx context.Context, identity any) {
+	o.migration = session.Key(tenant.Scope(ctx, o.typ), identity)
+	previous, loaded := session.Adopt(o.migration)
+	if !loaded {
+		return
+	}
+	h, ok := previous.(handover)
+	if !ok {
+		previous.Close()
+		return
+	}
+	h.outbound.access.Lock()
+	client := h.outbound.client
+	h.outbound.client = nil
+	h.outbound.access.Unlock()
+	if client == nil {
+		return
+	}
+	o.client = client
+	go o.watch(client)
+	if o.keepaliveInterval > 0 {
+		go o.keepalive(client)
+	}
+	o.logger.Info(o.typ, "[", o.tag, "]: reusing SSH session from previous configuration")
+}
@@ -0,0 +1,17 @@
+package statebackup
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// StateBackupOptions defines the configuration for the state-backup service
+type StateBackupOptions struct {
+	Interval       badoption.Duration `json:"interval,omitempty"`        // Time between backups (default 24h)
+	Path           string             `json:"path,omitempty"`            // Directory receiving the backups (default <state directory>/backups)
+	Keep           int                `json:"keep,omitempty"`            // Backups kept in path, oldest removed first (default 7)
+	URL            string             `json:"url,omitempty"`             // HTTPS URL each backup is also PUT to
+	Headers        map[string]string  `json:"headers,omitempty"`         // Headers of the upload, e.g. Authorization
+	Passphrase     string             `json:"passphrase,omitempty"`      // Passphrase encrypting the backups
+	PassphraseFile string             `json:"passphrase_file,omitempty"` // File holding the passphrase, instead of passphrase
+	Detour         string             `json:"detour,omitempty"`          // Outbound used to reach url
+}
@@ -0,0 +1,223 @@
+package statebackup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/json/badoption"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+const (
+	defaultInterval = 24 * time.Hour
+	defaultKeep     = 7
+	retryInterval   = time.Hour
+	uploadTimeout   = time.Minute
+)
+
+// Service periodically writes encrypted backups of the state directory, so
+// WARP identities, host keys, subscriptions and counters survive a
+// reinstall. Backups are restored with utp-core state restore.
+type Service struct {
+	boxService.Adapter
+	ctx        context.Context
+	cancel     context.CancelFunc
+	logger     log.ContextLogger
+	opts       StateBackupOptions
+	dir        string // State directory backed up
+	passphrase string
+	outbounds  adapter.OutboundManager
+}
+
+// NewService creates the state-backup service
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts StateBackupOptions) (adapter.Service, error) {
+	passphrase := opts.Passphrase
+	if opts.PassphraseFile != "" {
+		if passphrase != "" {
+			return nil, fmt.Errorf("state-backup: passphrase and passphrase_file are exclusive")
+		}
+		content, err := os.ReadFile(opts.PassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("state-backup: %w", err)
+		}
+		passphrase = strings.TrimSpace(string(content))
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("state-backup requires passphrase or passphrase_file")
+	}
+	if opts.URL != "" && !strings.HasPrefix(opts.URL, "https://") {
+		return nil, fmt.Errorf("state-backup: url must be an https:// URL")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = badoption.Duration(defaultInterval)
+	}
+	if opts.Keep <= 0 {
+		opts.Keep = defaultKeep
+	}
+	dir := state.PathContext(ctx)
+	if opts.Path == "" {
+		opts.Path = filepath.Join(dir, state.BackupsDir)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Service{
+		Adapter:    boxService.NewAdapter("state-backup", tag),
+		ctx:        ctx,
+		cancel:     cancel,
+		logger:     logger,
+		opts:       opts,
+		dir:        dir,
+		passphrase: passphrase,
+		outbounds:  service.FromContext[adapter.OutboundManager](ctx),
+	}, nil
+}
+
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStarted {
+		return nil
+	}
+	go s.loop()
+	return nil
+}
+
+func (s *Service) Close() error {
+	s.cancel()
+	return nil
+}
+
+// loop takes a backup whenever the newest one in path is older than the
+// interval, so restarts neither skip nor repeat backups
+func (s *Service) loop() {
+	due := time.NewTimer(max(time.Until(s.newest().Add(time.Duration(s.opts.Interval))), 0))
+	defer due.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-due.C:
+			if err := s.backup(); err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
+				s.logger.Warn("back up state: ", err)
+				due.Reset(retryInterval)
+				continue
+			}
+			due.Reset(time.Duration(s.opts.Interval))
+		}
+	}
+}
+
+// backups returns the backups in path, oldest first. Their names sort by
+// time.
+func (s *Service) backups() []string {
+	names, _ := filepath.Glob(filepath.Join(s.opts.Path, "state-*"+state.BackupExtension))
+	slices.Sort(names)
+	return names
+}
+
+// newest returns the time of the newest backup in path, zero without any
+func (s *Service) newest() time.Time {
+	backups := s.backups()
+	if len(backups) == 0 {
+		return time.Time{}
+	}
+	info, err := os.Stat(backups[len(backups)-1])
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// backup writes a backup to path, removes the backups beyond keep and
+// uploads the backup when a url is configured
+func (s *Service) backup() error {
+	content, err := state.Backup(s.dir, s.passphrase)
+	if err != nil {
+		return err
+	}
+	name := state.BackupName(time.Now())
+	if err := os.MkdirAll(s.opts.Path, 0o700); err != nil {
+		return err
+	}
+	path := filepath.Join(s.opts.Path, name)
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		return err
+	}
+	s.logger.Info("state backed up to ", path)
+	if backups := s.backups(); len(backups) > s.opts.Keep {
+		for _, old := range backups[:len(backups)-s.opts.Keep] {
+			os.Remove(old)
+		}
+	}
+	if s.opts.URL != "" {
+		if err := s.upload(name, content); err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+		s.logger.Debug("state backup uploaded")
+	}
+	return nil
+}
+
+// upload PUTs a backup to url, or to the name below it when url ends with
+// a slash
+func (s *Service) upload(name string, content []byte) error {
+	target := s.opts.URL
+	if strings.HasSuffix(target, "/") {
+		target += name
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, uploadTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	for key, value := range s.opts.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := s.client().Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("server answered %s", response.Status)
+	}
+	return nil
+}
+
+// client returns an HTTP client dialing through the detour when one is
+// configured, and directly otherwise
+func (s *Service) client() *http.Client {
+	dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	if s.opts.Detour != "" {
+		dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			outbound, loaded := s.outbounds.Outbound(s.opts.Detour)
+			if !loaded {
+				return nil, fmt.Errorf("detour not found: %s", s.opts.Detour)
+			}
+			return outbound.DialContext(ctx, network, metadata.ParseSocksaddr(address))
+		}
+	}
+	return &http.Client{
+		Timeout:   uploadTimeout,
+		Transport: &http.Transport{DialContext: dial, Proxy: nil},
+	}
+}
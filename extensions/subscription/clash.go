@@ -0,0 +1,247 @@
+package subscription
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseClash converts the "proxies" list of a Clash (Mihomo) profile
+func parseClash(content string) ([]entry, []error, error) {
+	profile, err := parseYAML(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse clash profile: %w", err)
+	}
+	proxies, isList := profile["proxies"].([]any)
+	if !isList {
+		return nil, nil, fmt.Errorf("parse clash profile: missing proxies list")
+	}
+	var (
+		entries []entry
+		skipped []error
+	)
+	for i, item := range proxies {
+		proxy, isMap := item.(map[string]any)
+		if !isMap {
+			skipped = append(skipped, fmt.Errorf("proxies[%d]: not a mapping", i))
+			continue
+		}
+		e, err := parseClashProxy(clashMap(proxy))
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("proxies[%d] %q: %w", i, clashMap(proxy).str("name"), err))
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, skipped, nil
+}
+
+func parseClashProxy(p clashMap) (entry, error) {
+	server := p.str("server")
+	port, err := parsePort(p.str("port"))
+	if err != nil {
+		return entry{}, err
+	}
+	if server == "" {
+		return entry{}, fmt.Errorf("missing server")
+	}
+	e := entry{name: p.str("name")}
+	if e.name == "" {
+		e.name = net.JoinHostPort(server, strconv.Itoa(int(port)))
+	}
+	sni := firstNonEmpty(p.str("servername"), p.str("sni"))
+	insecure := p.boolean("skip-cert-verify")
+
+	switch proxyType := p.str("type"); proxyType {
+	case "ss":
+		e.object = map[string]any{"type": "shadowsocks", "server": server, "server_port": port,
+			"method": p.str("cipher"), "password": p.str("password")}
+		if plugin := p.str("plugin"); plugin != "" {
+			name, opts, err := clashPlugin(plugin, p.sub("plugin-opts"))
+			if err != nil {
+				return entry{}, err
+			}
+			e.object["plugin"] = name
+			e.object["plugin_opts"] = opts
+		}
+	case "vmess", "vless", "trojan":
+		e.object = map[string]any{"type": proxyType, "server": server, "server_port": port}
+		switch proxyType {
+		case "vmess":
+			alterID, _ := strconv.Atoi(p.str("alterId"))
+			e.object["uuid"] = p.str("uuid")
+			e.object["alter_id"] = alterID
+			e.object["security"] = firstNonEmpty(p.str("cipher"), "auto")
+		case "vless":
+			e.object["uuid"] = p.str("uuid")
+			if flow := p.str("flow"); flow != "" {
+				e.object["flow"] = flow
+			}
+		case "trojan":
+			e.object["password"] = p.str("password")
+		}
+		reality := p.sub("reality-opts")
+		if proxyType == "trojan" || p.boolean("tls") || reality != nil {
+			e.object["tls"] = tlsObject(sni, insecure, p.list("alpn"), p.str("client-fingerprint"),
+				reality.str("public-key"), reality.str("short-id"))
+		}
+		transport, err := clashTransport(p)
+		if err != nil {
+			return entry{}, err
+		}
+		if transport != nil {
+			e.object["transport"] = transport
+		}
+	case "hysteria2":
+		e.object = map[string]any{"type": "hysteria2", "server": server, "server_port": port,
+			"password": p.str("password"), "tls": tlsObject(sni, insecure, firstList(p.list("alpn"), []string{"h3"}), "", "", "")}
+		if obfs := p.str("obfs"); obfs != "" {
+			e.object["obfs"] = map[string]any{"type": obfs, "password": p.str("obfs-password")}
+		}
+	case "socks5", "http":
+		e.object = map[string]any{"type": "http", "server": server, "server_port": port}
+		if proxyType == "socks5" {
+			e.object["type"] = "socks"
+			e.object["version"] = "5"
+		}
+		setCredentials(e.object, "username", p.str("username"), p.str("password"))
+		if p.boolean("tls") {
+			e.object["tls"] = tlsObject(sni, insecure, nil, "", "", "")
+		}
+	case "ssh":
+		e.object = map[string]any{"type": "ssh", "server": server, "server_port": port}
+		setCredentials(e.object, "user", p.str("username"), p.str("password"))
+		if key := p.str("private-key"); key != "" {
+			e.object["private_key"] = key
+		}
+		if hostKeys := p.list("host-key"); len(hostKeys) > 0 {
+			e.object["host_key"] = hostKeys
+		}
+	case "wireguard":
+		peer := map[string]any{"address": server, "port": port, "public_key": p.str("public-key"),
+			"allowed_ips": firstList(p.list("allowed-ips"), []string{"0.0.0.0/0", "::/0"})}
+		if reserved := p.list("reserved"); len(reserved) > 0 {
+			values, err := parseReserved(strings.Join(reserved, ","))
+			if err != nil {
+				return entry{}, err
+			}
+			peer["reserved"] = values
+		}
+		if err := setKeepalive(peer, p.str("persistent-keepalive")); err != nil {
+			return entry{}, err
+		}
+		var addresses []string
+		for _, key := range []string{"ip", "ipv6"} {
+			if address := p.str(key); address != "" {
+				if !strings.Contains(address, "/") {
+					if strings.Contains(address, ":") {
+						address += "/128"
+					} else {
+						address += "/32"
+					}
+				}
+				addresses = append(addresses, address)
+			}
+		}
+		e.endpoint = true
+		e.object = map[string]any{"type": "wireguard", "private_key": p.str("private-key"), "address": addresses, "peers": []any{peer}}
+		if mtu := p.str("mtu"); mtu != "" {
+			value, err := strconv.Atoi(mtu)
+			if err != nil {
+				return entry{}, fmt.Errorf("invalid mtu: %s", mtu)
+			}
+			e.object["mtu"] = value
+		}
+	default:
+		return entry{}, fmt.Errorf("unsupported type: %s", proxyType)
+	}
+	return e, nil
+}
+
+func clashTransport(p clashMap) (map[string]any, error) {
+	switch network := p.str("network"); network {
+	case "ws":
+		ws := p.sub("ws-opts")
+		return transportObject("ws", ws.str("path"), ws.sub("headers").str("Host"), "")
+	case "grpc":
+		return transportObject("grpc", "", "", p.sub("grpc-opts").str("grpc-service-name"))
+	case "h2":
+		h2 := p.sub("h2-opts")
+		return transportObject("h2", h2.str("path"), strings.Join(h2.list("host"), ","), "")
+	case "http":
+		// Clash "http" is HTTP/1.1 header obfuscation over plain TCP
+		return nil, fmt.Errorf("unsupported transport: http")
+	default:
+		return transportObject(network, "", "", "")
+	}
+}
+
+// clashPlugin converts Clash plugin-opts to a SIP003 plugin option string
+func clashPlugin(plugin string, opts clashMap) (string, string, error) {
+	switch plugin {
+	case "obfs":
+		options := "obfs=" + opts.str("mode")
+		if host := opts.str("host"); host != "" {
+			options += ";obfs-host=" + host
+		}
+		return "obfs-local", options, nil
+	case "v2ray-plugin":
+		options := []string{"mode=" + firstNonEmpty(opts.str("mode"), "websocket")}
+		if opts.boolean("tls") {
+			options = append(options, "tls")
+		}
+		if host := opts.str("host"); host != "" {
+			options = append(options, "host="+host)
+		}
+		if path := opts.str("path"); path != "" {
+			options = append(options, "path="+path)
+		}
+		return "v2ray-plugin", strings.Join(options, ";"), nil
+	default:
+		return "", "", fmt.Errorf("unsupported plugin: %s", plugin)
+	}
+}
+
+// clashMap reads the string scalars produced by parseYAML
+type clashMap map[string]any
+
+func (m clashMap) str(key string) string {
+	value, _ := m[key].(string)
+	return value
+}
+
+func (m clashMap) boolean(key string) bool {
+	return m.str(key) == "true"
+}
+
+func (m clashMap) sub(key string) clashMap {
+	value, _ := m[key].(map[string]any)
+	return value
+}
+
+// list accepts a YAML list or a comma separated string
+func (m clashMap) list(key string) []string {
+	switch value := m[key].(type) {
+	case []any:
+		var result []string
+		for _, item := range value {
+			if s, isString := item.(string); isString && s != "" {
+				result = append(result, s)
+			}
+		}
+		return result
+	case string:
+		return splitList(value)
+	}
+	return nil
+}
+
+func firstList(values ...[]string) []string {
+	for _, value := range values {
+		if len(value) > 0 {
+			return value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+package subscription
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// SubscriptionOptions defines the configuration for the subscription service
+type SubscriptionOptions struct {
+	URL       string             `json:"url"`                  // Subscription URL (Sing-box JSON, Clash YAML or share links)
+	Interval  badoption.Duration `json:"interval,omitempty"`   // Refresh interval (default 1h)
+	Group     string             `json:"group"`                // Tag of the group the servers are injected into
+	GroupType string             `json:"group_type,omitempty"` // "selector" (default), "urltest" or "load-balance"
+	TagPrefix string             `json:"tag_prefix,omitempty"` // Prefix of the member tags (default "<group>/")
+	Include   string             `json:"include,omitempty"`    // Only import servers whose name matches this regular expression
+	Exclude   string             `json:"exclude,omitempty"`    // Skip servers whose name matches this regular expression
+	Detour    string             `json:"detour,omitempty"`     // Outbound used to fetch the subscription
+	UserAgent string             `json:"user_agent,omitempty"` // User-Agent of the request (default "utp-core")
+}
+
+// Group types
+const (
+	GroupSelector    = "selector"
+	GroupURLTest     = "urltest"
+	GroupLoadBalance = "load-balance"
+)
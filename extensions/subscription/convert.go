@@ -0,0 +1,202 @@
+package subscription
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// entry is a subscription server converted to a Sing-box outbound object,
+// or an endpoint object for WireGuard (WARP)
+type entry struct {
+	name     string
+	object   map[string]any // Sing-box JSON including "type"; the tag is assigned when applied
+	endpoint bool
+}
+
+// Subscription formats
+const (
+	FormatSingBox = "sing-box"
+	FormatClash   = "clash"
+	FormatLinks   = "links"
+)
+
+// defaultKeepalive is the persistent keepalive, in seconds, of imported
+// WireGuard peers that do not set one. Mobile networks drop idle UDP
+// mappings within a minute or two, after which the server cannot reach the
+// client until it sends again.
+const defaultKeepalive = 25
+
+// groupTypes are never imported from a subscription
+var groupTypes = map[string]bool{
+	"direct": true, "block": true, "dns": true, "selector": true, "urltest": true, "load-balance": true,
+}
+
+// parseSubscription detects the format of content and converts its servers.
+// Entries that cannot be converted are skipped and reported in skipped.
+func parseSubscription(content []byte) (format string, entries []entry, skipped []error, err error) {
+	content = bytes.TrimSpace(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf")))
+	switch {
+	case len(content) == 0:
+		return "", nil, nil, fmt.Errorf("empty subscription")
+	case content[0] == '{':
+		entries, skipped, err = parseSingBox(content)
+		return FormatSingBox, entries, skipped, err
+	case bytes.Contains(content, []byte("proxies:")):
+		entries, skipped, err = parseClash(string(content))
+		return FormatClash, entries, skipped, err
+	}
+	if decoded, err := decodeBase64(string(content)); err == nil && bytes.Contains(decoded, []byte("://")) {
+		content = decoded
+	}
+	entries, skipped = parseLinks(string(content))
+	return FormatLinks, entries, skipped, nil
+}
+
+// tlsObject builds a Sing-box outbound "tls" object
+func tlsObject(serverName string, insecure bool, alpn []string, fingerprint string, realityKey string, realityShortID string) map[string]any {
+	object := map[string]any{"enabled": true}
+	if serverName != "" {
+		object["server_name"] = serverName
+	}
+	if insecure {
+		object["insecure"] = true
+	}
+	if len(alpn) > 0 {
+		object["alpn"] = alpn
+	}
+	if fingerprint != "" {
+		object["utls"] = map[string]any{"enabled": true, "fingerprint": fingerprint}
+	}
+	if realityKey != "" {
+		object["reality"] = map[string]any{"enabled": true, "public_key": realityKey, "short_id": realityShortID}
+		if fingerprint == "" {
+			object["utls"] = map[string]any{"enabled": true, "fingerprint": "chrome"}
+		}
+	}
+	return object
+}
+
+// transportObject builds a Sing-box V2Ray "transport" object, or nil for
+// plain TCP
+func transportObject(network string, path string, host string, serviceName string) (map[string]any, error) {
+	switch network {
+	case "", "tcp", "raw":
+		return nil, nil
+	case "ws":
+		object := map[string]any{"type": "ws"}
+		if path != "" {
+			object["path"] = path
+		}
+		if host != "" {
+			object["headers"] = map[string]any{"Host": host}
+		}
+		return object, nil
+	case "grpc":
+		return map[string]any{"type": "grpc", "service_name": serviceName}, nil
+	case "h2", "http":
+		object := map[string]any{"type": "http"}
+		if path != "" {
+			object["path"] = path
+		}
+		if host != "" {
+			object["host"] = splitList(host)
+		}
+		return object, nil
+	case "httpupgrade":
+		object := map[string]any{"type": "httpupgrade"}
+		if path != "" {
+			object["path"] = path
+		}
+		if host != "" {
+			object["host"] = host
+		}
+		return object, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport: %s", network)
+	}
+}
+
+func decodeBase64(value string) ([]byte, error) {
+	value = strings.Join(strings.Fields(value), "")
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(value); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid base64")
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// setKeepalive sets the persistent keepalive of peer from value, in
+// seconds; empty uses defaultKeepalive and 0 disables it
+func setKeepalive(peer map[string]any, value string) error {
+	keepalive := defaultKeepalive
+	if value != "" {
+		n, err := strconv.ParseUint(strings.TrimSuffix(value, "s"), 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid keepalive: %s", value)
+		}
+		keepalive = int(n)
+	}
+	if keepalive > 0 {
+		peer["persistent_keepalive_interval"] = keepalive
+	}
+	return nil
+}
+
+func parsePort(value string) (uint16, error) {
+	port, err := strconv.ParseUint(strings.TrimSpace(value), 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port: %s", value)
+	}
+	return uint16(port), nil
+}
+
+// parseSingBox imports the outbounds and endpoints of a Sing-box
+// configuration, keeping their JSON as is
+func parseSingBox(content []byte) ([]entry, []error, error) {
+	var config struct {
+		Outbounds []map[string]any `json:"outbounds"`
+		Endpoints []map[string]any `json:"endpoints"`
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, nil, fmt.Errorf("parse sing-box configuration: %w", err)
+	}
+	var (
+		entries []entry
+		skipped []error
+	)
+	for i, object := range append(config.Outbounds, config.Endpoints...) {
+		endpoint := i >= len(config.Outbounds)
+		objectType, _ := object["type"].(string)
+		tag, _ := object["tag"].(string)
+		if objectType == "" || groupTypes[objectType] {
+			continue
+		}
+		if tag == "" {
+			skipped = append(skipped, fmt.Errorf("%s without tag", objectType))
+			continue
+		}
+		// Chained servers refer to tags that are renamed when applied
+		if _, hasDetour := object["detour"]; hasDetour {
+			skipped = append(skipped, fmt.Errorf("%q: detour is not supported", tag))
+			continue
+		}
+		delete(object, "tag")
+		entries = append(entries, entry{name: tag, object: object, endpoint: endpoint})
+	}
+	return entries, skipped, nil
+}
@@ -0,0 +1,390 @@
+package subscription
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/json/badoption"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/extensions/group"
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+const (
+	defaultInterval  = time.Hour
+	defaultUserAgent = "utp-core"
+	fetchTimeout     = 30 * time.Second
+	maxContentSize   = 8 << 20
+)
+
+// member is an outbound or endpoint created from the subscription, kept as
+// the JSON it was created from to detect changes
+type member struct {
+	content  string
+	endpoint bool
+}
+
+// Service keeps the members of a group in sync with a subscription. Members
+// are created from the cached copy when the box is built, so route rules and
+// groups referring to the group work from the first connection, and are
+// updated at runtime on every refresh.
+type Service struct {
+	boxService.Adapter
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    log.ContextLogger
+	opts      SubscriptionOptions
+	router    adapter.Router
+	outbounds adapter.OutboundManager
+	endpoints adapter.EndpointManager
+	include   *regexp.Regexp
+	exclude   *regexp.Regexp
+	cachePath string
+	digest    [32]byte // of the applied content
+	fresh     bool     // the applied content was fetched rather than cached
+	members   map[string]member
+	tags      []string // group members, in subscription order
+}
+
+// NewService creates the subscription service and its group
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts SubscriptionOptions) (adapter.Service, error) {
+	if !strings.HasPrefix(opts.URL, "https://") && !strings.HasPrefix(opts.URL, "http://") {
+		return nil, fmt.Errorf("subscription: invalid url: %s", opts.URL)
+	}
+	if opts.Group == "" {
+		return nil, errors.New("subscription: missing group")
+	}
+	switch opts.GroupType {
+	case "":
+		opts.GroupType = GroupSelector
+	case GroupSelector, GroupURLTest, GroupLoadBalance:
+	default:
+		return nil, fmt.Errorf("subscription: unknown group type: %s", opts.GroupType)
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = badoption.Duration(defaultInterval)
+	}
+	if opts.TagPrefix == "" {
+		opts.TagPrefix = opts.Group + "/"
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = defaultUserAgent
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Service{
+		Adapter:   boxService.NewAdapter("subscription", tag),
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    logger,
+		opts:      opts,
+		router:    service.FromContext[adapter.Router](ctx),
+		outbounds: service.FromContext[adapter.OutboundManager](ctx),
+		endpoints: service.FromContext[adapter.EndpointManager](ctx),
+		cachePath: state.PathContext(ctx, "subscriptions", cacheName(opts.URL)),
+		members:   make(map[string]member),
+	}
+	var err error
+	if opts.Include != "" {
+		if s.include, err = regexp.Compile(opts.Include); err != nil {
+			cancel()
+			return nil, fmt.Errorf("subscription: invalid include: %w", err)
+		}
+	}
+	if opts.Exclude != "" {
+		if s.exclude, err = regexp.Compile(opts.Exclude); err != nil {
+			cancel()
+			return nil, fmt.Errorf("subscription: invalid exclude: %w", err)
+		}
+	}
+	if strings.HasPrefix(opts.URL, "http://") {
+		logger.Warn("subscription is fetched over plain HTTP, server credentials are exposed")
+	}
+
+	// Outbounds are not started yet, so a detour cannot fetch before Start
+	content, err := os.ReadFile(s.cachePath)
+	if err != nil && opts.Detour == "" {
+		content, err = s.fetch()
+		s.fresh = err == nil
+	}
+	if err != nil {
+		logger.Warn("subscription unavailable until the first refresh: ", err)
+		content = nil
+	}
+	if err := s.update(content); err != nil {
+		cancel()
+		return nil, fmt.Errorf("subscription: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStarted {
+		return nil
+	}
+	go s.loop()
+	return nil
+}
+
+func (s *Service) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *Service) loop() {
+	if !s.fresh {
+		s.refresh()
+	}
+	ticker := time.NewTicker(time.Duration(s.opts.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.refresh()
+		}
+	}
+}
+
+func (s *Service) refresh() {
+	content, err := s.fetch()
+	if err != nil {
+		if s.ctx.Err() == nil {
+			s.logger.Warn("refresh subscription: ", err)
+		}
+		return
+	}
+	if err := s.update(content); err != nil {
+		s.logger.Error("update subscription: ", err)
+	}
+}
+
+// fetch downloads the subscription and caches it under the state directory
+func (s *Service) fetch() ([]byte, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if s.opts.Detour != "" {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			detour, loaded := s.outbounds.Outbound(s.opts.Detour)
+			if !loaded {
+				return nil, fmt.Errorf("detour not found: %s", s.opts.Detour)
+			}
+			return detour.DialContext(ctx, network, metadata.ParseSocksaddr(address))
+		}
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, fetchTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.opts.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", s.opts.UserAgent)
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, maxContentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxContentSize {
+		return nil, fmt.Errorf("subscription exceeds %d bytes", maxContentSize)
+	}
+	if err := writeCache(s.cachePath, content); err != nil {
+		s.logger.Warn("cache subscription: ", err)
+	}
+	return content, nil
+}
+
+// update converts content and applies it to the group. Unchanged content is
+// ignored; content without usable servers keeps the current members unless
+// there are none yet.
+func (s *Service) update(content []byte) error {
+	digest := sha256.Sum256(content)
+	if content != nil && digest == s.digest {
+		return nil
+	}
+	var entries []entry
+	if content != nil {
+		format, converted, skipped, err := parseSubscription(content)
+		if err != nil {
+			if len(s.tags) > 0 {
+				return err
+			}
+			s.logger.Error("subscription: ", err)
+		}
+		for _, reason := range skipped {
+			s.logger.Debug("skipped server: ", reason)
+		}
+		entries = s.filter(converted)
+		s.logger.Info("subscription (", format, "): ", len(entries), " servers, ", len(skipped), " skipped")
+		if len(entries) == 0 && len(s.tags) > 0 {
+			return errors.New("no usable servers, keeping the current ones")
+		}
+	}
+	s.apply(entries)
+	s.digest = digest
+	return nil
+}
+
+func (s *Service) filter(entries []entry) []entry {
+	return slices.DeleteFunc(entries, func(e entry) bool {
+		return (s.include != nil && !s.include.MatchString(e.name)) || (s.exclude != nil && s.exclude.MatchString(e.name))
+	})
+}
+
+// apply creates new and changed members, points the group at them, then
+// removes the members that left the subscription
+func (s *Service) apply(entries []entry) {
+	next := make(map[string]member)
+	var tags []string
+	for _, e := range entries {
+		tag := s.opts.TagPrefix + e.name
+		for i := 2; next[tag] != (member{}); i++ {
+			tag = s.opts.TagPrefix + e.name + " #" + strconv.Itoa(i)
+		}
+		object := make(map[string]any, len(e.object)+1)
+		for key, value := range e.object {
+			object[key] = value
+		}
+		object["tag"] = tag
+		content, err := json.Marshal(object)
+		if err != nil {
+			s.logger.Warn("server ", e.name, ": ", err)
+			continue
+		}
+		m := member{content: string(content), endpoint: e.endpoint}
+		if s.members[tag] != m {
+			if err := s.create(tag, m); err != nil {
+				s.logger.Warn("server ", e.name, ": ", err)
+				continue
+			}
+		}
+		next[tag] = m
+		tags = append(tags, tag)
+	}
+	if len(tags) == 0 {
+		// Keep the group valid, failing its connections, until servers are available
+		tag := s.opts.TagPrefix + "unavailable"
+		m := member{content: `{"type":"block","tag":` + strconv.Quote(tag) + `}`}
+		if s.members[tag] != m {
+			if err := s.create(tag, m); err != nil {
+				s.logger.Error("create placeholder: ", err)
+				return
+			}
+		}
+		next[tag] = m
+		tags = append(tags, tag)
+	}
+	if !slices.Equal(tags, s.tags) {
+		if err := s.createGroup(tags); err != nil {
+			s.logger.Error("update group: ", err)
+		}
+	}
+	for tag, m := range s.members {
+		if _, kept := next[tag]; !kept {
+			s.remove(tag, m)
+		}
+	}
+	s.members = next
+	s.tags = tags
+}
+
+func (s *Service) create(tag string, m member) error {
+	if previous, loaded := s.members[tag]; loaded && previous.endpoint != m.endpoint {
+		s.remove(tag, previous)
+	}
+	if m.endpoint {
+		var options option.Endpoint
+		if err := options.UnmarshalJSONContext(s.ctx, []byte(m.content)); err != nil {
+			return err
+		}
+		return s.endpoints.Create(s.ctx, s.router, s.logger, tag, options.Type, options.Options)
+	}
+	var options option.Outbound
+	if err := options.UnmarshalJSONContext(s.ctx, []byte(m.content)); err != nil {
+		return err
+	}
+	return s.outbounds.Create(s.ctx, s.router, s.logger, tag, options.Type, options.Options)
+}
+
+func (s *Service) createGroup(tags []string) error {
+	switch s.opts.GroupType {
+	case GroupURLTest:
+		return s.outbounds.Create(s.ctx, s.router, s.logger, s.opts.Group, GroupURLTest,
+			&option.URLTestOutboundOptions{Outbounds: tags})
+	case GroupLoadBalance:
+		return s.outbounds.Create(s.ctx, s.router, s.logger, s.opts.Group, GroupLoadBalance,
+			&group.LoadBalanceOptions{Outbounds: tags})
+	default:
+		options := &option.SelectorOutboundOptions{Outbounds: tags}
+		// Keep the manual selection across updates
+		if current, loaded := s.outbounds.Outbound(s.opts.Group); loaded {
+			if selector, isGroup := current.(adapter.OutboundGroup); isGroup && slices.Contains(tags, selector.Now()) {
+				options.Default = selector.Now()
+			}
+		}
+		return s.outbounds.Create(s.ctx, s.router, s.logger, s.opts.Group, GroupSelector, options)
+	}
+}
+
+func (s *Service) remove(tag string, m member) {
+	if m.endpoint {
+		if err := s.endpoints.Remove(tag); err != nil {
+			s.logger.Debug("remove ", tag, ": ", err)
+		}
+		return
+	}
+	outbound, loaded := s.outbounds.Outbound(tag)
+	if !loaded {
+		return
+	}
+	// The manager keeps the dependencies of replaced groups, so removal
+	// may report a stale dependency; the outbound is unregistered anyway
+	// but left open.
+	if err := s.outbounds.Remove(tag); err != nil {
+		common.Close(outbound)
+	}
+}
+
+// cacheName derives the cache file name from the URL
+func cacheName(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8])
+}
+
+func writeCache(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
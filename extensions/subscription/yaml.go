@@ -0,0 +1,378 @@
+package subscription
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used by Clash subscriptions: block
+// and flow mappings and lists with plain or quoted scalars. Anchors, tags
+// and multi-line scalars are not supported. Scalars are kept as strings;
+// callers convert them when reading fields.
+func parseYAML(content string) (map[string]any, error) {
+	var lines []yamlLine
+	for number, raw := range strings.Split(content, "\n") {
+		text := stripComment(strings.TrimRight(raw, " \t\r"))
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" || strings.HasPrefix(trimmed, "%") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", number+1)
+		}
+		lines = append(lines, yamlLine{number: number + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	p := &yamlParser{lines: lines}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	value, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.index < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.index].number)
+	}
+	document, isMap := value.(map[string]any)
+	if !isMap {
+		return nil, fmt.Errorf("document is not a mapping")
+	}
+	return document, nil
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	index int
+}
+
+func (p *yamlParser) block(indent int) (any, error) {
+	if isListItem(p.lines[p.index].text) {
+		return p.list(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	result := make(map[string]any)
+	for p.index < len(p.lines) {
+		line := p.lines[p.index]
+		if line.indent < indent || (line.indent == indent && isListItem(line.text)) {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+		key, rest, found := splitKey(line.text)
+		if !found {
+			return nil, fmt.Errorf("line %d: expected key: value", line.number)
+		}
+		p.index++
+		if rest != "" {
+			value, err := p.inline(rest, line.number)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = value
+			continue
+		}
+		// Nested block; lists may start at the key's own indentation
+		if p.index < len(p.lines) {
+			next := p.lines[p.index]
+			if next.indent > indent || (next.indent == indent && isListItem(next.text)) {
+				value, err := p.block(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				result[key] = value
+				continue
+			}
+		}
+		result[key] = ""
+	}
+	return result, nil
+}
+
+func (p *yamlParser) list(indent int) ([]any, error) {
+	var result []any
+	for p.index < len(p.lines) {
+		line := p.lines[p.index]
+		if line.indent != indent || !isListItem(line.text) {
+			if line.indent > indent {
+				return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+			}
+			break
+		}
+		content := strings.TrimLeft(line.text[1:], " ")
+		switch {
+		case content == "":
+			p.index++
+			if p.index >= len(p.lines) || p.lines[p.index].indent <= indent {
+				result = append(result, "")
+				continue
+			}
+			value, err := p.block(p.lines[p.index].indent)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		case content[0] != '{' && content[0] != '[' && !isQuoted(content) && hasKey(content):
+			// "- key: value" starts a mapping indented to its first key
+			p.lines[p.index] = yamlLine{number: line.number, indent: indent + len(line.text) - len(content), text: content}
+			value, err := p.mapping(p.lines[p.index].indent)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		default:
+			p.index++
+			value, err := p.inline(content, line.number)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		}
+	}
+	return result, nil
+}
+
+// inline parses a value on the rest of a line. Flow collections may span
+// several lines until their brackets balance.
+func (p *yamlParser) inline(text string, number int) (any, error) {
+	if text[0] != '{' && text[0] != '[' {
+		return unquote(text), nil
+	}
+	for !balanced(text) && p.index < len(p.lines) {
+		text += " " + p.lines[p.index].text
+		p.index++
+	}
+	f := &flowParser{text: text}
+	value, err := f.value()
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", number, err)
+	}
+	f.skipSpace()
+	if f.pos != len(f.text) {
+		return nil, fmt.Errorf("line %d: unexpected %q after flow collection", number, f.text[f.pos:])
+	}
+	return value, nil
+}
+
+// flowParser parses {a: b, c: [d, e]} collections
+type flowParser struct {
+	text string
+	pos  int
+}
+
+func (f *flowParser) value() (any, error) {
+	f.skipSpace()
+	if f.pos >= len(f.text) {
+		return nil, fmt.Errorf("unexpected end of flow collection")
+	}
+	switch f.text[f.pos] {
+	case '{':
+		f.pos++
+		result := make(map[string]any)
+		for {
+			f.skipSpace()
+			if f.consume('}') {
+				return result, nil
+			}
+			key, err := f.scalar(":,}")
+			if err != nil {
+				return nil, err
+			}
+			f.skipSpace()
+			var value any = ""
+			if f.consume(':') {
+				value, err = f.value()
+				if err != nil {
+					return nil, err
+				}
+			}
+			result[key] = value
+			f.skipSpace()
+			if !f.consume(',') && (f.pos >= len(f.text) || f.text[f.pos] != '}') {
+				return nil, fmt.Errorf("expected , or } in flow mapping")
+			}
+		}
+	case '[':
+		f.pos++
+		var result []any
+		for {
+			f.skipSpace()
+			if f.consume(']') {
+				return result, nil
+			}
+			value, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+			f.skipSpace()
+			if !f.consume(',') && (f.pos >= len(f.text) || f.text[f.pos] != ']') {
+				return nil, fmt.Errorf("expected , or ] in flow sequence")
+			}
+		}
+	default:
+		return f.scalar(",}]")
+	}
+}
+
+// scalar reads a quoted scalar or a plain one ending at any of stops
+func (f *flowParser) scalar(stops string) (string, error) {
+	f.skipSpace()
+	if f.pos < len(f.text) && (f.text[f.pos] == '"' || f.text[f.pos] == '\'') {
+		end := closingQuote(f.text, f.pos)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quoted scalar")
+		}
+		value := unquote(f.text[f.pos : end+1])
+		f.pos = end + 1
+		return value, nil
+	}
+	start := f.pos
+	for f.pos < len(f.text) {
+		c := f.text[f.pos]
+		// A colon only ends a key when followed by a space, as in URLs
+		if c == ':' && strings.IndexByte(stops, ':') >= 0 && (f.pos+1 == len(f.text) || f.text[f.pos+1] == ' ') {
+			break
+		}
+		if c != ':' && strings.IndexByte(stops, c) >= 0 {
+			break
+		}
+		f.pos++
+	}
+	return strings.TrimSpace(f.text[start:f.pos]), nil
+}
+
+func (f *flowParser) skipSpace() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *flowParser) consume(c byte) bool {
+	if f.pos < len(f.text) && f.text[f.pos] == c {
+		f.pos++
+		return true
+	}
+	return false
+}
+
+func isListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func isQuoted(text string) bool {
+	return text[0] == '"' || text[0] == '\''
+}
+
+func hasKey(text string) bool {
+	_, _, found := splitKey(text)
+	return found
+}
+
+// splitKey splits "key: value" at the first ": " (or trailing ":") outside
+// quotes
+func splitKey(text string) (string, string, bool) {
+	start := 0
+	if isQuoted(text) {
+		end := closingQuote(text, 0)
+		if end < 0 {
+			return "", "", false
+		}
+		start = end + 1
+	}
+	for i := start; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return unquote(strings.TrimSpace(text[:i])), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// stripComment removes a "#" comment that is outside quotes and preceded by
+// whitespace
+func stripComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.IndexByte(" \t:,[{-", text[i-1]) >= 0 {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return strings.TrimRight(text[:i], " \t")
+		}
+	}
+	return text
+}
+
+// closingQuote returns the index of the quote closing the one at start
+func closingQuote(text string, start int) int {
+	quote := text[start]
+	for i := start + 1; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && quote == '"':
+			i++
+		case text[i] == quote:
+			if quote == '\'' && i+1 < len(text) && text[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// balanced reports whether the flow brackets of text are closed
+func balanced(text string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+func unquote(text string) string {
+	if len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"' {
+		if value, err := strconv.Unquote(text); err == nil {
+			return value
+		}
+		return text[1 : len(text)-1]
+	}
+	if len(text) >= 2 && text[0] == '\'' && text[len(text)-1] == '\'' {
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'")
+	}
+	return text
+}
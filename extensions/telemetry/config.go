@@ -0,0 +1,16 @@
+package telemetry
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// TelemetryOptions defines the configuration for the opt-in telemetry service
+type TelemetryOptions struct {
+	Collector     string             `json:"collector"`                // HTTPS URL receiving the reports
+	Interval      badoption.Duration `json:"interval,omitempty"`       // Time between reports (default 24h)
+	Epsilon       float64            `json:"epsilon,omitempty"`        // Privacy budget spent per report (default 1)
+	Network       string             `json:"network,omitempty"`        // Fixed network label, replacing the lookup (e.g. "AS12345 IR")
+	NetworkLookup string             `json:"network_lookup,omitempty"` // IP-info service giving the ASN and country (default https://ipinfo.io/json)
+	Preview       bool               `json:"preview,omitempty"`        // Log and store reports instead of sending them
+	Detour        string             `json:"detour,omitempty"`         // Outbound used to reach the collector
+}
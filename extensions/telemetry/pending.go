@@ -0,0 +1,191 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+// maxChain bounds the group nesting followed to find the protocol in use
+const maxChain = 8
+
+// Counts are the connection outcomes of one protocol on one network
+type Counts struct {
+	Attempts  int64 `json:"attempts"`
+	Successes int64 `json:"successes"` // Connections that received data
+}
+
+// Pending holds the counts gathered since the last report. It never leaves
+// the device; only the Report built from it is sent.
+type Pending struct {
+	Since    time.Time                    `json:"since"`
+	Networks map[string]map[string]Counts `json:"networks"` // Network label to protocol
+}
+
+// PendingPath is where the pending counts of the tenant of ctx are kept
+// between runs
+func PendingPath(ctx context.Context) string {
+	return state.PathContext(ctx, "telemetry", "pending.json")
+}
+
+// PreviewPath is where preview mode stores the latest report
+func PreviewPath(ctx context.Context) string {
+	return state.PathContext(ctx, "telemetry", "preview.json")
+}
+
+// LoadPending reads the pending counts of the tenant of ctx, or returns
+// empty counts when none were stored
+func LoadPending(ctx context.Context) (*Pending, error) {
+	p := &Pending{Since: time.Now(), Networks: make(map[string]map[string]Counts)}
+	content, err := os.ReadFile(PendingPath(ctx))
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, err
+	}
+	if p.Networks == nil {
+		p.Networks = make(map[string]map[string]Counts)
+	}
+	return p, nil
+}
+
+func (p *Pending) save(ctx context.Context) error {
+	return writeState(PendingPath(ctx), p)
+}
+
+func writeState(path string, value any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0o600)
+}
+
+// counter counts the outcome of routed TCP connections per protocol. UDP has
+// no clear notion of success and is not counted.
+type counter struct {
+	outbounds adapter.OutboundManager
+	network   atomic.Value // string, label of the current network
+
+	access  sync.Mutex
+	pending *Pending
+}
+
+var _ adapter.ConnectionTracker = (*counter)(nil)
+
+func (c *counter) RoutedConnection(ctx context.Context, conn net.Conn, metadata adapter.InboundContext, matchedRule adapter.Rule, matchOutbound adapter.Outbound) net.Conn {
+	protocol := c.protocol(matchOutbound)
+	if protocol == "" {
+		return conn
+	}
+	counted := &countedConn{network: c.currentNetwork(), protocol: protocol, counter: c}
+	counted.CounterConn = bufio.NewInt64CounterConn(conn, nil, []*atomic.Int64{&counted.download})
+	return counted
+}
+
+func (c *counter) RoutedPacketConnection(ctx context.Context, conn N.PacketConn, metadata adapter.InboundContext, matchedRule adapter.Rule, matchOutbound adapter.Outbound) N.PacketConn {
+	return conn
+}
+
+// protocol follows groups to the outbound carrying the connection and
+// returns its type, or "" for outbounds that do not tunnel
+func (c *counter) protocol(outbound adapter.Outbound) string {
+	for range maxChain {
+		if outbound == nil {
+			return ""
+		}
+		group, isGroup := outbound.(adapter.OutboundGroup)
+		if !isGroup {
+			break
+		}
+		outbound, _ = c.outbounds.Outbound(group.Now())
+	}
+	if outbound == nil {
+		return ""
+	}
+	switch outbound.Type() {
+	case C.TypeDirect, C.TypeBlock, C.TypeDNS, C.TypeSelector, C.TypeURLTest, "load-balance":
+		return ""
+	}
+	return outbound.Type()
+}
+
+func (c *counter) currentNetwork() string {
+	if network, ok := c.network.Load().(string); ok {
+		return network
+	}
+	return "AS? ??"
+}
+
+func (c *counter) record(network string, protocol string, success bool) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	protocols := c.pending.Networks[network]
+	if protocols == nil {
+		protocols = make(map[string]Counts)
+		c.pending.Networks[network] = protocols
+	}
+	counts := protocols[protocol]
+	counts.Attempts++
+	if success {
+		counts.Successes++
+	}
+	protocols[protocol] = counts
+}
+
+// snapshot returns a copy of the pending counts
+func (c *counter) snapshot() *Pending {
+	c.access.Lock()
+	defer c.access.Unlock()
+	copied := &Pending{Since: c.pending.Since, Networks: make(map[string]map[string]Counts, len(c.pending.Networks))}
+	for network, protocols := range c.pending.Networks {
+		copied.Networks[network] = make(map[string]Counts, len(protocols))
+		for protocol, counts := range protocols {
+			copied.Networks[network][protocol] = counts
+		}
+	}
+	return copied
+}
+
+// reset starts a new period after a report
+func (c *counter) reset() {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.pending = &Pending{Since: time.Now(), Networks: make(map[string]map[string]Counts)}
+}
+
+type countedConn struct {
+	*bufio.CounterConn
+	network  string
+	protocol string
+	counter  *counter
+	download atomic.Int64
+	once     sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		c.counter.record(c.network, c.protocol, c.download.Load() > 0)
+	})
+	return c.CounterConn.Close()
+}
@@ -0,0 +1,111 @@
+package telemetry
+
+import (
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+)
+
+const (
+	// DefaultEpsilon is the privacy budget of one report. Lower values add
+	// more noise.
+	DefaultEpsilon = 1.0
+	// RateBuckets divide success rates into equal ranges; bucket i covers
+	// [i/RateBuckets, (i+1)/RateBuckets), the last one includes 100%
+	RateBuckets = 5
+	// minAttempts keeps protocols that were barely used out of reports, as
+	// their rate says little and their use alone is identifying
+	minAttempts   = 10
+	reportVersion = 1
+)
+
+// Report is the body sent to the collector. It carries no addresses, tags,
+// destinations, times or counts: per network label, only the success rate
+// bucket of each protocol, perturbed by randomized response.
+type Report struct {
+	Version  int             `json:"version"`
+	Epsilon  float64         `json:"epsilon"` // Budget spent by the whole report
+	Buckets  int             `json:"buckets"`
+	Networks []NetworkReport `json:"networks"`
+}
+
+// NetworkReport holds the protocols used on one network
+type NetworkReport struct {
+	Network   string         `json:"network"`   // ASN and country, e.g. "AS12345 IR"
+	Protocols map[string]int `json:"protocols"` // Protocol to rate bucket
+}
+
+// Report builds the report of the pending counts with the given budget,
+// which is split evenly over the reported protocols. Each bucket is kept
+// with probability e^ε/(e^ε+k-1) and otherwise replaced by another bucket
+// chosen uniformly, so collectors can estimate the distribution of rates
+// over many reports but learn little from any single one.
+func (p *Pending) Report(epsilon float64) Report {
+	report := Report{
+		Version:  reportVersion,
+		Epsilon:  epsilon,
+		Buckets:  RateBuckets,
+		Networks: []NetworkReport{},
+	}
+	var entries int
+	for _, protocols := range p.Networks {
+		for _, counts := range protocols {
+			if counts.Attempts >= minAttempts {
+				entries++
+			}
+		}
+	}
+	if entries == 0 {
+		return report
+	}
+	share := epsilon / float64(entries)
+	for _, network := range slices.Sorted(maps.Keys(p.Networks)) {
+		item := NetworkReport{Network: network, Protocols: make(map[string]int)}
+		for protocol, counts := range p.Networks[network] {
+			if counts.Attempts < minAttempts {
+				continue
+			}
+			item.Protocols[protocol] = randomizedResponse(rateBucket(counts), share)
+		}
+		if len(item.Protocols) > 0 {
+			report.Networks = append(report.Networks, item)
+		}
+	}
+	return report
+}
+
+// Empty reports whether the report carries no protocol
+func (r Report) Empty() bool {
+	return len(r.Networks) == 0
+}
+
+func rateBucket(counts Counts) int {
+	rate := float64(counts.Successes) / float64(counts.Attempts)
+	return min(int(rate*RateBuckets), RateBuckets-1)
+}
+
+func randomizedResponse(bucket int, epsilon float64) int {
+	keep := math.Exp(epsilon) / (math.Exp(epsilon) + RateBuckets - 1)
+	if rand.Float64() < keep {
+		return bucket
+	}
+	other := rand.IntN(RateBuckets - 1)
+	if other >= bucket {
+		other++
+	}
+	return other
+}
+
+// parseNetwork reduces an IP-info answer to its ASN and country
+func parseNetwork(org string, country string) string {
+	asn, _, _ := strings.Cut(strings.TrimSpace(org), " ")
+	if !strings.HasPrefix(asn, "AS") {
+		asn = "AS?"
+	}
+	if len(country) != 2 {
+		country = "??"
+	}
+	return asn + " " + strings.ToUpper(country)
+}
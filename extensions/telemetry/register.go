@@ -0,0 +1,4 @@
+package telemetry
+
+// Note: Registration is handled in cmd/utp-core/main.go alongside the
+// extension inbounds and outbounds.
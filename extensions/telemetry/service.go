@@ -0,0 +1,237 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/json/badoption"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+)
+
+const (
+	defaultInterval      = 24 * time.Hour
+	defaultNetworkLookup = "https://ipinfo.io/json"
+	lookupInterval       = time.Hour
+	saveInterval         = 10 * time.Minute
+	requestTimeout       = 30 * time.Second
+)
+
+// Service counts protocol outcomes and periodically reports noised success
+// rates to the collector. Nothing is counted or sent unless the service is
+// configured.
+type Service struct {
+	boxService.Adapter
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    log.ContextLogger
+	opts      TelemetryOptions
+	outbounds adapter.OutboundManager
+	counter   *counter
+}
+
+// NewService creates the telemetry service
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts TelemetryOptions) (adapter.Service, error) {
+	if !strings.HasPrefix(opts.Collector, "https://") {
+		return nil, fmt.Errorf("telemetry collector must be an https:// URL")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = badoption.Duration(defaultInterval)
+	}
+	if opts.Epsilon <= 0 {
+		opts.Epsilon = DefaultEpsilon
+	}
+	if opts.NetworkLookup == "" {
+		opts.NetworkLookup = defaultNetworkLookup
+	}
+	pending, err := LoadPending(ctx)
+	if err != nil {
+		logger.Warn("discard unreadable telemetry counts: ", err)
+		pending = &Pending{Since: time.Now(), Networks: make(map[string]map[string]Counts)}
+	}
+	outbounds := service.FromContext[adapter.OutboundManager](ctx)
+	c := &counter{outbounds: outbounds, pending: pending}
+	if opts.Network != "" {
+		c.network.Store(opts.Network)
+	}
+	router := service.FromContext[adapter.Router](ctx)
+	if router == nil {
+		return nil, fmt.Errorf("router not found in context")
+	}
+	router.AppendTracker(c)
+	ctx, cancel := context.WithCancel(ctx)
+	return &Service{
+		Adapter:   boxService.NewAdapter("telemetry", tag),
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    logger,
+		opts:      opts,
+		outbounds: outbounds,
+		counter:   c,
+	}, nil
+}
+
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStarted {
+		return nil
+	}
+	if s.opts.Preview {
+		s.logger.Info("telemetry preview mode, reports are stored in ", PreviewPath(s.ctx), " and not sent")
+	}
+	go s.loop()
+	return nil
+}
+
+// Close stores the counts of the current period, which the next run
+// continues
+func (s *Service) Close() error {
+	s.cancel()
+	return s.counter.snapshot().save(s.ctx)
+}
+
+func (s *Service) loop() {
+	if s.opts.Network == "" {
+		s.lookupNetwork()
+	}
+	lookup := time.NewTicker(lookupInterval)
+	defer lookup.Stop()
+	save := time.NewTicker(saveInterval)
+	defer save.Stop()
+	// Time until the period started by the stored counts is due
+	due := time.NewTimer(max(time.Until(s.counter.snapshot().Since.Add(time.Duration(s.opts.Interval))), 0))
+	defer due.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-lookup.C:
+			if s.opts.Network == "" {
+				s.lookupNetwork()
+			}
+		case <-save.C:
+			if err := s.counter.snapshot().save(s.ctx); err != nil {
+				s.logger.Warn("save telemetry counts: ", err)
+			}
+		case <-due.C:
+			if err := s.report(); err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
+				// Keep counting and retry after the next lookup interval
+				s.logger.Warn("send telemetry report: ", err)
+				due.Reset(lookupInterval)
+				continue
+			}
+			due.Reset(time.Duration(s.opts.Interval))
+		}
+	}
+}
+
+// lookupNetwork labels the network the device is on by ASN and country. The
+// lookup goes out directly, as it describes the local network rather than
+// the tunnel.
+func (s *Service) lookupNetwork() {
+	client := s.client(false)
+	ctx, cancel := context.WithTimeout(s.ctx, requestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, s.opts.NetworkLookup, nil)
+	if err != nil {
+		s.logger.Warn("look up network: ", err)
+		return
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		s.logger.Debug("look up network: ", err)
+		return
+	}
+	defer response.Body.Close()
+	var info struct {
+		Org     string `json:"org"`
+		Country string `json:"country"`
+	}
+	if response.StatusCode != http.StatusOK {
+		s.logger.Debug("look up network: ", response.Status)
+		return
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 64<<10)).Decode(&info); err != nil {
+		s.logger.Debug("look up network: ", err)
+		return
+	}
+	network := parseNetwork(info.Org, info.Country)
+	if previous := s.counter.currentNetwork(); previous != network {
+		s.logger.Debug("telemetry network: ", network)
+	}
+	s.counter.network.Store(network)
+}
+
+// report sends the noised report of the current period and starts a new
+// one. In preview mode the report is logged and stored instead.
+func (s *Service) report() error {
+	report := s.counter.snapshot().Report(s.opts.Epsilon)
+	if report.Empty() {
+		s.counter.reset()
+		return nil
+	}
+	content, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if s.opts.Preview {
+		s.logger.Info("telemetry preview: ", string(content))
+		if err := writeState(PreviewPath(s.ctx), report); err != nil {
+			return err
+		}
+		s.counter.reset()
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, requestTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.Collector, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := s.client(true).Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", response.Status)
+	}
+	s.logger.Debug("telemetry report sent")
+	s.counter.reset()
+	return nil
+}
+
+// client returns an HTTP client dialing through the detour when detour is
+// set and one is configured, and directly otherwise
+func (s *Service) client(detour bool) *http.Client {
+	dial := func(ctx context.Context, network string, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	if detour && s.opts.Detour != "" {
+		dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			outbound, loaded := s.outbounds.Outbound(s.opts.Detour)
+			if !loaded {
+				return nil, fmt.Errorf("detour not found: %s", s.opts.Detour)
+			}
+			return outbound.DialContext(ctx, network, metadata.ParseSocksaddr(address))
+		}
+	}
+	return &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &http.Transport{DialContext: dial, Proxy: nil},
+	}
+}
@@ -0,0 +1,13 @@
+package timesync
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// TimeSyncOptions defines the configuration for the time-sync service
+type TimeSyncOptions struct {
+	Sources   []string           `json:"sources,omitempty"`   // HTTPS URLs whose Date header is trusted (default: Google, Cloudflare, Apple, Microsoft)
+	Interval  badoption.Duration `json:"interval,omitempty"`  // Time between measurements (default 1h)
+	Threshold badoption.Duration `json:"threshold,omitempty"` // Skew below which the clock is left alone (default 2s)
+	Detour    string             `json:"detour,omitempty"`    // Outbound used to reach the sources
+}
@@ -0,0 +1,126 @@
+package timesync
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	boxService "github.com/sagernet/sing-box/adapter/service"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/json/badoption"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/clock"
+)
+
+const (
+	defaultInterval  = time.Hour
+	defaultThreshold = 2 * time.Second
+	measureTimeout   = 10 * time.Second
+)
+
+// Service measures the skew of the system clock against HTTPS time sources
+// and corrects the clock used by handshakes (see internal/clock)
+type Service struct {
+	boxService.Adapter
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    log.ContextLogger
+	opts      TimeSyncOptions
+	outbounds adapter.OutboundManager
+}
+
+// NewService creates the time-sync service
+func NewService(ctx context.Context, logger log.ContextLogger, tag string, opts TimeSyncOptions) (adapter.Service, error) {
+	if len(opts.Sources) == 0 {
+		opts.Sources = clock.DefaultSources
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = badoption.Duration(defaultInterval)
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = badoption.Duration(defaultThreshold)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &Service{
+		Adapter:   boxService.NewAdapter("time-sync", tag),
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    logger,
+		opts:      opts,
+		outbounds: service.FromContext[adapter.OutboundManager](ctx),
+	}, nil
+}
+
+// Start measures once before the instance reports started, so the first
+// handshakes already use the corrected clock, then keeps measuring in the
+// background. A failed measurement keeps the previous correction.
+func (s *Service) Start(stage adapter.StartStage) error {
+	if stage != adapter.StartStateStart {
+		return nil
+	}
+	s.synchronize()
+	go s.loop()
+	return nil
+}
+
+func (s *Service) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *Service) loop() {
+	ticker := time.NewTicker(time.Duration(s.opts.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.synchronize()
+		}
+	}
+}
+
+func (s *Service) synchronize() {
+	ctx, cancel := context.WithTimeout(s.ctx, measureTimeout)
+	defer cancel()
+	offset, samples, err := clock.Measure(ctx, s.dial, s.opts.Sources)
+	for _, sample := range samples {
+		s.logger.Debug("time source ", sample.Source, ": offset ", sample.Offset.Round(time.Millisecond), ", rtt ", sample.RTT.Round(time.Millisecond))
+	}
+	if err != nil {
+		if s.ctx.Err() == nil {
+			s.logger.Warn("measure clock skew: ", err)
+		}
+		return
+	}
+	if offset.Abs() < time.Duration(s.opts.Threshold) {
+		offset = 0
+	}
+	previous := clock.Offset()
+	clock.SetOffset(offset)
+	switch {
+	case offset > 0 && (previous-offset).Abs() >= time.Duration(s.opts.Threshold):
+		s.logger.Warn("system clock is ", offset.Round(time.Second), " behind, correcting handshakes")
+	case offset < 0 && (previous-offset).Abs() >= time.Duration(s.opts.Threshold):
+		s.logger.Warn("system clock is ", (-offset).Round(time.Second), " ahead, correcting handshakes")
+	case offset == 0 && previous != 0:
+		s.logger.Info("system clock is accurate again")
+	}
+}
+
+func (s *Service) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	if s.opts.Detour == "" {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+	detour, loaded := s.outbounds.Outbound(s.opts.Detour)
+	if !loaded {
+		return nil, fmt.Errorf("detour not found: %s", s.opts.Detour)
+	}
+	return detour.DialContext(ctx, network, metadata.ParseSocksaddr(address))
+}
@@ -0,0 +1,205 @@
+package udp2raw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+)
+
+var errPermission = errors.New("raw sockets need root or CAP_NET_RAW (and CAP_NET_ADMIN for auto_rule)")
+
+var _ adapter.Outbound = (*Outbound)(nil)
+
+// Outbound tunnels UDP through a udp2raw server, disguised as a TCP
+// connection (faketcp) or as ICMP echoes. The packets are written to raw
+// sockets, so the outbound needs raw socket privileges and Linux. The
+// server relays every datagram to the single remote address it is
+// configured with (its -r option), typically a WireGuard or game server.
+type Outbound struct {
+	tag     string
+	opts    UDP2RawOptions
+	logger  log.ContextLogger
+	codec   *codec
+	limiter *limiter.Limiter
+	guard   *dnsguard.Guard
+
+	access  sync.Mutex
+	session *session
+}
+
+// dialOptions are the options of the raw sockets
+type dialOptions struct {
+	tag      string
+	marks    sockopt.Marks
+	autoRule bool
+}
+
+// NewOutbound creates a new udp2raw outbound
+func NewOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts UDP2RawOptions) (adapter.Outbound, error) {
+	if opts.Server == "" || opts.Port == 0 {
+		return nil, fmt.Errorf("udp2raw requires server and port")
+	}
+	if opts.Key == "" {
+		return nil, fmt.Errorf("udp2raw requires key")
+	}
+	switch opts.Mode {
+	case "":
+		opts.Mode = ModeFakeTCP
+	case ModeFakeTCP, ModeICMP:
+	default:
+		return nil, fmt.Errorf("udp2raw: unknown mode %q: expected faketcp or icmp", opts.Mode)
+	}
+	if opts.AutoRule && opts.Mode != ModeFakeTCP {
+		return nil, fmt.Errorf("udp2raw: auto_rule only applies to faketcp mode")
+	}
+	codec, err := newCodec(opts.Key, opts.CipherMode, opts.AuthMode)
+	if err != nil {
+		return nil, fmt.Errorf("udp2raw: %w", err)
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("udp2raw: %w", err)
+	}
+	guard, err := dnsguard.New(ctx, opts.DNSGuard)
+	if err != nil {
+		return nil, err
+	}
+	return &Outbound{
+		tag:     tag,
+		opts:    opts,
+		logger:  logger,
+		codec:   codec,
+		limiter: limiter.New(opts.Options),
+		guard:   guard,
+	}, nil
+}
+
+func (o *Outbound) Type() string {
+	return "udp2raw"
+}
+
+func (o *Outbound) Tag() string {
+	return o.tag
+}
+
+func (o *Outbound) Dependencies() []string {
+	return nil
+}
+
+func (o *Outbound) Network() []string {
+	return []string{"udp"}
+}
+
+// Start checks for raw socket privileges. Without them the instance still
+// starts and connections through the outbound fail with the reason.
+func (o *Outbound) Start() error {
+	if err := checkRaw(); err != nil {
+		o.logger.Warn("udp2raw[", o.tag, "]: ", err)
+	}
+	return nil
+}
+
+func (o *Outbound) Close() error {
+	o.access.Lock()
+	defer o.access.Unlock()
+	if o.session != nil {
+		o.session.close(net.ErrClosed)
+		o.session = nil
+	}
+	return nil
+}
+
+func (o *Outbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	return nil, fmt.Errorf("udp2raw outbound does not support TCP")
+}
+
+// ListenPacket starts a conversation in the session with the server,
+// connecting first if there is none
+func (o *Outbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	release, err := o.limiter.Acquire(ctx)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	conn, err := o.listen(ctx, destination)
+	if err != nil {
+		release()
+		o.logger.Debug("udp2raw[", o.tag, "]: server ", o.opts.Server, ":", o.opts.Port, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, err)
+	}
+	return limiter.WrapPacketConn(conn, release), nil
+}
+
+func (o *Outbound) listen(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	for attempt := 0; ; attempt++ {
+		s, err := o.currentSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if conn := s.open(destination); conn != nil {
+			return conn, nil
+		}
+		if attempt > 0 {
+			return nil, failure.Wrap(failure.StageConnect, s.err)
+		}
+	}
+}
+
+// currentSession returns the session with the server, establishing a new
+// one when it closed
+func (o *Outbound) currentSession(ctx context.Context) (*session, error) {
+	o.access.Lock()
+	defer o.access.Unlock()
+	if o.session != nil && !o.session.closed() {
+		return o.session, nil
+	}
+	server, err := o.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dialOpts := dialOptions{tag: o.tag, marks: o.opts.Marks, autoRule: o.opts.AutoRule}
+	var t transport
+	if o.opts.Mode == ModeICMP {
+		t, err = newICMPEcho(ctx, server.Addr(), dialOpts)
+	} else {
+		t, err = newFakeTCP(ctx, server, dialOpts)
+	}
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, err)
+	}
+	s, err := newSession(ctx, t, o.codec)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	o.session = s
+	return s, nil
+}
+
+// resolve returns the address of the server; raw packets need an IP
+func (o *Outbound) resolve(ctx context.Context) (netip.AddrPort, error) {
+	var addrs []netip.Addr
+	var err error
+	if o.guard != nil {
+		addrs, err = o.guard.Resolve(ctx, o.opts.Server)
+	} else {
+		addrs, err = net.DefaultResolver.LookupNetIP(ctx, "ip", o.opts.Server)
+	}
+	if err != nil {
+		return netip.AddrPort{}, failure.Wrap(failure.StageConnect, err)
+	}
+	if len(addrs) == 0 {
+		return netip.AddrPort{}, failure.Wrap(failure.StageConnect, fmt.Errorf("no address for %s", o.opts.Server))
+	}
+	return netip.AddrPortFrom(addrs[0].Unmap(), uint16(o.opts.Port)), nil
+}
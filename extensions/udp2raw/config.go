@@ -0,0 +1,23 @@
+package udp2raw
+
+import (
+	"github.com/UTPBox/utp-core/internal/dnsguard"
+	"github.com/UTPBox/utp-core/internal/limiter"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+)
+
+// UDP2RawOptions defines the configuration for the udp2raw outbound
+type UDP2RawOptions struct {
+	Server     string `json:"server"`                // Server hostname or IP
+	Port       int    `json:"port"`                  // Server port
+	Key        string `json:"key"`                   // Shared key (-k)
+	Mode       string `json:"mode,omitempty"`        // faketcp (default) or icmp (--raw-mode)
+	CipherMode string `json:"cipher_mode,omitempty"` // aes128cbc (default), xor or none
+	AuthMode   string `json:"auth_mode,omitempty"`   // md5 (default), hmac_sha1 or none
+	AutoRule   bool   `json:"auto_rule,omitempty"`   // Add the iptables rule dropping kernel resets in faketcp mode (-a)
+
+	DNSGuard dnsguard.Options `json:"dns_guard,omitempty"` // Reject poisoned server addresses and re-resolve securely
+
+	limiter.Options // max_connections / max_pending_dials
+	sockopt.Marks   // dscp / tos / socket_priority
+}
@@ -0,0 +1,304 @@
+package udp2raw
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Cipher and auth modes, named as udp2raw's --cipher-mode and --auth-mode
+const (
+	CipherAES128CBC = "aes128cbc"
+	CipherXOR       = "xor"
+	CipherNone      = "none"
+
+	AuthMD5      = "md5"
+	AuthHMACSHA1 = "hmac_sha1"
+	AuthNone     = "none"
+)
+
+// Message types of established connections
+const (
+	typeBare      = 'b' // Handshake, before the ids are agreed
+	typeHeartbeat = 'h'
+	typeData      = 'd' // Conversation id followed by a datagram
+)
+
+// Key derivation of udp2raw: the legacy key for md5 auth, and per-direction
+// cipher and HMAC keys expanded from PBKDF2 for hmac_sha1
+const (
+	legacyKeySuffix = "key1"
+	pbkdf2Salt      = "udp2raw_salt1"
+	pbkdf2Rounds    = 10000
+	hmacKeySize     = 20
+)
+
+// Sizes of the message headers
+const (
+	bareHeaderSize  = 8 + 8 + 1         // IV, padding, type
+	saferHeaderSize = 4 + 4 + 8 + 1 + 1 // Ids, sequence, type, roller
+)
+
+var errAuth = errors.New("authentication failed")
+
+// codec encrypts and authenticates messages in the client direction and
+// opens those of the server
+type codec struct {
+	cipher string
+	auth   string
+
+	legacyKey     []byte // md5(key + "key1"), the cipher key without hmac_sha1
+	cipherEncrypt []byte
+	cipherDecrypt []byte
+	hmacEncrypt   []byte
+	hmacDecrypt   []byte
+}
+
+func newCodec(key string, cipherMode string, authMode string) (*codec, error) {
+	switch cipherMode {
+	case "":
+		cipherMode = CipherAES128CBC
+	case CipherAES128CBC, CipherXOR, CipherNone:
+	default:
+		return nil, fmt.Errorf("unknown cipher_mode %q", cipherMode)
+	}
+	switch authMode {
+	case "":
+		authMode = AuthMD5
+	case AuthMD5, AuthHMACSHA1, AuthNone:
+	default:
+		return nil, fmt.Errorf("unknown auth_mode %q", authMode)
+	}
+	legacyKey := md5.Sum([]byte(key + legacyKeySuffix))
+	salt := md5.Sum([]byte(pbkdf2Salt))
+	master := pbkdf2.Key([]byte(key), salt[:], pbkdf2Rounds, 32, sha256.New)
+	return &codec{
+		cipher:        cipherMode,
+		auth:          authMode,
+		legacyKey:     legacyKey[:],
+		cipherEncrypt: expand(master, "cipher_key client-->server", aes.BlockSize),
+		cipherDecrypt: expand(master, "cipher_key server-->client", aes.BlockSize),
+		hmacEncrypt:   expand(master, "hmac_key client-->server", hmacKeySize),
+		hmacDecrypt:   expand(master, "hmac_key server-->client", hmacKeySize),
+	}, nil
+}
+
+func expand(master []byte, info string, size int) []byte {
+	key := make([]byte, size)
+	io.ReadFull(hkdf.Expand(sha256.New, master, []byte(info)), key)
+	return key
+}
+
+// seal encrypts a message. hmac_sha1 authenticates the ciphertext with the
+// directional keys; the other modes append their digest to the plaintext.
+func (c *codec) seal(message []byte) []byte {
+	if c.auth == AuthHMACSHA1 {
+		sealed := c.encrypt(message, c.cipherEncrypt)
+		mac := hmac.New(sha1.New, c.hmacEncrypt)
+		mac.Write(sealed)
+		return mac.Sum(sealed)
+	}
+	if c.auth == AuthMD5 {
+		digest := md5.Sum(message)
+		message = append(message[:len(message):len(message)], digest[:]...)
+	}
+	return c.encrypt(message, c.legacyKey)
+}
+
+func (c *codec) open(packet []byte) ([]byte, error) {
+	if c.auth == AuthHMACSHA1 {
+		if len(packet) < sha1.Size {
+			return nil, errAuth
+		}
+		sealed := packet[:len(packet)-sha1.Size]
+		mac := hmac.New(sha1.New, c.hmacDecrypt)
+		mac.Write(sealed)
+		if !hmac.Equal(mac.Sum(nil), packet[len(sealed):]) {
+			return nil, errAuth
+		}
+		return c.decrypt(sealed, c.cipherDecrypt)
+	}
+	message, err := c.decrypt(packet, c.legacyKey)
+	if err != nil {
+		return nil, err
+	}
+	if c.auth == AuthMD5 {
+		if len(message) < md5.Size {
+			return nil, errAuth
+		}
+		body := message[:len(message)-md5.Size]
+		digest := md5.Sum(body)
+		if !bytes.Equal(digest[:], message[len(body):]) {
+			return nil, errAuth
+		}
+		message = body
+	}
+	return message, nil
+}
+
+// encrypt applies the cipher. aes128cbc pads to the block size with the
+// padding length in the last byte and uses a zero IV, as udp2raw does; the
+// random or sequence-numbered header makes the first block unique.
+func (c *codec) encrypt(message []byte, key []byte) []byte {
+	switch c.cipher {
+	case CipherAES128CBC:
+		padding := aes.BlockSize - len(message)%aes.BlockSize
+		padded := make([]byte, len(message)+padding)
+		copy(padded, message)
+		padded[len(padded)-1] = byte(padding)
+		block, _ := aes.NewCipher(key)
+		cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(padded, padded)
+		return padded
+	case CipherXOR:
+		sealed := make([]byte, len(message))
+		for i := range message {
+			sealed[i] = message[i] ^ key[i%len(key)]
+		}
+		return sealed
+	default:
+		return append([]byte(nil), message...)
+	}
+}
+
+func (c *codec) decrypt(packet []byte, key []byte) ([]byte, error) {
+	switch c.cipher {
+	case CipherAES128CBC:
+		if len(packet) == 0 || len(packet)%aes.BlockSize != 0 {
+			return nil, errAuth
+		}
+		message := make([]byte, len(packet))
+		block, _ := aes.NewCipher(key)
+		cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(message, packet)
+		padding := int(message[len(message)-1])
+		if padding == 0 || padding > aes.BlockSize {
+			return nil, errAuth
+		}
+		return message[:len(message)-padding], nil
+	default:
+		// XOR is its own inverse
+		return c.encrypt(packet, key), nil
+	}
+}
+
+// sealBare builds a handshake message: random IV and padding, then the
+// type and the three ids (own, peer, constant)
+func (c *codec) sealBare(id uint32, peer uint32, constant uint32) []byte {
+	message := make([]byte, bareHeaderSize, bareHeaderSize+12)
+	rand.Read(message[:16])
+	message[16] = typeBare
+	message = binary.BigEndian.AppendUint32(message, id)
+	message = binary.BigEndian.AppendUint32(message, peer)
+	message = binary.BigEndian.AppendUint32(message, constant)
+	return c.seal(message)
+}
+
+// openBare returns the ids of a handshake message
+func openBare(message []byte) (id uint32, peer uint32, constant uint32, ok bool) {
+	if len(message) < bareHeaderSize+12 || message[16] != typeBare {
+		return 0, 0, 0, false
+	}
+	ids := message[bareHeaderSize:]
+	return binary.BigEndian.Uint32(ids), binary.BigEndian.Uint32(ids[4:]), binary.BigEndian.Uint32(ids[8:]), true
+}
+
+// saferHeader starts the messages of an established connection
+type saferHeader struct {
+	id     uint32 // Sender id
+	peer   uint32 // Receiver id
+	seq    uint64 // Anti-replay sequence number
+	kind   byte
+	roller byte // Last roller received from the peer
+}
+
+func (c *codec) sealSafer(header saferHeader, payload []byte) []byte {
+	message := make([]byte, 0, saferHeaderSize+len(payload))
+	message = binary.BigEndian.AppendUint32(message, header.id)
+	message = binary.BigEndian.AppendUint32(message, header.peer)
+	message = binary.BigEndian.AppendUint64(message, header.seq)
+	message = append(message, header.kind, header.roller)
+	message = append(message, payload...)
+	return c.seal(message)
+}
+
+func openSafer(message []byte) (saferHeader, []byte, bool) {
+	if len(message) < saferHeaderSize {
+		return saferHeader{}, nil, false
+	}
+	return saferHeader{
+		id:     binary.BigEndian.Uint32(message),
+		peer:   binary.BigEndian.Uint32(message[4:]),
+		seq:    binary.BigEndian.Uint64(message[8:]),
+		kind:   message[16],
+		roller: message[17],
+	}, message[saferHeaderSize:], true
+}
+
+// replayWindowSize is the number of sequence numbers behind the highest one
+// received that are still accepted, once each
+const replayWindowSize = 4000
+
+// replayWindow rejects replayed and very late sequence numbers
+type replayWindow struct {
+	highest uint64
+	started bool
+	seen    [(replayWindowSize + 63) / 64]uint64
+}
+
+// accept reports whether seq is new, recording it
+func (w *replayWindow) accept(seq uint64) bool {
+	if !w.started {
+		w.started = true
+		w.highest = seq
+		w.set(seq)
+		return true
+	}
+	if seq > w.highest {
+		if seq-w.highest >= replayWindowSize {
+			w.seen = [len(w.seen)]uint64{}
+		} else {
+			for i := w.highest + 1; i < seq; i++ {
+				w.clear(i)
+			}
+		}
+		w.highest = seq
+		w.set(seq)
+		return true
+	}
+	if w.highest-seq >= replayWindowSize || w.isSet(seq) {
+		return false
+	}
+	w.set(seq)
+	return true
+}
+
+func (w *replayWindow) index(seq uint64) (int, uint64) {
+	bit := seq % (uint64(len(w.seen)) * 64)
+	return int(bit / 64), 1 << (bit % 64)
+}
+
+func (w *replayWindow) set(seq uint64) {
+	word, mask := w.index(seq)
+	w.seen[word] |= mask
+}
+
+func (w *replayWindow) clear(seq uint64) {
+	word, mask := w.index(seq)
+	w.seen[word] &^= mask
+}
+
+func (w *replayWindow) isSet(seq uint64) bool {
+	word, mask := w.index(seq)
+	return w.seen[word]&mask != 0
+}
@@ -0,0 +1,112 @@
+package udp2raw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/UTPBox/utp-core/internal/sockopt"
+)
+
+// checkRaw reports whether this process may open raw sockets
+func checkRaw() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return rawError(err)
+	}
+	syscall.Close(fd)
+	return nil
+}
+
+func rawError(err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return errPermission
+	}
+	return err
+}
+
+// listenRaw opens a raw socket for protocol (tcp or icmp) bound to local.
+// The kernel adds the IP header of sent packets, and Go strips the one of
+// received IPv4 packets.
+func listenRaw(ctx context.Context, protocol string, local netip.Addr, opts dialOptions) (*net.IPConn, error) {
+	network := "ip4:" + protocol
+	if local.Is6() {
+		network = "ip6:" + protocol
+		if protocol == "icmp" {
+			network = "ip6:ipv6-icmp"
+		}
+	}
+	// The socket carries every connection of the outbound
+	listenConfig := net.ListenConfig{Control: sockopt.Dialer(opts.tag, nil, opts.marks).Control}
+	conn, err := listenConfig.ListenPacket(ctx, network, local.String())
+	if err != nil {
+		return nil, rawError(err)
+	}
+	return conn.(*net.IPConn), nil
+}
+
+// reservePort binds a TCP socket to a free port of local, so the kernel
+// hands the port to no other connection while the fake one uses it
+func reservePort(local netip.Addr) (uint16, io.Closer, error) {
+	family := syscall.AF_INET
+	var sockaddr syscall.Sockaddr = &syscall.SockaddrInet4{Addr: local.As4()}
+	if local.Is6() {
+		family = syscall.AF_INET6
+		sockaddr = &syscall.SockaddrInet6{Addr: local.As16()}
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := syscall.Bind(fd, sockaddr); err != nil {
+		syscall.Close(fd)
+		return 0, nil, fmt.Errorf("reserve local port: %w", err)
+	}
+	bound, err := syscall.Getsockname(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return 0, nil, err
+	}
+	var port int
+	switch addr := bound.(type) {
+	case *syscall.SockaddrInet4:
+		port = addr.Port
+	case *syscall.SockaddrInet6:
+		port = addr.Port
+	}
+	return uint16(port), fdCloser(fd), nil
+}
+
+type fdCloser int
+
+func (fd fdCloser) Close() error {
+	return syscall.Close(int(fd))
+}
+
+// dropResets adds an iptables rule dropping the resets the kernel sends in
+// answer to the segments of the fake connection, and returns the function
+// removing it
+func dropResets(local netip.AddrPort, server netip.AddrPort) (func(), error) {
+	command := "iptables"
+	if local.Addr().Is6() {
+		command = "ip6tables"
+	}
+	rule := []string{
+		"OUTPUT", "-p", "tcp",
+		"-s", local.Addr().String(), "--sport", strconv.Itoa(int(local.Port())),
+		"-d", server.Addr().String(), "--dport", strconv.Itoa(int(server.Port())),
+		"--tcp-flags", "RST", "RST", "-j", "DROP",
+	}
+	if output, err := exec.Command(command, append([]string{"-I"}, rule...)...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", command, err, output)
+	}
+	return func() {
+		exec.Command(command, append([]string{"-D"}, rule...)...).Run()
+	}, nil
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package udp2raw
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+)
+
+var errUnsupported = errors.New("udp2raw raw sockets are only supported on Linux")
+
+func checkRaw() error {
+	return errUnsupported
+}
+
+func listenRaw(ctx context.Context, protocol string, local netip.Addr, opts dialOptions) (*net.IPConn, error) {
+	return nil, errUnsupported
+}
+
+func reservePort(local netip.Addr) (uint16, io.Closer, error) {
+	return 0, nil, errUnsupported
+}
+
+func dropResets(local netip.AddrPort, server netip.AddrPort) (func(), error) {
+	return nil, errUnsupported
+}
@@ -0,0 +1,323 @@
+package udp2raw
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+)
+
+const (
+	handshakeTimeout  = 10 * time.Second
+	handshakeInterval = 500 * time.Millisecond
+	heartbeatInterval = 600 * time.Millisecond
+	serverTimeout     = 10 * time.Second // Without messages from the server
+	idleTimeout       = time.Minute      // Without conversations
+	queueSize         = 128              // Datagrams waiting for a slow reader; further ones are dropped
+)
+
+var errIdle = errors.New("session idle")
+
+// session is one udp2raw connection to the server. The packet connections
+// of the outbound are conversations in it: their datagrams carry a
+// conversation id, and the server relays each conversation from its own UDP
+// socket to the remote address it is configured with.
+type session struct {
+	transport transport
+	codec     *codec
+	id        uint32
+	peer      uint32
+	seq       atomic.Uint64
+	roller    atomic.Uint32
+	received  atomic.Int64 // Unix nanoseconds of the last message from the server
+	replay    replayWindow // Used by the handshake, then by the reader only
+
+	access sync.Mutex
+	convs  map[uint32]*packetConn
+	idle   time.Time // Since when there are no conversations
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// newSession opens the raw connection and performs the udp2raw handshake
+func newSession(ctx context.Context, t transport, c *codec) (*session, error) {
+	s := &session{
+		transport: t,
+		codec:     c,
+		id:        rand.Uint32(),
+		convs:     make(map[uint32]*packetConn),
+		idle:      time.Now(),
+		done:      make(chan struct{}),
+	}
+	s.seq.Store(rand.Uint64() / 10)
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	if err := t.handshake(ctx); err != nil {
+		return nil, failure.Wrap(failure.StageConnect, err)
+	}
+	if err := s.handshake(ctx); err != nil {
+		return nil, failure.Wrap(failure.StageHandshake, err)
+	}
+	go s.readLoop()
+	go s.heartbeatLoop()
+	return s, nil
+}
+
+// handshake agrees on the ids of both sides: the server answers the first
+// bare message with its id, and the second one, carrying both ids, with a
+// heartbeat
+func (s *session) handshake(ctx context.Context) error {
+	constant := rand.Uint32()
+	deadline, _ := ctx.Deadline()
+	for time.Now().Before(deadline) {
+		if err := s.transport.write(s.codec.sealBare(s.id, s.peer, constant)); err != nil {
+			return err
+		}
+		readDeadline := time.Now().Add(handshakeInterval)
+		if deadline.Before(readDeadline) {
+			readDeadline = deadline
+		}
+		s.transport.setReadDeadline(readDeadline)
+	receive:
+		for {
+			packet, err := s.transport.read()
+			if errors.Is(err, errReset) {
+				return err
+			}
+			if err != nil {
+				break
+			}
+			message, err := s.codec.open(packet)
+			if err != nil {
+				continue
+			}
+			if s.peer == 0 {
+				if id, peer, _, ok := openBare(message); ok && peer == s.id && id != 0 {
+					s.peer = id
+					break receive
+				}
+				continue
+			}
+			if header, _, ok := openSafer(message); ok && header.id == s.peer && header.peer == s.id && s.replay.accept(header.seq) {
+				s.roller.Store(uint32(header.roller))
+				s.received.Store(time.Now().UnixNano())
+				return s.transport.setReadDeadline(time.Time{})
+			}
+		}
+	}
+	if s.peer == 0 {
+		return fmt.Errorf("no handshake reply from server (check key, cipher_mode and auth_mode)")
+	}
+	return fmt.Errorf("handshake with server timed out")
+}
+
+func (s *session) readLoop() {
+	for {
+		packet, err := s.transport.read()
+		if err != nil {
+			s.close(err)
+			return
+		}
+		message, err := s.codec.open(packet)
+		if err != nil {
+			continue
+		}
+		header, payload, ok := openSafer(message)
+		if !ok || header.id != s.peer || header.peer != s.id || !s.replay.accept(header.seq) {
+			continue
+		}
+		s.received.Store(time.Now().UnixNano())
+		s.roller.Store(uint32(header.roller))
+		if header.kind != typeData || len(payload) < 4 {
+			continue
+		}
+		s.access.Lock()
+		conn := s.convs[binary.BigEndian.Uint32(payload)]
+		s.access.Unlock()
+		if conn != nil {
+			conn.deliver(payload[4:])
+		}
+	}
+}
+
+// heartbeatLoop keeps the session alive, and closes it when the server
+// stops answering or no conversation used it for idleTimeout
+func (s *session) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		if time.Since(time.Unix(0, s.received.Load())) > serverTimeout {
+			s.close(fmt.Errorf("server timed out"))
+			return
+		}
+		s.access.Lock()
+		idle := len(s.convs) == 0 && time.Since(s.idle) > idleTimeout
+		s.access.Unlock()
+		if idle {
+			s.close(errIdle)
+			return
+		}
+		if err := s.send(typeHeartbeat, nil); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *session) send(kind byte, payload []byte) error {
+	return s.transport.write(s.codec.sealSafer(saferHeader{
+		id:     s.id,
+		peer:   s.peer,
+		seq:    s.seq.Add(1),
+		kind:   kind,
+		roller: byte(s.roller.Load()),
+	}, payload))
+}
+
+// open starts a conversation, or returns nil when the session is closed
+func (s *session) open(destination metadata.Socksaddr) *packetConn {
+	s.access.Lock()
+	defer s.access.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	conv := rand.Uint32()
+	for s.convs[conv] != nil {
+		conv = rand.Uint32()
+	}
+	conn := &packetConn{
+		session:     s,
+		conv:        conv,
+		destination: destination,
+		queue:       make(chan []byte, queueSize),
+		done:        make(chan struct{}),
+	}
+	s.convs[conv] = conn
+	return conn
+}
+
+func (s *session) remove(conv uint32) {
+	s.access.Lock()
+	defer s.access.Unlock()
+	delete(s.convs, conv)
+	if len(s.convs) == 0 {
+		s.idle = time.Now()
+	}
+}
+
+func (s *session) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *session) close(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		s.transport.Close()
+	})
+}
+
+// packetConn is one conversation. Datagrams go to the remote address of the
+// server whatever their destination, and replies appear to come from the
+// destination the connection was opened for.
+type packetConn struct {
+	session     *session
+	conv        uint32
+	destination metadata.Socksaddr
+	queue       chan []byte
+	deadline    atomic.Pointer[time.Time]
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *packetConn) deliver(datagram []byte) {
+	select {
+	case c.queue <- datagram:
+	default:
+	}
+}
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if deadline := c.deadline.Load(); deadline != nil && !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(*deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case datagram := <-c.queue:
+		return copy(b, datagram), c.destination, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-c.session.done:
+		return 0, nil, c.session.err
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	case <-c.session.done:
+		return 0, c.session.err
+	default:
+	}
+	payload := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(payload, c.conv)
+	if err := c.session.send(typeData, append(payload, b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *packetConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.session.remove(c.conv)
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *packetConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Store(&t)
+	return nil
+}
+
+func (c *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,426 @@
+package udp2raw
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Raw modes, named as udp2raw's --raw-mode
+const (
+	ModeFakeTCP = "faketcp"
+	ModeICMP    = "icmp"
+)
+
+// TCP flags
+const (
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// ICMP echo types
+const (
+	icmpEchoReply     = 0
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+const (
+	tcpWindow       = 0xffff
+	synInterval     = time.Second
+	maxPacketLength = 65535
+)
+
+var errReset = errors.New("server reset the connection")
+
+// transport carries the messages of one connection in raw packets
+type transport interface {
+	// handshake opens the raw connection (the TCP handshake of faketcp)
+	handshake(ctx context.Context) error
+	write(message []byte) error
+	// read returns the next message from the server, blocking until the
+	// read deadline
+	read() ([]byte, error)
+	setReadDeadline(t time.Time) error
+	io.Closer
+}
+
+// localAddr returns the source address the system routes server through
+func localAddr(server netip.Addr) (netip.Addr, error) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(server, 9)))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+// fakeTCP sends messages as the payload of TCP segments of a connection the
+// kernel knows nothing about. It answers no retransmissions: the segments
+// only need to look like an established connection to middleboxes.
+type fakeTCP struct {
+	conn     *net.IPConn
+	local    netip.AddrPort
+	server   netip.AddrPort
+	reserved io.Closer // Socket holding the local port
+	unrule   func()    // Removes the rule dropping kernel resets, if added
+
+	access sync.Mutex
+	seq    uint32
+	ack    uint32
+	tsBase uint32
+	tsEcr  uint32
+	start  time.Time
+	buffer []byte
+}
+
+func newFakeTCP(ctx context.Context, server netip.AddrPort, opts dialOptions) (*fakeTCP, error) {
+	local, err := localAddr(server.Addr())
+	if err != nil {
+		return nil, err
+	}
+	port, reserved, err := reservePort(local)
+	if err != nil {
+		return nil, err
+	}
+	t := &fakeTCP{
+		local:    netip.AddrPortFrom(local, port),
+		server:   server,
+		reserved: reserved,
+		seq:      rand.Uint32(),
+		tsBase:   rand.Uint32(),
+		start:    time.Now(),
+		buffer:   make([]byte, maxPacketLength),
+	}
+	if opts.autoRule {
+		t.unrule, err = dropResets(t.local, server)
+		if err != nil {
+			reserved.Close()
+			return nil, err
+		}
+	}
+	t.conn, err = listenRaw(ctx, "tcp", local, opts)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *fakeTCP) handshake(ctx context.Context) error {
+	for {
+		if err := t.send(tcpSYN, nil); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(synInterval)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		t.conn.SetReadDeadline(deadline)
+		for {
+			segment, err := t.receive()
+			if errors.Is(err, errReset) {
+				return err
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return fmt.Errorf("no SYN-ACK from server: %w", ctx.Err())
+				}
+				break
+			}
+			if segment.flags&(tcpSYN|tcpACK) == tcpSYN|tcpACK && segment.ack == t.seq+1 {
+				t.access.Lock()
+				t.seq++
+				t.ack = segment.seq + 1
+				t.access.Unlock()
+				t.conn.SetReadDeadline(time.Time{})
+				return t.send(tcpACK, nil)
+			}
+		}
+	}
+}
+
+func (t *fakeTCP) write(message []byte) error {
+	return t.send(tcpPSH|tcpACK, message)
+}
+
+func (t *fakeTCP) send(flags byte, payload []byte) error {
+	t.access.Lock()
+	segment := tcpSegment{
+		srcPort: t.local.Port(),
+		dstPort: t.server.Port(),
+		seq:     t.seq,
+		ack:     t.ack,
+		flags:   flags,
+		tsVal:   t.tsBase + uint32(time.Since(t.start).Milliseconds()),
+		tsEcr:   t.tsEcr,
+		payload: payload,
+	}
+	t.seq += uint32(len(payload))
+	t.access.Unlock()
+	packet := segment.build(t.local.Addr(), t.server.Addr())
+	_, err := t.conn.WriteToIP(packet, &net.IPAddr{IP: t.server.Addr().AsSlice()})
+	return err
+}
+
+func (t *fakeTCP) read() ([]byte, error) {
+	for {
+		segment, err := t.receive()
+		if err != nil {
+			return nil, err
+		}
+		if segment.flags&tcpSYN != 0 {
+			// Our ACK was lost
+			t.send(tcpACK, nil)
+			continue
+		}
+		if len(segment.payload) == 0 {
+			continue
+		}
+		t.access.Lock()
+		if end := segment.seq + uint32(len(segment.payload)); int32(end-t.ack) > 0 {
+			t.ack = end
+		}
+		t.access.Unlock()
+		return segment.payload, nil
+	}
+}
+
+// receive returns the next segment of the connection
+func (t *fakeTCP) receive() (tcpSegment, error) {
+	for {
+		n, addr, err := t.conn.ReadFromIP(t.buffer)
+		if err != nil {
+			return tcpSegment{}, err
+		}
+		source, _ := netip.AddrFromSlice(addr.IP)
+		if source.Unmap() != t.server.Addr() {
+			continue
+		}
+		segment, ok := parseTCP(t.buffer[:n])
+		if !ok || segment.srcPort != t.server.Port() || segment.dstPort != t.local.Port() {
+			continue
+		}
+		if segment.flags&tcpRST != 0 {
+			return tcpSegment{}, errReset
+		}
+		if segment.tsVal != 0 {
+			t.access.Lock()
+			t.tsEcr = segment.tsVal
+			t.access.Unlock()
+		}
+		return segment, nil
+	}
+}
+
+func (t *fakeTCP) setReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *fakeTCP) Close() error {
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	if t.unrule != nil {
+		t.unrule()
+	}
+	return t.reserved.Close()
+}
+
+// tcpSegment is a TCP header with the timestamp option, and its payload
+type tcpSegment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	flags   byte
+	tsVal   uint32
+	tsEcr   uint32
+	payload []byte
+}
+
+// build returns the segment with its checksum. SYNs carry the options of a
+// Linux SYN (MSS, SACK permitted, timestamps, window scale), other segments
+// only timestamps.
+func (s tcpSegment) build(src netip.Addr, dst netip.Addr) []byte {
+	var options []byte
+	if s.flags&tcpSYN != 0 {
+		options = []byte{2, 4, 0x05, 0xb4, 4, 2, 8, 10, 0, 0, 0, 0, 0, 0, 0, 0, 1, 3, 3, 7}
+		binary.BigEndian.PutUint32(options[8:], s.tsVal)
+		binary.BigEndian.PutUint32(options[12:], s.tsEcr)
+	} else {
+		options = []byte{1, 1, 8, 10, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(options[4:], s.tsVal)
+		binary.BigEndian.PutUint32(options[8:], s.tsEcr)
+	}
+	headerLength := 20 + len(options)
+	packet := make([]byte, headerLength, headerLength+len(s.payload))
+	binary.BigEndian.PutUint16(packet, s.srcPort)
+	binary.BigEndian.PutUint16(packet[2:], s.dstPort)
+	binary.BigEndian.PutUint32(packet[4:], s.seq)
+	binary.BigEndian.PutUint32(packet[8:], s.ack)
+	packet[12] = byte(headerLength/4) << 4
+	packet[13] = s.flags
+	binary.BigEndian.PutUint16(packet[14:], tcpWindow)
+	copy(packet[20:], options)
+	packet = append(packet, s.payload...)
+	binary.BigEndian.PutUint16(packet[16:], checksum(packet, pseudoHeaderSum(src, dst, 6, len(packet))))
+	return packet
+}
+
+func parseTCP(packet []byte) (tcpSegment, bool) {
+	if len(packet) < 20 {
+		return tcpSegment{}, false
+	}
+	headerLength := int(packet[12]>>4) * 4
+	if headerLength < 20 || headerLength > len(packet) {
+		return tcpSegment{}, false
+	}
+	segment := tcpSegment{
+		srcPort: binary.BigEndian.Uint16(packet),
+		dstPort: binary.BigEndian.Uint16(packet[2:]),
+		seq:     binary.BigEndian.Uint32(packet[4:]),
+		ack:     binary.BigEndian.Uint32(packet[8:]),
+		flags:   packet[13],
+		payload: packet[headerLength:],
+	}
+	options := packet[20:headerLength]
+	for len(options) > 0 {
+		kind := options[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			break
+		}
+		if kind == 8 && options[1] == 10 {
+			segment.tsVal = binary.BigEndian.Uint32(options[2:])
+			segment.tsEcr = binary.BigEndian.Uint32(options[6:])
+		}
+		options = options[options[1]:]
+	}
+	return segment, true
+}
+
+// icmpEcho sends messages as echo requests and receives the echo replies of
+// the server. The kernel of the server must not answer the requests itself
+// (net.ipv4.icmp_echo_ignore_all=1).
+type icmpEcho struct {
+	conn   *net.IPConn
+	server netip.Addr
+	id     uint16
+
+	access sync.Mutex
+	seq    uint16
+	buffer []byte
+}
+
+func newICMPEcho(ctx context.Context, server netip.Addr, opts dialOptions) (*icmpEcho, error) {
+	local, err := localAddr(server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := listenRaw(ctx, "icmp", local, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &icmpEcho{
+		conn:   conn,
+		server: server,
+		id:     uint16(rand.Uint32()),
+		buffer: make([]byte, maxPacketLength),
+	}, nil
+}
+
+func (t *icmpEcho) handshake(ctx context.Context) error {
+	return nil
+}
+
+func (t *icmpEcho) write(message []byte) error {
+	t.access.Lock()
+	t.seq++
+	seq := t.seq
+	t.access.Unlock()
+	requestType := byte(icmpEchoRequest)
+	if t.server.Is6() {
+		requestType = icmpv6EchoRequest
+	}
+	packet := make([]byte, 8, 8+len(message))
+	packet[0] = requestType
+	binary.BigEndian.PutUint16(packet[4:], t.id)
+	binary.BigEndian.PutUint16(packet[6:], seq)
+	packet = append(packet, message...)
+	if t.server.Is4() {
+		// The kernel computes ICMPv6 checksums
+		binary.BigEndian.PutUint16(packet[2:], checksum(packet, 0))
+	}
+	_, err := t.conn.WriteToIP(packet, &net.IPAddr{IP: t.server.AsSlice()})
+	return err
+}
+
+func (t *icmpEcho) read() ([]byte, error) {
+	replyType := byte(icmpEchoReply)
+	if t.server.Is6() {
+		replyType = icmpv6EchoReply
+	}
+	for {
+		n, addr, err := t.conn.ReadFromIP(t.buffer)
+		if err != nil {
+			return nil, err
+		}
+		source, _ := netip.AddrFromSlice(addr.IP)
+		packet := t.buffer[:n]
+		if source.Unmap() != t.server || len(packet) < 8 || packet[0] != replyType || binary.BigEndian.Uint16(packet[4:]) != t.id {
+			continue
+		}
+		return packet[8:], nil
+	}
+}
+
+func (t *icmpEcho) setReadDeadline(deadline time.Time) error {
+	return t.conn.SetReadDeadline(deadline)
+}
+
+func (t *icmpEcho) Close() error {
+	return t.conn.Close()
+}
+
+// pseudoHeaderSum returns the sum of the pseudo header of a transport
+// checksum
+func pseudoHeaderSum(src netip.Addr, dst netip.Addr, protocol byte, length int) uint32 {
+	var sum uint32
+	for _, addr := range [][]byte{src.AsSlice(), dst.AsSlice()} {
+		for i := 0; i < len(addr); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(addr[i:]))
+		}
+	}
+	return sum + uint32(protocol) + uint32(length)
+}
+
+// checksum returns the Internet checksum of data, starting from sum
+func checksum(data []byte, sum uint32) uint16 {
+	for ; len(data) >= 2; data = data[2:] {
+		sum += uint32(binary.BigEndian.Uint16(data))
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
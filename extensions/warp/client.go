@@ -0,0 +1,153 @@
+// Package warp registers devices with the Cloudflare WARP API and converts
+// a registration to a Sing-box WireGuard endpoint. It backs the
+// "utp-core warp" commands; nothing is registered with the box.
+package warp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// DefaultAPI is the WARP client API
+	DefaultAPI = "https://api.cloudflareclient.com/v0a2158"
+
+	// The API only serves requests that look like the Android client
+	clientVersion  = "a-6.10-2158"
+	userAgent      = "okhttp/3.12.1"
+	requestTimeout = 30 * time.Second
+	maxResponse    = 1 << 20
+)
+
+// Client talks to the WARP API
+type Client struct {
+	api  string
+	http *http.Client
+}
+
+// NewClient returns a client of api ("" for DefaultAPI) sending requests
+// through httpClient (nil for a direct client)
+func NewClient(api string, httpClient *http.Client) *Client {
+	if api == "" {
+		api = DefaultAPI
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: requestTimeout}
+	}
+	return &Client{api: api, http: httpClient}
+}
+
+// Register generates a WireGuard keypair and registers a new device with
+// its public key
+func (c *Client) Register(ctx context.Context) (*Device, error) {
+	privateKey, publicKey, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]string{
+		"key":           publicKey,
+		"install_id":    "",
+		"fcm_token":     "",
+		"tos":           time.Now().UTC().Format(time.RFC3339),
+		"model":         "PC",
+		"serial_number": "",
+		"locale":        "en_US",
+	}
+	var device Device
+	if err := c.do(ctx, http.MethodPost, "/reg", "", request, &device); err != nil {
+		return nil, fmt.Errorf("register device: %w", err)
+	}
+	if device.ID == "" || device.Token == "" {
+		return nil, fmt.Errorf("register device: response has no device id or token")
+	}
+	device.PrivateKey = privateKey
+	return &device, nil
+}
+
+// ApplyLicense binds device to the account of a WARP+ license key and
+// refreshes device from the API
+func (c *Client) ApplyLicense(ctx context.Context, device *Device, license string) error {
+	request := map[string]string{"license": license}
+	if err := c.do(ctx, http.MethodPut, "/reg/"+device.ID+"/account", device.Token, request, nil); err != nil {
+		return fmt.Errorf("apply license: %w", err)
+	}
+	return c.Refresh(ctx, device)
+}
+
+// Refresh reloads the account and configuration of device, keeping its
+// credentials
+func (c *Client) Refresh(ctx context.Context, device *Device) error {
+	var refreshed Device
+	if err := c.do(ctx, http.MethodGet, "/reg/"+device.ID, device.Token, nil, &refreshed); err != nil {
+		return fmt.Errorf("refresh device: %w", err)
+	}
+	device.Account = refreshed.Account
+	device.Config = refreshed.Config
+	return nil
+}
+
+// do sends a JSON request and decodes the JSON response into response
+// unless it is nil
+func (c *Client) do(ctx context.Context, method string, path string, token string, request any, response any) error {
+	var body io.Reader
+	if request != nil {
+		content, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, method, c.api+path, body)
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("User-Agent", userAgent)
+	httpRequest.Header.Set("CF-Client-Version", clientVersion)
+	if request != nil {
+		httpRequest.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	if token != "" {
+		httpRequest.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpResponse, err := c.http.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(httpResponse.Body, maxResponse))
+	if err != nil {
+		return err
+	}
+	if httpResponse.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", httpResponse.Status, apiError(content))
+	}
+	if response == nil {
+		return nil
+	}
+	if err := json.Unmarshal(content, response); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
+
+// apiError returns the messages of an API error response, or the response
+// itself when it has none
+func apiError(content []byte) string {
+	var response struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(content, &response) == nil && len(response.Errors) > 0 {
+		return response.Errors[0].Message
+	}
+	if len(content) > 200 {
+		content = content[:200]
+	}
+	return string(bytes.TrimSpace(content))
+}
@@ -0,0 +1,22 @@
+package warp
+
+import (
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/porthop"
+	"github.com/UTPBox/utp-core/internal/sockopt"
+)
+
+// NoiseOptions defines the configuration for the warp-noise outbound, set as
+// the detour of a WARP wireguard endpoint. Zero values select the defaults.
+type NoiseOptions struct {
+	JunkCount   int                `json:"junk_count,omitempty"`    // Junk packets sent before each handshake initiation (default 5)
+	JunkMinSize int                `json:"junk_min_size,omitempty"` // Smallest junk packet in bytes (default 50)
+	JunkMaxSize int                `json:"junk_max_size,omitempty"` // Largest junk packet in bytes (default 1000)
+	JunkDelay   badoption.Duration `json:"junk_delay,omitempty"`    // Pause after each junk packet (default none)
+
+	porthop.Options       // hop_ports / hop_interval / hop_key
+	sockopt.Marks         // dscp / tos / socket_priority
+	netdial.DialerOptions // detour / bind_interface / inet4_bind_address / inet6_bind_address / routing_mark
+}
@@ -0,0 +1,156 @@
+package warp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/sagernet/sing/common/json/badjson"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// defaultPort is the WireGuard port of the WARP endpoints
+	defaultPort = 2408
+	// mtu leaves room for IPv6 and PPPoE headers, as the WARP client does
+	mtu = 1280
+	// keepalive keeps the NAT mapping of the peer open, in seconds
+	keepalive = 25
+)
+
+// Device is a registration with the WARP API. ID and Token authenticate
+// later requests; PrivateKey and PeerEndpoint are never sent to the API.
+type Device struct {
+	ID           string       `json:"id"`
+	Token        string       `json:"token"`
+	PrivateKey   string       `json:"private_key,omitempty"`
+	PeerEndpoint string       `json:"peer_endpoint,omitempty"` // Selected by a scan instead of the endpoint of Config
+	Account      Account      `json:"account"`
+	Config       DeviceConfig `json:"config"`
+}
+
+// Account is the account a device is bound to
+type Account struct {
+	ID          string `json:"id"`
+	AccountType string `json:"account_type"` // "free", "limited" (WARP+) or "unlimited"
+	WarpPlus    bool   `json:"warp_plus"`
+	License     string `json:"license"`
+}
+
+// DeviceConfig is the WireGuard configuration of a device
+type DeviceConfig struct {
+	ClientID  string `json:"client_id"` // Base64 of the reserved bytes
+	Interface struct {
+		Addresses struct {
+			V4 string `json:"v4"`
+			V6 string `json:"v6"`
+		} `json:"addresses"`
+	} `json:"interface"`
+	Peers []struct {
+		PublicKey string `json:"public_key"`
+		Endpoint  struct {
+			V4   string `json:"v4"`
+			V6   string `json:"v6"`
+			Host string `json:"host"`
+		} `json:"endpoint"`
+	} `json:"peers"`
+}
+
+// Reserved returns the three reserved bytes the WARP server expects in
+// every WireGuard message of the device
+func (d *Device) Reserved() ([]int, error) {
+	clientID, err := base64.StdEncoding.DecodeString(d.Config.ClientID)
+	if err != nil || len(clientID) != 3 {
+		return nil, fmt.Errorf("invalid client_id: %s", d.Config.ClientID)
+	}
+	return []int{int(clientID[0]), int(clientID[1]), int(clientID[2])}, nil
+}
+
+// Endpoint returns the Sing-box WireGuard endpoint object of the device,
+// with keys in the order of a hand-written configuration
+func (d *Device) Endpoint(tag string) (*badjson.JSONObject, error) {
+	if d.PrivateKey == "" {
+		return nil, fmt.Errorf("device has no private key")
+	}
+	if len(d.Config.Peers) == 0 {
+		return nil, fmt.Errorf("device has no peer")
+	}
+	peer := d.Config.Peers[0]
+	peerEndpoint := peer.Endpoint.Host
+	if d.PeerEndpoint != "" {
+		peerEndpoint = d.PeerEndpoint
+	}
+	host, port, err := splitEndpoint(peerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	reserved, err := d.Reserved()
+	if err != nil {
+		return nil, err
+	}
+	var address []any
+	if v4 := d.Config.Interface.Addresses.V4; v4 != "" {
+		address = append(address, v4+"/32")
+	}
+	if v6 := d.Config.Interface.Addresses.V6; v6 != "" {
+		address = append(address, v6+"/128")
+	}
+	if len(address) == 0 {
+		return nil, fmt.Errorf("device has no interface address")
+	}
+
+	peerObject := new(badjson.JSONObject)
+	peerObject.Put("address", host)
+	peerObject.Put("port", port)
+	peerObject.Put("public_key", peer.PublicKey)
+	peerObject.Put("allowed_ips", []any{"0.0.0.0/0", "::/0"})
+	peerObject.Put("reserved", []any{reserved[0], reserved[1], reserved[2]})
+	peerObject.Put("persistent_keepalive_interval", keepalive)
+
+	endpoint := new(badjson.JSONObject)
+	endpoint.Put("type", "wireguard")
+	endpoint.Put("tag", tag)
+	endpoint.Put("address", address)
+	endpoint.Put("private_key", d.PrivateKey)
+	endpoint.Put("mtu", mtu)
+	endpoint.Put("peers", []any{peerObject})
+	return endpoint, nil
+}
+
+// splitEndpoint splits the "host:port" endpoint of a peer; the port is
+// optional
+func splitEndpoint(endpoint string) (string, int, error) {
+	if endpoint == "" {
+		return "", 0, fmt.Errorf("peer has no endpoint")
+	}
+	host, portString, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint, defaultPort, nil
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid peer endpoint: %s", endpoint)
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+	return host, port, nil
+}
+
+// generateKey returns a new WireGuard private key and its public key, in
+// base64
+func generateKey() (string, string, error) {
+	var privateKey [curve25519.ScalarSize]byte
+	if _, err := rand.Read(privateKey[:]); err != nil {
+		return "", "", err
+	}
+	privateKey[0] &= 248
+	privateKey[31] = (privateKey[31] & 127) | 64
+	publicKey, err := curve25519.X25519(privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(privateKey[:]), base64.StdEncoding.EncodeToString(publicKey), nil
+}
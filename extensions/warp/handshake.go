@@ -0,0 +1,184 @@
+package warp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// WireGuard handshake constants, from the WireGuard paper
+const (
+	noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	noiseIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	labelMAC1         = "mac1----"
+
+	messageInitiation      = 1
+	messageResponse        = 2
+	initiationLength       = 148
+	responseLength         = 92
+	initiationMAC1Offset   = 116
+	responseReceiverOffset = 8
+)
+
+// initiation builds WireGuard handshake initiations of a device, which the
+// WARP servers answer only when they carry the device key and reserved bytes
+type initiation struct {
+	privateKey [32]byte
+	publicKey  [32]byte
+	peerKey    [32]byte
+	reserved   [3]byte
+}
+
+func newInitiation(device *Device) (*initiation, error) {
+	if len(device.Config.Peers) == 0 {
+		return nil, fmt.Errorf("device has no peer")
+	}
+	var i initiation
+	if err := decodeKey(i.privateKey[:], device.PrivateKey); err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+	if err := decodeKey(i.peerKey[:], device.Config.Peers[0].PublicKey); err != nil {
+		return nil, fmt.Errorf("invalid peer public key: %w", err)
+	}
+	publicKey, err := curve25519.X25519(i.privateKey[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(i.publicKey[:], publicKey)
+	reserved, err := device.Reserved()
+	if err != nil {
+		return nil, err
+	}
+	for index, value := range reserved {
+		i.reserved[index] = byte(value)
+	}
+	return &i, nil
+}
+
+// message returns a new initiation message and its sender index, which the
+// response echoes as its receiver index
+func (i *initiation) message() ([]byte, uint32, error) {
+	var ephemeral [32]byte
+	if _, err := rand.Read(ephemeral[:]); err != nil {
+		return nil, 0, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, 0, err
+	}
+	var senderIndex [4]byte
+	if _, err := rand.Read(senderIndex[:]); err != nil {
+		return nil, 0, err
+	}
+
+	msg := make([]byte, initiationLength)
+	msg[0] = messageInitiation
+	copy(msg[1:4], i.reserved[:])
+	copy(msg[4:8], senderIndex[:])
+
+	chainKey := blake2s.Sum256([]byte(noiseConstruction))
+	hashValue := mixHash(mixHash(chainKey, []byte(noiseIdentifier)), i.peerKey[:])
+
+	copy(msg[8:40], ephemeralPublic)
+	chainKey = kdf1(chainKey, ephemeralPublic)
+	hashValue = mixHash(hashValue, ephemeralPublic)
+
+	shared, err := curve25519.X25519(ephemeral[:], i.peerKey[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	var key [32]byte
+	chainKey, key = kdf2(chainKey, shared)
+	static := seal(key, i.publicKey[:], hashValue[:])
+	copy(msg[40:88], static)
+	hashValue = mixHash(hashValue, static)
+
+	shared, err = curve25519.X25519(i.privateKey[:], i.peerKey[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	_, key = kdf2(chainKey, shared)
+	timestamp := seal(key, tai64n(time.Now()), hashValue[:])
+	copy(msg[88:116], timestamp)
+
+	mac1Key := blake2s.Sum256(append([]byte(labelMAC1), i.peerKey[:]...))
+	mac, _ := blake2s.New128(mac1Key[:])
+	mac.Write(msg[:initiationMAC1Offset])
+	copy(msg[initiationMAC1Offset:], mac.Sum(nil))
+	// mac2 stays zero: it is only required from servers under load
+	return msg, binary.LittleEndian.Uint32(senderIndex[:]), nil
+}
+
+// isResponse reports whether packet is the handshake response to the
+// initiation of senderIndex
+func isResponse(packet []byte, senderIndex uint32) bool {
+	return len(packet) == responseLength && packet[0] == messageResponse &&
+		binary.LittleEndian.Uint32(packet[responseReceiverOffset:]) == senderIndex
+}
+
+func decodeKey(dst []byte, value string) error {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	if len(key) != len(dst) {
+		return fmt.Errorf("key is %d bytes, not %d", len(key), len(dst))
+	}
+	copy(dst, key)
+	return nil
+}
+
+func newHash() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func hmacSum(key []byte, input ...[]byte) [32]byte {
+	mac := hmac.New(newHash, key)
+	for _, b := range input {
+		mac.Write(b)
+	}
+	var sum [32]byte
+	mac.Sum(sum[:0])
+	return sum
+}
+
+func mixHash(h [32]byte, data []byte) [32]byte {
+	return blake2s.Sum256(append(h[:], data...))
+}
+
+func kdf1(key [32]byte, input []byte) [32]byte {
+	t0 := hmacSum(key[:], input)
+	return hmacSum(t0[:], []byte{1})
+}
+
+func kdf2(key [32]byte, input []byte) ([32]byte, [32]byte) {
+	t0 := hmacSum(key[:], input)
+	t1 := hmacSum(t0[:], []byte{1})
+	t2 := hmacSum(t0[:], t1[:], []byte{2})
+	return t1, t2
+}
+
+// seal encrypts plaintext with a zero nonce, as every handshake key is used
+// once
+func seal(key [32]byte, plaintext []byte, additionalData []byte) []byte {
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plaintext, additionalData)
+}
+
+// tai64n encodes t as the TAI64N label of the handshake timestamp
+func tai64n(t time.Time) []byte {
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[:8], 0x400000000000000a+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+	return b[:]
+}
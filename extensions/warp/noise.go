@@ -0,0 +1,258 @@
+package warp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/porthop"
+)
+
+// Junk packet defaults, within the ranges AmneziaWG recommends
+const (
+	DefaultJunkCount   = 5
+	DefaultJunkMinSize = 50
+	DefaultJunkMaxSize = 1000
+
+	maxJunkCount = 128
+	maxJunkSize  = 65507 // Largest UDP payload over IPv4
+)
+
+var _ adapter.Outbound = (*NoiseOutbound)(nil)
+
+// NoiseOutbound carries the UDP of a wireguard endpoint and sends junk
+// packets of random sizes and contents to the peer before each handshake
+// initiation, like the Jc, Jmin and Jmax parameters of AmneziaWG. DPI
+// matching the first packet of a flow then sees no handshake to block. The
+// peer drops the junk as invalid messages, so it needs no support on the
+// server, unlike the handshake padding of AmneziaWG (S1 and S2), which the
+// WARP servers reject. With hop_ports, the datagrams of endpoints with a
+// single peer hop between the ports of the peer, all of which a WARP peer
+// answers on.
+type NoiseOutbound struct {
+	tag      string
+	logger   log.ContextLogger
+	opts     NoiseOptions
+	junk     junk
+	schedule *porthop.Schedule // nil without port hopping
+	dialer   *netdial.Outbound
+}
+
+// NewNoiseOutbound creates a new warp-noise outbound
+func NewNoiseOutbound(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts NoiseOptions) (adapter.Outbound, error) {
+	j := junk{
+		count:   opts.JunkCount,
+		minSize: opts.JunkMinSize,
+		maxSize: opts.JunkMaxSize,
+		delay:   time.Duration(opts.JunkDelay),
+	}
+	if j.count == 0 {
+		j.count = DefaultJunkCount
+	}
+	if j.minSize == 0 {
+		j.minSize = DefaultJunkMinSize
+	}
+	if j.maxSize == 0 {
+		j.maxSize = max(DefaultJunkMaxSize, j.minSize)
+	}
+	switch {
+	case j.count < 0 || j.count > maxJunkCount:
+		return nil, fmt.Errorf("warp-noise: junk_count must be between 1 and %d", maxJunkCount)
+	case j.minSize < 1 || j.maxSize > maxJunkSize:
+		return nil, fmt.Errorf("warp-noise: junk sizes must be between 1 and %d", maxJunkSize)
+	case j.minSize > j.maxSize:
+		return nil, fmt.Errorf("warp-noise: junk_min_size exceeds junk_max_size")
+	case j.delay < 0:
+		return nil, fmt.Errorf("warp-noise: negative junk_delay")
+	}
+	if err := opts.Marks.Validate(); err != nil {
+		return nil, fmt.Errorf("warp-noise: %w", err)
+	}
+	var schedule *porthop.Schedule
+	if opts.Options.Enabled() {
+		var err error
+		if schedule, err = porthop.NewSchedule(opts.Options); err != nil {
+			return nil, fmt.Errorf("warp-noise: %w", err)
+		}
+	}
+	dialer, err := netdial.New(ctx, tag, opts.DialerOptions, opts.Marks)
+	if err != nil {
+		return nil, fmt.Errorf("warp-noise: %w", err)
+	}
+	return &NoiseOutbound{
+		tag:      tag,
+		logger:   logger,
+		opts:     opts,
+		junk:     j,
+		schedule: schedule,
+		dialer:   dialer,
+	}, nil
+}
+
+func (o *NoiseOutbound) Type() string {
+	return "warp-noise"
+}
+
+func (o *NoiseOutbound) Tag() string {
+	return o.tag
+}
+
+func (o *NoiseOutbound) Dependencies() []string {
+	return o.opts.DialerOptions.Dependencies()
+}
+
+func (o *NoiseOutbound) Network() []string {
+	return []string{"udp"}
+}
+
+func (o *NoiseOutbound) Start() error {
+	return nil
+}
+
+func (o *NoiseOutbound) Close() error {
+	return nil
+}
+
+// DialContext connects to a single peer, as wireguard endpoints with one
+// peer do
+func (o *NoiseOutbound) DialContext(ctx context.Context, network string, destination metadata.Socksaddr) (net.Conn, error) {
+	if N.NetworkName(network) != N.NetworkUDP {
+		return nil, fmt.Errorf("warp-noise outbound does not support TCP")
+	}
+	if o.schedule != nil {
+		return o.dialHopping(ctx, destination)
+	}
+	conn, err := o.dialer.For(adapter.ContextFrom(ctx)).DialContext(ctx, "udp", destination.String())
+	if err != nil {
+		o.logger.Debug("warp-noise[", o.tag, "]: peer ", destination, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, failure.Wrap(failure.StageConnect, err))
+	}
+	return &noiseConn{Conn: conn, junk: o.junk}, nil
+}
+
+// ListenPacket opens the socket of wireguard endpoints with several peers
+func (o *NoiseOutbound) ListenPacket(ctx context.Context, destination metadata.Socksaddr) (net.PacketConn, error) {
+	conn, err := o.dialer.ListenPacket(ctx, adapter.ContextFrom(ctx))
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, failure.Wrap(failure.StageConnect, err))
+	}
+	return &noisePacketConn{PacketConn: conn, junk: o.junk}, nil
+}
+
+// dialHopping connects to a single peer whose port follows the hop
+// schedule. A connected socket has a fixed port, so the connection is a
+// socket bound to the peer instead.
+func (o *NoiseOutbound) dialHopping(ctx context.Context, destination metadata.Socksaddr) (net.Conn, error) {
+	peer, err := o.resolvePeer(ctx, destination)
+	if err != nil {
+		return nil, failure.Report(ctx, o.tag, failure.Wrap(failure.StageConnect, err))
+	}
+	conn, err := o.dialer.ListenPacket(ctx, adapter.ContextFrom(ctx))
+	if err != nil {
+		o.logger.Debug("warp-noise[", o.tag, "]: peer ", destination, " failed: ", err)
+		return nil, failure.Report(ctx, o.tag, failure.Wrap(failure.StageConnect, err))
+	}
+	hopping := porthop.NewPacketConn(conn, peer, o.schedule)
+	return &noiseConn{Conn: bufio.NewBindPacketConn(hopping, net.UDPAddrFromAddrPort(peer)), junk: o.junk}, nil
+}
+
+// resolvePeer returns the address of the peer, whose port is replaced by
+// the hop schedule. The name is resolved as the dialer would resolve it, so
+// a detour or domain resolver applies.
+func (o *NoiseOutbound) resolvePeer(ctx context.Context, destination metadata.Socksaddr) (netip.AddrPort, error) {
+	if destination.IsIP() {
+		return destination.AddrPort(), nil
+	}
+	addrs, err := o.dialer.Lookup(ctx, destination.Fqdn)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if len(addrs) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("no address for %s", destination.Fqdn)
+	}
+	return netip.AddrPortFrom(addrs[0].Unmap(), destination.Port), nil
+}
+
+// junk sends the packets preceding a handshake initiation
+type junk struct {
+	count   int
+	minSize int
+	maxSize int
+	delay   time.Duration
+}
+
+// isInitiation reports whether b is a WireGuard handshake initiation; the
+// reserved bytes WARP sets do not change the type or length
+func isInitiation(b []byte) bool {
+	return len(b) == initiationLength && b[0] == messageInitiation
+}
+
+// send writes the junk packets with write, pausing for the delay after each
+func (j junk) send(write func([]byte) error) error {
+	buffer := make([]byte, j.maxSize)
+	var size [4]byte
+	for range j.count {
+		if _, err := rand.Read(size[:]); err != nil {
+			return err
+		}
+		packet := buffer[:j.minSize+int(binary.LittleEndian.Uint32(size[:])%uint32(j.maxSize-j.minSize+1))]
+		if _, err := rand.Read(packet); err != nil {
+			return err
+		}
+		if err := write(packet); err != nil {
+			return err
+		}
+		if j.delay > 0 {
+			time.Sleep(j.delay)
+		}
+	}
+	return nil
+}
+
+type noiseConn struct {
+	net.Conn
+	junk junk
+}
+
+func (c *noiseConn) Write(b []byte) (int, error) {
+	if isInitiation(b) {
+		err := c.junk.send(func(packet []byte) error {
+			_, err := c.Conn.Write(packet)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+type noisePacketConn struct {
+	net.PacketConn
+	junk junk
+}
+
+func (c *noisePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if isInitiation(b) {
+		err := c.junk.send(func(packet []byte) error {
+			_, err := c.PacketConn.WriteTo(packet, addr)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
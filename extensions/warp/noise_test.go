@@ -0,0 +1,84 @@
+package warp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/metadata"
+
+	"github.com/UTPBox/utp-core/internal/testkit"
+)
+
+func TestNoiseJunk(t *testing.T) {
+	const (
+		junkCount = 3
+		junkSize  = 100
+	)
+	network := &testkit.Network{}
+	received := make(chan net.Conn, 1)
+	done := make(chan struct{})
+	defer close(done)
+	listener, err := network.Serve("engage.example:2408", func(conn net.Conn) {
+		received <- conn
+		<-done
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ctx := testkit.Context(context.Background(), network, nil)
+	outbound, _, err := testkit.NewOutbound(ctx, nil, NewNoiseOutbound, "warp-noise-out", NoiseOptions{
+		JunkCount:   junkCount,
+		JunkMinSize: junkSize,
+		JunkMaxSize: junkSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := outbound.DialContext(context.Background(), "udp", metadata.ParseSocksaddrHostPort("engage.example", 2408))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := <-received
+
+	// A WireGuard handshake initiation is message type 1 padded to 148 bytes;
+	// type 4 is a transport data message
+	initiation := make([]byte, 148)
+	initiation[0] = 1
+	transport := []byte{4, 0, 0, 0, 1, 2, 3, 4}
+	buffer := make([]byte, 2048)
+	for _, test := range []struct {
+		packet []byte
+		junk   int
+	}{
+		{initiation, junkCount},
+		{transport, 0},
+		{initiation, junkCount},
+	} {
+		if _, err := conn.Write(test.packet); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i <= test.junk; i++ {
+			n, err := peer.Read(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case i < test.junk && (n != junkSize || bytes.Equal(buffer[:n], initiation[:n])):
+				t.Fatalf("junk packet %d of %d bytes: %x", i+1, n, buffer[:n])
+			case i == test.junk && !bytes.Equal(buffer[:n], test.packet):
+				t.Fatalf("peer got %x after %d junk packets, want %x", buffer[:n], test.junk, test.packet)
+			}
+		}
+	}
+	peer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if n, err := peer.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("peer got %d more bytes (%v), want none", n, err)
+	}
+}
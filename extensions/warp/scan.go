@@ -0,0 +1,237 @@
+package warp
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultEndpoint is the endpoint the WARP client tries first
+var DefaultEndpoint = netip.MustParseAddrPort("162.159.192.1:2408")
+
+// DefaultPrefixes are the address ranges of the WARP endpoints
+var DefaultPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("162.159.192.0/24"),
+	netip.MustParsePrefix("162.159.193.0/24"),
+	netip.MustParsePrefix("162.159.195.0/24"),
+	netip.MustParsePrefix("188.114.96.0/24"),
+	netip.MustParsePrefix("188.114.97.0/24"),
+	netip.MustParsePrefix("188.114.98.0/24"),
+	netip.MustParsePrefix("188.114.99.0/24"),
+}
+
+// DefaultPorts are the UDP ports the WARP endpoints answer on
+var DefaultPorts = []uint16{
+	500, 854, 859, 864, 878, 880, 890, 891, 894, 903, 908, 928, 934, 939, 942,
+	943, 945, 946, 955, 968, 987, 988, 1002, 1010, 1014, 1018, 1070, 1074, 1180,
+	1387, 1701, 1843, 2371, 2408, 2506, 3138, 3476, 3581, 3854, 4177, 4198, 4233,
+	4500, 5279, 5956, 7103, 7152, 7156, 7281, 7559, 8319, 8742, 8854, 8886,
+}
+
+// Scan defaults
+const (
+	DefaultSamples     = 100
+	DefaultAttempts    = 3
+	DefaultScanTimeout = time.Second
+	DefaultConcurrency = 32
+)
+
+// ScanOptions select the endpoints probed by Scan. Zero values select the
+// defaults.
+type ScanOptions struct {
+	Prefixes    []netip.Prefix
+	Ports       []uint16
+	Samples     int           // Endpoints probed besides DefaultEndpoint
+	Attempts    int           // Handshakes sent to each endpoint
+	Timeout     time.Duration // For each handshake response
+	Concurrency int           // Endpoints probed at once
+}
+
+// ScanResult is an endpoint that answered at least one handshake
+type ScanResult struct {
+	Endpoint netip.AddrPort
+	RTT      time.Duration // Mean of the answered handshakes
+	Loss     float64       // Share of unanswered handshakes
+}
+
+// Scan sends handshake initiations of device to DefaultEndpoint and a random
+// sample of the configured ranges and ports, and returns the endpoints that
+// answered, least loss first, then fastest
+func Scan(ctx context.Context, device *Device, opts ScanOptions) ([]ScanResult, error) {
+	opts = opts.withDefaults()
+	i, err := newInitiation(device)
+	if err != nil {
+		return nil, err
+	}
+	candidates := sample(opts)
+	results := make([]ScanResult, 0, len(candidates))
+	var access sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, opts.Concurrency)
+	for _, endpoint := range candidates {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			result, ok := probe(ctx, i, endpoint, opts)
+			if !ok {
+				return
+			}
+			access.Lock()
+			results = append(results, result)
+			access.Unlock()
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(results, func(a, b ScanResult) int {
+		if a.Loss != b.Loss {
+			if a.Loss < b.Loss {
+				return -1
+			}
+			return 1
+		}
+		return int(a.RTT - b.RTT)
+	})
+	return results, nil
+}
+
+// Select returns DefaultEndpoint when it answers every handshake, and the
+// best endpoint of a scan otherwise, for networks filtering the default
+func Select(ctx context.Context, device *Device, opts ScanOptions) (ScanResult, error) {
+	opts = opts.withDefaults()
+	i, err := newInitiation(device)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	if result, ok := probe(ctx, i, DefaultEndpoint, opts); ok && result.Loss == 0 {
+		return result, nil
+	}
+	results, err := Scan(ctx, device, opts)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	if len(results) == 0 {
+		return ScanResult{}, fmt.Errorf("no endpoint answered")
+	}
+	return results[0], nil
+}
+
+func (o ScanOptions) withDefaults() ScanOptions {
+	if len(o.Prefixes) == 0 {
+		o.Prefixes = DefaultPrefixes
+	}
+	if len(o.Ports) == 0 {
+		o.Ports = DefaultPorts
+	}
+	if o.Samples <= 0 {
+		o.Samples = DefaultSamples
+	}
+	if o.Attempts <= 0 {
+		o.Attempts = DefaultAttempts
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultScanTimeout
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	return o
+}
+
+// sample returns DefaultEndpoint and up to opts.Samples distinct random
+// endpoints of the ranges
+func sample(opts ScanOptions) []netip.AddrPort {
+	candidates := []netip.AddrPort{DefaultEndpoint}
+	seen := map[netip.AddrPort]bool{DefaultEndpoint: true}
+	// Give up on drawing distinct endpoints when the ranges are small
+	for tries := 0; len(candidates) <= opts.Samples && tries < opts.Samples*10; tries++ {
+		endpoint := netip.AddrPortFrom(randomAddr(opts.Prefixes[rand.IntN(len(opts.Prefixes))]), opts.Ports[rand.IntN(len(opts.Ports))])
+		if seen[endpoint] {
+			continue
+		}
+		seen[endpoint] = true
+		candidates = append(candidates, endpoint)
+	}
+	return candidates
+}
+
+// randomAddr returns a random address of prefix
+func randomAddr(prefix netip.Prefix) netip.Addr {
+	prefix = prefix.Masked()
+	b := prefix.Addr().AsSlice()
+	hostBits := len(b)*8 - prefix.Bits()
+	for index := len(b) - 1; index >= 0 && hostBits > 0; index-- {
+		mask := byte(0xff)
+		if hostBits < 8 {
+			mask = byte(1<<hostBits - 1)
+		}
+		b[index] |= byte(rand.UintN(256)) & mask
+		hostBits -= 8
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// probe sends opts.Attempts handshake initiations to endpoint, one at a
+// time, and reports whether any was answered
+func probe(ctx context.Context, i *initiation, endpoint netip.AddrPort, opts ScanOptions) (ScanResult, bool) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", endpoint.String())
+	if err != nil {
+		return ScanResult{}, false
+	}
+	defer conn.Close()
+	var (
+		answered int
+		total    time.Duration
+		buffer   [512]byte
+	)
+	for range opts.Attempts {
+		if ctx.Err() != nil {
+			break
+		}
+		msg, senderIndex, err := i.message()
+		if err != nil {
+			return ScanResult{}, false
+		}
+		start := time.Now()
+		if _, err := conn.Write(msg); err != nil {
+			continue
+		}
+		conn.SetReadDeadline(start.Add(opts.Timeout))
+		for {
+			n, err := conn.Read(buffer[:])
+			if err != nil {
+				break
+			}
+			if isResponse(buffer[:n], senderIndex) {
+				answered++
+				total += time.Since(start)
+				break
+			}
+		}
+	}
+	if answered == 0 {
+		return ScanResult{}, false
+	}
+	return ScanResult{
+		Endpoint: endpoint,
+		RTT:      total / time.Duration(answered),
+		Loss:     1 - float64(answered)/float64(opts.Attempts),
+	}, true
+}
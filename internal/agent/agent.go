@@ -0,0 +1,317 @@
+// Package agent keeps an outbound WebSocket connection to a central
+// controller, so instances behind NAT can be managed without exposing an
+// admin API. The controller pushes configurations and commands; the agent
+// reports status and the latest dial failures periodically.
+//
+// Messages are JSON text frames. The agent sends "hello" after connecting,
+// "status" every report interval and "result" for each controller request.
+// The controller sends "config" (a complete configuration) and "command"
+// (one of the built-in commands: "reload", "status", "ping"). Arbitrary
+// command execution is deliberately not supported.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/ws"
+	"github.com/sagernet/ws/wsutil"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+)
+
+const (
+	DefaultReportInterval = time.Minute
+	minReconnectDelay     = time.Second
+	maxReconnectDelay     = time.Minute
+	writeTimeout          = 10 * time.Second
+	// maxMessageSize bounds controller messages, pushed configurations
+	// included
+	maxMessageSize = 4 << 20
+)
+
+// Options configures the agent
+type Options struct {
+	URL            string        // Controller endpoint (wss://, or ws:// on loopback)
+	Token          string        // Sent as a bearer token in the handshake
+	NodeID         string        // Identifies this instance to the controller
+	ReportInterval time.Duration // Time between status reports
+}
+
+// Handler applies controller requests to the running instance
+type Handler interface {
+	// ApplyConfig validates, stores and activates a configuration
+	ApplyConfig(content []byte) error
+	// Reload re-reads the stored configuration
+	Reload() error
+	// Status describes the running instance
+	Status() any
+}
+
+// Message is the envelope exchanged with the controller
+type Message struct {
+	Type     string           `json:"type"`
+	ID       string           `json:"id,omitempty"`      // Request ID, echoed in the result
+	Node     string           `json:"node,omitempty"`    // Sender node ID
+	Command  string           `json:"command,omitempty"` // For "command"
+	Config   json.RawMessage  `json:"config,omitempty"`  // For "config"
+	OK       bool             `json:"ok,omitempty"`      // For "result"
+	Error    string           `json:"error,omitempty"`   // For "result"
+	Status   any              `json:"status,omitempty"`  // For "hello", "status" and "result"
+	Failures []failure.Record `json:"failures,omitempty"`
+}
+
+// Agent maintains the controller connection
+type Agent struct {
+	opts    Options
+	handler Handler
+	logger  log.Logger
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	writeAccess sync.Mutex
+}
+
+// New creates an agent. Call Start to connect.
+func New(opts Options, handler Handler, logger log.Logger) (*Agent, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("agent: controller URL is required")
+	}
+	if err := checkURL(opts.URL); err != nil {
+		return nil, fmt.Errorf("agent: %w", err)
+	}
+	if opts.ReportInterval <= 0 {
+		opts.ReportInterval = DefaultReportInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Agent{
+		opts:    opts,
+		handler: handler,
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// checkURL requires TLS for the controller connection, which carries the
+// token and configurations applied without further checks; plain ws:// is
+// only accepted for a controller on the same host
+func checkURL(rawURL string) error {
+	controller, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid controller URL: %w", err)
+	}
+	switch controller.Scheme {
+	case "wss":
+		return nil
+	case "ws":
+		host := controller.Hostname()
+		if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+			return nil
+		}
+		return fmt.Errorf("controller URL must use wss:// unless the controller is on loopback")
+	default:
+		return fmt.Errorf("unsupported controller URL scheme: %s", controller.Scheme)
+	}
+}
+
+// Start connects in the background and reconnects with backoff
+func (a *Agent) Start() {
+	go a.loop()
+}
+
+// Close disconnects from the controller
+func (a *Agent) Close() error {
+	a.cancel()
+	<-a.done
+	return nil
+}
+
+func (a *Agent) loop() {
+	defer close(a.done)
+	delay := minReconnectDelay
+	for {
+		connected, err := a.session()
+		if a.ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = minReconnectDelay
+		}
+		a.logger.Warn("agent: controller connection lost: ", err, ", retrying in ", delay)
+		select {
+		case <-time.After(delay):
+		case <-a.ctx.Done():
+			return
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+// session runs one controller connection until it fails
+func (a *Agent) session() (bool, error) {
+	header := http.Header{}
+	if a.opts.Token != "" {
+		header.Set("Authorization", "Bearer "+a.opts.Token)
+	}
+	dialer := ws.Dialer{Header: ws.HandshakeHeaderHTTP(header)}
+	conn, reader, _, err := dialer.Dial(a.ctx, a.opts.URL)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(a.ctx, func() { conn.Close() })
+	defer stop()
+	a.logger.Info("agent: connected to controller ", a.opts.URL)
+
+	var source io.Reader = conn
+	if reader != nil {
+		source = io.MultiReader(reader, conn)
+	}
+	if err := a.send(conn, Message{Type: "hello", Status: a.handler.Status()}); err != nil {
+		return true, err
+	}
+
+	reportDone := make(chan struct{})
+	defer close(reportDone)
+	go a.report(conn, reportDone)
+
+	for {
+		content, err := a.readText(conn, source)
+		if err != nil {
+			return true, err
+		}
+		var request Message
+		if err := json.Unmarshal(content, &request); err != nil {
+			a.logger.Warn("agent: invalid controller message: ", err)
+			continue
+		}
+		if err := a.send(conn, a.handle(request)); err != nil {
+			return true, err
+		}
+	}
+}
+
+// handle executes a controller request and returns its result
+func (a *Agent) handle(request Message) Message {
+	result := Message{Type: "result", ID: request.ID}
+	var err error
+	switch request.Type {
+	case "config":
+		a.logger.Info("agent: applying configuration pushed by controller")
+		err = a.handler.ApplyConfig(request.Config)
+	case "command":
+		switch request.Command {
+		case "reload":
+			err = a.handler.Reload()
+		case "status":
+			result.Status = a.handler.Status()
+			result.Failures = failure.All()
+		case "ping":
+		default:
+			err = fmt.Errorf("unknown command: %s", request.Command)
+		}
+	default:
+		err = fmt.Errorf("unknown message type: %s", request.Type)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.OK = true
+	}
+	return result
+}
+
+func (a *Agent) report(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(a.opts.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := a.send(conn, Message{Type: "status", Status: a.handler.Status(), Failures: failure.All()})
+			if err != nil {
+				conn.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (a *Agent) send(conn net.Conn, message Message) error {
+	message.Node = a.opts.NodeID
+	content, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	a.writeAccess.Lock()
+	defer a.writeAccess.Unlock()
+	// Compile the frame so it goes out in a single write
+	frame, err := ws.CompileFrame(ws.MaskFrameInPlace(ws.NewTextFrame(content)))
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = conn.Write(frame)
+	return err
+}
+
+// readText returns the next text message, failing on messages larger than
+// maxMessageSize. Control frames are answered with a single write under the
+// write lock, so replies cannot interleave with status reports.
+func (a *Agent) readText(conn net.Conn, source io.Reader) ([]byte, error) {
+	controlHandler := func(header ws.Header, payload io.Reader) error {
+		var frame bytes.Buffer
+		err := wsutil.ControlFrameHandler(&frame, ws.StateClientSide)(header, payload)
+		if frame.Len() > 0 {
+			a.writeAccess.Lock()
+			conn.Write(frame.Bytes())
+			a.writeAccess.Unlock()
+		}
+		return err
+	}
+	reader := wsutil.Reader{
+		Source:         source,
+		State:          ws.StateClientSide,
+		CheckUTF8:      true,
+		OnIntermediate: controlHandler,
+	}
+	for {
+		header, err := reader.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if header.OpCode.IsControl() {
+			if err := controlHandler(header, &reader); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if header.OpCode != ws.OpText {
+			if err := reader.Discard(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		content, err := io.ReadAll(io.LimitReader(&reader, maxMessageSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > maxMessageSize {
+			return nil, fmt.Errorf("controller message exceeds %d bytes", maxMessageSize)
+		}
+		return content, nil
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"time"
+
+	"github.com/UTPBox/utp-core/internal/metrics"
+)
+
+// Messages are encoded by hand following api.proto; field numbers below must
+// match it.
+
+// Status describes the managed instance
+type Status struct {
+	Running    bool
+	Version    string
+	Uptime     time.Duration // Since the instance was started, zero when stopped
+	ConfigHash string        // Of the running configuration, see config.Hash
+}
+
+func (s Status) marshal() []byte {
+	var e encoder
+	e.bool(1, s.Running)
+	e.string(2, s.Version)
+	e.int(3, int64(s.Uptime.Seconds()))
+	e.string(4, s.ConfigHash)
+	return e
+}
+
+// Outbound describes one outbound of the running instance
+type Outbound struct {
+	Tag            string
+	Type           string
+	Now            string   // Selected member, for groups
+	All            []string // Members, for groups
+	Selectable     bool     // Whether SwitchSelector applies
+	FailureKind    string   // Latest dial failure, see internal/failure
+	FailureMessage string
+}
+
+func (o Outbound) marshal() []byte {
+	var e encoder
+	e.string(1, o.Tag)
+	e.string(2, o.Type)
+	e.string(3, o.Now)
+	e.strings(4, o.All)
+	e.bool(5, o.Selectable)
+	e.string(6, o.FailureKind)
+	e.string(7, o.FailureMessage)
+	return e
+}
+
+func marshalOutbounds(outbounds []Outbound) []byte {
+	var e encoder
+	for _, outbound := range outbounds {
+		e.bytes(1, outbound.marshal())
+	}
+	return e
+}
+
+func marshalConnection(c metrics.Connection) []byte {
+	var e encoder
+	e.string(1, c.ID)
+	e.string(2, c.Network)
+	e.string(3, c.Inbound)
+	e.string(4, c.Source)
+	e.string(5, c.Destination)
+	e.string(6, c.Domain)
+	e.string(7, c.Outbound)
+	e.string(8, c.Rule)
+	e.int(9, c.Upload)
+	e.int(10, c.Download)
+	e.int(11, c.Start.UnixMilli())
+	return e
+}
+
+func marshalConnections(connections []metrics.Connection) []byte {
+	var e encoder
+	for _, connection := range connections {
+		e.bytes(1, marshalConnection(connection))
+	}
+	return e
+}
+
+// switchSelectorRequest selects Outbound in the selector Group
+type switchSelectorRequest struct {
+	Group    string
+	Outbound string
+}
+
+func (r *switchSelectorRequest) unmarshal(message []byte) error {
+	fields, err := decode(message)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch f.Number {
+		case 1:
+			r.Group = string(f.Bytes)
+		case 2:
+			r.Outbound = string(f.Bytes)
+		}
+	}
+	return nil
+}
+
+// closeConnectionRequest names the connection to close
+type closeConnectionRequest struct {
+	ID string
+}
+
+func (r *closeConnectionRequest) unmarshal(message []byte) error {
+	fields, err := decode(message)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		if f.Number == 1 {
+			r.ID = string(f.Bytes)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+// Package api serves a gRPC management API, so external controllers and
+// mobile wrappers can drive utp-core programmatically instead of
+// re-executing the binary. The service is described in api.proto.
+//
+// gRPC is implemented directly on HTTP/2 without TLS (h2c, prior knowledge),
+// which covers the unary calls of the API; messages are encoded by hand.
+// Compressed messages are not supported. Listen on loopback or a Unix socket,
+// and require a token when the address is shared with other users; other
+// TCP addresses are refused without a token.
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/UTPBox/utp-core/internal/metrics"
+)
+
+const (
+	servicePath    = "/utp.api.v1.Control/"
+	maxMessageSize = 1 << 20
+)
+
+// Code is a gRPC status code
+type Code int
+
+const (
+	CodeOK                 Code = 0
+	CodeUnknown            Code = 2
+	CodeInvalidArgument    Code = 3
+	CodeNotFound           Code = 5
+	CodeFailedPrecondition Code = 9
+	CodeUnimplemented      Code = 12
+	CodeInternal           Code = 13
+	CodeUnauthenticated    Code = 16
+)
+
+// Error is returned by handlers to choose the status code of a call. Other
+// errors are returned as CodeUnknown.
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf returns an Error with a formatted message
+func Errorf(code Code, format string, args ...any) error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Handler applies API calls to the managed instance
+type Handler interface {
+	// Start builds an instance from the configuration when none is running
+	Start() error
+	// Stop closes the running instance
+	Stop() error
+	// Reload replaces the running instance, or starts one when stopped
+	Reload() error
+	Status() Status
+	Outbounds() ([]Outbound, error)
+	// SwitchSelector selects outbound in the selector group
+	SwitchSelector(group string, outbound string) error
+	Connections() ([]metrics.Connection, error)
+	CloseConnection(id string) error
+}
+
+// Options configures the server
+type Options struct {
+	Listen string // host:port, or unix:path for a Unix socket
+	Token  string // Required as "authorization: Bearer <token>" metadata when set
+}
+
+// Server serves the API until closed
+type Server struct {
+	opts     Options
+	handler  Handler
+	listener net.Listener
+	server   *http.Server
+}
+
+// New listens on the configured address. A TCP address other than loopback
+// requires a token, as anyone reaching it could stop the instance.
+func New(opts Options, handler Handler) (*Server, error) {
+	var listener net.Listener
+	var err error
+	path, isUnix := strings.CutPrefix(opts.Listen, "unix:")
+	if !isUnix && opts.Token == "" && !isLoopback(opts.Listen) {
+		return nil, fmt.Errorf("api: %s is not a loopback address, a token is required", opts.Listen)
+	}
+	if isUnix {
+		// A socket left by a previous run would make the listen fail
+		os.Remove(path)
+		listener, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0o600)
+		}
+	} else {
+		listener, err = net.Listen("tcp", opts.Listen)
+	}
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		return nil, fmt.Errorf("api: %w", err)
+	}
+	s := &Server{
+		opts:     opts,
+		handler:  handler,
+		listener: listener,
+	}
+	s.server = &http.Server{
+		Handler:           h2c.NewHandler(s, &http2.Server{}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+// isLoopback reports whether the host of address is a loopback IP or
+// localhost
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Start serves in the background
+func (s *Server) Start() {
+	go s.server.Serve(s.listener)
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// ServeHTTP handles one unary call
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	if s.opts.Token != "" {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+			writeStatus(w, CodeUnauthenticated, "invalid token")
+			return
+		}
+	}
+	method, found := strings.CutPrefix(r.URL.Path, servicePath)
+	if !found {
+		writeStatus(w, CodeUnimplemented, "unknown service")
+		return
+	}
+	message, err := readMessage(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response, err := s.call(method, message)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(response)))
+	w.Write(append(frame, response...))
+	w.Header().Set("Grpc-Status", "0")
+	w.Header().Set("Grpc-Message", "")
+}
+
+func (s *Server) call(method string, message []byte) ([]byte, error) {
+	switch method {
+	case "Start":
+		return nil, s.handler.Start()
+	case "Stop":
+		return nil, s.handler.Stop()
+	case "Reload":
+		return nil, s.handler.Reload()
+	case "GetStatus":
+		return s.handler.Status().marshal(), nil
+	case "ListOutbounds":
+		outbounds, err := s.handler.Outbounds()
+		if err != nil {
+			return nil, err
+		}
+		return marshalOutbounds(outbounds), nil
+	case "SwitchSelector":
+		var request switchSelectorRequest
+		if err := request.unmarshal(message); err != nil {
+			return nil, Errorf(CodeInvalidArgument, "invalid request: %v", err)
+		}
+		return nil, s.handler.SwitchSelector(request.Group, request.Outbound)
+	case "GetConnections":
+		connections, err := s.handler.Connections()
+		if err != nil {
+			return nil, err
+		}
+		return marshalConnections(connections), nil
+	case "CloseConnection":
+		var request closeConnectionRequest
+		if err := request.unmarshal(message); err != nil {
+			return nil, Errorf(CodeInvalidArgument, "invalid request: %v", err)
+		}
+		return nil, s.handler.CloseConnection(request.ID)
+	}
+	return nil, Errorf(CodeUnimplemented, "unknown method: %s", method)
+}
+
+// readMessage reads the single length-prefixed message of a unary request
+func readMessage(body io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(body, header[:]); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "missing request message")
+	}
+	if header[0] != 0 {
+		return nil, Errorf(CodeUnimplemented, "compressed messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxMessageSize {
+		return nil, Errorf(CodeInvalidArgument, "message too large")
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(body, message); err != nil {
+		return nil, Errorf(CodeInvalidArgument, "truncated request message")
+	}
+	return message, nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := CodeUnknown
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		code = apiErr.Code
+	}
+	writeStatus(w, code, err.Error())
+}
+
+// writeStatus answers a failed call with a trailers-only response
+func writeStatus(w http.ResponseWriter, code Code, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(code)))
+	w.Header().Set("Grpc-Message", encodeMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeMessage percent-encodes a status message as gRPC requires
+func encodeMessage(message string) string {
+	var builder strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		} else {
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
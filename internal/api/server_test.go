@@ -0,0 +1,236 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/http2"
+
+	"github.com/UTPBox/utp-core/internal/metrics"
+)
+
+// recordingHandler records the calls reaching it and fails SwitchSelector
+// for unknown groups
+type recordingHandler struct {
+	calls []string
+}
+
+func (h *recordingHandler) Start() error {
+	h.calls = append(h.calls, "Start")
+	return nil
+}
+
+func (h *recordingHandler) Stop() error {
+	h.calls = append(h.calls, "Stop")
+	return errors.New("not running: ü")
+}
+
+func (h *recordingHandler) Reload() error {
+	h.calls = append(h.calls, "Reload")
+	return nil
+}
+
+func (h *recordingHandler) Status() Status {
+	return Status{Running: true, Version: "1.0"}
+}
+
+func (h *recordingHandler) Outbounds() ([]Outbound, error) {
+	return nil, nil
+}
+
+func (h *recordingHandler) SwitchSelector(group string, outbound string) error {
+	h.calls = append(h.calls, "SwitchSelector "+group+" "+outbound)
+	if group != "select" {
+		return Errorf(CodeNotFound, "no group %s", group)
+	}
+	return nil
+}
+
+func (h *recordingHandler) Connections() ([]metrics.Connection, error) {
+	return nil, nil
+}
+
+func (h *recordingHandler) CloseConnection(id string) error {
+	return nil
+}
+
+// grpcResult is the outcome of a call: the status, its message and the
+// response message, nil for trailers-only responses
+type grpcResult struct {
+	code    Code
+	message string
+	body    []byte
+}
+
+// serveAPI serves handler on loopback and returns a plaintext HTTP/2 client
+// of the server, as gRPC clients connect without TLS
+func serveAPI(t *testing.T, opts Options, handler Handler) (*http.Client, string) {
+	t.Helper()
+	opts.Listen = "127.0.0.1:0"
+	server, err := New(opts, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Start()
+	t.Cleanup(func() { server.Close() })
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	return client, "http://" + server.Addr().String()
+}
+
+// invoke posts body, a complete request as framed on the wire, to method
+func invoke(t *testing.T, client *http.Client, base string, method string, token string, body []byte) grpcResult {
+	t.Helper()
+	request, err := http.NewRequest(http.MethodPost, base+"/utp.api.v1.Control/"+method, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.ProtoMajor != 2 || response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("%s: %s %s, content type %q", method, response.Proto, response.Status, response.Header.Get("Content-Type"))
+	}
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Trailers-only responses carry the status in the headers
+	trailer := response.Trailer
+	if status := response.Header.Get("Grpc-Status"); status != "" {
+		trailer = response.Header
+	}
+	code, err := strconv.Atoi(trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: grpc-status %q", method, trailer.Get("Grpc-Status"))
+	}
+	result := grpcResult{code: Code(code), message: trailer.Get("Grpc-Message")}
+	if len(content) > 0 {
+		if len(content) < 5 || content[0] != 0 || int(binary.BigEndian.Uint32(content[1:5])) != len(content)-5 {
+			t.Fatalf("%s: response %x is not one uncompressed message", method, content)
+		}
+		result.body = content[5:]
+	}
+	return result
+}
+
+// frame prefixes a message given in hex with the uncompressed flag and its
+// length
+func frame(message string) []byte {
+	content, _ := hex.DecodeString(message)
+	return append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(content))), content...)
+}
+
+func TestUnaryCalls(t *testing.T) {
+	handler := &recordingHandler{}
+	client, base := serveAPI(t, Options{}, handler)
+	for _, test := range []struct {
+		method  string
+		request []byte
+		want    grpcResult
+	}{
+		{"GetStatus", frame(""), grpcResult{body: []byte("\x08\x01\x12\x031.0")}},
+		{"Reload", frame(""), grpcResult{body: []byte{}}},
+		{"SwitchSelector", frame("0a0673656c656374120477617270"), grpcResult{body: []byte{}}},
+		{"SwitchSelector", frame("0a036e6f7012017a"), grpcResult{code: CodeNotFound, message: "no group nop"}},
+		{"Stop", frame(""), grpcResult{code: CodeUnknown, message: "not running: %C3%BC"}},
+		{"Restart", frame(""), grpcResult{code: CodeUnimplemented, message: "unknown method: Restart"}},
+		{"SwitchSelector", frame("12"), grpcResult{code: CodeInvalidArgument, message: "invalid request: truncated message"}},
+	} {
+		got := invoke(t, client, base, test.method, "", test.request)
+		if got.code != test.want.code || got.message != test.want.message || !bytes.Equal(got.body, test.want.body) {
+			t.Errorf("%s %x: got %+v, want %+v", test.method, test.request, got, test.want)
+		}
+	}
+	want := []string{"Reload", "SwitchSelector select warp", "SwitchSelector nop z", "Stop"}
+	if len(handler.calls) != len(want) {
+		t.Fatalf("handler got %q, want %q", handler.calls, want)
+	}
+	for i := range want {
+		if handler.calls[i] != want[i] {
+			t.Fatalf("handler got %q, want %q", handler.calls, want)
+		}
+	}
+}
+
+func TestMalformedFrames(t *testing.T) {
+	handler := &recordingHandler{}
+	client, base := serveAPI(t, Options{}, handler)
+	for _, test := range []struct {
+		name string
+		body []byte
+		want Code
+	}{
+		{"empty body", nil, CodeInvalidArgument},
+		{"compressed", []byte{1, 0, 0, 0, 0}, CodeUnimplemented},
+		{"too large", binary.BigEndian.AppendUint32([]byte{0}, maxMessageSize+1), CodeInvalidArgument},
+		{"truncated", []byte{0, 0, 0, 0, 4, 0x08}, CodeInvalidArgument},
+	} {
+		if got := invoke(t, client, base, "Reload", "", test.body); got.code != test.want || got.body != nil {
+			t.Errorf("%s: got %+v, want code %d", test.name, got, test.want)
+		}
+	}
+	if len(handler.calls) != 0 {
+		t.Fatalf("malformed requests reached the handler: %q", handler.calls)
+	}
+}
+
+func TestToken(t *testing.T) {
+	handler := &recordingHandler{}
+	client, base := serveAPI(t, Options{Token: "secret"}, handler)
+	for _, token := range []string{"", "secre", "secret2"} {
+		if got := invoke(t, client, base, "Start", token, frame("")); got.code != CodeUnauthenticated {
+			t.Errorf("token %q: got %+v, want unauthenticated", token, got)
+		}
+	}
+	if len(handler.calls) != 0 {
+		t.Fatalf("unauthenticated calls reached the handler: %q", handler.calls)
+	}
+	if got := invoke(t, client, base, "Start", "secret", frame("")); got.code != CodeOK {
+		t.Fatalf("valid token: got %+v", got)
+	}
+}
+
+func TestExposedListen(t *testing.T) {
+	for _, listen := range []string{"0.0.0.0:0", ":0", "192.0.2.1:9092", "example.com:9092"} {
+		if server, err := New(Options{Listen: listen}, &recordingHandler{}); err == nil {
+			server.Close()
+			t.Errorf("listened on %s without a token", listen)
+		}
+	}
+	for _, opts := range []Options{
+		{Listen: "127.0.0.1:0"},
+		{Listen: "localhost:0"},
+		{Listen: "unix:" + filepath.Join(t.TempDir(), "api.sock")},
+		{Listen: "0.0.0.0:0", Token: "secret"},
+	} {
+		server, err := New(opts, &recordingHandler{})
+		if err != nil {
+			t.Errorf("%+v: %v", opts, err)
+			continue
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Protobuf wire types used by the API messages
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errTruncated = errors.New("truncated message")
+
+// encoder appends protobuf fields. Zero values are omitted, as proto3 does.
+type encoder []byte
+
+func (e *encoder) tag(number int, wireType int) {
+	*e = binary.AppendUvarint(*e, uint64(number)<<3|uint64(wireType))
+}
+
+func (e *encoder) uint(number int, value uint64) {
+	if value == 0 {
+		return
+	}
+	e.tag(number, wireVarint)
+	*e = binary.AppendUvarint(*e, value)
+}
+
+func (e *encoder) int(number int, value int64) {
+	e.uint(number, uint64(value))
+}
+
+func (e *encoder) bool(number int, value bool) {
+	if value {
+		e.uint(number, 1)
+	}
+}
+
+func (e *encoder) bytes(number int, value []byte) {
+	e.tag(number, wireBytes)
+	*e = binary.AppendUvarint(*e, uint64(len(value)))
+	*e = append(*e, value...)
+}
+
+func (e *encoder) string(number int, value string) {
+	if value != "" {
+		e.bytes(number, []byte(value))
+	}
+}
+
+// strings encodes a repeated string field, keeping empty elements
+func (e *encoder) strings(number int, values []string) {
+	for _, value := range values {
+		e.bytes(number, []byte(value))
+	}
+}
+
+// field is one decoded field. Value holds varints, Bytes length-delimited
+// content.
+type field struct {
+	Number int
+	Value  uint64
+	Bytes  []byte
+}
+
+// decode splits a message into fields. Fixed-width fields, which the API
+// does not use, are skipped.
+func decode(message []byte) ([]field, error) {
+	var fields []field
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return nil, errTruncated
+		}
+		message = message[n:]
+		f := field{Number: int(key >> 3)}
+		switch key & 7 {
+		case wireVarint:
+			f.Value, n = binary.Uvarint(message)
+			if n <= 0 {
+				return nil, errTruncated
+			}
+			message = message[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || length > uint64(len(message)-n) {
+				return nil, errTruncated
+			}
+			f.Bytes = message[n : n+int(length)]
+			message = message[n+int(length):]
+		case 1:
+			if len(message) < 8 {
+				return nil, errTruncated
+			}
+			message = message[8:]
+			continue
+		case 5:
+			if len(message) < 4 {
+				return nil, errTruncated
+			}
+			message = message[4:]
+			continue
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// Expected encodings are worked out from the protobuf encoding reference,
+// whose examples the first two are, not produced by the encoder
+func TestEncoder(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		encode func(e *encoder)
+		want   string
+	}{
+		{"varint", func(e *encoder) { e.uint(1, 150) }, "089601"},
+		{"string", func(e *encoder) { e.string(2, "testing") }, "120774657374696e67"},
+		{"negative int64", func(e *encoder) { e.int(9, -1) }, "48ffffffffffffffffff01"},
+		{"two-byte tag", func(e *encoder) { e.bool(16, true) }, "800101"},
+		{"zero values omitted", func(e *encoder) { e.uint(1, 0); e.string(2, ""); e.bool(3, false) }, ""},
+		{"repeated keeps empty", func(e *encoder) { e.strings(4, []string{"a", ""}) }, "2201612200"},
+	} {
+		var e encoder
+		test.encode(&e)
+		if got := hex.EncodeToString(e); got != test.want {
+			t.Errorf("%s: encoded %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	status := Status{Running: true, Version: "1.0", Uptime: 90 * time.Second, ConfigHash: "ab"}
+	if got, want := hex.EncodeToString(status.marshal()), "0801"+"1203312e30"+"185a"+"22026162"; got != want {
+		t.Errorf("status encoded %s, want %s", got, want)
+	}
+	outbounds := marshalOutbounds([]Outbound{{Tag: "proxy", Type: "selector", Now: "a", All: []string{"a", "b"}, Selectable: true}})
+	// ListOutboundsResponse{outbounds: [{tag, type, now, all: [a, b], selectable}]}
+	want := "0a1c" + "0a0570726f7879" + "120873656c6563746f72" + "1a0161" + "220161" + "220162" + "2801"
+	if got := hex.EncodeToString(outbounds); got != want {
+		t.Errorf("outbounds encoded %s, want %s", got, want)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	// Unknown fields of every wire type but groups are skipped
+	message, _ := hex.DecodeString("0a0673656c656374" + "19" + "0102030405060708" + "25" + "01020304" + "3801" + "120477617270")
+	var request switchSelectorRequest
+	if err := request.unmarshal(message); err != nil {
+		t.Fatal(err)
+	}
+	if request.Group != "select" || request.Outbound != "warp" {
+		t.Fatalf("decoded %+v", request)
+	}
+
+	for _, malformed := range []string{
+		"08",           // Varint missing
+		"0880",         // Varint cut short
+		"12",           // Length missing
+		"1205616263",   // Shorter than its length
+		"1901020304",   // Fixed64 cut short
+		"0b",           // Group start
+		"80",           // Key cut short
+		"12ffffffff0f", // Length beyond the message
+	} {
+		message, _ := hex.DecodeString(malformed)
+		if _, err := decode(message); err == nil {
+			t.Errorf("decoded %s without error", malformed)
+		}
+	}
+}
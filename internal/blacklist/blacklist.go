@@ -0,0 +1,188 @@
+// Package blacklist remembers servers that keep failing handshakes. After a
+// few failures in a row a server is blacklisted for a while, and outbounds
+// choosing among several candidates try it only after the others. A server
+// failing again once its ban ends is blacklisted again at once for twice as
+// long, while a day without failures halves the next ban, so servers that
+// are down for good stay out of the way and servers that were briefly
+// unreachable return quickly. The list is kept in the state
+// directory, so a restart does not start over with known-dead servers.
+package blacklist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+const (
+	threshold = 3                // Failures in a row that blacklist a server
+	baseBan   = 5 * time.Minute  // First ban
+	maxBan    = 6 * time.Hour    // Longest ban
+	decay     = 24 * time.Hour   // Time without failures that halves the next ban
+	fileName  = "blacklist.json" // In the state directory of the tenant
+)
+
+// Entry is the failure history of one server
+type Entry struct {
+	Failures int       `json:"failures"` // Failures since the last ban or success
+	Level    int       `json:"level"`    // Bans in a row; each doubles the next
+	Until    time.Time `json:"until"`    // End of the current ban
+	Last     time.Time `json:"last"`     // Latest failure
+}
+
+// List holds the entries of one state directory, keyed by server
+type List struct {
+	path string
+
+	access  sync.Mutex
+	entries map[string]*Entry
+}
+
+var (
+	listAccess sync.Mutex
+	lists      = make(map[string]*List)
+)
+
+// ForContext returns the list of the tenant of ctx, loading it from the
+// state directory on first use
+func ForContext(ctx context.Context) *List {
+	path := state.PathContext(ctx, fileName)
+	listAccess.Lock()
+	defer listAccess.Unlock()
+	if l, loaded := lists[path]; loaded {
+		return l
+	}
+	l := &List{path: path, entries: make(map[string]*Entry)}
+	// A missing or damaged file starts an empty list
+	if content, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(content, &l.entries)
+	}
+	now := time.Now()
+	for key, entry := range l.entries {
+		if entry == nil || expired(entry, now) {
+			delete(l.entries, key)
+		}
+	}
+	lists[path] = l
+	return l
+}
+
+// Blocked reports whether key is blacklisted
+func (l *List) Blocked(key string) bool {
+	l.access.Lock()
+	defer l.access.Unlock()
+	entry, loaded := l.entries[key]
+	return loaded && time.Now().Before(entry.Until)
+}
+
+// Failure records a failed dial of key and returns the length of the ban
+// it started, or 0. Failures that do not show the server is unreachable or
+// blocking handshakes (bad credentials, a failing target, a captive
+// portal, a canceled dial) are ignored, as are failures during a ban.
+func (l *List) Failure(key string, err error) time.Duration {
+	if !Counts(err) {
+		return 0
+	}
+	l.access.Lock()
+	defer l.access.Unlock()
+	now := time.Now()
+	entry, loaded := l.entries[key]
+	if !loaded {
+		entry = &Entry{}
+		l.entries[key] = entry
+	}
+	if now.Before(entry.Until) {
+		return 0
+	}
+	if !entry.Last.IsZero() {
+		idle := now.Sub(entry.Last)
+		entry.Level = max(entry.Level-int(idle/decay), 0)
+		if idle >= decay {
+			entry.Failures = 0
+		}
+	}
+	entry.Last = now
+	entry.Failures++
+	// A server failing again after a ban is blacklisted again at once
+	if entry.Failures < threshold && entry.Level == 0 {
+		return 0
+	}
+	ban := min(baseBan<<min(entry.Level, 16), maxBan)
+	entry.Failures = 0
+	entry.Level++
+	entry.Until = now.Add(ban)
+	l.save()
+	return ban
+}
+
+// Success forgets the failures of key
+func (l *List) Success(key string) {
+	l.access.Lock()
+	defer l.access.Unlock()
+	entry, loaded := l.entries[key]
+	if !loaded {
+		return
+	}
+	delete(l.entries, key)
+	if entry.Level > 0 {
+		l.save()
+	}
+}
+
+// Demote returns candidates with the blacklisted ones moved to the end,
+// keeping the order otherwise. They are kept so that a dial still has
+// somewhere to go when every candidate is blacklisted.
+func Demote[T any](l *List, candidates []T, key func(T) string) []T {
+	ordered := make([]T, 0, len(candidates))
+	var blocked []T
+	for _, candidate := range candidates {
+		if l.Blocked(key(candidate)) {
+			blocked = append(blocked, candidate)
+		} else {
+			ordered = append(ordered, candidate)
+		}
+	}
+	return append(ordered, blocked...)
+}
+
+// Counts reports whether err counts towards blacklisting the server
+func Counts(err error) bool {
+	if err == nil {
+		return false
+	}
+	kind := failure.KindOf(err)
+	switch kind {
+	case failure.KindCaptivePortal, failure.KindDNSFailure, failure.KindBackoff:
+		return false
+	}
+	var typed *failure.Error
+	if errors.As(err, &typed) && typed.Stage == failure.StageTarget {
+		return false
+	}
+	return failure.Transient(kind)
+}
+
+// expired reports whether entry no longer affects bans
+func expired(entry *Entry, now time.Time) bool {
+	return !now.Before(entry.Until) && now.Sub(entry.Last) >= time.Duration(entry.Level+1)*decay
+}
+
+// save writes the entries to the state directory. A list that cannot be
+// written still works for this run.
+func (l *List) save() {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return
+	}
+	content, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return
+	}
+	os.WriteFile(l.path, content, 0o600)
+}
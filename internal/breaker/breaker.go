@@ -0,0 +1,195 @@
+// Package breaker holds back outbound dials during failure storms. When
+// dials to many servers fail at once, as in a national block event, every
+// outbound retrying at full speed hammers blocked servers and stands out in
+// flow logs. The breaker detects the storm from the failures reported by
+// extension outbounds and then admits one probing dial at a time, spaced by
+// an exponential backoff with jitter, until a dial succeeds again. The
+// breaker is process-wide and applied by the dialer shared by extension
+// outbounds (see dnsguard.Guard.DialContext).
+package breaker
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config describes when a storm starts and how dials are spaced during it
+type Config struct {
+	Threshold  int           // Failures within Window that start a storm
+	Outbounds  int           // Distinct outbounds among those failures
+	Window     time.Duration // Span failures are counted over
+	Backoff    time.Duration // Delay before the first probe
+	MaxBackoff time.Duration // Largest delay between probes
+}
+
+// Validate checks that c is usable
+func (c Config) Validate() error {
+	switch {
+	case c.Threshold <= 0:
+		return fmt.Errorf("invalid threshold %d", c.Threshold)
+	case c.Outbounds <= 0 || c.Outbounds > c.Threshold:
+		return fmt.Errorf("invalid outbounds %d: expected 1 to threshold", c.Outbounds)
+	case c.Window <= 0:
+		return fmt.Errorf("invalid window %s", c.Window)
+	case c.Backoff <= 0 || c.MaxBackoff < c.Backoff:
+		return fmt.Errorf("invalid backoff %s-%s", c.Backoff, c.MaxBackoff)
+	}
+	return nil
+}
+
+// HeldBackError is returned for dials refused during a storm
+type HeldBackError struct {
+	Until time.Time // Time of the next probe
+}
+
+func (e *HeldBackError) Error() string {
+	return fmt.Sprintf("dial held back during failure storm, next probe in %s", time.Until(e.Until).Round(time.Second))
+}
+
+// Breaker tracks failures and admits dials. Storm changes are reported to
+// onChange, with the failures that started the storm.
+type Breaker struct {
+	config   Config
+	onChange func(storm bool, failures int)
+
+	access    sync.Mutex
+	failures  []failed // Within the window, oldest first
+	storm     bool
+	backoff   time.Duration // Of the next probe
+	nextProbe time.Time
+}
+
+type failed struct {
+	time     time.Time
+	outbound string
+}
+
+// New returns a breaker for config. onChange may be nil.
+func New(config Config, onChange func(storm bool, failures int)) *Breaker {
+	return &Breaker{config: config, onChange: onChange}
+}
+
+var current atomic.Pointer[Breaker]
+
+// Current returns the breaker in force, or nil when dials are never held
+// back
+func Current() *Breaker {
+	return current.Load()
+}
+
+// Set puts b in force; nil disables the breaker
+func Set(b *Breaker) {
+	current.Store(b)
+}
+
+// Clear disables the breaker if b is still in force, so an instance closing
+// after its replacement started keeps the new breaker
+func Clear(b *Breaker) {
+	current.CompareAndSwap(b, nil)
+}
+
+// Admit reports whether a dial may proceed under the breaker in force. During
+// a storm only the first dial after each backoff is admitted, as a probe.
+func Admit() error {
+	if b := Current(); b != nil {
+		return b.admit(time.Now())
+	}
+	return nil
+}
+
+// Failed records a failed dial of outbound under the breaker in force.
+// Only failures that may come from blocking, such as resets, timeouts and
+// unreachable servers, should be recorded.
+func Failed(outbound string) {
+	if b := Current(); b != nil {
+		b.failed(time.Now(), outbound)
+	}
+}
+
+// Succeeded records a successful dial under the breaker in force, which ends
+// a storm
+func Succeeded() {
+	if b := Current(); b != nil {
+		b.succeeded()
+	}
+}
+
+// Storm reports whether dials are being held back
+func (b *Breaker) Storm() bool {
+	b.access.Lock()
+	defer b.access.Unlock()
+	return b.storm
+}
+
+func (b *Breaker) admit(now time.Time) error {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if !b.storm {
+		return nil
+	}
+	if now.Before(b.nextProbe) {
+		return &HeldBackError{Until: b.nextProbe}
+	}
+	b.backoff = min(b.backoff*2, b.config.MaxBackoff)
+	b.nextProbe = now.Add(jitter(b.backoff))
+	return nil
+}
+
+func (b *Breaker) failed(now time.Time, outbound string) {
+	b.access.Lock()
+	if b.storm {
+		b.access.Unlock()
+		return
+	}
+	b.failures = append(b.failures, failed{time: now, outbound: outbound})
+	expired := 0
+	for expired < len(b.failures) && now.Sub(b.failures[expired].time) > b.config.Window {
+		expired++
+	}
+	b.failures = b.failures[expired:]
+	if len(b.failures) < b.config.Threshold || b.distinct() < b.config.Outbounds {
+		b.access.Unlock()
+		return
+	}
+	count := len(b.failures)
+	b.storm = true
+	b.failures = nil
+	b.backoff = b.config.Backoff
+	b.nextProbe = now.Add(jitter(b.backoff))
+	b.access.Unlock()
+	if b.onChange != nil {
+		b.onChange(true, count)
+	}
+}
+
+func (b *Breaker) succeeded() {
+	b.access.Lock()
+	if !b.storm {
+		b.failures = b.failures[:0]
+		b.access.Unlock()
+		return
+	}
+	b.storm = false
+	b.access.Unlock()
+	if b.onChange != nil {
+		b.onChange(false, 0)
+	}
+}
+
+// distinct returns the number of outbounds among the failures
+func (b *Breaker) distinct() int {
+	outbounds := make(map[string]struct{}, len(b.failures))
+	for _, f := range b.failures {
+		outbounds[f.outbound] = struct{}{}
+	}
+	return len(outbounds)
+}
+
+// jitter spreads delays over [d/2, d), so clients hit by the same block do
+// not probe in step
+func jitter(d time.Duration) time.Duration {
+	return d/2 + rand.N(d/2+1)
+}
@@ -0,0 +1,145 @@
+// Package capability describes what each registered outbound type can do,
+// so GUIs can build protocol pickers without hard-coding protocol knowledge.
+// Capabilities are read from the option structs the types are registered
+// with: a type whose options have a detour field can be chained behind
+// another outbound, multiplex enables multiplexing, pool_size keeps
+// connections ready ahead of dials, and network selects TCP and UDP. An
+// inbound registered under the same type is its server. Only the networks
+// of types that cannot choose them are declared here.
+package capability
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing/service"
+)
+
+// Networks
+const (
+	NetworkTCP = "tcp"
+	NetworkUDP = "udp"
+)
+
+// tcpOnlyTypes are the outbound types that only carry TCP, and udpOnlyTypes
+// those that only carry UDP. Other types carry both, or choose with their
+// network field.
+var (
+	tcpOnlyTypes = map[string]bool{
+		C.TypeHTTP: true, C.TypeSSH: true, C.TypeTor: true, C.TypeShadowTLS: true,
+		"naive": true, "obfs4": true, "meek": true, "cloak": true,
+		"http-inject": true, "ws-inject": true,
+		"ssh-direct": true, "ssh-tls": true, "ssh-dnstt": true,
+	}
+	udpOnlyTypes = map[string]bool{"udp2raw": true, "warp-noise": true}
+)
+
+// Networks returns the networks outbounds of outboundType can carry
+func Networks(outboundType string) []string {
+	switch {
+	case tcpOnlyTypes[outboundType]:
+		return []string{NetworkTCP}
+	case udpOnlyTypes[outboundType]:
+		return []string{NetworkUDP}
+	}
+	return []string{NetworkTCP, NetworkUDP}
+}
+
+// Capabilities are what outbounds of one type can do
+type Capabilities struct {
+	Type     string   `json:"type"`
+	Networks []string `json:"networks"`         // tcp and/or udp
+	Network  bool     `json:"network"`          // The network field restricts them
+	Mux      bool     `json:"mux"`              // Connections can be multiplexed (multiplex)
+	Detour   bool     `json:"detour"`           // Can be chained behind another outbound (detour)
+	Prewarm  bool     `json:"prewarm"`          // Connections can be kept ready (pool_size)
+	Server   bool     `json:"server"`           // An inbound of the same type serves them
+	Fields   []string `json:"fields,omitempty"` // Option fields, for forms
+}
+
+// Matrix returns the capabilities of every outbound type registered in ctx,
+// sorted by type
+func Matrix(ctx context.Context) []Capabilities {
+	outbounds := service.FromContext[adapter.OutboundRegistry](ctx)
+	if outbounds == nil {
+		return nil
+	}
+	inbounds := service.FromContext[adapter.InboundRegistry](ctx)
+	var matrix []Capabilities
+	for _, outboundType := range registeredTypes(outbounds) {
+		options, loaded := outbounds.CreateOptions(outboundType)
+		if !loaded {
+			continue
+		}
+		fields := jsonFields(reflect.TypeOf(options))
+		capabilities := Capabilities{
+			Type:     outboundType,
+			Networks: Networks(outboundType),
+			Network:  slices.Contains(fields, "network"),
+			Mux:      slices.Contains(fields, "multiplex"),
+			Detour:   slices.Contains(fields, "detour"),
+			Prewarm:  slices.Contains(fields, "pool_size"),
+			Fields:   fields,
+		}
+		if inbounds != nil {
+			_, capabilities.Server = inbounds.CreateOptions(outboundType)
+		}
+		matrix = append(matrix, capabilities)
+	}
+	return matrix
+}
+
+// registeredTypes returns the types of registry. The Sing-box registry does
+// not list them, so they are read from the keys of its options map.
+func registeredTypes(registry adapter.OutboundRegistry) []string {
+	value := reflect.ValueOf(registry)
+	if value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	options := value.FieldByName("optionsType")
+	if options.Kind() != reflect.Map {
+		return nil
+	}
+	types := make([]string, 0, options.Len())
+	for _, key := range options.MapKeys() {
+		types = append(types, key.String())
+	}
+	slices.Sort(types)
+	return types
+}
+
+// jsonFields returns the JSON names of the fields of the struct t points
+// to, including those of embedded structs, sorted
+func jsonFields(t reflect.Type) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			fields = append(fields, jsonFields(field.Type)...)
+			continue
+		}
+		if !field.IsExported() || name == "" {
+			continue
+		}
+		fields = append(fields, name)
+	}
+	slices.Sort(fields)
+	return slices.Compact(fields)
+}
@@ -0,0 +1,205 @@
+// Package captive detects captive portals on the network outbounds dial
+// from. Hotel and airport networks intercept traffic until the user signs
+// in, which looks like every server being blocked. Before an outbound is
+// reported down, its detector fetches a plain HTTP probe that normally
+// answers 204 No Content; any other answer means the network is hijacking
+// requests. While a portal is detected, outbounds fail fast instead of
+// reconnecting, and the detector keeps probing until connectivity returns.
+package captive
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+const (
+	// DefaultURL answers 204 No Content when the network is open
+	DefaultURL      = "http://connectivitycheck.gstatic.com/generate_204"
+	defaultInterval = 30 * time.Second
+	probeTimeout    = 5 * time.Second
+	// minProbeInterval bounds the probes caused by dial failures while the
+	// network is open
+	minProbeInterval = 10 * time.Second
+)
+
+// Options is embedded by extension outbound options
+type Options struct {
+	Enabled  bool               `json:"enabled,omitempty"`
+	URL      string             `json:"url,omitempty"`      // Probe answering 204 when open (default DefaultURL)
+	Interval badoption.Duration `json:"interval,omitempty"` // Time between probes while a portal is detected (default 30s)
+}
+
+// Status describes a detected captive portal
+type Status struct {
+	URL    string    `json:"url"`    // Probe that was hijacked
+	Portal string    `json:"portal"` // Where the network redirected the probe, or the probe itself
+	Code   int       `json:"code"`   // Status code answered in place of 204
+	Since  time.Time `json:"since"`
+}
+
+// Detector probes one URL. Detectors are shared by every outbound probing
+// the same URL, since they sit on the same network. A nil Detector never
+// detects a portal.
+type Detector struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	access  sync.Mutex
+	status  *Status
+	checked time.Time
+}
+
+var (
+	detectorAccess sync.Mutex
+	detectors      = make(map[string]*Detector)
+)
+
+// New returns the detector for the configured URL, or nil when detection is
+// not enabled
+func New(opts Options) *Detector {
+	if !opts.Enabled {
+		return nil
+	}
+	url := opts.URL
+	if url == "" {
+		url = DefaultURL
+	}
+	detectorAccess.Lock()
+	defer detectorAccess.Unlock()
+	if d, loaded := detectors[url]; loaded {
+		return d
+	}
+	interval := time.Duration(opts.Interval)
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	d := &Detector{
+		url:      url,
+		interval: interval,
+		client: &http.Client{
+			// Probe the underlying network, never a configured proxy
+			Transport: &http.Transport{
+				DialContext:       (&net.Dialer{}).DialContext,
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+			Timeout: probeTimeout,
+		},
+	}
+	detectors[url] = d
+	return d
+}
+
+// Detected returns the portal blocking the network, if any
+func (d *Detector) Detected() (Status, bool) {
+	if d == nil {
+		return Status{}, false
+	}
+	d.access.Lock()
+	defer d.access.Unlock()
+	if d.status == nil {
+		return Status{}, false
+	}
+	return *d.status, true
+}
+
+// Check probes the network after a dial failure and reports whether a
+// captive portal explains it. Probes are rate limited while the network is
+// open; a network that cannot be reached at all is not a portal.
+func (d *Detector) Check(ctx context.Context) (Status, bool) {
+	if d == nil {
+		return Status{}, false
+	}
+	d.access.Lock()
+	if d.status != nil || time.Since(d.checked) < minProbeInterval {
+		defer d.access.Unlock()
+		if d.status == nil {
+			return Status{}, false
+		}
+		return *d.status, true
+	}
+	d.checked = time.Now()
+	d.access.Unlock()
+
+	status, captive := d.probe(ctx)
+	if !captive {
+		return Status{}, false
+	}
+	d.access.Lock()
+	defer d.access.Unlock()
+	if d.status == nil {
+		d.status = &status
+		go d.watch()
+	}
+	return *d.status, true
+}
+
+// watch probes until the portal is gone
+func (d *Detector) watch() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, captive := d.probe(context.Background()); captive {
+			continue
+		}
+		d.access.Lock()
+		d.status = nil
+		d.checked = time.Now()
+		d.access.Unlock()
+		return
+	}
+}
+
+// probe fetches the URL and reports a portal when it does not answer 204.
+// Errors count as no portal: the network is down or the probe is blocked.
+func (d *Detector) probe(ctx context.Context) (Status, bool) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return Status{}, false
+	}
+	response, err := d.client.Do(request)
+	if err != nil {
+		return Status{}, false
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusNoContent {
+		return Status{}, false
+	}
+	status := Status{
+		URL:    d.url,
+		Portal: d.url,
+		Code:   response.StatusCode,
+		Since:  time.Now(),
+	}
+	if location, err := response.Location(); err == nil {
+		status.Portal = location.String()
+	}
+	return status, true
+}
+
+// All returns the portals currently detected
+func All() []Status {
+	detectorAccess.Lock()
+	defer detectorAccess.Unlock()
+	var all []Status
+	for _, d := range detectors {
+		if status, captive := d.Detected(); captive {
+			all = append(all, status)
+		}
+	}
+	return all
+}
+
+// Err describes the portal for failure records
+func (s Status) Err() error {
+	return fmt.Errorf("captive portal at %s (probe answered %d)", s.Portal, s.Code)
+}
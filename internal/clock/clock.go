@@ -0,0 +1,40 @@
+// Package clock corrects the system clock for handshakes that are sensitive
+// to skew, such as TLS certificate validity, VMess authentication, Shadowsocks
+// 2022 timestamps and port hopping schedules. Devices with a broken RTC can
+// be hours or years off; the offset measured against trusted time sources is
+// applied process-wide without touching the system clock.
+package clock
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing/common/ntp"
+)
+
+var offset atomic.Int64 // Nanoseconds added to the system clock
+
+// Now returns the corrected current time
+func Now() time.Time {
+	return time.Now().Add(Offset())
+}
+
+// Offset returns the correction applied to the system clock
+func Offset() time.Duration {
+	return time.Duration(offset.Load())
+}
+
+// SetOffset sets the correction applied to the system clock
+func SetOffset(d time.Duration) {
+	offset.Store(int64(d))
+}
+
+var _ ntp.TimeService = TimeService{}
+
+// TimeService exposes the corrected clock to Sing-box components, which read
+// it from the context for TLS, VMess and Shadowsocks 2022
+type TimeService struct{}
+
+func (TimeService) TimeFunc() func() time.Time {
+	return Now
+}
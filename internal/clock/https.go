@@ -0,0 +1,149 @@
+package clock
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultSources are HTTPS servers with well-kept clocks on separate
+// infrastructure
+var DefaultSources = []string{
+	"https://www.google.com",
+	"https://www.cloudflare.com",
+	"https://www.apple.com",
+	"https://www.microsoft.com",
+}
+
+// Sample is the offset of the system clock measured against one source
+type Sample struct {
+	Source string
+	Offset time.Duration
+	RTT    time.Duration
+}
+
+// DialFunc opens a TCP connection
+type DialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// Measure queries the sources in parallel and returns the median of their
+// offsets. A majority of the sources must answer, so a single lying or
+// hijacked source cannot move the clock on its own.
+func Measure(ctx context.Context, dial DialFunc, sources []string) (time.Duration, []Sample, error) {
+	if len(sources) == 0 {
+		return 0, nil, errors.New("no time sources")
+	}
+	var (
+		access  sync.Mutex
+		wait    sync.WaitGroup
+		samples []Sample
+		errs    []error
+	)
+	for _, source := range sources {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			sample, err := MeasureHTTPS(ctx, dial, source)
+			access.Lock()
+			defer access.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", source, err))
+				return
+			}
+			samples = append(samples, sample)
+		}()
+	}
+	wait.Wait()
+	if len(samples) <= len(sources)/2 {
+		return 0, samples, fmt.Errorf("%d of %d time sources answered: %w", len(samples), len(sources), errors.Join(errs...))
+	}
+	offsets := make([]time.Duration, 0, len(samples))
+	for _, sample := range samples {
+		offsets = append(offsets, sample.Offset)
+	}
+	slices.Sort(offsets)
+	return offsets[len(offsets)/2], samples, nil
+}
+
+// MeasureHTTPS reads the Date header of an HTTPS server. The system clock
+// cannot be trusted to check the certificate, so the chain is verified at
+// the date the server claims instead: a forged date still needs a
+// certificate for the host that was valid at that date.
+func MeasureHTTPS(ctx context.Context, dial DialFunc, source string) (Sample, error) {
+	target, err := url.Parse(source)
+	if err != nil || target.Scheme != "https" || target.Hostname() == "" {
+		return Sample{}, fmt.Errorf("invalid time source, expected an https URL: %s", source)
+	}
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), "443")
+	}
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return Sample{}, err
+	}
+	defer conn.Close()
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         target.Hostname(),
+		InsecureSkipVerify: true, // Verified below at the server's date
+		NextProtos:         []string{"http/1.1"},
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return Sample{}, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+	if err != nil {
+		return Sample{}, err
+	}
+	request.Header.Set("User-Agent", "utp-core")
+	request.Close = true
+	sent := time.Now()
+	if err := request.Write(tlsConn); err != nil {
+		return Sample{}, err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(tlsConn), request)
+	if err != nil {
+		return Sample{}, err
+	}
+	received := time.Now()
+	response.Body.Close()
+	date, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		return Sample{}, errors.New("missing or invalid Date header")
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return Sample{}, errors.New("no peer certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       target.Hostname(),
+		Intermediates: intermediates,
+		CurrentTime:   date,
+	}); err != nil {
+		return Sample{}, fmt.Errorf("certificate not valid at server date %s: %w", date.Format(time.RFC3339), err)
+	}
+
+	// Date is truncated to the second and was taken about halfway through
+	// the exchange
+	rtt := received.Sub(sent)
+	serverTime := date.Add(500 * time.Millisecond)
+	localTime := sent.Add(rtt / 2)
+	return Sample{Source: source, Offset: serverTime.Sub(localTime), RTT: rtt}, nil
+}
@@ -0,0 +1,19 @@
+package config
+
+import (
+	"context"
+
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/service"
+)
+
+// ContextWithOptions attaches the parsed configuration to ctx so extensions
+// can inspect the rest of the configuration (e.g. route rules)
+func ContextWithOptions(ctx context.Context, options *option.Options) context.Context {
+	return service.ContextWith[*option.Options](ctx, options)
+}
+
+// OptionsFromContext returns the configuration attached by ContextWithOptions
+func OptionsFromContext(ctx context.Context) *option.Options {
+	return service.FromContext[*option.Options](ctx)
+}
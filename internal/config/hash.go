@@ -0,0 +1,62 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sagernet/sing/service"
+)
+
+// Canonical returns content, a configuration as returned by Loader.Read, in
+// a canonical form: compact JSON with object keys sorted. Whitespace, key
+// order and the split into fragments do not change it; number literals are
+// kept as written.
+func Canonical(content []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %w", err)
+	}
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), nil
+}
+
+// Hash returns the SHA-256 of the canonical form of content, in hex. Nodes
+// running the same effective configuration report the same hash.
+func Hash(content []byte) (string, error) {
+	canonical, err := Canonical(content)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashKey carries the configuration hash in a context
+type hashKey struct {
+	hash string
+}
+
+// ContextWithHash attaches the hash of the running configuration to ctx, for
+// extensions reporting it (e.g. the admin API)
+func ContextWithHash(ctx context.Context, hash string) context.Context {
+	return service.ContextWith[*hashKey](ctx, &hashKey{hash: hash})
+}
+
+// HashFromContext returns the hash attached by ContextWithHash, or ""
+func HashFromContext(ctx context.Context) string {
+	if key := service.FromContext[*hashKey](ctx); key != nil {
+		return key.hash
+	}
+	return ""
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// interpolate replaces ${NAME} and ${file:/path} placeholders inside the
+// JSON strings of content with the value of the environment variable or the
+// contents of the file (without its trailing newline). Relative file paths
+// are resolved against baseDir. "$${" produces a literal "${". Values are
+// JSON-escaped, so a placeholder may be all or part of a string.
+func interpolate(content []byte, baseDir string) ([]byte, error) {
+	if !bytes.Contains(content, []byte("${")) {
+		return content, nil
+	}
+	var (
+		output   = make([]byte, 0, len(content))
+		inString bool
+		line     = 1
+	)
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '\n':
+			line++
+		case c == '"':
+			inString = !inString
+		case c == '\\' && inString && i+1 < len(content):
+			output = append(output, c, content[i+1])
+			i++
+			continue
+		case c == '$' && inString && bytes.HasPrefix(content[i+1:], []byte("${")):
+			output = append(output, "${"...)
+			i += 2
+			continue
+		case c == '$' && inString && bytes.HasPrefix(content[i+1:], []byte("{")):
+			end := bytes.IndexAny(content[i+2:], "}\"\n")
+			if end < 0 || content[i+2+end] != '}' {
+				return nil, fmt.Errorf("line %d: unterminated placeholder", line)
+			}
+			value, err := resolvePlaceholder(string(content[i+2:i+2+end]), baseDir)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			escaped, _ := json.Marshal(value)
+			output = append(output, escaped[1:len(escaped)-1]...)
+			i += 2 + end
+			continue
+		}
+		output = append(output, c)
+	}
+	return output, nil
+}
+
+// Escape turns every "${" inside the JSON strings of content into "$${", so
+// a configuration received from elsewhere can be stored as a file and read
+// back unchanged instead of having its placeholders substituted
+func Escape(content []byte) []byte {
+	if !bytes.Contains(content, []byte("${")) {
+		return content
+	}
+	output := make([]byte, 0, len(content)+16)
+	inString := false
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '"':
+			inString = !inString
+		case c == '\\' && inString && i+1 < len(content):
+			output = append(output, c, content[i+1])
+			i++
+			continue
+		case c == '$' && inString && i+1 < len(content) && content[i+1] == '{':
+			output = append(output, '$')
+		}
+		output = append(output, c)
+	}
+	return output
+}
+
+func resolvePlaceholder(name string, baseDir string) (string, error) {
+	if path, isFile := strings.CutPrefix(name, "file:"); isFile {
+		if path == "" {
+			return "", fmt.Errorf("empty file placeholder")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		value := strings.TrimSuffix(string(content), "\n")
+		return strings.TrimSuffix(value, "\r"), nil
+	}
+	if name == "" {
+		return "", fmt.Errorf("empty placeholder")
+	}
+	value, found := os.LookupEnv(name)
+	if !found {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
@@ -4,13 +4,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/sagernet/sing-box/option"
 )
 
-// Loader handles configuration file loading and validation
+// Loader handles configuration loading and validation. The path may be a
+// single file, a directory of fragments or an HTTPS URL.
 type Loader struct {
-	path string
+	path     string
+	remote   RemoteOptions
+	verbatim bool // Placeholders are left as they are
+	stale    error
 }
 
 // NewLoader creates a new configuration loader
@@ -18,18 +23,73 @@ func NewLoader(path string) *Loader {
 	return &Loader{path: path}
 }
 
-// Load reads and parses the configuration file
-func (l *Loader) Load() (*option.Options, error) {
+// Read returns the configuration with ${ENV_VAR} and ${file:/path}
+// placeholders substituted, so secrets need not be stored in the file, and
+// outbounds extending outbound_templates expanded. Placeholders of remote
+// configurations are left as they are: the configuration server must not
+// read the environment or files of the host.
+func (l *Loader) Read() ([]byte, error) {
+	content, err := l.ReadRaw()
+	if err != nil {
+		return nil, err
+	}
+	if !IsRemote(l.path) && !l.verbatim {
+		baseDir := filepath.Dir(l.path)
+		if info, err := os.Stat(l.path); err == nil && info.IsDir() {
+			baseDir = l.path
+		}
+		content, err = interpolate(content, baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to substitute configuration placeholders: %w", err)
+		}
+	}
+	content, err = resolveTemplates(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve outbound templates: %w", err)
+	}
+	return content, nil
+}
+
+// WithoutPlaceholders leaves the placeholders of the configuration as they
+// are, for configurations written by someone who must not read the
+// environment or files of the host, such as tenants
+func (l *Loader) WithoutPlaceholders() *Loader {
+	l.verbatim = true
+	return l
+}
+
+// ReadRaw returns the configuration without substituting placeholders.
+// When the path is a directory, its *.json fragments are merged into a
+// single document; URLs are fetched and cached, falling back to the cached
+// copy when offline.
+func (l *Loader) ReadRaw() ([]byte, error) {
+	if IsRemote(l.path) {
+		return l.readRemote()
+	}
+
 	// Check if file exists
-	if _, err := os.Stat(l.path); os.IsNotExist(err) {
+	info, err := os.Stat(l.path)
+	if os.IsNotExist(err) {
 		return nil, fmt.Errorf("configuration file not found: %s", l.path)
 	}
+	if err == nil && info.IsDir() {
+		return readDirectory(l.path)
+	}
 
 	// Read file content
 	content, err := os.ReadFile(l.path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read configuration file: %w", err)
 	}
+	return content, nil
+}
+
+// Load reads and parses the configuration file or directory
+func (l *Loader) Load() (*option.Options, error) {
+	content, err := l.Read()
+	if err != nil {
+		return nil, err
+	}
 
 	// Parse JSON
 	var options option.Options
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// taggedLists are the lists whose entries must have unique tags across all
+// fragments of a configuration directory
+var taggedLists = [][]string{
+	{"inbounds"},
+	{"outbounds"},
+	{"outbound_templates"},
+	{"endpoints"},
+	{"dns", "servers"},
+	{"route", "rule_set"},
+}
+
+// readDirectory merges every *.json file of dir in lexical order. Objects
+// are merged recursively, lists are concatenated and other values from
+// later files replace earlier ones, so "10-base.json", "20-outbounds.json"
+// style prefixes control precedence.
+func readDirectory(dir string) ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.json files in configuration directory: %s", dir)
+	}
+	sort.Strings(files)
+
+	merged := make(map[string]any)
+	tags := make(map[string]string)
+	for _, file := range files {
+		fragment, err := decodeFragment(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkTags(fragment, filepath.Base(file), tags); err != nil {
+			return nil, err
+		}
+		merged = mergeObjects(merged, fragment)
+	}
+	return json.Marshal(merged)
+}
+
+// decodeFragment decodes a fragment as it is read, so large fragments are
+// never held in memory twice
+func decodeFragment(file string) (map[string]any, error) {
+	reader, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	defer reader.Close()
+	fragment, err := decodeStream(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filepath.Base(file), err)
+	}
+	return fragment, nil
+}
+
+// checkTags records the tags defined by fragment and fails on a tag that an
+// earlier fragment (or the same one) already defined
+func checkTags(fragment map[string]any, file string, seen map[string]string) error {
+	for _, path := range taggedLists {
+		list, ok := lookup(fragment, path).([]any)
+		if !ok {
+			continue
+		}
+		kind := strings.Join(path, ".")
+		for _, item := range list {
+			entry, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			tag, ok := entry["tag"].(string)
+			if !ok || tag == "" {
+				continue
+			}
+			key := kind + "\x00" + tag
+			if previous, exists := seen[key]; exists {
+				return fmt.Errorf("duplicate tag %q in %s of %s (already defined in %s)", tag, kind, file, previous)
+			}
+			seen[key] = file
+		}
+	}
+	return nil
+}
+
+func lookup(object map[string]any, path []string) any {
+	var value any = object
+	for _, key := range path {
+		current, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = current[key]
+	}
+	return value
+}
+
+func mergeObjects(base map[string]any, overlay map[string]any) map[string]any {
+	for key, value := range overlay {
+		base[key] = mergeValues(base[key], value)
+	}
+	return base
+}
+
+func mergeValues(base any, overlay any) any {
+	switch overlayValue := overlay.(type) {
+	case map[string]any:
+		if baseValue, ok := base.(map[string]any); ok {
+			return mergeObjects(baseValue, overlayValue)
+		}
+	case []any:
+		if baseValue, ok := base.([]any); ok {
+			return append(baseValue, overlayValue...)
+		}
+	}
+	return overlay
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/UTPBox/utp-core/internal/state"
+	"github.com/UTPBox/utp-core/internal/tlsconfig"
+)
+
+const (
+	defaultFetchTimeout = 30 * time.Second
+	maxRemoteSize       = 16 << 20
+)
+
+// RemoteOptions configures fetching a configuration from an HTTPS URL
+type RemoteOptions struct {
+	Header    string        // Request header as "Name: value", e.g. an Authorization header
+	PinSHA256 []string      // SPKI SHA-256 pins replacing certificate verification
+	Timeout   time.Duration // Request timeout (default 30s)
+}
+
+// IsRemote reports whether path is a URL rather than a local path
+func IsRemote(path string) bool {
+	return strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://")
+}
+
+// WithRemote sets how remote configurations are fetched
+func (l *Loader) WithRemote(opts RemoteOptions) *Loader {
+	l.remote = opts
+	return l
+}
+
+// Stale returns the fetch error when the last Read fell back to the cached
+// copy of a remote configuration, or nil
+func (l *Loader) Stale() error {
+	return l.stale
+}
+
+// readRemote downloads the configuration and caches it under the state
+// directory. When the download fails, the cached copy is returned instead
+// and the error is kept for Stale.
+func (l *Loader) readRemote() ([]byte, error) {
+	l.stale = nil
+	if !strings.HasPrefix(l.path, "https://") {
+		return nil, fmt.Errorf("remote configuration must be fetched over https: %s", l.path)
+	}
+	cachePath := state.Path("config-cache", cacheName(l.path))
+	content, err := l.fetch()
+	if err != nil {
+		cached, cacheErr := os.ReadFile(cachePath)
+		if cacheErr != nil {
+			return nil, fmt.Errorf("failed to fetch configuration: %w", err)
+		}
+		l.stale = err
+		return cached, nil
+	}
+	if err := writeCache(cachePath, content); err != nil {
+		return nil, fmt.Errorf("failed to cache configuration: %w", err)
+	}
+	return content, nil
+}
+
+func (l *Loader) fetch() ([]byte, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(l.remote.PinSHA256) > 0 {
+		tlsConfig, err := tlsconfig.PinnedConfig(l.remote.PinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	timeout := l.remote.Timeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, l.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.remote.Header != "" {
+		name, value, found := strings.Cut(l.remote.Header, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid header, expected \"Name: value\": %s", name)
+		}
+		request.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", response.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, maxRemoteSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxRemoteSize {
+		return nil, fmt.Errorf("configuration exceeds %d bytes", maxRemoteSize)
+	}
+	return content, nil
+}
+
+// cacheName derives the cache file name from the URL, so several remote
+// configurations do not share a cache
+func cacheName(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8]) + ".json"
+}
+
+func writeCache(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// decodeStream decodes the JSON object read from reader token by token.
+// json.Decoder.Decode buffers the whole value before decoding it, so a large
+// document would be in memory twice, as text and decoded; tokens are
+// dropped from the buffer once read, leaving only the decoded document.
+// Numbers are kept as json.Number, as with UseNumber.
+func decodeStream(reader io.Reader) (map[string]any, error) {
+	decoder := json.NewDecoder(reader)
+	decoder.UseNumber()
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	object, err := decodeObject(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON object")
+	}
+	return object, nil
+}
+
+// decodeValue decodes the value starting with token
+func decodeValue(decoder *json.Decoder, token json.Token) (any, error) {
+	switch token {
+	case json.Delim('{'):
+		return decodeObject(decoder)
+	case json.Delim('['):
+		return decodeArray(decoder)
+	}
+	return token, nil
+}
+
+// decodeObject decodes the members of an object whose opening brace was read
+func decodeObject(decoder *json.Decoder) (map[string]any, error) {
+	object := make(map[string]any)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := token.(string)
+		if token, err = decoder.Token(); err != nil {
+			return nil, err
+		}
+		if object[key], err = decodeValue(decoder, token); err != nil {
+			return nil, err
+		}
+	}
+	// Closing brace
+	_, err := decoder.Token()
+	return object, err
+}
+
+// decodeArray decodes the elements of an array whose opening bracket was
+// read
+func decodeArray(decoder *json.Decoder) ([]any, error) {
+	array := make([]any, 0)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		value, err := decodeValue(decoder, token)
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+	// Closing bracket
+	_, err := decoder.Token()
+	return array, err
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// resolveTemplates expands outbounds that extend a template. Templates are
+// the tagged entries of the top-level outbound_templates list, holding the
+// settings shared by many servers:
+//
+//	"outbound_templates": [
+//	  { "tag": "cdn", "type": "ws-inject", "path": "/ws", "tls": { "enabled": true } }
+//	],
+//	"outbounds": [
+//	  { "tag": "edge-1", "extends": "cdn", "server": "203.0.113.1" },
+//	  { "tag": "edge-2", "extends": "cdn", "server": "203.0.113.2" }
+//	]
+//
+// The fields of an outbound override those of its template; objects are
+// merged recursively, other values, lists included, are replaced. Templates
+// may extend other templates. The list is removed, since Sing-box does not
+// know it. Configurations without templates are returned unchanged.
+func resolveTemplates(content []byte) ([]byte, error) {
+	if !bytes.Contains(content, []byte(`"outbound_templates"`)) && !bytes.Contains(content, []byte(`"extends"`)) {
+		return content, nil
+	}
+	document, err := decodeStream(bytes.NewReader(content))
+	if err != nil {
+		// Left for the parser, which reports the position
+		return content, nil
+	}
+	templates := make(map[string]map[string]any)
+	if value, exists := document["outbound_templates"]; exists {
+		list, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("outbound_templates: expected a list")
+		}
+		for i, item := range list {
+			template, ok := item.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("outbound_templates[%d]: expected an object", i)
+			}
+			tag, _ := template["tag"].(string)
+			if tag == "" {
+				return nil, fmt.Errorf("outbound_templates[%d]: missing tag", i)
+			}
+			if _, exists := templates[tag]; exists {
+				return nil, fmt.Errorf("duplicate tag %q in outbound_templates", tag)
+			}
+			templates[tag] = template
+		}
+		delete(document, "outbound_templates")
+	}
+	outbounds, _ := document["outbounds"].([]any)
+	for i, item := range outbounds {
+		outbound, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, extends := outbound["extends"]; !extends {
+			continue
+		}
+		resolved, err := inherit(outbound, templates, nil)
+		if err != nil {
+			tag, _ := outbound["tag"].(string)
+			return nil, fmt.Errorf("outbound %q: %w", tag, err)
+		}
+		outbounds[i] = resolved
+	}
+	return json.Marshal(document)
+}
+
+// inherit returns entry merged over the chain of templates it extends.
+// chain holds the templates already visited, to detect cycles.
+func inherit(entry map[string]any, templates map[string]map[string]any, chain []string) (map[string]any, error) {
+	value, extends := entry["extends"]
+	if !extends {
+		return entry, nil
+	}
+	name, ok := value.(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("extends: expected a template tag")
+	}
+	if slices.Contains(chain, name) {
+		return nil, fmt.Errorf("template cycle: %s", strings.Join(append(chain, name), " -> "))
+	}
+	template, exists := templates[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown template %q", name)
+	}
+	base, err := inherit(template, templates, append(chain, name))
+	if err != nil {
+		return nil, err
+	}
+	resolved := overlay(base, entry)
+	delete(resolved, "extends")
+	if tag, exists := entry["tag"]; exists {
+		resolved["tag"] = tag
+	} else {
+		delete(resolved, "tag")
+	}
+	return resolved, nil
+}
+
+// overlay returns a copy of base with the fields of top. Unlike the merging
+// of fragments, lists are replaced rather than concatenated, so an outbound
+// can override a template's list.
+func overlay(base map[string]any, top map[string]any) map[string]any {
+	result := make(map[string]any, len(base)+len(top))
+	for key, value := range base {
+		result[key] = value
+	}
+	for key, value := range top {
+		baseObject, baseIsObject := result[key].(map[string]any)
+		topObject, topIsObject := value.(map[string]any)
+		if baseIsObject && topIsObject {
+			result[key] = overlay(baseObject, topObject)
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
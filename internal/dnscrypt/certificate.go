@@ -0,0 +1,91 @@
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Certificate layout, all integers big-endian:
+//
+//	"DNSC" || es-version (2) || minor version (2) || signature (64) ||
+//	resolver-pk (32) || client-magic (8) || serial (4) || ts-start (4) ||
+//	ts-end (4) || extensions
+//
+// The signature covers everything from resolver-pk on.
+const (
+	certificateMagic     = "DNSC"
+	certificateMinLength = 124
+	signedOffset         = 72
+	// esXSalsa20Poly1305 is the X25519-XSalsa20Poly1305 construction, the
+	// one every DNSCrypt resolver publishes a certificate for
+	esXSalsa20Poly1305 = 0x0001
+)
+
+// certificate is a resolver certificate whose signature was verified
+type certificate struct {
+	resolverKey [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// parseCertificate decodes a certificate published by the provider and
+// checks its signature against signingKey. Certificates of other
+// constructions are reported with errUnsupported.
+func parseCertificate(content []byte, signingKey ed25519.PublicKey) (certificate, error) {
+	if len(content) < certificateMinLength || string(content[:4]) != certificateMagic {
+		return certificate{}, fmt.Errorf("not a DNSCrypt certificate")
+	}
+	if version := binary.BigEndian.Uint16(content[4:6]); version != esXSalsa20Poly1305 {
+		return certificate{}, fmt.Errorf("%w: es-version %d", errUnsupported, version)
+	}
+	if !ed25519.Verify(signingKey, content[signedOffset:], content[8:signedOffset]) {
+		return certificate{}, fmt.Errorf("invalid certificate signature")
+	}
+	var cert certificate
+	copy(cert.resolverKey[:], content[72:104])
+	copy(cert.clientMagic[:], content[104:112])
+	cert.serial = binary.BigEndian.Uint32(content[112:116])
+	cert.notBefore = time.Unix(int64(binary.BigEndian.Uint32(content[116:120])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(content[120:124])), 0)
+	return cert, nil
+}
+
+// valid reports whether now is within the validity period of c
+func (c certificate) valid(now time.Time) bool {
+	return !now.Before(c.notBefore) && now.Before(c.notAfter)
+}
+
+// unescapeTXT turns a TXT string as presented by miekg/dns, with
+// non-printable bytes escaped as \DDD and others as \X, back into bytes
+func unescapeTXT(value string) ([]byte, error) {
+	content := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			content = append(content, value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			return nil, fmt.Errorf("truncated escape in TXT record")
+		}
+		if i+2 < len(value) && isDigit(value[i]) && isDigit(value[i+1]) && isDigit(value[i+2]) {
+			code := int(value[i]-'0')*100 + int(value[i+1]-'0')*10 + int(value[i+2]-'0')
+			if code > 255 {
+				return nil, fmt.Errorf("invalid escape in TXT record")
+			}
+			content = append(content, byte(code))
+			i += 2
+			continue
+		}
+		content = append(content, value[i])
+	}
+	return content, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
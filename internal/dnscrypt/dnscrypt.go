@@ -0,0 +1,308 @@
+// Package dnscrypt is a client of DNSCrypt version 2. The resolver's
+// short-term key is published in certificates signed by the provider's
+// long-term Ed25519 key, fetched as TXT records of the provider name; every
+// query is then padded and encrypted with X25519-XSalsa20Poly1305 under an
+// ephemeral client key, and sent over UDP, or TCP when the answer does not
+// fit.
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/UTPBox/utp-core/internal/clock"
+)
+
+const (
+	// certificateRefresh is how long a certificate is used before the
+	// provider is asked again, so rotated keys are picked up in time
+	certificateRefresh = time.Hour
+	defaultTimeout     = 10 * time.Second
+	minUDPQueryLength  = 256
+	paddingBlock       = 64
+	maxPacketLength    = 65535
+	clientNonceLength  = 12
+	// Queries are prefixed by the client magic, the client public key and
+	// the client half of the nonce
+	queryHeaderLength = 8 + 32 + clientNonceLength
+	// Responses are prefixed by the resolver magic and the full nonce
+	responseHeaderLength = 8 + 24
+)
+
+// resolverMagic starts every encrypted response
+var resolverMagic = []byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+
+var errUnsupported = errors.New("unsupported certificate")
+
+// DialFunc opens a UDP or TCP connection to the resolver
+type DialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
+
+// Client sends queries to one DNSCrypt resolver
+type Client struct {
+	address      string
+	providerName string
+	signingKey   ed25519.PublicKey
+	dial         DialFunc
+
+	access  sync.Mutex
+	current *session
+}
+
+// session is a verified certificate with the ephemeral key pair used with it
+type session struct {
+	cert      certificate
+	fetched   time.Time
+	publicKey [32]byte
+	shared    [32]byte
+}
+
+// New returns a client of the resolver described by stamp
+func New(stamp Stamp, dial DialFunc) *Client {
+	return &Client{
+		address:      stamp.Address,
+		providerName: dns.Fqdn(stamp.ProviderName),
+		signingKey:   ed25519.PublicKey(stamp.PublicKey),
+		dial:         dial,
+	}
+}
+
+// Exchange sends message encrypted to the resolver and returns its
+// decrypted response. A truncated UDP response is retried over TCP.
+func (c *Client) Exchange(ctx context.Context, message *dns.Msg) (*dns.Msg, error) {
+	s, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.exchange(ctx, s, "udp", query)
+	if err == nil && response.Truncated {
+		response, err = c.exchange(ctx, s, "tcp", query)
+	}
+	return response, err
+}
+
+// session returns the current session, fetching a certificate first when
+// there is none or it expired or is due for a refresh
+func (c *Client) session(ctx context.Context) (*session, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	now := clock.Now()
+	if c.current != nil && c.current.cert.valid(now) && now.Sub(c.current.fetched) < certificateRefresh {
+		return c.current, nil
+	}
+	cert, err := c.fetchCertificate(ctx, now)
+	if err != nil {
+		if c.current != nil && c.current.cert.valid(now) {
+			// Keep the valid certificate until the provider answers again
+			return c.current, nil
+		}
+		return nil, fmt.Errorf("fetch DNSCrypt certificate: %w", err)
+	}
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{cert: cert, fetched: now, publicKey: *publicKey}
+	box.Precompute(&s.shared, &cert.resolverKey, secretKey)
+	c.current = s
+	return s, nil
+}
+
+// invalidate drops s after the resolver failed to answer a query sent under
+// it, in case the resolver rotated its key
+func (c *Client) invalidate(s *session) {
+	c.access.Lock()
+	if c.current == s {
+		c.current = nil
+	}
+	c.access.Unlock()
+}
+
+// fetchCertificate asks the resolver for the certificates of the provider
+// and returns the valid one with the highest serial
+func (c *Client) fetchCertificate(ctx context.Context, now time.Time) (certificate, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(c.providerName, dns.TypeTXT)
+	packed, err := query.Pack()
+	if err != nil {
+		return certificate{}, err
+	}
+	content, err := c.roundTrip(ctx, "udp", packed)
+	if err != nil {
+		return certificate{}, err
+	}
+	var response dns.Msg
+	if err := response.Unpack(content); err != nil {
+		return certificate{}, err
+	}
+	if response.Truncated {
+		if content, err = c.roundTrip(ctx, "tcp", packed); err != nil {
+			return certificate{}, err
+		}
+		if err := response.Unpack(content); err != nil {
+			return certificate{}, err
+		}
+	}
+	if response.Id != query.Id {
+		return certificate{}, fmt.Errorf("response ID mismatch")
+	}
+	var (
+		best    certificate
+		found   bool
+		lastErr = fmt.Errorf("no certificate for %s", strings.TrimSuffix(c.providerName, "."))
+	)
+	for _, answer := range response.Answer {
+		txt, isTXT := answer.(*dns.TXT)
+		if !isTXT {
+			continue
+		}
+		content, err := unescapeTXT(strings.Join(txt.Txt, ""))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cert, err := parseCertificate(content, c.signingKey)
+		if err != nil {
+			if !errors.Is(err, errUnsupported) {
+				lastErr = err
+			}
+			continue
+		}
+		if !cert.valid(now) {
+			lastErr = fmt.Errorf("certificate %d valid from %s to %s only", cert.serial, cert.notBefore.UTC(), cert.notAfter.UTC())
+			continue
+		}
+		if !found || cert.serial > best.serial {
+			best, found = cert, true
+		}
+	}
+	if !found {
+		return certificate{}, lastErr
+	}
+	return best, nil
+}
+
+// exchange encrypts query for the resolver, sends it over network and
+// decrypts the response
+func (c *Client) exchange(ctx context.Context, s *session, network string, query []byte) (*dns.Msg, error) {
+	var clientNonce [clientNonceLength]byte
+	if _, err := rand.Read(clientNonce[:]); err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	copy(nonce[:], clientNonce[:])
+	packet := make([]byte, 0, queryHeaderLength+minUDPQueryLength+box.Overhead)
+	packet = append(packet, s.cert.clientMagic[:]...)
+	packet = append(packet, s.publicKey[:]...)
+	packet = append(packet, clientNonce[:]...)
+	packet = box.SealAfterPrecomputation(packet, pad(query, network == "udp"), &nonce, &s.shared)
+
+	content, err := c.roundTrip(ctx, network, packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < responseHeaderLength+box.Overhead || !bytes.Equal(content[:8], resolverMagic) {
+		c.invalidate(s)
+		return nil, fmt.Errorf("invalid DNSCrypt response")
+	}
+	copy(nonce[:], content[8:responseHeaderLength])
+	if !bytes.Equal(nonce[:clientNonceLength], clientNonce[:]) {
+		return nil, fmt.Errorf("DNSCrypt response nonce mismatch")
+	}
+	plain, ok := box.OpenAfterPrecomputation(nil, content[responseHeaderLength:], &nonce, &s.shared)
+	if !ok {
+		c.invalidate(s)
+		return nil, fmt.Errorf("failed to decrypt DNSCrypt response")
+	}
+	plain, err = unpad(plain)
+	if err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	if err := response.Unpack(plain); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// roundTrip sends packet over a new connection and returns the answer, with
+// the two-byte length prefix of DNS over TCP when network is tcp
+func (c *Client) roundTrip(ctx context.Context, network string, packet []byte) ([]byte, error) {
+	conn, err := c.dial(ctx, network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	conn.SetDeadline(deadline)
+	if network == "udp" {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buffer := make([]byte, maxPacketLength)
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		return buffer[:n], nil
+	}
+	framed := make([]byte, 2, 2+len(packet))
+	binary.BigEndian.PutUint16(framed, uint16(len(packet)))
+	if _, err := conn.Write(append(framed, packet...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	content := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// pad appends the ISO/IEC 7816-4 padding of DNSCrypt: 0x80, then zeros up
+// to a multiple of 64 bytes, and at least 256 bytes over UDP, the smallest
+// query resolvers answer, which keeps them from amplifying spoofed queries
+func pad(query []byte, udp bool) []byte {
+	length := (len(query) + 1 + paddingBlock - 1) / paddingBlock * paddingBlock
+	if udp {
+		length = max(length, minUDPQueryLength)
+	}
+	padded := make([]byte, length)
+	copy(padded, query)
+	padded[len(query)] = 0x80
+	return padded
+}
+
+// unpad removes the padding of a decrypted response
+func unpad(content []byte) ([]byte, error) {
+	end := len(content) - 1
+	for end >= 0 && content[end] == 0 {
+		end--
+	}
+	if end < 0 || content[end] != 0x80 {
+		return nil, fmt.Errorf("invalid DNSCrypt padding")
+	}
+	return content[:end], nil
+}
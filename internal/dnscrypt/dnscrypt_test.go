@@ -0,0 +1,292 @@
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+
+	"github.com/UTPBox/utp-core/internal/testkit"
+)
+
+// The resolver of these tests follows the DNSCrypt v2 specification
+// (dnscrypt.info/protocol) with its literal values; none of the code of the
+// client is used.
+const (
+	testProviderName = "2.dnscrypt-cert.example.com."
+	// Certificates: magic | es-version | minor version | signature |
+	// resolver key | client magic | serial | start | end, signed from the
+	// resolver key on
+	certSignedFrom = 4 + 2 + 2 + ed25519.SignatureSize
+	// Queries: client magic | client key | client nonce | box
+	queryBoxFrom = 8 + 32 + 12
+)
+
+// testResolver is a DNSCrypt resolver publishing certificates signed by its
+// provider key and answering A queries with 192.0.2.1. Names under
+// large.example are truncated over UDP.
+type testResolver struct {
+	signingKey  ed25519.PrivateKey
+	certs       [][]byte
+	publicKey   *[32]byte
+	secretKey   *[32]byte
+	clientMagic [8]byte
+
+	access   sync.Mutex
+	networks []string // Of the encrypted queries answered
+}
+
+func newResolver(t *testing.T) *testResolver {
+	t.Helper()
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testResolver{signingKey: signingKey, publicKey: publicKey, secretKey: secretKey}
+	rand.Read(r.clientMagic[:])
+	return r
+}
+
+// certificate returns a certificate of resolverKey signed with signingKey
+func (r *testResolver) certificate(signingKey ed25519.PrivateKey, resolverKey *[32]byte, serial uint32, notBefore time.Time, notAfter time.Time) []byte {
+	cert := []byte("DNSC")
+	cert = binary.BigEndian.AppendUint16(cert, 0x0001) // X25519-XSalsa20Poly1305
+	cert = binary.BigEndian.AppendUint16(cert, 0)
+	cert = append(cert, make([]byte, ed25519.SignatureSize)...)
+	cert = append(cert, resolverKey[:]...)
+	cert = append(cert, r.clientMagic[:]...)
+	cert = binary.BigEndian.AppendUint32(cert, serial)
+	cert = binary.BigEndian.AppendUint32(cert, uint32(notBefore.Unix()))
+	cert = binary.BigEndian.AppendUint32(cert, uint32(notAfter.Unix()))
+	copy(cert[8:certSignedFrom], ed25519.Sign(signingKey, cert[certSignedFrom:]))
+	return cert
+}
+
+// serve answers the queries of conn: a datagram each over udp, and length
+// prefixed over tcp
+func (r *testResolver) serve(network string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		var query []byte
+		if network == "udp" {
+			buffer := make([]byte, 65535)
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			query = buffer[:n]
+		} else {
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query = make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+		}
+		response, err := r.answer(network, query)
+		if err != nil {
+			return
+		}
+		if network == "tcp" {
+			response = append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...)
+		}
+		conn.Write(response)
+	}
+}
+
+func (r *testResolver) answer(network string, query []byte) ([]byte, error) {
+	if !bytes.HasPrefix(query, r.clientMagic[:]) {
+		// Certificates are asked for in the clear
+		var message dns.Msg
+		if err := message.Unpack(query); err != nil {
+			return nil, err
+		}
+		response := new(dns.Msg).SetReply(&message)
+		for _, cert := range r.certs {
+			var escaped strings.Builder
+			for _, b := range cert {
+				fmt.Fprintf(&escaped, "\\%03d", b)
+			}
+			response.Answer = append(response.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: testProviderName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 86400},
+				Txt: []string{escaped.String()},
+			})
+		}
+		return response.Pack()
+	}
+	// Queries over UDP are padded to 256 bytes at least
+	if len(query) < queryBoxFrom+box.Overhead || network == "udp" && len(query) < 256 {
+		return nil, fmt.Errorf("short query")
+	}
+	var clientKey [32]byte
+	var nonce [24]byte
+	copy(clientKey[:], query[8:40])
+	copy(nonce[:], query[40:queryBoxFrom]) // Then 12 zero bytes
+	padded, ok := box.Open(nil, query[queryBoxFrom:], &nonce, &clientKey, r.secretKey)
+	if !ok {
+		return nil, fmt.Errorf("undecryptable query")
+	}
+	// ISO/IEC 7816-4 padding to a multiple of 64 bytes
+	plain := bytes.TrimRight(padded, "\x00")
+	if len(padded)%64 != 0 || len(plain) == 0 || plain[len(plain)-1] != 0x80 {
+		return nil, fmt.Errorf("invalid query padding")
+	}
+	plain = plain[:len(plain)-1]
+	var message dns.Msg
+	if err := message.Unpack(plain); err != nil {
+		return nil, err
+	}
+	r.access.Lock()
+	r.networks = append(r.networks, network)
+	r.access.Unlock()
+	response := new(dns.Msg).SetReply(&message)
+	if network == "udp" && dns.IsSubDomain("large.example.", message.Question[0].Name) {
+		response.Truncated = true
+	} else {
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: message.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		return nil, err
+	}
+	rand.Read(nonce[12:])
+	packed = append(packed, 0x80)
+	packed = append(packed, make([]byte, 63-(len(packed)+63)%64)...)
+	content := append([]byte("r6fnvWj8"), nonce[:]...)
+	return box.Seal(content, packed, &nonce, &clientKey, r.secretKey), nil
+}
+
+// clientOf serves r on an in-memory network and returns a client of it
+func clientOf(t *testing.T, r *testResolver) *Client {
+	t.Helper()
+	network := &testkit.Network{}
+	for _, name := range []string{"udp", "tcp"} {
+		listener, err := network.Serve(name+"://192.0.2.53:443", r.serve(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+	}
+	stamp := Stamp{
+		Address:      "192.0.2.53:443",
+		PublicKey:    r.signingKey.Public().(ed25519.PublicKey),
+		ProviderName: testProviderName,
+	}
+	return New(stamp, func(ctx context.Context, name string, address string) (net.Conn, error) {
+		return network.DialContext(ctx, name, name+"://"+address)
+	})
+}
+
+func exchange(client *Client, name string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return client.Exchange(ctx, new(dns.Msg).SetQuestion(name, dns.TypeA))
+}
+
+func TestExchange(t *testing.T) {
+	r := newResolver(t)
+	now := time.Now()
+	// The certificate with the highest serial is used; the resolver no
+	// longer has the key of the other
+	oldKey, _, _ := box.GenerateKey(rand.Reader)
+	r.certs = [][]byte{
+		r.certificate(r.signingKey, oldKey, 1, now.Add(-time.Hour), now.Add(time.Hour)),
+		r.certificate(r.signingKey, r.publicKey, 2, now.Add(-time.Hour), now.Add(time.Hour)),
+	}
+	client := clientOf(t, r)
+	for _, name := range []string{"www.example.com.", "www.large.example."} {
+		response, err := exchange(client, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+			t.Fatalf("%s: answer %v", name, response.Answer)
+		}
+	}
+	r.access.Lock()
+	defer r.access.Unlock()
+	// The truncated answer was asked for again over TCP
+	if strings.Join(r.networks, ",") != "udp,udp,tcp" {
+		t.Fatalf("queries over %v, want udp, then udp and tcp", r.networks)
+	}
+}
+
+func TestInvalidCertificate(t *testing.T) {
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	for _, test := range []struct {
+		name    string
+		cert    func(r *testResolver) []byte
+		message string
+	}{
+		{"signature", func(r *testResolver) []byte {
+			return r.certificate(otherKey, r.publicKey, 1, now.Add(-time.Hour), now.Add(time.Hour))
+		}, "invalid certificate signature"},
+		{"expired", func(r *testResolver) []byte {
+			return r.certificate(r.signingKey, r.publicKey, 1, now.Add(-2*time.Hour), now.Add(-time.Hour))
+		}, "valid from"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := newResolver(t)
+			r.certs = [][]byte{test.cert(r)}
+			_, err := exchange(clientOf(t, r), "www.example.com.")
+			if err == nil || !strings.Contains(err.Error(), test.message) {
+				t.Fatalf("error = %v, want %q", err, test.message)
+			}
+		})
+	}
+}
+
+func TestParseStamp(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, ed25519.PublicKeySize)
+	encode := func(address string) string {
+		content := []byte{0x01, 0, 0, 0, 0, 0, 0, 0, 0} // DNSCrypt, no properties
+		for _, field := range [][]byte{[]byte(address), key, []byte("2.dnscrypt-cert.example.com")} {
+			content = append(content, byte(len(field)))
+			content = append(content, field...)
+		}
+		return "sdns://" + base64.RawURLEncoding.EncodeToString(content)
+	}
+	for _, test := range []struct {
+		address string
+		want    string
+	}{
+		{"192.0.2.1", "192.0.2.1:443"},
+		{"192.0.2.1:8443", "192.0.2.1:8443"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+		{"[2001:db8::1]:8443", "[2001:db8::1]:8443"},
+	} {
+		stamp, err := ParseStamp(encode(test.address))
+		if err != nil {
+			t.Fatalf("%s: %v", test.address, err)
+		}
+		if stamp.Address != test.want || !bytes.Equal(stamp.PublicKey, key) || stamp.ProviderName != "2.dnscrypt-cert.example.com" {
+			t.Fatalf("%s: parsed %+v", test.address, stamp)
+		}
+	}
+	for _, stamp := range []string{"sdns://", "https://example.com", encode("192.0.2.1")[:20]} {
+		if _, err := ParseStamp(stamp); err == nil {
+			t.Fatalf("%s: parsed", stamp)
+		}
+	}
+}
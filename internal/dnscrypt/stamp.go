@@ -0,0 +1,90 @@
+package dnscrypt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	stampScheme      = "sdns://"
+	stampDNSCrypt    = 0x01
+	defaultPort      = "443"
+	signingKeyLength = 32
+)
+
+// Stamp is a DNSCrypt resolver stamp: the server address, the provider's
+// signing key and the provider name its certificates are published under
+type Stamp struct {
+	Address      string // host:port
+	PublicKey    []byte // Ed25519 key signing the certificates
+	ProviderName string // e.g. 2.dnscrypt-cert.example.com
+}
+
+// ParseStamp decodes an sdns:// stamp of a DNSCrypt resolver, as listed in
+// the public resolver lists of dnscrypt-proxy:
+//
+//	0x01 || props (8 bytes) || LP(addr) || LP(pk) || LP(provider name)
+//
+// where LP is a one-byte length followed by the value. The port of addr
+// defaults to 443.
+func ParseStamp(stamp string) (Stamp, error) {
+	encoded, found := strings.CutPrefix(stamp, stampScheme)
+	if !found {
+		return Stamp{}, fmt.Errorf("stamp must start with %s", stampScheme)
+	}
+	content, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return Stamp{}, fmt.Errorf("invalid stamp encoding: %w", err)
+	}
+	if len(content) < 9 {
+		return Stamp{}, fmt.Errorf("stamp too short")
+	}
+	if content[0] != stampDNSCrypt {
+		return Stamp{}, fmt.Errorf("not a DNSCrypt stamp (protocol 0x%02x)", content[0])
+	}
+	// Properties (DNSSEC, no logs, no filter) only describe the resolver
+	rest := content[9:]
+	var fields [3][]byte
+	for i := range fields {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return Stamp{}, fmt.Errorf("stamp truncated")
+		}
+		fields[i], rest = rest[1:1+int(rest[0])], rest[1+int(rest[0]):]
+	}
+	if len(rest) > 0 {
+		return Stamp{}, fmt.Errorf("unexpected data after the stamp")
+	}
+	address, err := stampAddress(string(fields[0]))
+	if err != nil {
+		return Stamp{}, err
+	}
+	if len(fields[1]) != signingKeyLength {
+		return Stamp{}, fmt.Errorf("invalid public key length %d in stamp", len(fields[1]))
+	}
+	if len(fields[2]) == 0 {
+		return Stamp{}, fmt.Errorf("missing provider name in stamp")
+	}
+	return Stamp{
+		Address:      address,
+		PublicKey:    fields[1],
+		ProviderName: string(fields[2]),
+	}, nil
+}
+
+// stampAddress adds the default port to the address of a stamp, which may
+// be "192.0.2.1", "192.0.2.1:8443", "[2001:db8::1]" or "[2001:db8::1]:8443"
+func stampAddress(address string) (string, error) {
+	if address == "" {
+		return "", fmt.Errorf("missing address in stamp")
+	}
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		return net.JoinHostPort(host, port), nil
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if strings.ContainsAny(host, "[]") {
+		return "", fmt.Errorf("invalid address %q in stamp", address)
+	}
+	return net.JoinHostPort(host, defaultPort), nil
+}
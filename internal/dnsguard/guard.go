@@ -0,0 +1,212 @@
+// Package dnsguard defends outbound server dials against DNS cache
+// poisoning. Censoring resolvers commonly answer with bogons, loopback or a
+// small set of injected addresses; the guard rejects such answers and
+// re-resolves the server name through a trusted DNS server before dialing.
+package dnsguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/breaker"
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/netdial"
+	"github.com/UTPBox/utp-core/internal/shaping"
+)
+
+// Options is embedded by extension outbound options
+type Options struct {
+	RejectBogon  bool     `json:"reject_bogon,omitempty"`   // Reject private, loopback, reserved and multicast answers
+	RejectIPCIDR []string `json:"reject_ip_cidr,omitempty"` // Additional poisoned addresses or prefixes
+	SecureDNS    string   `json:"secure_dns,omitempty"`     // DNS server tag used to re-resolve after a poisoned answer
+}
+
+// Enabled reports whether any check is configured
+func (o Options) Enabled() bool {
+	return o.RejectBogon || len(o.RejectIPCIDR) > 0
+}
+
+// bogons are never valid addresses for a public proxy server
+var bogons = mustPrefixes(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+	"2001:db8::/32",
+)
+
+// Guard resolves server names and filters poisoned answers. A nil Guard
+// dials without any checks.
+type Guard struct {
+	ctx       context.Context
+	bogon     bool
+	rejected  []netip.Prefix
+	secureDNS string
+}
+
+// New returns a guard, or nil when no check is configured
+func New(ctx context.Context, opts Options) (*Guard, error) {
+	if !opts.Enabled() {
+		return nil, nil
+	}
+	g := &Guard{
+		ctx:       ctx,
+		bogon:     opts.RejectBogon,
+		secureDNS: opts.SecureDNS,
+	}
+	for _, value := range opts.RejectIPCIDR {
+		prefix, err := parsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("dns guard: %w", err)
+		}
+		g.rejected = append(g.rejected, prefix)
+	}
+	return g, nil
+}
+
+// Poisoned reports whether addr is a known poisoning answer
+func (g *Guard) Poisoned(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if g.bogon {
+		for _, prefix := range bogons {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	for _, prefix := range g.rejected {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the usable addresses of host. IP literals are returned
+// as-is, since they come from the configuration rather than from DNS.
+func (g *Guard) Resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("failed to resolve %s: %w", host, err))
+	}
+	clean := g.filter(addrs)
+	if len(clean) == len(addrs) {
+		return clean, nil
+	}
+
+	// The system resolver returned poisoned answers, ask the trusted server
+	if g.secureDNS != "" {
+		addrs, err = g.lookupSecure(ctx, host)
+		if err != nil {
+			return nil, failure.New(failure.KindDNSFailure, failure.StageConnect, fmt.Errorf("failed to re-resolve %s via %s: %w", host, g.secureDNS, err))
+		}
+		clean = g.filter(addrs)
+	}
+	if len(clean) == 0 {
+		return nil, failure.New(failure.KindDNSFailure, failure.StageConnect, fmt.Errorf("poisoned DNS answer for %s: %v", host, addrs))
+	}
+	return clean, nil
+}
+
+// DialContext resolves host through the guard and dials the first address
+// that answers, unless a failure storm holds dials back (see
+// internal/breaker). Connections shape their first flight under the policy
+// in force (see internal/shaping).
+func (g *Guard) DialContext(ctx context.Context, dialer netdial.Dialer, network string, host string, port int) (net.Conn, error) {
+	if err := breaker.Admit(); err != nil {
+		return nil, failure.New(failure.KindBackoff, failure.StageConnect, err)
+	}
+	if g == nil {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			return nil, err
+		}
+		return shaping.Wrap(conn), nil
+	}
+	addrs, err := g.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, netip.AddrPortFrom(addr, uint16(port)).String())
+		if err == nil {
+			return shaping.Wrap(conn), nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (g *Guard) filter(addrs []netip.Addr) []netip.Addr {
+	clean := make([]netip.Addr, 0, len(addrs))
+	for _, addr := range addrs {
+		if !g.Poisoned(addr) {
+			clean = append(clean, addr.Unmap())
+		}
+	}
+	return clean
+}
+
+func (g *Guard) lookupSecure(ctx context.Context, host string) ([]netip.Addr, error) {
+	router := service.FromContext[adapter.DNSRouter](g.ctx)
+	transports := service.FromContext[adapter.DNSTransportManager](g.ctx)
+	if router == nil || transports == nil {
+		return nil, fmt.Errorf("DNS router not available")
+	}
+	transport, loaded := transports.Transport(g.secureDNS)
+	if !loaded {
+		return nil, fmt.Errorf("DNS server not found: %s", g.secureDNS)
+	}
+	return router.Lookup(ctx, host, adapter.DNSQueryOptions{
+		Transport:    transport,
+		DisableCache: true,
+	})
+}
+
+// parsePrefix accepts a CIDR prefix or a single address
+func parsePrefix(value string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid reject_ip_cidr value: %s", value)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func mustPrefixes(values ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		prefixes = append(prefixes, netip.MustParsePrefix(value))
+	}
+	return prefixes
+}
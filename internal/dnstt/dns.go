@@ -0,0 +1,281 @@
+package dnstt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Framing of the DNS messages, as dnstt defines it: queries carry the client
+// ID, padding and at most one packet in the base32 labels of a TXT question
+// under the tunnel domain; responses carry packets in the TXT answer
+const (
+	clientIDSize       = 8
+	paddingForData     = 3 // Random bytes defeating resolver caches
+	paddingForPoll     = 8
+	paddingPrefix      = 224 // Length prefixes from 224 on introduce padding
+	maxLabel           = 63
+	maxName            = 255
+	typeTXT            = 16
+	typeOPT            = 41
+	classIN            = 1
+	ednsPayloadSize    = 4096
+	initialPollDelay   = 500 * time.Millisecond
+	maxPollDelay       = 10 * time.Second
+	pollDelayFactor    = 2
+	pollLimit          = 16
+	outgoingQueueLimit = 128
+)
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// nameCapacity returns how many payload bytes fit in the labels of a query
+// name under domain
+func nameCapacity(domain []string) int {
+	capacity := maxName - 1 // Root label
+	for _, label := range domain {
+		capacity -= len(label) + 1
+	}
+	// Every 63 bytes take a length octet, and base32 turns 5 bytes into 8
+	return capacity * maxLabel / (maxLabel + 1) * 5 / 8
+}
+
+// transport exchanges DNS messages with the recursive resolver. Responses
+// are handed to the receive function given when it was opened.
+type transport interface {
+	send(query []byte) error
+	Close() error
+}
+
+// tunnel carries the packets of a KCP session in DNS queries and responses.
+// The server can only answer queries, so the client keeps polling with
+// empty queries, more often while packets flow and backing off while idle.
+type tunnel struct {
+	transport transport
+	domain    []string
+	clientID  [clientIDSize]byte
+	receive   func(packet []byte)
+	outgoing  chan []byte
+	polls     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func newTunnel(domain []string, receive func([]byte)) *tunnel {
+	t := &tunnel{
+		domain:   domain,
+		receive:  receive,
+		outgoing: make(chan []byte, outgoingQueueLimit),
+		polls:    make(chan struct{}, pollLimit),
+		done:     make(chan struct{}),
+	}
+	rand.Read(t.clientID[:])
+	return t
+}
+
+// start sends queries over transport until the tunnel is closed
+func (t *tunnel) start(transport transport) {
+	t.transport = transport
+	go t.sendLoop()
+}
+
+// send queues packet for the next query, dropping it when the queue is full
+// as a congested link would; KCP retransmits it
+func (t *tunnel) send(packet []byte) {
+	select {
+	case t.outgoing <- append([]byte(nil), packet...):
+	default:
+	}
+}
+
+func (t *tunnel) close(err error) {
+	t.closeOnce.Do(func() {
+		t.err = err
+		close(t.done)
+		if t.transport != nil {
+			t.transport.Close()
+		}
+	})
+}
+
+func (t *tunnel) sendLoop() {
+	pollDelay := initialPollDelay
+	pollTimer := time.NewTimer(pollDelay)
+	defer pollTimer.Stop()
+	for {
+		var packet []byte
+		expired := false
+		select {
+		case packet = <-t.outgoing:
+		default:
+			select {
+			case packet = <-t.outgoing:
+			case <-t.polls:
+			case <-pollTimer.C:
+				expired = true
+			case <-t.done:
+				return
+			}
+		}
+		if len(packet) > 0 {
+			// A query carrying data is a poll as well
+			select {
+			case <-t.polls:
+			default:
+			}
+		}
+		if expired {
+			pollDelay = min(pollDelay*pollDelayFactor, maxPollDelay)
+		} else {
+			if !pollTimer.Stop() {
+				select {
+				case <-pollTimer.C:
+				default:
+				}
+			}
+			pollDelay = initialPollDelay
+		}
+		pollTimer.Reset(pollDelay)
+		if err := t.transport.send(t.query(packet)); err != nil {
+			t.close(err)
+			return
+		}
+	}
+}
+
+// query returns the DNS query carrying packet, or polling without one
+func (t *tunnel) query(packet []byte) []byte {
+	padding := paddingForData
+	if len(packet) == 0 {
+		padding = paddingForPoll
+	}
+	payload := append([]byte(nil), t.clientID[:]...)
+	payload = append(payload, byte(paddingPrefix+padding))
+	payload = append(payload, make([]byte, padding)...)
+	rand.Read(payload[len(payload)-padding:])
+	if len(packet) > 0 {
+		payload = append(payload, byte(len(packet)))
+		payload = append(payload, packet...)
+	}
+	encoded := strings.ToLower(base32Encoding.EncodeToString(payload))
+
+	var id [2]byte
+	rand.Read(id[:])
+	message := append(id[:], 0x01, 0x00)                // RD
+	message = binary.BigEndian.AppendUint16(message, 1) // QDCOUNT
+	message = binary.BigEndian.AppendUint16(message, 0) // ANCOUNT
+	message = binary.BigEndian.AppendUint16(message, 0) // NSCOUNT
+	message = binary.BigEndian.AppendUint16(message, 1) // ARCOUNT
+	for len(encoded) > 0 {
+		label := encoded[:min(len(encoded), maxLabel)]
+		encoded = encoded[len(label):]
+		message = append(message, byte(len(label)))
+		message = append(message, label...)
+	}
+	for _, label := range t.domain {
+		message = append(message, byte(len(label)))
+		message = append(message, label...)
+	}
+	message = append(message, 0)
+	message = binary.BigEndian.AppendUint16(message, typeTXT)
+	message = binary.BigEndian.AppendUint16(message, classIN)
+	// EDNS(0) OPT record announcing large responses
+	message = append(message, 0)
+	message = binary.BigEndian.AppendUint16(message, typeOPT)
+	message = binary.BigEndian.AppendUint16(message, ednsPayloadSize)
+	message = binary.BigEndian.AppendUint32(message, 0)
+	message = binary.BigEndian.AppendUint16(message, 0)
+	return message
+}
+
+// handleResponse passes the packets of a response to the KCP session
+func (t *tunnel) handleResponse(response []byte) {
+	payload, err := responsePayload(response)
+	if err != nil {
+		return
+	}
+	received := false
+	for len(payload) >= 2 {
+		length := int(binary.BigEndian.Uint16(payload))
+		if len(payload) < 2+length {
+			break
+		}
+		t.receive(payload[2 : 2+length])
+		payload = payload[2+length:]
+		received = true
+	}
+	if received {
+		// More may be waiting on the server: poll again at once
+		select {
+		case t.polls <- struct{}{}:
+		default:
+		}
+	}
+}
+
+var errNoPayload = errors.New("no tunnel payload")
+
+// responsePayload returns the data of the TXT answer of response
+func responsePayload(response []byte) ([]byte, error) {
+	if len(response) < 12 {
+		return nil, errNoPayload
+	}
+	flags := binary.BigEndian.Uint16(response[2:])
+	if flags&0x8000 == 0 || flags&0x000f != 0 { // QR, RCODE
+		return nil, errNoPayload
+	}
+	questions := binary.BigEndian.Uint16(response[4:])
+	answers := binary.BigEndian.Uint16(response[6:])
+	if answers == 0 {
+		return nil, errNoPayload
+	}
+	offset := 12
+	for range questions {
+		offset = skipName(response, offset)
+		offset += 4 // QTYPE, QCLASS
+	}
+	offset = skipName(response, offset)
+	if offset < 0 || offset+10 > len(response) {
+		return nil, errNoPayload
+	}
+	rrType := binary.BigEndian.Uint16(response[offset:])
+	length := int(binary.BigEndian.Uint16(response[offset+8:]))
+	offset += 10
+	if rrType != typeTXT || offset+length > len(response) {
+		return nil, errNoPayload
+	}
+	// The character-strings of the TXT record, concatenated
+	var payload bytes.Buffer
+	data := response[offset : offset+length]
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			return nil, errNoPayload
+		}
+		payload.Write(data[1 : 1+n])
+		data = data[1+n:]
+	}
+	return payload.Bytes(), nil
+}
+
+// skipName returns the offset following the name at offset, or -1
+func skipName(message []byte, offset int) int {
+	for offset >= 0 && offset < len(message) {
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			return offset + 1
+		case length&0xc0 == 0xc0: // Compression pointer
+			return offset + 2
+		default:
+			offset += 1 + length
+		}
+	}
+	return -1
+}
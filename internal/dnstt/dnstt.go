@@ -0,0 +1,212 @@
+// Package dnstt is a client of dnstt, the DNS tunnel of David Fifield: a
+// KCP session carried in the TXT queries and responses of a tunnel domain
+// delegated to the dnstt server, encrypted with Noise (NK, authenticating the
+// server by its public key) and multiplexed with smux. Queries go through a
+// recursive resolver over UDP, DNS over TLS or DNS over HTTPS, so only the
+// resolver is seen on the network. Each stream reaches the one upstream the
+// server forwards to, usually an SSH server.
+package dnstt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/smux"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/netdial"
+)
+
+// Session parameters of dnstt
+const (
+	minMTU          = 80
+	idleTimeout     = 2 * time.Minute
+	maxStreamBuffer = 1 << 20
+)
+
+// TunnelOptions is embedded by the options of outbounds reaching their
+// server through a dnstt tunnel
+type TunnelOptions struct {
+	Domain    string `json:"domain"`     // Tunnel domain delegated to the dnstt server
+	PublicKey string `json:"public_key"` // Server public key in hex, as written by dnstt-server -gen-key
+	Resolver  string `json:"resolver"`   // udp://8.8.8.8:53 (or 8.8.8.8), tls://dns.google or https://dns.google/dns-query
+}
+
+// Client opens streams through one dnstt session, established on the first
+// dial and again once it drops
+type Client struct {
+	domain    []string
+	serverKey []byte
+	mtu       int
+	resolver  *url.URL
+	dialer    netdial.Dialer
+
+	access  sync.Mutex
+	session *smux.Session
+}
+
+// New checks opts and returns a client reaching the resolver through dialer
+func New(opts TunnelOptions, dialer netdial.Dialer) (*Client, error) {
+	domain := strings.Split(strings.Trim(strings.ToLower(opts.Domain), "."), ".")
+	if opts.Domain == "" || opts.PublicKey == "" || opts.Resolver == "" {
+		return nil, fmt.Errorf("dnstt requires domain, public_key and resolver")
+	}
+	for _, label := range domain {
+		if label == "" || len(label) > maxLabel {
+			return nil, fmt.Errorf("invalid dnstt domain: %s", opts.Domain)
+		}
+	}
+	serverKey, err := hex.DecodeString(strings.TrimSpace(opts.PublicKey))
+	if err != nil || len(serverKey) != 32 {
+		return nil, fmt.Errorf("invalid dnstt public_key: expected 64 hex digits")
+	}
+	// The client ID, the padding with its prefix and the packet length
+	// prefix share the query name with the KCP packet
+	mtu := nameCapacity(domain) - clientIDSize - 1 - paddingForData - 1
+	if mtu < minMTU {
+		return nil, fmt.Errorf("dnstt domain too long: %s", opts.Domain)
+	}
+	resolver, err := parseResolver(opts.Resolver)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		domain:    domain,
+		serverKey: serverKey,
+		mtu:       mtu,
+		resolver:  resolver,
+		dialer:    dialer,
+	}, nil
+}
+
+// parseResolver accepts udp://, tls:// and https:// URLs, and bare
+// addresses meaning UDP
+func parseResolver(value string) (*url.URL, error) {
+	if !strings.Contains(value, "://") {
+		value = "udp://" + value
+	}
+	resolver, err := url.Parse(value)
+	if err != nil || resolver.Host == "" {
+		return nil, fmt.Errorf("invalid dnstt resolver: %s", value)
+	}
+	switch resolver.Scheme {
+	case "udp", "tls", "https":
+	default:
+		return nil, fmt.Errorf("invalid dnstt resolver: %s: expected udp://, tls:// or https://", value)
+	}
+	return resolver, nil
+}
+
+// DialContext opens a stream to the upstream of the server
+func (c *Client) DialContext(ctx context.Context) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		session, err := c.current(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := session.OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+		session.Close()
+		if attempt > 0 || ctx.Err() != nil {
+			return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("dnstt stream: %w", err))
+		}
+	}
+}
+
+// Close ends the session and its streams
+func (c *Client) Close() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+	return nil
+}
+
+// current returns the live session, establishing one when there is none
+func (c *Client) current(ctx context.Context) (*smux.Session, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.session != nil && !c.session.IsClosed() {
+		return c.session, nil
+	}
+	session, err := c.establish(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.session = session
+	return session, nil
+}
+
+// establish opens the transport to the resolver and runs the KCP, Noise and
+// smux layers over it
+func (c *Client) establish(ctx context.Context) (*smux.Session, error) {
+	var kcp *kcpConn
+	t := newTunnel(c.domain, func(packet []byte) { kcp.input(packet) })
+	var conv [4]byte
+	rand.Read(conv[:])
+	kcp = newKCPConn(binary.LittleEndian.Uint32(conv[:]), c.mtu, t.send)
+
+	var transport transport
+	var err error
+	switch c.resolver.Scheme {
+	case "udp":
+		transport, err = dialUDP(ctx, c.dialer, hostPort(c.resolver.Host, "53"), t)
+	case "tls":
+		transport, err = dialDoT(ctx, c.dialer, hostPort(c.resolver.Host, "853"), c.resolver.Hostname(), t)
+	default:
+		transport = newDoH(c.dialer, c.resolver.String(), t)
+	}
+	if err != nil {
+		kcp.Close()
+		return nil, failure.Wrap(failure.StageConnect, fmt.Errorf("dnstt resolver %s: %w", c.resolver.Host, err))
+	}
+	t.start(transport)
+	// Tear the layers below down with the KCP session
+	go func() {
+		select {
+		case <-kcp.done:
+		case <-t.done:
+			kcp.close(fmt.Errorf("dnstt resolver: %w", t.err))
+		}
+		t.close(net.ErrClosed)
+	}()
+
+	stop := context.AfterFunc(ctx, func() { kcp.close(ctx.Err()) })
+	conn, err := noiseHandshake(kcp, c.serverKey)
+	if !stop() || err != nil {
+		kcp.Close()
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, failure.Wrap(failure.StageHandshake, fmt.Errorf("dnstt handshake: %w", err))
+	}
+	config := smux.DefaultConfig()
+	config.Version = 2
+	config.KeepAliveTimeout = idleTimeout
+	config.MaxStreamBuffer = maxStreamBuffer
+	session, err := smux.Client(conn, config)
+	if err != nil {
+		kcp.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func hostPort(host string, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
@@ -0,0 +1,520 @@
+package dnstt
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sagernet/smux"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/testkit"
+)
+
+// The server of these tests follows dnstt-server (www.bamsoftware.com/git/
+// dnstt.git) layer by layer, with miekg/dns, the Noise specification and a
+// KCP responder written here; none of the code of the client is used.
+const (
+	tunnelDomain = "t.example."
+	// Packets of the server, as KCP segments: header and data
+	serverSegment = 24 + 900
+	// How long a query is held for downstream packets, as dnstt servers do
+	// to save the client polls
+	holdTime = 50 * time.Millisecond
+)
+
+// tunnelServer answers the queries of one client. Its streams are echoed
+// back.
+type tunnelServer struct {
+	static []byte
+	public []byte
+
+	access     sync.Mutex
+	session    *kcpResponder
+	downstream [][]byte // Packets waiting for a query
+}
+
+func newTunnelServer() *tunnelServer {
+	s := &tunnelServer{static: make([]byte, 32)}
+	rand.Read(s.static)
+	s.public, _ = curve25519.X25519(s.static, curve25519.Basepoint)
+	return s
+}
+
+func (s *tunnelServer) serve(conn net.Conn) {
+	buffer := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		query := new(dns.Msg)
+		if query.Unpack(buffer[:n]) != nil {
+			continue
+		}
+		go func() {
+			if response, err := s.answer(query); err == nil {
+				conn.Write(response)
+			}
+		}()
+	}
+}
+
+// answer takes the packets of a query, whose name is the base32 of client
+// ID | padding | packets under the tunnel domain, each after a length
+// octet (224 and above introduce padding), and answers with the packets of
+// the session in a TXT record, each after a 16-bit length
+func (s *tunnelServer) answer(query *dns.Msg) ([]byte, error) {
+	if len(query.Question) != 1 || query.Question[0].Qtype != dns.TypeTXT {
+		return nil, errors.New("not a tunnel query")
+	}
+	name := query.Question[0].Name
+	if !dns.IsSubDomain(tunnelDomain, name) {
+		return nil, fmt.Errorf("query outside of %s", tunnelDomain)
+	}
+	encoded := strings.ReplaceAll(strings.TrimSuffix(name, "."+tunnelDomain), ".", "")
+	payload, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(encoded))
+	if err != nil || len(payload) < 8 {
+		return nil, errors.New("invalid payload")
+	}
+	for rest := payload[8:]; len(rest) > 0; {
+		length := int(rest[0])
+		if length >= 224 {
+			length -= 224
+		} else if 1+length <= len(rest) {
+			s.input(rest[1 : 1+length])
+		}
+		rest = rest[min(1+length, len(rest)):]
+	}
+
+	var downstream []byte
+	for deadline := time.Now().Add(holdTime); len(downstream) < 4000; {
+		s.access.Lock()
+		var packet []byte
+		if len(s.downstream) > 0 {
+			packet, s.downstream = s.downstream[0], s.downstream[1:]
+		}
+		s.access.Unlock()
+		if packet != nil {
+			downstream = binary.BigEndian.AppendUint16(downstream, uint16(len(packet)))
+			downstream = append(downstream, packet...)
+		} else if len(downstream) > 0 || time.Now().After(deadline) {
+			break
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// TXT strings are written as zone file text
+	var texts []string
+	for len(downstream) > 0 || texts == nil {
+		chunk := downstream[:min(len(downstream), 255)]
+		downstream = downstream[len(chunk):]
+		var escaped bytes.Buffer
+		for _, b := range chunk {
+			fmt.Fprintf(&escaped, "\\%03d", b)
+		}
+		texts = append(texts, escaped.String())
+	}
+	response := new(dns.Msg).SetReply(query)
+	response.Authoritative = true
+	response.Answer = []dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: texts,
+	}}
+	return response.Pack()
+}
+
+// input passes a packet to the session, starting it on the first one
+func (s *tunnelServer) input(packet []byte) {
+	if len(packet) < 24 {
+		return
+	}
+	s.access.Lock()
+	if s.session == nil {
+		s.session = newKCPResponder(binary.LittleEndian.Uint32(packet), func(segment []byte) {
+			s.access.Lock()
+			s.downstream = append(s.downstream, segment)
+			s.access.Unlock()
+		})
+		go s.accept(s.session)
+	}
+	session := s.session
+	s.access.Unlock()
+	session.input(packet)
+}
+
+// accept runs Noise and smux over the session, echoing the streams
+func (s *tunnelServer) accept(session *kcpResponder) {
+	defer session.Close()
+	conn, err := respondNK(session, s.static, s.public)
+	if err != nil {
+		return
+	}
+	config := smux.DefaultConfig()
+	config.Version = 2
+	mux, err := smux.Server(conn, config)
+	if err != nil {
+		return
+	}
+	defer mux.Close()
+	for {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			io.Copy(stream, stream)
+		}()
+	}
+}
+
+// kcpResponder is the server end of a KCP session over a link that loses
+// nothing: it acknowledges and orders the segments of the client, and sends
+// its own within the window the client announces. Segments are little
+// endian: conv 4 | cmd 1 | frg 1 | wnd 2 | ts 4 | sn 4 | una 4 | len 4 |
+// data, and carry a byte stream, so frg is 0.
+type kcpResponder struct {
+	conv   uint32
+	output func(segment []byte)
+
+	access    sync.Mutex
+	changed   *sync.Cond
+	received  map[uint32][]byte
+	nextSN    uint32 // Next segment of the client to deliver
+	readable  []byte
+	unsent    [][]byte
+	sendSN    uint32
+	clientUna uint32
+	clientWnd uint32
+	closed    bool
+}
+
+const (
+	kcpCmdPush = 81
+	kcpCmdAck  = 82
+	kcpCmdWask = 83
+	kcpCmdWins = 84
+)
+
+func newKCPResponder(conv uint32, output func([]byte)) *kcpResponder {
+	k := &kcpResponder{conv: conv, output: output, received: make(map[uint32][]byte), clientWnd: 1}
+	k.changed = sync.NewCond(&k.access)
+	return k
+}
+
+// segment returns a segment of the server; access must be held
+func (k *kcpResponder) segment(cmd byte, ts uint32, sn uint32, data []byte) []byte {
+	segment := binary.LittleEndian.AppendUint32(nil, k.conv)
+	segment = append(segment, cmd, 0)
+	segment = binary.LittleEndian.AppendUint16(segment, 256)
+	segment = binary.LittleEndian.AppendUint32(segment, ts)
+	segment = binary.LittleEndian.AppendUint32(segment, sn)
+	segment = binary.LittleEndian.AppendUint32(segment, k.nextSN)
+	segment = binary.LittleEndian.AppendUint32(segment, uint32(len(data)))
+	return append(segment, data...)
+}
+
+func (k *kcpResponder) input(packet []byte) {
+	k.access.Lock()
+	defer k.access.Unlock()
+	for len(packet) >= 24 {
+		cmd, wnd := packet[4], binary.LittleEndian.Uint16(packet[6:])
+		ts, sn := binary.LittleEndian.Uint32(packet[8:]), binary.LittleEndian.Uint32(packet[12:])
+		una, length := binary.LittleEndian.Uint32(packet[16:]), binary.LittleEndian.Uint32(packet[20:])
+		if binary.LittleEndian.Uint32(packet) != k.conv || uint32(len(packet)-24) < length {
+			return
+		}
+		data := packet[24 : 24+length]
+		packet = packet[24+length:]
+		k.clientUna, k.clientWnd = una, uint32(wnd)
+		switch cmd {
+		case kcpCmdPush:
+			if int32(sn-k.nextSN) >= 0 {
+				k.received[sn] = bytes.Clone(data)
+			}
+			for data, ok := k.received[k.nextSN]; ok; data, ok = k.received[k.nextSN] {
+				delete(k.received, k.nextSN)
+				k.readable = append(k.readable, data...)
+				k.nextSN++
+			}
+			// Duplicates are acknowledged again, their first ACK may be late
+			k.output(k.segment(kcpCmdAck, ts, sn, nil))
+		case kcpCmdWask:
+			k.output(k.segment(kcpCmdWins, ts, 0, nil))
+		}
+	}
+	k.flush()
+	k.changed.Broadcast()
+}
+
+// flush sends the queued data the window of the client has room for;
+// access must be held
+func (k *kcpResponder) flush() {
+	for len(k.unsent) > 0 && k.sendSN-k.clientUna < k.clientWnd {
+		k.output(k.segment(kcpCmdPush, uint32(time.Now().UnixMilli()), k.sendSN, k.unsent[0]))
+		k.unsent = k.unsent[1:]
+		k.sendSN++
+	}
+}
+
+func (k *kcpResponder) Read(p []byte) (int, error) {
+	k.access.Lock()
+	defer k.access.Unlock()
+	for len(k.readable) == 0 && !k.closed {
+		k.changed.Wait()
+	}
+	if k.closed {
+		return 0, net.ErrClosed
+	}
+	n := copy(p, k.readable)
+	k.readable = k.readable[n:]
+	return n, nil
+}
+
+func (k *kcpResponder) Write(p []byte) (int, error) {
+	k.access.Lock()
+	defer k.access.Unlock()
+	for rest := p; len(rest) > 0; {
+		data := rest[:min(len(rest), serverSegment-24)]
+		rest = rest[len(data):]
+		k.unsent = append(k.unsent, bytes.Clone(data))
+	}
+	k.flush()
+	return len(p), nil
+}
+
+func (k *kcpResponder) Close() error {
+	k.access.Lock()
+	defer k.access.Unlock()
+	k.closed = true
+	k.changed.Broadcast()
+	return nil
+}
+
+// noiseCipher is a Noise CipherState of ChaChaPoly: nonces are 4 zero bytes
+// and a 64-bit little endian counter
+type noiseCipher struct {
+	key   []byte
+	nonce uint64
+}
+
+func (c *noiseCipher) nextNonce() []byte {
+	nonce := binary.LittleEndian.AppendUint64(make([]byte, 4), c.nonce)
+	c.nonce++
+	return nonce
+}
+
+func (c *noiseCipher) seal(ad []byte, plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(c.key)
+	return aead.Seal(nil, c.nextNonce(), plaintext, ad)
+}
+
+func (c *noiseCipher) open(ad []byte, ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(c.key)
+	return aead.Open(nil, c.nextNonce(), ciphertext, ad)
+}
+
+func newBLAKE2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+// noiseHKDF is HKDF of the Noise specification with HMAC-BLAKE2s, two
+// outputs
+func noiseHKDF(chainingKey []byte, material []byte) ([]byte, []byte) {
+	extract := hmac.New(newBLAKE2s, chainingKey)
+	extract.Write(material)
+	tempKey := extract.Sum(nil)
+	expand := hmac.New(newBLAKE2s, tempKey)
+	expand.Write([]byte{1})
+	first := expand.Sum(nil)
+	expand = hmac.New(newBLAKE2s, tempKey)
+	expand.Write(append(bytes.Clone(first), 2))
+	return first, expand.Sum(nil)
+}
+
+// respondNK is the responder of Noise_NK_25519_ChaChaPoly_BLAKE2s with the
+// prologue of dnstt: <- s, then -> e, es and <- e, ee. Messages, handshake
+// and transport alike, go after a 16-bit big endian length.
+func respondNK(rw io.ReadWriter, static []byte, public []byte) (*noiseStream, error) {
+	name := blake2s.Sum256([]byte("Noise_NK_25519_ChaChaPoly_BLAKE2s"))
+	h, chainingKey := name[:], name[:]
+	var cipher *noiseCipher
+	mixHash := func(data []byte) {
+		sum := blake2s.Sum256(append(bytes.Clone(h), data...))
+		h = sum[:]
+	}
+	mixKey := func(material []byte) {
+		var key []byte
+		chainingKey, key = noiseHKDF(chainingKey, material)
+		cipher = &noiseCipher{key: key}
+	}
+	mixHash([]byte("dnstt 2020-04-13"))
+	mixHash(public)
+
+	message, err := readNoiseMessage(rw)
+	if err != nil {
+		return nil, err
+	}
+	if len(message) < 32 {
+		return nil, errors.New("short handshake")
+	}
+	initiator := message[:32]
+	mixHash(initiator)
+	shared, err := curve25519.X25519(static, initiator)
+	if err != nil {
+		return nil, err
+	}
+	mixKey(shared)
+	if _, err := cipher.open(h, message[32:]); err != nil {
+		return nil, err
+	}
+	mixHash(message[32:])
+
+	ephemeral := make([]byte, 32)
+	rand.Read(ephemeral)
+	ephemeralPublic, _ := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	mixHash(ephemeralPublic)
+	if shared, err = curve25519.X25519(ephemeral, initiator); err != nil {
+		return nil, err
+	}
+	mixKey(shared)
+	payload := cipher.seal(h, nil)
+	if err := writeNoiseMessage(rw, append(ephemeralPublic, payload...)); err != nil {
+		return nil, err
+	}
+	toResponder, toInitiator := noiseHKDF(chainingKey, nil)
+	return &noiseStream{rw: rw, receive: &noiseCipher{key: toResponder}, send: &noiseCipher{key: toInitiator}}, nil
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(r, message)
+	return message, err
+}
+
+func writeNoiseMessage(w io.Writer, message []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(message))), message...))
+	return err
+}
+
+// noiseStream is the transport phase of the responder
+type noiseStream struct {
+	rw      io.ReadWriter
+	receive *noiseCipher
+	send    *noiseCipher
+	pending []byte
+}
+
+func (s *noiseStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		message, err := readNoiseMessage(s.rw)
+		if err != nil {
+			return 0, err
+		}
+		if s.pending, err = s.receive.open(nil, message); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *noiseStream) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		chunk := rest[:min(len(rest), 4096)]
+		rest = rest[len(chunk):]
+		if err := writeNoiseMessage(s.rw, s.send.seal(nil, chunk)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *noiseStream) Close() error {
+	return nil
+}
+
+// tunnelClient serves server on an in-memory resolver address and returns
+// a client trusting publicKey
+func tunnelClient(t *testing.T, server *tunnelServer, publicKey []byte) *Client {
+	t.Helper()
+	network := &testkit.Network{}
+	listener, err := network.Serve("192.0.2.53:53", server.serve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	client, err := New(TunnelOptions{
+		Domain:    tunnelDomain,
+		PublicKey: hex.EncodeToString(publicKey),
+		Resolver:  "192.0.2.53",
+	}, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestTunnel(t *testing.T) {
+	server := newTunnelServer()
+	client := tunnelClient(t, server, server.public)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	// Streams share the session
+	for range 2 {
+		stream, err := client.DialContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := make([]byte, 20000)
+		rand.Read(message)
+		if _, err := stream.Write(message); err != nil {
+			t.Fatal(err)
+		}
+		echo := make([]byte, len(message))
+		if _, err := io.ReadFull(stream, echo); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(echo, message) {
+			t.Fatal("echo differs from the message")
+		}
+		stream.Close()
+	}
+}
+
+func TestTunnelUnknownServer(t *testing.T) {
+	client := tunnelClient(t, newTunnelServer(), newTunnelServer().public)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := client.DialContext(ctx)
+	var typed *failure.Error
+	if !errors.As(err, &typed) || typed.Stage != failure.StageHandshake {
+		t.Fatalf("dial error = %v, want a handshake failure", err)
+	}
+}
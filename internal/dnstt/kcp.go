@@ -0,0 +1,390 @@
+package dnstt
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// KCP segment commands
+const (
+	kcpPush = 81 // Data
+	kcpAck  = 82 // Acknowledgment of one segment
+	kcpWask = 83 // Window probe: what is your window?
+	kcpWins = 84 // Window announcement
+)
+
+// KCP parameters, matching what dnstt configures in kcp-go: stream mode, no
+// congestion window, no fast resend and windows of 64 segments
+const (
+	kcpOverhead  = 24
+	kcpWindow    = 64
+	kcpInterval  = 10 * time.Millisecond
+	kcpMinRTO    = 100
+	kcpDefRTO    = 200
+	kcpMaxRTO    = 60000
+	kcpDeadLink  = 20   // Transmissions of a segment before the link is declared dead
+	kcpProbeInit = 7000 // Wait before the first window probe, in ms
+	kcpProbeMax  = 120000
+)
+
+var errDeadLink = errors.New("kcp: peer stopped acknowledging")
+
+// kcpSegment is a segment sent and not acknowledged yet
+type kcpSegment struct {
+	sn       uint32
+	data     []byte
+	xmit     int
+	rto      uint32
+	resendAt uint32
+}
+
+type kcpAckItem struct {
+	sn uint32
+	ts uint32
+}
+
+// kcpConn is the client side of a KCP session in stream mode, the reliable
+// byte stream dnstt runs the Noise channel over. Packets are handed to
+// output, which may drop them, and fed back with input.
+type kcpConn struct {
+	conv   uint32
+	mtu    int
+	output func(packet []byte)
+	start  time.Time
+
+	access   sync.Mutex
+	changed  *sync.Cond // Signals readers and writers
+	err      error      // Set once the session is over
+	sndQueue [][]byte
+	sndBuf   []*kcpSegment
+	sndNxt   uint32
+	sndUna   uint32
+	rcvNxt   uint32
+	rcvBuf   map[uint32][]byte
+	readable []byte
+	acks     []kcpAckItem
+	rmtWnd   uint32
+	srtt     int32
+	rttvar   int32
+	rto      uint32
+	askSend  bool // Send a window probe
+	askTell  bool // Announce our window
+	probeAt  uint32
+	probeGap uint32
+
+	done chan struct{}
+}
+
+func newKCPConn(conv uint32, mtu int, output func([]byte)) *kcpConn {
+	c := &kcpConn{
+		conv:   conv,
+		mtu:    mtu,
+		output: output,
+		start:  time.Now(),
+		rcvBuf: make(map[uint32][]byte),
+		rmtWnd: kcpWindow,
+		rto:    kcpDefRTO,
+		done:   make(chan struct{}),
+	}
+	c.changed = sync.NewCond(&c.access)
+	go c.loop()
+	return c
+}
+
+func (c *kcpConn) now() uint32 {
+	return uint32(time.Since(c.start).Milliseconds())
+}
+
+// before reports whether sequence number or time a comes before b
+func before(a uint32, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (c *kcpConn) mss() int {
+	return c.mtu - kcpOverhead
+}
+
+func (c *kcpConn) loop() {
+	ticker := time.NewTicker(kcpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.access.Lock()
+			c.flush()
+			c.access.Unlock()
+		}
+	}
+}
+
+func (c *kcpConn) Read(p []byte) (int, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	for len(c.readable) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.changed.Wait()
+	}
+	closedWindow := c.window() == 0
+	n := copy(p, c.readable)
+	c.readable = c.readable[n:]
+	c.deliver()
+	if closedWindow && c.window() > 0 {
+		c.askTell = true
+	}
+	return n, nil
+}
+
+func (c *kcpConn) Write(p []byte) (int, error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	var written int
+	for len(p) > 0 {
+		for c.err == nil && len(c.sndQueue)+len(c.sndBuf) >= kcpWindow {
+			c.changed.Wait()
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		// Stream mode: top up the last queued segment first
+		if last := len(c.sndQueue) - 1; last >= 0 && len(c.sndQueue[last]) < c.mss() {
+			n := min(len(p), c.mss()-len(c.sndQueue[last]))
+			c.sndQueue[last] = append(c.sndQueue[last], p[:n]...)
+			written += n
+			p = p[n:]
+			continue
+		}
+		n := min(len(p), c.mss())
+		c.sndQueue = append(c.sndQueue, append(make([]byte, 0, c.mss()), p[:n]...))
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *kcpConn) Close() error {
+	c.close(net.ErrClosed)
+	return nil
+}
+
+func (c *kcpConn) close(err error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.changed.Broadcast()
+}
+
+// input processes a packet of segments from the peer
+func (c *kcpConn) input(packet []byte) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.err != nil {
+		return
+	}
+	current := c.now()
+	for len(packet) >= kcpOverhead {
+		conv := binary.LittleEndian.Uint32(packet)
+		cmd := packet[4]
+		wnd := binary.LittleEndian.Uint16(packet[6:])
+		ts := binary.LittleEndian.Uint32(packet[8:])
+		sn := binary.LittleEndian.Uint32(packet[12:])
+		una := binary.LittleEndian.Uint32(packet[16:])
+		length := binary.LittleEndian.Uint32(packet[20:])
+		packet = packet[kcpOverhead:]
+		if conv != c.conv || uint32(len(packet)) < length {
+			break
+		}
+		data := packet[:length]
+		packet = packet[length:]
+
+		c.rmtWnd = uint32(wnd)
+		c.acknowledgeUntil(una)
+		switch cmd {
+		case kcpAck:
+			if !before(current, ts) {
+				c.updateRTO(int32(current - ts))
+			}
+			c.acknowledge(sn)
+		case kcpPush:
+			if before(sn, c.rcvNxt+kcpWindow) {
+				c.acks = append(c.acks, kcpAckItem{sn: sn, ts: ts})
+				if !before(sn, c.rcvNxt) {
+					if _, loaded := c.rcvBuf[sn]; !loaded {
+						c.rcvBuf[sn] = append([]byte(nil), data...)
+					}
+				}
+			}
+		case kcpWask:
+			c.askTell = true
+		case kcpWins:
+		default:
+			return
+		}
+	}
+	c.deliver()
+	c.changed.Broadcast()
+}
+
+// deliver moves segments received in order to the readable bytes, as long
+// as the receive window has room
+func (c *kcpConn) deliver() {
+	for len(c.readable) < kcpWindow*c.mss() {
+		data, loaded := c.rcvBuf[c.rcvNxt]
+		if !loaded {
+			return
+		}
+		delete(c.rcvBuf, c.rcvNxt)
+		c.readable = append(c.readable, data...)
+		c.rcvNxt++
+	}
+}
+
+// window returns the free receive window announced to the peer
+func (c *kcpConn) window() uint16 {
+	used := (len(c.readable) + c.mss() - 1) / c.mss()
+	return uint16(max(kcpWindow-used, 0))
+}
+
+func (c *kcpConn) acknowledgeUntil(una uint32) {
+	i := 0
+	for i < len(c.sndBuf) && before(c.sndBuf[i].sn, una) {
+		i++
+	}
+	c.sndBuf = c.sndBuf[i:]
+	c.updateUna()
+}
+
+func (c *kcpConn) acknowledge(sn uint32) {
+	for i, segment := range c.sndBuf {
+		if segment.sn == sn {
+			c.sndBuf = append(c.sndBuf[:i], c.sndBuf[i+1:]...)
+			break
+		}
+	}
+	c.updateUna()
+}
+
+func (c *kcpConn) updateUna() {
+	if len(c.sndBuf) > 0 {
+		c.sndUna = c.sndBuf[0].sn
+	} else {
+		c.sndUna = c.sndNxt
+	}
+}
+
+// updateRTO folds a round-trip time sample into the retransmission timeout,
+// as RFC 6298 and KCP do
+func (c *kcpConn) updateRTO(rtt int32) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := rtt - c.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = max((7*c.srtt+rtt)/8, 1)
+	}
+	rto := c.srtt + max(int32(kcpInterval/time.Millisecond), 4*c.rttvar)
+	c.rto = uint32(min(max(rto, kcpMinRTO), kcpMaxRTO))
+}
+
+// flush sends pending acknowledgments, window probes, new segments and
+// retransmissions, packing segments into packets of at most mtu bytes
+func (c *kcpConn) flush() {
+	current := c.now()
+	wnd := c.window()
+	var packet []byte
+	emit := func(cmd byte, sn uint32, ts uint32, data []byte) {
+		if len(packet)+kcpOverhead+len(data) > c.mtu {
+			c.output(packet)
+			packet = nil
+		}
+		packet = binary.LittleEndian.AppendUint32(packet, c.conv)
+		packet = append(packet, cmd, 0)
+		packet = binary.LittleEndian.AppendUint16(packet, wnd)
+		packet = binary.LittleEndian.AppendUint32(packet, ts)
+		packet = binary.LittleEndian.AppendUint32(packet, sn)
+		packet = binary.LittleEndian.AppendUint32(packet, c.rcvNxt)
+		packet = binary.LittleEndian.AppendUint32(packet, uint32(len(data)))
+		packet = append(packet, data...)
+	}
+
+	for _, ack := range c.acks {
+		emit(kcpAck, ack.sn, ack.ts, nil)
+	}
+	c.acks = c.acks[:0]
+
+	if c.rmtWnd == 0 {
+		switch {
+		case c.probeGap == 0:
+			c.probeGap = kcpProbeInit
+			c.probeAt = current + c.probeGap
+		case !before(current, c.probeAt):
+			c.probeGap = min(c.probeGap+c.probeGap/2, kcpProbeMax)
+			c.probeAt = current + c.probeGap
+			c.askSend = true
+		}
+	} else {
+		c.probeGap = 0
+	}
+	if c.askSend {
+		emit(kcpWask, 0, current, nil)
+		c.askSend = false
+	}
+	if c.askTell {
+		emit(kcpWins, 0, current, nil)
+		c.askTell = false
+	}
+
+	window := min(uint32(kcpWindow), c.rmtWnd)
+	for len(c.sndQueue) > 0 && before(c.sndNxt, c.sndUna+window) {
+		c.sndBuf = append(c.sndBuf, &kcpSegment{sn: c.sndNxt, data: c.sndQueue[0]})
+		c.sndQueue = c.sndQueue[1:]
+		c.sndNxt++
+	}
+	if len(c.sndQueue) < kcpWindow {
+		c.changed.Broadcast()
+	}
+
+	for _, segment := range c.sndBuf {
+		switch {
+		case segment.xmit == 0:
+			segment.rto = c.rto
+		case !before(current, segment.resendAt):
+			segment.rto += max(segment.rto, c.rto)
+			segment.rto = min(segment.rto, kcpMaxRTO)
+		default:
+			continue
+		}
+		segment.xmit++
+		segment.resendAt = current + segment.rto
+		emit(kcpPush, segment.sn, current, segment.data)
+		if segment.xmit >= kcpDeadLink {
+			if len(packet) > 0 {
+				c.output(packet)
+			}
+			c.err = errDeadLink
+			close(c.done)
+			c.changed.Broadcast()
+			return
+		}
+	}
+	if len(packet) > 0 {
+		c.output(packet)
+	}
+}
+
+var _ io.ReadWriteCloser = (*kcpConn)(nil)
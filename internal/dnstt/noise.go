@@ -0,0 +1,256 @@
+package dnstt
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The Noise protocol of dnstt: the NK pattern, in which the client knows the
+// static key of the server and stays anonymous itself
+const (
+	noiseProtocol = "Noise_NK_25519_ChaChaPoly_BLAKE2s"
+	noisePrologue = "dnstt 2020-04-13"
+	maxMessage    = 65535 // Messages carry a 16-bit length
+)
+
+// noiseConn is the encrypted stream of a tunnel. Every message, handshake
+// and transport alike, is prefixed with its length as a 16-bit big-endian
+// integer.
+type noiseConn struct {
+	io.ReadWriteCloser
+	send *cipherState
+	recv *cipherState
+
+	readAccess  sync.Mutex
+	pending     []byte
+	writeAccess sync.Mutex
+}
+
+// noiseHandshake runs the NK handshake as initiator over rwc: -> e, es and
+// <- e, ee
+func noiseHandshake(rwc io.ReadWriteCloser, serverKey []byte) (*noiseConn, error) {
+	var s symmetricState
+	s.init()
+	s.mixHash([]byte(noisePrologue))
+	s.mixHash(serverKey)
+
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ephemeralPublic)
+	shared, err := curve25519.X25519(ephemeral, serverKey)
+	if err != nil {
+		return nil, err
+	}
+	s.mixKey(shared)
+	payload, err := s.encryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeMessage(rwc, append(ephemeralPublic, payload...)); err != nil {
+		return nil, err
+	}
+
+	message, err := readMessage(rwc)
+	if err != nil {
+		return nil, err
+	}
+	if len(message) < curve25519.PointSize {
+		return nil, fmt.Errorf("short handshake response")
+	}
+	remoteEphemeral := message[:curve25519.PointSize]
+	s.mixHash(remoteEphemeral)
+	shared, err = curve25519.X25519(ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	s.mixKey(shared)
+	payload, err = s.decryptAndHash(message[curve25519.PointSize:])
+	if err != nil {
+		return nil, fmt.Errorf("handshake response: %w", err)
+	}
+	if len(payload) != 0 {
+		return nil, fmt.Errorf("unexpected handshake payload")
+	}
+	send, recv := s.split()
+	return &noiseConn{ReadWriteCloser: rwc, send: send, recv: recv}, nil
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	for len(c.pending) == 0 {
+		message, err := readMessage(c.ReadWriteCloser)
+		if err != nil {
+			return 0, err
+		}
+		c.pending, err = c.recv.decrypt(nil, message)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxMessage-chacha20poly1305.Overhead)]
+		message, err := c.send.encrypt(nil, chunk)
+		if err != nil {
+			return written, err
+		}
+		if err := writeMessage(c.ReadWriteCloser, message); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func readMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func writeMessage(w io.Writer, message []byte) error {
+	if len(message) > maxMessage {
+		return fmt.Errorf("noise message too long: %d", len(message))
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(message))), message...))
+	return err
+}
+
+// cipherState encrypts with a key and a counter nonce, as the Noise
+// specification defines for ChaChaPoly
+type cipherState struct {
+	aead  cipher.AEAD // nil before a key is mixed in
+	nonce uint64
+}
+
+func newCipherState(key []byte) *cipherState {
+	aead, _ := chacha20poly1305.New(key)
+	return &cipherState{aead: aead}
+}
+
+func (c *cipherState) nextNonce() []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+	return nonce[:]
+}
+
+func (c *cipherState) encrypt(ad []byte, plaintext []byte) ([]byte, error) {
+	if c.aead == nil {
+		return plaintext, nil
+	}
+	if c.nonce == ^uint64(0) {
+		return nil, errors.New("noise nonce exhausted")
+	}
+	return c.aead.Seal(nil, c.nextNonce(), plaintext, ad), nil
+}
+
+func (c *cipherState) decrypt(ad []byte, ciphertext []byte) ([]byte, error) {
+	if c.aead == nil {
+		return ciphertext, nil
+	}
+	if c.nonce == ^uint64(0) {
+		return nil, errors.New("noise nonce exhausted")
+	}
+	return c.aead.Open(nil, c.nextNonce(), ciphertext, ad)
+}
+
+// symmetricState is the chaining key and handshake hash of a handshake
+type symmetricState struct {
+	ck     [blake2s.Size]byte
+	h      [blake2s.Size]byte
+	cipher cipherState
+}
+
+func (s *symmetricState) init() {
+	// The protocol name is longer than the hash, so it is hashed
+	s.h = blake2s.Sum256([]byte(noiseProtocol))
+	s.ck = s.h
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	s.h = blake2s.Sum256(append(s.h[:], data...))
+}
+
+func (s *symmetricState) mixKey(input []byte) {
+	ck, key := hkdf(s.ck[:], input)
+	s.ck = ck
+	s.cipher = *newCipherState(key[:])
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) ([]byte, error) {
+	ciphertext, err := s.cipher.encrypt(s.h[:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return ciphertext, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext, err := s.cipher.decrypt(s.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the cipher states of the initiator: sending, then receiving
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	first, second := hkdf(s.ck[:], nil)
+	return newCipherState(first[:]), newCipherState(second[:])
+}
+
+// hkdf is the two-output HKDF of the Noise specification over HMAC-BLAKE2s
+func hkdf(chainingKey []byte, input []byte) ([blake2s.Size]byte, [blake2s.Size]byte) {
+	newHash := func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}
+	mac := hmac.New(newHash, chainingKey)
+	mac.Write(input)
+	tempKey := mac.Sum(nil)
+	var first, second [blake2s.Size]byte
+	mac = hmac.New(newHash, tempKey)
+	mac.Write([]byte{1})
+	mac.Sum(first[:0])
+	mac = hmac.New(newHash, tempKey)
+	mac.Write(first[:])
+	mac.Write([]byte{2})
+	mac.Sum(second[:0])
+	return first, second
+}
@@ -0,0 +1,175 @@
+package dnstt
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/UTPBox/utp-core/internal/netdial"
+)
+
+// Limits of the DNS transports
+const (
+	maxResponse    = 65535
+	dohConcurrency = 32 // Queries in flight, each held by the server until it has data
+	dohTimeout     = 30 * time.Second
+)
+
+// udpTransport sends queries to a resolver over plain UDP
+type udpTransport struct {
+	conn net.Conn
+}
+
+func dialUDP(ctx context.Context, dialer netdial.Dialer, address string, t *tunnel) (*udpTransport, error) {
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	u := &udpTransport{conn: conn}
+	go func() {
+		buffer := make([]byte, maxResponse)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				t.close(err)
+				return
+			}
+			t.handleResponse(buffer[:n])
+		}
+	}()
+	return u, nil
+}
+
+func (u *udpTransport) send(query []byte) error {
+	_, err := u.conn.Write(query)
+	return err
+}
+
+func (u *udpTransport) Close() error {
+	return u.conn.Close()
+}
+
+// dotTransport sends queries to a resolver over DNS over TLS, each message
+// prefixed with its length
+type dotTransport struct {
+	conn   net.Conn
+	access sync.Mutex
+}
+
+func dialDoT(ctx context.Context, dialer netdial.Dialer, address string, serverName string, t *tunnel) (*dotTransport, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d := &dotTransport{conn: tlsConn}
+	go func() {
+		var length [2]byte
+		for {
+			if _, err := io.ReadFull(tlsConn, length[:]); err != nil {
+				t.close(err)
+				return
+			}
+			response := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(tlsConn, response); err != nil {
+				t.close(err)
+				return
+			}
+			t.handleResponse(response)
+		}
+	}()
+	return d, nil
+}
+
+func (d *dotTransport) send(query []byte) error {
+	d.access.Lock()
+	defer d.access.Unlock()
+	_, err := d.conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+	return err
+}
+
+func (d *dotTransport) Close() error {
+	return d.conn.Close()
+}
+
+// dohTransport sends queries to a resolver over DNS over HTTPS, as POST
+// requests of RFC 8484. Failed requests are dropped like lost datagrams.
+type dohTransport struct {
+	url    string
+	client *http.Client
+	tunnel *tunnel
+	slots  chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newDoH(dialer netdial.Dialer, url string, t *tunnel) *dohTransport {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dohTransport{
+		url: url,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				ForceAttemptHTTP2:   true,
+				MaxIdleConnsPerHost: dohConcurrency,
+			},
+			Timeout: dohTimeout,
+		},
+		tunnel: t,
+		slots:  make(chan struct{}, dohConcurrency),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (d *dohTransport) send(query []byte) error {
+	select {
+	case d.slots <- struct{}{}:
+	case <-d.ctx.Done():
+		return d.ctx.Err()
+	}
+	go func() {
+		defer func() { <-d.slots }()
+		response, err := d.exchange(query)
+		if err != nil {
+			return
+		}
+		d.tunnel.handleResponse(response)
+	}()
+	return nil
+}
+
+func (d *dohTransport) exchange(query []byte) ([]byte, error) {
+	request, err := http.NewRequestWithContext(d.ctx, http.MethodPost, d.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH: %s", response.Status)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, maxResponse))
+}
+
+func (d *dohTransport) Close() error {
+	d.cancel()
+	d.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,73 @@
+// Package egress holds the results of the egress-check service: the public
+// address and country each checked outbound exits from, with the exits seen
+// before. The admin API serves them.
+package egress
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Exit is an address an outbound was seen exiting from
+type Exit struct {
+	IP      string    `json:"ip"`
+	Country string    `json:"country,omitempty"` // ISO 3166 code, when the provider reports it
+	Since   time.Time `json:"since"`             // First check seeing this exit
+	Checked time.Time `json:"checked"`           // Latest check seeing this exit
+}
+
+// History is the exits of one outbound, oldest first. The last one is the
+// current exit.
+type History struct {
+	Outbound string `json:"outbound"`
+	Exits    []Exit `json:"exits"`
+	Error    string `json:"error,omitempty"` // Of the latest check, when it failed
+}
+
+// Current returns the current exit, if one was seen
+func (h History) Current() (Exit, bool) {
+	if len(h.Exits) == 0 {
+		return Exit{}, false
+	}
+	return h.Exits[len(h.Exits)-1], true
+}
+
+var (
+	access    sync.RWMutex
+	histories = make(map[string]History)
+)
+
+// Store records the history of an outbound
+func Store(history History) {
+	access.Lock()
+	histories[history.Outbound] = history
+	access.Unlock()
+}
+
+// Load returns the history of outbound, if it is checked
+func Load(outbound string) (History, bool) {
+	access.RLock()
+	defer access.RUnlock()
+	history, loaded := histories[outbound]
+	return history, loaded
+}
+
+// Delete forgets outbound, when it is no longer checked
+func Delete(outbound string) {
+	access.Lock()
+	delete(histories, outbound)
+	access.Unlock()
+}
+
+// All returns the history of every checked outbound, sorted by tag
+func All() []History {
+	access.RLock()
+	all := make([]History, 0, len(histories))
+	for _, history := range histories {
+		all = append(all, history)
+	}
+	access.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].Outbound < all[j].Outbound })
+	return all
+}
@@ -0,0 +1,183 @@
+// Package failure defines the error taxonomy returned by extension dials.
+// Typed failures let the router choose sensible fallbacks (rotate servers
+// on resets, stop retrying on bad credentials) and let management APIs show
+// a human-meaningful reason per outbound.
+package failure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/UTPBox/utp-core/internal/breaker"
+)
+
+// Kind classifies why a dial failed
+type Kind string
+
+const (
+	KindUnknown          Kind = "unknown"
+	KindAuthFailed       Kind = "auth-failed"       // Credentials rejected by the server
+	KindHandshakeTimeout Kind = "handshake-timeout" // Server did not complete a handshake in time
+	KindBlockedReset     Kind = "blocked-reset"     // Connection reset or refused, typical of DPI blocking
+	KindDNSFailure       Kind = "dns-failure"       // Server name could not be resolved
+	KindQuotaExceeded    Kind = "quota-exceeded"    // Server or account limit reached
+	KindUnreachable      Kind = "unreachable"       // No route to the server
+	KindCanceled         Kind = "canceled"          // Caller gave up
+	KindCaptivePortal    Kind = "captive-portal"    // Network intercepts traffic until the user signs in
+	KindBackoff          Kind = "backoff"           // Dial held back during a failure storm
+)
+
+// Stage names the step of the dial that failed
+type Stage string
+
+const (
+	StageConnect   Stage = "connect"
+	StageTLS       Stage = "tls"
+	StageHandshake Stage = "handshake"
+	StageAuth      Stage = "auth"
+	StageTarget    Stage = "target"
+)
+
+// Error is a classified dial failure
+type Error struct {
+	Kind  Kind
+	Stage Stage
+	Err   error
+}
+
+func (e *Error) Error() string {
+	if e.Stage != "" {
+		return fmt.Sprintf("%s (%s): %v", e.Stage, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New wraps err with an explicit kind
+func New(kind Kind, stage Stage, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Stage: stage, Err: err}
+}
+
+// Wrap classifies err heuristically and attaches the stage. Errors that are
+// already classified keep their kind.
+func Wrap(stage Stage, err error) error {
+	if err == nil {
+		return nil
+	}
+	var typed *Error
+	if errors.As(err, &typed) {
+		return err
+	}
+	return &Error{Kind: Classify(err), Stage: stage, Err: err}
+}
+
+// KindOf returns the kind of err, classifying it if it is not typed
+func KindOf(err error) Kind {
+	if err == nil {
+		return ""
+	}
+	var typed *Error
+	if errors.As(err, &typed) {
+		return typed.Kind
+	}
+	return Classify(err)
+}
+
+// Classify infers a kind from well-known error values and messages
+func Classify(err error) Kind {
+	var dnsErr *net.DNSError
+	var heldBack *breaker.HeldBackError
+	switch {
+	case errors.As(err, &heldBack):
+		return KindBackoff
+	case errors.Is(err, context.Canceled):
+		return KindCanceled
+	case errors.As(err, &dnsErr):
+		return KindDNSFailure
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNABORTED):
+		return KindBlockedReset
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return KindUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return KindHandshakeTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return KindHandshakeTimeout
+	}
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "unable to authenticate"), strings.Contains(message, "authentication failed"),
+		strings.Contains(message, "permission denied"), strings.Contains(message, "407"):
+		return KindAuthFailed
+	case strings.Contains(message, "quota"), strings.Contains(message, "too many"), strings.Contains(message, "429"):
+		return KindQuotaExceeded
+	case strings.Contains(message, "connection reset"), strings.Contains(message, "broken pipe"),
+		strings.Contains(message, "unexpected eof"), message == "eof":
+		return KindBlockedReset
+	case strings.Contains(message, "no such host"):
+		return KindDNSFailure
+	}
+	return KindUnknown
+}
+
+// ClassifyMessage infers a kind from an error message alone, such as one
+// read back from a log line. Kinds already named in the message are kept.
+func ClassifyMessage(message string) Kind {
+	lower := strings.ToLower(message)
+	for _, kind := range []Kind{KindAuthFailed, KindHandshakeTimeout, KindBlockedReset, KindDNSFailure,
+		KindQuotaExceeded, KindUnreachable, KindCanceled, KindCaptivePortal, KindBackoff} {
+		if strings.Contains(lower, "("+string(kind)+")") {
+			return kind
+		}
+	}
+	switch {
+	case strings.Contains(lower, "connection refused"), strings.Contains(lower, "connection aborted"):
+		return KindBlockedReset
+	case strings.Contains(lower, "network is unreachable"), strings.Contains(lower, "no route to host"):
+		return KindUnreachable
+	case strings.Contains(lower, "i/o timeout"), strings.Contains(lower, "deadline exceeded"):
+		return KindHandshakeTimeout
+	case strings.Contains(lower, "context canceled"), strings.Contains(lower, "operation was canceled"):
+		return KindCanceled
+	}
+	return Classify(errors.New(message))
+}
+
+// Retryable reports whether trying another server may succeed. Credential
+// and quota failures are tied to the server and worth rotating away from;
+// cancellation, captive portals and storm backoff, which hold back every
+// server, are not.
+func Retryable(kind Kind) bool {
+	return kind != KindCanceled && kind != KindCaptivePortal && kind != KindBackoff
+}
+
+// Blocking reports whether a failure of kind may come from blocking of the
+// server, and so counts towards a failure storm (see internal/breaker)
+func Blocking(kind Kind) bool {
+	switch kind {
+	case KindBlockedReset, KindHandshakeTimeout, KindUnreachable:
+		return true
+	}
+	return false
+}
+
+// Transient reports whether retrying the same server later may succeed
+func Transient(kind Kind) bool {
+	switch kind {
+	case KindAuthFailed, KindQuotaExceeded, KindCanceled:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package failure
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/UTPBox/utp-core/internal/breaker"
+	"github.com/UTPBox/utp-core/internal/metrics"
+	"github.com/UTPBox/utp-core/internal/tenant"
+)
+
+// Record is the most recent failure of an outbound
+type Record struct {
+	Tenant   string    `json:"tenant,omitempty"`
+	Outbound string    `json:"outbound"`
+	Kind     Kind      `json:"kind"`
+	Stage    Stage     `json:"stage,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+var (
+	recordAccess sync.RWMutex
+	records      = make(map[string]Record) // By tenant.Scope of the outbound tag
+)
+
+// Report stores err as the latest failure of outbound, counts it by stage
+// and kind, feeds blocking failures to the storm breaker, and returns err
+// unchanged, so it can wrap return statements. ctx is the context of the
+// dial, whose tenant keeps outbounds of the same tag apart.
+func Report(ctx context.Context, outbound string, err error) error {
+	if err == nil {
+		return nil
+	}
+	key := tenant.Scope(ctx, outbound)
+	record := Record{
+		Tenant:   tenant.FromContext(ctx),
+		Outbound: outbound,
+		Kind:     KindOf(err),
+		Message:  err.Error(),
+		Time:     time.Now(),
+	}
+	var typed *Error
+	if errors.As(err, &typed) {
+		record.Stage = typed.Stage
+	}
+	recordAccess.Lock()
+	records[key] = record
+	recordAccess.Unlock()
+	metrics.CountFailure(record.Tenant, outbound, string(record.Stage), string(record.Kind))
+	if Blocking(record.Kind) {
+		breaker.Failed(key)
+	}
+	return err
+}
+
+// Last returns the latest failure of outbound in the tenant of ctx
+func Last(ctx context.Context, outbound string) (Record, bool) {
+	recordAccess.RLock()
+	defer recordAccess.RUnlock()
+	record, ok := records[tenant.Scope(ctx, outbound)]
+	return record, ok
+}
+
+// All returns the latest failure of every outbound of every tenant that has
+// failed
+func All() []Record {
+	recordAccess.RLock()
+	defer recordAccess.RUnlock()
+	all := make([]Record, 0, len(records))
+	for _, record := range records {
+		all = append(all, record)
+	}
+	return all
+}
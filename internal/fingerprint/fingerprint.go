@@ -0,0 +1,144 @@
+// Package fingerprint inspects the first bytes a client sends to its server,
+// the part of a connection censors classify most often, and points out
+// traits known to single the client out: the ClientHello of Go crypto/tls,
+// the default User-Agent of Go HTTP clients, SSH library banners, and random
+// looking bytes caught by fully encrypted traffic heuristics.
+package fingerprint
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strings"
+)
+
+// Protocols recognized in a first flight
+const (
+	ProtocolTLS     = "tls"
+	ProtocolHTTP    = "http"
+	ProtocolSSH     = "ssh"
+	ProtocolUnknown = "unknown"
+)
+
+// Concern is a trait of the first flight that helps identifying the client
+type Concern struct {
+	Issue  string
+	Advice string
+}
+
+// Report describes a first flight
+type Report struct {
+	Protocol string
+	Details  [][2]string // Parsed fields as name and value, in display order
+	Concerns []Concern
+}
+
+func (r *Report) detail(name string, value string) {
+	r.Details = append(r.Details, [2]string{name, value})
+}
+
+func (r *Report) concern(issue string, advice string) {
+	r.Concerns = append(r.Concerns, Concern{Issue: issue, Advice: advice})
+}
+
+// Analyze reports on data, the bytes a client sent before hearing from the
+// server
+func Analyze(data []byte) *Report {
+	switch {
+	case len(data) >= 5 && data[0] == recordHandshake && data[1] == 0x03:
+		return analyzeTLS(data)
+	case bytes.HasPrefix(data, []byte("SSH-")):
+		return analyzeSSH(data)
+	case isHTTP(data):
+		return analyzeHTTP(data)
+	default:
+		return analyzeOpaque(data)
+	}
+}
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT "}
+
+func isHTTP(data []byte) bool {
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(data, []byte(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+func analyzeHTTP(data []byte) *Report {
+	r := &Report{Protocol: ProtocolHTTP}
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		line, _, _ := bytes.Cut(data, []byte("\r\n"))
+		r.detail("request", string(line))
+		r.concern(fmt.Sprintf("malformed HTTP request: %v", err), "check the outbound against a real server of the protocol")
+		return r
+	}
+	r.detail("request", request.Method+" "+request.RequestURI+" "+request.Proto)
+	r.detail("host", request.Host)
+	userAgent := request.Header.Get("User-Agent")
+	r.detail("user-agent", userAgent)
+	switch {
+	case strings.HasPrefix(userAgent, "Go-http-client/"):
+		r.concern("default User-Agent of the Go HTTP client", "set a browser User-Agent in the outbound headers (header_overrides for psiphon)")
+	case userAgent == "":
+		r.concern("no User-Agent, which browsers always send", "set a browser User-Agent in the outbound headers (header_overrides for psiphon)")
+	}
+	if request.Header.Get("Proxy-Authorization") != "" || request.Header.Get("Authorization") != "" {
+		r.concern("credentials sent in clear text", "enable TLS on the outbound")
+	}
+	return r
+}
+
+func analyzeSSH(data []byte) *Report {
+	r := &Report{Protocol: ProtocolSSH}
+	banner, _, _ := bytes.Cut(data, []byte("\n"))
+	banner = bytes.TrimSuffix(banner, []byte("\r"))
+	r.detail("banner", string(banner))
+	if bytes.HasPrefix(banner, []byte("SSH-2.0-Go")) {
+		r.concern("banner names the Go SSH library", `set ssh.client_version to "openssh" (psiphon), or carry SSH inside TLS or an obfuscation layer`)
+	} else {
+		r.concern("plain SSH, identified by its banner", "carry SSH inside TLS or an obfuscation layer so the banner is not visible")
+	}
+	return r
+}
+
+// analyzeOpaque applies the exemptions of the fully encrypted traffic
+// heuristic deployed by the GFW in 2021 (Wu et al., USENIX Security 2023):
+// a first packet is blocked unless it has a low or high share of set bits,
+// starts with 6 printable bytes, is mostly printable, or contains more than
+// 20 printable bytes in a row
+func analyzeOpaque(data []byte) *Report {
+	r := &Report{Protocol: ProtocolUnknown}
+	if len(data) == 0 {
+		return r
+	}
+	var setBits, printable, run, longestRun int
+	for _, b := range data {
+		setBits += bits.OnesCount8(b)
+		if b >= 0x20 && b <= 0x7e {
+			printable++
+			run++
+			longestRun = max(longestRun, run)
+		} else {
+			run = 0
+		}
+	}
+	average := float64(setBits) / float64(len(data))
+	r.detail("set bits per byte", fmt.Sprintf("%.2f", average))
+	r.detail("printable", fmt.Sprintf("%d%%", printable*100/len(data)))
+	prefix := data[:min(len(data), 6)]
+	exempt := average <= 3.4 || average >= 4.6 ||
+		(len(prefix) == 6 && bytes.IndexFunc(prefix, func(c rune) bool { return c < 0x20 || c > 0x7e }) < 0) ||
+		printable*2 > len(data) ||
+		longestRun > 20
+	if !exempt {
+		r.concern("looks uniformly random, which fully encrypted traffic detection blocks",
+			"prefer a transport that starts like an allowed protocol (TLS based: meek, naive, cloak)")
+	}
+	return r
+}
@@ -0,0 +1,268 @@
+package fingerprint
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const recordHandshake = 0x16
+
+// TLS extension types read from ClientHellos
+const (
+	extServerName        = 0x0000
+	extSupportedGroups   = 0x000a
+	extECPointFormats    = 0x000b
+	extALPN              = 0x0010
+	extSupportedVersions = 0x002b
+)
+
+// clientHello holds the ClientHello fields JA3 is computed from
+type clientHello struct {
+	version      uint16
+	cipherSuites []uint16
+	extensions   []uint16
+	groups       []uint16
+	pointFormats []uint8
+	serverName   string
+	alpn         []string
+	versions     []uint16
+	grease       bool
+}
+
+// JA3 returns the JA3 string of h, without GREASE values
+func (h *clientHello) JA3() string {
+	fields := []string{
+		strconv.Itoa(int(h.version)),
+		joinValues(h.cipherSuites),
+		joinValues(h.extensions),
+		joinValues(h.groups),
+		joinValues(h.pointFormats),
+	}
+	return strings.Join(fields, ",")
+}
+
+func joinValues[T uint8 | uint16](values []T) string {
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		parts = append(parts, strconv.Itoa(int(value)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func analyzeTLS(data []byte) *Report {
+	r := &Report{Protocol: ProtocolTLS}
+	hello, err := parseClientHello(data)
+	if err != nil {
+		r.concern(fmt.Sprintf("malformed ClientHello: %v", err), "check the outbound against a real server of the protocol")
+		return r
+	}
+	ja3 := hello.JA3()
+	hash := md5.Sum([]byte(ja3))
+	r.detail("server_name", hello.serverName)
+	r.detail("alpn", strings.Join(hello.alpn, ", "))
+	r.detail("cipher suites", strconv.Itoa(len(hello.cipherSuites)))
+	r.detail("ja3", ja3)
+	r.detail("ja3 hash", hex.EncodeToString(hash[:]))
+
+	if !hello.grease {
+		reference, err := goClientHello(hello.serverName, hello.alpn)
+		if err == nil && slices.Equal(reference.cipherSuites, hello.cipherSuites) {
+			r.concern("ClientHello of Go crypto/tls, which no browser sends",
+				"enable tls.utls with a browser fingerprint (needs a build with the with_utls tag)")
+		}
+	}
+	if hello.serverName == "" {
+		r.concern("no server_name, which browsers always send", "set tls.server_name")
+	}
+	if len(hello.alpn) == 0 {
+		r.concern("no ALPN, which browsers always offer", `set tls.alpn, e.g. ["h2", "http/1.1"]`)
+	}
+	if !slices.Contains(hello.versions, tls.VersionTLS13) {
+		r.concern("TLS 1.3 not offered", "raise tls.max_version to 1.3")
+	}
+	return r
+}
+
+// parseClientHello parses the ClientHello in the handshake records of data
+func parseClientHello(data []byte) (*clientHello, error) {
+	var message []byte
+	for len(data) >= 5 && data[0] == recordHandshake {
+		length := int(binary.BigEndian.Uint16(data[3:]))
+		if len(data) < 5+length {
+			return nil, fmt.Errorf("truncated record")
+		}
+		message = append(message, data[5:5+length]...)
+		data = data[5+length:]
+	}
+	if len(message) < 4 || message[0] != 0x01 {
+		return nil, fmt.Errorf("not a ClientHello")
+	}
+	length := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+	if len(message) < 4+length {
+		return nil, fmt.Errorf("truncated ClientHello")
+	}
+	s := reader(message[4 : 4+length])
+	h := &clientHello{}
+	var random, sessionID, suites, compression, extensions reader
+	if !s.u16(&h.version) || !s.bytes(32, &random) || !s.prefixed8(&sessionID) ||
+		!s.prefixed16(&suites) || !s.prefixed8(&compression) {
+		return nil, fmt.Errorf("truncated ClientHello")
+	}
+	for len(suites) >= 2 {
+		var suite uint16
+		suites.u16(&suite)
+		h.addValue(&h.cipherSuites, suite)
+	}
+	if len(s) == 0 {
+		return h, nil
+	}
+	if !s.prefixed16(&extensions) {
+		return nil, fmt.Errorf("truncated extensions")
+	}
+	for len(extensions) > 0 {
+		var extensionType uint16
+		var body reader
+		if !extensions.u16(&extensionType) || !extensions.prefixed16(&body) {
+			return nil, fmt.Errorf("truncated extension")
+		}
+		h.addValue(&h.extensions, extensionType)
+		switch extensionType {
+		case extServerName:
+			var list, name reader
+			var nameType uint8
+			if body.prefixed16(&list) && list.u8(&nameType) && list.prefixed16(&name) && nameType == 0 {
+				h.serverName = string(name)
+			}
+		case extSupportedGroups:
+			var list reader
+			body.prefixed16(&list)
+			for len(list) >= 2 {
+				var group uint16
+				list.u16(&group)
+				h.addValue(&h.groups, group)
+			}
+		case extECPointFormats:
+			var list reader
+			body.prefixed8(&list)
+			h.pointFormats = append(h.pointFormats, list...)
+		case extALPN:
+			var list reader
+			body.prefixed16(&list)
+			for len(list) > 0 {
+				var protocol reader
+				if !list.prefixed8(&protocol) {
+					break
+				}
+				h.alpn = append(h.alpn, string(protocol))
+			}
+		case extSupportedVersions:
+			var list reader
+			body.prefixed8(&list)
+			for len(list) >= 2 {
+				var version uint16
+				list.u16(&version)
+				h.addValue(&h.versions, version)
+			}
+		}
+	}
+	return h, nil
+}
+
+// addValue appends value to list unless it is GREASE, which JA3 ignores
+func (h *clientHello) addValue(list *[]uint16, value uint16) {
+	if isGREASE(value) {
+		h.grease = true
+		return
+	}
+	*list = append(*list, value)
+}
+
+var (
+	referenceAccess sync.Mutex
+	references      = make(map[string]*clientHello)
+)
+
+// goClientHello returns the ClientHello Go crypto/tls sends by default
+// with serverName and alpn
+func goClientHello(serverName string, alpn []string) (*clientHello, error) {
+	key := serverName + "\x00" + strings.Join(alpn, ",")
+	referenceAccess.Lock()
+	defer referenceAccess.Unlock()
+	if hello, loaded := references[key]; loaded {
+		return hello, nil
+	}
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		return nil, err
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		return nil, err
+	}
+	hello, err := parseClientHello(record)
+	if err != nil {
+		return nil, err
+	}
+	references[key] = hello
+	return hello, nil
+}
+
+// reader consumes big-endian fields
+type reader []byte
+
+func (r *reader) u8(value *uint8) bool {
+	if len(*r) < 1 {
+		return false
+	}
+	*value = (*r)[0]
+	*r = (*r)[1:]
+	return true
+}
+
+func (r *reader) u16(value *uint16) bool {
+	if len(*r) < 2 {
+		return false
+	}
+	*value = binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return true
+}
+
+func (r *reader) bytes(n int, out *reader) bool {
+	if len(*r) < n {
+		return false
+	}
+	*out = (*r)[:n]
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) prefixed8(out *reader) bool {
+	var length uint8
+	return r.u8(&length) && r.bytes(int(length), out)
+}
+
+func (r *reader) prefixed16(out *reader) bool {
+	var length uint16
+	return r.u16(&length) && r.bytes(int(length), out)
+}
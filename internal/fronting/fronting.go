@@ -0,0 +1,54 @@
+// Package fronting sets the two names a fronted connection presents
+// independently: the TLS SNI, seen by the network, and the HTTP Host, seen
+// by the CDN or proxy that terminates TLS and routes by it. An innocuous SNI
+// with the real site in Host is domain fronting; an allowed SNI on a
+// connection to another server is SNI spoofing. Outbounds embed Names and
+// fold them into the names they configure themselves, so sni and
+// host_header mean the same in every protocol.
+package fronting
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Names defines the names presented by a fronted connection
+type Names struct {
+	SNI        string `json:"sni,omitempty"`         // TLS server name, whatever address is dialed
+	HostHeader string `json:"host_header,omitempty"` // HTTP Host, whatever the SNI
+}
+
+// Validate checks the names can be sent
+func (n Names) Validate() error {
+	if strings.ContainsAny(n.SNI, "\r\n /") {
+		return fmt.Errorf("invalid sni %q", n.SNI)
+	}
+	if strings.ContainsAny(n.HostHeader, "\r\n ") {
+		return fmt.Errorf("invalid host_header %q", n.HostHeader)
+	}
+	return nil
+}
+
+// ServerName returns the SNI: sni, or configured, the server name the
+// protocol sets otherwise
+func (n Names) ServerName(configured string) (string, error) {
+	return pick("sni", n.SNI, configured)
+}
+
+// Host returns the HTTP Host: host_header, or configured, the Host the
+// protocol sets otherwise
+func (n Names) Host(configured string) (string, error) {
+	return pick("host_header", n.HostHeader, configured)
+}
+
+// pick returns value, or configured when value is unset. Both set to
+// different names is ambiguous.
+func pick(name string, value string, configured string) (string, error) {
+	if value == "" {
+		return configured, nil
+	}
+	if configured != "" && configured != value {
+		return "", fmt.Errorf("%s %q conflicts with %q", name, value, configured)
+	}
+	return value, nil
+}
@@ -0,0 +1,122 @@
+// Package headers implements per-destination HTTP header overrides for
+// HTTP-aware transports, letting one outbound adapt its disguise (Host,
+// front domain, User-Agent...) to the destination being reached.
+package headers
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/sagernet/sing/common/metadata"
+)
+
+// OverrideRule sets headers for destinations matching any of its conditions
+type OverrideRule struct {
+	Domain       []string          `json:"domain,omitempty"`        // Exact destination domains
+	DomainSuffix []string          `json:"domain_suffix,omitempty"` // Destination domain suffixes
+	IPCIDR       []string          `json:"ip_cidr,omitempty"`       // Destination IP prefixes
+	Port         []uint16          `json:"port,omitempty"`          // Destination ports (AND-ed with the above)
+	Headers      map[string]string `json:"headers"`                 // Headers to set; "Host" replaces the request host
+}
+
+// Overrides is a compiled, ordered list of override rules
+type Overrides struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	domains  map[string]bool
+	suffixes []string
+	prefixes []netip.Prefix
+	ports    map[uint16]bool
+	headers  http.Header
+}
+
+// Compile validates rules and prepares them for matching
+func Compile(rules []OverrideRule) (*Overrides, error) {
+	o := &Overrides{}
+	for i, rule := range rules {
+		if len(rule.Headers) == 0 {
+			return nil, fmt.Errorf("header_overrides[%d]: no headers", i)
+		}
+		c := compiledRule{
+			domains: make(map[string]bool),
+			ports:   make(map[uint16]bool),
+			headers: make(http.Header),
+		}
+		for _, domain := range rule.Domain {
+			c.domains[strings.ToLower(domain)] = true
+		}
+		for _, suffix := range rule.DomainSuffix {
+			c.suffixes = append(c.suffixes, strings.TrimPrefix(strings.ToLower(suffix), "."))
+		}
+		for _, cidr := range rule.IPCIDR {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("header_overrides[%d]: %w", i, err)
+			}
+			c.prefixes = append(c.prefixes, prefix)
+		}
+		for _, port := range rule.Port {
+			c.ports[port] = true
+		}
+		for key, value := range rule.Headers {
+			c.headers.Set(key, value)
+		}
+		o.rules = append(o.rules, c)
+	}
+	return o, nil
+}
+
+// Match returns the headers of the first rule matching destination, or nil
+func (o *Overrides) Match(destination metadata.Socksaddr) http.Header {
+	index := o.MatchIndex(destination)
+	if index < 0 {
+		return nil
+	}
+	return o.rules[index].headers
+}
+
+// MatchIndex returns the index of the first rule matching destination, or -1
+func (o *Overrides) MatchIndex(destination metadata.Socksaddr) int {
+	if o == nil {
+		return -1
+	}
+	for i, rule := range o.rules {
+		if rule.match(destination) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *compiledRule) match(destination metadata.Socksaddr) bool {
+	if len(r.ports) > 0 && !r.ports[destination.Port] {
+		return false
+	}
+	hasAddressCond := len(r.domains) > 0 || len(r.suffixes) > 0 || len(r.prefixes) > 0
+	if !hasAddressCond {
+		return true
+	}
+	if destination.IsFqdn() {
+		fqdn := strings.ToLower(strings.TrimSuffix(destination.Fqdn, "."))
+		if r.domains[fqdn] {
+			return true
+		}
+		for _, suffix := range r.suffixes {
+			if fqdn == suffix || strings.HasSuffix(fqdn, "."+suffix) {
+				return true
+			}
+		}
+		return false
+	}
+	addr := destination.Addr.Unmap()
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
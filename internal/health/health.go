@@ -0,0 +1,79 @@
+// Package health holds the results of the health-check service: whether
+// each probed outbound is up, with its latest probe. Groups consult it to
+// try members that are down only after the others.
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// Status is the health of one outbound
+type Status struct {
+	Outbound string        `json:"outbound"`
+	Up       bool          `json:"up"`
+	Since    time.Time     `json:"since"`             // Time of the latest change between up and down
+	Checked  time.Time     `json:"checked"`           // Time of the latest probe
+	Latency  time.Duration `json:"latency,omitempty"` // Of the latest successful probe
+	Error    string        `json:"error,omitempty"`   // Of the latest failed probe
+}
+
+var (
+	access   sync.RWMutex
+	statuses = make(map[string]Status)
+)
+
+// Store records the status of an outbound
+func Store(status Status) {
+	access.Lock()
+	statuses[status.Outbound] = status
+	access.Unlock()
+}
+
+// Load returns the status of outbound, if it is probed
+func Load(outbound string) (Status, bool) {
+	access.RLock()
+	defer access.RUnlock()
+	status, loaded := statuses[outbound]
+	return status, loaded
+}
+
+// Delete forgets outbound, when it is no longer probed
+func Delete(outbound string) {
+	access.Lock()
+	delete(statuses, outbound)
+	access.Unlock()
+}
+
+// Down reports whether outbound is probed and down. Outbounds that are not
+// probed are never down.
+func Down(outbound string) bool {
+	status, loaded := Load(outbound)
+	return loaded && !status.Up
+}
+
+// Demote returns outbounds with the ones that are down moved to the end,
+// keeping the order otherwise
+func Demote(outbounds []string) []string {
+	ordered := make([]string, 0, len(outbounds))
+	var down []string
+	for _, outbound := range outbounds {
+		if Down(outbound) {
+			down = append(down, outbound)
+		} else {
+			ordered = append(ordered, outbound)
+		}
+	}
+	return append(ordered, down...)
+}
+
+// All returns the status of every probed outbound
+func All() []Status {
+	access.RLock()
+	defer access.RUnlock()
+	all := make([]Status, 0, len(statuses))
+	for _, status := range statuses {
+		all = append(all, status)
+	}
+	return all
+}
@@ -0,0 +1,204 @@
+// Package hostkey verifies the host keys of the SSH servers extension
+// outbounds connect to: against keys pinned in the configuration, against an
+// OpenSSH known_hosts file, or by trusting the key a server presents first
+// and pinning it to known_hosts for later sessions. Without any of them
+// every key is accepted, as servers are usually authenticated by the layer
+// below (TLS) or not at all.
+package hostkey
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/sagernet/sing/common/json/badoption"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+// HostKeyOptions is embedded by the SSH options of extension outbounds
+type HostKeyOptions struct {
+	HostKey           badoption.Listable[string] `json:"host_key,omitempty"`            // Accepted server keys, "ssh-ed25519 AAAA..." or base64
+	HostKeyAlgorithms badoption.Listable[string] `json:"host_key_algorithms,omitempty"` // Host key algorithms offered, in order of preference
+	KnownHostsPath    string                     `json:"known_hosts_path,omitempty"`    // OpenSSH known_hosts file checked for the server
+	TrustOnFirstUse   bool                       `json:"trust_on_first_use,omitempty"`  // Pin the first key of unknown servers to known_hosts (default file: ssh/known_hosts in the state directory)
+}
+
+// IsEmpty reports whether no verification is configured
+func (o HostKeyOptions) IsEmpty() bool {
+	return len(o.HostKey) == 0 && o.KnownHostsPath == "" && !o.TrustOnFirstUse
+}
+
+// ErrMismatch is returned when a server presents a key other than the one
+// it is known by, which a man in the middle would
+var ErrMismatch = errors.New("host key mismatch")
+
+// Verifier checks the host keys of the servers of one outbound. A nil
+// Verifier accepts any key.
+type Verifier struct {
+	keys       []ssh.PublicKey
+	algorithms []string
+	knownHosts string
+	tofu       bool
+
+	access sync.Mutex // Serializes reads and pins of knownHosts
+}
+
+// New returns the verifier of opts, or nil when opts verify nothing. The
+// known_hosts file of trust_on_first_use defaults to a path in the state
+// directory of the tenant of ctx.
+func New(ctx context.Context, opts HostKeyOptions) (*Verifier, error) {
+	if err := checkAlgorithms(opts.HostKeyAlgorithms); err != nil {
+		return nil, err
+	}
+	if opts.IsEmpty() {
+		if len(opts.HostKeyAlgorithms) == 0 {
+			return nil, nil
+		}
+		return &Verifier{algorithms: opts.HostKeyAlgorithms}, nil
+	}
+	v := &Verifier{
+		algorithms: opts.HostKeyAlgorithms,
+		knownHosts: opts.KnownHostsPath,
+		tofu:       opts.TrustOnFirstUse,
+	}
+	for _, value := range opts.HostKey {
+		key, err := ParseKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host_key %q: %w", value, err)
+		}
+		v.keys = append(v.keys, key)
+	}
+	if v.tofu && v.knownHosts == "" {
+		v.knownHosts = state.PathContext(ctx, "ssh", "known_hosts")
+	}
+	if v.knownHosts != "" && !v.tofu {
+		// Without pinning the file must exist; report a typo now rather
+		// than on every handshake
+		if _, err := knownhosts.New(v.knownHosts); err != nil {
+			return nil, fmt.Errorf("known_hosts_path: %w", err)
+		}
+	}
+	return v, nil
+}
+
+// ParseKey parses a public key in authorized_keys format, or the base64 of
+// its wire format as Psiphon server entries carry it
+func ParseKey(value string) (ssh.PublicKey, error) {
+	value = strings.TrimSpace(value)
+	if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value)); err == nil {
+		return key, nil
+	}
+	wire, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("neither an authorized_keys line nor base64")
+	}
+	return ssh.ParsePublicKey(wire)
+}
+
+func checkAlgorithms(algorithms []string) error {
+	supported := ssh.SupportedAlgorithms().HostKeys
+	for _, algorithm := range algorithms {
+		if !slices.Contains(supported, algorithm) {
+			return fmt.Errorf("unsupported host key algorithm %q: expected one of %s", algorithm, strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+// Configure sets the host key callback and algorithms of config
+func (v *Verifier) Configure(config *ssh.ClientConfig) {
+	if v == nil {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return
+	}
+	config.HostKeyAlgorithms = v.algorithms
+	if len(v.keys) == 0 && v.knownHosts == "" {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return
+	}
+	config.HostKeyCallback = v.check
+}
+
+// check verifies the key of the server at hostname, a host:port. Keys are
+// looked up by the configured name, not by the remote address, which is
+// that of the proxy or CDN when the session does not reach the server
+// directly.
+func (v *Verifier) check(hostname string, _ net.Addr, key ssh.PublicKey) error {
+	for _, accepted := range v.keys {
+		if bytes.Equal(accepted.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+	if v.knownHosts == "" {
+		return mismatch(hostname, key)
+	}
+	v.access.Lock()
+	defer v.access.Unlock()
+	callback, err := knownhosts.New(v.knownHosts)
+	if errors.Is(err, os.ErrNotExist) && v.tofu {
+		return v.pin(hostname, key)
+	}
+	if err != nil {
+		return fmt.Errorf("known_hosts: %w", err)
+	}
+	err = callback(hostname, hostAddr(hostname), key)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) > 0 {
+			return mismatch(hostname, key)
+		}
+		if v.tofu {
+			return v.pin(hostname, key)
+		}
+		return failure.New(failure.KindAuthFailed, failure.StageHandshake,
+			fmt.Errorf("%s is not in %s (server offered %s %s)", hostname, v.knownHosts, key.Type(), ssh.FingerprintSHA256(key)))
+	}
+	return err
+}
+
+// pin appends the key of hostname to the known_hosts file
+func (v *Verifier) pin(hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(v.knownHosts), 0o700); err != nil {
+		return fmt.Errorf("known_hosts: %w", err)
+	}
+	file, err := os.OpenFile(v.knownHosts, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("known_hosts: %w", err)
+	}
+	_, err = file.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("known_hosts: %w", err)
+	}
+	return nil
+}
+
+func mismatch(hostname string, key ssh.PublicKey) error {
+	return failure.New(failure.KindAuthFailed, failure.StageHandshake,
+		fmt.Errorf("%w for %s: server offered %s %s", ErrMismatch, hostname, key.Type(), ssh.FingerprintSHA256(key)))
+}
+
+// hostAddr is the address knownhosts checks besides the host name
+type hostAddr string
+
+func (a hostAddr) Network() string {
+	return "tcp"
+}
+
+func (a hostAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,135 @@
+// Package limiter bounds the number of concurrent connections and pending
+// dials of an outbound. Dials beyond max_connections wait in FIFO order;
+// once max_pending_dials are already waiting, new dials are rejected
+// immediately so slow transports shed load instead of piling up goroutines.
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/UTPBox/utp-core/internal/breaker"
+	"github.com/UTPBox/utp-core/internal/failure"
+)
+
+// Options is embedded by extension outbound options
+type Options struct {
+	MaxConnections  int `json:"max_connections,omitempty"`   // Concurrent connections (0 = unlimited)
+	MaxPendingDials int `json:"max_pending_dials,omitempty"` // Dials allowed to wait for a slot (0 = unlimited)
+}
+
+// Limiter enforces Options. A nil Limiter imposes no limit.
+type Limiter struct {
+	slots      chan struct{}
+	maxPending int64
+	pending    atomic.Int64
+}
+
+// New returns a limiter, or nil when no limit is configured
+func New(opts Options) *Limiter {
+	if opts.MaxConnections <= 0 {
+		return nil
+	}
+	return &Limiter{
+		slots:      make(chan struct{}, opts.MaxConnections),
+		maxPending: int64(opts.MaxPendingDials),
+	}
+}
+
+// Acquire waits for a connection slot. The returned release function must
+// be called exactly once when the connection is done.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	// Fast path: a slot is free
+	select {
+	case l.slots <- struct{}{}:
+		return l.releaseFunc(), nil
+	default:
+	}
+	pending := l.pending.Add(1)
+	defer l.pending.Add(-1)
+	if l.maxPending > 0 && pending > l.maxPending {
+		return nil, failure.New(failure.KindQuotaExceeded, failure.StageConnect, fmt.Errorf("too many pending dials"))
+	}
+	// Blocked senders are served in arrival order
+	select {
+	case l.slots <- struct{}{}:
+		return l.releaseFunc(), nil
+	case <-ctx.Done():
+		return nil, failure.New(failure.KindCanceled, failure.StageConnect, ctx.Err())
+	}
+}
+
+func (l *Limiter) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.slots
+		})
+	}
+}
+
+// Active returns the number of connections holding a slot
+func (l *Limiter) Active() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// Pending returns the number of dials waiting for a slot
+func (l *Limiter) Pending() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.pending.Load())
+}
+
+// Conn releases its slot when closed
+type Conn struct {
+	net.Conn
+	release func()
+}
+
+// WrapConn ties release to the lifetime of conn. Wrapping marks a successful
+// dial, which ends a failure storm (see internal/breaker).
+func WrapConn(conn net.Conn, release func()) net.Conn {
+	breaker.Succeeded()
+	return &Conn{Conn: conn, release: release}
+}
+
+func (c *Conn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+func (c *Conn) Upstream() any {
+	return c.Conn
+}
+
+// PacketConn releases its slot when closed
+type PacketConn struct {
+	net.PacketConn
+	release func()
+}
+
+// WrapPacketConn ties release to the lifetime of conn. Like WrapConn, it
+// marks a successful dial.
+func WrapPacketConn(conn net.PacketConn, release func()) net.PacketConn {
+	breaker.Succeeded()
+	return &PacketConn{PacketConn: conn, release: release}
+}
+
+func (c *PacketConn) Close() error {
+	c.release()
+	return c.PacketConn.Close()
+}
+
+func (c *PacketConn) Upstream() any {
+	return c.PacketConn
+}
@@ -0,0 +1,242 @@
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badjson"
+	"github.com/sagernet/sing/service"
+	"github.com/sagernet/sing/service/filemanager"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+
+	// Outputs the console is written through when records are formatted or
+	// filtered, as Sing-box only hands file outputs to the file manager
+	stderrOutput = "/dev/stderr"
+	stdoutOutput = "/dev/stdout"
+)
+
+// Options are the utp-core fields of the log section. Sing-box rejects
+// unknown fields, so Extract removes them before the configuration is parsed.
+type Options struct {
+	Format string            `json:"format,omitempty"` // text (default) or json
+	Levels map[string]string `json:"levels,omitempty"` // Extension or component name to level, e.g. {"psiphon": "debug", "dns": "warn"}
+
+	base log.Level // Level of the log section
+}
+
+// IsZero reports whether o keeps the Sing-box log output as it is
+func (o Options) IsZero() bool {
+	return o.Format != FormatJSON && len(o.Levels) == 0
+}
+
+// Extract returns the utp-core log options of content together with
+// content without them. Content that is not a JSON object is returned
+// unchanged, so the parser reports the syntax error.
+func Extract(content []byte) (Options, []byte, error) {
+	var fields struct {
+		Log *struct {
+			Format *string            `json:"format"`
+			Levels *map[string]string `json:"levels"`
+		} `json:"log"`
+	}
+	if json.Unmarshal(content, &fields) != nil || fields.Log == nil || (fields.Log.Format == nil && fields.Log.Levels == nil) {
+		return Options{}, content, nil
+	}
+	var options Options
+	if fields.Log.Format != nil {
+		options.Format = *fields.Log.Format
+	}
+	if fields.Log.Levels != nil {
+		options.Levels = *fields.Log.Levels
+	}
+	if err := options.validate(); err != nil {
+		return Options{}, nil, err
+	}
+	var object badjson.JSONObject
+	if err := object.UnmarshalJSON(content); err != nil {
+		return Options{}, content, nil
+	}
+	section, _ := object.Get("log")
+	if logObject, isObject := section.(*badjson.JSONObject); isObject {
+		logObject.Remove("format")
+		logObject.Remove("levels")
+	}
+	stripped, err := object.MarshalJSON()
+	if err != nil {
+		return Options{}, nil, err
+	}
+	return options, stripped, nil
+}
+
+// Restore adds o to the log section of content, an indented configuration
+// written without them
+func Restore(content []byte, o Options) ([]byte, error) {
+	if o.Format == "" && len(o.Levels) == 0 {
+		return content, nil
+	}
+	var object badjson.JSONObject
+	if err := object.UnmarshalJSON(content); err != nil {
+		return nil, err
+	}
+	section, _ := object.Get("log")
+	logObject, isObject := section.(*badjson.JSONObject)
+	if !isObject {
+		logObject = new(badjson.JSONObject)
+		object.Put("log", logObject)
+	}
+	if o.Format != "" {
+		logObject.Put("format", o.Format)
+	}
+	if len(o.Levels) > 0 {
+		logObject.Put("levels", o.Levels)
+	}
+	compact, err := object.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := json.Indent(&buffer, compact, "", "  "); err != nil {
+		return nil, err
+	}
+	buffer.WriteByte('\n')
+	return buffer.Bytes(), nil
+}
+
+func (o Options) validate() error {
+	switch o.Format {
+	case "", FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("log.format: expected text or json, got %q", o.Format)
+	}
+	for name, level := range o.Levels {
+		if _, err := log.ParseLevel(level); err != nil {
+			return fmt.Errorf("log.levels.%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ContextWithOptions returns ctx, which must carry the file manager of
+// ContextWithSinks, formatting and filtering the log outputs according to o.
+// logOptions are adjusted to match: the console outputs are replaced by
+// pipes, and the level is lowered to the most verbose extension level so the
+// pipe can filter each extension by its own level.
+func ContextWithOptions(ctx context.Context, o Options, logOptions *option.LogOptions) context.Context {
+	parent, isSinks := service.FromContext[filemanager.Manager](ctx).(*manager)
+	if !isSinks || o.IsZero() || logOptions.Disabled {
+		return ctx
+	}
+	switch logOptions.Output {
+	case "", "stderr":
+		logOptions.Output = stderrOutput
+	case "stdout":
+		logOptions.Output = stdoutOutput
+	}
+	o.base = log.LevelTrace
+	if level, err := log.ParseLevel(logOptions.Level); err == nil {
+		o.base = level
+	}
+	if len(o.Levels) > 0 {
+		lowest := o.base
+		for _, level := range o.Levels {
+			parsed, _ := log.ParseLevel(level)
+			lowest = max(lowest, parsed)
+		}
+		logOptions.Level = log.FormatLevel(lowest)
+	}
+	return service.ContextWith[filemanager.Manager](ctx, &manager{Manager: parent.Manager, options: o})
+}
+
+// level returns the level of extension, or the level of the log section
+// for unlisted extensions
+func (o Options) level(extension string) log.Level {
+	if level, err := log.ParseLevel(o.Levels[extension]); err == nil {
+		return level
+	}
+	return o.base
+}
+
+// Record is one log line in JSON format. Fields other than the level and
+// message are present when the line carries them.
+type Record struct {
+	Time        time.Time `json:"time"`
+	Level       string    `json:"level"`
+	Extension   string    `json:"extension,omitempty"`   // Protocol or component, e.g. "psiphon" or "router"
+	Kind        string    `json:"kind,omitempty"`        // inbound, outbound, service...
+	Tag         string    `json:"tag,omitempty"`         // Configured tag
+	Connection  uint64    `json:"connection,omitempty"`  // ID shared by the lines of one connection
+	Duration    int64     `json:"duration_ms,omitempty"` // Age of the connection
+	Destination string    `json:"destination,omitempty"`
+	ErrorClass  string    `json:"error_class,omitempty"` // Failure kind of warnings and errors
+	Message     string    `json:"message"`
+
+	level log.Level
+}
+
+// parseRecord splits a Sing-box log line ("LEVEL[0000] [id age] kind/type[tag]:
+// message") into a record
+func parseRecord(line string) (Record, bool) {
+	record := Record{Time: time.Now()}
+	rest := line
+	found := false
+	for range 4 {
+		field, remaining, more := strings.Cut(strings.TrimLeft(rest, " "), " ")
+		name, _, _ := strings.Cut(field, "[")
+		if level, err := log.ParseLevel(strings.ToLower(name)); err == nil && name == strings.ToUpper(name) {
+			record.level, record.Level, rest, found = level, log.FormatLevel(level), remaining, true
+			break
+		}
+		if !more {
+			break
+		}
+		rest = remaining
+	}
+	if !found {
+		return Record{}, false
+	}
+	rest = strings.TrimSpace(rest)
+	if strings.HasPrefix(rest, "[") {
+		if connection, remaining, closed := strings.Cut(rest[1:], "] "); closed {
+			id, age, _ := strings.Cut(connection, " ")
+			record.Connection, _ = strconv.ParseUint(id, 10, 64)
+			if duration, err := time.ParseDuration(age); err == nil {
+				record.Duration = duration.Milliseconds()
+			}
+			rest = remaining
+		}
+	}
+	if tag, message, hasTag := strings.Cut(rest, ": "); hasTag && !strings.Contains(tag, " ") {
+		record.Kind, record.Extension, _ = strings.Cut(tag, "/")
+		if record.Extension == "" {
+			record.Kind, record.Extension = "", record.Kind
+		}
+		if name, configured, hasName := strings.Cut(record.Extension, "["); hasName {
+			record.Extension, record.Tag = name, strings.TrimSuffix(configured, "]")
+		}
+		rest = message
+	}
+	record.Message = rest
+	if _, destination, hasDestination := strings.Cut(rest, "connection to "); hasDestination {
+		record.Destination, _, _ = strings.Cut(destination, " ")
+		record.Destination = strings.TrimSuffix(record.Destination, ":")
+	}
+	if record.level <= log.LevelWarn {
+		if kind := failure.ClassifyMessage(rest); kind != failure.KindUnknown {
+			record.ErrorClass = string(kind)
+		}
+	}
+	return record, true
+}
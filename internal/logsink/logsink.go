@@ -0,0 +1,161 @@
+// Package logsink forwards the log to syslog, journald or a remote syslog
+// collector, for deployments where local log files are undesirable. Sinks are
+// selected with log.output:
+//
+//	syslog                   local syslog daemon (/dev/log)
+//	journald                 systemd journal
+//	syslog+udp://host:514    remote syslog (RFC 5424)
+//	syslog+tcp://host:601    remote syslog over TCP (octet counting)
+//	syslog+tls://host:6514   remote syslog over TLS
+//
+// Remote outputs accept ?facility= (default daemon). Sing-box opens log
+// outputs as files, so a file manager in the context hands it a pipe whose
+// lines are forwarded to the sink. A reload builds a new pipe, which makes
+// sinks switchable at runtime.
+//
+// The same pipe formats lines as JSON records (log.format) and filters them
+// by extension (log.levels) for files and the console; see Options.
+package logsink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/sagernet/sing/service"
+	"github.com/sagernet/sing/service/filemanager"
+)
+
+const (
+	// queueSize bounds the lines waiting for a slow sink; further lines are
+	// dropped rather than blocking the logger
+	queueSize = 1024
+	tag       = "utp-core"
+)
+
+// IsSink reports whether output names a sink rather than a file. The
+// console outputs set by ContextWithOptions count as sinks.
+func IsSink(output string) bool {
+	return output == "syslog" || output == "journald" || strings.HasPrefix(output, "syslog+") ||
+		output == stderrOutput || output == stdoutOutput
+}
+
+// ContextWithSinks returns ctx with a file manager opening sink outputs
+func ContextWithSinks(ctx context.Context) context.Context {
+	parent := service.FromContext[filemanager.Manager](ctx)
+	if parent == nil {
+		parent = service.FromContext[filemanager.Manager](filemanager.WithDefault(context.Background(), "", "", os.Getuid(), os.Getgid()))
+	}
+	return service.ContextWith[filemanager.Manager](ctx, &manager{Manager: parent})
+}
+
+type manager struct {
+	filemanager.Manager
+	options Options
+}
+
+func (m *manager) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	if IsSink(name) {
+		return open(name, m.options)
+	}
+	if m.options.IsZero() {
+		return m.Manager.OpenFile(name, flag, perm)
+	}
+	logFile, err := m.Manager.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return pipe(&file{out: logFile}, m.options)
+}
+
+// Open connects the sink named by output and returns the pipe feeding it.
+// The sink is closed once the pipe is closed and the queued lines are sent.
+func Open(output string) (*os.File, error) {
+	return open(output, Options{})
+}
+
+func open(output string, options Options) (*os.File, error) {
+	s, err := newSink(output)
+	if err != nil {
+		return nil, err
+	}
+	return pipe(s, options)
+}
+
+func pipe(s sink, options Options) (*os.File, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	queue := make(chan string, queueSize)
+	go func() {
+		defer reader.Close()
+		defer close(queue)
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+		for scanner.Scan() {
+			select {
+			case queue <- scanner.Text():
+			default:
+			}
+		}
+	}()
+	go func() {
+		defer s.Close()
+		for line := range queue {
+			if line == "" {
+				continue
+			}
+			severity, message := parseLine(line)
+			if _, isFile := s.(*file); isFile {
+				// Files and the console keep the Sing-box line
+				message = line
+			}
+			if record, parsed := parseRecord(line); parsed {
+				if len(options.Levels) > 0 && record.level > options.level(record.Extension) {
+					continue
+				}
+				if options.Format == FormatJSON {
+					content, _ := json.Marshal(record)
+					message = string(content)
+				}
+			}
+			s.Write(severity, message)
+		}
+	}()
+	return writer, nil
+}
+
+// Syslog severities
+const (
+	severityCritical = 2
+	severityError    = 3
+	severityWarning  = 4
+	severityInfo     = 6
+	severityDebug    = 7
+)
+
+var severities = map[string]int{
+	"PANIC": severityCritical, "FATAL": severityCritical, "ERROR": severityError,
+	"WARN": severityWarning, "INFO": severityInfo, "DEBUG": severityDebug, "TRACE": severityDebug,
+}
+
+// parseLine finds the level of a log line, after the timestamp when
+// log.timestamp is set, and returns its severity with the message
+func parseLine(line string) (int, string) {
+	rest := line
+	for range 4 {
+		field, remaining, found := strings.Cut(strings.TrimLeft(rest, " "), " ")
+		if severity, isLevel := severities[field]; isLevel {
+			return severity, strings.TrimSpace(remaining)
+		}
+		if !found {
+			break
+		}
+		rest = remaining
+	}
+	return severityInfo, line
+}
@@ -0,0 +1,189 @@
+package logsink
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+	// redialDelay is the time lines are dropped after a remote collector
+	// could not be reached
+	redialDelay = 5 * time.Second
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var defaultPorts = map[string]string{"udp": "514", "tcp": "601", "tls": "6514"}
+
+type sink interface {
+	Write(severity int, message string)
+	Close() error
+}
+
+func newSink(output string) (sink, error) {
+	switch output {
+	case stderrOutput:
+		return &file{out: os.Stderr, console: true}, nil
+	case stdoutOutput:
+		return &file{out: os.Stdout, console: true}, nil
+	case "syslog":
+		return dialLocal([]string{"/dev/log", "/var/run/syslog", "/var/run/log"}, false)
+	case "journald":
+		return dialLocal([]string{"/run/systemd/journal/socket"}, true)
+	}
+	target, err := url.Parse(output)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log output: %w", err)
+	}
+	transport, _ := strings.CutPrefix(target.Scheme, "syslog+")
+	port, known := defaultPorts[transport]
+	if !known || target.Hostname() == "" {
+		return nil, fmt.Errorf("invalid log output %s: expected syslog+udp, syslog+tcp or syslog+tls://host[:port]", output)
+	}
+	if target.Port() != "" {
+		port = target.Port()
+	}
+	r := &remote{
+		network:  "tcp",
+		address:  net.JoinHostPort(target.Hostname(), port),
+		facility: facilities["daemon"],
+		hostname: "-",
+		pid:      os.Getpid(),
+	}
+	if name := target.Query().Get("facility"); name != "" {
+		facility, known := facilities[name]
+		if !known {
+			return nil, fmt.Errorf("invalid log output %s: unknown facility %s", output, name)
+		}
+		r.facility = facility
+	}
+	switch transport {
+	case "udp":
+		r.network = "udp"
+	case "tls":
+		r.tlsConfig = &tls.Config{ServerName: target.Hostname()}
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		r.hostname = hostname
+	}
+	return r, nil
+}
+
+// local writes to a syslog daemon or the journal on this machine
+type local struct {
+	conn    net.Conn
+	journal bool
+	pid     int
+}
+
+func dialLocal(paths []string, journal bool) (sink, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("local syslog and journald are not available on windows")
+	}
+	var lastErr error
+	for _, path := range paths {
+		conn, err := net.Dial("unixgram", path)
+		if err == nil {
+			return &local{conn: conn, journal: journal, pid: os.Getpid()}, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("failed to connect to the local log daemon: %w", lastErr)
+}
+
+func (l *local) Write(severity int, message string) {
+	if l.journal {
+		// Native journal protocol; lines never contain a newline
+		fmt.Fprintf(l.conn, "PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\nSYSLOG_PID=%d\nMESSAGE=%s\n", severity, tag, l.pid, message)
+		return
+	}
+	fmt.Fprintf(l.conn, "<%d>%s %s[%d]: %s", facilities["daemon"]*8+severity, time.Now().Format(time.Stamp), tag, l.pid, message)
+}
+
+func (l *local) Close() error {
+	return l.conn.Close()
+}
+
+// file writes lines to a log file or the console
+type file struct {
+	out     *os.File
+	console bool
+}
+
+func (f *file) Write(severity int, message string) {
+	f.out.WriteString(message + "\n")
+}
+
+func (f *file) Close() error {
+	if f.console {
+		return nil
+	}
+	return f.out.Close()
+}
+
+// remote sends RFC 5424 messages to a collector, one datagram per message
+// over UDP and octet-counted over TCP and TLS (RFC 6587). The connection is
+// opened on first use and re-opened after errors, so an unreachable collector
+// does not keep the instance from starting.
+type remote struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	facility  int
+	hostname  string
+	pid       int
+	conn      net.Conn
+	retryAt   time.Time
+}
+
+func (r *remote) Write(severity int, message string) {
+	if r.conn == nil {
+		if time.Now().Before(r.retryAt) {
+			return
+		}
+		conn, err := r.dial()
+		if err != nil {
+			r.retryAt = time.Now().Add(redialDelay)
+			return
+		}
+		r.conn = conn
+	}
+	record := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", r.facility*8+severity,
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), r.hostname, tag, r.pid, message)
+	if r.network != "udp" {
+		record = strconv.Itoa(len(record)) + " " + record
+	}
+	r.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := r.conn.Write([]byte(record)); err != nil {
+		r.conn.Close()
+		r.conn = nil
+	}
+}
+
+func (r *remote) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	if r.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, r.network, r.address, r.tlsConfig)
+	}
+	return dialer.Dial(r.network, r.address)
+}
+
+func (r *remote) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
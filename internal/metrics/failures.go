@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// FailureCount is the number of dials of an outbound that failed at one
+// stage for one reason, since the process started
+type FailureCount struct {
+	Tenant   string `json:"tenant,omitempty"`
+	Outbound string `json:"outbound"`
+	Stage    string `json:"stage,omitempty"` // connect, tls, handshake, auth or target; empty when unknown
+	Reason   string `json:"reason"`          // Failure kind, such as blocked-reset or auth-failed
+	Count    int64  `json:"count"`
+}
+
+type failureKey struct {
+	tenant   string
+	outbound string
+	stage    string
+	reason   string
+}
+
+// Failure counters are process-wide like the failure records they count,
+// so they survive reloads and are shared by every store
+var failures sync.Map // failureKey to *atomic.Int64
+
+// CountFailure adds a failed dial of outbound of the tenant, "" for the main
+// instance
+func CountFailure(tenant string, outbound string, stage string, reason string) {
+	key := failureKey{tenant: tenant, outbound: outbound, stage: stage, reason: reason}
+	counter, loaded := failures.Load(key)
+	if !loaded {
+		counter, _ = failures.LoadOrStore(key, new(atomic.Int64))
+	}
+	counter.(*atomic.Int64).Add(1)
+}
+
+// Failures returns the failure counters of the tenant, by outbound, stage
+// and reason
+func Failures(tenant string) []FailureCount {
+	var result []FailureCount
+	failures.Range(func(key, value any) bool {
+		k := key.(failureKey)
+		if k.tenant != tenant {
+			return true
+		}
+		result = append(result, FailureCount{
+			Tenant:   k.tenant,
+			Outbound: k.outbound,
+			Stage:    k.stage,
+			Reason:   k.reason,
+			Count:    value.(*atomic.Int64).Load(),
+		})
+		return true
+	})
+	slices.SortFunc(result, func(a, b FailureCount) int {
+		return cmp.Or(cmp.Compare(a.Outbound, b.Outbound), cmp.Compare(a.Stage, b.Stage), cmp.Compare(a.Reason, b.Reason))
+	})
+	return result
+}
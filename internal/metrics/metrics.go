@@ -0,0 +1,440 @@
+// Package metrics keeps traffic counters of routed connections, per outbound
+// and per inbound user, a short history of throughput samples for graphs,
+// and counters of failed outbound dials by stage and reason. It also
+// enforces the quotas of users.
+package metrics
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing/common/bufio"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// Sampling parameters of the throughput history
+const (
+	SampleInterval = time.Second
+	HistoryLength  = 300
+)
+
+var _ adapter.ConnectionTracker = (*Store)(nil)
+
+// Counters are the totals of one outbound or user
+type Counters struct {
+	Upload      int64 `json:"upload"`
+	Download    int64 `json:"download"`
+	Connections int64 `json:"connections"` // Currently open
+	Total       int64 `json:"total"`       // Opened since start
+}
+
+// Quota limits one user authenticated by an inbound. Zero fields do not
+// limit.
+type Quota struct {
+	Traffic        int64 `json:"traffic,omitempty"`         // Upload plus download bytes since start
+	MaxConnections int64 `json:"max_connections,omitempty"` // Connections open at once
+}
+
+// UserCounters are the totals of one user and its quota, if any
+type UserCounters struct {
+	Counters
+	Quota *Quota `json:"quota,omitempty"`
+}
+
+// Connection describes an open connection
+type Connection struct {
+	ID          string    `json:"id"`
+	Start       time.Time `json:"start"`
+	Network     string    `json:"network"`
+	Inbound     string    `json:"inbound"`
+	InboundType string    `json:"inbound_type"`
+	User        string    `json:"user,omitempty"` // Authenticated by the inbound
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Domain      string    `json:"domain,omitempty"`
+	Outbound    string    `json:"outbound"`
+	Rule        string    `json:"rule"`
+	Upload      int64     `json:"upload"`
+	Download    int64     `json:"download"`
+}
+
+// Sample is the throughput of one sampling interval, in bytes per second
+type Sample struct {
+	Time     time.Time `json:"time"`
+	Upload   int64     `json:"upload"`
+	Download int64     `json:"download"`
+}
+
+type counters struct {
+	upload      atomic.Int64
+	download    atomic.Int64
+	connections atomic.Int64
+	total       atomic.Int64
+}
+
+func (c *counters) load() Counters {
+	return Counters{
+		Upload:      c.upload.Load(),
+		Download:    c.download.Load(),
+		Connections: c.connections.Load(),
+		Total:       c.total.Load(),
+	}
+}
+
+// Store counts the traffic of every connection routed through it. Register
+// it with Router.AppendTracker.
+type Store struct {
+	started time.Time
+	all     counters
+
+	access    sync.RWMutex
+	outbounds map[string]*counters
+	users     map[string]*counters
+	quotas    map[string]Quota
+	history   []Sample
+	cancel    context.CancelFunc
+
+	nextID atomic.Uint64
+	live   sync.Map // ID to *connection
+}
+
+// connection is an open connection with its own counters
+type connection struct {
+	info     Connection
+	upload   atomic.Int64
+	download atomic.Int64
+	conn     interface{ Close() error }
+}
+
+// NewStore returns an empty store
+func NewStore() *Store {
+	return &Store{
+		started:   time.Now(),
+		outbounds: make(map[string]*counters),
+		users:     make(map[string]*counters),
+	}
+}
+
+// SetQuotas limits the users named in quotas. Connections of a user beyond
+// its connection limit, or once its traffic reached its quota, are closed as
+// soon as they are routed; open connections are closed when the traffic of
+// their user reaches its quota, checked every sampling interval.
+func (s *Store) SetQuotas(quotas map[string]Quota) {
+	s.access.Lock()
+	s.quotas = quotas
+	s.access.Unlock()
+}
+
+// Start samples the throughput until Close
+func (s *Store) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.sample(ctx)
+}
+
+// Close stops sampling
+func (s *Store) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return nil
+}
+
+// Uptime returns the time since the store was created
+func (s *Store) Uptime() time.Duration {
+	return time.Since(s.started)
+}
+
+// Total returns the totals over all outbounds
+func (s *Store) Total() Counters {
+	return s.all.load()
+}
+
+// Outbounds returns the totals of every outbound that carried a connection
+func (s *Store) Outbounds() map[string]Counters {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	result := make(map[string]Counters, len(s.outbounds))
+	for tag, c := range s.outbounds {
+		result[tag] = c.load()
+	}
+	return result
+}
+
+// Users returns the totals of every user authenticated by an inbound that
+// carried a connection, such as the users of shadowsocks and trojan servers,
+// and of every user with a quota
+func (s *Store) Users() map[string]UserCounters {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	result := make(map[string]UserCounters, len(s.users))
+	for name, c := range s.users {
+		result[name] = UserCounters{Counters: c.load()}
+	}
+	for name, quota := range s.quotas {
+		counters := result[name]
+		counters.Quota = &quota
+		result[name] = counters
+	}
+	return result
+}
+
+// History returns the throughput samples, oldest first
+func (s *Store) History() []Sample {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return append([]Sample(nil), s.history...)
+}
+
+// Connections returns the open connections, oldest first
+func (s *Store) Connections() []Connection {
+	var result []Connection
+	s.live.Range(func(_, value any) bool {
+		c := value.(*connection)
+		info := c.info
+		info.Upload = c.upload.Load()
+		info.Download = c.download.Load()
+		result = append(result, info)
+		return true
+	})
+	slices.SortFunc(result, func(a, b Connection) int {
+		return a.Start.Compare(b.Start)
+	})
+	return result
+}
+
+// CloseConnection closes the open connection with the given ID and reports
+// whether it was found
+func (s *Store) CloseConnection(id string) bool {
+	value, loaded := s.live.Load(id)
+	if !loaded {
+		return false
+	}
+	value.(*connection).conn.Close()
+	return true
+}
+
+// CloseConnections closes all open connections
+func (s *Store) CloseConnections() {
+	s.live.Range(func(_, value any) bool {
+		value.(*connection).conn.Close()
+		return true
+	})
+}
+
+// RoutedConnection counts reads from the inbound connection as upload and
+// writes to it as download
+func (s *Store) RoutedConnection(ctx context.Context, conn net.Conn, metadata adapter.InboundContext, matchedRule adapter.Rule, matchOutbound adapter.Outbound) net.Conn {
+	c := s.open(matchOutbound, metadata.User)
+	live := s.track("tcp", metadata, matchedRule, matchOutbound)
+	upload, download := c.counters(live)
+	tracked := &trackedConn{
+		CounterConn: bufio.NewInt64CounterConn(conn, upload, download),
+		close:       s.closer(c, live),
+	}
+	live.conn = tracked
+	s.live.Store(live.info.ID, live)
+	if s.overQuota(metadata.User, c.user) {
+		tracked.Close()
+	}
+	return tracked
+}
+
+func (s *Store) RoutedPacketConnection(ctx context.Context, conn N.PacketConn, metadata adapter.InboundContext, matchedRule adapter.Rule, matchOutbound adapter.Outbound) N.PacketConn {
+	c := s.open(matchOutbound, metadata.User)
+	live := s.track("udp", metadata, matchedRule, matchOutbound)
+	upload, download := c.counters(live)
+	tracked := &trackedPacketConn{
+		CounterPacketConn: bufio.NewInt64CounterPacketConn(conn, upload, nil, download, nil),
+		close:             s.closer(c, live),
+	}
+	live.conn = tracked
+	s.live.Store(live.info.ID, live)
+	if s.overQuota(metadata.User, c.user) {
+		tracked.Close()
+	}
+	return tracked
+}
+
+// overQuota reports whether a new connection of user, already counted in c,
+// exceeds the quota of the user
+func (s *Store) overQuota(user string, c *counters) bool {
+	if c == nil {
+		return false
+	}
+	s.access.RLock()
+	quota, limited := s.quotas[user]
+	s.access.RUnlock()
+	if !limited {
+		return false
+	}
+	totals := c.load()
+	return (quota.MaxConnections > 0 && totals.Connections > quota.MaxConnections) ||
+		(quota.Traffic > 0 && totals.Upload+totals.Download >= quota.Traffic)
+}
+
+// enforce closes the open connections of the users whose traffic reached
+// their quota
+func (s *Store) enforce() {
+	exceeded := make(map[string]bool)
+	s.access.RLock()
+	for name, quota := range s.quotas {
+		if c, loaded := s.users[name]; loaded && quota.Traffic > 0 && c.upload.Load()+c.download.Load() >= quota.Traffic {
+			exceeded[name] = true
+		}
+	}
+	s.access.RUnlock()
+	if len(exceeded) == 0 {
+		return
+	}
+	s.live.Range(func(_, value any) bool {
+		if c := value.(*connection); exceeded[c.info.User] {
+			c.conn.Close()
+		}
+		return true
+	})
+}
+
+func (s *Store) track(network string, metadata adapter.InboundContext, matchedRule adapter.Rule, matchOutbound adapter.Outbound) *connection {
+	info := Connection{
+		ID:          strconv.FormatUint(s.nextID.Add(1), 10),
+		Start:       time.Now(),
+		Network:     network,
+		Inbound:     metadata.Inbound,
+		InboundType: metadata.InboundType,
+		User:        metadata.User,
+		Source:      metadata.Source.String(),
+		Destination: metadata.Destination.String(),
+		Domain:      metadata.Domain,
+		Rule:        "final",
+	}
+	if info.Domain == "" && metadata.Destination.IsFqdn() {
+		info.Domain = metadata.Destination.Fqdn
+	}
+	if matchOutbound != nil {
+		info.Outbound = matchOutbound.Tag()
+	}
+	if matchedRule != nil {
+		info.Rule = matchedRule.String() + " => " + matchedRule.Action().String()
+	}
+	return &connection{info: info}
+}
+
+// opened are the counters a new connection adds to
+type opened struct {
+	all      *counters
+	outbound *counters
+	user     *counters // nil without an authenticated user
+}
+
+// counters returns the upload and download counters of a connection
+func (o opened) counters(live *connection) (upload []*atomic.Int64, download []*atomic.Int64) {
+	upload = []*atomic.Int64{&o.all.upload, &o.outbound.upload, &live.upload}
+	download = []*atomic.Int64{&o.all.download, &o.outbound.download, &live.download}
+	if o.user != nil {
+		upload = append(upload, &o.user.upload)
+		download = append(download, &o.user.download)
+	}
+	return
+}
+
+func (s *Store) open(outbound adapter.Outbound, user string) opened {
+	tag := ""
+	if outbound != nil {
+		tag = outbound.Tag()
+	}
+	c := opened{all: &s.all, outbound: s.load(s.outbounds, tag)}
+	if user != "" {
+		c.user = s.load(s.users, user)
+	}
+	for _, counters := range []*counters{c.all, c.outbound, c.user} {
+		if counters != nil {
+			counters.connections.Add(1)
+			counters.total.Add(1)
+		}
+	}
+	return c
+}
+
+// load returns the counters of key in m, adding them if missing
+func (s *Store) load(m map[string]*counters, key string) *counters {
+	s.access.RLock()
+	c, loaded := m[key]
+	s.access.RUnlock()
+	if !loaded {
+		s.access.Lock()
+		if c, loaded = m[key]; !loaded {
+			c = new(counters)
+			m[key] = c
+		}
+		s.access.Unlock()
+	}
+	return c
+}
+
+func (s *Store) closer(c opened, live *connection) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, counters := range []*counters{c.all, c.outbound, c.user} {
+				if counters != nil {
+					counters.connections.Add(-1)
+				}
+			}
+			s.live.Delete(live.info.ID)
+		})
+	}
+}
+
+func (s *Store) sample(ctx context.Context) {
+	ticker := time.NewTicker(SampleInterval)
+	defer ticker.Stop()
+	last := s.all.load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			current := s.all.load()
+			sample := Sample{
+				Time:     now,
+				Upload:   (current.Upload - last.Upload) * int64(time.Second) / int64(SampleInterval),
+				Download: (current.Download - last.Download) * int64(time.Second) / int64(SampleInterval),
+			}
+			last = current
+			s.access.Lock()
+			if len(s.history) == HistoryLength {
+				s.history = append(s.history[:0], s.history[1:]...)
+			}
+			s.history = append(s.history, sample)
+			s.access.Unlock()
+			s.enforce()
+		}
+	}
+}
+
+type trackedConn struct {
+	*bufio.CounterConn
+	close func()
+}
+
+func (c *trackedConn) Close() error {
+	c.close()
+	return c.CounterConn.Close()
+}
+
+type trackedPacketConn struct {
+	*bufio.CounterPacketConn
+	close func()
+}
+
+func (c *trackedPacketConn) Close() error {
+	c.close()
+	return c.CounterPacketConn.Close()
+}
@@ -0,0 +1,32 @@
+// Package netdial builds the dialers extension outbounds reach their servers
+// with: a sing-box dialer honoring detour, bind_interface, bind addresses and
+// routing_mark when the outbound sets them, a system socket carrying its QoS
+// marks otherwise, or a dialer carried by the context the outbound is
+// created with. Tests use the latter to connect outbounds to in-memory
+// servers (see internal/testkit).
+package netdial
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer opens connections to network addresses, like net.Dialer
+type Dialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+type contextKey struct{}
+
+// WithDialer returns a context making outbounds created with it dial through
+// dialer
+func WithDialer(ctx context.Context, dialer Dialer) context.Context {
+	return context.WithValue(ctx, contextKey{}, dialer)
+}
+
+// FromContext returns the dialer set with WithDialer, or nil when outbounds
+// dial system sockets
+func FromContext(ctx context.Context) Dialer {
+	dialer, _ := ctx.Value(contextKey{}).(Dialer)
+	return dialer
+}
@@ -0,0 +1,140 @@
+package netdial
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/dialer"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badoption"
+	"github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/sockopt"
+)
+
+// DialerOptions select how an extension outbound reaches its server, with the
+// meaning of the sing-box dial fields of the same names
+type DialerOptions struct {
+	Detour           string          `json:"detour,omitempty"`             // Outbound to reach the server through
+	BindInterface    string          `json:"bind_interface,omitempty"`     // Network interface to bind to
+	Inet4BindAddress *badoption.Addr `json:"inet4_bind_address,omitempty"` // Local IPv4 address
+	Inet6BindAddress *badoption.Addr `json:"inet6_bind_address,omitempty"` // Local IPv6 address
+	RoutingMark      option.FwMark   `json:"routing_mark,omitempty"`       // Linux SO_MARK
+}
+
+// IsEmpty reports whether no option is set, leaving sockets to the system
+func (o DialerOptions) IsEmpty() bool {
+	return o.Detour == "" && o.BindInterface == "" && o.Inet4BindAddress == nil && o.Inet6BindAddress == nil && o.RoutingMark == 0
+}
+
+// Dependencies returns the detour, which must start before the outbound
+func (o DialerOptions) Dependencies() []string {
+	if o.Detour == "" {
+		return nil
+	}
+	return []string{o.Detour}
+}
+
+// Outbound dials the server of an extension outbound: through the dialer
+// injected by tests, through a sing-box dialer when options are set, and
+// through a system socket carrying the QoS marks otherwise
+type Outbound struct {
+	tag      string
+	marks    sockopt.Marks
+	injected Dialer
+	box      N.Dialer
+	dns      adapter.DNSRouter
+}
+
+// New returns the dialer of the outbound tag. QoS marks are set on system
+// sockets only, so they cannot be combined with options.
+func New(ctx context.Context, tag string, opts DialerOptions, marks sockopt.Marks) (*Outbound, error) {
+	d := &Outbound{tag: tag, marks: marks, injected: FromContext(ctx)}
+	if opts.IsEmpty() || d.injected != nil {
+		return d, nil
+	}
+	if marks != (sockopt.Marks{}) {
+		return nil, fmt.Errorf("dscp, tos and socket_priority cannot be combined with detour, bind_interface, bind addresses or routing_mark")
+	}
+	singDialer, err := dialer.New(ctx, option.DialerOptions{
+		Detour:           opts.Detour,
+		BindInterface:    opts.BindInterface,
+		Inet4BindAddress: opts.Inet4BindAddress,
+		Inet6BindAddress: opts.Inet6BindAddress,
+		RoutingMark:      opts.RoutingMark,
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+	d.box = singDialer
+	d.dns = service.FromContext[adapter.DNSRouter](ctx)
+	return d, nil
+}
+
+// For returns the dialer of a connection. metadata, the connection routed
+// through the outbound, lets QoS rules match it; it is nil for sessions
+// shared by many connections.
+func (d *Outbound) For(metadata *adapter.InboundContext) Dialer {
+	switch {
+	case d.injected != nil:
+		return d.injected
+	case d.box != nil:
+		return boxDialer{d.box}
+	default:
+		return sockopt.Dialer(d.tag, metadata, d.marks)
+	}
+}
+
+// Lookup resolves the server name host for outbounds that need its address
+// rather than a connection, such as to rewrite ports. With options set, the
+// DNS router resolves it with the domain resolver of the sing-box dialer, as
+// its dials do; otherwise the system resolver does, as for system sockets.
+func (d *Outbound) Lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	switch {
+	case d.injected != nil:
+		return nil, fmt.Errorf("injected dialer does not resolve names")
+	case d.box != nil:
+		if d.dns == nil {
+			return nil, fmt.Errorf("DNS router not available")
+		}
+		var options adapter.DNSQueryOptions
+		if resolver, isResolver := d.box.(dialer.ResolveDialer); isResolver {
+			options = resolver.QueryOptions()
+		}
+		return d.dns.Lookup(ctx, host, options)
+	default:
+		return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	}
+}
+
+// ListenPacket returns an unconnected UDP socket, for outbounds exchanging
+// datagrams with several servers. Dialers injected by tests only carry
+// streams.
+func (d *Outbound) ListenPacket(ctx context.Context, inboundContext *adapter.InboundContext) (net.PacketConn, error) {
+	switch {
+	case d.injected != nil:
+		return nil, fmt.Errorf("injected dialer does not support UDP sockets")
+	case d.box != nil:
+		return d.box.ListenPacket(ctx, metadata.Socksaddr{})
+	default:
+		config := net.ListenConfig{Control: sockopt.Dialer(d.tag, inboundContext, d.marks).Control}
+		return config.ListenPacket(ctx, "udp", "")
+	}
+}
+
+// boxDialer adapts a sing-box dialer to address strings
+type boxDialer struct {
+	dialer N.Dialer
+}
+
+func (b boxDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return b.dialer.DialContext(ctx, network, metadata.ParseSocksaddr(address))
+}
@@ -0,0 +1,94 @@
+package pairing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PollInterval is the time between checks for the operator's decision
+const PollInterval = 2 * time.Second
+
+// Join pairs with the server at baseURL. showCode is called with the code to
+// display as soon as it is known; Join then waits for the operator's
+// decision and returns the delivered configuration. The key of the server
+// must match the commitment it sent before seeing the key of the joiner.
+func Join(ctx context.Context, baseURL string, showCode func(code string)) ([]byte, error) {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	var started startResponse
+	if err := call(ctx, http.MethodPost, baseURL+"/pair", nil, &started); err != nil {
+		return nil, err
+	}
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(joinRequest{PublicKey: key.PublicKey()})
+	if err != nil {
+		return nil, err
+	}
+	var joined joinResponse
+	if err := call(ctx, http.MethodPost, baseURL+"/pair/"+started.ID, body, &joined); err != nil {
+		return nil, err
+	}
+	if !CheckCommitment(started.Commitment, joined.PublicKey) {
+		return nil, fmt.Errorf("pairing server revealed a key other than the one committed to")
+	}
+	secret, err := key.Derive(joined.PublicKey, key.PublicKey(), joined.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	showCode(secret.Code())
+
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		var delivery deliveryResponse
+		err := call(ctx, http.MethodGet, baseURL+"/pair/"+started.ID, nil, &delivery)
+		if err == errPending {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return secret.Open(delivery.Config)
+	}
+}
+
+var errPending = fmt.Errorf("pairing pending")
+
+func call(ctx context.Context, method string, url string, body []byte, result any) error {
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(response.Body).Decode(result)
+	case http.StatusAccepted:
+		return errPending
+	}
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("pairing server: %s: %s", response.Status, strings.TrimSpace(string(message)))
+}
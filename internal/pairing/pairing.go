@@ -0,0 +1,124 @@
+// Package pairing provisions a configuration to a new instance without
+// copying JSON around. The new instance (the joiner) and the provisioning
+// instance exchange ephemeral X25519 keys over plain HTTP; both derive the
+// same short numeric code from the shared secret and display it. The
+// operator approves the request only if the codes match, and the
+// configuration is then delivered encrypted with a key derived from the
+// same secret.
+//
+// The server commits to its key before it sees the joiner's and reveals it
+// afterwards, so a man in the middle cannot search for keys giving both
+// sides the same code: each attempt matches by chance only, one in a
+// million, and costs an approval prompt on the server.
+package pairing
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// CodeDigits is the length of the pairing code
+const CodeDigits = 6
+
+// Key is one side of a pairing exchange
+type Key struct {
+	private *ecdh.PrivateKey
+}
+
+// NewKey generates an ephemeral key
+func NewKey() (*Key, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{private: private}, nil
+}
+
+// PublicKey returns the raw public key sent to the peer
+func (k *Key) PublicKey() []byte {
+	return k.private.PublicKey().Bytes()
+}
+
+// Commitment returns the commitment to the raw public key of the server
+// sent before the joiner's key
+func Commitment(publicKey []byte) []byte {
+	sum := sha256.Sum256(append([]byte("utp-core pairing commitment"), publicKey...))
+	return sum[:]
+}
+
+// CheckCommitment reports whether publicKey is the key committed to
+func CheckCommitment(commitment []byte, publicKey []byte) bool {
+	return bytes.Equal(commitment, Commitment(publicKey))
+}
+
+// Secret is the state shared by both sides after the key exchange
+type Secret struct {
+	code string
+	key  []byte
+}
+
+// Derive computes the shared secret with the peer. joinerKey and serverKey
+// are the raw public keys of both sides, so both derive identical values.
+func (k *Key) Derive(peerKey []byte, joinerKey []byte, serverKey []byte) (*Secret, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer key: %w", err)
+	}
+	shared, err := k.private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	info := append(append([]byte("utp-core pairing v2"), joinerKey...), serverKey...)
+	reader := hkdf.New(sha256.New, shared, nil, info)
+	material := make([]byte, 4+chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(reader, material); err != nil {
+		return nil, err
+	}
+	code := binary.BigEndian.Uint32(material[:4]) % 1_000_000
+	return &Secret{
+		code: fmt.Sprintf("%03d-%03d", code/1000, code%1000),
+		key:  material[4:],
+	}, nil
+}
+
+// Code is the short code both sides display for comparison
+func (s *Secret) Code() string {
+	return s.code
+}
+
+// Seal encrypts a configuration for the joiner
+func (s *Secret) Seal(content []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(s.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(content)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, content, nil), nil
+}
+
+// Open decrypts a configuration sealed by the server
+func (s *Secret) Open(sealed []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(s.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed configuration too short")
+	}
+	content, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt configuration: %w", err)
+	}
+	return content, nil
+}
@@ -0,0 +1,203 @@
+package pairing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestTTL is how long a pairing request waits for approval and delivery
+const RequestTTL = 10 * time.Minute
+
+// joinTimeout is how long a started request waits for the joiner's key
+const joinTimeout = 30 * time.Second
+
+// maxPending bounds the requests awaiting a decision, so a peer cannot
+// flood the operator with prompts to guess a matching code
+const maxPending = 4
+
+// Request is a pairing request awaiting a decision
+type Request struct {
+	ID     string
+	Code   string
+	Remote string
+}
+
+// ApproveFunc decides a request. It is called once per request, from its
+// own goroutine.
+type ApproveFunc func(request Request) bool
+
+// Server answers pairing requests with a sealed configuration
+type Server struct {
+	config  func() ([]byte, error)
+	approve ApproveFunc
+
+	access  sync.Mutex
+	pending map[string]*pendingRequest
+}
+
+type pendingRequest struct {
+	key      *Key
+	secret   *Secret // Set once the joiner sent its key
+	created  time.Time
+	decided  bool
+	approved bool
+}
+
+type startResponse struct {
+	ID         string `json:"id"`
+	Commitment []byte `json:"commitment"`
+}
+
+type joinRequest struct {
+	PublicKey []byte `json:"public_key"`
+}
+
+type joinResponse struct {
+	PublicKey []byte `json:"public_key"`
+}
+
+type deliveryResponse struct {
+	Config []byte `json:"config"`
+}
+
+// NewServer creates a pairing server. config returns the configuration
+// delivered to approved joiners.
+func NewServer(config func() ([]byte, error), approve ApproveFunc) *Server {
+	return &Server{
+		config:  config,
+		approve: approve,
+		pending: make(map[string]*pendingRequest),
+	}
+}
+
+// ServeHTTP handles POST /pair (start, answered with the commitment),
+// POST /pair/<id> (the joiner's key, answered with the server's) and
+// GET /pair/<id> (poll)
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/pair":
+		s.handleStart(w)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/pair/"):
+		s.handleJoin(w, r, strings.TrimPrefix(r.URL.Path, "/pair/"))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/pair/"):
+		s.handlePoll(w, strings.TrimPrefix(r.URL.Path, "/pair/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) handleStart(w http.ResponseWriter) {
+	key, err := NewKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+
+	s.access.Lock()
+	s.sweep()
+	if len(s.pending) >= maxPending {
+		s.access.Unlock()
+		http.Error(w, "too many pairing requests pending", http.StatusTooManyRequests)
+		return
+	}
+	s.pending[id] = &pendingRequest{key: key, created: time.Now()}
+	s.access.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(startResponse{ID: id, Commitment: Commitment(key.PublicKey())})
+}
+
+// handleJoin takes the key of the joiner, once per request, and reveals the
+// key of the server committed to in handleStart
+func (s *Server) handleJoin(w http.ResponseWriter, r *http.Request, id string) {
+	var request joinRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.access.Lock()
+	p, ok := s.pending[id]
+	if !ok || time.Since(p.created) > joinTimeout {
+		s.access.Unlock()
+		http.Error(w, "unknown or expired pairing request", http.StatusNotFound)
+		return
+	}
+	if p.secret != nil {
+		s.access.Unlock()
+		http.Error(w, "pairing request already joined", http.StatusConflict)
+		return
+	}
+	secret, err := p.key.Derive(request.PublicKey, request.PublicKey, p.key.PublicKey())
+	if err != nil {
+		s.access.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.secret = secret
+	s.access.Unlock()
+
+	go func() {
+		approved := s.approve(Request{ID: id, Code: secret.Code(), Remote: r.RemoteAddr})
+		s.access.Lock()
+		if p, ok := s.pending[id]; ok {
+			p.decided = true
+			p.approved = approved
+		}
+		s.access.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(joinResponse{PublicKey: p.key.PublicKey()})
+}
+
+func (s *Server) handlePoll(w http.ResponseWriter, id string) {
+	s.access.Lock()
+	p, ok := s.pending[id]
+	if ok && p.decided {
+		// A decision is delivered once
+		delete(s.pending, id)
+	}
+	s.access.Unlock()
+	switch {
+	case !ok || time.Since(p.created) > RequestTTL:
+		http.Error(w, "unknown or expired pairing request", http.StatusNotFound)
+		return
+	case p.secret == nil:
+		http.Error(w, "pairing request not joined", http.StatusConflict)
+		return
+	case !p.decided:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	case !p.approved:
+		http.Error(w, "pairing rejected", http.StatusForbidden)
+		return
+	}
+	content, err := s.config()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sealed, err := p.secret.Seal(content)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveryResponse{Config: sealed})
+}
+
+func (s *Server) sweep() {
+	for id, p := range s.pending {
+		if time.Since(p.created) > RequestTTL || p.secret == nil && time.Since(p.created) > joinTimeout {
+			delete(s.pending, id)
+		}
+	}
+}
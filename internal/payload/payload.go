@@ -0,0 +1,229 @@
+// Package payload renders the request payloads of HTTP injector tools, sent
+// ahead of a tunnel to get it past proxies and firewalls that only let HTTP
+// through, such as
+//
+//	CONNECT [host_port] HTTP/1.1[crlf]Host: cdn.example.com[crlf][crlf]
+//
+// Tokens in square brackets are replaced when the payload is rendered. Other
+// bracketed text, such as an IPv6 address, is kept as is, but a bracketed
+// word that is not a token is refused as a likely typo.
+//
+//	[host] [port] [host_port]   the server the tunnel reaches
+//	[crlf] [cr] [lf]            line breaks
+//	[ua]                        a browser User-Agent
+//	[raw] [netdata]             CONNECT [host_port] HTTP/1.1
+//	[split] [instant_split]     end the write here: what follows goes out in a new one
+//	[delay] [delay_split]       end the write and wait a second before the next
+//	[delay=500ms]               end the write and wait the given duration
+//	[rotate=a;b;c]              a, b and c in turn, one per rendering
+package payload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDelay is the wait of [delay] and [delay_split]
+const DefaultDelay = time.Second
+
+// DefaultUserAgent is the User-Agent of [ua], that of a desktop Chrome
+const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
+
+// token matches the bracketed words that may be tokens
+var token = regexp.MustCompile(`\[([a-zA-Z_]+)(?:=([^\]]*))?\]`)
+
+// Vars are the values of the tokens naming the server
+type Vars struct {
+	Host      string
+	Port      int
+	UserAgent string // Default DefaultUserAgent
+}
+
+// Chunk is one write of a rendered payload
+type Chunk struct {
+	Delay time.Duration // Waited before writing Data
+	Data  []byte
+}
+
+// Template is a parsed payload. It is safe for concurrent use; renderings
+// advance the rotations in turn.
+type Template struct {
+	parts    []part
+	rotation atomic.Uint64
+}
+
+type partKind int
+
+const (
+	partText partKind = iota
+	partHost
+	partPort
+	partHostPort
+	partUserAgent
+	partSplit
+	partRotate
+)
+
+type part struct {
+	kind    partKind
+	text    string
+	delay   time.Duration // Of partSplit
+	choices []string      // Of partRotate
+}
+
+// Parse checks template and returns it parsed. Unknown tokens are errors,
+// since a misspelled one would be sent as is.
+func Parse(template string) (*Template, error) {
+	t := &Template{}
+	rest := template
+	for {
+		location := token.FindStringSubmatchIndex(rest)
+		if location == nil {
+			t.text(rest)
+			return t, nil
+		}
+		t.text(rest[:location[0]])
+		name := strings.ToLower(rest[location[2]:location[3]])
+		hasValue := location[4] >= 0
+		var value string
+		if hasValue {
+			value = rest[location[4]:location[5]]
+		}
+		raw := rest[location[0]:location[1]]
+		rest = rest[location[1]:]
+
+		switch name {
+		case "host", "port", "host_port", "crlf", "cr", "lf", "ua", "raw", "netdata", "split", "instant_split", "delay_split":
+			if hasValue {
+				return nil, fmt.Errorf("payload token %s takes no value", raw)
+			}
+		}
+		switch name {
+		case "host":
+			t.parts = append(t.parts, part{kind: partHost})
+		case "port":
+			t.parts = append(t.parts, part{kind: partPort})
+		case "host_port":
+			t.parts = append(t.parts, part{kind: partHostPort})
+		case "crlf":
+			t.text("\r\n")
+		case "cr":
+			t.text("\r")
+		case "lf":
+			t.text("\n")
+		case "ua":
+			t.parts = append(t.parts, part{kind: partUserAgent})
+		case "raw", "netdata":
+			t.text("CONNECT ")
+			t.parts = append(t.parts, part{kind: partHostPort})
+			t.text(" HTTP/1.1")
+		case "split", "instant_split":
+			t.parts = append(t.parts, part{kind: partSplit})
+		case "delay_split":
+			t.parts = append(t.parts, part{kind: partSplit, delay: DefaultDelay})
+		case "delay":
+			delay := DefaultDelay
+			if hasValue {
+				var err error
+				delay, err = time.ParseDuration(value)
+				if err != nil || delay < 0 {
+					return nil, fmt.Errorf("invalid payload delay %s", raw)
+				}
+			}
+			t.parts = append(t.parts, part{kind: partSplit, delay: delay})
+		case "rotate":
+			if !hasValue || value == "" {
+				return nil, fmt.Errorf("payload token %s needs values, as in [rotate=a;b]", raw)
+			}
+			t.parts = append(t.parts, part{kind: partRotate, choices: strings.Split(value, ";")})
+		default:
+			return nil, fmt.Errorf("unknown payload token %s", raw)
+		}
+	}
+}
+
+func (t *Template) text(text string) {
+	if text == "" {
+		return
+	}
+	if last := len(t.parts) - 1; last >= 0 && t.parts[last].kind == partText {
+		t.parts[last].text += text
+		return
+	}
+	t.parts = append(t.parts, part{kind: partText, text: text})
+}
+
+// Render returns the writes of the payload for vars. Rotations take their
+// next value on every rendering.
+func (t *Template) Render(vars Vars) []Chunk {
+	if vars.UserAgent == "" {
+		vars.UserAgent = DefaultUserAgent
+	}
+	turn := t.rotation.Add(1) - 1
+	var chunks []Chunk
+	var current Chunk
+	for _, p := range t.parts {
+		switch p.kind {
+		case partText:
+			current.Data = append(current.Data, p.text...)
+		case partHost:
+			current.Data = append(current.Data, vars.Host...)
+		case partPort:
+			current.Data = strconv.AppendInt(current.Data, int64(vars.Port), 10)
+		case partHostPort:
+			current.Data = append(current.Data, net.JoinHostPort(vars.Host, strconv.Itoa(vars.Port))...)
+		case partUserAgent:
+			current.Data = append(current.Data, vars.UserAgent...)
+		case partRotate:
+			current.Data = append(current.Data, p.choices[turn%uint64(len(p.choices))]...)
+		case partSplit:
+			if len(current.Data) > 0 {
+				chunks = append(chunks, current)
+				current = Chunk{}
+			}
+			// Consecutive splits add up their delays
+			current.Delay += p.delay
+		}
+	}
+	if len(current.Data) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+// Text renders the payload for vars as one string, without its splits and
+// delays, for templates inside a request line or header value
+func (t *Template) Text(vars Vars) string {
+	var text strings.Builder
+	for _, chunk := range t.Render(vars) {
+		text.Write(chunk.Data)
+	}
+	return text.String()
+}
+
+// Write renders the payload for vars and writes it to w, one write per
+// chunk, waiting the delays in between
+func (t *Template) Write(ctx context.Context, w io.Writer, vars Vars) error {
+	for _, chunk := range t.Render(vars) {
+		if chunk.Delay > 0 {
+			timer := time.NewTimer(chunk.Delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
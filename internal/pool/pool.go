@@ -0,0 +1,199 @@
+// Package pool keeps connections of an outbound ready before they are
+// needed, so a dial takes an established, handshaken connection instead of
+// paying the round trips of a new one. Connections idle for longer than the
+// idle timeout are closed, as servers and middleboxes drop quiet
+// connections, and replaced.
+package pool
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+const (
+	// DefaultIdleTimeout is the time a ready connection is kept unused
+	DefaultIdleTimeout = 30 * time.Second
+	dialTimeout        = 30 * time.Second
+	minBackoff         = time.Second
+	maxBackoff         = time.Minute
+)
+
+// PoolOptions is embedded by extension outbound options
+type PoolOptions struct {
+	PoolSize        int                `json:"pool_size,omitempty"`         // Connections kept ready (0 = no pool)
+	PoolIdleTimeout badoption.Duration `json:"pool_idle_timeout,omitempty"` // Before an unused connection is replaced (default 30s)
+}
+
+// DialFunc opens a connection to be kept ready
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// Pool keeps up to PoolOptions.PoolSize connections ready. A nil Pool keeps
+// none.
+type Pool struct {
+	size   int
+	idle   time.Duration
+	dial   DialFunc
+	ctx    context.Context
+	cancel context.CancelFunc
+	refill chan struct{}
+
+	access sync.Mutex
+	ready  []entry // Oldest first
+}
+
+// entry is a ready connection and the time it became ready
+type entry struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// New returns a pool filled with dial, or nil when no pool is configured.
+// Filling begins with Start.
+func New(opts PoolOptions, dial DialFunc) *Pool {
+	if opts.PoolSize <= 0 {
+		return nil
+	}
+	idle := time.Duration(opts.PoolIdleTimeout)
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{
+		size:   opts.PoolSize,
+		idle:   idle,
+		dial:   dial,
+		ctx:    ctx,
+		cancel: cancel,
+		refill: make(chan struct{}, 1),
+	}
+}
+
+// Start begins filling the pool
+func (p *Pool) Start() {
+	if p == nil {
+		return
+	}
+	go p.loop()
+}
+
+// Close closes the ready connections and stops filling the pool
+func (p *Pool) Close() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.access.Lock()
+	defer p.access.Unlock()
+	for _, e := range p.ready {
+		e.conn.Close()
+	}
+	p.ready = nil
+}
+
+// Get returns a ready connection, the most recent one, or nil when none is
+// ready. The pool is refilled in the background.
+func (p *Pool) Get() net.Conn {
+	if p == nil {
+		return nil
+	}
+	p.access.Lock()
+	p.evict()
+	var conn net.Conn
+	if n := len(p.ready); n > 0 {
+		conn = p.ready[n-1].conn
+		p.ready = p.ready[:n-1]
+	}
+	p.access.Unlock()
+	p.wake()
+	return conn
+}
+
+// Ready returns the number of connections ready
+func (p *Pool) Ready() int {
+	if p == nil {
+		return 0
+	}
+	p.access.Lock()
+	defer p.access.Unlock()
+	return len(p.ready)
+}
+
+func (p *Pool) wake() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// evict closes the connections idle for longer than the idle timeout;
+// access must be held
+func (p *Pool) evict() {
+	cutoff := time.Now().Add(-p.idle)
+	var expired int
+	for expired < len(p.ready) && p.ready[expired].since.Before(cutoff) {
+		p.ready[expired].conn.Close()
+		expired++
+	}
+	p.ready = p.ready[expired:]
+}
+
+// loop tops the pool up when woken and when connections expire, backing off
+// while dials fail
+func (p *Pool) loop() {
+	ticker := time.NewTicker(p.idle / 4)
+	defer ticker.Stop()
+	backoff := minBackoff
+	for {
+		if p.fill() {
+			backoff = minBackoff
+		} else {
+			select {
+			case <-time.After(backoff):
+			case <-p.ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		select {
+		case <-ticker.C:
+			p.access.Lock()
+			p.evict()
+			p.access.Unlock()
+		case <-p.refill:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// fill dials until the pool is full, and reports whether every dial
+// succeeded
+func (p *Pool) fill() bool {
+	for {
+		p.access.Lock()
+		missing := p.size - len(p.ready)
+		p.access.Unlock()
+		if missing <= 0 || p.ctx.Err() != nil {
+			return true
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, dialTimeout)
+		conn, err := p.dial(ctx)
+		cancel()
+		if err != nil {
+			return p.ctx.Err() != nil
+		}
+		p.access.Lock()
+		if p.ctx.Err() != nil {
+			p.access.Unlock()
+			conn.Close()
+			return true
+		}
+		p.ready = append(p.ready, entry{conn: conn, since: time.Now()})
+		p.access.Unlock()
+	}
+}
@@ -0,0 +1,48 @@
+package porthop
+
+import (
+	"net"
+	"net/netip"
+)
+
+// PacketConn rewrites the destination port of outgoing datagrams according
+// to a Schedule and accepts replies from any port in the schedule, reporting
+// them as coming from the configured server address.
+type PacketConn struct {
+	net.PacketConn
+	server   netip.AddrPort
+	schedule *Schedule
+}
+
+// NewPacketConn wraps pc so that datagrams to server follow the hop schedule
+func NewPacketConn(pc net.PacketConn, server netip.AddrPort, schedule *Schedule) *PacketConn {
+	return &PacketConn{
+		PacketConn: pc,
+		server:     netip.AddrPortFrom(server.Addr().Unmap(), server.Port()),
+		schedule:   schedule,
+	}
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && c.isServer(udpAddr) {
+		addr = &net.UDPAddr{IP: udpAddr.IP, Port: int(c.schedule.Current()), Zone: udpAddr.Zone}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && c.isServer(udpAddr) && c.schedule.Contains(uint16(udpAddr.Port)) {
+		// Present a stable remote address to the protocol above
+		addr = net.UDPAddrFromAddrPort(c.server)
+	}
+	return n, addr, nil
+}
+
+func (c *PacketConn) isServer(addr *net.UDPAddr) bool {
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	return ok && ip.Unmap() == c.server.Addr()
+}
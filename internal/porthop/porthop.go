@@ -0,0 +1,145 @@
+// Package porthop implements Hysteria2-style destination port hopping for
+// UDP-based outbounds. Client and server derive the active port from the
+// current time slot and a shared key, so both sides agree on the schedule
+// without any signalling.
+package porthop
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/clock"
+)
+
+// DefaultInterval is used when hopping is enabled without an explicit interval
+const DefaultInterval = 30 * time.Second
+
+// Options is embedded by UDP-based outbound options to enable port hopping
+type Options struct {
+	HopPorts    string             `json:"hop_ports,omitempty"`    // Port list/ranges, e.g. "20000-30000,443"
+	HopInterval badoption.Duration `json:"hop_interval,omitempty"` // Time between hops (default 30s)
+	HopKey      string             `json:"hop_key,omitempty"`      // Shared key synchronizing the schedule with the server
+}
+
+// Enabled reports whether port hopping is configured
+func (o Options) Enabled() bool {
+	return o.HopPorts != ""
+}
+
+// Schedule maps time slots to destination ports
+type Schedule struct {
+	ports    []uint16
+	interval time.Duration
+	key      []byte
+}
+
+// NewSchedule builds a schedule from the given options
+func NewSchedule(opts Options) (*Schedule, error) {
+	ports, err := ParsePorts(opts.HopPorts)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(opts.HopInterval)
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	if interval < time.Second {
+		return nil, fmt.Errorf("hop interval must be at least 1s")
+	}
+	return &Schedule{
+		ports:    ports,
+		interval: interval,
+		key:      []byte(opts.HopKey),
+	}, nil
+}
+
+// Interval returns the hop interval
+func (s *Schedule) Interval() time.Duration {
+	return s.interval
+}
+
+// Ports returns every port the schedule may select
+func (s *Schedule) Ports() []uint16 {
+	return s.ports
+}
+
+// PortAt returns the destination port active at time t
+func (s *Schedule) PortAt(t time.Time) uint16 {
+	if len(s.ports) == 1 {
+		return s.ports[0]
+	}
+	slot := uint64(t.Unix()) / uint64(s.interval/time.Second)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], slot)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(buf[:])
+	sum := mac.Sum(nil)
+	return s.ports[binary.BigEndian.Uint64(sum[:8])%uint64(len(s.ports))]
+}
+
+// Current returns the destination port active now, on the corrected clock
+func (s *Schedule) Current() uint16 {
+	return s.PortAt(clock.Now())
+}
+
+// Contains reports whether port belongs to the schedule
+func (s *Schedule) Contains(port uint16) bool {
+	for _, p := range s.ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePorts parses a comma separated list of ports and inclusive ranges
+func ParsePorts(spec string) ([]uint16, error) {
+	var ports []uint16
+	seen := make(map[uint16]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		start, end, isRange := strings.Cut(part, "-")
+		first, err := parsePort(start)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			last, err = parsePort(end)
+			if err != nil {
+				return nil, err
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid port range: %s", part)
+			}
+		}
+		for p := uint32(first); p <= uint32(last); p++ {
+			if !seen[uint16(p)] {
+				seen[uint16(p)] = true
+				ports = append(ports, uint16(p))
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("empty hop port list")
+	}
+	return ports, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return uint16(n), nil
+}
@@ -0,0 +1,107 @@
+package pppauth
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EAP method types, RFC 3748 section 5 and the IANA registry
+const (
+	eapIdentity     = 1
+	eapNotification = 2
+	eapNak          = 3
+	eapMD5          = 4
+	eapMSCHAPv2     = 26
+)
+
+// EAP-MS-CHAPv2 op codes, draft-kamath-pppext-eap-mschapv2
+const (
+	mschapChallenge = 1
+	mschapResponse  = 2
+	mschapSuccess   = 3
+	mschapFailure   = 4
+)
+
+func (c *Client) handleEAP(p packet) ([]byte, error) {
+	switch p.code {
+	case codeSuccess:
+		// EAP-MS-CHAPv2 already checked the server in its own success
+		// message; EAP-MD5 does not authenticate the server
+		return nil, c.finish(nil)
+	case codeFailure:
+		if c.rejection != "" {
+			return nil, c.finish(fmt.Errorf("rejected: %s", failureMessage(c.rejection)))
+		}
+		return nil, c.finish(fmt.Errorf("rejected"))
+	case codeRequest:
+	default:
+		return nil, fmt.Errorf("unexpected EAP code: %d", p.code)
+	}
+	if len(p.data) < 1 {
+		return nil, fmt.Errorf("EAP request without type")
+	}
+	typeData := p.data[1:]
+	switch p.data[0] {
+	case eapIdentity:
+		return eapReply(p.identifier, eapIdentity, []byte(c.creds.Username)), nil
+	case eapNotification:
+		return eapReply(p.identifier, eapNotification, nil), nil
+	case eapMD5:
+		if len(typeData) < 1 || int(typeData[0]) > len(typeData)-1 {
+			return nil, fmt.Errorf("invalid EAP-MD5 challenge")
+		}
+		value := md5Response(p.identifier, c.creds.Password, typeData[1:1+typeData[0]])
+		return eapReply(p.identifier, eapMD5, append([]byte{byte(len(value))}, value...)), nil
+	case eapMSCHAPv2:
+		return c.handleEAPMSCHAPv2(p.identifier, typeData)
+	default:
+		// Legacy Nak proposing the methods of this client
+		return eapReply(p.identifier, eapNak, []byte{eapMSCHAPv2, eapMD5}), nil
+	}
+}
+
+// handleEAPMSCHAPv2 handles an EAP-MS-CHAPv2 request: the MS-CHAPv2
+// packets with an op code in place of the CHAP code
+func (c *Client) handleEAPMSCHAPv2(identifier byte, data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, fmt.Errorf("EAP-MS-CHAPv2 request without op code")
+	}
+	switch data[0] {
+	case mschapChallenge:
+		// Op code, MS-CHAPv2-ID, MS-Length, Value-Size, Challenge, Name
+		if len(data) < 5 || int(data[4]) > len(data)-5 {
+			return nil, fmt.Errorf("invalid EAP-MS-CHAPv2 challenge")
+		}
+		value, err := c.mschapv2Response(data[5 : 5+data[4]])
+		if err != nil {
+			return nil, err
+		}
+		response := []byte{mschapResponse, data[1], 0, 0, byte(len(value))}
+		response = append(response, value...)
+		response = append(response, c.creds.Username...)
+		binary.BigEndian.PutUint16(response[2:], uint16(len(response)))
+		return eapReply(identifier, eapMSCHAPv2, response), nil
+	case mschapSuccess:
+		// Op code, MS-CHAPv2-ID, MS-Length, Message; EAP Success follows
+		// the acknowledgement
+		if len(data) < 4 {
+			return nil, fmt.Errorf("invalid EAP-MS-CHAPv2 success")
+		}
+		if c.ntResponse == nil || !CheckAuthenticatorResponse(string(data[4:]), c.authenticator) {
+			return nil, c.finish(fmt.Errorf("server failed to authenticate"))
+		}
+		c.sendKey, c.receiveKey = MPPEKeys(c.creds.Password, c.ntResponse)
+		return eapReply(identifier, eapMSCHAPv2, []byte{mschapSuccess}), nil
+	case mschapFailure:
+		if len(data) >= 4 {
+			c.rejection = string(data[4:])
+		}
+		// Acknowledge, so the authenticator sends EAP Failure
+		return eapReply(identifier, eapMSCHAPv2, []byte{mschapFailure}), nil
+	}
+	return nil, fmt.Errorf("unexpected EAP-MS-CHAPv2 op code: %d", data[0])
+}
+
+func eapReply(identifier byte, eapType byte, data []byte) []byte {
+	return packet{code: codeResponse, identifier: identifier, data: append([]byte{eapType}, data...)}.marshal()
+}
@@ -0,0 +1,154 @@
+package pppauth
+
+import (
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// MS-CHAPv2 value lengths, from RFC 2759
+const (
+	challengeLength  = 16
+	ntResponseLength = 24
+	// responseLength is the Response value: Peer-Challenge, 8 reserved
+	// bytes, NT-Response and Flags
+	responseLength = challengeLength + 8 + ntResponseLength + 1
+)
+
+// Magic constants of GenerateAuthenticatorResponse, RFC 2759 section 8.7
+var (
+	authMagic1 = []byte("Magic server to client signing constant")
+	authMagic2 = []byte("Pad to make it do more than one iteration")
+)
+
+// Magic constants of the MPPE key derivation, RFC 3079 section 3.4
+var (
+	keyMagic1 = []byte("This is the MPPE Master Key")
+	keyMagic2 = []byte("On the client side, this is the send key; on the server side, it is the receive key.")
+	keyMagic3 = []byte("On the client side, this is the receive key; on the server side, it is the send key.")
+	shsPad1   = make([]byte, 40)
+	shsPad2   = []byte(strings.Repeat("\xf2", 40))
+)
+
+// ChallengeHash returns the 8-byte challenge the NT-Response answers, RFC
+// 2759 section 8.2. The username is stripped of any domain.
+func ChallengeHash(peerChallenge, authenticatorChallenge []byte, username string) []byte {
+	if _, user, found := strings.Cut(username, `\`); found {
+		username = user
+	}
+	h := sha1.New()
+	h.Write(peerChallenge)
+	h.Write(authenticatorChallenge)
+	h.Write([]byte(username))
+	return h.Sum(nil)[:8]
+}
+
+// NTPasswordHash returns the MD4 of the UTF-16LE password, RFC 2759
+// section 8.3
+func NTPasswordHash(password string) []byte {
+	h := md4.New()
+	h.Write(utf16le(password))
+	return h.Sum(nil)
+}
+
+// GenerateNTResponse returns the 24-byte NT-Response, RFC 2759 section 8.1
+func GenerateNTResponse(authenticatorChallenge, peerChallenge []byte, username, password string) []byte {
+	challenge := ChallengeHash(peerChallenge, authenticatorChallenge, username)
+	return challengeResponse(challenge, NTPasswordHash(password))
+}
+
+// GenerateAuthenticatorResponse returns the "S=" message the authenticator
+// sends on success, RFC 2759 section 8.7
+func GenerateAuthenticatorResponse(password string, ntResponse, peerChallenge, authenticatorChallenge []byte, username string) string {
+	passwordHashHash := md4.New()
+	passwordHashHash.Write(NTPasswordHash(password))
+
+	h := sha1.New()
+	h.Write(passwordHashHash.Sum(nil))
+	h.Write(ntResponse)
+	h.Write(authMagic1)
+	digest := h.Sum(nil)
+
+	h = sha1.New()
+	h.Write(digest)
+	h.Write(ChallengeHash(peerChallenge, authenticatorChallenge, username))
+	h.Write(authMagic2)
+	return "S=" + strings.ToUpper(hex.EncodeToString(h.Sum(nil)))
+}
+
+// CheckAuthenticatorResponse reports whether the success message of the
+// authenticator starts with the expected "S=" response, RFC 2759 section
+// 8.8. It authenticates the server to the client.
+func CheckAuthenticatorResponse(message string, expected string) bool {
+	if len(message) < len(expected) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.ToUpper(message[:len(expected)])), []byte(expected)) == 1
+}
+
+// MPPEKeys returns the 16-byte MPPE send and receive keys of the client
+// after an MS-CHAPv2 authentication, RFC 3079 section 3
+func MPPEKeys(password string, ntResponse []byte) (send, receive []byte) {
+	passwordHashHash := md4.New()
+	passwordHashHash.Write(NTPasswordHash(password))
+
+	h := sha1.New()
+	h.Write(passwordHashHash.Sum(nil))
+	h.Write(ntResponse)
+	h.Write(keyMagic1)
+	masterKey := h.Sum(nil)[:16]
+	return asymmetricStartKey(masterKey, keyMagic2), asymmetricStartKey(masterKey, keyMagic3)
+}
+
+func asymmetricStartKey(masterKey, magic []byte) []byte {
+	h := sha1.New()
+	h.Write(masterKey)
+	h.Write(shsPad1)
+	h.Write(magic)
+	h.Write(shsPad2)
+	return h.Sum(nil)[:16]
+}
+
+// challengeResponse encrypts challenge with the three DES keys cut from the
+// zero-padded password hash, RFC 2759 section 8.5
+func challengeResponse(challenge, passwordHash []byte) []byte {
+	var padded [21]byte
+	copy(padded[:], passwordHash)
+	response := make([]byte, 0, ntResponseLength)
+	for i := 0; i < 3; i++ {
+		block, _ := des.NewCipher(desKey(padded[i*7 : i*7+7]))
+		var out [8]byte
+		block.Encrypt(out[:], challenge)
+		response = append(response, out[:]...)
+	}
+	return response
+}
+
+// desKey spreads 7 key bytes over the 8 bytes of a DES key, leaving the
+// parity bits clear as DES ignores them
+func desKey(key []byte) []byte {
+	var v uint64
+	for _, b := range key {
+		v = v<<8 | uint64(b)
+	}
+	out := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		out[i] = byte(v>>(49-7*i)) << 1
+	}
+	return out
+}
+
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], unit)
+	}
+	return b
+}
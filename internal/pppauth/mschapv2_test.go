@@ -0,0 +1,72 @@
+package pppauth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors of RFC 2759 section 9.2 and RFC 3079 section 3.5.3
+const (
+	testUsername = "User"
+	testPassword = "clientPass"
+)
+
+var (
+	testAuthenticatorChallenge = mustHex("5B5D7C7D7B3F2F3E3C2C602132262628")
+	testPeerChallenge          = mustHex("21402324255E262A28295F2B3A337C7E")
+	testNTResponse             = mustHex("82309ECD8D708B5EA08FAA3981CD83544233114A3D85D6DF")
+)
+
+func mustHex(s string) []byte {
+	content, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return content
+}
+
+func TestChallengeHash(t *testing.T) {
+	got := ChallengeHash(testPeerChallenge, testAuthenticatorChallenge, testUsername)
+	if want := mustHex("D02E4386BCE91226"); !bytes.Equal(got, want) {
+		t.Fatalf("ChallengeHash = %X, want %X", got, want)
+	}
+}
+
+func TestNTPasswordHash(t *testing.T) {
+	got := NTPasswordHash(testPassword)
+	if want := mustHex("44EBBA8D5312B8D611474411F56989AE"); !bytes.Equal(got, want) {
+		t.Fatalf("NTPasswordHash = %X, want %X", got, want)
+	}
+}
+
+func TestGenerateNTResponse(t *testing.T) {
+	got := GenerateNTResponse(testAuthenticatorChallenge, testPeerChallenge, testUsername, testPassword)
+	if !bytes.Equal(got, testNTResponse) {
+		t.Fatalf("GenerateNTResponse = %X, want %X", got, testNTResponse)
+	}
+}
+
+func TestAuthenticatorResponse(t *testing.T) {
+	const want = "S=407A5589115FD0D6209F510FE9C04566932CDA56"
+	got := GenerateAuthenticatorResponse(testPassword, testNTResponse, testPeerChallenge, testAuthenticatorChallenge, testUsername)
+	if got != want {
+		t.Fatalf("GenerateAuthenticatorResponse = %s, want %s", got, want)
+	}
+	if !CheckAuthenticatorResponse(want+" M=Access granted", got) {
+		t.Fatal("CheckAuthenticatorResponse rejected the expected response")
+	}
+	if CheckAuthenticatorResponse("S=0000000000000000000000000000000000000000", got) {
+		t.Fatal("CheckAuthenticatorResponse accepted another response")
+	}
+}
+
+func TestMPPEKeys(t *testing.T) {
+	send, receive := MPPEKeys(testPassword, testNTResponse)
+	if want := mustHex("8B7CDC149B993A1BA118CB153F56DCCB"); !bytes.Equal(receive, want) {
+		t.Fatalf("receive key = %X, want %X", receive, want)
+	}
+	if want := mustHex("D5F0E9521E3EA9589645E86051C82226"); !bytes.Equal(send, want) {
+		t.Fatalf("send key = %X, want %X", send, want)
+	}
+}
@@ -0,0 +1,353 @@
+// Package pppauth implements the client side of the PPP authentication
+// protocols negotiated by L2TP, PPTP and SSTP links: PAP (RFC 1334), CHAP
+// with MD5 (RFC 1994), MS-CHAPv2 (RFC 2759) and EAP (RFC 3748) with the
+// MD5-Challenge and MS-CHAPv2 methods. The link layer negotiates the method
+// in LCP, then passes the packets of the authentication protocol to a
+// Client until it is done.
+package pppauth
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/UTPBox/utp-core/internal/failure"
+)
+
+// PPP protocol numbers of the authentication protocols
+const (
+	ProtocolPAP  uint16 = 0xc023
+	ProtocolCHAP uint16 = 0xc223
+	ProtocolEAP  uint16 = 0xc227
+)
+
+// CHAP algorithms of the LCP Authentication-Protocol option
+const (
+	algorithmMD5      = 5
+	algorithmMSCHAPv2 = 0x81
+)
+
+// Method is an authentication method negotiated in LCP
+type Method int
+
+const (
+	MethodPAP Method = iota + 1
+	MethodCHAPMD5
+	MethodMSCHAPv2
+	MethodEAP
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodPAP:
+		return "PAP"
+	case MethodCHAPMD5:
+		return "CHAP-MD5"
+	case MethodMSCHAPv2:
+		return "MS-CHAPv2"
+	case MethodEAP:
+		return "EAP"
+	}
+	return fmt.Sprint("method ", int(m))
+}
+
+// Protocol returns the PPP protocol carrying m
+func (m Method) Protocol() uint16 {
+	switch m {
+	case MethodPAP:
+		return ProtocolPAP
+	case MethodEAP:
+		return ProtocolEAP
+	}
+	return ProtocolCHAP
+}
+
+// MethodFromLCP returns the method of the data of an LCP
+// Authentication-Protocol option: the protocol and, for CHAP, the algorithm
+func MethodFromLCP(data []byte) (Method, error) {
+	if len(data) < 2 {
+		return 0, fmt.Errorf("authentication protocol option too short")
+	}
+	switch protocol := binary.BigEndian.Uint16(data); protocol {
+	case ProtocolPAP:
+		return MethodPAP, nil
+	case ProtocolEAP:
+		return MethodEAP, nil
+	case ProtocolCHAP:
+		if len(data) < 3 {
+			return 0, fmt.Errorf("CHAP option without algorithm")
+		}
+		switch data[2] {
+		case algorithmMD5:
+			return MethodCHAPMD5, nil
+		case algorithmMSCHAPv2:
+			return MethodMSCHAPv2, nil
+		}
+		return 0, fmt.Errorf("unsupported CHAP algorithm: %#x", data[2])
+	default:
+		return 0, fmt.Errorf("unsupported authentication protocol: %#04x", protocol)
+	}
+}
+
+// LCPOption returns the data of the LCP Authentication-Protocol option
+// requesting m
+func (m Method) LCPOption() []byte {
+	data := binary.BigEndian.AppendUint16(nil, m.Protocol())
+	switch m {
+	case MethodCHAPMD5:
+		data = append(data, algorithmMD5)
+	case MethodMSCHAPv2:
+		data = append(data, algorithmMSCHAPv2)
+	}
+	return data
+}
+
+// Packet codes shared by PAP, CHAP and EAP
+const (
+	codeRequest  = 1 // PAP Authenticate-Request, CHAP Challenge, EAP Request
+	codeResponse = 2 // PAP Authenticate-Ack, CHAP Response, EAP Response
+	codeSuccess  = 3 // PAP Authenticate-Nak, CHAP and EAP Success
+	codeFailure  = 4 // CHAP and EAP Failure
+)
+
+// packet is the code, identifier and data of a PAP, CHAP or EAP packet
+type packet struct {
+	code       byte
+	identifier byte
+	data       []byte
+}
+
+func parsePacket(b []byte) (packet, error) {
+	if len(b) < 4 {
+		return packet{}, fmt.Errorf("packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length < 4 || length > len(b) {
+		return packet{}, fmt.Errorf("invalid packet length: %d", length)
+	}
+	return packet{code: b[0], identifier: b[1], data: b[4:length]}, nil
+}
+
+func (p packet) marshal() []byte {
+	b := make([]byte, 4, 4+len(p.data))
+	b[0] = p.code
+	b[1] = p.identifier
+	binary.BigEndian.PutUint16(b[2:], uint16(4+len(p.data)))
+	return append(b, p.data...)
+}
+
+// Credentials authenticate the client
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// ErrNotDone is returned by Client.Result while authentication is running
+var ErrNotDone = errors.New("authentication not done")
+
+// Client authenticates a PPP link with the method negotiated in LCP. It is
+// not safe for concurrent use.
+type Client struct {
+	method Method
+	creds  Credentials
+	done   bool
+	err    error
+
+	// MS-CHAPv2 state
+	ntResponse    []byte
+	authenticator string // Expected "S=" message
+	rejection     string // EAP-MS-CHAPv2 failure message, reported on EAP Failure
+	sendKey       []byte
+	receiveKey    []byte
+}
+
+// NewClient returns a client authenticating with method
+func NewClient(method Method, creds Credentials) (*Client, error) {
+	switch method {
+	case MethodPAP, MethodCHAPMD5, MethodMSCHAPv2, MethodEAP:
+	default:
+		return nil, fmt.Errorf("unsupported authentication method: %v", method)
+	}
+	return &Client{method: method, creds: creds}, nil
+}
+
+// Start returns the packet the client sends first: the PAP
+// Authenticate-Request, or nil for the methods where the authenticator
+// speaks first
+func (c *Client) Start() []byte {
+	if c.method != MethodPAP {
+		return nil
+	}
+	data := make([]byte, 0, 2+len(c.creds.Username)+len(c.creds.Password))
+	data = append(data, byte(len(c.creds.Username)))
+	data = append(data, c.creds.Username...)
+	data = append(data, byte(len(c.creds.Password)))
+	data = append(data, c.creds.Password...)
+	return packet{code: codeRequest, identifier: 1, data: data}.marshal()
+}
+
+// Handle processes a packet of protocol received from the authenticator and
+// returns the reply to send, or nil. Once the authenticator accepts or
+// rejects the client, Done reports true and Result the outcome; a rejection
+// is also returned as a failure.KindAuthFailed error.
+func (c *Client) Handle(protocol uint16, b []byte) ([]byte, error) {
+	if c.done {
+		return nil, nil
+	}
+	if protocol != c.method.Protocol() {
+		return nil, fmt.Errorf("unexpected protocol %#04x during %v", protocol, c.method)
+	}
+	p, err := parsePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	switch c.method {
+	case MethodPAP:
+		return nil, c.handlePAP(p)
+	case MethodCHAPMD5, MethodMSCHAPv2:
+		return c.handleCHAP(p)
+	default:
+		return c.handleEAP(p)
+	}
+}
+
+// Done reports whether the authenticator accepted or rejected the client
+func (c *Client) Done() bool {
+	return c.done
+}
+
+// Result returns nil when the client was accepted, the rejection otherwise,
+// and ErrNotDone until then
+func (c *Client) Result() error {
+	if !c.done {
+		return ErrNotDone
+	}
+	return c.err
+}
+
+// MPPEKeys returns the MPPE send and receive keys derived by a successful
+// MS-CHAPv2 authentication, directly or within EAP, or nil
+func (c *Client) MPPEKeys() (send, receive []byte) {
+	if !c.done || c.err != nil {
+		return nil, nil
+	}
+	return c.sendKey, c.receiveKey
+}
+
+// finish ends the authentication; a rejection is reported as
+// failure.KindAuthFailed
+func (c *Client) finish(err error) error {
+	c.done = true
+	if err != nil {
+		err = failure.New(failure.KindAuthFailed, failure.StageAuth, fmt.Errorf("%v: %w", c.method, err))
+	}
+	c.err = err
+	return err
+}
+
+func (c *Client) handlePAP(p packet) error {
+	switch p.code {
+	case codeResponse:
+		return c.finish(nil)
+	case codeSuccess: // Authenticate-Nak
+		return c.finish(fmt.Errorf("rejected: %s", papMessage(p.data)))
+	}
+	return fmt.Errorf("unexpected PAP code: %d", p.code)
+}
+
+// papMessage returns the message of an Authenticate-Ack or -Nak
+func papMessage(data []byte) string {
+	if len(data) == 0 || int(data[0]) > len(data)-1 {
+		return ""
+	}
+	return string(data[1 : 1+data[0]])
+}
+
+func (c *Client) handleCHAP(p packet) ([]byte, error) {
+	switch p.code {
+	case codeRequest:
+		if len(p.data) < 1 || int(p.data[0]) > len(p.data)-1 {
+			return nil, fmt.Errorf("invalid CHAP challenge")
+		}
+		challenge := p.data[1 : 1+p.data[0]]
+		value, err := c.chapResponse(p.identifier, challenge)
+		if err != nil {
+			return nil, err
+		}
+		data := append([]byte{byte(len(value))}, value...)
+		data = append(data, c.creds.Username...)
+		return packet{code: codeResponse, identifier: p.identifier, data: data}.marshal(), nil
+	case codeSuccess:
+		return nil, c.success(string(p.data))
+	case codeFailure:
+		return nil, c.finish(fmt.Errorf("rejected: %s", failureMessage(string(p.data))))
+	}
+	return nil, fmt.Errorf("unexpected CHAP code: %d", p.code)
+}
+
+// chapResponse returns the Response value to a challenge of the CHAP
+// algorithm of c
+func (c *Client) chapResponse(identifier byte, challenge []byte) ([]byte, error) {
+	if c.method == MethodCHAPMD5 {
+		return md5Response(identifier, c.creds.Password, challenge), nil
+	}
+	return c.mschapv2Response(challenge)
+}
+
+// md5Response is the CHAP MD5 response, RFC 1994 section 4.1
+func md5Response(identifier byte, secret string, challenge []byte) []byte {
+	h := md5.New()
+	h.Write([]byte{identifier})
+	h.Write([]byte(secret))
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// mschapv2Response returns the Response value to an authenticator
+// challenge and prepares the checks of the success message
+func (c *Client) mschapv2Response(challenge []byte) ([]byte, error) {
+	if len(challenge) != challengeLength {
+		return nil, fmt.Errorf("MS-CHAPv2 challenge is %d bytes, not %d", len(challenge), challengeLength)
+	}
+	peerChallenge := make([]byte, challengeLength)
+	if _, err := rand.Read(peerChallenge); err != nil {
+		return nil, err
+	}
+	c.ntResponse = GenerateNTResponse(challenge, peerChallenge, c.creds.Username, c.creds.Password)
+	c.authenticator = GenerateAuthenticatorResponse(c.creds.Password, c.ntResponse, peerChallenge, challenge, c.creds.Username)
+	value := make([]byte, 0, responseLength)
+	value = append(value, peerChallenge...)
+	value = append(value, make([]byte, 8)...)
+	value = append(value, c.ntResponse...)
+	return append(value, 0), nil
+}
+
+// success handles the success message of CHAP or EAP-MS-CHAPv2. MS-CHAPv2
+// authenticates the server as well: a success message without the expected
+// authenticator response is a failure.
+func (c *Client) success(message string) error {
+	if c.ntResponse == nil {
+		return c.finish(nil)
+	}
+	if !CheckAuthenticatorResponse(message, c.authenticator) {
+		return c.finish(fmt.Errorf("server failed to authenticate"))
+	}
+	c.sendKey, c.receiveKey = MPPEKeys(c.creds.Password, c.ntResponse)
+	return c.finish(nil)
+}
+
+// failureMessage returns the text of an MS-CHAPv2 failure message
+// ("E=691 R=0 C=... V=3 M=Authentication failure"), or message itself
+func failureMessage(message string) string {
+	text := message
+	if _, m, found := strings.Cut(message, "M="); found {
+		text = m
+	}
+	if code, _, _ := strings.Cut(message, " "); strings.HasPrefix(code, "E=") {
+		return text + " (error " + code[2:] + ")"
+	}
+	return text
+}
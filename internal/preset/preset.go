@@ -0,0 +1,353 @@
+// Package preset expands the route shorthands of utp-core configurations
+// into Sing-box route rules. Sing-box rejects unknown fields, so Extract
+// removes them before the configuration is parsed and Apply adds their rules
+// to the parsed options.
+//
+// route.time_bypass sends clock synchronization traffic around the tunnel: a
+// wrong clock breaks TLS, which breaks the tunnel, which keeps the clock from
+// being corrected.
+//
+// route.transport_rules picks the outbound by network and destination port,
+// since transports differ in what they carry: QUIC through WARP and TCP
+// through an SSH tunnel, for example.
+package preset
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing/common/json/badjson"
+	"github.com/sagernet/sing/common/json/badoption"
+
+	"github.com/UTPBox/utp-core/internal/capability"
+)
+
+// TimePorts are the ports of clock synchronization protocols: RFC 868 time
+// (37), NTP, SNTP and chrony (123), Roughtime (2002) and NTS key exchange
+// (4460)
+var TimePorts = []uint16{37, 123, 2002, 4460}
+
+// timeDirectTag is the outbound added by time_bypass: true when the
+// configuration has no direct outbound
+const timeDirectTag = "time-direct"
+
+// Networks of transport rules. quic is UDP sniffed as QUIC.
+const (
+	networkTCP  = "tcp"
+	networkUDP  = "udp"
+	networkQUIC = "quic"
+)
+
+// Options are the utp-core fields of the route section
+type Options struct {
+	TimeBypass     *Bypass         `json:"time_bypass,omitempty"`     // true for a direct outbound, or the tag of the outbound to use
+	TransportRules []TransportRule `json:"transport_rules,omitempty"` // Outbounds by network and destination port, after the configured rules
+}
+
+// IsZero reports whether o adds no rules
+func (o Options) IsZero() bool {
+	return o.TimeBypass == nil && len(o.TransportRules) == 0
+}
+
+// TransportRule routes connections of the listed networks to destination
+// ports to an outbound. Empty conditions match everything.
+type TransportRule struct {
+	Network   badoption.Listable[string] `json:"network,omitempty"`    // tcp, udp or quic
+	Port      badoption.Listable[uint16] `json:"port,omitempty"`       // Destination ports
+	PortRange badoption.Listable[string] `json:"port_range,omitempty"` // Destination port ranges: 1000:2000, :3000 or 4000:
+	Outbound  string                     `json:"outbound"`
+}
+
+// Bypass is the value of a bypass shorthand: true for the first direct
+// outbound, or an outbound tag. false disables it.
+type Bypass struct {
+	Outbound string
+}
+
+func (b Bypass) MarshalJSON() ([]byte, error) {
+	if b.Outbound == "" {
+		return []byte("true"), nil
+	}
+	return json.Marshal(b.Outbound)
+}
+
+func (b *Bypass) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if json.Unmarshal(data, &enabled) == nil && enabled {
+		return nil
+	}
+	if err := json.Unmarshal(data, &b.Outbound); err != nil || b.Outbound == "" {
+		return fmt.Errorf("expected true or an outbound tag")
+	}
+	return nil
+}
+
+// Extract returns the utp-core route options of content together with
+// content without them. Content that is not a JSON object is returned
+// unchanged, so the parser reports the syntax error.
+func Extract(content []byte) (Options, []byte, error) {
+	var fields struct {
+		Route *struct {
+			TimeBypass     json.RawMessage `json:"time_bypass"`
+			TransportRules json.RawMessage `json:"transport_rules"`
+		} `json:"route"`
+	}
+	if json.Unmarshal(content, &fields) != nil || fields.Route == nil || (fields.Route.TimeBypass == nil && fields.Route.TransportRules == nil) {
+		return Options{}, content, nil
+	}
+	var options Options
+	if fields.Route.TimeBypass != nil && !bytes.Equal(fields.Route.TimeBypass, []byte("false")) && !bytes.Equal(fields.Route.TimeBypass, []byte("null")) {
+		options.TimeBypass = new(Bypass)
+		if err := options.TimeBypass.UnmarshalJSON(fields.Route.TimeBypass); err != nil {
+			return Options{}, nil, fmt.Errorf("route.time_bypass: %w", err)
+		}
+	}
+	if fields.Route.TransportRules != nil {
+		if err := json.Unmarshal(fields.Route.TransportRules, &options.TransportRules); err != nil {
+			return Options{}, nil, fmt.Errorf("route.transport_rules: %w", err)
+		}
+	}
+	var object badjson.JSONObject
+	if err := object.UnmarshalJSON(content); err != nil {
+		return Options{}, content, nil
+	}
+	section, _ := object.Get("route")
+	if routeObject, isObject := section.(*badjson.JSONObject); isObject {
+		routeObject.Remove("time_bypass")
+		routeObject.Remove("transport_rules")
+	}
+	stripped, err := object.MarshalJSON()
+	if err != nil {
+		return Options{}, nil, err
+	}
+	return options, stripped, nil
+}
+
+// Restore adds o to the route section of content, an indented configuration
+// written without them
+func Restore(content []byte, o Options) ([]byte, error) {
+	if o.IsZero() {
+		return content, nil
+	}
+	var object badjson.JSONObject
+	if err := object.UnmarshalJSON(content); err != nil {
+		return nil, err
+	}
+	section, _ := object.Get("route")
+	routeObject, isObject := section.(*badjson.JSONObject)
+	if !isObject {
+		routeObject = new(badjson.JSONObject)
+		object.Put("route", routeObject)
+	}
+	if o.TimeBypass != nil {
+		routeObject.Put("time_bypass", o.TimeBypass)
+	}
+	if len(o.TransportRules) > 0 {
+		routeObject.Put("transport_rules", o.TransportRules)
+	}
+	compact, err := object.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := json.Indent(&buffer, compact, "", "  "); err != nil {
+		return nil, err
+	}
+	buffer.WriteByte('\n')
+	return buffer.Bytes(), nil
+}
+
+// Apply adds the rules of o to options: the time bypass ahead of the
+// configured rules so it wins over catch-all rules, and the transport rules
+// after them, as defaults by network and port in front of route.final
+func Apply(options *option.Options, o Options) error {
+	if err := applyTimeBypass(options, o.TimeBypass); err != nil {
+		return err
+	}
+	return applyTransportRules(options, o.TransportRules)
+}
+
+func applyTimeBypass(options *option.Options, bypass *Bypass) error {
+	if bypass == nil {
+		return nil
+	}
+	outbound := bypass.Outbound
+	if outbound == "" {
+		outbound = directOutbound(options)
+	} else if !hasOutbound(options, outbound) {
+		return fmt.Errorf("route.time_bypass: outbound not found: %s", outbound)
+	}
+	rule := option.Rule{
+		Type: C.RuleTypeDefault,
+		DefaultOptions: option.DefaultRule{
+			RawDefaultRule: option.RawDefaultRule{
+				Port: badoption.Listable[uint16](TimePorts),
+			},
+			RuleAction: option.RuleAction{
+				Action:       C.RuleActionTypeRoute,
+				RouteOptions: option.RouteActionOptions{Outbound: outbound},
+			},
+		},
+	}
+	if options.Route == nil {
+		options.Route = &option.RouteOptions{}
+	}
+	options.Route.Rules = append([]option.Rule{rule}, options.Route.Rules...)
+	return nil
+}
+
+func applyTransportRules(options *option.Options, transportRules []TransportRule) error {
+	if len(transportRules) == 0 {
+		return nil
+	}
+	var rules []option.Rule
+	sniffQUIC := false
+	for index, transportRule := range transportRules {
+		prefix := fmt.Sprintf("route.transport_rules[%d]", index)
+		outboundType, found := outboundType(options, transportRule.Outbound)
+		if !found {
+			return fmt.Errorf("%s: outbound not found: %s", prefix, transportRule.Outbound)
+		}
+		for _, portRange := range transportRule.PortRange {
+			if err := checkPortRange(portRange); err != nil {
+				return fmt.Errorf("%s: %w", prefix, err)
+			}
+		}
+		var networks []string
+		quic := false
+		for _, network := range transportRule.Network {
+			switch network {
+			case networkTCP, networkUDP:
+				networks = append(networks, network)
+			case networkQUIC:
+				quic = true
+			default:
+				return fmt.Errorf("%s: invalid network %q: expected tcp, udp or quic", prefix, network)
+			}
+		}
+		carriesTCP := len(transportRule.Network) == 0 || slices.Contains(networks, networkTCP)
+		carriesUDP := len(transportRule.Network) == 0 || quic || slices.Contains(networks, networkUDP)
+		// Transport rules sending an outbound a network it cannot carry are
+		// refused before any connection fails
+		carried := capability.Networks(outboundType)
+		if carriesUDP && !slices.Contains(carried, capability.NetworkUDP) {
+			return fmt.Errorf("%s: outbound %s (%s) does not carry UDP", prefix, transportRule.Outbound, outboundType)
+		}
+		if carriesTCP && !slices.Contains(carried, capability.NetworkTCP) {
+			return fmt.Errorf("%s: outbound %s (%s) does not carry TCP", prefix, transportRule.Outbound, outboundType)
+		}
+
+		if len(networks) > 0 || !quic {
+			rules = append(rules, transportRoute(transportRule, networks, nil))
+		}
+		// QUIC is already matched when the rule takes all of UDP
+		if quic && !slices.Contains(networks, networkUDP) {
+			rules = append(rules, transportRoute(transportRule, []string{networkUDP}, []string{C.ProtocolQUIC}))
+			sniffQUIC = true
+		}
+	}
+	if options.Route == nil {
+		options.Route = &option.RouteOptions{}
+	}
+	options.Route.Rules = append(options.Route.Rules, rules...)
+	if sniffQUIC {
+		// Protocols are only known once sniffed, ahead of the rules matching them
+		sniff := option.Rule{
+			Type: C.RuleTypeDefault,
+			DefaultOptions: option.DefaultRule{
+				RawDefaultRule: option.RawDefaultRule{Network: badoption.Listable[string]{networkUDP}},
+				RuleAction: option.RuleAction{
+					Action:       C.RuleActionTypeSniff,
+					SniffOptions: option.RouteActionSniff{Sniffer: badoption.Listable[string]{C.ProtocolQUIC}},
+				},
+			},
+		}
+		options.Route.Rules = append([]option.Rule{sniff}, options.Route.Rules...)
+	}
+	return nil
+}
+
+func transportRoute(transportRule TransportRule, networks []string, protocols []string) option.Rule {
+	return option.Rule{
+		Type: C.RuleTypeDefault,
+		DefaultOptions: option.DefaultRule{
+			RawDefaultRule: option.RawDefaultRule{
+				Network:   networks,
+				Protocol:  protocols,
+				Port:      transportRule.Port,
+				PortRange: transportRule.PortRange,
+			},
+			RuleAction: option.RuleAction{
+				Action:       C.RuleActionTypeRoute,
+				RouteOptions: option.RouteActionOptions{Outbound: transportRule.Outbound},
+			},
+		},
+	}
+}
+
+// checkPortRange checks a range as Sing-box writes them: from:to, with
+// either end left out
+func checkPortRange(portRange string) error {
+	from, to, found := strings.Cut(portRange, ":")
+	if !found || from == "" && to == "" {
+		return fmt.Errorf("invalid port range %q: expected from:to, :to or from:", portRange)
+	}
+	var ends [2]uint64
+	for index, end := range []string{from, to} {
+		if end == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(end, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port range %q: %w", portRange, err)
+		}
+		ends[index] = port
+	}
+	if from != "" && to != "" && ends[0] > ends[1] {
+		return fmt.Errorf("invalid port range %q: start after end", portRange)
+	}
+	return nil
+}
+
+// directOutbound returns the tag of the first direct outbound of options,
+// adding one when there is none
+func directOutbound(options *option.Options) string {
+	for _, outbound := range options.Outbounds {
+		if outbound.Type == C.TypeDirect && outbound.Tag != "" {
+			return outbound.Tag
+		}
+	}
+	options.Outbounds = append(options.Outbounds, option.Outbound{
+		Type:    C.TypeDirect,
+		Tag:     timeDirectTag,
+		Options: &option.DirectOutboundOptions{},
+	})
+	return timeDirectTag
+}
+
+// hasOutbound reports whether tag names an outbound or endpoint of options
+func hasOutbound(options *option.Options, tag string) bool {
+	_, found := outboundType(options, tag)
+	return found
+}
+
+// outboundType returns the type of the outbound or endpoint tagged tag
+func outboundType(options *option.Options, tag string) (string, bool) {
+	for _, outbound := range options.Outbounds {
+		if outbound.Tag == tag {
+			return outbound.Type, true
+		}
+	}
+	for _, endpoint := range options.Endpoints {
+		if endpoint.Tag == tag {
+			return endpoint.Type, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,86 @@
+package replay
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of bytes shown around the first difference
+const diffContext = 16
+
+// Mismatch describes where actual diverged from the expected payload
+type Mismatch struct {
+	Offset   int // First differing byte
+	Expected []byte
+	Actual   []byte
+}
+
+// Compare returns the first difference between expected and actual outside
+// the ignored ranges, or nil if they match
+func Compare(expected []byte, actual []byte, ignore [][2]int) *Mismatch {
+	for offset := 0; offset < max(len(expected), len(actual)); offset++ {
+		if ignored(offset, ignore) {
+			continue
+		}
+		if offset >= len(expected) || offset >= len(actual) || expected[offset] != actual[offset] {
+			return &Mismatch{Offset: offset, Expected: expected, Actual: actual}
+		}
+	}
+	return nil
+}
+
+func ignored(offset int, ignore [][2]int) bool {
+	for _, r := range ignore {
+		if offset >= r[0] && offset < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders both payloads around the first difference as hex dumps
+func (m *Mismatch) String() string {
+	var b strings.Builder
+	if m.Offset >= len(m.Actual) {
+		fmt.Fprintf(&b, "truncated: got %d of %d bytes\n", len(m.Actual), len(m.Expected))
+	} else {
+		fmt.Fprintf(&b, "differs at offset %d (0x%x)\n", m.Offset, m.Offset)
+	}
+	start := max(m.Offset-diffContext, 0) &^ 0xf
+	end := m.Offset + diffContext
+	fmt.Fprintf(&b, "  expected:\n%s", dump(m.Expected, start, end, m.Offset))
+	fmt.Fprintf(&b, "  actual:\n%s", dump(m.Actual, start, end, m.Offset))
+	return b.String()
+}
+
+// dump renders data[start:end] as hex, marking the byte at mark
+func dump(data []byte, start int, end int, mark int) string {
+	end = min(end, len(data))
+	if start >= end {
+		return "    (no data)\n"
+	}
+	var b strings.Builder
+	for line := start; line < end; line += 16 {
+		fmt.Fprintf(&b, "    %08x ", line)
+		for offset := line; offset < line+16; offset++ {
+			switch {
+			case offset >= end:
+				b.WriteString("   ")
+			case offset == mark:
+				fmt.Fprintf(&b, ">%02x", data[offset])
+			default:
+				fmt.Fprintf(&b, " %02x", data[offset])
+			}
+		}
+		b.WriteString("  |")
+		for offset := line; offset < min(line+16, end); offset++ {
+			if c := data[offset]; c >= 0x20 && c < 0x7f {
+				b.WriteByte(c)
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteString("|\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Result is the outcome of one step
+type Result struct {
+	Index    int
+	Step     *Step
+	Mismatch *Mismatch // Set for received steps that differ
+	Err      error     // Set when the step could not be played
+}
+
+// Failed reports whether the step did not reproduce the capture
+func (r Result) Failed() bool {
+	return r.Mismatch != nil || r.Err != nil
+}
+
+// Play drives conn as side: steps from side are written, steps from the
+// other side are read and compared. Playing stops at the first step that
+// could not be played; mismatches do not stop playback.
+func Play(conn net.Conn, steps []Step, side string, timeout time.Duration) []Result {
+	results := make([]Result, 0, len(steps))
+	for index := range steps {
+		step := &steps[index]
+		result := Result{Index: index + 1, Step: step}
+		if step.From == side {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+			if _, err := conn.Write(step.data); err != nil {
+				result.Err = fmt.Errorf("write: %w", err)
+			}
+		} else {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			actual := make([]byte, len(step.data))
+			n, err := io.ReadFull(conn, actual)
+			result.Mismatch = Compare(step.data, actual[:n], step.Ignore)
+			switch {
+			case err == nil:
+			case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+				result.Err = fmt.Errorf("peer closed the connection after %d of %d bytes", n, len(step.data))
+			default:
+				result.Err = fmt.Errorf("read after %d of %d bytes: %w", n, len(step.data), err)
+			}
+		}
+		results = append(results, result)
+		if result.Err != nil {
+			break
+		}
+	}
+	return results
+}
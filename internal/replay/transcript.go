@@ -0,0 +1,97 @@
+// Package replay plays recorded handshake transcripts against protocol
+// implementations and reports where the produced bytes diverge from the
+// reference capture.
+package replay
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Sides of a transcript step
+const (
+	FromClient = "client"
+	FromServer = "server"
+)
+
+// Transcript is a recorded exchange between a client and a server. Exactly
+// one of Outbound and Inbound is set: an outbound is replayed as the client
+// against a fake server, an inbound as the server behind a fake client.
+type Transcript struct {
+	Outbound    json.RawMessage `json:"outbound,omitempty"`    // Outbound object (server and port are redirected)
+	Inbound     json.RawMessage `json:"inbound,omitempty"`     // Inbound object (listen and port are redirected)
+	Destination string          `json:"destination,omitempty"` // Target dialed through the outbound
+	Timeout     string          `json:"timeout,omitempty"`     // Per-step read timeout (default 5s)
+	Steps       []Step          `json:"steps"`
+}
+
+// Step is one direction of the exchange
+type Step struct {
+	From   string   `json:"from"`             // "client" or "server"
+	Hex    string   `json:"hex,omitempty"`    // Payload as hex (whitespace ignored)
+	Base64 string   `json:"base64,omitempty"` // Payload as standard base64
+	Text   string   `json:"text,omitempty"`   // Payload as text, e.g. HTTP headers
+	Ignore [][2]int `json:"ignore,omitempty"` // [start, end) byte ranges that differ on every run (nonces, keys, padding)
+	Note   string   `json:"note,omitempty"`   // Shown in the report
+
+	data []byte
+}
+
+// Data returns the decoded payload
+func (s *Step) Data() []byte {
+	return s.data
+}
+
+// Load reads and validates a transcript
+func Load(path string) (*Transcript, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t Transcript
+	if err := json.Unmarshal(content, &t); err != nil {
+		return nil, fmt.Errorf("invalid transcript: %w", err)
+	}
+	if (t.Outbound == nil) == (t.Inbound == nil) {
+		return nil, fmt.Errorf("transcript must contain exactly one of outbound and inbound")
+	}
+	if t.Outbound != nil && t.Destination == "" {
+		return nil, fmt.Errorf("outbound transcripts require a destination")
+	}
+	if len(t.Steps) == 0 {
+		return nil, fmt.Errorf("transcript has no steps")
+	}
+	for index := range t.Steps {
+		step := &t.Steps[index]
+		if step.From != FromClient && step.From != FromServer {
+			return nil, fmt.Errorf("step %d: from must be %q or %q", index+1, FromClient, FromServer)
+		}
+		step.data, err = step.decode()
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", index+1, err)
+		}
+		for _, r := range step.Ignore {
+			if r[0] < 0 || r[1] < r[0] || r[1] > len(step.data) {
+				return nil, fmt.Errorf("step %d: ignore range %v out of bounds", index+1, r)
+			}
+		}
+	}
+	return &t, nil
+}
+
+func (s *Step) decode() ([]byte, error) {
+	switch {
+	case s.Hex != "" && s.Base64 == "" && s.Text == "":
+		return hex.DecodeString(strings.Join(strings.Fields(s.Hex), ""))
+	case s.Base64 != "" && s.Hex == "" && s.Text == "":
+		return base64.StdEncoding.DecodeString(s.Base64)
+	case s.Text != "" && s.Hex == "" && s.Base64 == "":
+		return []byte(s.Text), nil
+	default:
+		return nil, fmt.Errorf("exactly one of hex, base64 and text is required")
+	}
+}
@@ -0,0 +1,138 @@
+// Package session lets outbounds hand long-lived underlying sessions (SSH
+// clients, HTTP/2 connections to meek fronts) from the instance being torn
+// down by a hot reload to the instance replacing it.
+//
+// During a reload the old outbound offers its session under a key derived
+// from everything that identifies the remote end (type, server, credentials),
+// or parks it when the old instance has to close first. The new outbound, if
+// configured identically, adopts the session instead of dialing again. An
+// offered session stays with the old outbound until it is adopted; a parked
+// one is closed unless adopted within the grace period.
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultGrace is how long a parked session waits to be adopted
+const DefaultGrace = 30 * time.Second
+
+// Session is anything that owns underlying resources
+type Session interface {
+	Close() error
+}
+
+// Migrator is implemented by outbounds whose sessions can move to the
+// instance replacing theirs while they keep running
+type Migrator interface {
+	// OfferSessions offers the sessions of the outbound for adoption. The
+	// outbound keeps using them until they are adopted.
+	OfferSessions()
+}
+
+type parked struct {
+	session Session
+	timer   *time.Timer // nil for offered sessions
+}
+
+var (
+	access    sync.Mutex
+	sessions  = make(map[string]*parked)
+	reloading atomic.Bool
+)
+
+// BeginReload marks the start of a hot reload. While set, outbounds should
+// Park their sessions on Close instead of closing them.
+func BeginReload() {
+	reloading.Store(true)
+}
+
+// EndReload marks the end of a hot reload. Offers not adopted are withdrawn,
+// leaving the sessions with their outbounds; sessions still parked are
+// closed when their grace period expires.
+func EndReload() {
+	reloading.Store(false)
+	access.Lock()
+	defer access.Unlock()
+	for key, p := range sessions {
+		if p.timer == nil {
+			delete(sessions, key)
+		}
+	}
+}
+
+// Reloading reports whether a hot reload is in progress
+func Reloading() bool {
+	return reloading.Load()
+}
+
+// Key derives a migration key from the outbound type and the options that
+// identify its remote end. Outbounds with different keys never share sessions.
+func Key(outboundType string, identity any) string {
+	content, err := json.Marshal(identity)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(outboundType+"\x00"), content...))
+	return outboundType + ":" + hex.EncodeToString(sum[:16])
+}
+
+// Offer stores s under key for adoption by the next instance without
+// handing it over: until adopted, s stays with the caller
+func Offer(key string, s Session) {
+	if key == "" {
+		return
+	}
+	access.Lock()
+	defer access.Unlock()
+	if previous, ok := sessions[key]; ok && previous.timer != nil {
+		previous.timer.Stop()
+		previous.session.Close()
+	}
+	sessions[key] = &parked{session: s}
+}
+
+// Park stores s under key for adoption by the next instance, closing it
+// unless adopted within the grace period. An existing parked session with
+// the same key is closed.
+func Park(key string, s Session) {
+	if key == "" {
+		s.Close()
+		return
+	}
+	access.Lock()
+	defer access.Unlock()
+	if previous, ok := sessions[key]; ok && previous.timer != nil {
+		previous.timer.Stop()
+		if previous.session != s {
+			previous.session.Close()
+		}
+	}
+	p := &parked{session: s}
+	p.timer = time.AfterFunc(DefaultGrace, func() {
+		access.Lock()
+		if sessions[key] == p {
+			delete(sessions, key)
+		}
+		access.Unlock()
+		s.Close()
+	})
+	sessions[key] = p
+}
+
+// Adopt removes and returns the session offered or parked under key
+func Adopt(key string) (Session, bool) {
+	access.Lock()
+	defer access.Unlock()
+	p, ok := sessions[key]
+	if !ok || (p.timer != nil && !p.timer.Stop()) {
+		return nil, false
+	}
+	delete(sessions, key)
+	return p.session, true
+}
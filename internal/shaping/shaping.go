@@ -0,0 +1,127 @@
+// Package shaping randomizes the size of the first packets of outbound
+// connections. Many blocks trigger on characteristic first-packet lengths
+// (a TLS ClientHello of a given size, a fixed-length obfuscation preamble)
+// regardless of the protocol, so the first flight is written in segments of
+// random size, and protocols with a padding field pad it to a random length
+// within the same profile. The policy is process-wide and applied by the
+// dialer shared by extension outbounds (see dnsguard.Guard.DialContext).
+package shaping
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Policy describes how the first flight is shaped
+type Policy struct {
+	MinSegment int           // Smallest segment written
+	MaxSegment int           // Largest segment written
+	MinFlight  int           // Smallest padded first message
+	MaxFlight  int           // Largest padded first message
+	Limit      int           // Bytes shaped at the start of each connection
+	Delay      time.Duration // Pause between segments, so they are not coalesced
+}
+
+// Profiles are the named policies. fragment cuts the first flight into tiny
+// segments, splitting SNI and protocol headers across packets; mtu and
+// random vary packet sizes without the cost of tiny segments.
+var Profiles = map[string]Policy{
+	"fragment": {MinSegment: 8, MaxSegment: 64, MinFlight: 200, MaxFlight: 700, Limit: 1024, Delay: time.Millisecond},
+	"mtu":      {MinSegment: 300, MaxSegment: 1400, MinFlight: 600, MaxFlight: 1400, Limit: 4096},
+	"random":   {MinSegment: 40, MaxSegment: 1460, MinFlight: 100, MaxFlight: 4096, Limit: 4096},
+}
+
+// DefaultProfile is used when a policy is enabled without a profile
+const DefaultProfile = "mtu"
+
+// Validate checks that the sizes of p are usable
+func (p Policy) Validate() error {
+	switch {
+	case p.MinSegment <= 0 || p.MaxSegment < p.MinSegment:
+		return fmt.Errorf("invalid segment sizes %d-%d", p.MinSegment, p.MaxSegment)
+	case p.MinFlight < 0 || p.MaxFlight < p.MinFlight:
+		return fmt.Errorf("invalid first message sizes %d-%d", p.MinFlight, p.MaxFlight)
+	case p.Limit < 0:
+		return fmt.Errorf("invalid limit %d", p.Limit)
+	}
+	return nil
+}
+
+var current atomic.Pointer[Policy]
+
+// Current returns the policy in force, or nil when first flights are not
+// shaped
+func Current() *Policy {
+	return current.Load()
+}
+
+// SetPolicy puts p in force; nil disables shaping
+func SetPolicy(p *Policy) {
+	current.Store(p)
+}
+
+// ClearPolicy disables shaping if p is still in force, so an instance
+// closing after its replacement started keeps the new policy
+func ClearPolicy(p *Policy) {
+	current.CompareAndSwap(p, nil)
+}
+
+// Padding returns the padding to add to a first message of length bytes
+// under the current policy, at most maxPadding. ok is false without a
+// policy, and the protocol keeps its own padding.
+func Padding(length int, maxPadding int) (padding int, ok bool) {
+	p := Current()
+	if p == nil {
+		return 0, false
+	}
+	low := min(max(p.MinFlight-length, 0), maxPadding)
+	high := min(max(p.MaxFlight-length, low), maxPadding)
+	return low + rand.IntN(high-low+1), true
+}
+
+// Wrap returns conn shaping its first flight under the current policy, or
+// conn itself without a policy
+func Wrap(conn net.Conn) net.Conn {
+	p := Current()
+	if p == nil || p.Limit == 0 {
+		return conn
+	}
+	return &shapedConn{Conn: conn, policy: p, remaining: p.Limit}
+}
+
+// shapedConn writes its first Limit bytes in random segments. It does not
+// expose the connection it wraps, so copies cannot bypass it.
+type shapedConn struct {
+	net.Conn
+	policy    *Policy
+	remaining int
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	if c.remaining <= 0 {
+		return c.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 && c.remaining > 0 {
+		if written > 0 && c.policy.Delay > 0 {
+			time.Sleep(c.policy.Delay)
+		}
+		size := c.policy.MinSegment + rand.IntN(c.policy.MaxSegment-c.policy.MinSegment+1)
+		size = min(size, len(b), c.remaining)
+		n, err := c.Conn.Write(b[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[size:]
+		c.remaining -= size
+	}
+	if len(b) > 0 {
+		n, err := c.Conn.Write(b)
+		return written + n, err
+	}
+	return written, nil
+}
@@ -0,0 +1,41 @@
+package sockopt
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+const supported = true
+
+// control sets marks on sockets before they connect
+func control(marks Marks) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			err = apply(int(fd), network, marks)
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+}
+
+func apply(fd int, network string, marks Marks) error {
+	if tos := marks.tos(); tos != 0 {
+		if strings.HasSuffix(network, "6") {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos); err != nil {
+				return fmt.Errorf("set traffic class: %w", err)
+			}
+		} else if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos); err != nil {
+			return fmt.Errorf("set TOS: %w", err)
+		}
+	}
+	if marks.Priority != 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PRIORITY, marks.Priority); err != nil {
+			return fmt.Errorf("set socket priority: %w", err)
+		}
+	}
+	return nil
+}
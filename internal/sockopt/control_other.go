@@ -0,0 +1,14 @@
+//go:build !linux
+
+package sockopt
+
+import (
+	"syscall"
+)
+
+const supported = false
+
+// control is never called, as Validate rejects marks on this platform
+func control(marks Marks) func(network string, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,216 @@
+// Package sockopt marks the sockets of extension outbounds for router QoS
+// policies: the DSCP (or whole TOS byte) of their packets and the Linux
+// socket priority. Outbounds carry their own marks, and the rules in force
+// (set by the qos service) override them per connection.
+package sockopt
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sagernet/sing-box/adapter"
+)
+
+// Marks are the QoS marks set on a socket. Zero values leave the system
+// default.
+type Marks struct {
+	DSCP     int `json:"dscp,omitempty"`            // Differentiated services code point 0-63, e.g. 46 (EF) or 10 (AF11)
+	TOS      int `json:"tos,omitempty"`             // Whole TOS / traffic class byte 0-255, instead of dscp
+	Priority int `json:"socket_priority,omitempty"` // SO_PRIORITY for the egress queueing discipline, 0-6 without CAP_NET_ADMIN
+}
+
+// IsZero reports whether m leaves sockets unmarked
+func (m Marks) IsZero() bool {
+	return m == Marks{}
+}
+
+// Validate checks that the marks are in range and can be set here
+func (m Marks) Validate() error {
+	switch {
+	case m.IsZero():
+		return nil
+	case !supported:
+		return fmt.Errorf("dscp, tos and socket_priority are only supported on Linux")
+	case m.DSCP != 0 && m.TOS != 0:
+		return fmt.Errorf("dscp and tos are mutually exclusive")
+	case m.DSCP < 0 || m.DSCP > 63:
+		return fmt.Errorf("invalid dscp %d: expected 0-63", m.DSCP)
+	case m.TOS < 0 || m.TOS > 255:
+		return fmt.Errorf("invalid tos %d: expected 0-255", m.TOS)
+	case m.Priority < 0:
+		return fmt.Errorf("invalid socket_priority %d", m.Priority)
+	}
+	return nil
+}
+
+// tos returns the TOS byte to set, or 0 to leave it
+func (m Marks) tos() int {
+	if m.DSCP != 0 {
+		return m.DSCP << 2
+	}
+	return m.TOS
+}
+
+// override returns m with the marks set in other replacing its own
+func (m Marks) override(other Marks) Marks {
+	if other.DSCP != 0 || other.TOS != 0 {
+		m.DSCP, m.TOS = other.DSCP, other.TOS
+	}
+	if other.Priority != 0 {
+		m.Priority = other.Priority
+	}
+	return m
+}
+
+// Rule sets marks for the connections matching all of its conditions.
+// Empty conditions match everything.
+type Rule struct {
+	Outbound     []string `json:"outbound,omitempty"`      // Outbound tags
+	Inbound      []string `json:"inbound,omitempty"`       // Inbound tags
+	Domain       []string `json:"domain,omitempty"`        // Exact destination domains
+	DomainSuffix []string `json:"domain_suffix,omitempty"` // Destination domain suffixes
+	IPCIDR       []string `json:"ip_cidr,omitempty"`       // Destination IP prefixes
+	Port         []uint16 `json:"port,omitempty"`          // Destination ports
+
+	Marks
+}
+
+// Rules is a compiled, ordered list of rules; the first match applies
+type Rules struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	outbounds []string
+	inbounds  []string
+	domains   []string
+	suffixes  []string
+	prefixes  []netip.Prefix
+	ports     []uint16
+	marks     Marks
+}
+
+// Compile validates rules and prepares them for matching
+func Compile(rules []Rule) (*Rules, error) {
+	compiled := &Rules{}
+	for i, rule := range rules {
+		if rule.IsZero() {
+			return nil, fmt.Errorf("rules[%d]: no dscp, tos or socket_priority", i)
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		c := compiledRule{
+			outbounds: rule.Outbound,
+			inbounds:  rule.Inbound,
+			ports:     rule.Port,
+			marks:     rule.Marks,
+		}
+		for _, domain := range rule.Domain {
+			c.domains = append(c.domains, strings.ToLower(domain))
+		}
+		for _, suffix := range rule.DomainSuffix {
+			c.suffixes = append(c.suffixes, strings.TrimPrefix(strings.ToLower(suffix), "."))
+		}
+		for _, cidr := range rule.IPCIDR {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("rules[%d]: %w", i, err)
+			}
+			c.prefixes = append(c.prefixes, prefix)
+		}
+		compiled.rules = append(compiled.rules, c)
+	}
+	return compiled, nil
+}
+
+// match returns the marks of the first rule matching a connection through
+// outbound, described by metadata when known
+func (r *Rules) match(outbound string, metadata *adapter.InboundContext) (Marks, bool) {
+	for _, rule := range r.rules {
+		if rule.match(outbound, metadata) {
+			return rule.marks, true
+		}
+	}
+	return Marks{}, false
+}
+
+func (r *compiledRule) match(outbound string, metadata *adapter.InboundContext) bool {
+	if len(r.outbounds) > 0 && !slices.Contains(r.outbounds, outbound) {
+		return false
+	}
+	hasConnectionCond := len(r.inbounds) > 0 || len(r.ports) > 0 || len(r.domains) > 0 || len(r.suffixes) > 0 || len(r.prefixes) > 0
+	if !hasConnectionCond {
+		return true
+	}
+	if metadata == nil {
+		return false
+	}
+	if len(r.inbounds) > 0 && !slices.Contains(r.inbounds, metadata.Inbound) {
+		return false
+	}
+	destination := metadata.Destination
+	if len(r.ports) > 0 && !slices.Contains(r.ports, destination.Port) {
+		return false
+	}
+	if len(r.domains) == 0 && len(r.suffixes) == 0 && len(r.prefixes) == 0 {
+		return true
+	}
+	domain := metadata.Domain
+	if destination.IsFqdn() {
+		domain = destination.Fqdn
+	}
+	if domain != "" {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if slices.Contains(r.domains, domain) {
+			return true
+		}
+		for _, suffix := range r.suffixes {
+			if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+				return true
+			}
+		}
+	}
+	if destination.IsIP() {
+		addr := destination.Addr.Unmap()
+		for _, prefix := range r.prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var current atomic.Pointer[Rules]
+
+// SetRules puts rules in force; nil removes them
+func SetRules(r *Rules) {
+	current.Store(r)
+}
+
+// ClearRules removes r if it is still in force, so an instance closing
+// after its replacement started keeps the new rules
+func ClearRules(r *Rules) {
+	current.CompareAndSwap(r, nil)
+}
+
+// Dialer returns a dialer for outbound setting marks on its sockets, or the
+// marks of the first rule in force matching the connection. metadata is nil
+// for sockets shared by several connections, which only outbound rules
+// match.
+func Dialer(outbound string, metadata *adapter.InboundContext, marks Marks) *net.Dialer {
+	if rules := current.Load(); rules != nil {
+		if override, matched := rules.match(outbound, metadata); matched {
+			marks = marks.override(override)
+		}
+	}
+	if marks.IsZero() {
+		return &net.Dialer{}
+	}
+	return &net.Dialer{Control: control(marks)}
+}
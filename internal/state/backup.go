@@ -0,0 +1,218 @@
+package state
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// BackupsDir is the subdirectory receiving backups by default. Directories
+// of this name are left out of backups, which would otherwise contain every
+// earlier backup.
+const BackupsDir = "backups"
+
+// BackupExtension is the file name extension of backups
+const BackupExtension = ".utpbackup"
+
+// A backup is a gzipped tar of the state directory sealed with
+// XChaCha20-Poly1305 under a key derived from the passphrase by scrypt:
+// magic, salt, nonce, then the sealed archive
+const (
+	backupMagic   = "UTPSTATE1"
+	backupSaltLen = 16
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+)
+
+// BackupName returns the file name of a backup taken at t
+func BackupName(t time.Time) string {
+	return "state-" + t.UTC().Format("20060102T150405Z") + BackupExtension
+}
+
+// Backup archives the files of dir and seals the archive with passphrase
+func Backup(dir string, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("backup requires a passphrase")
+	}
+	var archive bytes.Buffer
+	compressor := gzip.NewWriter(&archive)
+	writer := tar.NewWriter(compressor)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if entry.IsDir() && entry.Name() == BackupsDir {
+			return filepath.SkipDir
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(writer, file)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to archive state: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	return seal(archive.Bytes(), passphrase)
+}
+
+// Restore opens a backup with passphrase and writes its files into dir,
+// replacing files of the same name. Files missing from the backup are kept.
+// It returns the number of files restored.
+func Restore(dir string, backup []byte, passphrase string) (int, error) {
+	archive, err := open(backup, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	decompressor, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return 0, fmt.Errorf("invalid backup: %w", err)
+	}
+	reader := tar.NewReader(decompressor)
+	var restored int
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return restored, nil
+		}
+		if err != nil {
+			return restored, fmt.Errorf("invalid backup: %w", err)
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(header.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return restored, fmt.Errorf("invalid backup: path %q leaves the state directory", header.Name)
+		}
+		path := filepath.Join(dir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o700); err != nil {
+				return restored, err
+			}
+		case tar.TypeReg:
+			if err := restoreFile(path, reader, header.FileInfo().Mode().Perm()); err != nil {
+				return restored, err
+			}
+			restored++
+		}
+	}
+}
+
+// restoreFile writes a file through a temporary file, so an interrupted
+// restore leaves whole files only
+func restoreFile(path string, content io.Reader, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	temporary, err := os.CreateTemp(filepath.Dir(path), ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := io.Copy(temporary, content); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Chmod(mode & 0o700); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
+
+func seal(content []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, backupSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := append([]byte(backupMagic), salt...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed = append(sealed, nonce...)
+	// The header is authenticated with the archive
+	return aead.Seal(sealed, nonce, content, sealed), nil
+}
+
+func open(sealed []byte, passphrase string) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, []byte(backupMagic)) {
+		return nil, fmt.Errorf("not a utp-core state backup")
+	}
+	header := len(backupMagic) + backupSaltLen + chacha20poly1305.NonceSizeX
+	if len(sealed) < header {
+		return nil, fmt.Errorf("backup too short")
+	}
+	salt := sealed[len(backupMagic) : len(backupMagic)+backupSaltLen]
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	content, err := aead.Open(nil, sealed[header-aead.NonceSize():header], sealed[header:], sealed[:header])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt backup: wrong passphrase or damaged file")
+	}
+	return content, nil
+}
@@ -0,0 +1,68 @@
+// Package state locates the directory where utp-core keeps persistent
+// runtime data such as ACME certificates and caches.
+package state
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/UTPBox/utp-core/internal/tenant"
+)
+
+// EnvStateDir overrides the default state directory
+const EnvStateDir = "UTP_STATE_DIR"
+
+var (
+	access sync.RWMutex
+	dir    string
+)
+
+// SetDir sets the state directory, typically from the --state-dir flag
+func SetDir(path string) {
+	access.Lock()
+	defer access.Unlock()
+	dir = path
+}
+
+// Dir returns the state directory. Resolution order: SetDir, the
+// UTP_STATE_DIR environment variable, then <user config dir>/utp-core.
+func Dir() string {
+	access.RLock()
+	defer access.RUnlock()
+	if dir != "" {
+		return dir
+	}
+	if env := os.Getenv(EnvStateDir); env != "" {
+		return env
+	}
+	if base, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(base, "utp-core")
+	}
+	return filepath.Join(os.TempDir(), "utp-core")
+}
+
+// Path returns a path inside the state directory
+func Path(elem ...string) string {
+	return filepath.Join(append([]string{Dir()}, elem...)...)
+}
+
+// PathContext returns a path inside the state directory of the tenant of
+// ctx: tenants/<name> for tenants, the state directory itself otherwise
+func PathContext(ctx context.Context, elem ...string) string {
+	if name := tenant.FromContext(ctx); name != "" {
+		return Path(append([]string{"tenants", name}, elem...)...)
+	}
+	return Path(elem...)
+}
+
+// Ensure creates a subdirectory of the state directory and returns its path
+func Ensure(elem ...string) (string, error) {
+	path := Path(elem...)
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %w", err)
+	}
+	return path, nil
+}
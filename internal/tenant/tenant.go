@@ -0,0 +1,48 @@
+// Package tenant names the namespace an instance belongs to when one process
+// serves several tenants (see the --tenants flag). Each tenant runs its own
+// instance with its own inbounds, outbounds, users, statistics and admin
+// tokens; the name is carried in the instance context so process-wide
+// facilities such as the state directory and session migration keep tenants
+// apart.
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+type contextKey struct{}
+
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// ValidateName checks that name is usable as a tenant name and directory
+func ValidateName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid tenant name %q: expected lowercase letters, digits, - and _", name)
+	}
+	return nil
+}
+
+// ContextWith returns ctx belonging to the tenant name
+func ContextWith(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, name)
+}
+
+// FromContext returns the tenant of ctx, or "" for the main instance
+func FromContext(ctx context.Context) string {
+	name, _ := ctx.Value(contextKey{}).(string)
+	return name
+}
+
+// Scope prefixes key with the tenant of ctx, leaving keys of the main
+// instance unchanged
+func Scope(ctx context.Context, key string) string {
+	if name := FromContext(ctx); name != "" {
+		return name + "/" + key
+	}
+	return key
+}
@@ -0,0 +1,67 @@
+package testkit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sagernet/sing-box/log"
+)
+
+var _ log.ContextLogger = (*Logger)(nil)
+
+// Entry is a message written to a Logger
+type Entry struct {
+	Level   log.Level
+	Message string
+}
+
+func (e Entry) String() string {
+	return log.FormatLevel(e.Level) + ": " + e.Message
+}
+
+// Logger keeps the messages written to it
+type Logger struct {
+	access  sync.Mutex
+	entries []Entry
+}
+
+// Entries returns the messages written so far
+func (l *Logger) Entries() []Entry {
+	l.access.Lock()
+	defer l.access.Unlock()
+	return append([]Entry(nil), l.entries...)
+}
+
+// Contains reports whether a message at level or more severe contains text
+func (l *Logger) Contains(level log.Level, text string) bool {
+	for _, entry := range l.Entries() {
+		if entry.Level <= level && strings.Contains(entry.Message, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Logger) write(level log.Level, args []any) {
+	l.access.Lock()
+	l.entries = append(l.entries, Entry{Level: level, Message: fmt.Sprint(args...)})
+	l.access.Unlock()
+}
+
+func (l *Logger) Trace(args ...any) { l.write(log.LevelTrace, args) }
+func (l *Logger) Debug(args ...any) { l.write(log.LevelDebug, args) }
+func (l *Logger) Info(args ...any)  { l.write(log.LevelInfo, args) }
+func (l *Logger) Warn(args ...any)  { l.write(log.LevelWarn, args) }
+func (l *Logger) Error(args ...any) { l.write(log.LevelError, args) }
+func (l *Logger) Fatal(args ...any) { l.write(log.LevelFatal, args) }
+func (l *Logger) Panic(args ...any) { l.write(log.LevelPanic, args) }
+
+func (l *Logger) TraceContext(ctx context.Context, args ...any) { l.Trace(args...) }
+func (l *Logger) DebugContext(ctx context.Context, args ...any) { l.Debug(args...) }
+func (l *Logger) InfoContext(ctx context.Context, args ...any)  { l.Info(args...) }
+func (l *Logger) WarnContext(ctx context.Context, args ...any)  { l.Warn(args...) }
+func (l *Logger) ErrorContext(ctx context.Context, args ...any) { l.Error(args...) }
+func (l *Logger) FatalContext(ctx context.Context, args ...any) { l.Fatal(args...) }
+func (l *Logger) PanicContext(ctx context.Context, args ...any) { l.Panic(args...) }
@@ -0,0 +1,270 @@
+package testkit
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/UTPBox/utp-core/internal/netdial"
+)
+
+var _ netdial.Dialer = (*Network)(nil)
+
+// Network connects dialers to listeners by address, in memory. Addresses
+// are matched as written, so listen on what the outbound dials: the
+// configured host:port, or the resolved address when a DNS guard is on.
+// Connections dialed over udp keep the boundaries of writes, as datagrams;
+// others are streams.
+type Network struct {
+	access    sync.Mutex
+	listeners map[string]*listener
+}
+
+// Listen accepts the connections dialed to address
+func (n *Network) Listen(address string) (net.Listener, error) {
+	n.access.Lock()
+	defer n.access.Unlock()
+	if n.listeners == nil {
+		n.listeners = make(map[string]*listener)
+	}
+	if _, exists := n.listeners[address]; exists {
+		return nil, &net.OpError{Op: "listen", Net: "memory", Addr: memoryAddr(address), Err: syscall.EADDRINUSE}
+	}
+	l := &listener{
+		network: n,
+		address: memoryAddr(address),
+		accept:  make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+// Serve accepts the connections dialed to address and runs handler on each,
+// until the returned listener is closed
+func (n *Network) Serve(address string, handler func(conn net.Conn)) (net.Listener, error) {
+	l, err := n.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return l, nil
+}
+
+// DialContext connects to the listener of address, and is refused when there
+// is none
+func (n *Network) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	n.access.Lock()
+	l := n.listeners[address]
+	n.access.Unlock()
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: memoryAddr(address), Err: syscall.ECONNREFUSED}
+	}
+	client, server := Pipe(memoryAddr("client"), l.address)
+	if strings.HasPrefix(network, "udp") {
+		client, server = PacketPipe(memoryAddr("client"), l.address)
+	}
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: l.address, Err: syscall.ECONNREFUSED}
+	case <-ctx.Done():
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: l.address, Err: ctx.Err()}
+	}
+}
+
+type listener struct {
+	network *Network
+	address memoryAddr
+	accept  chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.network.access.Lock()
+		delete(l.network.listeners, string(l.address))
+		l.network.access.Unlock()
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.address
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// Pipe returns the two ends of an in-memory connection. Unlike net.Pipe,
+// writes are buffered and return at once, so both ends may write before
+// reading, as handshakes often do.
+func Pipe(local net.Addr, remote net.Addr) (net.Conn, net.Conn) {
+	return newPipe(false, local, remote)
+}
+
+// PacketPipe returns the two ends of an in-memory connection like Pipe,
+// where every read returns the data of one write, as UDP sockets do
+func PacketPipe(local net.Addr, remote net.Addr) (net.Conn, net.Conn) {
+	return newPipe(true, local, remote)
+}
+
+func newPipe(datagram bool, local net.Addr, remote net.Addr) (net.Conn, net.Conn) {
+	a, b := newBuffer(datagram), newBuffer(datagram)
+	return &pipeConn{in: a, out: b, local: local, remote: remote},
+		&pipeConn{in: b, out: a, local: remote, remote: local}
+}
+
+// buffer is one direction of a pipe
+type buffer struct {
+	access   sync.Mutex
+	datagram bool
+	data     []byte
+	packets  [][]byte // Of datagram pipes
+	eof      bool     // The writing end closed
+	closed   bool     // The reading end closed
+	deadline time.Time
+	changed  chan struct{} // Closed and replaced on every change
+}
+
+func newBuffer(datagram bool) *buffer {
+	return &buffer{datagram: datagram, changed: make(chan struct{})}
+}
+
+// signal wakes up the readers; access must be held
+func (b *buffer) signal() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *buffer) read(p []byte) (int, error) {
+	for {
+		b.access.Lock()
+		switch {
+		case b.closed:
+			b.access.Unlock()
+			return 0, net.ErrClosed
+		case len(b.packets) > 0:
+			// What does not fit is lost, as with UDP
+			n := copy(p, b.packets[0])
+			b.packets = b.packets[1:]
+			b.access.Unlock()
+			return n, nil
+		case len(b.data) > 0:
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.access.Unlock()
+			return n, nil
+		case b.eof:
+			b.access.Unlock()
+			return 0, io.EOF
+		case !b.deadline.IsZero() && !time.Now().Before(b.deadline):
+			b.access.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		changed, deadline := b.changed, b.deadline
+		b.access.Unlock()
+		if deadline.IsZero() {
+			<-changed
+			continue
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (b *buffer) write(p []byte) (int, error) {
+	b.access.Lock()
+	defer b.access.Unlock()
+	if b.eof || b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if b.datagram {
+		b.packets = append(b.packets, append([]byte(nil), p...))
+	} else {
+		b.data = append(b.data, p...)
+	}
+	b.signal()
+	return len(p), nil
+}
+
+type pipeConn struct {
+	in     *buffer
+	out    *buffer
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.in.read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.out.write(p)
+}
+
+func (c *pipeConn) Close() error {
+	c.in.access.Lock()
+	c.in.closed = true
+	c.in.signal()
+	c.in.access.Unlock()
+	c.out.access.Lock()
+	c.out.eof = true
+	c.out.signal()
+	c.out.access.Unlock()
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.in.access.Lock()
+	c.in.deadline = t
+	c.in.signal()
+	c.in.access.Unlock()
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes never block
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
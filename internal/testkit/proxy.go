@@ -0,0 +1,97 @@
+package testkit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+)
+
+// SOCKSRequest is what a client asked a SOCKS5 proxy for
+type SOCKSRequest struct {
+	Username    string
+	Password    string
+	Destination metadata.Socksaddr
+}
+
+// AcceptSOCKS5 answers the SOCKS5 handshake of the client on conn as the
+// proxy behind a bridge or meek server would, accepting any credentials and
+// any CONNECT request. What the client writes next is its stream.
+func AcceptSOCKS5(conn net.Conn) (SOCKSRequest, error) {
+	var request SOCKSRequest
+	reader := byteReader{conn}
+	auth, err := socks5.ReadAuthRequest(reader)
+	if err != nil {
+		return request, err
+	}
+	method := socks5.AuthTypeNotRequired
+	if slices.Contains(auth.Methods, socks5.AuthTypeUsernamePassword) {
+		method = socks5.AuthTypeUsernamePassword
+	}
+	if err := socks5.WriteAuthResponse(conn, socks5.AuthResponse{Method: method}); err != nil {
+		return request, err
+	}
+	if method == socks5.AuthTypeUsernamePassword {
+		credentials, err := socks5.ReadUsernamePasswordAuthRequest(reader)
+		if err != nil {
+			return request, err
+		}
+		request.Username, request.Password = credentials.Username, credentials.Password
+		if err := socks5.WriteUsernamePasswordAuthResponse(conn, socks5.UsernamePasswordAuthResponse{}); err != nil {
+			return request, err
+		}
+	}
+	connect, err := socks5.ReadRequest(reader)
+	if err != nil {
+		return request, err
+	}
+	if connect.Command != socks5.CommandConnect {
+		socks5.WriteResponse(conn, socks5.Response{ReplyCode: socks5.ReplyCodeUnsupported})
+		return request, fmt.Errorf("unsupported SOCKS5 command %d", connect.Command)
+	}
+	request.Destination = connect.Destination
+	return request, socks5.WriteResponse(conn, socks5.Response{ReplyCode: socks5.ReplyCodeSuccess})
+}
+
+// ReadRequest reads the request of an HTTP proxy or tunnel gateway client
+// from conn, leaving the response to the caller. Reads of the returned
+// connection continue with what the client sent after the request.
+func ReadRequest(conn net.Conn) (*http.Request, net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return request, &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// Echo writes back what it reads from conn until the client closes it
+func Echo(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// byteReader reads single bytes without buffering, so the stream following
+// a handshake is left on the connection
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,98 @@
+package testkit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/log"
+)
+
+// Router stands in for the sing-box router given to outbound constructors.
+// Extension outbounds do not route, so its methods panic when called.
+type Router struct {
+	adapter.Router
+}
+
+// OutboundManager holds outbounds for groups and services under test. Only
+// lookups are implemented; the lifecycle and creation methods panic.
+type OutboundManager struct {
+	adapter.OutboundManager
+	access    sync.RWMutex
+	outbounds []adapter.Outbound
+}
+
+// NewOutboundManager returns a manager holding outbounds, the first one
+// being the default
+func NewOutboundManager(outbounds ...adapter.Outbound) *OutboundManager {
+	return &OutboundManager{outbounds: outbounds}
+}
+
+// Add adds or replaces outbound
+func (m *OutboundManager) Add(outbound adapter.Outbound) {
+	m.access.Lock()
+	defer m.access.Unlock()
+	for i, existing := range m.outbounds {
+		if existing.Tag() == outbound.Tag() {
+			m.outbounds[i] = outbound
+			return
+		}
+	}
+	m.outbounds = append(m.outbounds, outbound)
+}
+
+func (m *OutboundManager) Outbounds() []adapter.Outbound {
+	m.access.RLock()
+	defer m.access.RUnlock()
+	return append([]adapter.Outbound(nil), m.outbounds...)
+}
+
+func (m *OutboundManager) Outbound(tag string) (adapter.Outbound, bool) {
+	m.access.RLock()
+	defer m.access.RUnlock()
+	for _, outbound := range m.outbounds {
+		if outbound.Tag() == tag {
+			return outbound, true
+		}
+	}
+	return nil, false
+}
+
+func (m *OutboundManager) Default() adapter.Outbound {
+	m.access.RLock()
+	defer m.access.RUnlock()
+	if len(m.outbounds) == 0 {
+		return nil
+	}
+	return m.outbounds[0]
+}
+
+func (m *OutboundManager) Remove(tag string) error {
+	m.access.Lock()
+	defer m.access.Unlock()
+	for i, outbound := range m.outbounds {
+		if outbound.Tag() == tag {
+			m.outbounds = append(m.outbounds[:i], m.outbounds[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("outbound not found: %s", tag)
+}
+
+// Constructor is the signature of extension outbound constructors
+type Constructor[T any] func(ctx context.Context, router adapter.Router, logger log.ContextLogger, tag string, opts T) (adapter.Outbound, error)
+
+// NewOutbound creates an outbound with constructor, adds it to manager when
+// set, and returns it with the logger it writes to
+func NewOutbound[T any](ctx context.Context, manager *OutboundManager, constructor Constructor[T], tag string, opts T) (adapter.Outbound, *Logger, error) {
+	logger := &Logger{}
+	outbound, err := constructor(ctx, &Router{}, logger, tag, opts)
+	if err != nil {
+		return nil, logger, err
+	}
+	if manager != nil {
+		manager.Add(outbound)
+	}
+	return outbound, logger, nil
+}
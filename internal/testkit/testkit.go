@@ -0,0 +1,29 @@
+// Package testkit runs extensions without a network or a sing-box instance:
+// a recording logger, an outbound manager holding given outbounds, an
+// in-memory network whose listeners extension outbounds reach through
+// internal/netdial, and transcripts of connections compared against golden
+// files. It is meant for tests and is never linked into the binary.
+package testkit
+
+import (
+	"context"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing/service"
+
+	"github.com/UTPBox/utp-core/internal/netdial"
+)
+
+// Context returns a context for creating extensions under test: outbounds
+// created with it dial through network, and services find outbounds in
+// manager. Either may be nil.
+func Context(parent context.Context, network *Network, manager *OutboundManager) context.Context {
+	ctx := service.ContextWithDefaultRegistry(parent)
+	if network != nil {
+		ctx = netdial.WithDialer(ctx, network)
+	}
+	if manager != nil {
+		service.MustRegister[adapter.OutboundManager](ctx, manager)
+	}
+	return ctx
+}
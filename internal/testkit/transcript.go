@@ -0,0 +1,156 @@
+package testkit
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// UpdateGoldenEnv, when set to 1, makes Transcript.Golden rewrite golden
+// files instead of comparing against them
+const UpdateGoldenEnv = "UTP_UPDATE_GOLDEN"
+
+// Transcript records the bytes sent and received on a connection, for
+// comparing handshakes against golden files. Only deterministic exchanges
+// can be compared: fix the randomness of the protocol under test (keys,
+// padding, nonces) before recording.
+type Transcript struct {
+	net.Conn
+	writing sync.Mutex // Held until written bytes are recorded
+	access  sync.Mutex
+	turns   []turn
+}
+
+// turn is the bytes moved in one direction before the other direction was
+// used
+type turn struct {
+	sent bool
+	data []byte
+}
+
+// Record returns conn recording into a transcript
+func Record(conn net.Conn) *Transcript {
+	return &Transcript{Conn: conn}
+}
+
+func (t *Transcript) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	t.add(false, p[:n])
+	return n, err
+}
+
+func (t *Transcript) Write(p []byte) (int, error) {
+	t.writing.Lock()
+	defer t.writing.Unlock()
+	n, err := t.Conn.Write(p)
+	t.add(true, p[:n])
+	return n, err
+}
+
+// add appends data to the current turn, as the boundaries of reads and
+// writes within a turn depend on buffering
+func (t *Transcript) add(sent bool, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	if last := len(t.turns) - 1; last >= 0 && t.turns[last].sent == sent {
+		t.turns[last].data = append(t.turns[last].data, data...)
+		return
+	}
+	t.turns = append(t.turns, turn{sent: sent, data: append([]byte(nil), data...)})
+}
+
+// Dump returns the transcript as text: a line per turn, starting with > for
+// sent and < for received bytes, followed by the bytes in hex. Writes in
+// progress are waited for, as the peer may have read their bytes already.
+func (t *Transcript) Dump() []byte {
+	t.writing.Lock()
+	defer t.writing.Unlock()
+	t.access.Lock()
+	defer t.access.Unlock()
+	var dump bytes.Buffer
+	for _, turn := range t.turns {
+		if turn.sent {
+			dump.WriteString("> ")
+		} else {
+			dump.WriteString("< ")
+		}
+		dump.WriteString(hex.EncodeToString(turn.data))
+		dump.WriteByte('\n')
+	}
+	return dump.Bytes()
+}
+
+// Golden compares the transcript with the golden file at path, or rewrites
+// the file when UpdateGoldenEnv is set to 1. Golden files are written for
+// reading: see parseGolden. Rewriting a file drops its comments.
+func (t *Transcript) Golden(path string) error {
+	dump := t.Dump()
+	if os.Getenv(UpdateGoldenEnv) == "1" {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(path, dump, 0o644)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read golden transcript (set %s=1 to create it): %w", UpdateGoldenEnv, err)
+	}
+	golden, err := parseGolden(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if bytes.Equal(dump, golden) {
+		return nil
+	}
+	got, want := bytes.Split(dump, []byte("\n")), bytes.Split(golden, []byte("\n"))
+	for i := 0; i < max(len(got), len(want)); i++ {
+		var gotLine, wantLine []byte
+		if i < len(got) {
+			gotLine = got[i]
+		}
+		if i < len(want) {
+			wantLine = want[i]
+		}
+		if !bytes.Equal(gotLine, wantLine) {
+			return fmt.Errorf("transcript differs from %s at turn %d:\n got: %.80s\nwant: %.80s", path, i+1, gotLine, wantLine)
+		}
+	}
+	return fmt.Errorf("transcript differs from %s", path)
+}
+
+// parseGolden returns a golden file in the form of Dump. Text from # to the
+// end of a line is a comment, hex digits may be spaced, and a turn goes on
+// over the following lines until one starts with > or <.
+func parseGolden(content []byte) ([]byte, error) {
+	var golden []byte
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		if comment := bytes.IndexByte(line, '#'); comment >= 0 {
+			line = line[:comment]
+		}
+		line = bytes.Join(bytes.Fields(line), nil)
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '>' || line[0] == '<':
+			golden = append(golden, line[0], ' ')
+			line = line[1:]
+		case len(golden) == 0:
+			return nil, fmt.Errorf("line %d: bytes before the first turn", i+1)
+		default:
+			golden = golden[:len(golden)-1]
+		}
+		if _, err := hex.DecodeString(string(line)); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		golden = append(golden, bytes.ToLower(line)...)
+		golden = append(golden, '\n')
+	}
+	return golden, nil
+}
@@ -0,0 +1,148 @@
+package tlsconfig
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"time"
+
+	tf "github.com/sagernet/sing-box/common/tlsfragment"
+	"github.com/sagernet/sing/common/json/badoption"
+)
+
+// Fragment defaults
+const (
+	DefaultFragmentMinSize = 16
+	DefaultFragmentMaxSize = 64
+	DefaultFragmentDelay   = 10 * time.Millisecond
+)
+
+const recordHeaderLen = 5
+
+// FragmentOptions split the ClientHello into many TCP segments, so filters
+// reading the SNI from the first packet miss it. One cut always falls
+// inside the server name. Servers reassemble the stream and notice nothing.
+// With records, every segment is also a TLS record of its own, for filters
+// that reassemble TCP but not TLS records.
+type FragmentOptions struct {
+	Enabled bool                `json:"enabled,omitempty"`
+	MinSize int                 `json:"min_size,omitempty"` // Smallest segment in bytes (default 16)
+	MaxSize int                 `json:"max_size,omitempty"` // Largest segment in bytes (default 64)
+	Delay   *badoption.Duration `json:"delay,omitempty"`    // Pause between segments, so they are not coalesced (default 10ms, 0 for none)
+	Records bool                `json:"records,omitempty"`  // Also split the ClientHello into TLS records
+}
+
+// fragmenter is the validated form of FragmentOptions
+type fragmenter struct {
+	minSize int
+	maxSize int
+	delay   time.Duration
+	records bool
+}
+
+func newFragmenter(opts FragmentOptions) (*fragmenter, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+	f := &fragmenter{minSize: opts.MinSize, maxSize: opts.MaxSize, delay: DefaultFragmentDelay, records: opts.Records}
+	if opts.Delay != nil {
+		f.delay = time.Duration(*opts.Delay)
+	}
+	if f.minSize == 0 {
+		f.minSize = min(DefaultFragmentMinSize, max(f.maxSize, 1))
+	}
+	if f.maxSize == 0 {
+		f.maxSize = max(DefaultFragmentMaxSize, f.minSize)
+	}
+	if f.minSize <= 0 || f.maxSize < f.minSize {
+		return nil, fmt.Errorf("tls_fragment: invalid segment sizes %d-%d", f.minSize, f.maxSize)
+	}
+	if f.delay < 0 {
+		return nil, fmt.Errorf("tls_fragment: invalid delay %s", f.delay)
+	}
+	return f, nil
+}
+
+// Fragment splits the ClientHello of the connections of c under opts. It
+// must be called before c is used.
+func (c *Config) Fragment(opts FragmentOptions) error {
+	f, err := newFragmenter(opts)
+	if err != nil {
+		return err
+	}
+	c.fragment = f
+	return nil
+}
+
+// fragmentConn splits its first write when it is a ClientHello
+type fragmentConn struct {
+	net.Conn
+	fragmenter *fragmenter
+	written    bool
+}
+
+func (c *fragmentConn) Write(b []byte) (int, error) {
+	if c.written {
+		return c.Conn.Write(b)
+	}
+	c.written = true
+	serverName := tf.IndexTLSServerName(b)
+	if serverName == nil {
+		return c.Conn.Write(b)
+	}
+	for i, segment := range c.fragmenter.split(b, serverName.Index+serverName.Length/2) {
+		if i > 0 && c.fragmenter.delay > 0 {
+			time.Sleep(c.fragmenter.delay)
+		}
+		if _, err := c.Conn.Write(segment); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// split cuts the ClientHello record at the start of b into segments of
+// random size, one cut falling at sniCut. Bytes after the record go with the
+// last segment.
+func (f *fragmenter) split(b []byte, sniCut int) [][]byte {
+	end := recordHeaderLen + int(binary.BigEndian.Uint16(b[3:5]))
+	start := 0
+	if f.records {
+		start = recordHeaderLen
+	}
+	cuts := []int{sniCut}
+	for cut := start + f.size(); cut < end; cut += f.size() {
+		cuts = append(cuts, cut)
+	}
+	slices.Sort(cuts)
+	cuts = slices.Compact(append(cuts, end))
+	var segments [][]byte
+	previous := start
+	for _, cut := range cuts {
+		if cut <= previous {
+			continue
+		}
+		if f.records {
+			// Each piece of the handshake message in a record of its own
+			record := make([]byte, recordHeaderLen, recordHeaderLen+cut-previous)
+			copy(record, b[:3])
+			binary.BigEndian.PutUint16(record[3:], uint16(cut-previous))
+			segments = append(segments, append(record, b[previous:cut]...))
+		} else {
+			segments = append(segments, b[previous:cut])
+		}
+		previous = cut
+	}
+	if end < len(b) {
+		last := len(segments) - 1
+		segments[last] = append(slices.Clip(segments[last]), b[end:]...)
+	}
+	return segments
+}
+
+// size returns a random segment size
+func (f *fragmenter) size() int {
+	return f.minSize + rand.IntN(f.maxSize-f.minSize+1)
+}
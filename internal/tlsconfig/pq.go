@@ -0,0 +1,97 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// Named groups are spelled out numerically so the table does not depend on
+// which of them the Go toolchain exports.
+const (
+	groupX25519Kyber768Draft00 tls.CurveID = 0x6399
+	groupX25519MLKEM768        tls.CurveID = 0x11ec
+)
+
+var namedGroups = map[string]tls.CurveID{
+	"x25519mlkem768":        groupX25519MLKEM768,
+	"x25519kyber768draft00": groupX25519Kyber768Draft00,
+	"x25519kyber768":        groupX25519Kyber768Draft00,
+	"x25519":                tls.X25519,
+	"p256":                  tls.CurveP256,
+	"p384":                  tls.CurveP384,
+	"p521":                  tls.CurveP521,
+}
+
+// postQuantumGroups are hybrid groups tried first when PreferPostQuantum is set
+var postQuantumGroups = []tls.CurveID{groupX25519MLKEM768, groupX25519Kyber768Draft00}
+
+func isPostQuantum(id tls.CurveID) bool {
+	for _, pq := range postQuantumGroups {
+		if id == pq {
+			return true
+		}
+	}
+	return false
+}
+
+// curvePreferences resolves the key exchange options into an ordered list of
+// groups. It returns nil when the Go defaults should be kept.
+func (o Options) curvePreferences() ([]tls.CurveID, error) {
+	var groups []tls.CurveID
+	for _, name := range o.KeyExchange {
+		id, ok := namedGroups[strings.ToLower(strings.ReplaceAll(name, "_", ""))]
+		if !ok {
+			return nil, fmt.Errorf("unknown key exchange group: %s", name)
+		}
+		groups = append(groups, id)
+	}
+	if !o.PreferPostQuantum {
+		return groups, nil
+	}
+	if len(groups) == 0 {
+		groups = []tls.CurveID{tls.X25519, tls.CurveP256}
+	}
+	// Move hybrid groups to the front, adding them if they were not listed
+	preferred := append([]tls.CurveID(nil), postQuantumGroups...)
+	for _, id := range groups {
+		if !isPostQuantum(id) {
+			preferred = append(preferred, id)
+		}
+	}
+	return preferred, nil
+}
+
+// validateKeyExchange checks the key exchange options before the client is
+// created. They only apply to Go crypto/tls: uTLS, and so REALITY, sends the
+// key shares of its fingerprint.
+func (o Options) validateKeyExchange() error {
+	if len(o.KeyExchange) == 0 && !o.PreferPostQuantum {
+		return nil
+	}
+	if o.Reality != nil && o.Reality.Enabled {
+		return fmt.Errorf("key_exchange and prefer_post_quantum cannot be used with reality, which requires uTLS")
+	}
+	if o.UTLS != nil && o.UTLS.Enabled {
+		return fmt.Errorf("key_exchange and prefer_post_quantum cannot be used with uTLS; the fingerprint determines key shares")
+	}
+	_, err := o.curvePreferences()
+	return err
+}
+
+// applyKeyExchange configures the key exchange on a standard library config.
+// Hybrid groups only exist in TLS 1.3, so preferring them also raises the
+// minimum version.
+func (o Options) applyKeyExchange(config *tls.Config) error {
+	groups, err := o.curvePreferences()
+	if err != nil {
+		return err
+	}
+	if groups != nil {
+		config.CurvePreferences = groups
+	}
+	if o.PreferPostQuantum && config.MinVersion < tls.VersionTLS13 {
+		config.MinVersion = tls.VersionTLS13
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package tlsconfig
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/sagernet/sing-box/common/tls"
+	"github.com/sagernet/sing-box/log"
+	"github.com/sagernet/sing-box/option"
+
+	"github.com/UTPBox/utp-core/internal/state"
+)
+
+// ServerOptions defines the TLS configuration for an extension inbound. It
+// accepts the Sing-box inbound "tls" object, including "acme" for automatic
+// certificate issuance and renewal (HTTP-01, TLS-ALPN-01 or DNS-01).
+type ServerOptions struct {
+	option.InboundTLSOptions
+}
+
+// ServerConfig is a prepared server TLS configuration
+type ServerConfig struct {
+	config tls.ServerConfig
+}
+
+// NewServer prepares a server configuration. It returns nil when TLS is
+// disabled. ACME certificates are stored under <state dir>/acme unless a
+// data_directory is configured.
+func NewServer(ctx context.Context, logger log.Logger, opts ServerOptions) (*ServerConfig, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+	options := opts.InboundTLSOptions
+	if options.ACME != nil && len(options.ACME.Domain) > 0 {
+		acme := *options.ACME
+		if acme.DataDirectory == "" {
+			dir, err := state.Ensure("acme")
+			if err != nil {
+				return nil, err
+			}
+			acme.DataDirectory = dir
+		}
+		options.ACME = &acme
+	}
+	config, err := tls.NewServer(ctx, logger, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS server: %w", err)
+	}
+	return &ServerConfig{config: config}, nil
+}
+
+// Start begins certificate management (ACME issuance, file reloading)
+func (c *ServerConfig) Start() error {
+	return c.config.Start()
+}
+
+// Close stops certificate management
+func (c *ServerConfig) Close() error {
+	return c.config.Close()
+}
+
+// Handshake performs the server handshake over conn
+func (c *ServerConfig) Handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	tlsConn, err := tls.ServerHandshake(ctx, conn, c.config)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,149 @@
+// Package tlsconfig is the TLS layer shared by extension outbounds. It
+// accepts the same JSON as the Sing-box outbound "tls" object and adds
+// utp-core specific behaviour on top of it.
+package tlsconfig
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/sagernet/sing-box/common/tls"
+	"github.com/sagernet/sing-box/option"
+)
+
+// DefaultFingerprint is the uTLS fingerprint used when no uTLS configuration
+// is given. Builds without uTLS (the with_utls tag) use Go crypto/tls instead,
+// except for REALITY which requires uTLS.
+const DefaultFingerprint = "chrome"
+
+// Fingerprints are the ClientHello fingerprints accepted by utls.fingerprint
+var Fingerprints = []string{"chrome", "firefox", "edge", "safari", "360", "qq", "ios", "android", "random", "randomized"}
+
+// Options defines the TLS configuration for an extension outbound
+type Options struct {
+	option.OutboundTLSOptions
+
+	// KeyExchange lists the named groups offered, in order of preference,
+	// e.g. ["x25519mlkem768", "x25519"]. Empty keeps the Go defaults.
+	KeyExchange []string `json:"key_exchange,omitempty"`
+	// PreferPostQuantum puts the X25519MLKEM768 and X25519Kyber768 hybrids
+	// first and requires TLS 1.3.
+	PreferPostQuantum bool `json:"prefer_post_quantum,omitempty"`
+	// PinSHA256 lists SPKI SHA-256 pins (base64 or hex). The handshake fails
+	// unless a certificate in the peer chain matches one of them. Combined
+	// with insecure, pins replace chain verification for self-signed servers.
+	PinSHA256 []string `json:"pin_sha256,omitempty"`
+}
+
+// Config is a prepared client TLS configuration
+type Config struct {
+	config   tls.Config
+	pins     [][]byte
+	fragment *fragmenter // nil unless the ClientHello is split
+}
+
+// New prepares a client configuration for serverAddress. It returns nil
+// when TLS is disabled. Without a utls object the ClientHello mimics
+// DefaultFingerprint, so extension connections are not identifiable as Go
+// crypto/tls; "utls": {"enabled": false} opts out.
+func New(ctx context.Context, serverAddress string, opts Options) (*Config, error) {
+	if !opts.Enabled {
+		return nil, nil
+	}
+	options := opts.OutboundTLSOptions
+	if options.Fragment || options.RecordFragment {
+		// Sing-box applies them in its own dialer, which extensions bypass
+		return nil, fmt.Errorf("tls.fragment and tls.record_fragment are not supported, use tls_fragment of the outbound instead")
+	}
+	if err := opts.validateKeyExchange(); err != nil {
+		return nil, err
+	}
+	pins, err := parsePins(opts.PinSHA256)
+	if err != nil {
+		return nil, err
+	}
+	if options.Reality != nil && options.Reality.Enabled {
+		if err := validateReality(options); err != nil {
+			return nil, err
+		}
+		if len(pins) > 0 {
+			return nil, fmt.Errorf("reality: pin_sha256 is not supported, the server is authenticated by public_key")
+		}
+		// REALITY rides on uTLS; pick a browser fingerprint if none was given
+		if options.UTLS == nil || !options.UTLS.Enabled {
+			options.UTLS = &option.OutboundUTLSOptions{
+				Enabled:     true,
+				Fingerprint: DefaultFingerprint,
+			}
+		}
+	} else if options.UTLS == nil && utlsAvailable && len(opts.KeyExchange) == 0 && !opts.PreferPostQuantum {
+		options.UTLS = &option.OutboundUTLSOptions{
+			Enabled:     true,
+			Fingerprint: DefaultFingerprint,
+		}
+	}
+	if options.UTLS != nil && options.UTLS.Enabled && options.UTLS.Fingerprint != "" &&
+		!slices.Contains(Fingerprints, options.UTLS.Fingerprint) {
+		return nil, fmt.Errorf("unknown uTLS fingerprint %q, expected one of %s", options.UTLS.Fingerprint, strings.Join(Fingerprints, ", "))
+	}
+	config, err := tls.NewClient(ctx, serverAddress, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create TLS client: %w", err)
+	}
+	if len(opts.KeyExchange) > 0 || opts.PreferPostQuantum {
+		stdConfig, err := config.Config()
+		if err != nil {
+			return nil, err
+		}
+		if err := opts.applyKeyExchange(stdConfig); err != nil {
+			return nil, err
+		}
+	}
+	return &Config{config: config, pins: pins}, nil
+}
+
+// Pinned reports whether the peer is authenticated by certificate pins
+func (c *Config) Pinned() bool {
+	return len(c.pins) > 0
+}
+
+// ServerName returns the SNI presented in the ClientHello
+func (c *Config) ServerName() string {
+	return c.config.ServerName()
+}
+
+// Handshake performs the client handshake over conn
+func (c *Config) Handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if c.fragment != nil {
+		conn = &fragmentConn{Conn: conn, fragmenter: c.fragment}
+	}
+	tlsConn, err := tls.ClientHandshake(ctx, conn, c.config)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.pins) > 0 {
+		if err := verifyPins(c.pins, tlsConn.ConnectionState().PeerCertificates); err != nil {
+			tlsConn.Close()
+			return nil, err
+		}
+	}
+	return tlsConn, nil
+}
+
+// validateReality checks the REALITY parameters. The server_name selects the
+// target site whose certificate the REALITY server borrows.
+func validateReality(options option.OutboundTLSOptions) error {
+	if options.ServerName == "" {
+		return fmt.Errorf("reality: server_name is required")
+	}
+	if options.Reality.PublicKey == "" {
+		return fmt.Errorf("reality: public_key is required")
+	}
+	if len(options.Reality.ShortID) > 16 || len(options.Reality.ShortID)%2 != 0 {
+		return fmt.Errorf("reality: short_id must be an even-length hex string of at most 16 characters")
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build with_utls
+
+package tlsconfig
+
+// utlsAvailable reports whether the build includes uTLS, which extension
+// connections then use by default
+const utlsAvailable = true
@@ -0,0 +1,5 @@
+//go:build !with_utls
+
+package tlsconfig
+
+const utlsAvailable = false